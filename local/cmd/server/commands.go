@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/crypto"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+	"github.com/mahdi/dns-proxy-local/internal/recorder"
+	"github.com/mahdi/dns-proxy-local/internal/server"
+	"github.com/mahdi/dns-proxy-local/internal/service"
+	"github.com/mahdi/dns-proxy-local/internal/setup"
+	"github.com/mahdi/dns-proxy-local/internal/sysdns"
+)
+
+const redacted = "REDACTED"
+
+// runServer loads the configuration and serves DNS until shutdown, under
+// the Windows service manager when it started the process
+func runServer(args []string) error {
+	fs, cf := newFlagSet("run")
+	setDNS := fs.Bool("set-system-dns", false, "Point the system resolver at the server while it runs")
+	dnsState := fs.String("system-dns-state", "", "File recording the replaced system DNS settings (default system-dns-state.json beside the config)")
+	fs.Parse(args)
+
+	stateFile := ""
+	if *setDNS {
+		stateFile = *dnsState
+		if stateFile == "" {
+			stateFile = filepath.Join(filepath.Dir(cf.path), "system-dns-state.json")
+		}
+	}
+	if service.Managed() {
+		return service.Run(func(stop <-chan struct{}, logs io.Writer) error {
+			return serve(cf, stateFile, stop, logs)
+		})
+	}
+	return serve(cf, stateFile, nil, os.Stdout)
+}
+
+// serve runs the server until shutdown or until stop is closed. It logs to
+// logs unless logging.output_file is set. With a dnsState file the system
+// resolver points at the server while it runs.
+func serve(cf *configFlags, dnsState string, stop <-chan struct{}, logs io.Writer) error {
+	// Load configuration
+	cfg, err := cf.load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Create logger
+	logger, logCloser, err := logging.NewTo(cfg.Logging, logs)
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %w", err)
+	}
+	defer logCloser.Close()
+
+	// Create API client for the startup profile
+	active, err := cfg.WithProfile(cfg.Profile)
+	if err != nil {
+		return err
+	}
+	clientLogger := logger.With("component", "client")
+	apiClient, err := newAPIClient(active, clientLogger)
+	if err != nil {
+		return err
+	}
+
+	// Create and run server
+	srv, err := server.New(cfg, apiClient, logger.With("component", "server"))
+	if err != nil {
+		logger.Error("failed to create server", "error", err)
+		logCloser.Close()
+		os.Exit(1)
+	}
+	srv.EnableProfiles(func(cfg *config.Config) (server.APIClient, error) {
+		return newAPIClient(cfg, clientLogger)
+	})
+	srv.EnableReload(cf.load)
+	if stop != nil {
+		go func() {
+			<-stop
+			srv.Stop()
+		}()
+	}
+	if dnsState != "" {
+		addr, err := systemDNSAddr(cfg)
+		if err != nil {
+			return err
+		}
+		if err := sysdns.Point(addr, dnsState); err != nil {
+			return fmt.Errorf("failed to set system DNS: %w", err)
+		}
+		logger.Info("system DNS pointed at the server", "addr", addr, "state", dnsState)
+		if len(cfg.API.Bootstrap.Servers) == 0 && len(cfg.API.Bootstrap.Hosts) == 0 {
+			logger.Warn("endpoint hostnames now resolve through the server itself; set api.bootstrap unless the endpoints are IP addresses")
+		}
+	}
+	err = srv.Run()
+	if dnsState != "" {
+		if err := sysdns.Restore(dnsState); err != nil {
+			logger.Error("failed to restore system DNS", "error", err, "state", dnsState)
+		} else {
+			logger.Info("system DNS restored")
+		}
+	}
+	if err != nil {
+		logger.Error("server error", "error", err)
+		logCloser.Close()
+		os.Exit(1)
+	}
+	return nil
+}
+
+// systemDNSAddr returns the address the system resolver reaches the server
+// at, which must be on port 53 over UDP
+func systemDNSAddr(cfg *config.Config) (string, error) {
+	if cfg.Server.Port != 53 || cfg.Server.Protocol == "tcp" {
+		return "", fmt.Errorf("-set-system-dns needs the server on UDP port 53")
+	}
+	switch host := cfg.Server.Addresses()[0]; host {
+	case "0.0.0.0", "::":
+		return "127.0.0.1", nil
+	default:
+		return host, nil
+	}
+}
+
+// newAPIClient creates the API client, with the cipher if encryption is enabled
+func newAPIClient(cfg *config.Config, logger *slog.Logger) (*client.Client, error) {
+	var cipher *crypto.Cipher
+	if cfg.Security.EncryptionEnabled {
+		var err error
+		cipher, err = crypto.NewSuiteCipher(cfg.Security.CipherSuite, cfg.Security.EncryptionKeyID, cfg.Security.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher: %w", err)
+		}
+	}
+	c := client.NewClient(cfg.API, cipher, logger)
+	c.EnablePadding(crypto.Padding{
+		Mode:      cfg.Security.Padding.Mode,
+		BlockSize: cfg.Security.Padding.BlockSize,
+		MaxRandom: cfg.Security.Padding.MaxRandom,
+	})
+	if cfg.Security.Sessions.Enabled {
+		c.EnableSessions()
+	}
+	return c, nil
+}
+
+// runSetup runs the interactive first-run wizard
+func runSetup(args []string) error {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to write the configuration file")
+	fs.Parse(args)
+
+	if err := setup.NewWizard(os.Stdin, os.Stdout).Run(*configPath); err != nil {
+		return fmt.Errorf("setup failed: %w", err)
+	}
+	return nil
+}
+
+// runService installs, controls or removes the boot-time service
+func runService(args []string) error {
+	const usage = "usage: service install|start|stop|uninstall [-config file]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Configuration file the service runs with (install)")
+	fs.Parse(args[1:])
+
+	var err error
+	switch action {
+	case "install":
+		// A service that can't start would just keep restarting
+		if _, err := config.Load(*configPath); err != nil {
+			return err
+		}
+		err = service.Install(*configPath)
+	case "start":
+		err = service.Start()
+	case "stop":
+		err = service.Stop()
+	case "uninstall":
+		err = service.Uninstall()
+	default:
+		return fmt.Errorf(usage)
+	}
+	if err != nil {
+		return fmt.Errorf("service %s: %w", action, err)
+	}
+	fmt.Printf("service %s: ok\n", action)
+	return nil
+}
+
+// runKeygen prints a new encryption key
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Parse(args)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// runCheck validates the configuration and prints the effective settings
+func runCheck(args []string) error {
+	fs, cf := newFlagSet("check")
+	showSecrets := fs.Bool("show-secrets", false, "Print API keys and encryption keys instead of redacting them")
+	fs.Parse(args)
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+
+	if !*showSecrets {
+		redactEndpoints(cfg.API.Endpoints)
+		for _, p := range cfg.Profiles {
+			redactEndpoints(p.Endpoints)
+		}
+		if cfg.Security.EncryptionKey != "" {
+			cfg.Security.EncryptionKey = redacted
+		}
+		if cfg.QueryLog.HashSalt != "" {
+			cfg.QueryLog.HashSalt = redacted
+		}
+		if cfg.Report.Email.Password != "" {
+			cfg.Report.Email.Password = redacted
+		}
+	}
+
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: configuration is valid\n", cf.path)
+	os.Stdout.Write(out)
+	return nil
+}
+
+// redactEndpoints hides the endpoints' credentials
+func redactEndpoints(endpoints []config.EndpointConfig) {
+	for i := range endpoints {
+		endpoints[i].APIKey = redacted
+		if endpoints[i].SigningSecret != "" {
+			endpoints[i].SigningSecret = redacted
+		}
+		if u, err := url.Parse(endpoints[i].Proxy); err == nil && u.User != nil {
+			u.User = url.UserPassword(redacted, redacted)
+			endpoints[i].Proxy = u.String()
+		}
+	}
+}
+
+// runQuery resolves one name through the configured API endpoints
+func runQuery(args []string) error {
+	fs, cf := newFlagSet("query")
+	profile := fs.String("profile", "", "Profile whose endpoints to use (default: profile from the config)")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("usage: query [-config file] [-profile name] <domain> [type]")
+	}
+	domain := strings.TrimSuffix(fs.Arg(0), ".")
+	recordType := "A"
+	if fs.NArg() == 2 {
+		recordType = strings.ToUpper(fs.Arg(1))
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if *profile == "" {
+		*profile = cfg.Profile
+	}
+	if cfg, err = cfg.WithProfile(*profile); err != nil {
+		return err
+	}
+
+	apiClient, err := newAPIClient(cfg, logging.Discard())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.API.MaxRetries+1)*cfg.API.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	result, err := apiClient.Resolve(ctx, domain, recordType)
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf("%s: %s", domain, result.Error)
+	}
+	for _, rec := range result.Records {
+		fmt.Printf("%s\t%d\t%s\t%s\n", rec.Name, rec.TTL, rec.Type, rec.Value)
+	}
+	fmt.Fprintf(os.Stderr, ";; %d records in %s (cached on remote: %t)\n", len(result.Records), time.Since(start).Round(time.Millisecond), result.Cached)
+	return nil
+}
+
+// runReplay feeds a recording made with record.enabled back through the
+// local pipeline (cache, post-processing, record conversion) without
+// contacting the remote API
+func runReplay(args []string) error {
+	fs, cf := newFlagSet("replay")
+	file := fs.String("file", "", "Recording to replay (default: record.file from the config)")
+	useCache := fs.Bool("cache", false, "Keep the cache enabled, so repeated questions may be answered from it")
+	verbose := fs.Bool("v", false, "Log the pipeline at debug level to stderr")
+	fs.Parse(args)
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		*file = cfg.Record.File
+	}
+	// Replay with the startup profile's rules, without switching
+	if cfg, err = cfg.WithProfile(cfg.Profile); err != nil {
+		return err
+	}
+	cfg.Profile, cfg.Profiles = "", nil
+
+	replayer, err := recorder.Load(*file)
+	if err != nil {
+		return err
+	}
+
+	// Only the API exchange is replayed; everything with side effects or
+	// network access is switched off
+	cfg.Record.Enabled = false
+	cfg.Fallback.Enabled = false
+	cfg.QueryLog.Enabled = false
+	cfg.Dnstap.Enabled = false
+	cfg.Anomaly.Enabled = false
+	cfg.Obfuscation.Enabled = false
+	cfg.Cache.Prefetch.Enabled = false
+	cfg.Server.AllowedNetworks = nil
+	cfg.Cache.Enabled = *useCache
+
+	logger := logging.Discard()
+	if *verbose {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	srv, err := server.New(cfg, replayer, logger)
+	if err != nil {
+		return err
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53535}
+	for _, e := range replayer.Exchanges() {
+		qtype, ok := dns.StringToType[strings.ToUpper(e.Type)]
+		if !ok {
+			fmt.Printf("%s %s: unknown type, skipped\n", e.Domain, e.Type)
+			continue
+		}
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(e.Domain), qtype)
+
+		recorded := "error: " + e.Error
+		if e.Error == "" && e.Response != nil {
+			recorded = fmt.Sprintf("%d records", len(e.Response.Records))
+			if e.Response.Error != "" {
+				recorded = "api error: " + e.Response.Error
+			}
+		}
+
+		resp := srv.Exchange(r, client)
+		if resp == nil {
+			fmt.Printf("%s %s\trecorded: %s\treplayed: no reply\n", e.Domain, e.Type, recorded)
+			continue
+		}
+		fmt.Printf("%s %s\trecorded: %s\treplayed: %s, %d answers\n", e.Domain, e.Type, recorded, dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		for _, rr := range resp.Answer {
+			fmt.Printf("\t%s\n", rr.String())
+		}
+	}
+	return nil
+}
+
+// runProfile shows or switches the active profile of a running server
+// through its admin interface
+func runProfile(args []string) error {
+	fs, cf := newFlagSet("profile")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: profile [-config file] [name]")
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if !cfg.Admin.Enabled {
+		return fmt.Errorf("admin interface is not enabled (admin.enabled)")
+	}
+
+	adminURL := "http://" + cfg.Admin.ListenAddr + "/profile"
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	method, body := http.MethodGet, io.Reader(nil)
+	if fs.NArg() == 1 {
+		name, _ := json.Marshal(map[string]string{"name": fs.Arg(0)})
+		method, body = http.MethodPut, bytes.NewReader(name)
+	}
+	req, err := http.NewRequest(method, adminURL, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.Admin.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Admin.Token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("admin interface: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("admin interface: %s", strings.TrimSpace(string(msg)))
+	}
+	var status server.ProfileStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("admin interface: %w", err)
+	}
+	for _, name := range status.Profiles {
+		marker := " "
+		if name == status.Active {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\n", marker, name)
+	}
+	return nil
+}
@@ -2,41 +2,81 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 
-	"github.com/mahdi/dns-proxy-local/internal/client"
 	"github.com/mahdi/dns-proxy-local/internal/config"
-	"github.com/mahdi/dns-proxy-local/internal/crypto"
-	"github.com/mahdi/dns-proxy-local/internal/server"
 )
 
+const usage = `Usage: dns-local [command] [flags]
+
+Commands:
+  run       Start the local DNS server (default)
+  setup     Interactive first-run configuration wizard
+  keygen    Generate a random 32-byte encryption key
+  check     Validate a configuration file and print it with defaults applied
+  query     Resolve a name through the configured API endpoints: query example.com [A]
+  replay    Run recorded API exchanges (record.enabled) back through the pipeline offline
+  profile   Show or switch the active profile of the running server: profile [name]
+  service   Run at boot as a systemd, launchd or Windows service: service install|start|stop|uninstall
+
+Run "dns-local <command> -h" for command flags.
+`
+
 func main() {
-	configPath := flag.String("config", "config.yaml", "Path to configuration file")
-	flag.Parse()
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		command, args = args[0], args[1:]
+	}
 
-	// Load configuration
-	cfg, err := config.Load(*configPath)
+	var err error
+	switch command {
+	case "run":
+		err = runServer(args)
+	case "setup":
+		err = runSetup(args)
+	case "keygen":
+		err = runKeygen(args)
+	case "check", "validate-config":
+		err = runCheck(args)
+	case "query":
+		err = runQuery(args)
+	case "replay":
+		err = runReplay(args)
+	case "profile":
+		err = runProfile(args)
+	case "service":
+		err = runService(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		log.Fatal(err)
 	}
+}
 
-	// Create cipher if encryption is enabled
-	var cipher *crypto.Cipher
-	if cfg.Security.EncryptionEnabled {
-		cipher, err = crypto.NewCipher(cfg.Security.EncryptionKey)
-		if err != nil {
-			log.Fatalf("Failed to create cipher: %v", err)
-		}
-	}
+// configFlags holds the shared flags that locate and override the config
+type configFlags struct {
+	path string
+	set  config.Overrides
+}
 
-	// Create API client
-	apiClient := client.NewClient(cfg.API, cipher)
+// load reads the config file with DNS_PROXY_* environment variables and
+// -set flags applied on top, in that order
+func (c *configFlags) load() (*config.Config, error) {
+	return config.Load(c.path, c.set...)
+}
 
-	// Create and run server
-	srv := server.New(cfg, apiClient)
-	if err := srv.Run(); err != nil {
-		log.Printf("Server error: %v", err)
-		os.Exit(1)
-	}
+// newFlagSet returns a flag set with the shared -config and -set flags
+func newFlagSet(name string) (*flag.FlagSet, *configFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	cf := &configFlags{}
+	fs.StringVar(&cf.path, "config", "config.yaml", "Path to configuration file")
+	fs.Var(&cf.set, "set", "Override a config value, e.g. -set server.port=9443 (repeatable)")
+	return fs, cf
 }
@@ -0,0 +1,204 @@
+package anomaly
+
+import (
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// minLabelLen is the shortest label considered for the entropy heuristic;
+// short labels never carry enough characters to look random
+const minLabelLen = 10
+
+// Reason explains why a client was flagged
+type Reason string
+
+const (
+	ReasonDGA            Reason = "dga"
+	ReasonSubdomainFlood Reason = "subdomain_flood"
+)
+
+// Detector flags clients whose queries look like domain generation
+// algorithms (many random-looking names) or subdomain floods (many distinct
+// names under one parent, typical of DNS tunneling), and can throttle them.
+type Detector struct {
+	cfg    config.AnomalyConfig
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	clients map[string]*window
+	flagged int64
+}
+
+// window holds one client's counters for the current observation window
+type window struct {
+	start      time.Time
+	queries    int
+	random     int
+	subdomains map[string]map[string]struct{} // parent -> distinct names
+	blockUntil time.Time
+	lastAlert  time.Time
+}
+
+// New creates a detector, or returns nil if anomaly detection is disabled
+func New(cfg config.AnomalyConfig, logger *slog.Logger) *Detector {
+	if !cfg.Enabled {
+		return nil
+	}
+	d := &Detector{
+		cfg:     cfg,
+		logger:  logger,
+		clients: make(map[string]*window),
+	}
+	go d.cleanup()
+	return d
+}
+
+// Observe records a query from client and reports whether the client is
+// currently throttled. It is safe to call on a nil Detector.
+func (d *Detector) Observe(client, qname string) bool {
+	if d == nil {
+		return false
+	}
+	now := time.Now()
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w, ok := d.clients[client]
+	if !ok || now.Sub(w.start) > d.cfg.Window {
+		blockUntil := time.Time{}
+		lastAlert := time.Time{}
+		if ok {
+			blockUntil, lastAlert = w.blockUntil, w.lastAlert
+		}
+		w = &window{
+			start:      now,
+			subdomains: make(map[string]map[string]struct{}),
+			blockUntil: blockUntil,
+			lastAlert:  lastAlert,
+		}
+		d.clients[client] = w
+	}
+
+	w.queries++
+	if looksRandom(name, d.cfg.EntropyThreshold) {
+		w.random++
+	}
+	if parent := parentDomain(name); parent != "" && parent != name {
+		names := w.subdomains[parent]
+		if names == nil {
+			names = make(map[string]struct{})
+			w.subdomains[parent] = names
+		}
+		// Stop growing once over the limit so a flood cannot exhaust memory
+		if len(names) <= d.cfg.SubdomainLimit {
+			names[name] = struct{}{}
+		}
+		if len(names) > d.cfg.SubdomainLimit {
+			d.flag(client, w, ReasonSubdomainFlood, now, "parent", parent, "distinct_names", len(names))
+		}
+	}
+	if w.queries >= d.cfg.MinQueries && float64(w.random)/float64(w.queries) >= d.cfg.DGARatio {
+		d.flag(client, w, ReasonDGA, now, "queries", w.queries, "random_looking", w.random)
+	}
+
+	return d.cfg.Throttle && now.Before(w.blockUntil)
+}
+
+// flag alerts about a client at most once per window and starts throttling
+// (must be called with lock held)
+func (d *Detector) flag(client string, w *window, reason Reason, now time.Time, attrs ...any) {
+	if d.cfg.Throttle {
+		w.blockUntil = now.Add(d.cfg.ThrottleDuration)
+	}
+	if now.Sub(w.lastAlert) < d.cfg.Window {
+		return
+	}
+	w.lastAlert = now
+	d.flagged++
+	d.logger.Warn("anomalous query pattern",
+		append([]any{"client", client, "reason", string(reason), "throttled", d.cfg.Throttle}, attrs...)...)
+}
+
+// Stats returns detector statistics
+func (d *Detector) Stats() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	throttled := 0
+	now := time.Now()
+	for _, w := range d.clients {
+		if now.Before(w.blockUntil) {
+			throttled++
+		}
+	}
+	return map[string]interface{}{
+		"tracked_clients":   len(d.clients),
+		"alerts":            d.flagged,
+		"throttled_clients": throttled,
+	}
+}
+
+// cleanup drops clients that have been idle for a full window and are not
+// throttled
+func (d *Detector) cleanup() {
+	ticker := time.NewTicker(d.cfg.Window)
+	for range ticker.C {
+		now := time.Now()
+		d.mu.Lock()
+		for client, w := range d.clients {
+			if now.Sub(w.start) > 2*d.cfg.Window && now.After(w.blockUntil) {
+				delete(d.clients, client)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+// looksRandom reports whether the longest label of name has the character
+// entropy of generated rather than human-chosen text
+func looksRandom(name string, threshold float64) bool {
+	longest := ""
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > len(longest) {
+			longest = label
+		}
+	}
+	if len(longest) < minLabelLen {
+		return false
+	}
+	return entropy(longest) >= threshold
+}
+
+// entropy returns the Shannon entropy of s in bits per character
+func entropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	n := float64(len(s))
+	h := 0.0
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// parentDomain approximates the registered domain as the last two labels
+func parentDomain(name string) string {
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
@@ -0,0 +1,124 @@
+package anomaly
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func testConfig() config.AnomalyConfig {
+	return config.AnomalyConfig{
+		Enabled:          true,
+		Window:           time.Minute,
+		MinQueries:       10,
+		EntropyThreshold: 3.5,
+		DGARatio:         0.5,
+		SubdomainLimit:   20,
+		Throttle:         true,
+		ThrottleDuration: time.Minute,
+	}
+}
+
+func randomLabel(n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = chars[rand.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+func TestDetectDGA(t *testing.T) {
+	d := New(testConfig(), logging.Discard())
+
+	throttled := false
+	for i := 0; i < 20; i++ {
+		throttled = d.Observe("10.0.0.5", randomLabel(16)+".com.")
+	}
+	if !throttled {
+		t.Error("expected DGA-like client to be throttled")
+	}
+	if d.Observe("10.0.0.6", "www.google.com.") {
+		t.Error("other clients must not be throttled")
+	}
+}
+
+func TestDetectSubdomainFlood(t *testing.T) {
+	d := New(testConfig(), logging.Discard())
+
+	throttled := false
+	for i := 0; i < 30; i++ {
+		throttled = d.Observe("10.0.0.7", fmt.Sprintf("chunk%d.tunnel.example.", i))
+	}
+	if !throttled {
+		t.Error("expected subdomain flood to be throttled")
+	}
+}
+
+func TestNormalTraffic(t *testing.T) {
+	d := New(testConfig(), logging.Discard())
+
+	names := []string{"www.google.com.", "mail.google.com.", "github.com.", "api.github.com.",
+		"cdn.jsdelivr.net.", "fonts.googleapis.com.", "www.wikipedia.org.", "news.ycombinator.com."}
+	for i := 0; i < 50; i++ {
+		if d.Observe("10.0.0.8", names[i%len(names)]) {
+			t.Fatalf("normal traffic throttled after %d queries", i+1)
+		}
+	}
+}
+
+func TestNilDetector(t *testing.T) {
+	var d *Detector
+	if d.Observe("10.0.0.1", "example.com.") {
+		t.Error("nil detector must not throttle")
+	}
+}
+
+func TestValidator(t *testing.T) {
+	cfg := config.QueryValidationConfig{
+		Enabled:          true,
+		Action:           "reject",
+		MaxNameLength:    60,
+		MaxLabelLength:   30,
+		EntropyThreshold: 4.0,
+		EntropyMinLength: 20,
+	}
+	v := NewValidator(cfg, logging.Discard())
+
+	tests := []struct {
+		name string
+		want Violation
+	}{
+		{"www.example.com.", ""},
+		{"_dmarc.Example.COM.", ""},
+		{".", ""},
+		{"internationalization-localization.example.com.", ViolationLabelLength},
+		{strings.Repeat("abc.", 16) + "com.", ViolationNameLength},
+		{`bad\032name.example.com.`, ViolationCharacters},
+		{"under score.example.com.", ViolationCharacters},
+		{"q3v9x2m8k1z7w4p0r6t5.example.com.", ViolationEntropy},
+		{"aaaaaaaaaaaaaaaaaaaaaaaa.example.com.", ""},
+	}
+	for _, tt := range tests {
+		got, reject := v.Check("10.0.0.5", tt.name)
+		if got != tt.want || reject != (tt.want != "") {
+			t.Errorf("%q: violation %q (reject %v), want %q", tt.name, got, reject, tt.want)
+		}
+	}
+	if n := v.Stats()["invalid"].(int64); n != 5 {
+		t.Errorf("invalid = %d, want 5", n)
+	}
+
+	cfg.Action = "flag"
+	if got, reject := NewValidator(cfg, logging.Discard()).Check("10.0.0.5", "q3v9x2m8k1z7w4p0r6t5.example.com."); got != ViolationEntropy || reject {
+		t.Errorf("flag action: violation %q, reject %v; want counted, not rejected", got, reject)
+	}
+	if got, reject := (*Validator)(nil).Check("10.0.0.5", "anything."); got != "" || reject {
+		t.Error("nil validator should accept everything")
+	}
+}
@@ -0,0 +1,112 @@
+package anomaly
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// Violation names the check a query name failed
+type Violation string
+
+const (
+	ViolationNameLength  Violation = "name_too_long"
+	ViolationLabelLength Violation = "label_too_long"
+	ViolationCharacters  Violation = "invalid_characters"
+	ViolationEntropy     Violation = "high_entropy"
+)
+
+// Validator checks each query name at the listener, before it can use
+// tunnel quota: overlong names and labels, characters outside hostname
+// syntax, and labels random enough to be data smuggled in DNS rather than
+// a name. Unlike the Detector it judges single queries, not clients.
+type Validator struct {
+	cfg    config.QueryValidationConfig
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	counts map[Violation]int64
+}
+
+// NewValidator creates a validator, or returns nil if validation is disabled
+func NewValidator(cfg config.QueryValidationConfig, logger *slog.Logger) *Validator {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Validator{cfg: cfg, logger: logger, counts: make(map[Violation]int64)}
+}
+
+// Check returns the first check qname fails, if any, and whether the query
+// must be rejected rather than only counted. It is safe to call on a nil
+// Validator.
+func (v *Validator) Check(client, qname string) (Violation, bool) {
+	if v == nil {
+		return "", false
+	}
+	violation := v.violation(strings.TrimSuffix(qname, "."))
+	if violation == "" {
+		return "", false
+	}
+
+	v.mu.Lock()
+	v.counts[violation]++
+	v.mu.Unlock()
+
+	reject := v.cfg.Action == "reject"
+	v.logger.Debug("invalid query name", "client", client, "name", qname, "violation", string(violation), "rejected", reject)
+	return violation, reject
+}
+
+func (v *Validator) violation(name string) Violation {
+	if len(name) > v.cfg.MaxNameLength {
+		return ViolationNameLength
+	}
+	if name == "" {
+		return "" // the root
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > v.cfg.MaxLabelLength {
+			return ViolationLabelLength
+		}
+		if !hostnameLabel(label) {
+			return ViolationCharacters
+		}
+		if v.cfg.EntropyThreshold > 0 && len(label) >= v.cfg.EntropyMinLength && entropy(strings.ToLower(label)) >= v.cfg.EntropyThreshold {
+			return ViolationEntropy
+		}
+	}
+	return ""
+}
+
+// hostnameLabel reports whether label only has letters, digits, hyphens and
+// underscores (service labels such as _dmarc). Other bytes arrive escaped
+// (\DDD or \.) in names parsed from the wire, so the backslash is caught too.
+func hostnameLabel(label string) bool {
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Stats returns the number of queries that failed each check
+func (v *Validator) Stats() map[string]interface{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	violations := make(map[string]int64, len(v.counts))
+	var total int64
+	for violation, n := range v.counts {
+		violations[string(violation)] = n
+		total += n
+	}
+	return map[string]interface{}{
+		"action":     v.cfg.Action,
+		"invalid":    total,
+		"violations": violations,
+	}
+}
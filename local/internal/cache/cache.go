@@ -1,37 +1,100 @@
 package cache
 
 import (
+	"container/list"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	// maxShards is the shard count for large caches
+	maxShards = 256
+	// minShardItems keeps small caches from being split into tiny shards
+	// whose LRU order would be meaningless
+	minShardItems = 16
+	// staleTTL is the TTL of answers served past their expiry (RFC 8767)
+	staleTTL = 30
+)
+
 // Entry represents a cached DNS response
 type Entry struct {
 	Msg       *dns.Msg
 	ExpiresAt time.Time
 	CreatedAt time.Time
+
+	key         string
+	question    *dns.Question
+	hits        atomic.Int64
+	used        atomic.Int64 // last stored or hit, in Unix nanoseconds
+	prefetching atomic.Bool
+}
+
+// shard is one LRU partition of the cache with its own lock
+type shard struct {
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	lru      *list.List // front is most recently used
+	maxItems int
 }
 
-// Cache is a thread-safe DNS response cache
+// Cache is a thread-safe DNS response cache. Keys are spread over
+// independently locked LRU shards so concurrent queries rarely contend and
+// eviction is O(1).
 type Cache struct {
-	items      map[string]*Entry
-	mu         sync.RWMutex
-	maxItems   int
+	shards     []*shard
 	defaultTTL time.Duration
 	minTTL     time.Duration
 	maxTTL     time.Duration
+	negTTL     time.Duration // cap on negative entries; 0 for none
+	retain     time.Duration // how long expired entries are kept for Lookup
+	prefetch   *prefetcher
+	stop       chan struct{}
+	stopOnce   sync.Once
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+	stale     atomic.Int64
+}
+
+// Stats holds cache counters
+type Stats struct {
+	Size       int   `json:"size"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Evictions  int64 `json:"evictions"`
+	Prefetches int64 `json:"prefetches"`
+	Stale      int64 `json:"stale"` // hits served past the entry's expiry
 }
 
 // New creates a new DNS cache
 func New(maxItems int, defaultTTL, minTTL, maxTTL time.Duration) *Cache {
+	n := maxShards
+	for n > 1 && maxItems/n < minShardItems {
+		n /= 2
+	}
+	perShard := (maxItems + n - 1) / n
+	if perShard < 1 {
+		perShard = 1
+	}
+
 	c := &Cache{
-		items:      make(map[string]*Entry),
-		maxItems:   maxItems,
+		shards:     make([]*shard, n),
 		defaultTTL: defaultTTL,
 		minTTL:     minTTL,
 		maxTTL:     maxTTL,
+		stop:       make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			items:    make(map[string]*list.Element),
+			lru:      list.New(),
+			maxItems: perShard,
+		}
 	}
 
 	// Start cleanup goroutine
@@ -45,28 +108,83 @@ func Key(q dns.Question) string {
 	return q.Name + ":" + dns.TypeToString[q.Qtype]
 }
 
+func (c *Cache) shardFor(key string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// Freshness relaxes when an entry still answers, trading freshness for
+// fewer API requests
+type Freshness struct {
+	Stretch float64       // entries stay fresh for this many times their TTL; 1 or less for their TTL
+	Stale   time.Duration // and are then served stale for this long
+}
+
 // Get retrieves a cached DNS response
 func (c *Cache) Get(key string) (*dns.Msg, bool) {
-	c.mu.RLock()
-	entry, ok := c.items[key]
-	c.mu.RUnlock()
+	return c.get(key, true, Freshness{})
+}
+
+// Peek is Get without prefetching: the hit never leads to an API request
+func (c *Cache) Peek(key string) (*dns.Msg, bool) {
+	return c.get(key, false, Freshness{})
+}
+
+// Lookup is Peek with relaxed freshness. Entries past their expiry are
+// only kept as long as RetainExpired allows; their answers get a short TTL.
+func (c *Cache) Lookup(key string, f Freshness) (*dns.Msg, bool) {
+	return c.get(key, false, f)
+}
+
+func (c *Cache) get(key string, prefetch bool, f Freshness) (*dns.Msg, bool) {
+	s := c.shardFor(key)
+	now := time.Now()
 
+	s.mu.Lock()
+	elem, ok := s.items[key]
 	if !ok {
+		s.mu.Unlock()
+		c.misses.Add(1)
 		return nil, false
 	}
-
-	if time.Now().After(entry.ExpiresAt) {
-		c.mu.Lock()
-		delete(c.items, key)
-		c.mu.Unlock()
+	entry := elem.Value.(*Entry)
+	if now.After(entry.ExpiresAt.Add(c.retain)) {
+		s.remove(elem)
+		s.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+	if now.After(entry.servedUntil(f, c.retain)) {
+		s.mu.Unlock()
+		c.misses.Add(1)
 		return nil, false
 	}
+	s.lru.MoveToFront(elem)
+	s.mu.Unlock()
+
+	c.hits.Add(1)
+	entry.hits.Add(1)
+	entry.used.Store(now.UnixNano())
+	if prefetch {
+		c.maybePrefetch(entry, now)
+	}
 
 	// Return a copy of the message
 	msg := entry.Msg.Copy()
 
 	// Adjust TTLs based on elapsed time
-	elapsed := uint32(time.Since(entry.CreatedAt).Seconds())
+	if now.After(entry.ExpiresAt) {
+		c.stale.Add(1)
+		for _, rr := range msg.Answer {
+			rr.Header().Ttl = min(rr.Header().Ttl, staleTTL)
+		}
+		return msg, true
+	}
+	elapsed := uint32(now.Sub(entry.CreatedAt).Seconds())
 	for _, rr := range msg.Answer {
 		if rr.Header().Ttl > elapsed {
 			rr.Header().Ttl -= elapsed
@@ -78,13 +196,33 @@ func (c *Cache) Get(key string) (*dns.Msg, bool) {
 	return msg, true
 }
 
+// servedUntil returns when the entry stops answering under f, at most
+// retain past its expiry
+func (e *Entry) servedUntil(f Freshness, retain time.Duration) time.Time {
+	until := e.ExpiresAt
+	if f.Stretch > 1 {
+		until = e.CreatedAt.Add(time.Duration(float64(e.ExpiresAt.Sub(e.CreatedAt)) * f.Stretch))
+	}
+	until = until.Add(f.Stale)
+	if limit := e.ExpiresAt.Add(retain); until.After(limit) {
+		until = limit
+	}
+	return until
+}
+
 // Set stores a DNS response in the cache
 func (c *Cache) Set(key string, msg *dns.Msg) {
 	if msg == nil || len(msg.Question) == 0 {
 		return
 	}
 
-	// Determine TTL from response
+	q := msg.Question[0]
+	c.store(key, msg, c.ttl(msg), &q)
+}
+
+// ttl returns how long to cache msg: its lowest answer TTL, or the default
+// TTL without answers, clamped to the cache's bounds
+func (c *Cache) ttl(msg *dns.Msg) time.Duration {
 	ttl := c.defaultTTL
 	if len(msg.Answer) > 0 {
 		minAnswerTTL := msg.Answer[0].Header().Ttl
@@ -103,78 +241,124 @@ func (c *Cache) Set(key string, msg *dns.Msg) {
 	if ttl > c.maxTTL {
 		ttl = c.maxTTL
 	}
+	return ttl
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// LimitNegative caps how long negative entries are kept. It must be called
+// before the cache is used.
+func (c *Cache) LimitNegative(maxTTL time.Duration) {
+	c.negTTL = maxTTL
+}
+
+// RetainExpired keeps entries for d past their expiry, so Lookup can still
+// serve them. It must be called before the cache is used.
+func (c *Cache) RetainExpired(d time.Duration) {
+	c.retain = d
+}
 
-	// Evict if at capacity
-	if len(c.items) >= c.maxItems {
-		c.evictOldest()
+// SetNegative stores a negative (NXDOMAIN or no data) cache entry for ttl,
+// at most the negative limit
+func (c *Cache) SetNegative(key string, msg *dns.Msg, ttl time.Duration) {
+	if c.negTTL > 0 && ttl > c.negTTL {
+		ttl = c.negTTL
 	}
+	c.store(key, msg, ttl, nil)
+}
 
-	c.items[key] = &Entry{
+func (c *Cache) store(key string, msg *dns.Msg, ttl time.Duration, q *dns.Question) {
+	now := time.Now()
+	entry := &Entry{
 		Msg:       msg.Copy(),
-		ExpiresAt: time.Now().Add(ttl),
-		CreatedAt: time.Now(),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+		key:       key,
+		question:  q,
 	}
-}
+	entry.used.Store(now.UnixNano())
 
-// SetNegative stores a negative (NXDOMAIN) cache entry
-func (c *Cache) SetNegative(key string, msg *dns.Msg, ttl time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(c.items) >= c.maxItems {
-		c.evictOldest()
+	if elem, ok := s.items[key]; ok {
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+		return
 	}
 
-	c.items[key] = &Entry{
-		Msg:       msg.Copy(),
-		ExpiresAt: time.Now().Add(ttl),
-		CreatedAt: time.Now(),
+	// Evict the least recently used entry if at capacity
+	if s.lru.Len() >= s.maxItems {
+		if oldest := s.lru.Back(); oldest != nil {
+			s.remove(oldest)
+			c.evictions.Add(1)
+		}
 	}
+
+	s.items[key] = s.lru.PushFront(entry)
 }
 
 // Len returns the number of items in the cache
 func (c *Cache) Len() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return len(c.items)
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Stats returns the cache size and hit/miss/eviction counters
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Size:       c.Len(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+		Prefetches: c.Prefetches(),
+		Stale:      c.stale.Load(),
+	}
 }
 
 // Clear removes all items from the cache
 func (c *Cache) Clear() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.items = make(map[string]*Entry)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[string]*list.Element)
+		s.lru.Init()
+		s.mu.Unlock()
+	}
 }
 
-func (c *Cache) evictOldest() {
-	var oldestKey string
-	var oldestTime time.Time
-
-	for key, entry := range c.items {
-		if oldestKey == "" || entry.ExpiresAt.Before(oldestTime) {
-			oldestKey = key
-			oldestTime = entry.ExpiresAt
-		}
-	}
+// remove deletes an element (must be called with the shard lock held)
+func (s *shard) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.items, elem.Value.(*Entry).key)
+}
 
-	if oldestKey != "" {
-		delete(c.items, oldestKey)
-	}
+// Close stops the cache's background cleanup. The cache stays usable.
+func (c *Cache) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
 }
 
 func (c *Cache) cleanup() {
 	ticker := time.NewTicker(time.Minute)
-	for range ticker.C {
-		c.mu.Lock()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
 		now := time.Now()
-		for key, entry := range c.items {
-			if now.After(entry.ExpiresAt) {
-				delete(c.items, key)
+		for _, s := range c.shards {
+			s.mu.Lock()
+			for _, elem := range s.items {
+				if now.After(elem.Value.(*Entry).ExpiresAt.Add(c.retain)) {
+					s.remove(elem)
+				}
 			}
+			s.mu.Unlock()
 		}
-		c.mu.Unlock()
 	}
 }
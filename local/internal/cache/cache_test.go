@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
@@ -96,3 +97,227 @@ func TestKey(t *testing.T) {
 		t.Errorf("Unexpected key: %s", key)
 	}
 }
+
+func TestPrefetch(t *testing.T) {
+	c := New(100, time.Minute, 0, time.Hour)
+
+	refreshed := make(chan dns.Question, 1)
+	c.EnablePrefetch(2, 0.5, 1, func(q dns.Question) { refreshed <- q })
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("hot.example.", dns.TypeA)
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "hot.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+		A:   []byte{1, 2, 3, 4},
+	})
+	key := Key(msg.Question[0])
+	c.Set(key, msg)
+
+	// Popular but far from expiry: no refresh yet
+	c.Get(key)
+	c.Get(key)
+	select {
+	case <-refreshed:
+		t.Fatal("refreshed too early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	c.Get(key)
+
+	select {
+	case q := <-refreshed:
+		if q.Name != "hot.example." || q.Qtype != dns.TypeA {
+			t.Errorf("refreshed %v", q)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a prefetch")
+	}
+	if c.Prefetches() != 1 {
+		t.Errorf("Prefetches() = %d, want 1", c.Prefetches())
+	}
+
+	// That refresh stored nothing, so a later hit tries again
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for c.Prefetches() < 2 && time.Now().Before(deadline) {
+		c.Get(key)
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("failed refresh never retried")
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	c := New(2, time.Minute, time.Minute, time.Hour)
+
+	set := func(name string) string {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		key := Key(msg.Question[0])
+		c.Set(key, msg)
+		return key
+	}
+
+	a := set("a.example.")
+	b := set("b.example.")
+	c.Get(a) // a is now more recently used than b
+	set("c.example.")
+
+	if _, ok := c.Get(b); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+	if _, ok := c.Get(a); !ok {
+		t.Error("expected recently used entry to survive")
+	}
+
+	stats := c.Stats()
+	if stats.Size != 2 || stats.Evictions != 1 || stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	old := New(100, time.Minute, time.Minute, time.Hour)
+	defer old.Close()
+
+	set := func(c *Cache, name string, ttl uint32) string {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   []byte{1, 2, 3, 4},
+		})
+		key := Key(msg.Question[0])
+		c.Set(key, msg)
+		return key
+	}
+
+	a := set(old, "a.example.", 600)
+	b := set(old, "b.example.", 600)
+	fresh := set(old, "fresh.example.", 600)
+	old.Get(a) // a is now more recently used than b
+
+	neg := "neg.example.:A"
+	old.SetNegative(neg, new(dns.Msg), time.Hour)
+	old.Get(a)
+
+	// Room for two entries, and answers cached for at most 5 minutes
+	next := New(2, time.Minute, time.Minute, 5*time.Minute)
+	defer next.Close()
+	set(next, "fresh.example.", 60) // stored after the switch, must win
+
+	if moved := next.Migrate(old); moved != 1 {
+		t.Errorf("migrated %d entries, want 1", moved)
+	}
+	for _, key := range []string{b, neg} {
+		if _, ok := next.Get(key); ok {
+			t.Errorf("%s survived the shrink", key)
+		}
+	}
+	if got, ok := next.Get(a); !ok || got.Answer[0].Header().Ttl != 600 {
+		t.Fatalf("recently used entry was not kept: %v", got)
+	}
+	if got, ok := next.Get(fresh); !ok || got.Answer[0].Header().Ttl != 60 {
+		t.Errorf("answer stored after the switch was replaced: %v", got)
+	}
+	s := next.shardFor(a)
+	if e := s.items[a].Value.(*Entry); e.ExpiresAt.Sub(e.CreatedAt) != 5*time.Minute {
+		t.Errorf("migrated lifetime = %v, want the new 5m maximum", e.ExpiresAt.Sub(e.CreatedAt))
+	}
+
+	// Entries already past the new maximum are dropped; negative entries
+	// keep their lifetime up to it
+	old.shardFor(a).items[a].Value.(*Entry).CreatedAt = time.Now().Add(-10 * time.Minute)
+	roomy := New(100, time.Minute, time.Minute, 5*time.Minute)
+	defer roomy.Close()
+	if moved := roomy.Migrate(old); moved != 3 {
+		t.Errorf("migrated %d entries, want 3", moved)
+	}
+	if _, ok := roomy.Get(a); ok {
+		t.Error("entry older than the new maximum was migrated")
+	}
+	if e := roomy.shardFor(neg).items[neg].Value.(*Entry); e.ExpiresAt.Sub(e.CreatedAt) != 5*time.Minute {
+		t.Errorf("negative entry lifetime = %v, want 5m", e.ExpiresAt.Sub(e.CreatedAt))
+	}
+}
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	c := New(10000, time.Minute, time.Minute, time.Hour)
+	keys := make([]string, 1000)
+	for i := range keys {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(strconv.Itoa(i)+".example"), dns.TypeA)
+		keys[i] = Key(msg.Question[0])
+		c.Set(keys[i], msg)
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.Get(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+func TestLookupFreshness(t *testing.T) {
+	c := New(100, time.Minute, time.Second, time.Hour)
+	defer c.Close()
+	c.RetainExpired(2 * time.Minute)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("stale.example.", dns.TypeA)
+	msg.Answer = append(msg.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "stale.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   []byte{1, 2, 3, 4},
+	})
+	key := Key(msg.Question[0])
+	c.Set(key, msg)
+
+	// Cached 100s ago with a 60s TTL: expired 40s ago
+	age := func(d time.Duration) {
+		e := c.shardFor(key).items[key].Value.(*Entry)
+		e.CreatedAt = time.Now().Add(-d)
+		e.ExpiresAt = e.CreatedAt.Add(time.Minute)
+	}
+	age(100 * time.Second)
+
+	tests := []struct {
+		name string
+		f    Freshness
+		hit  bool
+	}{
+		{"plain", Freshness{}, false},
+		{"stretched", Freshness{Stretch: 2}, true},
+		{"stretched too little", Freshness{Stretch: 1.5}, false},
+		{"stale", Freshness{Stale: time.Minute}, true},
+		{"stale too little", Freshness{Stale: 30 * time.Second}, false},
+	}
+	for _, tt := range tests {
+		got, ok := c.Lookup(key, tt.f)
+		if ok != tt.hit {
+			t.Errorf("%s: hit = %v, want %v", tt.name, ok, tt.hit)
+		}
+		if ok && got.Answer[0].Header().Ttl != staleTTL {
+			t.Errorf("%s: expired answer served with TTL %d", tt.name, got.Answer[0].Header().Ttl)
+		}
+	}
+	if _, ok := c.Get(key); ok {
+		t.Error("Get served an expired entry")
+	}
+	if c.Stats().Stale != 2 {
+		t.Errorf("stale = %d, want 2", c.Stats().Stale)
+	}
+
+	// Beyond what the cache retains, nothing is served and the entry goes
+	age(200 * time.Second)
+	if _, ok := c.Lookup(key, Freshness{Stretch: 10, Stale: time.Hour}); ok {
+		t.Error("entry served past its retention")
+	}
+	if c.Len() != 0 {
+		t.Error("entry past its retention was kept")
+	}
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"sort"
+	"time"
+)
+
+// Migrate moves the live entries of old into c, so a cache rebuilt with new
+// settings starts warm instead of sending every name back to the API.
+// Entries get c's TTL bounds, measured from when they were first cached
+// (negative entries keep their lifetime, capped at the new limits), and
+// those expired under the new bounds, beyond what c retains, are dropped.
+// When c is smaller, the most recently used entries are kept. Keys already
+// in c, answers stored since the switch, are left alone. Returns the number
+// of entries moved.
+func (c *Cache) Migrate(old *Cache) int {
+	now := time.Now()
+
+	var entries []*Entry
+	for _, s := range old.shards {
+		s.mu.Lock()
+		for elem := s.lru.Front(); elem != nil; elem = elem.Next() {
+			entries = append(entries, elem.Value.(*Entry))
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].used.Load() > entries[j].used.Load()
+	})
+
+	moved := 0
+	for _, entry := range entries {
+		expires := entry.ExpiresAt
+		if entry.question != nil {
+			expires = entry.CreatedAt.Add(c.ttl(entry.Msg))
+		} else {
+			limit := c.maxTTL
+			if c.negTTL > 0 && c.negTTL < limit {
+				limit = c.negTTL
+			}
+			if end := entry.CreatedAt.Add(limit); expires.After(end) {
+				expires = end
+			}
+		}
+		if !expires.Add(c.retain).After(now) {
+			continue
+		}
+		if c.adopt(entry, expires) {
+			moved++
+		}
+	}
+	return moved
+}
+
+// adopt stores a copy of an entry from another cache behind the entries
+// already in its shard. Nothing is evicted: it reports false if the key is
+// present or the shard is full. Adopting entries most recently used first
+// therefore keeps the LRU order.
+func (c *Cache) adopt(entry *Entry, expires time.Time) bool {
+	moved := &Entry{
+		Msg:       entry.Msg,
+		ExpiresAt: expires,
+		CreatedAt: entry.CreatedAt,
+		key:       entry.key,
+		question:  entry.question,
+	}
+	moved.hits.Store(entry.hits.Load())
+	moved.used.Store(entry.used.Load())
+
+	s := c.shardFor(entry.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[entry.key]; ok || s.lru.Len() >= s.maxItems {
+		return false
+	}
+	s.items[entry.key] = s.lru.PushBack(moved)
+	return true
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RefreshFunc resolves a question again and stores the fresh answer with Set
+type RefreshFunc func(q dns.Question)
+
+// prefetcher refreshes popular entries shortly before they expire so hot
+// names never wait on the API
+type prefetcher struct {
+	minHits  int64
+	window   float64
+	sem      chan struct{}
+	refresh  RefreshFunc
+	inflight atomic.Int64
+	total    atomic.Int64
+}
+
+// EnablePrefetch refreshes entries hit at least minHits times once less
+// than window (a fraction of the original TTL) remains. At most concurrency
+// refreshes run at a time; extra candidates are skipped. It must be called
+// before the cache is used.
+func (c *Cache) EnablePrefetch(minHits int, window float64, concurrency int, refresh RefreshFunc) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	c.prefetch = &prefetcher{
+		minHits: int64(minHits),
+		window:  window,
+		sem:     make(chan struct{}, concurrency),
+		refresh: refresh,
+	}
+}
+
+// Prefetches returns the number of refreshes started
+func (c *Cache) Prefetches() int64 {
+	if c.prefetch == nil {
+		return 0
+	}
+	return c.prefetch.total.Load()
+}
+
+// maybePrefetch starts a background refresh if the entry is popular and
+// close to expiry
+func (c *Cache) maybePrefetch(entry *Entry, now time.Time) {
+	p := c.prefetch
+	if p == nil || entry.question == nil {
+		return
+	}
+	if entry.hits.Load() < p.minHits {
+		return
+	}
+	ttl := entry.ExpiresAt.Sub(entry.CreatedAt)
+	if entry.ExpiresAt.Sub(now) > time.Duration(float64(ttl)*p.window) {
+		return
+	}
+	if !entry.prefetching.CompareAndSwap(false, true) {
+		return
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		// Over budget; let a later hit try again
+		entry.prefetching.Store(false)
+		return
+	}
+
+	p.total.Add(1)
+	go func() {
+		defer func() { <-p.sem }()
+		p.refresh(*entry.question)
+		// A refresh that failed, leaving the entry in place, may be retried
+		entry.prefetching.Store(false)
+	}()
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// route is one address of an endpoint's server. An endpoint starts on its
+// configured URL and moves along its routes when it seems blocked.
+type route struct {
+	url        string
+	healthURL  string
+	sessionURL string
+}
+
+// newRoutes returns the routes of ep: its URL, its alternates, then its URL
+// on each alternate port
+func newRoutes(ep config.EndpointConfig, ports []int) []route {
+	healthURL := ep.HealthURL
+	if healthURL == "" {
+		healthURL = deriveHealthURL(ep.URL)
+	}
+	routes := []route{{url: ep.URL, healthURL: healthURL, sessionURL: deriveSessionURL(ep.URL)}}
+	seen := map[string]bool{ep.URL: true}
+	add := func(u, health string) {
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+		routes = append(routes, route{url: u, healthURL: health, sessionURL: deriveSessionURL(u)})
+	}
+	for _, alt := range ep.Alternates {
+		add(alt, deriveHealthURL(alt))
+	}
+	for _, port := range ports {
+		add(withPort(ep.URL, port), withPort(healthURL, port))
+	}
+	return routes
+}
+
+// routeURLs returns the URLs of every route of the endpoints, for settings
+// kept per host (proxies, pins, bootstrap addresses)
+func routeURLs(ep config.EndpointConfig, ports []int) []string {
+	var urls []string
+	for _, r := range newRoutes(ep, ports) {
+		urls = append(urls, r.url, r.healthURL)
+	}
+	return urls
+}
+
+// withPort returns raw with its port replaced
+func withPort(raw string, port int) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	return u.String()
+}
+
+// alternatePorts returns the ports endpoints rotate over, none unless
+// blocking detection is enabled
+func alternatePorts(cfg config.BlockingConfig) []int {
+	if !cfg.Enabled {
+		return nil
+	}
+	return cfg.AlternatePorts
+}
+
+// route returns the address the endpoint is reached at
+func (ep *Endpoint) route() route {
+	return ep.routes[ep.routeIndex.Load()]
+}
+
+// blockSignal is a sign that an endpoint is blocked on the network path
+// rather than down
+type blockSignal int
+
+const (
+	blockNone blockSignal = iota
+	// blockReset: the connection was reset or closed before a response,
+	// typically right after the TLS ClientHello showed the server name
+	blockReset
+	// blockTimeout: a timeout while another endpoint answered recently
+	blockTimeout
+	// blockForbidden: a 403 page the API did not send, as middleboxes serve
+	blockForbidden
+
+	numBlockSignals
+)
+
+func (b blockSignal) String() string {
+	switch b {
+	case blockReset:
+		return "reset"
+	case blockTimeout:
+		return "timeout"
+	case blockForbidden:
+		return "forbidden_page"
+	default:
+		return "none"
+	}
+}
+
+// answeredWindow is how recently another endpoint must have answered for a
+// timeout to count as blocking rather than an outage of the network
+const answeredWindow = 2 * time.Minute
+
+// blockingSignal classifies a failed request to ep
+func (c *Client) blockingSignal(ep *Endpoint, err error) blockSignal {
+	var he *httpError
+	var ne net.Error
+	switch {
+	case errors.As(err, &he):
+		if he.status == http.StatusForbidden && !he.fromAPI {
+			return blockForbidden
+		}
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return blockReset
+	case errors.As(err, &ne) && ne.Timeout():
+		if c.answeredElsewhere(ep) {
+			return blockTimeout
+		}
+	}
+	return blockNone
+}
+
+// answeredElsewhere reports whether an endpoint other than ep answered
+// within answeredWindow
+func (c *Client) answeredElsewhere(ep *Endpoint) bool {
+	since := time.Now().Add(-answeredWindow).UnixNano()
+	for _, other := range c.endpoints {
+		if other != ep && other.lastSuccess.Load() > since {
+			return true
+		}
+	}
+	return false
+}
+
+// observeBlocking counts a failed request to ep that looks like blocking.
+// After threshold such failures in a row the endpoint moves to its next
+// route; other failures neither count nor reset the streak.
+func (c *Client) observeBlocking(ep *Endpoint, err error) {
+	if c.blockThreshold == 0 {
+		return
+	}
+	signal := c.blockingSignal(ep, err)
+	if signal == blockNone {
+		return
+	}
+	ep.blockSignals[signal].Add(1)
+	if int(ep.blockStreak.Add(1)) < c.blockThreshold {
+		return
+	}
+	ep.blockStreak.Store(0)
+
+	from := ep.routeIndex.Load()
+	if len(ep.routes) < 2 {
+		c.logger.Warn("endpoint blocking suspected; no alternate route", "endpoint", ep.URL, "signal", signal.String())
+		return
+	}
+	to := (from + 1) % int32(len(ep.routes))
+	if !ep.routeIndex.CompareAndSwap(from, to) {
+		return // rotated concurrently
+	}
+	ep.rotations.Add(1)
+	// The new address starts with a clean slate
+	ep.breaker.reset()
+	c.logger.Warn("endpoint blocking suspected; rotating",
+		"endpoint", ep.URL,
+		"signal", signal.String(),
+		"from", ep.routes[from].url,
+		"to", ep.routes[to].url,
+	)
+}
+
+// blockingSnapshot returns the endpoint's route and blocking counters
+func (ep *Endpoint) blockingSnapshot() map[string]interface{} {
+	signals := make(map[string]int64, numBlockSignals-1)
+	for signal := blockReset; signal < numBlockSignals; signal++ {
+		signals[signal.String()] = ep.blockSignals[signal].Load()
+	}
+	return map[string]interface{}{
+		"route":     ep.route().url,
+		"rotations": ep.rotations.Load(),
+		"signals":   signals,
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// bootstrapper resolves endpoint hostnames without the system resolver,
+// which on a machine using this proxy points back at ourselves. Addresses
+// come from static config or dedicated bootstrap DNS servers and are pinned
+// between periodic refreshes, surviving refresh failures.
+type bootstrapper struct {
+	static   map[string][]string
+	resolver *net.Resolver
+	logger   *slog.Logger
+
+	// pinned is replaced copy-on-write, so it is read on every dial
+	// without locking
+	pinned atomic.Pointer[map[string][]string]
+	mu     sync.Mutex // serializes writers of pinned
+}
+
+// newBootstrapper returns nil when no bootstrap is configured, leaving name
+// resolution to the system
+func newBootstrapper(cfg config.BootstrapConfig, logger *slog.Logger) *bootstrapper {
+	if len(cfg.Servers) == 0 && len(cfg.Hosts) == 0 {
+		return nil
+	}
+
+	b := &bootstrapper{
+		static: cfg.Hosts,
+		logger: logger,
+	}
+	b.pinned.Store(&map[string][]string{})
+	if len(cfg.Servers) > 0 {
+		var next int
+		var mu sync.Mutex
+		b.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				// Rotate through the bootstrap servers on each dial
+				mu.Lock()
+				server := cfg.Servers[next%len(cfg.Servers)]
+				next++
+				mu.Unlock()
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return b
+}
+
+// lookup returns the pinned addresses for host, resolving on first use
+func (b *bootstrapper) lookup(ctx context.Context, host string) ([]string, error) {
+	if ips, ok := b.static[host]; ok {
+		return ips, nil
+	}
+
+	if ips, ok := (*b.pinned.Load())[host]; ok {
+		return ips, nil
+	}
+	return b.resolve(ctx, host)
+}
+
+func (b *bootstrapper) resolve(ctx context.Context, host string) ([]string, error) {
+	if b.resolver == nil {
+		return nil, fmt.Errorf("no bootstrap address for %s", host)
+	}
+	addrs, err := b.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap resolution of %s failed: %w", host, err)
+	}
+	ips := make([]string, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP.String()
+	}
+
+	b.mu.Lock()
+	old := *b.pinned.Load()
+	next := make(map[string][]string, len(old)+1)
+	for h, addrs := range old {
+		next[h] = addrs
+	}
+	next[host] = ips
+	b.pinned.Store(&next)
+	b.mu.Unlock()
+	return ips, nil
+}
+
+// dialContext dials the pinned addresses of the target host in turn
+func (b *bootstrapper) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	ips, err := b.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// refresh re-resolves the endpoint hostnames periodically so pinned
+// addresses follow DNS changes, until stop is closed; on failure the
+// previous addresses are kept
+func (b *bootstrapper) refresh(endpoints []*Endpoint, freq time.Duration, stop <-chan struct{}) {
+	if b.resolver == nil || freq <= 0 {
+		return
+	}
+	ticker := time.NewTicker(freq)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, host := range endpointHosts(endpoints) {
+			if _, ok := b.static[host]; ok {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if _, err := b.resolve(ctx, host); err != nil {
+				b.logger.Warn("bootstrap refresh failed; keeping pinned addresses", "host", host, "error", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// endpointHosts returns the distinct hostnames (not IP literals) of the
+// endpoints' routes
+func endpointHosts(endpoints []*Endpoint) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, ep := range endpoints {
+		for _, r := range ep.routes {
+			u, err := url.Parse(r.url)
+			if err != nil {
+				continue
+			}
+			host := u.Hostname()
+			if host == "" || net.ParseIP(host) != nil || seen[host] {
+				continue
+			}
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
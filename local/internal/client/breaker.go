@@ -0,0 +1,180 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// breakerState is the state of an endpoint's circuit breaker
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateClosed:
+		return "closed"
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// halfOpenTrials is how many trial requests a half-open breaker lets
+// through at a time
+const halfOpenTrials = 1
+
+// circuitBreaker takes an endpoint out of rotation after consecutive
+// failures, lets trial requests through one at a time once the open
+// timeout has passed, and closes again after enough consecutive successes.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	successes int
+	trials    int // trial requests in flight
+	openedAt  time.Time
+
+	failureThreshold int
+	successThreshold int
+	openTimeout      time.Duration
+}
+
+func newCircuitBreaker(failureThreshold, successThreshold int, openTimeout time.Duration) *circuitBreaker {
+	if failureThreshold <= 0 {
+		failureThreshold = 1
+	}
+	if successThreshold <= 0 {
+		successThreshold = 1
+	}
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		successThreshold: successThreshold,
+		openTimeout:      openTimeout,
+	}
+}
+
+// available reports whether allow would let a request through, without
+// changing the breaker's state
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case stateOpen:
+		return time.Since(b.openedAt) >= b.openTimeout
+	case stateHalfOpen:
+		return b.trials < halfOpenTrials
+	}
+	return true
+}
+
+// allow reports whether a request may be sent, moving an open breaker to
+// half-open once its timeout has elapsed. A half-open breaker admits trial
+// requests only while fewer than halfOpenTrials are in flight; trial is
+// set for those, which the caller must release when they are done.
+func (b *circuitBreaker) allow() (ok, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == stateOpen && time.Since(b.openedAt) >= b.openTimeout {
+		b.state = stateHalfOpen
+		b.successes = 0
+	}
+	switch b.state {
+	case stateOpen:
+		return false, false
+	case stateHalfOpen:
+		if b.trials >= halfOpenTrials {
+			return false, false
+		}
+		b.trials++
+		return true, true
+	}
+	return true, false
+}
+
+// release ends a trial request admitted by allow, after its outcome has
+// been recorded
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.trials > 0 {
+		b.trials--
+	}
+}
+
+// onSuccess records a successful request and returns the state transition
+func (b *circuitBreaker) onSuccess() (from, to breakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from = b.state
+	switch b.state {
+	case stateClosed:
+		b.failures = 0
+	case stateOpen:
+		// A passing health check lets trial traffic through early
+		b.state = stateHalfOpen
+		b.successes = 1
+	case stateHalfOpen:
+		b.successes++
+	}
+	if b.state == stateHalfOpen && b.successes >= b.successThreshold {
+		b.state = stateClosed
+		b.failures = 0
+	}
+	return from, b.state
+}
+
+// onFailure records a failed request and returns the state transition
+func (b *circuitBreaker) onFailure() (from, to breakerState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from = b.state
+	switch b.state {
+	case stateClosed:
+		b.failures++
+		if b.failures >= b.failureThreshold {
+			b.trip()
+		}
+	case stateHalfOpen:
+		b.trip()
+	case stateOpen:
+		b.openedAt = time.Now()
+	}
+	return from, b.state
+}
+
+// reset closes the breaker and clears its counts
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = stateClosed
+	b.failures = 0
+	b.successes = 0
+}
+
+// trip opens the breaker (must be called with lock held)
+func (b *circuitBreaker) trip() {
+	b.state = stateOpen
+	b.openedAt = time.Now()
+	b.successes = 0
+}
+
+func (b *circuitBreaker) snapshot() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]interface{}{
+		"state":                b.state.String(),
+		"consecutive_failures": b.failures,
+	}
+}
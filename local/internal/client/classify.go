@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+// failureClass sorts a failed request by what it says about the endpoint
+type failureClass int
+
+const (
+	// failureCanceled: the caller's context ended first, which says
+	// nothing about the endpoint. Health checks, which own their
+	// deadlines, still catch an endpoint that never answers.
+	failureCanceled failureClass = iota
+	// failureNetwork: no response (connection, TLS or transport timeout)
+	failureNetwork
+	// failureServer: a 5xx, or a response that can't be decoded
+	failureServer
+	// failureRejected: a 4xx; the endpoint works but refused this request
+	// or these credentials
+	failureRejected
+	// failureThrottled: a 429, or every endpoint throttled
+	failureThrottled
+
+	numFailureClasses
+)
+
+func (f failureClass) String() string {
+	switch f {
+	case failureCanceled:
+		return "canceled"
+	case failureNetwork:
+		return "network"
+	case failureServer:
+		return "server"
+	case failureRejected:
+		return "rejected"
+	default:
+		return "throttled"
+	}
+}
+
+// demotes reports whether the failure counts against the endpoint's health
+func (f failureClass) demotes() bool {
+	return f == failureNetwork || f == failureServer
+}
+
+// httpError is a non-200 response, keeping its status for classification
+type httpError struct {
+	status  int
+	err     error // classified by errcode
+	fromAPI bool  // the body was the API's own; see fromAPI
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+
+func (e *httpError) Unwrap() error { return e.err }
+
+// fromAPI reports whether resp carries the API's encoding rather than an
+// HTML page, which a middlebox answering in the server's place would send
+func fromAPI(resp *http.Response) bool {
+	mediaType := resp.Header.Get("Content-Type")
+	return strings.Contains(mediaType, "json") || strings.Contains(mediaType, "cbor")
+}
+
+// classify returns the class of err, a failure of a request made with ctx
+func classify(ctx context.Context, err error) failureClass {
+	var he *httpError
+	switch {
+	case ctx.Err() != nil:
+		return failureCanceled
+	case errors.As(err, &he):
+		switch {
+		case he.status == http.StatusTooManyRequests:
+			return failureThrottled
+		case he.status >= 500:
+			return failureServer
+		case he.status >= 400:
+			return failureRejected
+		}
+		return failureServer
+	case errcode.Of(err) == errcode.RateLimited:
+		return failureThrottled
+	case errcode.Of(err) == errcode.ProtocolMismatch:
+		return failureServer
+	}
+	return failureNetwork
+}
@@ -3,17 +3,24 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mahdi/dns-proxy-local/internal/config"
 	"github.com/mahdi/dns-proxy-local/internal/crypto"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
 )
 
 // DNSRecord represents a resolved DNS record
@@ -26,116 +33,271 @@ type DNSRecord struct {
 
 // ResolveResponse represents the API response
 type ResolveResponse struct {
-	Domain  string      `json:"domain"`
-	Records []DNSRecord `json:"records"`
-	Cached  bool        `json:"cached"`
-	Error   string      `json:"error,omitempty"`
+	Domain      string       `json:"domain"`
+	Records     []DNSRecord  `json:"records"`
+	Cached      bool         `json:"cached"`
+	NegativeTTL uint32       `json:"negative_ttl,omitempty"` // seconds a response without records (or NXDOMAIN) may be cached; 0 if unknown
+	Error       string       `json:"error,omitempty"`
+	Code        errcode.Code `json:"code,omitempty"` // class of Error, empty when unclassified
+	AD          bool         `json:"ad,omitempty"`   // the remote's upstream validated the answer with DNSSEC
 }
 
 // EncryptedRequest represents an encrypted request payload
 type EncryptedRequest struct {
-	Data string `json:"data"`
+	Version int    `json:"v,omitempty"`   // 1: padded plaintext, encrypted response
+	KeyID   string `json:"kid,omitempty"` // server key to decrypt with; empty for the unnamed key
+	Suite   string `json:"alg,omitempty"` // cipher suite; empty for aes-256-gcm
+	Session string `json:"sid,omitempty"` // session whose key sealed the data, replacing kid and alg
+	Data    string `json:"data"`
+}
+
+// EncryptedResponse is the server's answer to a version 1 request: an
+// encrypted, padded ResolveResponse
+type EncryptedResponse struct {
+	Version int    `json:"v"`
+	Data    string `json:"data"`
 }
 
 // Endpoint represents a single API endpoint with health status
 type Endpoint struct {
-	URL     string
-	APIKey  string
-	Weight  int
-	Healthy atomic.Bool
+	URL       string
+	APIKey    string
+	Weight    int
+	HealthURL string
+
+	cfg           config.EndpointConfig // as configured, for peers it lists
+	signingSecret string
+	session       atomic.Pointer[apiSession]
+	sessionMu     sync.Mutex // serializes session handshakes
+	breaker       *circuitBreaker
+	throttleUntil atomic.Int64 // unix nanoseconds; set by 429 responses
+	throttles     atomic.Int64
+	failures      [numFailureClasses]atomic.Int64
+	tlsWarned     atomic.Bool
+	proto         atomic.Value // HTTP version of the last response
+	probeRTT      atomic.Int64 // nanoseconds of the last health check; 0 if it failed
+	stats         latencyStats
+	currentWeight int // smooth weighted round-robin state, guarded by Client.wrrMu
+
+	routes       []route      // addresses of the server; the first is the configured one
+	routeIndex   atomic.Int32 // route in use
+	blockStreak  atomic.Int32 // consecutive failures that look like blocking
+	rotations    atomic.Int64
+	blockSignals [numBlockSignals]atomic.Int64
+	lastSuccess  atomic.Int64 // unix nanoseconds of the last answered request
 }
 
 // Client handles communication with remote DNS API servers
 type Client struct {
-	endpoints     []*Endpoint
-	httpClient    *http.Client
-	cipher        *crypto.Cipher
-	timeout       time.Duration
-	maxRetries    int
-	retryDelay    time.Duration
-	loadBalancing string
-	currentIndex  atomic.Uint32
-	mu            sync.RWMutex
+	endpoints      []*Endpoint
+	httpClient     *http.Client
+	sched          *scheduler
+	cipher         *crypto.Cipher
+	padding        crypto.Padding
+	sessions       bool // seal queries with per-endpoint session keys
+	binary         bool // CBOR bodies instead of JSON
+	gzip           bool // accept gzip-compressed responses
+	timeout        time.Duration
+	maxRetries     int
+	retryDelay     time.Duration
+	loadBalancing  string
+	blockThreshold int       // blocking-like failures before rotating routes; 0 disables
+	tuner          *tuner    // nil unless path tuning is enabled
+	failback       *failback // sticky failover; nil returns to the first endpoint at once
+	healthProbe    string    // http or resolve
+	probeDomain    string
+	currentIndex   atomic.Uint32
+	logger         *slog.Logger
+	wrrMu          sync.Mutex
+	stop           chan struct{}
+	stopOnce       sync.Once
 }
 
 // NewClient creates a new API client
-func NewClient(cfg config.APIConfig, cipher *crypto.Cipher) *Client {
+func NewClient(cfg config.APIConfig, cipher *crypto.Cipher, logger *slog.Logger) *Client {
+	ports := alternatePorts(cfg.Blocking)
 	endpoints := make([]*Endpoint, len(cfg.Endpoints))
 	for i, ep := range cfg.Endpoints {
+		healthURL := ep.HealthURL
+		if healthURL == "" {
+			healthURL = deriveHealthURL(ep.URL)
+		}
 		endpoints[i] = &Endpoint{
-			URL:    ep.URL,
-			APIKey: ep.APIKey,
-			Weight: ep.Weight,
+			URL:       ep.URL,
+			APIKey:    ep.APIKey,
+			Weight:    ep.Weight,
+			HealthURL: healthURL,
+
+			cfg:           ep,
+			signingSecret: ep.SigningSecret,
+			routes:        newRoutes(ep, ports),
+			breaker: newCircuitBreaker(
+				cfg.CircuitBreaker.FailureThreshold,
+				cfg.CircuitBreaker.SuccessThreshold,
+				cfg.CircuitBreaker.OpenTimeout,
+			),
 		}
-		endpoints[i].Healthy.Store(true)
+	}
+
+	tlsConfig := newTLSConfig(cfg.TLSMinVersion, cfg.TLSSessionCache)
+	if pins := newPinSet(cfg.Endpoints); len(pins) > 0 {
+		tlsConfig.VerifyConnection = pins.verify
+	}
+	transport := &http.Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		Protocols:           newProtocols(cfg.HTTPVersion),
+		DisableCompression:  true, // negotiated by doRequest, which bounds the decompressed size
+	}
+	if proxies := newProxySet(cfg.Endpoints, ports); len(proxies) > 0 {
+		transport.Proxy = proxies.proxy
+	}
+	stop := make(chan struct{})
+	boot := newBootstrapper(cfg.Bootstrap, logger)
+	if boot != nil {
+		transport.DialContext = boot.dialContext
+		go boot.refresh(endpoints, cfg.Bootstrap.Refresh, stop)
+	}
+	if cfg.HappyEyeballs.Enabled {
+		transport.DialContext = newHappyDialer(cfg.HappyEyeballs.Delay, boot).dialContext
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if cfg.HTTPVersion == "3" {
+		roundTripper = newH3Transport(transport, cfg.Timeout, boot)
 	}
 
 	client := &Client{
 		endpoints: endpoints,
 		httpClient: &http.Client{
-			Timeout: cfg.Timeout,
-			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     90 * time.Second,
-				TLSClientConfig: &tls.Config{
-					MinVersion: tls.VersionTLS12,
-				},
-			},
+			Timeout:   cfg.Timeout,
+			Transport: roundTripper,
 		},
+		sched:         newScheduler(cfg.MaxInFlight),
 		cipher:        cipher,
 		timeout:       cfg.Timeout,
 		maxRetries:    cfg.MaxRetries,
 		retryDelay:    cfg.RetryDelay,
 		loadBalancing: cfg.LoadBalancing,
+		healthProbe:   cfg.HealthProbe,
+		probeDomain:   cfg.ProbeDomain,
+		binary:        cfg.Encoding == "cbor",
+		gzip:          cfg.Compression == "gzip",
+		logger:        logger,
+		stop:          stop,
+	}
+	if cfg.Blocking.Enabled {
+		client.blockThreshold = cfg.Blocking.Threshold
+	}
+	if cfg.LoadBalancing == "failover" && cfg.Failback.Enabled && len(endpoints) > 0 {
+		client.failback = newFailback(len(endpoints), cfg.Failback.Probes)
 	}
 
 	// Start health check
 	go client.healthCheck(cfg.HealthCheckFreq)
+	if cfg.Tuning.Enabled && cipher != nil {
+		client.tuner = &tuner{interval: cfg.Tuning.Interval}
+		go client.tune()
+	}
 
 	return client
 }
 
 // Resolve sends a DNS resolution request to the remote API
 func (c *Client) Resolve(ctx context.Context, domain string, recordType string) (*ResolveResponse, error) {
-	// Build request body
-	reqBody := map[string]string{
-		"domain": domain,
-		"type":   recordType,
-	}
-
-	var body []byte
+	return c.resolve(ctx, domain, recordType, nil, c.maxRetries)
+}
 
-	if c.cipher != nil {
-		// Encrypt the request
-		jsonData, _ := json.Marshal(reqBody)
-		encrypted, err := c.cipher.Encrypt(jsonData)
-		if err != nil {
-			return nil, fmt.Errorf("encryption failed: %w", err)
-		}
-		body, _ = json.Marshal(EncryptedRequest{Data: encrypted})
-	} else {
-		body, _ = json.Marshal(reqBody)
-	}
+// resolve tries the query up to attempts times, on pinned alone if set and
+// on the endpoints the load balancing picks otherwise
+func (c *Client) resolve(ctx context.Context, domain, recordType string, pinned *Endpoint, attempts int) (*ResolveResponse, error) {
+	// Retries of this query share one key so the remote can replay
+	// its answer instead of resolving and rate limiting it again
+	idemKey := newIdempotencyKey()
 
 	// Try endpoints with retry logic
 	var lastErr error
-	for attempt := 0; attempt < c.maxRetries; attempt++ {
-		endpoint := c.selectEndpoint()
+	for attempt := 0; attempt < attempts; attempt++ {
+		endpoint := pinned
 		if endpoint == nil {
-			return nil, fmt.Errorf("no healthy endpoints available")
+			endpoint = c.selectEndpoint()
+		}
+		if endpoint == nil {
+			return nil, errcode.New(errcode.TunnelDown, "no healthy endpoints available")
+		}
+		if err := pace(ctx, endpoint); err != nil {
+			return nil, err
+		}
+		// A recovering endpoint takes one trial at a time; the rest of the
+		// traffic waits for it to prove itself. Pinned queries, probes of
+		// the endpoint, are not held back.
+		ok, trial := true, false
+		if pinned == nil {
+			ok, trial = endpoint.breaker.allow()
+		}
+		if !ok {
+			lastErr = errcode.New(errcode.TunnelDown, "endpoint circuit open")
+			break
 		}
 
-		resp, err := c.doRequest(ctx, endpoint, body)
+		start := time.Now()
+		resp, err := c.exchange(ctx, endpoint, domain, recordType, idemKey)
 		if err == nil {
+			endpoint.stats.record(time.Since(start), false)
+			c.recordOutcome(endpoint, true)
+			if trial {
+				endpoint.breaker.release()
+			}
 			return resp, nil
 		}
+		// Only network and server failures count against the endpoint's
+		// health. A throttled endpoint is working, just busy, and is paced;
+		// one that rejects the request is ranked down by its error rate
+		// (last if it never answered), without tripping its circuit.
+		class := classify(ctx, err)
+		endpoint.failures[class].Add(1)
+		switch class {
+		case failureCanceled:
+			// The caller gave up: no endpoint is to blame, and no
+			// retry could still be answered
+			if trial {
+				endpoint.breaker.release()
+			}
+			return nil, errcode.Wrap(errcode.TunnelDown, "query abandoned", err)
+		case failureNetwork, failureServer:
+			endpoint.stats.record(time.Since(start), true)
+			c.recordOutcome(endpoint, false)
+		case failureRejected:
+			endpoint.stats.record(time.Since(start), true)
+		}
+		// Released once the outcome is recorded, so a failed trial has
+		// reopened the circuit before another is admitted
+		if trial {
+			endpoint.breaker.release()
+		}
+		c.observeBlocking(endpoint, err)
 
 		lastErr = err
-		endpoint.Healthy.Store(false)
+		c.logger.Warn("endpoint request failed", "endpoint", endpoint.URL, "attempt", attempt+1, "class", class.String(), "error", err)
 
-		// Wait before retry
-		if attempt < c.maxRetries-1 {
+		if errcode.Of(err) == errcode.BlockedPolicy {
+			// The remote's policy refused the query; that is the answer
+			return nil, err
+		}
+
+		if c.sessions && errcode.Of(err) == errcode.ProtocolMismatch {
+			// The server may have forgotten the session (e.g. it
+			// restarted). The next attempt opens a new one, under a
+			// new key so the refusal isn't replayed to it.
+			endpoint.session.Store(nil)
+			idemKey = newIdempotencyKey()
+		}
+
+		// Back off before retrying after a failure of the endpoint itself;
+		// throttled and rejecting endpoints are passed over at once
+		if class.demotes() && attempt < attempts-1 {
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
@@ -144,18 +306,185 @@ func (c *Client) Resolve(ctx context.Context, domain string, recordType string)
 		}
 	}
 
-	return nil, fmt.Errorf("all attempts failed: %w", lastErr)
+	// Keep the code of the last failure; unclassified ones are transport
+	// errors, so the tunnel itself is down
+	code := errcode.Of(lastErr)
+	if code == "" {
+		code = errcode.TunnelDown
+	}
+	return nil, errcode.Wrap(code, "all attempts failed", lastErr)
+}
+
+// Close stops health checks and bootstrap refreshes and drops idle
+// connections. Requests in flight complete normally.
+func (c *Client) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.httpClient.CloseIdleConnections()
+}
+
+// EnablePadding pads encrypted requests and asks the server for padded,
+// encrypted responses (envelope version 1). It has no effect without a cipher.
+func (c *Client) EnablePadding(p crypto.Padding) {
+	c.padding = p
 }
 
-func (c *Client) doRequest(ctx context.Context, endpoint *Endpoint, body []byte) (*ResolveResponse, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+// exchange sends one query to endpoint, sealed with the endpoint's session
+// key when sessions are enabled and with the pre-shared key otherwise
+func (c *Client) exchange(ctx context.Context, endpoint *Endpoint, domain, recordType, idemKey string) (*ResolveResponse, error) {
+	cipher, sid := c.cipher, ""
+	if c.sessions {
+		var err error
+		if cipher, err = c.session(ctx, endpoint); err != nil {
+			return nil, err
+		}
+		sid = cipher.ID()
+	}
+
+	body, err := c.encodeRequest(cipher, sid, domain, recordType, flagsOf(ctx))
 	if err != nil {
 		return nil, err
 	}
+	data, err := c.doRequest(ctx, endpoint, endpoint.route().url, body, idemKey)
+	if err != nil {
+		return nil, err
+	}
+	var result ResolveResponse
+	if err := c.open(cipher, data, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
+// encodeRequest builds the request body, encrypting it when a cipher is
+// given; sid names the session the cipher belongs to, if any. Flags are
+// only sent when set, so plain queries look as they always have.
+func (c *Client) encodeRequest(cipher *crypto.Cipher, sid, domain, recordType string, flags Flags) ([]byte, error) {
+	reqBody := map[string]any{
+		"domain": domain,
+		"type":   recordType,
+	}
+	if flags.CheckingDisabled {
+		reqBody["cd"] = true
+	}
+	if flags.AuthenticatedData {
+		reqBody["ad"] = true
+	}
+	if flags.NoRecursion {
+		reqBody["rd"] = false
+	}
+	if flags.NoCache {
+		reqBody["no_cache"] = true
+	}
+
+	if cipher == nil {
+		return c.marshal(reqBody)
+	}
+
+	data, err := c.marshal(reqBody)
+	if err != nil {
+		return nil, err
+	}
+	version := 0
+	if sid != "" {
+		// Session responses must be sealed too, for forward secrecy
+		version = crypto.PaddingVersion
+	}
+	return c.seal(cipher, sid, data, version)
+}
+
+// seal encrypts a payload into a request envelope. Envelope version 1 (at
+// least version, and always when padding is enabled) carries a padded
+// plaintext and gets a sealed response.
+func (c *Client) seal(cipher *crypto.Cipher, sid string, data []byte, version int) ([]byte, error) {
+	return c.sealPadded(cipher, sid, data, version, c.requestPadding())
+}
+
+// sealPadded is seal with the given padding
+func (c *Client) sealPadded(cipher *crypto.Cipher, sid string, data []byte, version int, padding crypto.Padding) ([]byte, error) {
+	if padding.Enabled() {
+		version = crypto.PaddingVersion
+	}
+	if version >= crypto.PaddingVersion {
+		padded, err := padding.Pad(data)
+		if err != nil {
+			return nil, err
+		}
+		data = padded
+	}
+	sealed, err := cipher.Seal(data)
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %w", err)
+	}
+
+	env := binaryEnvelope{Version: version, Data: sealed}
+	if sid != "" {
+		env.Session = sid
+		return c.encodeEnvelope(env)
+	}
+	env.KeyID = cipher.ID()
+	if cipher.Suite() != crypto.SuiteAES256GCM {
+		// Left out for AES so servers predating suites accept the request
+		env.Suite = cipher.Suite()
+	}
+	return c.encodeEnvelope(env)
+}
+
+// open parses a response body into v, decrypting and unpadding it when the
+// server answered with an encrypted envelope
+func (c *Client) open(cipher *crypto.Cipher, body []byte, v any) error {
+	if cipher != nil {
+		version, sealed, err := c.decodeEnvelope(body)
+		if err != nil {
+			return err
+		}
+		if version > crypto.PaddingVersion {
+			return errcode.New(errcode.ProtocolMismatch, fmt.Sprintf("unsupported response envelope version %d", version))
+		}
+		if version == crypto.PaddingVersion {
+			padded, err := cipher.Open(sealed)
+			if err != nil {
+				return errcode.Wrap(errcode.ProtocolMismatch, "failed to decrypt response", err)
+			}
+			if body, err = crypto.Unpad(padded); err != nil {
+				return errcode.Wrap(errcode.ProtocolMismatch, "failed to decrypt response", err)
+			}
+		}
+	}
+
+	if err := c.unmarshal(body, v); err != nil {
+		return errcode.Wrap(errcode.ProtocolMismatch, "failed to decode response", err)
+	}
+	return nil
+}
+
+// doRequest posts body to url on endpoint and returns the response body.
+// An empty idemKey sends no Idempotency-Key.
+func (c *Client) doRequest(ctx context.Context, endpoint *Endpoint, url string, body []byte, idemKey string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", c.mediaType())
 	req.Header.Set("X-API-Key", endpoint.APIKey)
+	if idemKey != "" {
+		req.Header.Set("Idempotency-Key", idemKey)
+	}
 	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; DNS-Client/1.0)")
+	if c.gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if endpoint.signingSecret != "" {
+		if err := signRequest(req, endpoint.signingSecret, body); err != nil {
+			return nil, err
+		}
+	}
+
+	p := priorityOf(ctx)
+	if err := c.sched.acquire(ctx, p); err != nil {
+		return nil, err
+	}
+	defer c.sched.release(p)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -163,28 +492,137 @@ func (c *Client) doRequest(ctx context.Context, endpoint *Endpoint, body []byte)
 	}
 	defer resp.Body.Close()
 
+	c.checkTLS(endpoint, resp.TLS)
+	endpoint.proto.Store(resp.Proto)
+
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API error %d: %s", resp.StatusCode, string(body))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			endpoint.throttle(retryAfter(resp.Header.Get("Retry-After")))
+		}
+		body, _ := readBody(resp)
+		return nil, &httpError{status: resp.StatusCode, err: apiError(resp.StatusCode, body), fromAPI: fromAPI(resp)}
 	}
 
-	var result ResolveResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	data, err := readBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
+	return data, nil
+}
 
-	return &result, nil
+// apiError classifies a non-200 response by the code in its body, or by its
+// status when the body has none
+func apiError(status int, body []byte) error {
+	var e struct {
+		Error string       `json:"error"`
+		Code  errcode.Code `json:"code"`
+	}
+	json.Unmarshal(body, &e)
+	if e.Code == "" || !slices.Contains(errcode.Codes, e.Code) {
+		e.Code = errcode.ForStatus(status)
+	}
+	return errcode.New(e.Code, fmt.Sprintf("API error %d: %s", status, strings.TrimSpace(string(body))))
 }
 
-func (c *Client) selectEndpoint() *Endpoint {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// signRequest adds HMAC signature headers. Each attempt gets a fresh
+// timestamp and nonce, so retries aren't refused as replays.
+func signRequest(req *http.Request, secret string, body []byte) error {
+	nonce, err := crypto.NewNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(crypto.TimestampHeader, timestamp)
+	req.Header.Set(crypto.NonceHeader, nonce)
+	req.Header.Set(crypto.SignatureHeader, crypto.Sign(secret, timestamp, nonce, body))
+	return nil
+}
+
+// newTLSConfig returns the client TLS policy; "1.3" refuses anything older.
+// Sessions are cached so reconnects resume with an abbreviated handshake
+// instead of a full key exchange; a negative cache size disables this.
+func newTLSConfig(minVersion string, sessionCache int) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+	}
+	if minVersion == "1.3" {
+		cfg.MinVersion = tls.VersionTLS13
+		cfg.CipherSuites = nil
+	}
+	if sessionCache > 0 {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(sessionCache)
+	}
+	return cfg
+}
+
+// newProtocols returns the HTTP versions the transport may use. "auto"
+// prefers HTTP/2 where the server offers it by ALPN and falls back to
+// HTTP/1.1; "2" insists on HTTP/2, speaking it in cleartext to http://
+// endpoints (the remote needs server.h2c for that). "3" is served by an
+// h3Transport, whose TCP fallback negotiates like "auto".
+func newProtocols(version string) *http.Protocols {
+	p := new(http.Protocols)
+	switch version {
+	case "1.1":
+		p.SetHTTP1(true)
+	case "2":
+		p.SetHTTP2(true)
+		p.SetUnencryptedHTTP2(true)
+	default:
+		p.SetHTTP1(true)
+		p.SetHTTP2(true)
+	}
+	return p
+}
 
+// checkTLS warns once per endpoint when the connection was not negotiated
+// at TLS 1.3, which on a hostile network may indicate a downgrading middlebox
+func (c *Client) checkTLS(endpoint *Endpoint, state *tls.ConnectionState) {
+	if state == nil || state.Version >= tls.VersionTLS13 {
+		return
+	}
+	if endpoint.tlsWarned.Swap(true) {
+		return
+	}
+	c.logger.Warn("endpoint negotiated a TLS version below 1.3",
+		"endpoint", endpoint.URL,
+		"version", tls.VersionName(state.Version),
+	)
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// selectEndpoint picks the endpoint for a request. The endpoint list is
+// fixed after NewClient and health is tracked atomically, so this takes no
+// lock except for weighted round-robin and failback state.
+func (c *Client) selectEndpoint() *Endpoint {
 	switch c.loadBalancing {
 	case "round_robin":
 		return c.selectRoundRobin()
 	case "failover":
+		if c.failback != nil {
+			return c.selectFailback()
+		}
 		return c.selectFailover()
+	case "latency":
+		return c.selectLatency()
+	case "weighted_round_robin":
+		return c.selectWeightedRoundRobin()
+	case "weighted_random":
+		return c.selectWeightedRandom()
 	default:
 		return c.selectRoundRobin()
 	}
@@ -193,73 +631,207 @@ func (c *Client) selectEndpoint() *Endpoint {
 func (c *Client) selectRoundRobin() *Endpoint {
 	for i := 0; i < len(c.endpoints); i++ {
 		idx := int(c.currentIndex.Add(1)-1) % len(c.endpoints)
-		if c.endpoints[idx].Healthy.Load() {
+		if c.endpoints[idx].ready() {
 			return c.endpoints[idx]
 		}
 	}
-	// All unhealthy, try first one anyway
-	if len(c.endpoints) > 0 {
-		return c.endpoints[0]
-	}
-	return nil
+	return c.selectThrottled()
 }
 
 func (c *Client) selectFailover() *Endpoint {
 	for _, ep := range c.endpoints {
-		if ep.Healthy.Load() {
+		if ep.ready() {
 			return ep
 		}
 	}
-	// All unhealthy, try first one anyway
-	if len(c.endpoints) > 0 {
+	return c.selectThrottled()
+}
+
+// selectThrottled is the fallback when no endpoint is ready: the healthy
+// endpoint whose throttle ends first, or if none is healthy the first one,
+// whose breaker then turns the request away
+func (c *Client) selectThrottled() *Endpoint {
+	var best *Endpoint
+	for _, ep := range c.endpoints {
+		if ep.Healthy() && (best == nil || ep.throttleUntil.Load() < best.throttleUntil.Load()) {
+			best = ep
+		}
+	}
+	if best == nil && len(c.endpoints) > 0 {
 		return c.endpoints[0]
 	}
-	return nil
+	return best
 }
 
 func (c *Client) healthCheck(freq time.Duration) {
 	ticker := time.NewTicker(freq)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
 		for _, ep := range c.endpoints {
-			go c.checkEndpoint(ep)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.checkEndpoint(ep)
+			}()
+		}
+		if c.failback != nil {
+			go func() {
+				wg.Wait()
+				c.observeProbes()
+			}()
 		}
 	}
 }
 
+// checkEndpoint runs one health check, recording its round trip for failback
 func (c *Client) checkEndpoint(ep *Endpoint) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(WithPriority(context.Background(), PriorityBackground), 5*time.Second)
 	defer cancel()
 
-	// Parse base URL to get health endpoint
-	healthURL := ep.URL[:len(ep.URL)-len("/api/v1/resolve")] + "/health"
+	ep.probeRTT.Store(0)
+	start := time.Now()
+	if c.healthProbe == "resolve" {
+		err := c.probeResolve(ctx, ep)
+		if err != nil {
+			c.logger.Debug("resolve probe failed", "endpoint", ep.URL, "error", err)
+			c.observeBlocking(ep, err)
+		} else {
+			ep.probeRTT.Store(int64(time.Since(start)))
+		}
+		if errcode.Of(err) != errcode.RateLimited {
+			c.recordOutcome(ep, err == nil)
+		}
+		return
+	}
 
+	healthURL := ep.route().healthURL
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
 	if err != nil {
-		ep.Healthy.Store(false)
+		c.logger.Warn("invalid health URL", "endpoint", ep.URL, "health_url", healthURL, "error", err)
+		c.recordOutcome(ep, false)
 		return
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		ep.Healthy.Store(false)
+		c.logger.Debug("health check failed", "endpoint", ep.URL, "error", err)
+		c.recordOutcome(ep, false)
+		c.observeBlocking(ep, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	ep.Healthy.Store(resp.StatusCode == http.StatusOK)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		ep.throttle(retryAfter(resp.Header.Get("Retry-After")))
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		ep.probeRTT.Store(int64(time.Since(start)))
+	}
+	c.recordOutcome(ep, resp.StatusCode == http.StatusOK)
+}
+
+// probeResolve checks an endpoint end to end by resolving the probe domain
+// through it, which also catches broken keys, encryption or upstreams that a
+// plain /health request would miss
+func (c *Client) probeResolve(ctx context.Context, ep *Endpoint) error {
+	result, err := c.exchange(ctx, ep, c.probeDomain, "A", newIdempotencyKey())
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf("%s: %s", c.probeDomain, result.Error)
+	}
+	return nil
+}
+
+// deriveHealthURL returns the /health URL next to an endpoint's resolve
+// path, e.g. https://host/api/v1/resolve becomes https://host/health. Other
+// paths get /health appended.
+func deriveHealthURL(endpointURL string) string {
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return endpointURL
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	p = strings.TrimSuffix(p, "/api/v1/resolve")
+	u.Path = p + "/health"
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// Healthy reports whether the endpoint's circuit breaker lets requests
+// through. It only looks: the request itself is admitted by resolve.
+func (ep *Endpoint) Healthy() bool {
+	return ep.breaker.available()
+}
+
+// recordOutcome feeds a request or health check result into the endpoint's
+// circuit breaker and logs state transitions
+func (c *Client) recordOutcome(ep *Endpoint, ok bool) {
+	var from, to breakerState
+	if ok {
+		ep.lastSuccess.Store(time.Now().UnixNano())
+		ep.blockStreak.Store(0)
+		from, to = ep.breaker.onSuccess()
+	} else {
+		from, to = ep.breaker.onFailure()
+	}
+	if from == to {
+		return
+	}
+	if to == stateOpen {
+		c.logger.Warn("endpoint circuit opened", "endpoint", ep.URL, "from", from.String())
+	} else {
+		c.logger.Info("endpoint circuit "+to.String(), "endpoint", ep.URL, "from", from.String())
+	}
 }
 
 // Stats returns client statistics
 func (c *Client) Stats() map[string]interface{} {
 	healthy := 0
+	endpoints := make(map[string]interface{}, len(c.endpoints))
 	for _, ep := range c.endpoints {
-		if ep.Healthy.Load() {
+		if ep.Healthy() {
 			healthy++
 		}
+		stats := ep.stats.snapshot()
+		stats["circuit"] = ep.breaker.snapshot()
+		stats["throttled"] = ep.throttledFor() > 0
+		stats["throttles"] = ep.throttles.Load()
+		failures := make(map[string]int64, numFailureClasses)
+		for class := range numFailureClasses {
+			failures[class.String()] = ep.failures[class].Load()
+		}
+		stats["failures"] = failures
+		if proto, ok := ep.proto.Load().(string); ok {
+			stats["protocol"] = proto
+		}
+		if c.blockThreshold > 0 {
+			stats["blocking"] = ep.blockingSnapshot()
+		}
+		endpoints[ep.URL] = stats
 	}
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"endpoints_total":   len(c.endpoints),
 		"endpoints_healthy": healthy,
 		"load_balancing":    c.loadBalancing,
+		"requests":          c.sched.snapshot(),
+		"endpoints":         endpoints,
+	}
+	if c.failback != nil {
+		stats["failback"] = c.failbackSnapshot()
+	}
+	if c.tuner != nil {
+		stats["tuning"] = c.tuningSnapshot()
 	}
+	return stats
 }
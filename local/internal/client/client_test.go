@@ -0,0 +1,1258 @@
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/crypto"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func newTestEndpoints(n int) []*Endpoint {
+	endpoints := make([]*Endpoint, n)
+	for i := range endpoints {
+		endpoints[i] = &Endpoint{
+			URL:     string(rune('a' + i)),
+			Weight:  1,
+			breaker: newCircuitBreaker(1, 1, time.Minute),
+		}
+	}
+	return endpoints
+}
+
+func TestSelectLatency(t *testing.T) {
+	c := &Client{endpoints: newTestEndpoints(3), loadBalancing: "latency"}
+
+	t.Run("unmeasured_first", func(t *testing.T) {
+		c.endpoints[0].stats.record(50*time.Millisecond, false)
+		if ep := c.selectLatency(); ep != c.endpoints[1] {
+			t.Errorf("Expected unmeasured endpoint b, got %s", ep.URL)
+		}
+	})
+
+	t.Run("prefers_fastest", func(t *testing.T) {
+		c.endpoints[1].stats.record(10*time.Millisecond, false)
+		c.endpoints[2].stats.record(200*time.Millisecond, false)
+
+		counts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			counts[c.selectLatency().URL]++
+		}
+		if counts["b"] < 800 {
+			t.Errorf("Expected fastest endpoint to dominate, got %v", counts)
+		}
+		if counts["a"]+counts["c"] == 0 {
+			t.Error("Expected slower endpoints to be probed occasionally")
+		}
+	})
+
+	t.Run("errors_penalized", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			c.endpoints[1].stats.record(0, true)
+		}
+		failing, _ := c.endpoints[1].stats.score()
+		slower, _ := c.endpoints[0].stats.score()
+		if failing <= slower {
+			t.Errorf("Expected failing 10ms endpoint (%.0f) to score worse than clean 50ms one (%.0f)", failing, slower)
+		}
+	})
+
+	t.Run("never_answered_last", func(t *testing.T) {
+		c := &Client{endpoints: newTestEndpoints(3), loadBalancing: "latency"}
+		// a only ever failed, as an endpoint rejecting every request does
+		for i := 0; i < 3; i++ {
+			c.endpoints[0].stats.record(time.Millisecond, true)
+		}
+		if ep := c.selectLatency(); ep != c.endpoints[1] {
+			t.Errorf("Expected untried endpoint b before failed a, got %s", ep.URL)
+		}
+		c.endpoints[1].stats.record(200*time.Millisecond, false)
+		c.endpoints[2].stats.record(100*time.Millisecond, true)
+		c.endpoints[2].stats.record(300*time.Millisecond, false)
+
+		counts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			counts[c.selectLatency().URL]++
+		}
+		if counts["a"] > 200 || counts["b"]+counts["c"] < 800 {
+			t.Errorf("Expected the endpoint that never answered to be picked only by probes, got %v", counts)
+		}
+	})
+}
+
+func TestSelectWeighted(t *testing.T) {
+	endpoints := newTestEndpoints(3)
+	endpoints[0].Weight = 5
+	endpoints[1].Weight = 1
+	endpoints[2].Weight = 1
+	endpoints[2].breaker.onFailure()
+
+	c := &Client{endpoints: endpoints}
+
+	t.Run("round_robin", func(t *testing.T) {
+		counts := map[string]int{}
+		for i := 0; i < 60; i++ {
+			counts[c.selectWeightedRoundRobin().URL]++
+		}
+		if counts["a"] != 50 || counts["b"] != 10 || counts["c"] != 0 {
+			t.Errorf("Unexpected weighted round-robin distribution: %v", counts)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		counts := map[string]int{}
+		for i := 0; i < 6000; i++ {
+			counts[c.selectWeightedRandom().URL]++
+		}
+		if counts["c"] != 0 {
+			t.Error("Unhealthy endpoint must not be selected")
+		}
+		if counts["a"] < 4500 || counts["a"] > 5500 {
+			t.Errorf("Unexpected weighted random distribution: %v", counts)
+		}
+	})
+}
+
+func TestFailback(t *testing.T) {
+	c := &Client{
+		endpoints:     newTestEndpoints(2),
+		loadBalancing: "failover",
+		failback:      newFailback(2, 3),
+		logger:        logging.Discard(),
+	}
+	primary, backup := c.endpoints[0], c.endpoints[1]
+	probe := func(primaryRTT, backupRTT time.Duration) {
+		primary.probeRTT.Store(int64(primaryRTT))
+		backup.probeRTT.Store(int64(backupRTT))
+		c.observeProbes()
+	}
+
+	c.recordOutcome(primary, false)
+	if ep := c.selectEndpoint(); ep != backup {
+		t.Fatalf("expected failover to b, got %s", ep.URL)
+	}
+
+	// Recovered, but traffic stays put until the primary proves faster
+	c.recordOutcome(primary, true)
+	if ep := c.selectEndpoint(); ep != backup {
+		t.Fatalf("expected to stay on b after the primary recovered, got %s", ep.URL)
+	}
+	probe(10*time.Millisecond, 50*time.Millisecond)
+	probe(10*time.Millisecond, 50*time.Millisecond)
+	probe(80*time.Millisecond, 50*time.Millisecond) // slower: streak resets
+	probe(10*time.Millisecond, 50*time.Millisecond)
+	probe(10*time.Millisecond, 50*time.Millisecond)
+	if ep := c.selectEndpoint(); ep != backup {
+		t.Fatalf("failed back after a broken streak, got %s", ep.URL)
+	}
+	probe(10*time.Millisecond, 50*time.Millisecond)
+	if ep := c.selectEndpoint(); ep != primary {
+		t.Errorf("expected failback to a after 3 faster probes, got %s", ep.URL)
+	}
+
+	// A failed probe of the current endpoint counts as slower
+	c.recordOutcome(primary, false)
+	c.selectEndpoint()
+	c.recordOutcome(primary, true)
+	for i := 0; i < 3; i++ {
+		probe(200*time.Millisecond, 0)
+	}
+	if ep := c.selectEndpoint(); ep != primary {
+		t.Errorf("expected failback to a while b's probes fail, got %s", ep.URL)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(3, 2, 20*time.Millisecond)
+
+	b.onFailure()
+	b.onFailure()
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("Breaker should stay closed below the failure threshold")
+	}
+
+	if _, to := b.onFailure(); to != stateOpen {
+		t.Fatalf("Expected open after 3 failures, got %s", to)
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("Open breaker must reject requests")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if ok, trial := b.allow(); !ok || !trial {
+		t.Fatal("Expected half-open trial after timeout")
+	}
+
+	if _, to := b.onFailure(); to != stateOpen {
+		t.Fatalf("Half-open failure should reopen, got %s", to)
+	}
+	b.release()
+
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	if _, to := b.onSuccess(); to != stateHalfOpen {
+		t.Fatalf("Expected half-open after one success, got %s", to)
+	}
+	b.release()
+	b.allow()
+	if _, to := b.onSuccess(); to != stateClosed {
+		t.Fatalf("Expected closed after success threshold, got %s", to)
+	}
+	b.release()
+}
+
+func TestCircuitBreakerHalfOpenTrials(t *testing.T) {
+	b := newCircuitBreaker(1, 2, 20*time.Millisecond)
+	b.onFailure()
+	time.Sleep(30 * time.Millisecond)
+
+	// Looking must not move the breaker out of open
+	if !b.available() {
+		t.Fatal("Expected a trial to be available after the timeout")
+	}
+	if state := b.snapshot()["state"]; state != "open" {
+		t.Fatalf("available changed the state to %s", state)
+	}
+
+	if ok, trial := b.allow(); !ok || !trial {
+		t.Fatal("Expected the first request to be admitted as a trial")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(); ok {
+			t.Fatal("Half-open breaker admitted a second trial while one is in flight")
+		}
+	}
+	if b.available() {
+		t.Error("available should be false while the trial is in flight")
+	}
+
+	b.onSuccess()
+	b.release()
+	if ok, trial := b.allow(); !ok || !trial {
+		t.Fatal("Expected the next trial once the first was released")
+	}
+	b.onSuccess()
+	b.release()
+	if ok, trial := b.allow(); !ok || trial {
+		t.Fatal("Expected a closed breaker to admit requests without trials")
+	}
+}
+
+func TestDeriveHealthURL(t *testing.T) {
+	tests := map[string]string{
+		"https://api.example.com/api/v1/resolve":     "https://api.example.com/health",
+		"https://api.example.com/api/v1/resolve/":    "https://api.example.com/health",
+		"https://api.example.com/dns/api/v1/resolve": "https://api.example.com/dns/health",
+		"https://api.example.com:8443/custom?x=1":    "https://api.example.com:8443/custom/health",
+		"https://api.example.com":                    "https://api.example.com/health",
+	}
+	for in, want := range tests {
+		if got := deriveHealthURL(in); got != want {
+			t.Errorf("deriveHealthURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestBootstrapStaticHosts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	boot := newBootstrapper(config.BootstrapConfig{
+		Hosts: map[string][]string{"api.invalid": {"127.0.0.1"}},
+	}, logging.Discard())
+	httpClient := &http.Client{Transport: &http.Transport{DialContext: boot.dialContext}}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://api.invalid:"+port+"/health", nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("request through bootstrap failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := boot.lookup(context.Background(), "other.invalid"); err == nil {
+		t.Error("expected lookup without bootstrap servers to fail for unknown hosts")
+	}
+}
+
+func TestPaddedEnvelope(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	cipher, err := crypto.NewKeyedCipher("2024-06", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padding := crypto.Padding{Mode: crypto.PadBlock, BlockSize: 128}
+
+	// Emulates the remote server's version 1 handling
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env EncryptedRequest
+		json.NewDecoder(r.Body).Decode(&env)
+		padded, err := cipher.Decrypt(env.Data)
+		if err != nil || env.Version != crypto.PaddingVersion || env.KeyID != "2024-06" || len(padded)%128 != 0 {
+			http.Error(w, "bad envelope", http.StatusBadRequest)
+			return
+		}
+		plain, _ := crypto.Unpad(padded)
+		var req map[string]string
+		json.Unmarshal(plain, &req)
+
+		data, _ := json.Marshal(ResolveResponse{
+			Domain:  req["domain"],
+			Records: []DNSRecord{{Name: req["domain"], Type: "A", Value: "192.0.2.1", TTL: 60}},
+		})
+		padded, _ = padding.Pad(data)
+		encrypted, _ := cipher.Encrypt(padded)
+		json.NewEncoder(w).Encode(EncryptedResponse{Version: crypto.PaddingVersion, Data: encrypted})
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.APIConfig{
+		Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k", Weight: 1}},
+		Timeout:         time.Second,
+		MaxRetries:      1,
+		HealthCheckFreq: time.Hour,
+		LoadBalancing:   "round_robin",
+		CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 3, SuccessThreshold: 1, OpenTimeout: time.Minute},
+	}, cipher, logging.Discard())
+	c.EnablePadding(padding)
+
+	resp, err := c.Resolve(context.Background(), "padded.test", "A")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if resp.Domain != "padded.test" || len(resp.Records) != 1 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestTuning(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	cipher, _ := crypto.NewCipher(key)
+
+	// Emulates a path that loses requests padded beyond 1100 bytes
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env EncryptedRequest
+		json.NewDecoder(r.Body).Decode(&env)
+		padded, err := cipher.Decrypt(env.Data)
+		if err != nil || len(padded) > 1100 {
+			http.Error(w, "lost", http.StatusBadGateway)
+			return
+		}
+		plain, _ := crypto.Unpad(padded)
+		var req map[string]string
+		json.Unmarshal(plain, &req)
+		data, _ := json.Marshal(ResolveResponse{Domain: req["domain"]})
+		encrypted, _ := cipher.Encrypt(data)
+		json.NewEncoder(w).Encode(EncryptedResponse{Data: encrypted})
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.APIConfig{
+		Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k", Weight: 1}},
+		Timeout:         time.Second,
+		MaxRetries:      1,
+		HealthCheckFreq: time.Hour,
+		LoadBalancing:   "round_robin",
+		ProbeDomain:     "probe.test",
+		CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 100, SuccessThreshold: 1, OpenTimeout: time.Minute},
+		Tuning:          config.TuningConfig{Enabled: true, Interval: time.Hour},
+	}, cipher, logging.Discard())
+	defer c.Close()
+	c.EnablePadding(crypto.Padding{Mode: crypto.PadBlock, BlockSize: 2048, MaxRandom: 1024})
+
+	if c.PayloadLimit() != 0 {
+		t.Fatalf("limit %d before tuning", c.PayloadLimit())
+	}
+	c.tuneRound()
+	if got := c.PayloadLimit(); got != 1024 {
+		t.Errorf("PayloadLimit = %d, want 1024", got)
+	}
+	if p := c.requestPadding(); p.BlockSize != 1024 || p.MaxRandom != 512 {
+		t.Errorf("padding not capped at the limit: %+v", p)
+	}
+}
+
+func TestCBOREnvelope(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	cipher, _ := crypto.NewCipher(key)
+
+	// Emulates the remote server's CBOR handling: sealed data as raw bytes
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var env binaryEnvelope
+		if r.Header.Get("Content-Type") != mediaCBOR || cbor.Unmarshal(body, &env) != nil {
+			http.Error(w, "bad envelope", http.StatusUnsupportedMediaType)
+			return
+		}
+		padded, err := cipher.Open(env.Data)
+		if err != nil {
+			http.Error(w, "bad envelope", http.StatusBadRequest)
+			return
+		}
+		plain, _ := crypto.Unpad(padded)
+		var req map[string]string
+		cbor.Unmarshal(plain, &req)
+
+		data, _ := cbor.Marshal(ResolveResponse{
+			Domain:  req["domain"],
+			Records: []DNSRecord{{Name: req["domain"], Type: "A", Value: "192.0.2.1", TTL: 60}},
+		})
+		padded, _ = crypto.Padding{}.Pad(data)
+		sealed, _ := cipher.Seal(padded)
+		w.Header().Set("Content-Type", mediaCBOR)
+		resp, _ := cbor.Marshal(binaryEnvelope{Version: crypto.PaddingVersion, Data: sealed})
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	c := NewClient(config.APIConfig{
+		Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k", Weight: 1}},
+		Timeout:         time.Second,
+		MaxRetries:      1,
+		HealthCheckFreq: time.Hour,
+		LoadBalancing:   "round_robin",
+		Encoding:        "cbor",
+		CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 3, SuccessThreshold: 1, OpenTimeout: time.Minute},
+	}, cipher, logging.Discard())
+	c.EnablePadding(crypto.Padding{Mode: crypto.PadBlock, BlockSize: 128})
+
+	resp, err := c.Resolve(context.Background(), "cbor.test", "A")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if resp.Domain != "cbor.test" || len(resp.Records) != 1 || resp.Records[0].TTL != 60 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	body := []byte(`{"domain":"example.com","type":"A"}`)
+	req, _ := http.NewRequest(http.MethodPost, "https://api.invalid/api/v1/resolve", nil)
+	if err := signRequest(req, "secret", body); err != nil {
+		t.Fatal(err)
+	}
+	ts, nonce, sig := req.Header.Get(crypto.TimestampHeader), req.Header.Get(crypto.NonceHeader), req.Header.Get(crypto.SignatureHeader)
+	if !crypto.VerifySignature("secret", ts, nonce, body, sig) {
+		t.Error("signature does not verify")
+	}
+	if crypto.VerifySignature("secret", ts, nonce, []byte(`{"domain":"evil.com"}`), sig) {
+		t.Error("signature verified a different body")
+	}
+
+	again, _ := http.NewRequest(http.MethodPost, "https://api.invalid/api/v1/resolve", nil)
+	signRequest(again, "secret", body)
+	if again.Header.Get(crypto.NonceHeader) == nonce {
+		t.Error("retries must use a fresh nonce")
+	}
+}
+
+func TestEncodeRequestSuite(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	for _, suite := range crypto.Suites {
+		cipher, err := crypto.NewSuiteCipher(suite, "", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Client{cipher: cipher}
+		body, err := c.encodeRequest(cipher, "", "example.com", "A", Flags{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var env EncryptedRequest
+		json.Unmarshal(body, &env)
+
+		want := suite
+		if suite == crypto.SuiteAES256GCM {
+			want = "" // omitted for servers predating suites
+		}
+		if env.Suite != want {
+			t.Errorf("%s: envelope alg = %q, want %q", suite, env.Suite, want)
+		}
+		if _, err := cipher.Decrypt(env.Data); err != nil {
+			t.Errorf("%s: %v", suite, err)
+		}
+	}
+}
+
+func TestEncodeRequestFlags(t *testing.T) {
+	c := &Client{}
+	tests := []struct {
+		flags Flags
+		want  string
+	}{
+		{Flags{}, `{"domain":"example.com","type":"A"}`},
+		{Flags{CheckingDisabled: true, AuthenticatedData: true}, `{"ad":true,"cd":true,"domain":"example.com","type":"A"}`},
+		{Flags{NoRecursion: true}, `{"domain":"example.com","rd":false,"type":"A"}`},
+		{Flags{NoCache: true}, `{"domain":"example.com","no_cache":true,"type":"A"}`},
+	}
+	for _, tt := range tests {
+		body, err := c.encodeRequest(nil, "", "example.com", "A", tt.flags)
+		if err != nil || string(body) != tt.want {
+			t.Errorf("%+v: %s, want %s (%v)", tt.flags, body, tt.want, err)
+		}
+	}
+}
+
+func TestSessionExchange(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	psk, _ := crypto.NewCipher(key)
+
+	// Emulates the remote: sessions are keyed by ID, and the first resolve
+	// is refused as if the server had restarted and forgotten the session
+	sessions := map[string]*crypto.Cipher{}
+	handshakes, refused := 0, false
+	open := func(c *crypto.Cipher, data string) []byte {
+		padded, err := c.Decrypt(data)
+		if err != nil {
+			return nil
+		}
+		plain, _ := crypto.Unpad(padded)
+		return plain
+	}
+	sealed := func(w http.ResponseWriter, c *crypto.Cipher, v any) {
+		data, _ := json.Marshal(v)
+		padded, _ := crypto.Padding{}.Pad(data)
+		encrypted, _ := c.Encrypt(padded)
+		json.NewEncoder(w).Encode(EncryptedResponse{Version: crypto.PaddingVersion, Data: encrypted})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/session", func(w http.ResponseWriter, r *http.Request) {
+		var env EncryptedRequest
+		json.NewDecoder(r.Body).Decode(&env)
+		var req SessionRequest
+		if err := json.Unmarshal(open(psk, env.Data), &req); err != nil {
+			http.Error(w, "bad handshake", http.StatusBadRequest)
+			return
+		}
+		handshakes++
+		kp, _ := crypto.NewKeyPair()
+		sid := string(rune('a' + handshakes))
+		sessions[sid], _ = kp.SessionCipher(psk.Suite(), sid, req.PublicKey, kp.Public())
+		sealed(w, psk, SessionResponse{ID: sid, PublicKey: kp.Public(), ExpiresIn: 3600})
+	})
+	mux.HandleFunc("/api/v1/resolve", func(w http.ResponseWriter, r *http.Request) {
+		var env EncryptedRequest
+		json.NewDecoder(r.Body).Decode(&env)
+		sc, ok := sessions[env.Session]
+		if !refused {
+			refused, ok = true, false
+		}
+		if !ok || env.KeyID != "" {
+			http.Error(w, `{"error":"unknown session","code":"protocol_mismatch"}`, http.StatusBadRequest)
+			return
+		}
+		var req map[string]string
+		json.Unmarshal(open(sc, env.Data), &req)
+		sealed(w, sc, ResolveResponse{Domain: req["domain"]})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := NewClient(config.APIConfig{
+		Endpoints:       []config.EndpointConfig{{URL: srv.URL + "/api/v1/resolve", APIKey: "k", Weight: 1}},
+		Timeout:         time.Second,
+		MaxRetries:      2,
+		HealthCheckFreq: time.Hour,
+		LoadBalancing:   "round_robin",
+		CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 3, SuccessThreshold: 1, OpenTimeout: time.Minute},
+	}, psk, logging.Discard())
+	c.EnableSessions()
+
+	resp, err := c.Resolve(context.Background(), "session.test", "A")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if resp.Domain != "session.test" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if handshakes != 2 {
+		t.Errorf("handshakes = %d, want 2 (one more after the session was refused)", handshakes)
+	}
+
+	if _, err := c.Resolve(context.Background(), "again.test", "A"); err != nil || handshakes != 2 {
+		t.Errorf("second query: err %v, handshakes %d; want the session reused", err, handshakes)
+	}
+}
+
+func TestThrottledEndpointStaysHealthy(t *testing.T) {
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, `{"error":"too many requests","code":"rate_limited"}`, http.StatusTooManyRequests)
+	}))
+	defer busy.Close()
+	idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ResolveResponse{Domain: "paced.test"})
+	}))
+	defer idle.Close()
+
+	newClient := func(urls ...string) *Client {
+		var endpoints []config.EndpointConfig
+		for _, u := range urls {
+			endpoints = append(endpoints, config.EndpointConfig{URL: u, APIKey: "k", Weight: 1})
+		}
+		return NewClient(config.APIConfig{
+			Endpoints:       endpoints,
+			Timeout:         time.Second,
+			MaxRetries:      2,
+			HealthCheckFreq: time.Hour,
+			LoadBalancing:   "failover",
+			CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 1, SuccessThreshold: 1, OpenTimeout: time.Minute},
+		}, nil, logging.Discard())
+	}
+
+	// The throttled endpoint is skipped, not taken out of rotation
+	c := newClient(busy.URL, idle.URL)
+	if _, err := c.Resolve(context.Background(), "paced.test", "A"); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	first := c.endpoints[0]
+	if !first.Healthy() || first.throttledFor() < 29*time.Second {
+		t.Errorf("busy endpoint: healthy %v, throttled for %v", first.Healthy(), first.throttledFor())
+	}
+	if c.selectEndpoint() != c.endpoints[1] {
+		t.Error("expected the idle endpoint to be picked while the other is throttled")
+	}
+
+	// With nothing else to use, a throttle longer than the query's
+	// deadline fails fast as rate limited
+	c = newClient(busy.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := c.Resolve(ctx, "paced.test", "A")
+	if errcode.Of(err) != errcode.RateLimited {
+		t.Errorf("error = %v, want rate_limited", err)
+	}
+	if !c.endpoints[0].Healthy() {
+		t.Error("throttled endpoint should stay healthy")
+	}
+}
+
+func TestLookupOptions(t *testing.T) {
+	var requests []map[string]any
+	var mu sync.Mutex
+	serve := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req map[string]any
+			json.NewDecoder(r.Body).Decode(&req)
+			req["server"] = name
+			mu.Lock()
+			requests = append(requests, req)
+			mu.Unlock()
+			switch req["domain"] {
+			case "fail.test":
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			case "slow.test":
+				time.Sleep(500 * time.Millisecond)
+			}
+			json.NewEncoder(w).Encode(ResolveResponse{Domain: req["domain"].(string)})
+		}))
+	}
+	a, b := serve("a"), serve("b")
+	defer a.Close()
+	defer b.Close()
+
+	c := NewClient(config.APIConfig{
+		Endpoints: []config.EndpointConfig{
+			{URL: a.URL, APIKey: "k", Weight: 1},
+			{URL: b.URL, APIKey: "k", Weight: 1},
+		},
+		Timeout:         time.Second,
+		MaxRetries:      3,
+		HealthCheckFreq: time.Hour,
+		LoadBalancing:   "failover",
+		CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 10, SuccessThreshold: 1, OpenTimeout: time.Minute},
+	}, nil, logging.Discard())
+	defer c.Close()
+
+	tests := []struct {
+		name    string
+		domain  string
+		opts    []Option
+		wantErr bool
+		want    []map[string]any // the requests the servers saw
+	}{
+		{"defaults", "example.com", nil, false, []map[string]any{{"domain": "example.com", "type": "A", "server": "a"}}},
+		{"pinned", "example.com", []Option{WithEndpoint(b.URL)}, false, []map[string]any{{"domain": "example.com", "type": "A", "server": "b"}}},
+		{"types and no cache", "example.com", []Option{WithRecordTypes("A", "AAAA"), WithoutCache()}, false, []map[string]any{{"domain": "example.com", "type": "A+AAAA", "no_cache": true, "server": "a"}}},
+		{"one attempt", "fail.test", []Option{WithEndpoint(a.URL), WithMaxRetries(1)}, true, []map[string]any{{"domain": "fail.test", "type": "A", "server": "a"}}},
+		{"unknown endpoint", "example.com", []Option{WithEndpoint("https://elsewhere.test/api/v1/resolve")}, true, nil},
+		{"timeout", "slow.test", []Option{WithTimeout(50 * time.Millisecond), WithMaxRetries(1)}, true, []map[string]any{{"domain": "slow.test", "type": "A", "server": "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+			_, err := c.Lookup(context.Background(), tt.domain, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(requests, tt.want) {
+				t.Errorf("requests = %v, want %v", requests, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpointProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization")); !ok || user != "u" || pass != "p w" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		proxied = append(proxied, r.URL.String())
+		json.NewEncoder(w).Encode(ResolveResponse{Domain: "proxied.test"})
+	}))
+	defer proxy.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ResolveResponse{Domain: "direct.test"})
+	}))
+	defer direct.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("u", "p w")
+	c := NewClient(config.APIConfig{
+		Endpoints: []config.EndpointConfig{
+			// Only reachable through the proxy
+			{URL: "http://tunnel.invalid/api/v1/resolve", APIKey: "k", Proxy: proxyURL.String()},
+			{URL: direct.URL, APIKey: "k"},
+		},
+		Timeout:         time.Second,
+		MaxRetries:      1,
+		HealthCheckFreq: time.Hour,
+		LoadBalancing:   "round_robin",
+	}, nil, logging.Discard())
+	defer c.Close()
+
+	domains := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		resp, err := c.Resolve(context.Background(), "x.test", "A")
+		if err != nil {
+			t.Fatalf("Resolve failed: %v", err)
+		}
+		domains[resp.Domain] = true
+	}
+	if !domains["proxied.test"] || !domains["direct.test"] {
+		t.Errorf("answers from %v, want one through the proxy and one direct", domains)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://tunnel.invalid/api/v1/resolve" {
+		t.Errorf("proxy forwarded %v", proxied)
+	}
+}
+
+// parseProxyAuth decodes a Basic Proxy-Authorization header
+func parseProxyAuth(header string) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return r.BasicAuth()
+}
+
+func TestFailureClasses(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int // 0 hangs until the caller gives up
+		code     errcode.Code
+		attempts int
+		healthy  bool
+	}{
+		{"caller_timeout", 0, errcode.TunnelDown, 1, true},
+		{"server_error", http.StatusBadGateway, errcode.TunnelDown, 3, false},
+		{"bad_key", http.StatusUnauthorized, errcode.EndpointAuth, 3, true},
+		{"policy", http.StatusForbidden, errcode.BlockedPolicy, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				if tt.status == 0 {
+					io.ReadAll(r.Body) // lets the server notice the client hanging up
+					<-r.Context().Done()
+					return
+				}
+				http.Error(w, `{"error":"no"}`, tt.status)
+			}))
+			defer srv.Close()
+
+			c := NewClient(config.APIConfig{
+				Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k"}},
+				Timeout:         5 * time.Second,
+				MaxRetries:      3,
+				RetryDelay:      time.Millisecond,
+				HealthCheckFreq: time.Hour,
+				CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 3, SuccessThreshold: 1, OpenTimeout: time.Minute},
+			}, nil, logging.Discard())
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, err := c.Resolve(ctx, "x.test", "A")
+			if code := errcode.Of(err); code != tt.code {
+				t.Errorf("code = %s, want %s (%v)", code, tt.code, err)
+			}
+			if n := int(attempts.Load()); n != tt.attempts {
+				t.Errorf("attempts = %d, want %d", n, tt.attempts)
+			}
+			if healthy := c.endpoints[0].Healthy(); healthy != tt.healthy {
+				t.Errorf("healthy = %v, want %v", healthy, tt.healthy)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":       defaultThrottle,
+		"5":      5 * time.Second,
+		"0":      0,
+		"-3":     defaultThrottle,
+		"86400":  maxThrottle,
+		"banana": defaultThrottle,
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+	}
+	for header, want := range tests {
+		if got := retryAfter(header); got != want {
+			t.Errorf("retryAfter(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ResolveResponse{Domain: "h2.test"})
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	for version, want := range map[string]string{"auto": "HTTP/1.1", "1.1": "HTTP/1.1", "2": "HTTP/2.0"} {
+		c := NewClient(config.APIConfig{
+			Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k"}},
+			Timeout:         time.Second,
+			MaxRetries:      1,
+			HealthCheckFreq: time.Hour,
+			HTTPVersion:     version,
+		}, nil, logging.Discard())
+		if _, err := c.Resolve(context.Background(), "h2.test", "A"); err != nil {
+			t.Fatalf("%s: Resolve failed: %v", version, err)
+		}
+		// Cleartext HTTP/2 is only spoken with prior knowledge
+		ep := c.Stats()["endpoints"].(map[string]interface{})[srv.URL].(map[string]interface{})
+		if ep["protocol"] != want {
+			t.Errorf("http_version %s: protocol = %v, want %s", version, ep["protocol"], want)
+		}
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ResolveResponse{Domain: "h3.test"})
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The same port over UDP, with the same certificate
+	pc, err := net.ListenPacket("udp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Skipf("UDP port of the test server is taken: %v", err)
+	}
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: srv.TLS.Certificates})}
+	go h3.Serve(pc)
+
+	resolve := func() (*Client, string) {
+		c := NewClient(config.APIConfig{
+			Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k"}},
+			Timeout:         time.Second,
+			MaxRetries:      1,
+			HealthCheckFreq: time.Hour,
+			HTTPVersion:     "3",
+		}, nil, logging.Discard())
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		tr := c.httpClient.Transport.(*h3Transport)
+		tr.h3.TLSClientConfig.RootCAs = pool
+		tr.tcp.TLSClientConfig.RootCAs = pool
+		if _, err := c.Resolve(context.Background(), "h3.test", "A"); err != nil {
+			t.Fatalf("Resolve failed: %v", err)
+		}
+		ep := c.Stats()["endpoints"].(map[string]interface{})[srv.URL].(map[string]interface{})
+		proto, _ := ep["protocol"].(string)
+		return c, proto
+	}
+
+	c, proto := resolve()
+	defer c.Close()
+	if proto != "HTTP/3.0" {
+		t.Errorf("protocol = %s, want HTTP/3.0", proto)
+	}
+
+	// Without a QUIC listener the query still gets through, over TCP, and
+	// the host is not tried over QUIC again for a while
+	h3.Close()
+	pc.Close()
+	c, proto = resolve()
+	defer c.Close()
+	if proto != "HTTP/2.0" {
+		t.Errorf("protocol after fallback = %s, want HTTP/2.0", proto)
+	}
+	if !c.httpClient.Transport.(*h3Transport).fallingBack(srv.Listener.Addr().String()) {
+		t.Error("failed host is still tried over HTTP/3")
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler(2)
+	ctx := context.Background()
+	s.acquire(ctx, PriorityInteractive)
+	s.acquire(ctx, PriorityBackground)
+
+	// Background traffic is held to half the slots even while one is free
+	s.release(PriorityInteractive)
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(short, PriorityBackground); err == nil {
+		t.Fatal("second background request got a slot")
+	}
+	s.acquire(ctx, PriorityInteractive)
+
+	// With every slot taken, a freed slot goes to the interactive waiter
+	// even though the background one queued first
+	order := make(chan Priority, 2)
+	for _, p := range []Priority{PriorityBackground, PriorityInteractive} {
+		go func(p Priority) {
+			s.acquire(ctx, p)
+			order <- p
+		}(p)
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.release(PriorityInteractive)
+	if p := <-order; p != PriorityInteractive {
+		t.Errorf("first slot went to %s", p)
+	}
+	s.release(PriorityBackground)
+	if p := <-order; p != PriorityBackground {
+		t.Errorf("second slot went to %s", p)
+	}
+
+	q := s.snapshot()["queued"].(map[string]int)
+	if q["interactive"] != 0 || q["background"] != 0 {
+		t.Errorf("queued = %v", q)
+	}
+}
+
+func TestCertificatePinning(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ResolveResponse{Domain: "pinned.test"})
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // refused handshakes
+	srv.StartTLS()
+	defer srv.Close()
+	hash := spkiHash(srv.Certificate())
+	good := base64.StdEncoding.EncodeToString(hash[:])
+	other := sha256.Sum256([]byte("rogue CA"))
+	bad := base64.StdEncoding.EncodeToString(other[:])
+
+	for _, tt := range []struct {
+		name string
+		pins []string
+		ok   bool
+	}{
+		{"unpinned", nil, true},
+		{"pinned", []string{bad, "sha256/" + good}, true},
+		{"mismatch", []string{bad}, false},
+	} {
+		c := NewClient(config.APIConfig{
+			Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k", PinSHA256: tt.pins}},
+			Timeout:         time.Second,
+			MaxRetries:      1,
+			HealthCheckFreq: time.Hour,
+		}, nil, logging.Discard())
+		// Trust the test server's certificate, as a CA would
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		c.httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+
+		_, err := c.Resolve(context.Background(), "pinned.test", "A")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, errPinMismatch) {
+			t.Errorf("%s: error = %v, want a pin mismatch", tt.name, err)
+		}
+	}
+}
+
+func TestPinSetHealthURL(t *testing.T) {
+	pin := sha256.Sum256([]byte("key"))
+	pins := newPinSet([]config.EndpointConfig{{
+		URL:        "https://api.example.com/api/v1/resolve",
+		Alternates: []string{"https://[2001:DB8::1]/api/v1/resolve"},
+		HealthURL:  "https://Status.example.net/up",
+		PinSHA256:  []string{base64.StdEncoding.EncodeToString(pin[:])},
+	}, {
+		URL:       "https://unpinned.example.org/api/v1/resolve",
+		HealthURL: "https://health.example.org/up",
+	}})
+	for _, host := range []string{"api.example.com", "2001:db8::1", "status.example.net"} {
+		if !pins[host][pin] {
+			t.Errorf("%s not pinned", host)
+		}
+	}
+	if len(pins) != 3 {
+		t.Errorf("pinned hosts %v, want only the pinned endpoint's", pins)
+	}
+}
+
+func TestGzipResponses(t *testing.T) {
+	records := make([]DNSRecord, 40)
+	for i := range records {
+		records[i] = DNSRecord{Name: "txt.test", Type: "TXT", Value: "v=spf1 include:_spf.example.com ~all", TTL: 300}
+	}
+	var accepted atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted.Store(r.Header.Get("Accept-Encoding"))
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			json.NewEncoder(w).Encode(ResolveResponse{Domain: "txt.test", Records: records})
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		json.NewEncoder(zw).Encode(ResolveResponse{Domain: "txt.test", Records: records})
+		zw.Close()
+	}))
+	defer srv.Close()
+
+	for _, compression := range []string{"gzip", "none"} {
+		c := NewClient(config.APIConfig{
+			Endpoints:       []config.EndpointConfig{{URL: srv.URL, APIKey: "k"}},
+			Timeout:         time.Second,
+			MaxRetries:      1,
+			HealthCheckFreq: time.Hour,
+			Compression:     compression,
+		}, nil, logging.Discard())
+		resp, err := c.Resolve(context.Background(), "txt.test", "TXT")
+		if err != nil {
+			t.Fatalf("%s: Resolve failed: %v", compression, err)
+		}
+		if len(resp.Records) != len(records) {
+			t.Errorf("%s: %d records, want %d", compression, len(resp.Records), len(records))
+		}
+		want := map[string]string{"gzip": "gzip", "none": ""}[compression]
+		if got := accepted.Load(); got != want {
+			t.Errorf("%s: Accept-Encoding %q, want %q", compression, got, want)
+		}
+		c.Close()
+	}
+}
+
+func TestPeers(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/peers" || r.Header.Get("X-API-Key") != "k" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"peers":[
+			{"url":"https://a.example/api/v1/resolve","healthy":true},
+			{"url":"https://b.example/api/v1/resolve","healthy":false},
+			{"url":"http://c.example/api/v1/resolve","healthy":true},
+			{"url":"b.example","healthy":true}
+		]}`))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	a := config.EndpointConfig{URL: "https://a.example/api/v1/resolve", APIKey: "k", SigningSecret: "s"}
+	c := config.EndpointConfig{URL: "http://c.example/api/v1/resolve", APIKey: "k", SigningSecret: "s"}
+	for _, tt := range []struct {
+		srv  *httptest.Server
+		want []config.EndpointConfig
+	}{
+		{plain, []config.EndpointConfig{a, c}},
+		// Cleartext peers would get the key of an https endpoint
+		{secure, []config.EndpointConfig{a}},
+	} {
+		client := NewClient(config.APIConfig{
+			Endpoints:       []config.EndpointConfig{{URL: tt.srv.URL + "/api/v1/resolve", APIKey: "k", SigningSecret: "s", HealthURL: tt.srv.URL + "/up"}},
+			Timeout:         time.Second,
+			MaxRetries:      1,
+			HealthCheckFreq: time.Hour,
+		}, nil, logging.Discard())
+		pool := x509.NewCertPool()
+		pool.AddCert(secure.Certificate())
+		client.httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+
+		peers, err := client.Peers(context.Background())
+		client.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.srv.URL, err)
+		}
+		if !reflect.DeepEqual(peers, tt.want) {
+			t.Errorf("%s: peers %+v, want %+v", tt.srv.URL, peers, tt.want)
+		}
+	}
+}
+
+func TestBlockingRotation(t *testing.T) {
+	// A middlebox answering in the server's place with its own page
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<html>Access denied</html>"))
+	}))
+	defer blocked.Close()
+	// The remote's own refusal, which is an answer and not blocking
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":"forbidden","code":"blocked_policy"}`))
+	}))
+	defer policy.Close()
+	// Resets every connection before responding
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer reset.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ResolveResponse{Domain: "rotated.test"})
+	}))
+	defer ok.Close()
+
+	newClient := func(ep config.EndpointConfig) *Client {
+		ep.APIKey = "k"
+		return NewClient(config.APIConfig{
+			Endpoints:       []config.EndpointConfig{ep},
+			Timeout:         time.Second,
+			MaxRetries:      1,
+			HealthCheckFreq: time.Hour,
+			CircuitBreaker:  config.CircuitBreakerConfig{FailureThreshold: 2, SuccessThreshold: 1, OpenTimeout: time.Minute},
+			Blocking:        config.BlockingConfig{Enabled: true, Threshold: 2},
+		}, nil, logging.Discard())
+	}
+
+	for name, url := range map[string]string{"forbidden_page": blocked.URL, "reset": reset.URL} {
+		t.Run(name, func(t *testing.T) {
+			c := newClient(config.EndpointConfig{URL: url, Alternates: []string{ok.URL}})
+			defer c.Close()
+			for i := 0; i < 2; i++ {
+				if _, err := c.Resolve(context.Background(), "x.test", "A"); err == nil {
+					t.Fatalf("query %d through the blocked route succeeded", i)
+				}
+			}
+			resp, err := c.Resolve(context.Background(), "x.test", "A")
+			if err != nil || resp.Domain != "rotated.test" {
+				t.Fatalf("after rotation: %+v, %v", resp, err)
+			}
+			stats := c.Stats()["endpoints"].(map[string]interface{})[url].(map[string]interface{})["blocking"].(map[string]interface{})
+			if stats["route"] != ok.URL || stats["rotations"] != int64(1) || stats["signals"].(map[string]int64)[name] != 2 {
+				t.Errorf("blocking stats %v", stats)
+			}
+		})
+	}
+
+	t.Run("policy", func(t *testing.T) {
+		c := newClient(config.EndpointConfig{URL: policy.URL, Alternates: []string{ok.URL}})
+		defer c.Close()
+		for i := 0; i < 3; i++ {
+			c.Resolve(context.Background(), "x.test", "A")
+		}
+		if ep := c.endpoints[0]; ep.route().url != policy.URL || ep.rotations.Load() != 0 {
+			t.Errorf("policy refusals rotated to %s", ep.route().url)
+		}
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	routes := newRoutes(config.EndpointConfig{
+		URL:        "https://a.example/api/v1/resolve",
+		Alternates: []string{"https://b.example/api/v1/resolve", "https://a.example/api/v1/resolve"},
+	}, []int{8443, 443})
+	want := []route{
+		{"https://a.example/api/v1/resolve", "https://a.example/health", "https://a.example/api/v1/session"},
+		{"https://b.example/api/v1/resolve", "https://b.example/health", "https://b.example/api/v1/session"},
+		{"https://a.example:8443/api/v1/resolve", "https://a.example:8443/health", "https://a.example:8443/api/v1/session"},
+		{"https://a.example:443/api/v1/resolve", "https://a.example:443/health", "https://a.example:443/api/v1/session"},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("routes %+v, want %+v", routes, want)
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	if got, want := interleave([]string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}), []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("interleave = %v, want %v", got, want)
+	}
+
+	// IPv6 is blackholed on the path: its attempt hangs until cancelled
+	var cancelled atomic.Bool
+	h := &happyDialer{
+		delay: 20 * time.Millisecond,
+		lookup: func(ctx context.Context, host string) ([]string, error) {
+			return []string{"192.0.2.1", "2001:db8::1"}, nil
+		},
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "[") {
+				<-ctx.Done()
+				cancelled.Store(true)
+				return nil, ctx.Err()
+			}
+			conn, _ := net.Pipe()
+			return conn, nil
+		},
+	}
+	start := time.Now()
+	conn, err := h.dialContext(context.Background(), "tcp", "api.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connected after %s; the IPv4 attempt should start after the delay", elapsed)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !cancelled.Load() {
+		t.Error("pending IPv6 attempt not cancelled")
+	}
+
+	// A failed attempt starts the next at once, and all failing fails
+	h.delay = time.Hour
+	h.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("refused " + addr)
+	}
+	if _, err := h.dialContext(context.Background(), "tcp", "api.example:443"); err == nil || !strings.Contains(err.Error(), "192.0.2.1") {
+		t.Errorf("err = %v, want the last attempt's", err)
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+// mediaCBOR is the Content-Type of CBOR bodies. Struct fields go by their
+// JSON names, so every API type has the same shape in both encodings.
+const mediaCBOR = "application/cbor"
+
+// binaryEnvelope is EncryptedRequest and EncryptedResponse in CBOR bodies,
+// with the sealed data as a byte string instead of base64 text
+type binaryEnvelope struct {
+	Version int    `json:"v,omitempty"`
+	KeyID   string `json:"kid,omitempty"`
+	Suite   string `json:"alg,omitempty"`
+	Session string `json:"sid,omitempty"`
+	Data    []byte `json:"data"`
+}
+
+// mediaType is the Content-Type of request bodies; the server answers in
+// the same one
+func (c *Client) mediaType() string {
+	if c.binary {
+		return mediaCBOR
+	}
+	return "application/json"
+}
+
+func (c *Client) marshal(v any) ([]byte, error) {
+	if c.binary {
+		return cbor.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+func (c *Client) unmarshal(data []byte, v any) error {
+	if c.binary {
+		return cbor.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// encodeEnvelope encodes a request envelope, base64-encoding the sealed
+// data for JSON
+func (c *Client) encodeEnvelope(env binaryEnvelope) ([]byte, error) {
+	if c.binary {
+		return cbor.Marshal(env)
+	}
+	return json.Marshal(EncryptedRequest{
+		Version: env.Version,
+		KeyID:   env.KeyID,
+		Suite:   env.Suite,
+		Session: env.Session,
+		Data:    base64.StdEncoding.EncodeToString(env.Data),
+	})
+}
+
+// decodeEnvelope returns the version and sealed data of an encrypted
+// response. Plaintext responses have version 0.
+func (c *Client) decodeEnvelope(body []byte) (int, []byte, error) {
+	if c.binary {
+		var env binaryEnvelope
+		if cbor.Unmarshal(body, &env) != nil {
+			return 0, nil, nil
+		}
+		return env.Version, env.Data, nil
+	}
+
+	var env EncryptedResponse
+	if json.Unmarshal(body, &env) != nil || env.Version == 0 {
+		return 0, nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(env.Data)
+	if err != nil {
+		return 0, nil, errcode.Wrap(errcode.ProtocolMismatch, "failed to decrypt response", err)
+	}
+	return env.Version, data, nil
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+// maxDecompressedSize bounds a decompressed response body, far above any
+// real answer, so a broken or hostile endpoint can't exhaust memory
+const maxDecompressedSize = 16 << 20
+
+// readBody reads a response body, decompressing it as its Content-Encoding
+// says
+func readBody(resp *http.Response) ([]byte, error) {
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return io.ReadAll(resp.Body)
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, errcode.Wrap(errcode.ProtocolMismatch, "invalid gzip response", err)
+		}
+		defer zr.Close()
+		data, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+		if err != nil {
+			return nil, errcode.Wrap(errcode.ProtocolMismatch, "invalid gzip response", err)
+		}
+		if len(data) > maxDecompressedSize {
+			return nil, errcode.New(errcode.ProtocolMismatch, fmt.Sprintf("response larger than %d bytes decompressed", maxDecompressedSize))
+		}
+		return data, nil
+	default:
+		return nil, errcode.New(errcode.ProtocolMismatch, fmt.Sprintf("unsupported response Content-Encoding %q", encoding))
+	}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// happyDialer connects to endpoint hosts with several addresses the Happy
+// Eyeballs way (RFC 8305): attempts alternate between IPv6 and IPv4 and
+// start delay apart, or at once when the previous one fails, and the first
+// connection wins. An address family blocked on the path then costs delay
+// instead of a full connect timeout.
+type happyDialer struct {
+	delay  time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newHappyDialer returns a dialer resolving hosts through boot when it is
+// set, and the system resolver otherwise
+func newHappyDialer(delay time.Duration, boot *bootstrapper) *happyDialer {
+	var d net.Dialer
+	h := &happyDialer{delay: delay, lookup: net.DefaultResolver.LookupHost, dial: d.DialContext}
+	if boot != nil {
+		h.lookup = boot.lookup
+	}
+	return h
+}
+
+func (h *happyDialer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return h.dial(ctx, network, addr)
+	}
+	ips, err := h.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := interleave(ips)
+	for i, ip := range addrs {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return h.dialParallel(ctx, network, addrs)
+}
+
+// interleave orders ips IPv6 first, alternating between the families and
+// otherwise keeping the resolver's order
+func interleave(ips []string) []string {
+	var v6, v4 []string
+	for _, ip := range ips {
+		if a, err := netip.ParseAddr(ip); err == nil && a.Unmap().Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	out := make([]string, 0, len(ips))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// dialParallel races connection attempts to addrs in order, starting each
+// delay after the last or as soon as one fails. The losers are cancelled,
+// and closed if they connect anyway.
+func (h *happyDialer) dialParallel(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := h.dial(ctx, network, addr)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(h.delay)
+			}
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.err == nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, nil
+			}
+			lastErr = a.err
+			if next < len(addrs) {
+				start()
+				timer.Reset(h.delay)
+			}
+		}
+	}
+	return nil, lastErr
+}
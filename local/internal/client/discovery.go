@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+// peersResponse is a remote's list of its cluster's nodes
+type peersResponse struct {
+	Peers []struct {
+		URL     string `json:"url"`
+		Healthy bool   `json:"healthy"`
+	} `json:"peers"`
+}
+
+// Peers asks an endpoint for its cluster's nodes and returns the healthy
+// ones as endpoints. They get the settings of the endpoint that listed them
+// (API key, signing secret, pins, proxy), which nodes of one cluster share,
+// but not its alternates. An https endpoint's peers must be https too, so
+// a node cannot move clients and their keys to cleartext.
+func (c *Client) Peers(ctx context.Context) ([]config.EndpointConfig, error) {
+	ep := c.selectEndpoint()
+	if ep == nil {
+		return nil, errcode.New(errcode.TunnelDown, "no healthy endpoints available")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, derivePeersURL(ep.route().url), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", ep.APIKey)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; DNS-Client/1.0)")
+	if c.gzip {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if ep.signingSecret != "" {
+		if err := signRequest(req, ep.signingSecret, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	p := priorityOf(ctx)
+	if err := c.sched.acquire(ctx, p); err != nil {
+		return nil, err
+	}
+	defer c.sched.release(p)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.checkTLS(ep, resp.TLS)
+
+	body, err := readBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpError{status: resp.StatusCode, err: apiError(resp.StatusCode, body), fromAPI: fromAPI(resp)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	var list peersResponse
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, errcode.Wrap(errcode.ProtocolMismatch, "invalid peers response", err)
+	}
+
+	secure := strings.HasPrefix(ep.cfg.URL, "https://")
+	var peers []config.EndpointConfig
+	for _, peer := range list.Peers {
+		u, err := url.Parse(peer.URL)
+		if !peer.Healthy || err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			continue
+		}
+		if secure && u.Scheme != "https" {
+			c.logger.Warn("ignoring cleartext peer of an https endpoint", "endpoint", ep.URL, "peer", peer.URL)
+			continue
+		}
+		cfg := ep.cfg
+		cfg.URL = peer.URL
+		cfg.HealthURL = ""
+		cfg.Alternates = nil // addresses of the listing node, not of its peers
+		peers = append(peers, cfg)
+	}
+	return peers, nil
+}
+
+// derivePeersURL returns the peers endpoint next to an endpoint's resolve
+// path, e.g. https://host/api/v1/resolve becomes https://host/api/v1/peers
+func derivePeersURL(endpointURL string) string {
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return endpointURL
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		p = p[:i]
+	}
+	u.Path = p + "/peers"
+	u.RawPath = ""
+	return u.String()
+}
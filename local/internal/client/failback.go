@@ -0,0 +1,109 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+// failback makes failover load balancing sticky. Plain failover returns to
+// the first endpoint the moment its circuit closes, which flaps when a
+// primary recovers slowly or comes back degraded. With failback, traffic
+// stays on the endpoint it failed over to, and an earlier (preferred)
+// endpoint only gets it back after being healthy and answering health
+// checks faster than the current one for probes consecutive checks.
+type failback struct {
+	probes int
+
+	mu      sync.Mutex
+	current int   // index of the endpoint in use
+	streaks []int // per endpoint: consecutive health checks it beat the current one
+}
+
+func newFailback(endpoints, probes int) *failback {
+	return &failback{probes: probes, streaks: make([]int, endpoints)}
+}
+
+// moveTo makes endpoint i the current one. Called with mu held.
+func (f *failback) moveTo(i int) {
+	f.current = i
+	clear(f.streaks)
+}
+
+// selectFailback picks the current endpoint, or the next ready one after it
+// in list order. The current endpoint only changes when its circuit is
+// open; one that is merely throttled keeps its place.
+func (c *Client) selectFailback() *Endpoint {
+	f := c.failback
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := len(c.endpoints)
+	current := c.endpoints[f.current]
+	for k := 0; k < n; k++ {
+		i := (f.current + k) % n
+		ep := c.endpoints[i]
+		if !ep.ready() {
+			continue
+		}
+		if i != f.current && !current.Healthy() {
+			c.logger.Warn("endpoint failover", "from", current.URL, "to", ep.URL)
+			f.moveTo(i)
+		}
+		return ep
+	}
+	return c.selectThrottled()
+}
+
+// observeProbes updates the failback streaks after a round of health
+// checks. An endpoint earlier than the current one extends its streak when
+// it is healthy and its probe was faster than the current endpoint's; any
+// other round resets it. The earliest endpoint reaching the required streak
+// takes over.
+func (c *Client) observeProbes() {
+	f := c.failback
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current := c.endpoints[f.current]
+	currentRTT := time.Duration(current.probeRTT.Load())
+	for i := 0; i < f.current; i++ {
+		ep := c.endpoints[i]
+		rtt := time.Duration(ep.probeRTT.Load())
+		if rtt > 0 && ep.Healthy() && (currentRTT == 0 || rtt < currentRTT) {
+			f.streaks[i]++
+		} else {
+			f.streaks[i] = 0
+		}
+	}
+	for i := 0; i < f.current; i++ {
+		if f.streaks[i] < f.probes {
+			continue
+		}
+		ep := c.endpoints[i]
+		c.logger.Info("endpoint failback",
+			"from", current.URL,
+			"to", ep.URL,
+			"probes", f.streaks[i],
+			"latency_ms", float64(time.Duration(ep.probeRTT.Load()).Microseconds())/1000,
+			"from_latency_ms", float64(currentRTT.Microseconds())/1000,
+		)
+		f.moveTo(i)
+		return
+	}
+}
+
+// failbackSnapshot returns the endpoint in use and the streaks of earlier ones
+func (c *Client) failbackSnapshot() map[string]interface{} {
+	f := c.failback
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	streaks := make(map[string]int, f.current)
+	for i := 0; i < f.current; i++ {
+		streaks[c.endpoints[i].URL] = f.streaks[i]
+	}
+	return map[string]interface{}{
+		"current": c.endpoints[f.current].URL,
+		"streaks": streaks,
+	}
+}
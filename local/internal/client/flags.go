@@ -0,0 +1,25 @@
+package client
+
+import "context"
+
+// Flags are the DNS header bits of a client's query, passed on to the
+// remote so its upstreams see them. The zero value is a plain recursive
+// query, which sends no flags.
+type Flags struct {
+	CheckingDisabled  bool // CD: the client validates DNSSEC itself
+	AuthenticatedData bool // AD (or DO): the client wants to know if the answer was validated
+	NoRecursion       bool // RD clear
+	NoCache           bool // the remote resolves even if it has the answer cached
+}
+
+type flagsKey struct{}
+
+// WithFlags returns a context whose queries carry flags f
+func WithFlags(ctx context.Context, f Flags) context.Context {
+	return context.WithValue(ctx, flagsKey{}, f)
+}
+
+func flagsOf(ctx context.Context) Flags {
+	f, _ := ctx.Value(flagsKey{}).(Flags)
+	return f
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// h3Retry is how long a host whose HTTP/3 connection failed is reached
+// over TCP before HTTP/3 is tried again
+const h3Retry = 5 * time.Minute
+
+// h3Transport sends requests over HTTP/3 and falls back to tcp (HTTP/2 or
+// HTTP/1.1) for hosts it cannot reach that way, as networks that block or
+// throttle UDP are common where the tunnel is needed. Proxied endpoints
+// always go over tcp, the proxies speaking TCP only.
+type h3Transport struct {
+	h3    *http3.Transport
+	tcp   *http.Transport
+	proxy func(*http.Request) (*url.URL, error) // tcp's, nil without proxies
+
+	mu     sync.Mutex
+	failed map[string]time.Time // host: when HTTP/3 may be tried again
+}
+
+// newH3Transport returns an h3Transport with tcp's TLS settings. The QUIC
+// handshake gets half the request timeout, leaving the rest for the
+// fallback.
+func newH3Transport(tcp *http.Transport, timeout time.Duration, boot *bootstrapper) *h3Transport {
+	t := &h3Transport{
+		h3: &http3.Transport{
+			TLSClientConfig: tcp.TLSClientConfig.Clone(),
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: timeout / 2},
+		},
+		tcp:    tcp,
+		proxy:  tcp.Proxy,
+		failed: make(map[string]time.Time),
+	}
+	if boot != nil {
+		t.h3.Dial = boot.dialQUIC
+	}
+	return t
+}
+
+func (t *h3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || t.proxied(req) || t.fallingBack(req.URL.Host) {
+		return t.tcp.RoundTrip(req)
+	}
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	t.mu.Lock()
+	t.failed[req.URL.Host] = time.Now().Add(h3Retry)
+	t.mu.Unlock()
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, gerr := req.GetBody()
+		if gerr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.tcp.RoundTrip(req)
+}
+
+func (t *h3Transport) proxied(req *http.Request) bool {
+	if t.proxy == nil {
+		return false
+	}
+	u, _ := t.proxy(req)
+	return u != nil
+}
+
+// fallingBack reports whether host's HTTP/3 connection failed recently
+func (t *h3Transport) fallingBack(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.failed[host]
+	if ok && time.Now().After(until) {
+		delete(t.failed, host)
+		return false
+	}
+	return ok
+}
+
+func (t *h3Transport) CloseIdleConnections() {
+	t.h3.CloseIdleConnections()
+	t.tcp.CloseIdleConnections()
+}
+
+// dialQUIC is dialContext for QUIC connections
+func (b *bootstrapper) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+	}
+
+	ips, err := b.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := quic.DialAddrEarly(ctx, net.JoinHostPort(ip, port), tlsCfg, cfg)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
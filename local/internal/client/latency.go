@@ -0,0 +1,122 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// ewmaAlpha weights the newest sample in the moving averages
+	ewmaAlpha = 0.3
+	// probeRate is the share of requests sent to a non-best endpoint so
+	// that its latency estimate stays current when network paths change
+	probeRate = 0.1
+	// minSuccessRate caps the penalty for endpoints that almost always fail
+	minSuccessRate = 0.05
+)
+
+// latencyStats tracks exponentially weighted latency and error rate
+type latencyStats struct {
+	mu        sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	samples   int
+}
+
+func (l *latencyStats) record(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	errSample := 0.0
+	if failed {
+		errSample = 1.0
+	}
+
+	if l.samples == 0 {
+		l.errorRate = errSample
+		if !failed {
+			l.latency = latency
+		}
+	} else {
+		l.errorRate = ewmaAlpha*errSample + (1-ewmaAlpha)*l.errorRate
+		if !failed {
+			if l.latency == 0 {
+				l.latency = latency
+			} else {
+				l.latency = time.Duration(ewmaAlpha*float64(latency) + (1-ewmaAlpha)*float64(l.latency))
+			}
+		}
+	}
+	l.samples++
+}
+
+// score returns the ranking score (lower is better) and whether the
+// endpoint has been tried yet. The score is the expected time per
+// successful answer: latency divided by success rate. An endpoint that
+// has only ever failed ranks last.
+func (l *latencyStats) score() (float64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.samples == 0 {
+		return 0, false
+	}
+	if l.latency == 0 {
+		return math.Inf(1), true
+	}
+	success := 1 - l.errorRate
+	if success < minSuccessRate {
+		success = minSuccessRate
+	}
+	return float64(l.latency) / success, true
+}
+
+func (l *latencyStats) snapshot() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]interface{}{
+		"latency_ms": float64(l.latency.Microseconds()) / 1000,
+		"error_rate": l.errorRate,
+		"samples":    l.samples,
+	}
+}
+
+// selectLatency prefers the healthy endpoint with the best latency score.
+// Endpoints never tried are tried first, and a small share of traffic
+// probes the others.
+func (c *Client) selectLatency() *Endpoint {
+	var healthy []*Endpoint
+	for _, ep := range c.endpoints {
+		if ep.ready() {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		return c.selectFailover()
+	}
+
+	var best *Endpoint
+	bestScore := 0.0
+	for _, ep := range healthy {
+		score, measured := ep.stats.score()
+		if !measured {
+			return ep
+		}
+		if best == nil || score < bestScore {
+			best, bestScore = ep, score
+		}
+	}
+
+	if len(healthy) > 1 && rand.Float64() < probeRate {
+		for {
+			ep := healthy[rand.Intn(len(healthy))]
+			if ep != best {
+				return ep
+			}
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Option tunes one Lookup, overriding the client's configuration for it
+type Option func(*lookupOptions)
+
+type lookupOptions struct {
+	timeout  time.Duration
+	endpoint string
+	attempts int
+	types    []string
+	noCache  bool
+}
+
+// WithTimeout bounds the whole lookup, retries included
+func WithTimeout(d time.Duration) Option {
+	return func(o *lookupOptions) { o.timeout = d }
+}
+
+// WithEndpoint sends the lookup to the endpoint with URL u only, healthy or
+// not, instead of the one the load balancing picks
+func WithEndpoint(u string) Option {
+	return func(o *lookupOptions) { o.endpoint = u }
+}
+
+// WithMaxRetries makes at most n attempts instead of api.max_retries
+func WithMaxRetries(n int) Option {
+	return func(o *lookupOptions) { o.attempts = n }
+}
+
+// WithRecordTypes asks for the given record types, answered together;
+// lookups ask for A records otherwise
+func WithRecordTypes(types ...string) Option {
+	return func(o *lookupOptions) { o.types = append(o.types, types...) }
+}
+
+// WithoutCache has the remote resolve the name even if it has the answer
+// cached. The fresh answer replaces the cached one.
+func WithoutCache() Option {
+	return func(o *lookupOptions) { o.noCache = true }
+}
+
+// Lookup resolves domain like Resolve, with opts applied to this lookup
+// alone. Without options it asks for A records as configured.
+func (c *Client) Lookup(ctx context.Context, domain string, opts ...Option) (*ResolveResponse, error) {
+	o := lookupOptions{attempts: c.maxRetries}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.attempts < 1 {
+		o.attempts = 1
+	}
+
+	var pinned *Endpoint
+	if o.endpoint != "" {
+		for _, ep := range c.endpoints {
+			if ep.URL == o.endpoint {
+				pinned = ep
+				break
+			}
+		}
+		if pinned == nil {
+			return nil, fmt.Errorf("no endpoint %q", o.endpoint)
+		}
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	if o.noCache {
+		flags := flagsOf(ctx)
+		flags.NoCache = true
+		ctx = WithFlags(ctx, flags)
+	}
+	recordType := "A"
+	if len(o.types) > 0 {
+		recordType = strings.Join(o.types, "+")
+	}
+	return c.resolve(ctx, domain, recordType, pinned, o.attempts)
+}
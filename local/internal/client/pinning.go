@@ -0,0 +1,123 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// errPinMismatch is a server whose certificate chain carries none of the
+// pinned keys: a CA vouched for it, but it isn't the configured server
+var errPinMismatch = errors.New("certificate chain matches no pinned key")
+
+// pinSet holds the pinned SPKI hashes per server name
+type pinSet map[string]map[[sha256.Size]byte]bool
+
+// newPinSet collects the endpoints' pins by hostname, their alternates' and
+// health URLs' included, so no request of an endpoint runs unpinned. Endpoints without pins are not checked beyond normal TLS
+// verification. Config validation rejects malformed pins; any that get here
+// still leave their host pinned, so it fails closed.
+func newPinSet(endpoints []config.EndpointConfig) pinSet {
+	pins := make(pinSet)
+	for _, ep := range endpoints {
+		if len(ep.PinSHA256) == 0 {
+			continue
+		}
+		urls := append([]string{ep.URL}, ep.Alternates...)
+		if ep.HealthURL != "" {
+			urls = append(urls, ep.HealthURL)
+		}
+		for _, raw := range urls {
+			u, err := url.Parse(raw)
+			if err != nil {
+				continue
+			}
+			host := strings.ToLower(u.Hostname())
+			if ip, err := netip.ParseAddr(host); err == nil {
+				host = ip.String()
+			}
+			if pins[host] == nil {
+				pins[host] = make(map[[sha256.Size]byte]bool)
+			}
+			for _, pin := range ep.PinSHA256 {
+				if hash, err := parsePin(pin); err == nil {
+					pins[host][hash] = true
+				}
+			}
+		}
+	}
+	return pins
+}
+
+// parsePin decodes a base64 SHA-256 hash of a SubjectPublicKeyInfo, as
+// printed by
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func parsePin(pin string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	if err != nil || len(raw) != sha256.Size {
+		return hash, fmt.Errorf("pin %q is not a base64 SHA-256 hash", pin)
+	}
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+// spkiHash returns the pin of a certificate's public key
+func spkiHash(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// verify is a tls.Config VerifyConnection hook. It runs after the chain
+// has been verified and accepts it if any certificate in it, leaf or CA,
+// has a pinned key, so a pin on the issuing CA survives certificate renewals.
+func (p pinSet) verify(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	for _, name := range serverNames(cs) {
+		want := p[name]
+		if want == nil {
+			continue
+		}
+		if !chainPinned(cs.VerifiedChains, want) {
+			return fmt.Errorf("%s: %w", name, errPinMismatch)
+		}
+	}
+	return nil
+}
+
+// serverNames returns the names the connection was verified for. No SNI is
+// sent to an IP address, so the server is known by the IP addresses its
+// verified certificate is valid for.
+func serverNames(cs tls.ConnectionState) []string {
+	if cs.ServerName != "" {
+		return []string{strings.ToLower(cs.ServerName)}
+	}
+	var names []string
+	for _, ip := range cs.VerifiedChains[0][0].IPAddresses {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			names = append(names, addr.Unmap().String())
+		}
+	}
+	return names
+}
+
+func chainPinned(chains [][]*x509.Certificate, want map[[sha256.Size]byte]bool) bool {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if want[spkiHash(cert)] {
+				return true
+			}
+		}
+	}
+	return false
+}
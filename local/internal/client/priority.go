@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority ranks API requests when capacity is short
+type Priority int
+
+const (
+	// PriorityInteractive is for queries a client is waiting on
+	PriorityInteractive Priority = iota
+	// PriorityBackground is for prefetches, decoys and resolve probes,
+	// which yield to interactive queries
+	PriorityBackground
+)
+
+func (p Priority) String() string {
+	if p == PriorityBackground {
+		return "background"
+	}
+	return "interactive"
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose API requests are sent at priority p.
+// Requests are interactive unless marked otherwise.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// scheduler caps the requests in flight. Freed slots go to waiting
+// interactive requests first, and background requests may hold at most half
+// of the slots, so a burst of prefetches can't make user queries queue.
+type scheduler struct {
+	mu         sync.Mutex
+	limit      int
+	inFlight   int
+	background int
+	waiting    [2][]chan struct{} // FIFO per priority
+}
+
+// newScheduler returns a scheduler for limit requests, or nil (no limit)
+// for limit <= 0
+func newScheduler(limit int) *scheduler {
+	if limit <= 0 {
+		return nil
+	}
+	return &scheduler{limit: limit}
+}
+
+// backgroundLimit is the share of slots background requests may hold
+func (s *scheduler) backgroundLimit() int {
+	return max(s.limit/2, 1)
+}
+
+// canRun reports whether a request of priority p may take a slot now.
+// Called with mu held.
+func (s *scheduler) canRun(p Priority) bool {
+	if s.inFlight >= s.limit {
+		return false
+	}
+	if p == PriorityInteractive {
+		return true
+	}
+	return len(s.waiting[PriorityInteractive]) == 0 && s.background < s.backgroundLimit()
+}
+
+// take marks a slot used. Called with mu held.
+func (s *scheduler) take(p Priority) {
+	s.inFlight++
+	if p == PriorityBackground {
+		s.background++
+	}
+}
+
+// acquire waits for a slot for a request of priority p
+func (s *scheduler) acquire(ctx context.Context, p Priority) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if len(s.waiting[p]) == 0 && s.canRun(p) {
+		s.take(p)
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.waiting[p] = append(s.waiting[p], ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, ch := range s.waiting[p] {
+			if ch == ready {
+				s.waiting[p] = append(s.waiting[p][:i], s.waiting[p][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// The slot was granted while giving up; pass it on
+		s.free(p)
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of a request of priority p
+func (s *scheduler) release(p Priority) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.free(p)
+}
+
+// free returns a slot and hands slots to waiters, interactive ones first.
+// Called with mu held.
+func (s *scheduler) free(p Priority) {
+	s.inFlight--
+	if p == PriorityBackground {
+		s.background--
+	}
+	for _, q := range []Priority{PriorityInteractive, PriorityBackground} {
+		for len(s.waiting[q]) > 0 && s.canRun(q) {
+			s.take(q)
+			close(s.waiting[q][0])
+			s.waiting[q] = s.waiting[q][1:]
+		}
+	}
+}
+
+// snapshot returns the requests in flight and queued per priority
+func (s *scheduler) snapshot() map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"limit":     s.limit,
+		"in_flight": s.inFlight,
+		"queued": map[string]int{
+			PriorityInteractive.String(): len(s.waiting[PriorityInteractive]),
+			PriorityBackground.String():  len(s.waiting[PriorityBackground]),
+		},
+	}
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// proxySet holds the outbound proxy per endpoint host (host:port as in the
+// endpoint URL). Hosts without one are dialed directly; proxy environment
+// variables are not used.
+type proxySet map[string]*url.URL
+
+// newProxySet collects the endpoints' proxies by the hosts their requests
+// go to, the health URL's and every alternate route's included. Config
+// validation rejects malformed proxy URLs.
+func newProxySet(endpoints []config.EndpointConfig, ports []int) proxySet {
+	proxies := make(proxySet)
+	for _, ep := range endpoints {
+		if ep.Proxy == "" {
+			continue
+		}
+		proxy, err := url.Parse(ep.Proxy)
+		if err != nil {
+			continue
+		}
+		for _, raw := range routeURLs(ep, ports) {
+			if u, err := url.Parse(raw); err == nil && u.Host != "" {
+				proxies[u.Host] = proxy
+			}
+		}
+	}
+	return proxies
+}
+
+// proxy is an http.Transport Proxy hook. HTTP and HTTPS proxies are asked
+// to CONNECT (or, for http:// endpoints, to forward the request), SOCKS5
+// proxies to open a stream; credentials in the proxy URL authenticate both.
+func (p proxySet) proxy(req *http.Request) (*url.URL, error) {
+	return p[req.URL.Host], nil
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/crypto"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+// SessionRequest opens a session; it is sealed with the pre-shared key
+type SessionRequest struct {
+	PublicKey []byte `json:"pub"`
+}
+
+// SessionResponse completes the key exchange
+type SessionResponse struct {
+	ID        string `json:"sid"`
+	PublicKey []byte `json:"pub"`
+	ExpiresIn int    `json:"expires_in"` // seconds
+}
+
+// apiSession is an open session with one endpoint
+type apiSession struct {
+	cipher  *crypto.Cipher
+	renewAt time.Time
+}
+
+// EnableSessions seals queries with keys from an ephemeral X25519 exchange
+// with each endpoint, so a leaked pre-shared key can't decrypt recorded
+// traffic; the pre-shared key then only authenticates the exchange. It has
+// no effect without a cipher and needs a remote with sessions enabled.
+func (c *Client) EnableSessions() {
+	c.sessions = c.cipher != nil
+}
+
+// session returns the endpoint's session cipher, opening a new session when
+// there is none or the current one is close to expiring
+func (c *Client) session(ctx context.Context, ep *Endpoint) (*crypto.Cipher, error) {
+	if s := ep.session.Load(); s != nil && time.Now().Before(s.renewAt) {
+		return s.cipher, nil
+	}
+
+	ep.sessionMu.Lock()
+	defer ep.sessionMu.Unlock()
+	if s := ep.session.Load(); s != nil && time.Now().Before(s.renewAt) {
+		return s.cipher, nil
+	}
+
+	s, err := c.handshake(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+	ep.session.Store(s)
+	c.logger.Debug("session opened", "endpoint", ep.URL, "renew_at", s.renewAt)
+	return s.cipher, nil
+}
+
+// handshake performs the key exchange with an endpoint. Both messages are
+// sealed with the pre-shared key, so neither side accepts a public key
+// from anyone without it.
+func (c *Client) handshake(ctx context.Context, ep *Endpoint) (*apiSession, error) {
+	kp, err := crypto.NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.marshal(SessionRequest{PublicKey: kp.Public()})
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.seal(c.cipher, "", req, crypto.PaddingVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.doRequest(ctx, ep, ep.route().sessionURL, body, "")
+	if err != nil {
+		return nil, fmt.Errorf("session handshake: %w", err)
+	}
+	if version, _, err := c.decodeEnvelope(data); err != nil || version < crypto.PaddingVersion {
+		return nil, errcode.New(errcode.ProtocolMismatch, "session response is not sealed")
+	}
+	var resp SessionResponse
+	if err := c.open(c.cipher, data, &resp); err != nil {
+		return nil, err
+	}
+
+	sc, err := kp.SessionCipher(c.cipher.Suite(), resp.ID, kp.Public(), resp.PublicKey)
+	if err != nil {
+		return nil, errcode.Wrap(errcode.ProtocolMismatch, "session handshake", err)
+	}
+	// Renew with a tenth of the lifetime left, well before the server
+	// forgets the session
+	lifetime := time.Duration(resp.ExpiresIn) * time.Second
+	return &apiSession{cipher: sc, renewAt: time.Now().Add(lifetime * 9 / 10)}, nil
+}
+
+// deriveSessionURL returns the session endpoint next to an endpoint's
+// resolve path, e.g. https://host/api/v1/data becomes
+// https://host/api/v1/session
+func deriveSessionURL(endpointURL string) string {
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return endpointURL
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		p = p[:i]
+	}
+	u.Path = p + "/session"
+	u.RawPath = ""
+	return u.String()
+}
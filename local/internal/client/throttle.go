@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+const (
+	// defaultThrottle applies to 429 responses without a usable Retry-After
+	defaultThrottle = time.Second
+	// maxThrottle caps Retry-After, so one response can't keep an endpoint
+	// out of rotation for long
+	maxThrottle = time.Minute
+)
+
+// ready reports whether the endpoint is healthy and not throttled. A
+// throttled endpoint is skipped while others are ready, but its circuit
+// stays closed: 429 means busy, not broken.
+func (ep *Endpoint) ready() bool {
+	return ep.throttledFor() <= 0 && ep.Healthy()
+}
+
+// throttle holds requests to the endpoint back for d
+func (ep *Endpoint) throttle(d time.Duration) {
+	ep.throttles.Add(1)
+	until := time.Now().Add(d).UnixNano()
+	for {
+		old := ep.throttleUntil.Load()
+		if old >= until || ep.throttleUntil.CompareAndSwap(old, until) {
+			return
+		}
+	}
+}
+
+// throttledFor returns how long the endpoint is still throttled
+func (ep *Endpoint) throttledFor() time.Duration {
+	return time.Until(time.Unix(0, ep.throttleUntil.Load()))
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date
+func retryAfter(header string) time.Duration {
+	d := defaultThrottle
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		d = time.Until(t)
+	}
+	return min(max(d, 0), maxThrottle)
+}
+
+// pace waits out the endpoint's throttle. That only happens when every
+// healthy endpoint is throttled; if the wait would outlast ctx, the query
+// fails at once instead. Background requests never wait, leaving the
+// endpoint's first free moments to interactive queries.
+func pace(ctx context.Context, ep *Endpoint) error {
+	wait := ep.throttledFor()
+	if wait <= 0 {
+		return nil
+	}
+	if priorityOf(ctx) == PriorityBackground {
+		return errcode.New(errcode.RateLimited, "all endpoints are throttled")
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		return errcode.New(errcode.RateLimited, "all endpoints are throttled")
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/crypto"
+)
+
+// probeSizes are the padded request sizes a tuning round tries, smallest
+// first. Paths through tunnels and PPPoE links with a broken path MTU lose
+// the packets of larger requests while small ones get through.
+var probeSizes = []int{256, 512, 1024, 1400, 2048, 4096}
+
+// tuner probes the path to the endpoints for the largest request that gets
+// through, so padding doesn't push requests past it
+type tuner struct {
+	interval time.Duration
+	limit    atomic.Int64 // largest size that got through; 0 while unknown or unbounded
+	rounds   atomic.Int64
+	probes   atomic.Int64
+}
+
+// PayloadLimit returns the largest padded request the path was seen to
+// carry when larger ones failed, or 0 if none did or tuning is disabled
+func (c *Client) PayloadLimit() int {
+	if c.tuner == nil {
+		return 0
+	}
+	return int(c.tuner.limit.Load())
+}
+
+// tune runs a tuning round every interval until the client is closed
+func (c *Client) tune() {
+	ticker := time.NewTicker(c.tuner.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		c.tuneRound()
+	}
+}
+
+// tuneRound probes the endpoint the load balancing picks with ever larger
+// requests. The first size to fail twice in a row bounds the path at the
+// size before it; if even the smallest fails the round tells nothing.
+func (c *Client) tuneRound() {
+	ep := c.selectEndpoint()
+	if ep == nil {
+		return
+	}
+	c.tuner.rounds.Add(1)
+	limit := 0
+	for i, size := range probeSizes {
+		err := c.probePayload(ep, size)
+		if err != nil {
+			// Once more, so one lost request doesn't lower the limit
+			err = c.probePayload(ep, size)
+		}
+		if err == nil {
+			continue
+		}
+		if i == 0 {
+			c.logger.Debug("payload probe failed at the smallest size", "endpoint", ep.URL, "error", err)
+			return
+		}
+		limit = probeSizes[i-1]
+		break
+	}
+	if old := c.tuner.limit.Swap(int64(limit)); old != int64(limit) {
+		c.logger.Info("path payload limit changed", "endpoint", ep.URL, "limit", limit, "previous", old)
+	}
+}
+
+// probePayload resolves the probe domain through ep with the request
+// padded to size bytes. The smallest probes' round trips feed the
+// endpoint's latency estimate.
+func (c *Client) probePayload(ep *Endpoint, size int) error {
+	c.tuner.probes.Add(1)
+	ctx, cancel := context.WithTimeout(WithPriority(context.Background(), PriorityBackground), c.timeout)
+	defer cancel()
+
+	cipher, sid := c.cipher, ""
+	if c.sessions {
+		var err error
+		if cipher, err = c.session(ctx, ep); err != nil {
+			return err
+		}
+		sid = cipher.ID()
+	}
+	data, err := c.marshal(map[string]any{"domain": c.probeDomain, "type": "A"})
+	if err != nil {
+		return err
+	}
+	body, err := c.sealPadded(cipher, sid, data, crypto.PaddingVersion, crypto.Padding{Mode: crypto.PadBlock, BlockSize: size})
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := c.doRequest(ctx, ep, ep.route().url, body, newIdempotencyKey())
+	if err != nil {
+		return err
+	}
+	var result ResolveResponse
+	if err := c.open(cipher, resp, &result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf("%s: %s", c.probeDomain, result.Error)
+	}
+	if size == probeSizes[0] {
+		ep.stats.record(time.Since(start), false)
+	}
+	return nil
+}
+
+// requestPadding returns the padding for requests: the configured one,
+// with blocks and random padding kept within the path's payload limit
+func (c *Client) requestPadding() crypto.Padding {
+	p := c.padding
+	limit := c.PayloadLimit()
+	if limit == 0 {
+		return p
+	}
+	if p.BlockSize > limit {
+		p.BlockSize = limit
+	}
+	if p.MaxRandom > limit/2 {
+		p.MaxRandom = limit / 2
+	}
+	return p
+}
+
+// tuningSnapshot returns the tuner's findings
+func (c *Client) tuningSnapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"payload_limit": c.tuner.limit.Load(),
+		"rounds":        c.tuner.rounds.Load(),
+		"probes":        c.tuner.probes.Load(),
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"math/rand"
+)
+
+// weight returns the endpoint's configured weight, treating unset as 1
+func (ep *Endpoint) weight() int {
+	if ep.Weight <= 0 {
+		return 1
+	}
+	return ep.Weight
+}
+
+// selectWeightedRoundRobin implements smooth weighted round-robin (as in
+// nginx): each healthy endpoint gains its weight per pick and the leader is
+// chosen and pushed back by the total, which spreads picks evenly instead of
+// sending bursts to the heaviest endpoint.
+func (c *Client) selectWeightedRoundRobin() *Endpoint {
+	c.wrrMu.Lock()
+	defer c.wrrMu.Unlock()
+
+	var best *Endpoint
+	total := 0
+	for _, ep := range c.endpoints {
+		if !ep.ready() {
+			continue
+		}
+		w := ep.weight()
+		ep.currentWeight += w
+		total += w
+		if best == nil || ep.currentWeight > best.currentWeight {
+			best = ep
+		}
+	}
+
+	if best == nil {
+		return c.selectFailover()
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// selectWeightedRandom picks a healthy endpoint with probability
+// proportional to its weight
+func (c *Client) selectWeightedRandom() *Endpoint {
+	total := 0
+	for _, ep := range c.endpoints {
+		if ep.ready() {
+			total += ep.weight()
+		}
+	}
+	if total == 0 {
+		return c.selectFailover()
+	}
+
+	n := rand.Intn(total)
+	for _, ep := range c.endpoints {
+		if !ep.ready() {
+			continue
+		}
+		n -= ep.weight()
+		if n < 0 {
+			return ep
+		}
+	}
+	return c.selectFailover()
+}
@@ -1,81 +1,540 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
 )
 
 // Config holds all configuration for the local DNS server
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	API      APIConfig      `yaml:"api"`
-	Cache    CacheConfig    `yaml:"cache"`
-	Security SecurityConfig `yaml:"security"`
-	Logging  LoggingConfig  `yaml:"logging"`
+	Server          ServerConfig          `yaml:"server"`
+	API             APIConfig             `yaml:"api"`
+	Cache           CacheConfig           `yaml:"cache"`
+	Security        SecurityConfig        `yaml:"security"`
+	Logging         LoggingConfig         `yaml:"logging"`
+	QueryLog        QueryLogConfig        `yaml:"query_log"`
+	Dnstap          DnstapConfig          `yaml:"dnstap"`
+	Pcap            PcapConfig            `yaml:"pcap"`
+	Anomaly         AnomalyConfig         `yaml:"anomaly"`
+	QueryValidation QueryValidationConfig `yaml:"query_validation"`
+	QueryPolicy     QueryPolicyConfig     `yaml:"query_policy"`
+	Rewrite         RewriteConfig         `yaml:"rewrite"`
+	Hosts           HostsConfig           `yaml:"hosts"`
+	Response        ResponseConfig        `yaml:"response"`
+	DNS64           DNS64Config           `yaml:"dns64"`
+	LocalAnswers    LocalAnswersConfig    `yaml:"local_answers"`
+	SpecialUse      SpecialUseConfig      `yaml:"special_use"`
+	PrivateReverse  PrivateReverseConfig  `yaml:"private_reverse"`
+	MDNS            MDNSConfig            `yaml:"mdns"`
+	BandwidthSaver  BandwidthSaverConfig  `yaml:"bandwidth_saver"`
+	Fallback        FallbackConfig        `yaml:"fallback"`
+	Record          RecordConfig          `yaml:"record"`
+	Obfuscation     ObfuscationConfig     `yaml:"obfuscation"`
+	Report          ReportConfig          `yaml:"report"`
+	Admin           AdminConfig           `yaml:"admin"`
+
+	Preset string `yaml:"preset"` // strict-privacy, performance or low-bandwidth; settings given explicitly override it
+
+	Profile  string                   `yaml:"profile"` // profile active at startup; empty for the settings above
+	Profiles map[string]ProfileConfig `yaml:"profiles"`
+}
+
+// DefaultProfile names the top-level endpoints and rules as a profile
+const DefaultProfile = "default"
+
+// ProfileConfig is a named endpoint set with its rules (e.g. "home",
+// "travel"), which can be switched to at runtime. Settings left out keep
+// their top-level values.
+type ProfileConfig struct {
+	Endpoints     []EndpointConfig `yaml:"endpoints"`      // replaces api.endpoints
+	LoadBalancing string           `yaml:"load_balancing"` // replaces api.load_balancing
+	NAT           []NATRule        `yaml:"nat"`            // replaces response.nat
+	Fallback      *FallbackConfig  `yaml:"fallback"`       // replaces fallback
+}
+
+// AdminConfig holds the local control interface used by the profile command
+type AdminConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	ListenAddr string `yaml:"listen_addr"` // host:port; keep it on loopback
+	Token      string `yaml:"token"`       // when set, requests need "Authorization: Bearer <token>"
 }
 
 // ServerConfig holds DNS server settings
 type ServerConfig struct {
-	ListenAddr string `yaml:"listen_addr"`
-	Port       int    `yaml:"port"`
-	Protocol   string `yaml:"protocol"` // udp, tcp, both
+	ListenAddr      string              `yaml:"listen_addr"`
+	ListenAddrs     []string            `yaml:"listen_addrs"` // several addresses, e.g. ["127.0.0.1", "::1"]; replaces listen_addr. "::" is every IPv4 and IPv6 address
+	Port            int                 `yaml:"port"`
+	Protocol        string              `yaml:"protocol"` // udp, tcp, both
+	ProxyProtocol   ProxyProtocolConfig `yaml:"proxy_protocol"`
+	AllowedNetworks []string            `yaml:"allowed_networks"`    // client CIDRs answered; others get REFUSED. Empty allows all
+	CacheOnly       []string            `yaml:"cache_only_networks"` // client CIDRs answered only from the cache; misses get REFUSED
+	DoT             DoTConfig           `yaml:"dot"`
+	MaxInFlight     int                 `yaml:"max_in_flight"`  // queries resolved through the API at once; beyond it SERVFAIL. 0 for no limit
+	MaxPerClient    int                 `yaml:"max_per_client"` // queries in progress per client (device or IP); beyond it REFUSED. 0 for no limit
+}
+
+// Addresses returns the addresses the listeners bind: listen_addrs, or
+// listen_addr when it is empty
+func (s ServerConfig) Addresses() []string {
+	if len(s.ListenAddrs) > 0 {
+		return s.ListenAddrs
+	}
+	return []string{s.ListenAddr}
+}
+
+// DoTConfig holds the DNS-over-TLS listener settings
+type DoTConfig struct {
+	Enabled           bool   `yaml:"enabled"`
+	Port              int    `yaml:"port"`
+	CertFile          string `yaml:"cert_file"`
+	KeyFile           string `yaml:"key_file"`
+	ClientCAFile      string `yaml:"client_ca_file"`      // CA that signs device certificates
+	RequireClientCert bool   `yaml:"require_client_cert"` // refuse clients without a device certificate
+}
+
+// ProxyProtocolConfig holds HAProxy PROXY protocol settings for the TCP listener
+type ProxyProtocolConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	TrustedNetworks []string `yaml:"trusted_networks"` // CIDRs whose PROXY headers are used; empty trusts all
 }
 
 // APIConfig holds remote API settings
 type APIConfig struct {
-	Endpoints       []EndpointConfig `yaml:"endpoints"`
-	Timeout         time.Duration    `yaml:"timeout"`
-	MaxRetries      int              `yaml:"max_retries"`
-	RetryDelay      time.Duration    `yaml:"retry_delay"`
-	HealthCheckFreq time.Duration    `yaml:"health_check_freq"`
-	LoadBalancing   string           `yaml:"load_balancing"` // round_robin, random, failover
+	Endpoints       []EndpointConfig     `yaml:"endpoints"`
+	Timeout         time.Duration        `yaml:"timeout"`
+	MaxRetries      int                  `yaml:"max_retries"`
+	RetryDelay      time.Duration        `yaml:"retry_delay"`
+	MaxInFlight     int                  `yaml:"max_in_flight"` // concurrent API requests; background traffic gets at most half
+	HealthCheckFreq time.Duration        `yaml:"health_check_freq"`
+	LoadBalancing   string               `yaml:"load_balancing"`    // round_robin, failover, latency, weighted_round_robin, weighted_random
+	HealthProbe     string               `yaml:"health_probe"`      // http (GET health_url) or resolve (query probe_domain)
+	ProbeDomain     string               `yaml:"probe_domain"`      // sentinel domain for resolve probes
+	Encoding        string               `yaml:"encoding"`          // json or cbor request and response bodies
+	Compression     string               `yaml:"compression"`       // gzip (accept compressed responses) or none
+	HTTPVersion     string               `yaml:"http_version"`      // auto, 1.1, 2 (h2c with prior knowledge for http:// endpoints) or 3 (falling back to TCP)
+	TLSMinVersion   string               `yaml:"tls_min_version"`   // 1.2 or 1.3
+	TLSSessionCache int                  `yaml:"tls_session_cache"` // resumable sessions kept; -1 disables resumption
+	CircuitBreaker  CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Failback        FailbackConfig       `yaml:"failback"`
+	Bootstrap       BootstrapConfig      `yaml:"bootstrap"`
+	Discovery       DiscoveryConfig      `yaml:"discovery"`
+	Blocking        BlockingConfig       `yaml:"blocking"`
+	Tuning          TuningConfig         `yaml:"tuning"`
+	HappyEyeballs   HappyEyeballsConfig  `yaml:"happy_eyeballs"`
+}
+
+// HappyEyeballsConfig holds racing connections to the addresses of
+// endpoint hosts with several, alternating IPv6 and IPv4 (RFC 8305)
+type HappyEyeballsConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Delay   time.Duration `yaml:"delay"` // before starting the next attempt while the last is pending
+}
+
+// TuningConfig holds probing of the path to the endpoints for the largest
+// request that gets through, which caps padding and the UDP size offered to
+// DNS clients
+type TuningConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"` // between probe rounds
+}
+
+// BlockingConfig holds detection of endpoints blocked on the network path
+// and rotation to other addresses of the same server
+type BlockingConfig struct {
+	Enabled        bool  `yaml:"enabled"`
+	Threshold      int   `yaml:"threshold"`       // consecutive signs of blocking before rotating
+	AlternatePorts []int `yaml:"alternate_ports"` // tried on each endpoint's host after its alternates, e.g. the remote's extra_ports
+}
+
+// DiscoveryConfig holds refreshing the endpoints from the remotes' lists of
+// their cluster's nodes
+type DiscoveryConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Interval  time.Duration `yaml:"interval"`   // how often the node list is fetched
+	StateFile string        `yaml:"state_file"` // keeps discovered endpoints across restarts; empty keeps them in memory
+}
+
+// FailbackConfig holds when failover load balancing returns to an earlier
+// endpoint after failing over from it
+type FailbackConfig struct {
+	Enabled bool `yaml:"enabled"` // stay on the failover endpoint until an earlier one proves faster
+	Probes  int  `yaml:"probes"`  // consecutive health checks the earlier endpoint must be healthy and faster
+}
+
+// CircuitBreakerConfig holds per-endpoint circuit breaker settings
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"` // consecutive failures that open the circuit
+	OpenTimeout      time.Duration `yaml:"open_timeout"`      // wait before half-open trial requests
+	SuccessThreshold int           `yaml:"success_threshold"` // half-open successes needed to close
+}
+
+// BootstrapConfig holds how endpoint hostnames are resolved without the
+// system resolver, which may point back at this proxy
+type BootstrapConfig struct {
+	Servers []string            `yaml:"servers"` // plain DNS servers (host:port) for endpoint hostnames
+	Hosts   map[string][]string `yaml:"hosts"`   // static hostname -> IPs, takes precedence
+	Refresh time.Duration       `yaml:"refresh"` // re-resolution interval for pinned addresses
 }
 
 // EndpointConfig holds configuration for a single API endpoint
 type EndpointConfig struct {
-	URL    string `yaml:"url"`
-	APIKey string `yaml:"api_key"`
-	Weight int    `yaml:"weight"` // For weighted load balancing
+	URL           string   `yaml:"url"`
+	APIKey        string   `yaml:"api_key"`
+	Weight        int      `yaml:"weight"`         // For weighted load balancing
+	HealthURL     string   `yaml:"health_url"`     // defaults to /health next to the resolve path
+	SigningSecret string   `yaml:"signing_secret"` // HMAC secret when the server requires signed requests
+	PinSHA256     []string `yaml:"pin_sha256"`     // base64 SHA-256 hashes of accepted server or CA public keys
+	Proxy         string   `yaml:"proxy"`          // http://, https:// or socks5:// proxy URL, with user:password@ if it needs auth
+	Alternates    []string `yaml:"alternates"`     // other URLs of the same server (backup hostnames or ports), rotated to when it seems blocked
 }
 
 // CacheConfig holds DNS cache settings
 type CacheConfig struct {
-	Enabled     bool          `yaml:"enabled"`
-	MaxItems    int           `yaml:"max_items"`
-	DefaultTTL  time.Duration `yaml:"default_ttl"`
-	MinTTL      time.Duration `yaml:"min_ttl"`
-	MaxTTL      time.Duration `yaml:"max_ttl"`
-	NegativeTTL time.Duration `yaml:"negative_ttl"` // For NXDOMAIN caching
+	Enabled     bool           `yaml:"enabled"`
+	MaxItems    int            `yaml:"max_items"`
+	DefaultTTL  time.Duration  `yaml:"default_ttl"`
+	MinTTL      time.Duration  `yaml:"min_ttl"`
+	MaxTTL      time.Duration  `yaml:"max_ttl"`
+	NegativeTTL time.Duration  `yaml:"negative_ttl"` // For NXDOMAIN caching
+	Prefetch    PrefetchConfig `yaml:"prefetch"`
+	// Resolve A and AAAA in one API request on a miss for either, and cache both
+	PairAddresses bool `yaml:"pair_addresses"`
+}
+
+// BandwidthSaverConfig trades freshness for fewer tunnel requests during
+// peak hours, or once most of the endpoints' daily request quota is used
+type BandwidthSaverConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Hours         []string      `yaml:"hours"`          // local-time windows, HH:MM-HH:MM; may cross midnight
+	DailyRequests int64         `yaml:"daily_requests"` // API requests a day the endpoints allow; 0 for no quota
+	Threshold     float64       `yaml:"threshold"`      // share of daily_requests after which the saver turns on
+	TTLFactor     float64       `yaml:"ttl_factor"`     // cached answers stay fresh this many times their TTL
+	MaxStale      time.Duration `yaml:"max_stale"`      // and are then served stale for at most this long
+}
+
+// PrefetchConfig holds settings for refreshing popular entries before expiry
+type PrefetchConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	MinHits     int     `yaml:"min_hits"`    // hits before an entry counts as popular
+	Window      float64 `yaml:"window"`      // refresh when this fraction of the TTL remains
+	Concurrency int     `yaml:"concurrency"` // max refreshes in flight
 }
 
 // SecurityConfig holds security settings
 type SecurityConfig struct {
-	EncryptionEnabled bool   `yaml:"encryption_enabled"`
-	EncryptionKey     string `yaml:"encryption_key"` // 32 bytes hex for AES-256
+	EncryptionEnabled bool          `yaml:"encryption_enabled"`
+	EncryptionKey     string        `yaml:"encryption_key"`    // 32 bytes hex for AES-256
+	EncryptionKeyID   string        `yaml:"encryption_key_id"` // names the key to the server; empty for its unnamed key
+	CipherSuite       string        `yaml:"cipher_suite"`      // aes-256-gcm or xchacha20-poly1305
+	Padding           PaddingConfig `yaml:"padding"`
+	Sessions          SessionConfig `yaml:"sessions"`
+}
+
+// SessionConfig enables per-session X25519 key exchange with each endpoint.
+// Queries are then sealed with session keys, which gives forward secrecy:
+// a leaked encryption_key can't decrypt recorded traffic.
+type SessionConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// PaddingConfig sets how encrypted requests are padded. Anything but none
+// also asks the server for encrypted, padded responses, which needs a server
+// that understands envelope version 1.
+type PaddingConfig struct {
+	Mode      string `yaml:"mode"`       // none, block, random
+	BlockSize int    `yaml:"block_size"` // block mode: round payloads up to a multiple of this
+	MaxRandom int    `yaml:"max_random"` // random mode: up to this many extra bytes
 }
 
 // LoggingConfig holds logging settings
 type LoggingConfig struct {
-	Level      string `yaml:"level"`
-	Format     string `yaml:"format"`
-	OutputFile string `yaml:"output_file"`
+	Level      string `yaml:"level"`       // debug, info, warn, error
+	Format     string `yaml:"format"`      // json, text
+	OutputFile string `yaml:"output_file"` // empty for stdout
+	MaxSizeMB  int    `yaml:"max_size_mb"` // rotate output_file after this size; 0 for 100, -1 never rotates
+	MaxBackups int    `yaml:"max_backups"` // rotated files to keep; 0 for 3, -1 keeps none
+}
+
+// QueryLogConfig holds per-query log settings
+type QueryLogConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Output      string `yaml:"output"`       // file, syslog
+	File        string `yaml:"file"`         // path when output is file
+	MaxSizeMB   int    `yaml:"max_size_mb"`  // rotate file after this size; 0 for 100, -1 never rotates
+	MaxBackups  int    `yaml:"max_backups"`  // rotated files to keep; 0 for 3, -1 keeps none
+	AnonymizeIP string `yaml:"anonymize_ip"` // none, truncate, hash
+	HashQNames  bool   `yaml:"hash_qnames"`  // log a salted hash instead of the name
+	HashSalt    string `yaml:"hash_salt"`
+}
+
+// DnstapConfig holds dnstap output settings
+type DnstapConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Network   string `yaml:"network"` // unix, tcp
+	Address   string `yaml:"address"` // socket path or host:port
+	Identity  string `yaml:"identity"`
+	QueueSize int    `yaml:"queue_size"` // frames buffered before dropping
+}
+
+// PcapConfig holds capture of client queries and responses to pcap files
+type PcapConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	File       string  `yaml:"file"`
+	SampleRate float64 `yaml:"sample_rate"` // share of query/response pairs captured, 0-1
+	MaxSizeMB  int     `yaml:"max_size_mb"` // rotate file after this size; 0 for 100, -1 never rotates
+	MaxBackups int     `yaml:"max_backups"` // rotated files to keep; 0 for 3, -1 keeps none
+}
+
+// RecordConfig holds recording of API exchanges for offline replay
+type RecordConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	File      string `yaml:"file"`
+	MaxSizeMB int    `yaml:"max_size_mb"` // rotate after this size; one previous file is kept
+}
+
+// FallbackConfig holds the plain-DNS upstreams used when every API endpoint
+// fails. Fallback queries are not private.
+type FallbackConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Upstreams []string      `yaml:"upstreams"` // host:port
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// DNS64Config synthesizes AAAA records from A answers (RFC 6147) for
+// IPv6-only client networks behind a NAT64 gateway
+type DNS64Config struct {
+	Enabled bool     `yaml:"enabled"`
+	Prefix  string   `yaml:"prefix"`  // NAT64 prefix; default the well-known 64:ff9b::/96
+	Clients []string `yaml:"clients"` // client CIDRs answered with synthesized records; empty for all
+}
+
+// LocalAnswersConfig holds the built-in answers for localhost, loopback
+// reverse lookups and this host's own names, which are given without the
+// cache, rules or tunnel so they work with no connectivity at all
+type LocalAnswersConfig struct {
+	Disabled  bool          `yaml:"disabled"`  // send these names through like any other
+	Hostnames []string      `yaml:"hostnames"` // this host's names; default the system hostname
+	Addresses []string      `yaml:"addresses"` // addresses the hostnames resolve to; default the listen addresses
+	TTL       time.Duration `yaml:"ttl"`
+}
+
+// SpecialUseConfig keeps special-use names (RFC 6761), which mean nothing
+// on the public DNS, out of the tunnel by answering them NXDOMAIN
+type SpecialUseConfig struct {
+	Disabled bool          `yaml:"disabled"` // send them through like any other name
+	Domains  []string      `yaml:"domains"`  // more names treated the same, with their subdomains, e.g. ["lan"]
+	TTL      time.Duration `yaml:"ttl"`
+}
+
+// PrivateReverseConfig answers reverse lookups of private addresses
+// locally, from static names or with NXDOMAIN, so they don't reveal the
+// LAN's addressing to the tunnel (RFC 6303)
+type PrivateReverseConfig struct {
+	Enabled  bool              `yaml:"enabled"`
+	Networks []string          `yaml:"networks"` // CIDRs kept local; default RFC 1918, shared, link-local and unique local ranges
+	Hosts    map[string]string `yaml:"hosts"`    // address -> name its PTR answers with, e.g. "192.168.1.10": "nas.lan"
+	TTL      time.Duration     `yaml:"ttl"`
 }
 
-// Load loads configuration from a YAML file
-func Load(path string) (*Config, error) {
+// MDNSConfig advertises the server on the LAN with multicast DNS as a
+// DNS-SD _dns._udp service, so devices browsing for DNS servers find it
+type MDNSConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Instance  string   `yaml:"instance"`  // service name shown to users; default "DNS proxy on <hostname>"
+	Hostname  string   `yaml:"hostname"`  // .local name the service points at; default the system hostname
+	Interface string   `yaml:"interface"` // network interface to advertise on; empty for the system's default
+	Addresses []string `yaml:"addresses"` // addresses advertised; default the listen addresses (the host's with 0.0.0.0 or ::)
+}
+
+// ResponseConfig holds post-processing applied to every answer sent to clients
+type ResponseConfig struct {
+	AnswerOrder string        `yaml:"answer_order"` // fixed (sorted), rotate, random (A/AAAA records)
+	MinTTL      time.Duration `yaml:"min_ttl"`      // TTL floor sent to clients; 0 disables
+	MaxTTL      time.Duration `yaml:"max_ttl"`      // TTL ceiling sent to clients; 0 disables
+	NAT         []NATRule     `yaml:"nat"`          // public -> internal address rewrites
+}
+
+// NATRule answers LAN clients with the internal address of a self-hosted
+// service whose public DNS points at the router, for routers that can't
+// hairpin NAT
+type NATRule struct {
+	Public   string   `yaml:"public"`   // address in upstream answers
+	Internal string   `yaml:"internal"` // address sent to clients instead
+	Domains  []string `yaml:"domains"`  // names rewritten, with their subdomains; empty rewrites every answer
+}
+
+// AnomalyConfig holds DGA / subdomain flood detection settings
+type AnomalyConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	Window           time.Duration `yaml:"window"`            // observation window per client
+	MinQueries       int           `yaml:"min_queries"`       // queries in a window before the DGA ratio is judged
+	EntropyThreshold float64       `yaml:"entropy_threshold"` // bits per character for a label to look random
+	DGARatio         float64       `yaml:"dga_ratio"`         // share of random-looking names that flags a client
+	SubdomainLimit   int           `yaml:"subdomain_limit"`   // distinct names under one parent per window
+	Throttle         bool          `yaml:"throttle"`          // answer REFUSED to flagged clients
+	ThrottleDuration time.Duration `yaml:"throttle_duration"`
+}
+
+// QueryValidationConfig holds the checks each query name must pass at the
+// listener before it is sent through the tunnel
+type QueryValidationConfig struct {
+	Enabled          bool    `yaml:"enabled"`
+	Action           string  `yaml:"action"`             // reject (answer REFUSED) or flag (count and resolve anyway)
+	MaxNameLength    int     `yaml:"max_name_length"`    // characters, without the trailing dot
+	MaxLabelLength   int     `yaml:"max_label_length"`   // characters per label
+	EntropyThreshold float64 `yaml:"entropy_threshold"`  // bits per character for a label to count as random; 0 disables
+	EntropyMinLength int     `yaml:"entropy_min_length"` // shorter labels are not judged by entropy
+}
+
+// QueryPolicyConfig holds the query types answered REFUSED or not at all,
+// and how names are normalized before they are sent through the tunnel
+type QueryPolicyConfig struct {
+	RefuseTypes    []string `yaml:"refuse_types"`    // answered REFUSED, e.g. ANY, NULL
+	DropTypes      []string `yaml:"drop_types"`      // left unanswered, so abusers only see timeouts
+	LowercaseNames bool     `yaml:"lowercase_names"` // strip 0x20 case randomization from names sent to the remote
+}
+
+// RewriteConfig holds rules answering names with fixed addresses or
+// resolving other names in their place, and rewriting CNAME targets in
+// answers
+type RewriteConfig struct {
+	Rules []RewriteRule `yaml:"rules"` // in order: the first rule matching a name applies
+	TTL   time.Duration `yaml:"ttl"`   // of fixed answers and the CNAMEs of redirects
+}
+
+// RewriteRule matches a name exactly, its subdomains ("*.dev.example.com")
+// or a regular expression between slashes ('/^ads?[0-9]*\./'), and does
+// one of: answer with fixed addresses, redirect the query to another name
+// before resolution, or, after resolution, point CNAMEs whose target it
+// matches at another name
+type RewriteRule struct {
+	Match    string   `yaml:"match"`
+	Answer   []string `yaml:"answer"`   // IPv4/IPv6 addresses answered to A/AAAA queries
+	Redirect string   `yaml:"redirect"` // name resolved instead, answered with a CNAME to it; * and $1 take the wildcard's or regex's match
+	CNAME    string   `yaml:"cname"`    // new target for CNAMEs pointing at a matching name
+}
+
+// check reports whether the rule has a valid pattern and exactly one action
+func (r RewriteRule) check() error {
+	switch pattern, ok := RewritePattern(r.Match); {
+	case ok:
+		if _, err := regexp.Compile(pattern); err != nil {
+			return err
+		}
+	case strings.Trim(r.Match, "*.") == "" || strings.Contains(strings.TrimPrefix(r.Match, "*."), "*"):
+		return fmt.Errorf("match must be a name, *.name or /regex/")
+	}
+	actions := 0
+	for _, set := range []bool{len(r.Answer) > 0, r.Redirect != "", r.CNAME != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("needs exactly one of answer, redirect and cname")
+	}
+	for _, a := range r.Answer {
+		if net.ParseIP(a) == nil {
+			return fmt.Errorf("answer %q is not an IP address", a)
+		}
+	}
+	for _, name := range []string{r.Redirect, r.CNAME} {
+		if _, ok := dns.IsDomainName(name); name != "" && !ok {
+			return fmt.Errorf("%q is not a domain name", name)
+		}
+	}
+	return nil
+}
+
+// RewritePattern returns the regular expression of a /regex/ match
+func RewritePattern(match string) (string, bool) {
+	if len(match) < 2 || !strings.HasPrefix(match, "/") || !strings.HasSuffix(match, "/") {
+		return "", false
+	}
+	return match[1 : len(match)-1], true
+}
+
+// HostsConfig answers A and AAAA queries from hosts-format files, such as
+// /etc/hosts or ad-block lists pointing names at 0.0.0.0, which are
+// reloaded when they change
+type HostsConfig struct {
+	Files []string      `yaml:"files"` // read in order; a name in several files gets all their addresses
+	TTL   time.Duration `yaml:"ttl"`
+}
+
+// ObfuscationConfig holds traffic shaping settings for the API channel
+type ObfuscationConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	JitterMin     time.Duration `yaml:"jitter_min"`     // shortest random delay before each API request
+	JitterMax     time.Duration `yaml:"jitter_max"`     // longest random delay; 0 disables jitter
+	ChaffInterval time.Duration `yaml:"chaff_interval"` // mean gap between decoy queries; 0 disables them
+	ChaffDomains  []string      `yaml:"chaff_domains"`  // decoy pool; defaults to popular sites
+}
+
+// ReportConfig holds the scheduled usage summary sent by webhook or email
+type ReportConfig struct {
+	Enabled    bool        `yaml:"enabled"`
+	Schedule   string      `yaml:"schedule"`    // daily, or weekly (Mondays)
+	At         string      `yaml:"at"`          // local time of day, HH:MM
+	TopDomains int         `yaml:"top_domains"` // most queried names listed
+	WebhookURL string      `yaml:"webhook_url"` // receives the report as JSON
+	Email      EmailConfig `yaml:"email"`
+}
+
+// EmailConfig holds the SMTP delivery of reports
+type EmailConfig struct {
+	SMTPAddr string   `yaml:"smtp_addr"` // host:port; empty disables email
+	Username string   `yaml:"username"`  // PLAIN auth; empty sends without auth
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// defaultChaffDomains are resolved as decoys when no pool is configured
+var defaultChaffDomains = []string{
+	"google.com", "youtube.com", "instagram.com", "whatsapp.com", "wikipedia.org",
+	"github.com", "microsoft.com", "apple.com", "amazon.com", "cloudflare.com",
+	"telegram.org", "twitter.com", "linkedin.com", "yahoo.com", "bing.com",
+}
+
+// Load loads configuration from a YAML file. Values are layered: the file
+// first, then DNS_PROXY_* environment variables, then overrides
+// ("path=value", usually from -set flags), before defaults are applied.
+func Load(path string, overrides ...string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	if err := checkSchema(path, data); err != nil {
+		return nil, fmt.Errorf("invalid config file:\n%w", err)
+	}
+
 	cfg := &Config{}
+	if err := cfg.applyPreset(data, overrides); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := cfg.applyOverrides(overrides); err != nil {
+		return nil, fmt.Errorf("invalid override: %w", err)
+	}
+
 	cfg.setDefaults()
 
 	if err := cfg.validate(); err != nil {
@@ -95,9 +554,15 @@ func (c *Config) setDefaults() {
 	if c.Server.Protocol == "" {
 		c.Server.Protocol = "udp"
 	}
+	if c.Server.DoT.Port == 0 {
+		c.Server.DoT.Port = 853
+	}
 	if c.API.Timeout == 0 {
 		c.API.Timeout = 10 * time.Second
 	}
+	if c.API.MaxInFlight == 0 {
+		c.API.MaxInFlight = 64
+	}
 	if c.API.MaxRetries == 0 {
 		c.API.MaxRetries = 3
 	}
@@ -110,6 +575,54 @@ func (c *Config) setDefaults() {
 	if c.API.LoadBalancing == "" {
 		c.API.LoadBalancing = "round_robin"
 	}
+	if c.API.CircuitBreaker.FailureThreshold == 0 {
+		c.API.CircuitBreaker.FailureThreshold = 3
+	}
+	if c.API.CircuitBreaker.OpenTimeout == 0 {
+		c.API.CircuitBreaker.OpenTimeout = 30 * time.Second
+	}
+	if c.API.CircuitBreaker.SuccessThreshold == 0 {
+		c.API.CircuitBreaker.SuccessThreshold = 2
+	}
+	if c.API.Failback.Probes == 0 {
+		c.API.Failback.Probes = 3
+	}
+	if c.API.Bootstrap.Refresh == 0 {
+		c.API.Bootstrap.Refresh = 10 * time.Minute
+	}
+	if c.API.Blocking.Threshold == 0 {
+		c.API.Blocking.Threshold = 3
+	}
+	if c.API.HappyEyeballs.Delay == 0 {
+		c.API.HappyEyeballs.Delay = 250 * time.Millisecond
+	}
+	if c.API.Tuning.Interval == 0 {
+		c.API.Tuning.Interval = 10 * time.Minute
+	}
+	if c.API.Discovery.Interval == 0 {
+		c.API.Discovery.Interval = 15 * time.Minute
+	}
+	if c.API.HealthProbe == "" {
+		c.API.HealthProbe = "http"
+	}
+	if c.API.Encoding == "" {
+		c.API.Encoding = "json"
+	}
+	if c.API.Compression == "" {
+		c.API.Compression = "gzip"
+	}
+	if c.API.HTTPVersion == "" {
+		c.API.HTTPVersion = "auto"
+	}
+	if c.API.ProbeDomain == "" {
+		c.API.ProbeDomain = "example.com"
+	}
+	if c.API.TLSMinVersion == "" {
+		c.API.TLSMinVersion = "1.2"
+	}
+	if c.API.TLSSessionCache == 0 {
+		c.API.TLSSessionCache = 64
+	}
 	if c.Cache.MaxItems == 0 {
 		c.Cache.MaxItems = 10000
 	}
@@ -125,18 +638,269 @@ func (c *Config) setDefaults() {
 	if c.Cache.NegativeTTL == 0 {
 		c.Cache.NegativeTTL = 5 * time.Minute
 	}
-	if c.Logging.Level == "" {
+	if c.Cache.Prefetch.MinHits == 0 {
+		c.Cache.Prefetch.MinHits = 3
+	}
+	if c.Cache.Prefetch.Window == 0 {
+		c.Cache.Prefetch.Window = 0.1
+	}
+	if c.Cache.Prefetch.Concurrency == 0 {
+		c.Cache.Prefetch.Concurrency = 4
+	}
+	if c.Security.CipherSuite == "" {
+		c.Security.CipherSuite = "aes-256-gcm"
+	}
+	if c.Security.Padding.Mode == "" {
+		c.Security.Padding.Mode = "none"
+	}
+	if c.Security.Padding.BlockSize == 0 {
+		c.Security.Padding.BlockSize = 128
+	}
+	if c.Security.Padding.MaxRandom == 0 {
+		c.Security.Padding.MaxRandom = 256
+	}
+	// Level names as logging.ParseLevel takes them, in any case and
+	// with "warning" for warn
+	c.Logging.Level = strings.ToLower(c.Logging.Level)
+	switch c.Logging.Level {
+	case "":
 		c.Logging.Level = "info"
+	case "warning":
+		c.Logging.Level = "warn"
 	}
+	c.Logging.Format = strings.ToLower(c.Logging.Format)
 	if c.Logging.Format == "" {
 		c.Logging.Format = "text"
 	}
+	if c.Logging.MaxSizeMB == 0 {
+		c.Logging.MaxSizeMB = 100
+	}
+	if c.Logging.MaxBackups == 0 {
+		c.Logging.MaxBackups = 3
+	}
+	if c.QueryLog.Output == "" {
+		c.QueryLog.Output = "file"
+	}
+	if c.QueryLog.File == "" {
+		c.QueryLog.File = "query.log"
+	}
+	if c.QueryLog.MaxSizeMB == 0 {
+		c.QueryLog.MaxSizeMB = 100
+	}
+	if c.QueryLog.MaxBackups == 0 {
+		c.QueryLog.MaxBackups = 3
+	}
+	if c.Record.File == "" {
+		c.Record.File = "record.jsonl"
+	}
+	if c.Record.MaxSizeMB == 0 {
+		c.Record.MaxSizeMB = 50
+	}
+	if c.QueryLog.AnonymizeIP == "" {
+		c.QueryLog.AnonymizeIP = "none"
+	}
+	if c.Pcap.File == "" {
+		c.Pcap.File = "queries.pcap"
+	}
+	if c.Pcap.SampleRate == 0 {
+		c.Pcap.SampleRate = 1
+	}
+	if c.Pcap.MaxSizeMB == 0 {
+		c.Pcap.MaxSizeMB = 100
+	}
+	if c.Pcap.MaxBackups == 0 {
+		c.Pcap.MaxBackups = 3
+	}
+	if c.Dnstap.Network == "" {
+		c.Dnstap.Network = "unix"
+	}
+	if c.Dnstap.Address == "" {
+		c.Dnstap.Address = "/var/run/dns-local/dnstap.sock"
+	}
+	if c.Dnstap.QueueSize == 0 {
+		c.Dnstap.QueueSize = 1024
+	}
+	if c.Fallback.Timeout == 0 {
+		c.Fallback.Timeout = 3 * time.Second
+	}
+	if c.Response.AnswerOrder == "" {
+		c.Response.AnswerOrder = "fixed"
+	}
+	if c.Rewrite.TTL == 0 {
+		c.Rewrite.TTL = 5 * time.Minute
+	}
+	if c.Hosts.TTL == 0 {
+		c.Hosts.TTL = time.Minute
+	}
+	if c.SpecialUse.TTL == 0 {
+		c.SpecialUse.TTL = 5 * time.Minute
+	}
+	if len(c.PrivateReverse.Networks) == 0 {
+		c.PrivateReverse.Networks = []string{
+			"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "169.254.0.0/16",
+			"fc00::/7", "fe80::/10",
+		}
+	}
+	if c.PrivateReverse.TTL == 0 {
+		c.PrivateReverse.TTL = 5 * time.Minute
+	}
+	if c.LocalAnswers.TTL == 0 {
+		c.LocalAnswers.TTL = 5 * time.Minute
+	}
+	if c.DNS64.Prefix == "" {
+		c.DNS64.Prefix = "64:ff9b::/96"
+	}
+	if c.Anomaly.Window == 0 {
+		c.Anomaly.Window = time.Minute
+	}
+	if c.Anomaly.MinQueries == 0 {
+		c.Anomaly.MinQueries = 20
+	}
+	if c.Anomaly.EntropyThreshold == 0 {
+		c.Anomaly.EntropyThreshold = 3.5
+	}
+	if c.Anomaly.DGARatio == 0 {
+		c.Anomaly.DGARatio = 0.5
+	}
+	if c.Anomaly.SubdomainLimit == 0 {
+		c.Anomaly.SubdomainLimit = 100
+	}
+	if c.Anomaly.ThrottleDuration == 0 {
+		c.Anomaly.ThrottleDuration = 5 * time.Minute
+	}
+	if c.QueryValidation.Action == "" {
+		c.QueryValidation.Action = "reject"
+	}
+	if c.QueryValidation.MaxNameLength == 0 {
+		c.QueryValidation.MaxNameLength = 253
+	}
+	if c.QueryValidation.MaxLabelLength == 0 {
+		c.QueryValidation.MaxLabelLength = 63
+	}
+	if c.QueryValidation.EntropyMinLength == 0 {
+		c.QueryValidation.EntropyMinLength = 24
+	}
+	if len(c.Obfuscation.ChaffDomains) == 0 {
+		c.Obfuscation.ChaffDomains = defaultChaffDomains
+	}
+	if c.Report.Schedule == "" {
+		c.Report.Schedule = "daily"
+	}
+	if c.Report.At == "" {
+		c.Report.At = "08:00"
+	}
+	if c.BandwidthSaver.Threshold == 0 {
+		c.BandwidthSaver.Threshold = 0.8
+	}
+	if c.BandwidthSaver.TTLFactor == 0 {
+		c.BandwidthSaver.TTLFactor = 4
+	}
+	if c.BandwidthSaver.MaxStale == 0 {
+		c.BandwidthSaver.MaxStale = time.Hour
+	}
+	if c.Report.TopDomains == 0 {
+		c.Report.TopDomains = 10
+	}
+	if c.Admin.ListenAddr == "" {
+		c.Admin.ListenAddr = "127.0.0.1:5380"
+	}
+}
+
+// WithProfile returns the configuration with the named profile's endpoints
+// and rules in place of the top-level ones. The default profile, or an
+// empty name, returns c itself.
+func (c *Config) WithProfile(name string) (*Config, error) {
+	if name == "" || name == DefaultProfile {
+		return c, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	out := *c
+	if len(p.Endpoints) > 0 {
+		out.API.Endpoints = p.Endpoints
+	}
+	if p.LoadBalancing != "" {
+		out.API.LoadBalancing = p.LoadBalancing
+	}
+	if p.NAT != nil {
+		out.Response.NAT = p.NAT
+	}
+	if p.Fallback != nil {
+		out.Fallback = *p.Fallback
+		if out.Fallback.Timeout == 0 {
+			out.Fallback.Timeout = c.Fallback.Timeout
+		}
+	}
+	return &out, nil
+}
+
+// ProfileNames returns the names of all profiles, the default one included,
+// sorted
+func (c *Config) ProfileNames() []string {
+	names := []string{DefaultProfile}
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateProfiles checks the configuration each profile results in
+func (c *Config) validateProfiles() error {
+	if _, ok := c.Profiles[DefaultProfile]; ok {
+		return fmt.Errorf("profile name %q is reserved for the top-level settings", DefaultProfile)
+	}
+	if c.Profile != "" && c.Profile != DefaultProfile {
+		if _, ok := c.Profiles[c.Profile]; !ok {
+			return fmt.Errorf("profile %q is not defined in profiles", c.Profile)
+		}
+	}
+	for name := range c.Profiles {
+		derived, err := c.WithProfile(name)
+		if err != nil {
+			return err
+		}
+		derived.Profile, derived.Profiles = "", nil
+		if err := derived.validate(); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	return nil
 }
 
 func (c *Config) validate() error {
 	if len(c.API.Endpoints) == 0 {
 		return fmt.Errorf("at least one API endpoint is required")
 	}
+	for _, addr := range c.Server.Addresses() {
+		if strings.Contains(addr, ":") && net.ParseIP(addr) == nil {
+			return fmt.Errorf("server listen address %q must be a host without a port; write IPv6 addresses without brackets, e.g. ::1", addr)
+		}
+	}
+	for _, n := range c.Server.AllowedNetworks {
+		if net.ParseIP(n) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return fmt.Errorf("server allowed_networks: invalid network %q", n)
+		}
+	}
+	for _, n := range c.Server.CacheOnly {
+		if net.ParseIP(n) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return fmt.Errorf("server cache_only_networks: invalid network %q", n)
+		}
+	}
+	if len(c.Server.CacheOnly) > 0 && !c.Cache.Enabled {
+		return fmt.Errorf("server cache_only_networks requires cache.enabled")
+	}
+	if c.Server.MaxInFlight < 0 || c.Server.MaxPerClient < 0 {
+		return fmt.Errorf("server max_in_flight and max_per_client must not be negative")
+	}
 	for i, ep := range c.API.Endpoints {
 		if ep.URL == "" {
 			return fmt.Errorf("endpoint %d: URL is required", i)
@@ -144,9 +908,367 @@ func (c *Config) validate() error {
 		if ep.APIKey == "" {
 			return fmt.Errorf("endpoint %d: API key is required", i)
 		}
+		if err := validateURL(ep.URL); err != nil {
+			return fmt.Errorf("endpoint %d: %w", i, err)
+		}
+		if ep.HealthURL != "" {
+			if err := validateURL(ep.HealthURL); err != nil {
+				return fmt.Errorf("endpoint %d: health_url: %w", i, err)
+			}
+		}
+		for _, alt := range ep.Alternates {
+			if err := validateURL(alt); err != nil {
+				return fmt.Errorf("endpoint %d: alternates: %w", i, err)
+			}
+		}
+		if ep.Proxy != "" {
+			if err := validateProxyURL(ep.Proxy); err != nil {
+				return fmt.Errorf("endpoint %d: proxy: %w", i, err)
+			}
+		}
+		for _, pin := range ep.PinSHA256 {
+			raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(raw) != sha256.Size {
+				return fmt.Errorf("endpoint %d: pin_sha256 %q is not a base64 SHA-256 hash", i, pin)
+			}
+		}
+	}
+	switch c.API.LoadBalancing {
+	case "round_robin", "failover", "latency", "weighted_round_robin", "weighted_random":
+	default:
+		return fmt.Errorf("api load_balancing must be round_robin, failover, latency, weighted_round_robin, or weighted_random")
+	}
+	for i, ep := range c.API.Endpoints {
+		if ep.Weight < 0 {
+			return fmt.Errorf("endpoint %d: weight must not be negative", i)
+		}
+	}
+	if c.Server.DoT.Enabled && (c.Server.DoT.CertFile == "" || c.Server.DoT.KeyFile == "") {
+		return fmt.Errorf("dot requires cert_file and key_file")
+	}
+	if c.Server.DoT.RequireClientCert && c.Server.DoT.ClientCAFile == "" {
+		return fmt.Errorf("dot require_client_cert needs client_ca_file")
+	}
+	if c.Fallback.Enabled && len(c.Fallback.Upstreams) == 0 {
+		return fmt.Errorf("fallback requires at least one upstream")
+	}
+	for _, upstream := range c.Fallback.Upstreams {
+		if err := validateHostPort(upstream); err != nil {
+			return fmt.Errorf("fallback upstream: %w", err)
+		}
+	}
+	for _, cidr := range c.PrivateReverse.Networks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("private_reverse network %q: %w", cidr, err)
+		}
+	}
+	for addr := range c.PrivateReverse.Hosts {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("private_reverse host %q is not an IP address", addr)
+		}
+	}
+	if c.MDNS.Enabled && c.Server.Protocol == "tcp" {
+		return fmt.Errorf("mdns advertises a UDP service and needs server protocol udp or both")
+	}
+	for _, addr := range c.MDNS.Addresses {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("mdns address %q is not an IP address", addr)
+		}
+	}
+	for _, addr := range c.LocalAnswers.Addresses {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("local_answers address %q is not an IP address", addr)
+		}
+	}
+	if c.DNS64.Enabled {
+		prefix, err := netip.ParsePrefix(c.DNS64.Prefix)
+		if err != nil || !prefix.Addr().Is6() || !slices.Contains([]int{32, 40, 48, 56, 64, 96}, prefix.Bits()) {
+			return fmt.Errorf("dns64 prefix %q must be an IPv6 /32, /40, /48, /56, /64 or /96", c.DNS64.Prefix)
+		}
+		for _, n := range c.DNS64.Clients {
+			if net.ParseIP(n) != nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(n); err != nil {
+				return fmt.Errorf("dns64 clients: invalid network %q", n)
+			}
+		}
+	}
+	switch c.Response.AnswerOrder {
+	case "fixed", "rotate", "random":
+	default:
+		return fmt.Errorf("response answer_order must be fixed, rotate, or random")
+	}
+	if c.Response.MaxTTL > 0 && c.Response.MinTTL > c.Response.MaxTTL {
+		return fmt.Errorf("response min_ttl must not exceed max_ttl")
+	}
+	for _, rule := range c.Response.NAT {
+		public, internal := net.ParseIP(rule.Public), net.ParseIP(rule.Internal)
+		if public == nil || internal == nil {
+			return fmt.Errorf("response nat rule %s -> %s: invalid address", rule.Public, rule.Internal)
+		}
+		if (public.To4() == nil) != (internal.To4() == nil) {
+			return fmt.Errorf("response nat rule %s -> %s: addresses must be the same family", rule.Public, rule.Internal)
+		}
+	}
+	if c.Anomaly.DGARatio <= 0 || c.Anomaly.DGARatio > 1 {
+		return fmt.Errorf("anomaly dga_ratio must be between 0 and 1")
+	}
+	if v := c.QueryValidation; v.Enabled {
+		if v.Action != "reject" && v.Action != "flag" {
+			return fmt.Errorf("query_validation action must be reject or flag")
+		}
+		if v.MaxNameLength < 1 || v.MaxLabelLength < 1 || v.EntropyMinLength < 1 {
+			return fmt.Errorf("query_validation lengths must be positive")
+		}
+		if v.EntropyThreshold < 0 {
+			return fmt.Errorf("query_validation entropy_threshold must not be negative")
+		}
+	}
+	refused := map[string]bool{}
+	for _, t := range c.QueryPolicy.RefuseTypes {
+		if _, ok := dns.StringToType[strings.ToUpper(t)]; !ok {
+			return fmt.Errorf("query_policy refuse_types: unknown type %q", t)
+		}
+		refused[strings.ToUpper(t)] = true
+	}
+	for _, t := range c.QueryPolicy.DropTypes {
+		if _, ok := dns.StringToType[strings.ToUpper(t)]; !ok {
+			return fmt.Errorf("query_policy drop_types: unknown type %q", t)
+		}
+		if refused[strings.ToUpper(t)] {
+			return fmt.Errorf("query_policy: %s is both refused and dropped", strings.ToUpper(t))
+		}
+	}
+	for i, rule := range c.Rewrite.Rules {
+		if err := rule.check(); err != nil {
+			return fmt.Errorf("rewrite rule %d (%s): %w", i+1, rule.Match, err)
+		}
+	}
+	for _, file := range c.Hosts.Files {
+		if file == "" {
+			return fmt.Errorf("hosts files must not be empty")
+		}
+	}
+	if o := c.Obfuscation; o.JitterMin < 0 || o.JitterMax < 0 || o.ChaffInterval < 0 {
+		return fmt.Errorf("obfuscation durations must not be negative")
+	}
+	if c.Obfuscation.JitterMax > 0 && c.Obfuscation.JitterMin > c.Obfuscation.JitterMax {
+		return fmt.Errorf("obfuscation jitter_min must not exceed jitter_max")
+	}
+	if b := c.BandwidthSaver; b.Enabled {
+		if len(b.Hours) == 0 && b.DailyRequests == 0 {
+			return fmt.Errorf("bandwidth_saver requires hours or daily_requests")
+		}
+		for _, window := range b.Hours {
+			from, to, ok := strings.Cut(window, "-")
+			_, errFrom := time.Parse("15:04", from)
+			_, errTo := time.Parse("15:04", to)
+			if !ok || errFrom != nil || errTo != nil {
+				return fmt.Errorf("bandwidth_saver hours must be HH:MM-HH:MM, got %q", window)
+			}
+		}
+		if b.DailyRequests < 0 {
+			return fmt.Errorf("bandwidth_saver daily_requests must not be negative")
+		}
+		if b.Threshold <= 0 || b.Threshold > 1 {
+			return fmt.Errorf("bandwidth_saver threshold must be between 0 and 1")
+		}
+		if b.TTLFactor < 1 || b.MaxStale < 0 {
+			return fmt.Errorf("bandwidth_saver ttl_factor must be at least 1 and max_stale not negative")
+		}
+	}
+	if r := c.Report; r.Enabled {
+		if r.Schedule != "daily" && r.Schedule != "weekly" {
+			return fmt.Errorf("report schedule must be daily or weekly")
+		}
+		if _, err := time.Parse("15:04", r.At); err != nil {
+			return fmt.Errorf("report at must be a time of day (HH:MM), got %q", r.At)
+		}
+		if r.WebhookURL == "" && r.Email.SMTPAddr == "" {
+			return fmt.Errorf("report requires webhook_url or email smtp_addr")
+		}
+		if r.WebhookURL != "" {
+			if err := validateURL(r.WebhookURL); err != nil {
+				return fmt.Errorf("report webhook_url: %w", err)
+			}
+		}
+		if r.Email.SMTPAddr != "" {
+			if _, _, err := net.SplitHostPort(r.Email.SMTPAddr); err != nil {
+				return fmt.Errorf("report email smtp_addr must be host:port")
+			}
+			if r.Email.From == "" || len(r.Email.To) == 0 {
+				return fmt.Errorf("report email requires from and to")
+			}
+		}
+	}
+	for _, server := range c.API.Bootstrap.Servers {
+		if err := validateHostPort(server); err != nil {
+			return fmt.Errorf("api bootstrap server: %w", err)
+		}
+	}
+	for host, ips := range c.API.Bootstrap.Hosts {
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("api bootstrap host %s: invalid IP %q", host, ip)
+			}
+		}
+	}
+	if c.API.Failback.Probes < 1 {
+		return fmt.Errorf("api failback probes must be positive")
+	}
+	if c.API.MaxInFlight < 0 {
+		return fmt.Errorf("api max_in_flight must not be negative")
+	}
+	switch c.API.HealthProbe {
+	case "http", "resolve":
+	default:
+		return fmt.Errorf("api health_probe must be http or resolve")
+	}
+	switch c.API.Encoding {
+	case "json", "cbor":
+	default:
+		return fmt.Errorf("api encoding must be json or cbor")
+	}
+	if c.API.Compression != "gzip" && c.API.Compression != "none" {
+		return fmt.Errorf("api compression must be gzip or none")
+	}
+	if c.API.Blocking.Threshold < 1 {
+		return fmt.Errorf("api blocking threshold must be at least 1")
+	}
+	for _, port := range c.API.Blocking.AlternatePorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("api blocking alternate_ports: invalid port %d", port)
+		}
+	}
+	if c.API.HappyEyeballs.Delay < 0 {
+		return fmt.Errorf("api happy_eyeballs delay must not be negative")
+	}
+	if c.API.Tuning.Interval < 0 {
+		return fmt.Errorf("api tuning interval must not be negative")
+	}
+	if c.API.Discovery.Interval < 0 {
+		return fmt.Errorf("api discovery interval must not be negative")
+	}
+	switch c.API.HTTPVersion {
+	case "auto", "1.1", "2", "3":
+	default:
+		return fmt.Errorf("api http_version must be auto, 1.1, 2 or 3")
+	}
+	switch c.API.TLSMinVersion {
+	case "1.2", "1.3":
+	default:
+		return fmt.Errorf("api tls_min_version must be 1.2 or 1.3")
+	}
+	if c.Cache.Prefetch.Window <= 0 || c.Cache.Prefetch.Window >= 1 {
+		return fmt.Errorf("cache prefetch window must be between 0 and 1")
 	}
 	if c.Security.EncryptionEnabled && len(c.Security.EncryptionKey) != 64 {
 		return fmt.Errorf("encryption key must be 64 hex characters (32 bytes)")
 	}
+	if c.Security.Sessions.Enabled && !c.Security.EncryptionEnabled {
+		return fmt.Errorf("security sessions require encryption_enabled")
+	}
+	if c.API.Tuning.Enabled && !c.Security.EncryptionEnabled {
+		return fmt.Errorf("api tuning requires encryption_enabled to pad its probes")
+	}
+	switch c.Security.CipherSuite {
+	case "aes-256-gcm", "xchacha20-poly1305":
+	default:
+		return fmt.Errorf("security cipher_suite must be aes-256-gcm or xchacha20-poly1305")
+	}
+	switch c.Security.Padding.Mode {
+	case "none":
+	case "block", "random":
+		if !c.Security.EncryptionEnabled {
+			return fmt.Errorf("security padding requires encryption_enabled")
+		}
+	default:
+		return fmt.Errorf("security padding mode must be none, block, or random")
+	}
+	if c.Security.Padding.BlockSize < 1 || c.Security.Padding.MaxRandom < 1 {
+		return fmt.Errorf("security padding block_size and max_random must be positive")
+	}
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("logging level must be one of debug, info, warn, error")
+	}
+	switch c.Logging.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("logging format must be text or json")
+	}
+	for _, f := range []struct {
+		name string
+		n    int
+	}{
+		{"logging max_size_mb", c.Logging.MaxSizeMB},
+		{"logging max_backups", c.Logging.MaxBackups},
+		{"query_log max_size_mb", c.QueryLog.MaxSizeMB},
+		{"query_log max_backups", c.QueryLog.MaxBackups},
+		{"pcap max_size_mb", c.Pcap.MaxSizeMB},
+		{"pcap max_backups", c.Pcap.MaxBackups},
+	} {
+		if f.n < -1 {
+			return fmt.Errorf("%s must be -1 (off), 0 (default) or positive", f.name)
+		}
+	}
+	switch c.QueryLog.Output {
+	case "file", "syslog":
+	default:
+		return fmt.Errorf("query_log output must be file or syslog")
+	}
+	switch c.QueryLog.AnonymizeIP {
+	case "none", "truncate", "hash":
+	default:
+		return fmt.Errorf("query_log anonymize_ip must be none, truncate, or hash")
+	}
+	if c.Pcap.SampleRate < 0 || c.Pcap.SampleRate > 1 {
+		return fmt.Errorf("pcap sample_rate must be between 0 and 1")
+	}
+	if c.Admin.Enabled {
+		if _, _, err := net.SplitHostPort(c.Admin.ListenAddr); err != nil {
+			return fmt.Errorf("admin listen_addr must be host:port")
+		}
+	}
+	return c.validateProfiles()
+}
+
+// validateProxyURL checks that s is a proxy URL the HTTP transport can use
+func validateProxyURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("scheme must be http, https, socks5 or socks5h")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("proxy URL %q has no host", u.Redacted())
+	}
+	return nil
+}
+
+// validateURL checks that s is an absolute http(s) URL
+// validateHostPort checks a DNS server address, which needs an explicit port
+// and brackets around IPv6 addresses
+func validateHostPort(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("%q must be host:port, e.g. 1.1.1.1:53 or [2606:4700:4700::1111]:53", addr)
+	}
+	return nil
+}
+
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", s, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("URL %q must be an absolute http(s) URL", s)
+	}
 	return nil
 }
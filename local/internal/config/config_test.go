@@ -0,0 +1,50 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoggingSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "api:\n  endpoints:\n    - url: \"https://dns.example.com/api/v1/resolve\"\n      api_key: \"k\"\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every name logging.ParseLevel takes is accepted, and stored as the
+	// canonical one
+	for name, want := range map[string]string{"": "info", "DEBUG": "debug", "Warning": "warn", "warn": "warn", "error": "error"} {
+		cfg, err := Load(path, "logging.level="+name)
+		if err != nil {
+			t.Errorf("level %q: %v", name, err)
+			continue
+		}
+		if cfg.Logging.Level != want {
+			t.Errorf("level %q loaded as %q, want %q", name, cfg.Logging.Level, want)
+		}
+	}
+	if _, err := Load(path, "logging.level=verbose"); err == nil {
+		t.Error("unknown level should be rejected")
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Logging.MaxSizeMB != 100 || cfg.Logging.MaxBackups != 3 {
+		t.Errorf("defaults: max_size_mb %d, max_backups %d", cfg.Logging.MaxSizeMB, cfg.Logging.MaxBackups)
+	}
+	// -1 turns rotation off rather than falling back to the default
+	cfg, err = Load(path, "logging.max_size_mb=-1", "logging.max_backups=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Logging.MaxSizeMB != -1 || cfg.Logging.MaxBackups != -1 {
+		t.Errorf("-1 not kept: max_size_mb %d, max_backups %d", cfg.Logging.MaxSizeMB, cfg.Logging.MaxBackups)
+	}
+	if _, err := Load(path, "logging.max_backups=-2"); err == nil {
+		t.Error("max_backups below -1 should be rejected")
+	}
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefixes environment variables that override config values.
+// The rest of the name is the YAML path in upper case joined by
+// underscores, e.g. DNS_PROXY_SECURITY_ENCRYPTION_KEY; list elements that
+// exist in the file are addressed by index.
+const EnvPrefix = "DNS_PROXY_"
+
+// Overrides collects "path=value" settings from repeated -set flags, e.g.
+// -set security.encryption_key=... or -set server.port=9443. Paths use the
+// YAML names joined by dots. It implements flag.Value.
+type Overrides []string
+
+func (o *Overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+// Set records one override; the path is checked when the config is loaded
+func (o *Overrides) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return fmt.Errorf("expected path=value, got %q", s)
+	}
+	*o = append(*o, s)
+	return nil
+}
+
+// applyOverrides layers environment variables and then explicit overrides
+// on top of the values read from YAML
+func (c *Config) applyOverrides(overrides []string) error {
+	leaves := make(map[string]reflect.Value)
+	walkLeaves(reflect.ValueOf(c).Elem(), nil, func(path []string, v reflect.Value) {
+		leaves[strings.Join(path, ".")] = v
+	})
+
+	for path, v := range leaves {
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := setValue(v, value); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	for _, o := range overrides {
+		path, value, _ := strings.Cut(o, "=")
+		v, ok := leaves[path]
+		if !ok {
+			return fmt.Errorf("unknown config key %q", path)
+		}
+		if err := setValue(v, value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// walkLeaves calls fn for every settable scalar or scalar-list field,
+// descending into nested structs and existing elements of struct lists
+func walkLeaves(v reflect.Value, path []string, fn func([]string, reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		fpath := append(append([]string(nil), path...), name)
+
+		switch {
+		case fv.Kind() == reflect.Struct:
+			walkLeaves(fv, fpath, fn)
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < fv.Len(); j++ {
+				walkLeaves(fv.Index(j), append(fpath, strconv.Itoa(j)), fn)
+			}
+		case fv.Kind() == reflect.Map:
+			// not addressable by a flat name
+		default:
+			fn(fpath, fv)
+		}
+	}
+}
+
+// setValue parses s into v; lists are comma-separated
+func setValue(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		list := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setValue(list.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverridePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "server:\n  port: 5353\napi:\n  endpoints:\n    - url: \"https://dns.example.com/api/v1/resolve\"\n      api_key: \"from-file\"\nfallback:\n  upstreams: [\"192.0.2.1:53\"]\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DNS_PROXY_SERVER_PORT", "5300")
+	t.Setenv("DNS_PROXY_API_ENDPOINTS_0_API_KEY", "from-env")
+	t.Setenv("DNS_PROXY_API_TIMEOUT", "2s")
+	t.Setenv("DNS_PROXY_FALLBACK_UPSTREAMS", "192.0.2.2:53, 192.0.2.3:53")
+
+	cfg, err := Load(path, "server.port=5454")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 5454 {
+		t.Errorf("flag should beat env: port = %d", cfg.Server.Port)
+	}
+	if cfg.API.Endpoints[0].APIKey != "from-env" {
+		t.Errorf("env should beat file: api_key = %q", cfg.API.Endpoints[0].APIKey)
+	}
+	if len(cfg.Fallback.Upstreams) != 2 || cfg.Fallback.Upstreams[1] != "192.0.2.3:53" {
+		t.Errorf("env should replace file list: %v", cfg.Fallback.Upstreams)
+	}
+	if cfg.API.Timeout != 2*time.Second {
+		t.Errorf("timeout = %v", cfg.API.Timeout)
+	}
+
+	if _, err := Load(path, "server.nope=1"); err == nil {
+		t.Error("unknown key should be rejected")
+	}
+	if _, err := Load(path, "server.port=abc"); err == nil {
+		t.Error("bad value should be rejected")
+	}
+	// Only endpoints listed in the file can be addressed
+	if _, err := Load(path, "api.endpoints.1.api_key=x"); err == nil {
+		t.Error("missing list element should be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// presets are named groups of settings selected with preset: for people who
+// would rather not tune every option. A preset fills the config before the
+// file is decoded, so anything the file, the environment or -set gives
+// explicitly still wins. (profile: already names the network profiles that
+// can be switched at runtime, hence the different key.)
+var presets = map[string]func(c *Config){
+	// strict-privacy hides as much as possible from the network path and
+	// keeps as little as possible on disk. It needs security.encryption_key.
+	"strict-privacy": func(c *Config) {
+		c.Security.EncryptionEnabled = true
+		c.Security.Padding = PaddingConfig{Mode: "block", BlockSize: 256}
+		c.Security.Sessions.Enabled = true
+		c.Obfuscation.Enabled = true
+		c.Obfuscation.JitterMax = 100 * time.Millisecond
+		c.Obfuscation.ChaffInterval = 5 * time.Minute
+		c.QueryLog.AnonymizeIP = "hash"
+		c.QueryLog.HashQNames = true
+		c.Cache.Enabled = true
+		c.Fallback.Enabled = false // plain DNS would bypass the tunnel
+	},
+	// performance answers from the cache as much as it can, keeps popular
+	// entries fresh and picks the fastest endpoint.
+	"performance": func(c *Config) {
+		c.Cache.Enabled = true
+		c.Cache.Prefetch.Enabled = true
+		c.Cache.PairAddresses = true
+		c.API.LoadBalancing = "latency"
+		c.API.HappyEyeballs.Enabled = true
+		c.API.Compression = "gzip"
+	},
+	// low-bandwidth sends as few tunnel requests as it can, serving cached
+	// answers past their TTL instead of refreshing them.
+	"low-bandwidth": func(c *Config) {
+		c.Cache.Enabled = true
+		c.Cache.PairAddresses = true
+		c.BandwidthSaver.Enabled = true
+		c.BandwidthSaver.Hours = []string{"00:00-12:00", "12:00-00:00"} // all day
+		c.API.Compression = "gzip"
+		c.API.Encoding = "cbor"
+	},
+}
+
+// presetNames returns the defined presets, sorted
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreset fills c with the preset the file, the environment or the
+// overrides select, in that order of precedence from lowest
+func (c *Config) applyPreset(data []byte, overrides []string) error {
+	var head struct {
+		Preset string `yaml:"preset"`
+	}
+	if err := yaml.Unmarshal(data, &head); err != nil {
+		return err
+	}
+	name := head.Preset
+	if v, ok := os.LookupEnv(EnvPrefix + "PRESET"); ok {
+		name = v
+	}
+	for _, o := range overrides {
+		if path, value, _ := strings.Cut(o, "="); path == "preset" {
+			name = value
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	fill, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q (want %s)", name, strings.Join(presetNames(), ", "))
+	}
+	fill(c)
+	return nil
+}
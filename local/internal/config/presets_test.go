@@ -0,0 +1,72 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	const endpoint = "api:\n  endpoints:\n    - url: \"https://dns.example.com/api/v1/resolve\"\n      api_key: \"k\"\n"
+	tests := []struct {
+		name      string
+		yaml      string
+		env       map[string]string
+		overrides []string
+		check     func(c *Config) bool
+	}{
+		{"none", endpoint, nil, nil,
+			func(c *Config) bool { return !c.Cache.Prefetch.Enabled && c.API.LoadBalancing == "round_robin" }},
+		{"from the file", "preset: performance\n" + endpoint, nil, nil,
+			func(c *Config) bool { return c.Cache.Prefetch.Enabled && c.API.LoadBalancing == "latency" }},
+		// Settings given explicitly beat the preset, wherever they come from
+		{"file beats preset", "preset: performance\n" + endpoint + "  load_balancing: failover\n", nil, nil,
+			func(c *Config) bool { return c.Cache.Prefetch.Enabled && c.API.LoadBalancing == "failover" }},
+		{"env beats preset", "preset: performance\n" + endpoint, map[string]string{"DNS_PROXY_CACHE_PREFETCH_ENABLED": "false"}, nil,
+			func(c *Config) bool { return !c.Cache.Prefetch.Enabled && c.API.LoadBalancing == "latency" }},
+		{"flag beats preset and env", "preset: performance\n" + endpoint, map[string]string{"DNS_PROXY_API_LOAD_BALANCING": "failover"}, []string{"api.load_balancing=weighted_random"},
+			func(c *Config) bool { return c.API.LoadBalancing == "weighted_random" }},
+		// The preset itself is chosen by the same precedence
+		{"env chooses", "preset: performance\n" + endpoint, map[string]string{"DNS_PROXY_PRESET": "low-bandwidth"}, nil,
+			func(c *Config) bool {
+				return c.Preset == "low-bandwidth" && c.BandwidthSaver.Enabled && !c.Cache.Prefetch.Enabled
+			}},
+		{"flag chooses", "preset: performance\n" + endpoint, map[string]string{"DNS_PROXY_PRESET": "low-bandwidth"}, []string{"preset=performance"},
+			func(c *Config) bool {
+				return c.Preset == "performance" && !c.BandwidthSaver.Enabled && c.Cache.Prefetch.Enabled
+			}},
+		{"strict-privacy", "preset: strict-privacy\n" + endpoint, map[string]string{"DNS_PROXY_SECURITY_ENCRYPTION_KEY": strings.Repeat("ab", 32)}, nil,
+			func(c *Config) bool {
+				return c.Security.EncryptionEnabled && c.Security.Padding.Mode == "block" && !c.Fallback.Enabled
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			os.WriteFile(path, []byte(tt.yaml), 0o600)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Load(path, tt.overrides...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("unexpected settings: %+v %+v", cfg.API, cfg.Cache)
+			}
+		})
+	}
+}
+
+func TestUnknownPreset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("preset: fastest\napi:\n  endpoints:\n    - url: \"https://dns.example.com/api/v1/resolve\"\n      api_key: \"k\"\n"), 0o600)
+	_, err := Load(path)
+	if err == nil || !strings.Contains(err.Error(), `unknown preset "fastest" (want low-bandwidth, performance, strict-privacy)`) {
+		t.Errorf("unknown preset: %v", err)
+	}
+	if cfg, err := Load(path, "preset=performance"); err != nil || !cfg.Cache.Prefetch.Enabled {
+		t.Errorf("a flag should replace the file's preset: %v", err)
+	}
+}
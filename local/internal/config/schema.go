@@ -0,0 +1,188 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// checkSchema checks the YAML document against the Config structure before
+// it is decoded: keys no setting is named after, values of the wrong type
+// and durations that don't parse. Decoding alone ignores unknown keys, so a
+// typo such as max_retires would silently leave the default in place. Every
+// problem is reported, each with its file, line and column.
+func checkSchema(file string, data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil // a syntax error, reported by the decode that follows
+	}
+	if len(doc.Content) == 0 {
+		return nil // empty file
+	}
+
+	var errs []error
+	checkNode(doc.Content[0], reflect.TypeOf(Config{}), "", func(n *yaml.Node, path, msg string) {
+		if path == "" {
+			errs = append(errs, fmt.Errorf("%s:%d:%d: %s", file, n.Line, n.Column, msg))
+			return
+		}
+		errs = append(errs, fmt.Errorf("%s:%d:%d: %s: %s", file, n.Line, n.Column, path, msg))
+	})
+	return errors.Join(errs...)
+}
+
+// checkNode checks that n can be decoded into a value of type t, reporting
+// problems through report
+func checkNode(n *yaml.Node, t reflect.Type, path string, report func(n *yaml.Node, path, msg string)) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return // leaves the zero value
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		if n.Kind != yaml.ScalarNode {
+			report(n, path, "expected a duration such as 30s or 5m")
+		} else if _, err := time.ParseDuration(n.Value); err != nil && n.Tag != "!!int" {
+			report(n, path, fmt.Sprintf("invalid duration %q: use a number with a unit, such as 30s or 5m", n.Value))
+		}
+
+	case t.Kind() == reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			report(n, path, "expected a mapping of settings")
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Value == "<<" {
+				continue // merge key; the merged mapping is checked where it is defined
+			}
+			f, ok := fields[key.Value]
+			if !ok {
+				msg := "unknown key " + strconv.Quote(key.Value)
+				if near := closest(key.Value, fields); near != "" {
+					msg += fmt.Sprintf(" (did you mean %q?)", near)
+				}
+				report(key, path, msg)
+				continue
+			}
+			checkNode(value, f.Type, joinPath(path, key.Value), report)
+		}
+
+	case t.Kind() == reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			report(n, path, "expected a list")
+			return
+		}
+		for i, item := range n.Content {
+			checkNode(item, t.Elem(), joinPath(path, strconv.Itoa(i)), report)
+		}
+
+	case t.Kind() == reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			report(n, path, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			checkNode(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value), report)
+		}
+
+	case t.Kind() == reflect.Interface:
+		// anything goes
+
+	default:
+		if n.Kind != yaml.ScalarNode {
+			report(n, path, "expected "+scalarName(t))
+			return
+		}
+		if err := n.Decode(reflect.New(t).Interface()); err != nil {
+			report(n, path, fmt.Sprintf("expected %s, got %q", scalarName(t), n.Value))
+		}
+	}
+}
+
+// yamlFields maps the YAML names of a struct's settings to their fields
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if f.IsExported() && name != "" && name != "-" {
+			fields[name] = f
+		}
+	}
+	return fields
+}
+
+// scalarName describes the values a scalar type accepts
+func scalarName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	default:
+		return "a string"
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// closest returns the known key nearest to key by edit distance, if it is
+// close enough to be a likely typo
+func closest(key string, fields map[string]reflect.StructField) string {
+	best, bestDist := "", len(key)/3+1
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDist || (d == bestDist && best != "" && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b, counting a
+// swap of adjacent characters as one edit
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	tests := []struct {
+		name, yaml string
+		want       []string // substrings of the error, empty when valid
+	}{
+		{"valid", "server:\n  port: 53\napi:\n  timeout: 5s\n  max_retries: 2\n", nil},
+		{"empty", "", nil},
+		{"integer duration", "api:\n  timeout: 5000000000\n", nil},
+		{"null section", "logging:\n", nil},
+		{"preset", "preset: performance\n", nil},
+		{"typo", "api:\n  max_retires: 2\n", []string{`config.yaml:2:3: api: unknown key "max_retires" (did you mean "max_retries"?)`}},
+		{"unknown section", "logs:\n  level: info\n", []string{`config.yaml:1:1: unknown key "logs"`}},
+		{"bad duration", "api:\n  timeout: 5 seconds\n", []string{`config.yaml:2:12: api.timeout: invalid duration "5 seconds"`}},
+		{"wrong type", "server:\n  port: dns\n", []string{`config.yaml:2:9: server.port: expected a whole number, got "dns"`}},
+		{"list expected", "fallback:\n  upstreams: 192.0.2.1:53\n", []string{"fallback.upstreams: expected a list"}},
+		{"mapping expected", "server: 53\n", []string{"config.yaml:1:9: server: expected a mapping of settings"}},
+		{"list element", "api:\n  endpoints:\n    - url: https://dns.example.com\n      api_keys: k\n", []string{`config.yaml:4:7: api.endpoints.0: unknown key "api_keys" (did you mean "api_key"?)`}},
+		{"all reported", "server:\n  prot: 1\n  listen_addr: [a]\n", []string{`unknown key "prot"`, "server.listen_addr: expected a string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSchema("config.yaml", []byte(tt.yaml))
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("no error, want %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExampleConfigMatchesSchema(t *testing.T) {
+	data, err := os.ReadFile("../../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchema("config.example.yaml", data); err != nil {
+		t.Error(err)
+	}
+}
@@ -9,45 +9,94 @@ import (
 	"errors"
 	"fmt"
 	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher suites. Both take the same 32-byte key; the suite is named in the
+// request envelope, empty meaning AES-256-GCM.
+const (
+	SuiteAES256GCM = "aes-256-gcm"
+	// SuiteXChaCha20Poly1305 has 192-bit nonces, which can be drawn at
+	// random for any number of messages without risk of reuse
+	SuiteXChaCha20Poly1305 = "xchacha20-poly1305"
 )
 
-// Cipher handles AES-256-GCM encryption/decryption
+// Suites lists the supported cipher suites
+var Suites = []string{SuiteAES256GCM, SuiteXChaCha20Poly1305}
+
+// Cipher handles AEAD encryption/decryption under one key and suite
 type Cipher struct {
-	gcm cipher.AEAD
+	aead  cipher.AEAD
+	id    string
+	suite string
 }
 
 // NewCipher creates a new AES-256-GCM cipher with the given hex-encoded key
 func NewCipher(hexKey string) (*Cipher, error) {
+	return NewKeyedCipher("", hexKey)
+}
+
+// NewKeyedCipher creates an AES-256-GCM cipher whose key is named by id, so
+// both sides can hold several keys while one is being rotated out. The empty
+// ID is the unnamed key of deployments that predate key IDs.
+func NewKeyedCipher(id, hexKey string) (*Cipher, error) {
+	return NewSuiteCipher(SuiteAES256GCM, id, hexKey)
+}
+
+// NewSuiteCipher creates a cipher of the given suite for the key named id
+func NewSuiteCipher(suite, id, hexKey string) (*Cipher, error) {
 	key, err := hex.DecodeString(hexKey)
 	if err != nil {
 		return nil, fmt.Errorf("invalid hex key: %w", err)
 	}
+	return newCipher(suite, id, key)
+}
 
+func newCipher(suite, id string, key []byte) (*Cipher, error) {
 	if len(key) != 32 {
 		return nil, errors.New("key must be 32 bytes (256 bits)")
 	}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	var aead cipher.AEAD
+	var err error
+	switch suite {
+	case SuiteAES256GCM, "":
+		suite = SuiteAES256GCM
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("failed to create GCM: %w", err)
+		}
+	case SuiteXChaCha20Poly1305:
+		if aead, err = chacha20poly1305.NewX(key); err != nil {
+			return nil, fmt.Errorf("failed to create XChaCha20-Poly1305: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %q", suite)
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
-	}
+	return &Cipher{aead: aead, id: id, suite: suite}, nil
+}
+
+// ID returns the key ID, empty for an unnamed key
+func (c *Cipher) ID() string {
+	return c.id
+}
 
-	return &Cipher{gcm: gcm}, nil
+// Suite returns the cipher suite name
+func (c *Cipher) Suite() string {
+	return c.suite
 }
 
 // Encrypt encrypts plaintext and returns base64-encoded ciphertext
 func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
-	nonce := make([]byte, c.gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	ciphertext, err := c.Seal(plaintext)
+	if err != nil {
+		return "", err
 	}
-
-	ciphertext := c.gcm.Seal(nonce, nonce, plaintext, nil)
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
@@ -57,14 +106,30 @@ func (c *Cipher) Decrypt(encoded string) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode base64: %w", err)
 	}
+	return c.Open(ciphertext)
+}
+
+// Seal encrypts plaintext and returns the nonce followed by the
+// ciphertext, for binary bodies that need no base64
+func (c *Cipher) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	// Prepend nonce to ciphertext
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
 
-	nonceSize := c.gcm.NonceSize()
+// Open decrypts the output of Seal
+func (c *Cipher) Open(ciphertext []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
 	if len(ciphertext) < nonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := c.gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt: %w", err)
 	}
@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"testing"
+)
+
+// suiteVectors were sealed with fixed nonces by the reference AEAD
+// implementations. The remote server's crypto package carries the same
+// vectors, so both sides are held to one wire format.
+var suiteVectors = []struct {
+	suite      string
+	ciphertext string
+}{
+	{SuiteAES256GCM, "oKGio6SlpqeoqaqrnToYQiiqa9FAX6W2fxutrhzJd3P92mBAvnpf9hqJTyOTVDpYLcFDqX6b3/KqhshoogqY"},
+	{SuiteXChaCha20Poly1305, "oKGio6SlpqeoqaqrrK2ur7CxsrO0tba3Ps5ucto8zcJDVQ/sCVHOsFfPsU/Fa+j1PzTyl4KBxBSQpdcDrM4qkQmv2KHdZYVZgAsI"},
+}
+
+const (
+	vectorKey       = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	vectorPlaintext = `{"domain":"example.com","type":"A"}`
+)
+
+func TestSuiteVectors(t *testing.T) {
+	for _, v := range suiteVectors {
+		c, err := NewSuiteCipher(v.suite, "", vectorKey)
+		if err != nil {
+			t.Fatalf("%s: %v", v.suite, err)
+		}
+		plain, err := c.Decrypt(v.ciphertext)
+		if err != nil || string(plain) != vectorPlaintext {
+			t.Errorf("%s: Decrypt = %q, %v", v.suite, plain, err)
+		}
+
+		sealed, _ := c.Encrypt([]byte(vectorPlaintext))
+		if plain, err := c.Decrypt(sealed); err != nil || string(plain) != vectorPlaintext {
+			t.Errorf("%s: round trip = %q, %v", v.suite, plain, err)
+		}
+	}
+
+	// A payload sealed under one suite must not open under the other
+	aes, _ := NewSuiteCipher(SuiteAES256GCM, "", vectorKey)
+	if _, err := aes.Decrypt(suiteVectors[1].ciphertext); err == nil {
+		t.Error("AES-256-GCM opened an XChaCha20-Poly1305 payload")
+	}
+	if _, err := NewSuiteCipher("rot13", "", vectorKey); err == nil {
+		t.Error("expected an error for an unknown suite")
+	}
+}
@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Padding modes
+const (
+	PadNone   = "none"
+	PadBlock  = "block"  // round the plaintext up to a multiple of BlockSize
+	PadRandom = "random" // append 0..MaxRandom random-length padding
+)
+
+// PaddingVersion is the encrypted envelope version whose plaintext carries a
+// length prefix and padding. Version 0 (absent) is the unpadded format.
+const PaddingVersion = 1
+
+// lengthPrefix is the size of the big-endian message length before the payload
+const lengthPrefix = 4
+
+// Padding hides the size of encrypted payloads, which would otherwise reveal
+// which domain was looked up even though its name is encrypted
+type Padding struct {
+	Mode      string
+	BlockSize int
+	MaxRandom int
+}
+
+// Enabled reports whether payloads are padded
+func (p Padding) Enabled() bool {
+	return p.Mode == PadBlock || p.Mode == PadRandom
+}
+
+// Pad prefixes msg with its length and appends zero bytes per the mode.
+// The result is meant to be encrypted; Unpad reverses it after decryption.
+func (p Padding) Pad(msg []byte) ([]byte, error) {
+	size := lengthPrefix + len(msg)
+	switch p.Mode {
+	case PadBlock:
+		if p.BlockSize > 0 {
+			size = (size + p.BlockSize - 1) / p.BlockSize * p.BlockSize
+		}
+	case PadRandom:
+		if p.MaxRandom > 0 {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(p.MaxRandom)+1))
+			if err != nil {
+				return nil, fmt.Errorf("failed to pick padding length: %w", err)
+			}
+			size += int(n.Int64())
+		}
+	}
+
+	out := make([]byte, size)
+	binary.BigEndian.PutUint32(out, uint32(len(msg)))
+	copy(out[lengthPrefix:], msg)
+	return out, nil
+}
+
+// Unpad returns the message inside a padded plaintext
+func Unpad(padded []byte) ([]byte, error) {
+	if len(padded) < lengthPrefix {
+		return nil, errors.New("padded payload too short")
+	}
+	n := binary.BigEndian.Uint32(padded)
+	if uint64(n) > uint64(len(padded)-lengthPrefix) {
+		return nil, errors.New("padded payload length exceeds data")
+	}
+	return padded[lengthPrefix : lengthPrefix+int(n)], nil
+}
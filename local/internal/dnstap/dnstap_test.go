@@ -0,0 +1,95 @@
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestMarshal(t *testing.T) {
+	m := &Message{
+		Type:      ClientQuery,
+		Protocol:  ProtocolUDP,
+		QueryAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353},
+		QueryTime: time.Unix(1700000000, 0),
+		Query:     []byte{0xab, 0xcd},
+	}
+
+	out := marshal([]byte("id"), nil, m)
+
+	// Dnstap.identity = "id"
+	if !bytes.HasPrefix(out, []byte{0x0a, 0x02, 'i', 'd'}) {
+		t.Errorf("Unexpected identity encoding: % x", out[:4])
+	}
+	// Dnstap.type = MESSAGE as the trailing field
+	if !bytes.HasSuffix(out, []byte{0x78, 0x01}) {
+		t.Errorf("Unexpected type encoding: % x", out[len(out)-2:])
+	}
+	// Query address bytes are embedded verbatim
+	if !bytes.Contains(out, []byte{0x22, 0x04, 10, 0, 0, 1}) {
+		t.Error("Expected query_address field")
+	}
+}
+
+func TestWriterHandshake(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "tap.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	frames := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if readControl(conn, controlReady) != nil {
+			return
+		}
+		writeControl(conn, controlAccept, true)
+		if readControl(conn, controlStart) != nil {
+			return
+		}
+
+		var hdr [4]byte
+		if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		io.ReadFull(conn, frame)
+		frames <- frame
+	}()
+
+	w, err := New(config.DnstapConfig{
+		Enabled:   true,
+		Network:   "unix",
+		Address:   sock,
+		QueueSize: 8,
+	}, logging.Discard())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer w.Close()
+
+	w.Write(&Message{Type: ClientQuery, Query: []byte{1, 2, 3}})
+
+	select {
+	case frame := <-frames:
+		if !bytes.Contains(frame, []byte{1, 2, 3}) {
+			t.Errorf("Frame does not contain query: % x", frame)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for frame")
+	}
+}
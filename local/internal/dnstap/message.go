@@ -0,0 +1,148 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// MessageType mirrors dnstap.Message.Type
+type MessageType uint64
+
+const (
+	ClientQuery       MessageType = 5
+	ClientResponse    MessageType = 6
+	ForwarderQuery    MessageType = 7
+	ForwarderResponse MessageType = 8
+)
+
+// SocketProtocol mirrors dnstap.SocketProtocol
+type SocketProtocol uint64
+
+const (
+	ProtocolUDP SocketProtocol = 1
+	ProtocolTCP SocketProtocol = 2
+	ProtocolDoT SocketProtocol = 3
+	ProtocolDoH SocketProtocol = 4
+)
+
+const (
+	familyINET  = 1
+	familyINET6 = 2
+)
+
+// Message is a single dnstap event
+type Message struct {
+	Type         MessageType
+	Protocol     SocketProtocol
+	QueryAddr    net.Addr // DNS client (or this proxy, for forwarder messages)
+	ResponseAddr net.Addr
+	QueryTime    time.Time
+	ResponseTime time.Time
+	Query        []byte // wire-format query
+	Response     []byte // wire-format response
+}
+
+// marshal encodes a Dnstap protobuf wrapping m. The schema is small and
+// stable, so it is encoded by hand rather than pulling in protobuf codegen.
+func marshal(identity, version []byte, m *Message) []byte {
+	var msg []byte
+	msg = appendVarintField(msg, 1, uint64(m.Type))
+
+	qip, qport := splitAddr(m.QueryAddr)
+	rip, rport := splitAddr(m.ResponseAddr)
+	if ip := firstIP(qip, rip); ip != nil {
+		family := uint64(familyINET6)
+		if ip.To4() != nil {
+			family = familyINET
+		}
+		msg = appendVarintField(msg, 2, family)
+	}
+	if m.Protocol != 0 {
+		msg = appendVarintField(msg, 3, uint64(m.Protocol))
+	}
+	if qip != nil {
+		msg = appendBytesField(msg, 4, ipBytes(qip))
+	}
+	if rip != nil {
+		msg = appendBytesField(msg, 5, ipBytes(rip))
+	}
+	if qport != 0 {
+		msg = appendVarintField(msg, 6, uint64(qport))
+	}
+	if rport != 0 {
+		msg = appendVarintField(msg, 7, uint64(rport))
+	}
+	if !m.QueryTime.IsZero() {
+		msg = appendVarintField(msg, 8, uint64(m.QueryTime.Unix()))
+		msg = appendFixed32Field(msg, 9, uint32(m.QueryTime.Nanosecond()))
+	}
+	if m.Query != nil {
+		msg = appendBytesField(msg, 10, m.Query)
+	}
+	if !m.ResponseTime.IsZero() {
+		msg = appendVarintField(msg, 12, uint64(m.ResponseTime.Unix()))
+		msg = appendFixed32Field(msg, 13, uint32(m.ResponseTime.Nanosecond()))
+	}
+	if m.Response != nil {
+		msg = appendBytesField(msg, 14, m.Response)
+	}
+
+	var out []byte
+	if len(identity) > 0 {
+		out = appendBytesField(out, 1, identity)
+	}
+	if len(version) > 0 {
+		out = appendBytesField(out, 2, version)
+	}
+	out = appendBytesField(out, 14, msg)
+	out = appendVarintField(out, 15, 1) // Dnstap.Type = MESSAGE
+	return out
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	default:
+		return nil, 0
+	}
+}
+
+func firstIP(ips ...net.IP) net.IP {
+	for _, ip := range ips {
+		if ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+func ipBytes(ip net.IP) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, 0)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	b = appendTag(b, field, 5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
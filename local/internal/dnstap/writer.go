@@ -0,0 +1,244 @@
+package dnstap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+const contentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types
+const (
+	controlAccept = 0x01
+	controlStart  = 0x02
+	controlStop   = 0x03
+	controlReady  = 0x04
+	controlFinish = 0x05
+
+	controlFieldContentType = 0x01
+)
+
+// Writer ships dnstap frames to a Frame Streams collector over a unix or
+// TCP socket. Sends never block the query path: frames are queued and
+// dropped when the queue is full or the collector is unreachable.
+type Writer struct {
+	network  string
+	address  string
+	identity []byte
+	version  []byte
+	logger   *slog.Logger
+
+	queue   chan []byte
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+	sent    atomic.Uint64
+}
+
+// New creates a dnstap writer, or returns nil if dnstap is disabled
+func New(cfg config.DnstapConfig, logger *slog.Logger) (*Writer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	switch cfg.Network {
+	case "unix", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported dnstap network: %s", cfg.Network)
+	}
+
+	w := &Writer{
+		network:  cfg.Network,
+		address:  cfg.Address,
+		identity: []byte(cfg.Identity),
+		version:  []byte("dns-proxy-local"),
+		logger:   logger,
+		queue:    make(chan []byte, cfg.QueueSize),
+		done:     make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Write queues a message. It is safe to call on a nil Writer.
+func (w *Writer) Write(m *Message) {
+	if w == nil {
+		return
+	}
+
+	select {
+	case w.queue <- marshal(w.identity, w.version, m):
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Close flushes queued frames (best effort) and closes the connection
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	close(w.done)
+	w.wg.Wait()
+	return nil
+}
+
+// Stats returns writer counters
+func (w *Writer) Stats() map[string]interface{} {
+	if w == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"sent":    w.sent.Load(),
+		"dropped": w.dropped.Load(),
+		"queued":  len(w.queue),
+	}
+}
+
+func (w *Writer) run() {
+	defer w.wg.Done()
+
+	backoff := time.Second
+	for {
+		conn, err := w.connect()
+		if err != nil {
+			w.logger.Debug("dnstap connect failed", "address", w.address, "error", err)
+			select {
+			case <-w.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		w.logger.Info("dnstap connected", "network", w.network, "address", w.address)
+
+		if stop := w.pump(conn); stop {
+			return
+		}
+	}
+}
+
+// pump writes queued frames until the connection fails or the writer is
+// closed. It reports whether the writer is shutting down.
+func (w *Writer) pump(conn net.Conn) bool {
+	defer conn.Close()
+
+	for {
+		select {
+		case <-w.done:
+			w.drain(conn)
+			writeControl(conn, controlStop, false)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			readControl(conn, controlFinish)
+			return true
+
+		case frame := <-w.queue:
+			if err := writeData(conn, frame); err != nil {
+				w.logger.Warn("dnstap write failed", "error", err)
+				w.dropped.Add(1)
+				return false
+			}
+			w.sent.Add(1)
+		}
+	}
+}
+
+func (w *Writer) drain(conn net.Conn) {
+	for {
+		select {
+		case frame := <-w.queue:
+			if writeData(conn, frame) != nil {
+				return
+			}
+			w.sent.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+// connect dials the collector and performs the bidirectional Frame Streams
+// handshake: READY -> ACCEPT -> START.
+func (w *Writer) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(w.network, w.address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeControl(conn, controlReady, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readControl(conn, controlAccept); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := writeControl(conn, controlStart, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func writeData(wr io.Writer, frame []byte) error {
+	buf := make([]byte, 4, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	_, err := wr.Write(append(buf, frame...))
+	return err
+}
+
+func writeControl(wr io.Writer, ctype uint32, withContentType bool) error {
+	payload := binary.BigEndian.AppendUint32(nil, ctype)
+	if withContentType {
+		payload = binary.BigEndian.AppendUint32(payload, controlFieldContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(contentType)))
+		payload = append(payload, contentType...)
+	}
+
+	buf := binary.BigEndian.AppendUint32(nil, 0) // escape
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	_, err := wr.Write(append(buf, payload...))
+	return err
+}
+
+func readControl(rd io.Reader, want uint32) error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return errors.New("expected control frame")
+	}
+
+	length := binary.BigEndian.Uint32(hdr[4:])
+	if length < 4 || length > 512 {
+		return fmt.Errorf("invalid control frame length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return err
+	}
+
+	if got := binary.BigEndian.Uint32(payload[:4]); got != want {
+		return fmt.Errorf("unexpected control frame type %d", got)
+	}
+	return nil
+}
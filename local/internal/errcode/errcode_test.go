@@ -0,0 +1,34 @@
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	err := fmt.Errorf("resolve: %w", Wrap(TunnelDown, "all attempts failed", errors.New("connection refused")))
+	if got := Of(err); got != TunnelDown {
+		t.Errorf("Of = %q, want %q", got, TunnelDown)
+	}
+	if got := Of(errors.New("plain")); got != "" {
+		t.Errorf("unclassified error has code %q", got)
+	}
+}
+
+func TestForStatus(t *testing.T) {
+	tests := map[int]Code{
+		http.StatusUnauthorized:        EndpointAuth,
+		http.StatusForbidden:           BlockedPolicy,
+		http.StatusTooManyRequests:     RateLimited,
+		http.StatusBadRequest:          ProtocolMismatch,
+		http.StatusBadGateway:          TunnelDown,
+		http.StatusInternalServerError: TunnelDown,
+	}
+	for status, want := range tests {
+		if got := ForStatus(status); got != want {
+			t.Errorf("ForStatus(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Package hosts loads hosts-format files ("0.0.0.0 ads.example.com") into
+// a label trie and reloads them when they change on disk
+package hosts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+const (
+	// settle is how long a file must be left alone after a change before it
+	// is read again, so a list being downloaded is not loaded half written
+	settle = 500 * time.Millisecond
+	// pollInterval is how often the files are checked where they cannot be
+	// watched
+	pollInterval = 5 * time.Second
+	// maxLineLength bounds a line of a hosts file
+	maxLineLength = 64 * 1024
+)
+
+// Table maps names to the addresses hosts files give them. Names are kept
+// in a trie of labels from the top-level domain down, so the many names a
+// large ad-block list has under the same domains share their parents.
+type Table struct {
+	root    node
+	names   int
+	invalid int                   // lines and names skipped
+	ptr     map[netip.Addr]string // address -> first name given it, for reverse lookups
+}
+
+// node is one label of the trie
+type node struct {
+	label    string
+	children []*node          // sorted by label
+	addrs    []netip.Addr     // nil unless a name ends here
+	building map[string]*node // children while the table is loaded
+}
+
+// Lookup returns the addresses of name, in any case and with or without
+// the trailing dot, or nil if no file lists it
+func (t *Table) Lookup(name string) []netip.Addr {
+	name = strings.TrimSuffix(name, ".")
+	n := &t.root
+	for end := len(name); end > 0 && n != nil; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		n = n.child(strings.ToLower(name[start:end]))
+		end = start - 1
+	}
+	if n == nil || n == &t.root {
+		return nil
+	}
+	return n.addrs
+}
+
+// Name returns the name reverse lookups of addr answer with, an FQDN, or
+// "" if no file gives addr a name. Null addresses have none.
+func (t *Table) Name(addr netip.Addr) string {
+	return t.ptr[addr.Unmap()]
+}
+
+// Len returns the number of names in the table
+func (t *Table) Len() int {
+	return t.names
+}
+
+// child returns the child labelled label, or nil
+func (n *node) child(label string) *node {
+	i, ok := slices.BinarySearchFunc(n.children, label, func(c *node, label string) int {
+		return strings.Compare(c.label, label)
+	})
+	if !ok {
+		return nil
+	}
+	return n.children[i]
+}
+
+// builder fills a Table. Identical address lists, such as the single
+// 0.0.0.0 of every ad-block entry, are stored once.
+type builder struct {
+	table *Table
+	sets  map[string][]netip.Addr
+}
+
+func newBuilder() *builder {
+	return &builder{table: &Table{ptr: make(map[netip.Addr]string)}, sets: make(map[string][]netip.Addr)}
+}
+
+// add gives name, a lower case name without the trailing dot, addr
+func (b *builder) add(name string, addr netip.Addr) {
+	n := &b.table.root
+	for end := len(name); end > 0; {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		label := name[start:end]
+		next := n.building[label]
+		if next == nil {
+			if n.building == nil {
+				n.building = make(map[string]*node)
+			}
+			next = &node{label: label}
+			n.building[label] = next
+		}
+		n = next
+		end = start - 1
+	}
+	if _, ok := b.table.ptr[addr]; !ok && !addr.IsUnspecified() {
+		b.table.ptr[addr] = name + "."
+	}
+	if slices.Contains(n.addrs, addr) {
+		return
+	}
+	if n.addrs == nil {
+		b.table.names++
+	}
+	addrs := append(slices.Clip(n.addrs), addr)
+	key := fmt.Sprint(addrs)
+	if set, ok := b.sets[key]; ok {
+		addrs = set
+	} else {
+		b.sets[key] = addrs
+	}
+	n.addrs = addrs
+}
+
+// parse adds the entries of a hosts file: an address followed by names,
+// with # starting a comment
+func (b *builder) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxLineLength)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || len(fields) < 2 {
+			b.table.invalid++
+			continue
+		}
+		addr = addr.WithZone("").Unmap()
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			// Some lists carry "0.0.0.0 0.0.0.0" lines
+			if _, err := netip.ParseAddr(name); err == nil {
+				continue
+			}
+			if _, ok := dns.IsDomainName(name); !ok || strings.Contains(name, "..") {
+				b.table.invalid++
+				continue
+			}
+			b.add(name, addr)
+		}
+	}
+	return scanner.Err()
+}
+
+// finish sorts the trie's children for lookups and returns the table
+func (b *builder) finish() *Table {
+	stack := []*node{&b.table.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n.children = make([]*node, 0, len(n.building))
+		for _, c := range n.building {
+			n.children = append(n.children, c)
+		}
+		n.building = nil
+		slices.SortFunc(n.children, func(a, b *node) int { return strings.Compare(a.label, b.label) })
+		stack = append(stack, n.children...)
+	}
+	return b.table
+}
+
+// Load reads the hosts files into one table; a name listed in several
+// files gets the addresses of all of them
+func Load(files []string) (*Table, error) {
+	b := newBuilder()
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		err = b.parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return b.finish(), nil
+}
+
+// Hosts holds the table of the configured files and reloads it when any
+// of them changes: on Linux as soon as inotify reports a write or a file
+// renamed into place, elsewhere by polling their modification times. A
+// reload that fails keeps the previous table.
+type Hosts struct {
+	files    []string
+	logger   *slog.Logger
+	table    atomic.Pointer[Table]
+	loadedAt atomic.Int64 // unix seconds
+	reloads  atomic.Int64
+	failures atomic.Int64
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New loads the configured files and starts watching them, or returns nil
+// if none are configured
+func New(cfg config.HostsConfig, logger *slog.Logger) (*Hosts, error) {
+	if len(cfg.Files) == 0 {
+		return nil, nil
+	}
+	h := &Hosts{files: cfg.Files, logger: logger, done: make(chan struct{})}
+	table, err := Load(h.files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hosts files: %w", err)
+	}
+	h.store(table)
+	logger.Info("hosts files loaded", "files", len(h.files), "names", table.Len(), "invalid", table.invalid)
+
+	// Changes are caught from here on, even before the loop runs
+	run := h.watch()
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		run()
+	}()
+	return h, nil
+}
+
+// Lookup returns the addresses the files give name, or nil. It is safe to
+// call on a nil Hosts.
+func (h *Hosts) Lookup(name string) []netip.Addr {
+	if h == nil {
+		return nil
+	}
+	return h.table.Load().Lookup(name)
+}
+
+// Name returns the name the files give addr, or "". It is safe to call on
+// a nil Hosts.
+func (h *Hosts) Name(addr netip.Addr) string {
+	if h == nil {
+		return ""
+	}
+	return h.table.Load().Name(addr)
+}
+
+// Reload reads the files again, keeping the current table if that fails
+func (h *Hosts) Reload() error {
+	table, err := Load(h.files)
+	if err != nil {
+		h.failures.Add(1)
+		return err
+	}
+	h.store(table)
+	h.reloads.Add(1)
+	h.logger.Info("hosts files reloaded", "names", table.Len(), "invalid", table.invalid)
+	return nil
+}
+
+// reload is Reload for the watchers, which can only log its error
+func (h *Hosts) reload() {
+	if err := h.Reload(); err != nil {
+		h.logger.Error("hosts reload failed", "error", err)
+	}
+}
+
+func (h *Hosts) store(table *Table) {
+	h.table.Store(table)
+	h.loadedAt.Store(time.Now().Unix())
+}
+
+// Close stops watching the files. It is safe to call on a nil Hosts.
+func (h *Hosts) Close() {
+	if h == nil {
+		return
+	}
+	close(h.done)
+	h.wg.Wait()
+}
+
+// Stats returns the table's size and reload counters
+func (h *Hosts) Stats() map[string]interface{} {
+	table := h.table.Load()
+	return map[string]interface{}{
+		"files":           len(h.files),
+		"names":           table.Len(),
+		"invalid":         table.invalid,
+		"loaded_at":       time.Unix(h.loadedAt.Load(), 0).UTC().Format(time.RFC3339),
+		"reloads":         h.reloads.Load(),
+		"reload_failures": h.failures.Load(),
+	}
+}
+
+// poller returns the loop reloading the files whenever one's size or
+// modification time changes
+func (h *Hosts) poller() func() {
+	last := h.fingerprint()
+	return func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-ticker.C:
+				if now := h.fingerprint(); now != last {
+					last = now
+					h.reload()
+				}
+			}
+		}
+	}
+}
+
+// fingerprint returns the files' sizes and modification times
+func (h *Hosts) fingerprint() string {
+	var sb strings.Builder
+	for _, file := range h.files {
+		if fi, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&sb, "%d/%d;", fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			sb.WriteString("-;")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,150 @@
+package hosts
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	system := filepath.Join(dir, "hosts")
+	adblock := filepath.Join(dir, "adblock.hosts")
+	os.WriteFile(system, []byte(`# static names
+127.0.0.1	localhost
+192.168.1.10	nas.lan nas   # inline comment
+fe80::10%eth0	nas.lan
+::ffff:192.168.1.11 printer.lan.
+
+not-an-address	bad.example
+192.168.1.12
+`), 0o644)
+	os.WriteFile(adblock, []byte(`0.0.0.0 0.0.0.0
+0.0.0.0 Ads.Example.com
+0.0.0.0 tracker.ads.example.com
+0.0.0.0 ads.example.com bad..name
+192.168.1.20 nas.lan
+`), 0o644)
+
+	table, err := Load([]string{system, adblock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := func(s ...string) []netip.Addr {
+		var out []netip.Addr
+		for _, a := range s {
+			out = append(out, netip.MustParseAddr(a))
+		}
+		return out
+	}
+	tests := []struct {
+		name string
+		want []netip.Addr
+	}{
+		{"localhost", addrs("127.0.0.1")},
+		{"NAS.lan.", addrs("192.168.1.10", "fe80::10", "192.168.1.20")},
+		{"nas", addrs("192.168.1.10")},
+		{"printer.lan", addrs("192.168.1.11")},
+		{"ads.example.com.", addrs("0.0.0.0")},
+		{"tracker.ads.example.com", addrs("0.0.0.0")},
+		// Only the names listed, not their parents or subdomains
+		{"example.com", nil},
+		{"www.ads.example.com", nil},
+		{"lan", nil},
+		{"bad.example", nil},
+		{"0.0.0.0", nil},
+		{"", nil},
+		{".", nil},
+	}
+	for _, tt := range tests {
+		if got := table.Lookup(tt.name); !slices.Equal(got, tt.want) {
+			t.Errorf("Lookup(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if table.Len() != 6 || table.invalid != 3 {
+		t.Errorf("%d names, %d invalid; want 6 and 3", table.Len(), table.invalid)
+	}
+	// Reverse lookups get the first name given an address, null ones none
+	for addr, want := range map[string]string{"192.168.1.10": "nas.lan.", "::ffff:192.168.1.11": "printer.lan.", "fe80::10": "nas.lan.", "0.0.0.0": "", "192.168.1.99": ""} {
+		if got := table.Name(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Name(%s) = %q, want %q", addr, got, want)
+		}
+	}
+	// Identical address lists are shared
+	if &table.Lookup("ads.example.com")[0] != &table.Lookup("tracker.ads.example.com")[0] {
+		t.Error("0.0.0.0 stored once per name")
+	}
+
+	if _, err := Load([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	var sb strings.Builder
+	for i := range 100000 {
+		fmt.Fprintf(&sb, "0.0.0.0 ads%d.tracker%d.example.com\n", i, i%1000)
+	}
+	file := filepath.Join(b.TempDir(), "adblock.hosts")
+	os.WriteFile(file, []byte(sb.String()), 0o644)
+	b.ResetTimer()
+	for range b.N {
+		if _, err := Load([]string{file}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "adblock.hosts")
+	os.WriteFile(file, []byte("0.0.0.0 ads.example.com\n"), 0o644)
+	h, err := New(config.HostsConfig{Files: []string{file}}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if h.Lookup("ads.example.com") == nil {
+		t.Fatal("ads.example.com not loaded")
+	}
+
+	// Replaced the way list updaters do, by renaming a new file over it
+	next := file + ".tmp"
+	os.WriteFile(next, []byte("0.0.0.0 tracker.example.com\n"), 0o644)
+	if err := os.Rename(next, file); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(pollInterval + 5*time.Second)
+	for h.Lookup("tracker.example.com") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("not reloaded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if h.Lookup("ads.example.com") != nil {
+		t.Error("removed name still listed")
+	}
+
+	// A file that cannot be read keeps the table
+	os.Remove(file)
+	if err := h.Reload(); err == nil {
+		t.Error("reloaded a missing file")
+	}
+	stats := h.Stats()
+	if h.Lookup("tracker.example.com") == nil || stats["reloads"] != int64(1) || stats["reload_failures"] != int64(1) {
+		t.Errorf("after a failed reload: %v", stats)
+	}
+
+	var nilHosts *Hosts
+	if nilHosts.Lookup("ads.example.com") != nil {
+		t.Error("nil Hosts answered")
+	}
+	nilHosts.Close()
+}
@@ -0,0 +1,110 @@
+package hosts
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// watch sets inotify on the files and returns the loop reloading them
+// when one is written or renamed into place. The directories are watched,
+// not the files, so a file replaced by a new one keeps being followed.
+// Without inotify the files are polled.
+func (h *Hosts) watch() func() {
+	f, names, err := h.inotify()
+	if err != nil {
+		h.logger.Warn("cannot watch hosts files, polling them", "error", err)
+		return h.poller()
+	}
+
+	return func() {
+		// Closing the descriptor ends the pending read
+		defer f.Close()
+		changed := make(chan struct{}, 1)
+		go func() {
+			buf := make([]byte, 64*1024)
+			for {
+				n, err := f.Read(buf)
+				if err != nil {
+					return
+				}
+				if touches(buf[:n], names) {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}()
+
+		timer := time.NewTimer(settle)
+		timer.Stop()
+		for {
+			select {
+			case <-h.done:
+				timer.Stop()
+				return
+			case <-changed:
+				timer.Reset(settle)
+			case <-timer.C:
+				h.reload()
+			}
+		}
+	}
+}
+
+// inotify watches the files' directories, returning the inotify
+// descriptor and the file names watched in each directory by watch
+// descriptor
+func (h *Hosts) inotify() (*os.File, map[int32]map[string]bool, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Non-blocking, the descriptor goes to the runtime poller
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	names := make(map[int32]map[string]bool)
+	for _, file := range h.files {
+		wd, err := unix.InotifyAddWatch(fd, filepath.Dir(file), unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if names[int32(wd)] == nil {
+			names[int32(wd)] = make(map[string]bool)
+		}
+		names[int32(wd)][filepath.Base(file)] = true
+	}
+	return f, names, nil
+}
+
+// touches reports whether the inotify events in buf concern a watched
+// file, or were lost to an overflowing queue
+func touches(buf []byte, names map[int32]map[string]bool) bool {
+	for len(buf) >= unix.SizeofInotifyEvent {
+		wd := int32(binary.NativeEndian.Uint32(buf[0:]))
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		size := int(binary.NativeEndian.Uint32(buf[12:]))
+		if len(buf) < unix.SizeofInotifyEvent+size {
+			return false
+		}
+		name := string(trimNUL(buf[unix.SizeofInotifyEvent : unix.SizeofInotifyEvent+size]))
+		if mask&unix.IN_Q_OVERFLOW != 0 || names[wd][name] {
+			return true
+		}
+		buf = buf[unix.SizeofInotifyEvent+size:]
+	}
+	return false
+}
+
+// trimNUL strips the padding after an event's file name
+func trimNUL(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package hosts
+
+// watch returns the loop polling the files, there being no inotify
+func (h *Hosts) watch() func() {
+	return h.poller()
+}
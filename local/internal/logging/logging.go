@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// New creates a structured logger from the logging configuration.
+// The returned closer releases the output file, if any.
+func New(cfg config.LoggingConfig) (*slog.Logger, io.Closer, error) {
+	return NewTo(cfg, os.Stdout)
+}
+
+// NewTo is New writing to w instead of stdout when no output file is set
+func NewTo(cfg config.LoggingConfig, w io.Writer) (*slog.Logger, io.Closer, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var out io.WriteCloser = nopCloser{w}
+	if cfg.OutputFile != "" {
+		rf, err := NewRotatingFile(cfg.OutputFile, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = rf
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	case "text", "":
+		handler = slog.NewTextHandler(out, opts)
+	default:
+		out.Close()
+		return nil, nil, fmt.Errorf("unknown log format: %s", cfg.Format)
+	}
+
+	return slog.New(handler).With("service", "dns-local"), out, nil
+}
+
+// ParseLevel converts a level name (debug, info, warn, error) to a slog.Level
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info", "":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level: %s", name)
+	}
+}
+
+// Discard returns a logger that drops all records
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// RotatingFile is an io.WriteCloser that rotates the underlying file
+// once it grows past maxSize bytes, keeping up to maxBackups old files
+// named path.1, path.2, ...
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	header []byte // written at the start of every file
+}
+
+// NewRotatingFile opens (or creates) path for appending
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+
+	rf := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// Write appends p to the file, rotating first if the size limit would be exceeded
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// SetHeader makes every file start with header, for formats such as pcap
+// that need one: it is written now if the file is empty, and again after
+// each rotation.
+func (rf *RotatingFile) SetHeader(header []byte) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.header = header
+	return rf.writeHeader()
+}
+
+// writeHeader writes the header to an empty file (must be called with lock held)
+func (rf *RotatingFile) writeHeader() error {
+	if rf.size > 0 || len(rf.header) == 0 {
+		return nil
+	}
+	n, err := rf.file.Write(rf.header)
+	rf.size += int64(n)
+	return err
+}
+
+// Close closes the underlying file
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+// rotate shifts path.N-1 -> path.N ... path -> path.1 (must be called with lock held)
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	if rf.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+	return rf.writeHeader()
+}
@@ -0,0 +1,128 @@
+package obfuscation
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// maxChaffGapFactor caps a single gap between decoys at this multiple of
+// the mean interval, so an unlucky draw can't leave long silent stretches
+const maxChaffGapFactor = 5
+
+// ResolveFunc sends one query through the tunnel
+type ResolveFunc func(ctx context.Context, domain, recordType string) error
+
+// Shaper blurs the timing and volume of traffic on the API channel. Real
+// queries are held back by a random delay so request timing doesn't mirror
+// browsing, and decoy ("chaff") resolutions of popular domains are sent at
+// random intervals so idle periods and bursts are harder to read.
+type Shaper struct {
+	cfg     config.ObfuscationConfig
+	resolve ResolveFunc
+	logger  *slog.Logger
+
+	delayed     atomic.Int64
+	chaffSent   atomic.Int64
+	chaffFailed atomic.Int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a shaper, or returns nil if obfuscation is disabled. Decoys
+// are sent through resolve until Close is called.
+func New(cfg config.ObfuscationConfig, resolve ResolveFunc, logger *slog.Logger) *Shaper {
+	if !cfg.Enabled {
+		return nil
+	}
+	s := &Shaper{
+		cfg:     cfg,
+		resolve: resolve,
+		logger:  logger,
+		stop:    make(chan struct{}),
+	}
+	if cfg.ChaffInterval > 0 && len(cfg.ChaffDomains) > 0 {
+		go s.chaff()
+	}
+	return s
+}
+
+// Delay waits a random time between jitter_min and jitter_max before a real
+// query is sent. It returns early with the context's error if ctx ends, and
+// is safe to call on a nil Shaper.
+func (s *Shaper) Delay(ctx context.Context) error {
+	if s == nil || s.cfg.JitterMax <= 0 {
+		return nil
+	}
+	d := s.cfg.JitterMin
+	if spread := s.cfg.JitterMax - s.cfg.JitterMin; spread > 0 {
+		d += time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+	if d <= 0 {
+		return nil
+	}
+	s.delayed.Add(1)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// chaff sends decoy queries with exponentially distributed gaps (a Poisson
+// process), which has no fixed period for an observer to pick out
+func (s *Shaper) chaff() {
+	for {
+		gap := time.Duration(rand.ExpFloat64() * float64(s.cfg.ChaffInterval))
+		if limit := maxChaffGapFactor * s.cfg.ChaffInterval; gap > limit {
+			gap = limit
+		}
+
+		t := time.NewTimer(gap)
+		select {
+		case <-s.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		domain := s.cfg.ChaffDomains[rand.Intn(len(s.cfg.ChaffDomains))]
+		recordType := "A"
+		if rand.Intn(2) == 0 {
+			recordType = "AAAA"
+		}
+		if err := s.resolve(context.Background(), domain, recordType); err != nil {
+			s.chaffFailed.Add(1)
+			s.logger.Debug("decoy query failed", "domain", domain, "error", err)
+			continue
+		}
+		s.chaffSent.Add(1)
+	}
+}
+
+// Close stops sending decoys. It is safe to call on a nil Shaper.
+func (s *Shaper) Close() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// Stats returns shaping counters
+func (s *Shaper) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"delayed_queries": s.delayed.Load(),
+		"chaff_sent":      s.chaffSent.Load(),
+		"chaff_failed":    s.chaffFailed.Load(),
+	}
+}
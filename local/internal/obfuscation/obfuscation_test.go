@@ -0,0 +1,79 @@
+package obfuscation
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestDisabledIsNil(t *testing.T) {
+	s := New(config.ObfuscationConfig{}, nil, logging.Discard())
+	if s != nil {
+		t.Fatal("expected nil shaper when disabled")
+	}
+	if err := s.Delay(context.Background()); err != nil {
+		t.Errorf("nil Delay returned %v", err)
+	}
+	s.Close()
+}
+
+func TestDelay(t *testing.T) {
+	s := New(config.ObfuscationConfig{
+		Enabled:   true,
+		JitterMin: 20 * time.Millisecond,
+		JitterMax: 30 * time.Millisecond,
+	}, nil, logging.Discard())
+	defer s.Close()
+
+	start := time.Now()
+	if err := s.Delay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("delay %v shorter than jitter_min", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Delay(ctx); err == nil {
+		t.Error("expected cancelled context to end the delay")
+	}
+}
+
+func TestChaff(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	resolve := func(ctx context.Context, domain, recordType string) error {
+		mu.Lock()
+		seen[domain]++
+		mu.Unlock()
+		return nil
+	}
+
+	s := New(config.ObfuscationConfig{
+		Enabled:       true,
+		ChaffInterval: time.Millisecond,
+		ChaffDomains:  []string{"example.com", "example.org"},
+	}, resolve, logging.Discard())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Stats()["chaff_sent"].(int64) < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.Close()
+
+	if n := s.Stats()["chaff_sent"].(int64); n < 5 {
+		t.Fatalf("expected decoy queries, got %d", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for domain := range seen {
+		if domain != "example.com" && domain != "example.org" {
+			t.Errorf("decoy for %q outside the pool", domain)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Package pcap writes the DNS messages exchanged with clients to pcap
+// files that Wireshark and tcpdump open directly, for debugging what went
+// over the wire without running a packet capture on the host.
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+const (
+	linkTypeRaw = 101 // LINKTYPE_RAW: packets start with an IPv4 or IPv6 header
+	snapLen     = 65535
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+
+	// maxPayload is the largest DNS message that fits one IPv4 UDP datagram
+	maxPayload = 65535 - ipv4HeaderLen - udpHeaderLen
+)
+
+// Writer appends client queries and responses to a rotating pcap file. Each
+// message is written as a UDP datagram between the client and listener
+// addresses, with IP and UDP headers synthesized around it; messages that
+// came over TCP, DoT or DoH are written the same way, since Wireshark only
+// needs the port to decode them as DNS.
+type Writer struct {
+	out        io.WriteCloser
+	sampleRate float64
+
+	mu      sync.Mutex
+	buf     []byte
+	written atomic.Int64
+	skipped atomic.Int64 // messages too large for a datagram
+}
+
+// New creates a writer, or returns nil if capture is disabled
+func New(cfg config.PcapConfig) (*Writer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	out, err := logging.NewRotatingFile(cfg.File, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pcap file: %w", err)
+	}
+	if err := out.SetHeader(fileHeader()); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("failed to write pcap header: %w", err)
+	}
+	return &Writer{out: out, sampleRate: cfg.SampleRate}, nil
+}
+
+// fileHeader returns the pcap global header
+func fileHeader() []byte {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4) // microsecond timestamps
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], snapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	return h
+}
+
+// Sampled reports whether the exchange with client and message ID id is
+// captured. The choice is a hash of both, so a query and its response are
+// always kept or dropped together. It is safe to call on a nil Writer.
+func (w *Writer) Sampled(client net.Addr, id uint16) bool {
+	if w == nil {
+		return false
+	}
+	if w.sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	if ip, _ := addrPort(client); ip != nil {
+		h.Write(ip)
+	}
+	h.Write([]byte{byte(id >> 8), byte(id)})
+	return float64(h.Sum32()) < w.sampleRate*math.MaxUint32
+}
+
+// Write records wire, a packed DNS message sent from src to dst at t. It is
+// safe to call on a nil Writer.
+func (w *Writer) Write(src, dst net.Addr, wire []byte, t time.Time) {
+	if w == nil {
+		return
+	}
+	if len(wire) > maxPayload {
+		w.skipped.Add(1)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = appendRecord(w.buf[:0], src, dst, wire, t)
+	if _, err := w.out.Write(w.buf); err == nil {
+		w.written.Add(1)
+	}
+}
+
+// Close closes the pcap file
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.out.Close()
+}
+
+// Stats returns the number of messages written and skipped
+func (w *Writer) Stats() map[string]interface{} {
+	return map[string]interface{}{
+		"sample_rate": w.sampleRate,
+		"written":     w.written.Load(),
+		"skipped":     w.skipped.Load(),
+	}
+}
+
+// appendRecord appends a pcap record holding wire in a UDP datagram
+func appendRecord(b []byte, src, dst net.Addr, wire []byte, t time.Time) []byte {
+	srcIP, srcPort := addrPort(src)
+	dstIP, dstPort := addrPort(dst)
+	v4 := srcIP.To4() != nil && dstIP.To4() != nil
+	if v4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else {
+		// One side IPv6, e.g. a dual-stack socket: write both as IPv6,
+		// IPv4-mapped where needed
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	udpLen := udpHeaderLen + len(wire)
+	packetLen := ipv6HeaderLen + udpLen
+	if v4 {
+		packetLen = ipv4HeaderLen + udpLen
+	}
+
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(packetLen))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(packetLen))
+	b = append(b, rec[:]...)
+
+	ipStart := len(b)
+	if v4 {
+		b = append(b, 0x45, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(packetLen))
+		b = append(b, 0, 0, 0x40, 0, 64, 17, 0, 0) // don't fragment, TTL 64, UDP
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+		binary.BigEndian.PutUint16(b[ipStart+10:], checksum(0, b[ipStart:]))
+	} else {
+		b = append(b, 0x60, 0, 0, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+		b = append(b, 17, 64) // UDP, hop limit 64
+		b = append(b, srcIP...)
+		b = append(b, dstIP...)
+	}
+
+	udpStart := len(b)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	b = binary.BigEndian.AppendUint16(b, dstPort)
+	b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+	b = append(b, 0, 0)
+	b = append(b, wire...)
+
+	// The UDP checksum covers a pseudo-header of addresses, protocol and
+	// length; IPv6 requires it, and Wireshark flags a wrong one either way
+	var sum uint32
+	sum = sumWords(sum, srcIP)
+	sum = sumWords(sum, dstIP)
+	sum += 17 + uint32(udpLen)
+	csum := checksum(sum, b[udpStart:])
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[udpStart+6:], csum)
+	return b
+}
+
+// addrPort returns the IP and port of a UDP or TCP address. Other addresses
+// (DoH clients seen through a proxy, for instance) get the unspecified
+// address and port 0.
+func addrPort(addr net.Addr) (net.IP, uint16) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	}
+	return net.IPv4zero, 0
+}
+
+// sumWords adds b to a ones' complement sum as big-endian 16-bit words
+func sumWords(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum completes the Internet checksum of b, starting from sum
+func checksum(sum uint32, b []byte) uint16 {
+	sum = sumWords(sum, b)
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
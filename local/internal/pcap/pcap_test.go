@@ -0,0 +1,154 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// packets parses a pcap file into the packets it holds
+func packets(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	if len(data) < 24 || !bytes.Equal(data[:24], fileHeader()) {
+		t.Fatalf("missing pcap header: % x", data[:min(len(data), 24)])
+	}
+	var out [][]byte
+	for b := data[24:]; len(b) > 0; {
+		if len(b) < 16 {
+			t.Fatalf("truncated record header")
+		}
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		if len(b) < 16+n {
+			t.Fatalf("truncated packet")
+		}
+		out = append(out, b[16:16+n])
+		b = b[16+n:]
+	}
+	return out
+}
+
+// datagram checks a packet's headers and returns its ports and payload
+func datagram(t *testing.T, pkt []byte) (src, dst net.IP, srcPort, dstPort uint16, payload []byte) {
+	t.Helper()
+	var pseudo uint32
+	var udp []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if checksum(0, pkt[:ipv4HeaderLen]) != 0 {
+			t.Error("bad IPv4 header checksum")
+		}
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		udp = pkt[ipv4HeaderLen:]
+	case 6:
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		udp = pkt[ipv6HeaderLen:]
+	default:
+		t.Fatalf("not an IP packet: % x", pkt[:4])
+	}
+	pseudo = sumWords(sumWords(0, src), dst) + 17 + uint32(len(udp))
+	if checksum(pseudo, udp) != 0 {
+		t.Error("bad UDP checksum")
+	}
+	if int(binary.BigEndian.Uint16(udp[4:])) != len(udp) {
+		t.Errorf("UDP length %d, want %d", binary.BigEndian.Uint16(udp[4:]), len(udp))
+	}
+	return src, dst, binary.BigEndian.Uint16(udp), binary.BigEndian.Uint16(udp[2:]), udp[udpHeaderLen:]
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.pcap")
+	w, err := New(config.PcapConfig{Enabled: true, File: path, SampleRate: 1, MaxSizeMB: 1, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	wire, _ := q.Pack()
+
+	tests := []struct {
+		src, dst net.Addr
+		wantSrc  string
+	}{
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::53"), Port: 53}, "2001:db8::1"},
+		// IPv4 client on a dual-stack socket
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}, &net.UDPAddr{IP: net.IPv6unspecified, Port: 53}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		w.Write(tt.src, tt.dst, wire, time.Now())
+	}
+	w.Write(tests[0].src, tests[0].dst, make([]byte, maxPayload+1), time.Now())
+	w.Close()
+
+	data, _ := os.ReadFile(path)
+	pkts := packets(t, data)
+	if len(pkts) != len(tests) {
+		t.Fatalf("%d packets, want %d", len(pkts), len(tests))
+	}
+	for i, pkt := range pkts {
+		src, _, srcPort, dstPort, payload := datagram(t, pkt)
+		if !src.Equal(net.ParseIP(tests[i].wantSrc)) || srcPort != 40000 || dstPort != 53 {
+			t.Errorf("packet %d: %s:%d -> %d", i, src, srcPort, dstPort)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(payload); err != nil || m.Question[0].Name != "example.com." {
+			t.Errorf("packet %d: payload %v, %v", i, m, err)
+		}
+	}
+	if got := w.Stats()["skipped"]; got != int64(1) {
+		t.Errorf("skipped = %v, want 1", got)
+	}
+}
+
+func TestRotationKeepsHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.pcap")
+	w, err := New(config.PcapConfig{Enabled: true, File: path, SampleRate: 1, MaxSizeMB: 1, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53}
+	for i := 0; i < 40; i++ {
+		w.Write(src, dst, make([]byte, 60000), time.Now())
+	}
+	w.Close()
+
+	for _, p := range []string{path, path + ".1"} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(packets(t, data)); n == 0 {
+			t.Errorf("%s holds no packets", p)
+		}
+	}
+}
+
+func TestSampled(t *testing.T) {
+	if (*Writer)(nil).Sampled(nil, 1) {
+		t.Error("nil writer sampled")
+	}
+	w := &Writer{sampleRate: 0.25}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	kept := 0
+	for id := 0; id < 4000; id++ {
+		if w.Sampled(client, uint16(id)) {
+			kept++
+		}
+		if w.Sampled(client, uint16(id)) != w.Sampled(client, uint16(id)) {
+			t.Fatalf("id %d sampled inconsistently", id)
+		}
+	}
+	if kept < 800 || kept > 1200 {
+		t.Errorf("kept %d of 4000 at rate 0.25", kept)
+	}
+}
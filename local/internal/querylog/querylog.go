@@ -0,0 +1,151 @@
+package querylog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// Source identifies where an answer came from
+type Source string
+
+const (
+	SourceCache     Source = "cache"
+	SourceAPI       Source = "api"
+	SourceBlocked   Source = "blocked"
+	SourceThrottled Source = "throttled"
+	SourceDenied    Source = "denied"
+	SourceDropped   Source = "dropped" // left unanswered by the query policy
+	SourceInvalid   Source = "invalid"
+	SourceCacheOnly Source = "cache_only" // a cache miss for a cache-only client
+	SourceFallback  Source = "fallback"
+	SourceLocal     Source = "local"   // built-in answer for localhost or this host
+	SourceRewrite   Source = "rewrite" // fixed answer of a rewrite rule
+	SourceError     Source = "error"
+)
+
+// Entry is a single query log record
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Device    string    `json:"device,omitempty"` // from the DoT client certificate
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	LatencyMs float64   `json:"latency_ms"`
+	Source    Source    `json:"source"`
+	Code      string    `json:"code,omitempty"` // error code of failed queries
+}
+
+// Logger writes query log entries with the configured privacy transforms
+type Logger struct {
+	out         io.WriteCloser
+	anonymizeIP string
+	hashQNames  bool
+	salt        []byte
+	mu          sync.Mutex
+}
+
+// New creates a query logger, or returns nil if the query log is disabled
+func New(cfg config.QueryLogConfig) (*Logger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var out io.WriteCloser
+	var err error
+	switch cfg.Output {
+	case "syslog":
+		out, err = newSyslogWriter()
+	case "file":
+		out, err = logging.NewRotatingFile(cfg.File, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+	default:
+		err = fmt.Errorf("unknown query log output: %s", cfg.Output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{
+		out:         out,
+		anonymizeIP: cfg.AnonymizeIP,
+		hashQNames:  cfg.HashQNames,
+		salt:        []byte(cfg.HashSalt),
+	}, nil
+}
+
+// Log records a query. It is safe to call on a nil Logger.
+func (l *Logger) Log(e Entry) {
+	if l == nil {
+		return
+	}
+
+	e.Client = l.client(e.Client)
+	if l.hashQNames {
+		e.QName = l.hash(e.QName)
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// Close closes the underlying output
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.out.Close()
+}
+
+func (l *Logger) client(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	switch l.anonymizeIP {
+	case "none", "":
+		return host
+	case "hash":
+		return l.hash(host)
+	case "truncate":
+		return AnonymizeIP(host)
+	default:
+		return host
+	}
+}
+
+func (l *Logger) hash(s string) string {
+	h := sha256.New()
+	h.Write(l.salt)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// AnonymizeIP zeroes the host part of an address, keeping a /24 for IPv4
+// and a /48 for IPv6.
+func AnonymizeIP(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,85 @@
+package querylog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{"192.168.1.77", "192.168.1.0"},
+		{"2001:db8:abcd:12::1", "2001:db8:abcd::"},
+		{"not-an-ip", "not-an-ip"},
+	}
+
+	for _, tc := range testCases {
+		if got := AnonymizeIP(tc.in); got != tc.want {
+			t.Errorf("AnonymizeIP(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestLoggerPrivacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+
+	l, err := New(config.QueryLogConfig{
+		Enabled:     true,
+		Output:      "file",
+		File:        path,
+		AnonymizeIP: "truncate",
+		HashQNames:  true,
+		HashSalt:    "salt",
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	l.Log(Entry{
+		Time:   time.Now(),
+		Client: "10.0.0.42:5353",
+		QName:  "secret.example.com.",
+		QType:  "A",
+		Rcode:  "NOERROR",
+		Source: SourceAPI,
+	})
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if e.Client != "10.0.0.0" {
+		t.Errorf("Expected truncated client, got %s", e.Client)
+	}
+	if e.QName == "secret.example.com." || len(e.QName) != 16 {
+		t.Errorf("Expected hashed qname, got %s", e.QName)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	l, err := New(config.QueryLogConfig{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if l != nil {
+		t.Fatal("Expected nil logger when disabled")
+	}
+
+	// Must be safe on nil
+	l.Log(Entry{})
+	l.Close()
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package querylog
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter() (io.WriteCloser, error) {
+	return nil, errors.New("syslog output is not supported on this platform")
+}
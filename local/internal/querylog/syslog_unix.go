@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+
+package querylog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func newSyslogWriter() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "dns-local-query")
+}
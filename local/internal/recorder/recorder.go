@@ -0,0 +1,180 @@
+// Package recorder captures exchanges with the remote API so user-reported
+// resolution problems can be reproduced offline, and replays them in place
+// of the API client.
+package recorder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// Exchange is one recorded API round trip. Only the plaintext question and
+// answer are kept: no API keys, ciphertext, or endpoint URLs.
+type Exchange struct {
+	Time      time.Time               `json:"time"`
+	Domain    string                  `json:"domain"`
+	Type      string                  `json:"type"`
+	Response  *client.ResolveResponse `json:"response,omitempty"`
+	Error     string                  `json:"error,omitempty"`
+	Code      errcode.Code            `json:"code,omitempty"` // error code of a failed exchange
+	LatencyMs float64                 `json:"latency_ms"`
+}
+
+// urlPattern matches URLs in error messages, which may carry endpoint
+// hostnames or tokens
+var urlPattern = regexp.MustCompile(`https?://[^\s"]+`)
+
+// Recorder appends exchanges to a file as JSON lines
+type Recorder struct {
+	out io.WriteCloser
+	mu  sync.Mutex
+}
+
+// New creates a recorder, or returns nil if recording is disabled
+func New(cfg config.RecordConfig) (*Recorder, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	out, err := logging.NewRotatingFile(cfg.File, int64(cfg.MaxSizeMB)*1024*1024, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open record file: %w", err)
+	}
+	return &Recorder{out: out}, nil
+}
+
+// Record stores one exchange. It is safe to call on a nil Recorder.
+func (r *Recorder) Record(domain, recordType string, resp *client.ResolveResponse, err error, latency time.Duration) {
+	if r == nil {
+		return
+	}
+
+	e := Exchange{
+		Time:      time.Now().UTC(),
+		Domain:    domain,
+		Type:      recordType,
+		Response:  resp,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+	}
+	if err != nil {
+		e.Response = nil
+		e.Error = urlPattern.ReplaceAllString(err.Error(), "<endpoint>")
+		e.Code = errcode.Of(err)
+	}
+
+	line, mErr := json.Marshal(e)
+	if mErr != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out.Write(line)
+}
+
+// Close closes the record file
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.out.Close()
+}
+
+// Replayer answers API queries from a recording. Repeated questions get
+// their recorded answers in order, the last one repeating once exhausted.
+type Replayer struct {
+	exchanges []Exchange
+	byKey     map[string][]Exchange
+	next      map[string]int
+	mu        sync.Mutex
+}
+
+// Load reads a recording made by a Recorder
+func Load(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &Replayer{
+		byKey: make(map[string][]Exchange),
+		next:  make(map[string]int),
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var e Exchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		p.exchanges = append(p.exchanges, e)
+		k := key(e.Domain, e.Type)
+		p.byKey[k] = append(p.byKey[k], e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Exchanges returns the recording in its original order
+func (p *Replayer) Exchanges() []Exchange {
+	return p.exchanges
+}
+
+// Resolve returns the next recorded answer for the question, with the
+// recorded error if the original request failed
+func (p *Replayer) Resolve(ctx context.Context, domain string, recordType string) (*client.ResolveResponse, error) {
+	k := key(domain, recordType)
+
+	p.mu.Lock()
+	recorded := p.byKey[k]
+	i := p.next[k]
+	if i < len(recorded)-1 {
+		p.next[k] = i + 1
+	}
+	p.mu.Unlock()
+
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("no recorded answer for %s %s", domain, recordType)
+	}
+	e := recorded[i]
+	if e.Error != "" {
+		if e.Code != "" {
+			return nil, errcode.New(e.Code, "recorded failure: "+e.Error)
+		}
+		return nil, fmt.Errorf("recorded failure: %s", e.Error)
+	}
+	if e.Response == nil {
+		return nil, fmt.Errorf("recorded exchange for %s %s has no response", domain, recordType)
+	}
+	resp := *e.Response
+	resp.Records = append([]client.DNSRecord(nil), e.Response.Records...)
+	return &resp, nil
+}
+
+// Stats reports the size of the recording
+func (p *Replayer) Stats() map[string]interface{} {
+	return map[string]interface{}{"replay_exchanges": len(p.exchanges)}
+}
+
+func key(domain, recordType string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, ".")) + ":" + strings.ToUpper(recordType)
+}
@@ -0,0 +1,68 @@
+package recorder
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.jsonl")
+	rec, err := New(config.RecordConfig{Enabled: true, File: path, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &client.ResolveResponse{Domain: "example.com", Records: []client.DNSRecord{{Name: "example.com", Type: "A", Value: "192.0.2.1", TTL: 60}}}
+	second := &client.ResolveResponse{Domain: "example.com", Records: []client.DNSRecord{{Name: "example.com", Type: "A", Value: "192.0.2.2", TTL: 60}}}
+	rec.Record("example.com", "A", first, nil, time.Millisecond)
+	rec.Record("example.com", "A", second, nil, time.Millisecond)
+	rec.Record("broken.example", "AAAA", nil, errors.New(`Post "https://api.example.net/secret-path": timeout`), time.Second)
+	rec.Close()
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "secret-path") {
+		t.Errorf("endpoint URL leaked into recording: %s", data)
+	}
+
+	replayer, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(replayer.Exchanges()); n != 3 {
+		t.Fatalf("loaded %d exchanges, want 3", n)
+	}
+
+	ctx := context.Background()
+	for _, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.2"} {
+		resp, err := replayer.Resolve(ctx, "Example.com.", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Records[0].Value; got != want {
+			t.Errorf("replayed %s, want %s", got, want)
+		}
+	}
+
+	if _, err := replayer.Resolve(ctx, "broken.example", "AAAA"); err == nil || !strings.Contains(err.Error(), "<endpoint>") {
+		t.Errorf("expected the recorded failure, got %v", err)
+	}
+	if _, err := replayer.Resolve(ctx, "unknown.example", "A"); err == nil {
+		t.Error("expected an error for an unrecorded question")
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var rec *Recorder
+	rec.Record("example.com", "A", nil, nil, 0)
+	if err := rec.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,336 @@
+// Package report sends a periodic usage summary (query volume, top domains,
+// blocked queries, tunnel availability and endpoint latency) to a webhook
+// or by email, for operators who want passive reporting instead of polling
+// stats.
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/cache"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/querylog"
+)
+
+const (
+	// maxDomains bounds the distinct names counted per period; once reached,
+	// queries for new names are only counted as other_domains
+	maxDomains = 10000
+
+	// checkInterval is how often tunnel availability is sampled
+	checkInterval = time.Minute
+
+	sendTimeout = 30 * time.Second
+)
+
+// StatsFunc returns the server statistics reports are built from
+type StatsFunc func() map[string]interface{}
+
+// Report is one period's summary. Webhooks receive it as JSON.
+type Report struct {
+	Period       string             `json:"period"` // daily or weekly
+	From         time.Time          `json:"from"`
+	To           time.Time          `json:"to"`
+	Queries      int64              `json:"queries"`
+	Sources      map[string]int64   `json:"sources"` // queries by answer source: api, cache, fallback, ...
+	Blocked      int64              `json:"blocked"` // blocked, denied and throttled queries
+	TopDomains   []DomainCount      `json:"top_domains"`
+	OtherDomains int64              `json:"other_domains,omitempty"` // queries for names past the counting limit
+	Availability float64            `json:"tunnel_availability"`     // share of checks with a healthy endpoint, 0-1
+	Latency      map[string]float64 `json:"endpoint_latency_ms"`     // current latency estimate per endpoint
+	Cache        *cache.Stats       `json:"cache,omitempty"`         // cache counters since start
+}
+
+// DomainCount is a queried name and how often it was asked for
+type DomainCount struct {
+	Domain  string `json:"domain"`
+	Queries int64  `json:"queries"`
+}
+
+// Reporter counts queries between reports and sends a Report on schedule
+type Reporter struct {
+	cfg    config.ReportConfig
+	stats  StatsFunc
+	logger *slog.Logger
+	client *http.Client
+	mail   func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+	mu      sync.Mutex
+	from    time.Time
+	queries int64
+	sources map[string]int64
+	domains map[string]int64
+	other   int64
+	checks  int
+	up      int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a reporter, or returns nil if reports are disabled. Reports
+// are sent until Close is called.
+func New(cfg config.ReportConfig, stats StatsFunc, logger *slog.Logger) *Reporter {
+	if !cfg.Enabled {
+		return nil
+	}
+	r := newReporter(cfg, stats, logger)
+	go r.run()
+	return r
+}
+
+func newReporter(cfg config.ReportConfig, stats StatsFunc, logger *slog.Logger) *Reporter {
+	return &Reporter{
+		cfg:     cfg,
+		stats:   stats,
+		logger:  logger,
+		client:  &http.Client{Timeout: sendTimeout},
+		mail:    smtp.SendMail,
+		from:    time.Now(),
+		sources: make(map[string]int64),
+		domains: make(map[string]int64),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Observe counts an answered query. It is safe to call on a nil Reporter.
+func (r *Reporter) Observe(qname string, source querylog.Source) {
+	if r == nil {
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries++
+	r.sources[string(source)]++
+	if _, ok := r.domains[name]; ok || len(r.domains) < maxDomains {
+		r.domains[name]++
+	} else {
+		r.other++
+	}
+}
+
+// Close stops sending reports. It is safe to call on a nil Reporter.
+func (r *Reporter) Close() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *Reporter) run() {
+	check := time.NewTicker(checkInterval)
+	defer check.Stop()
+	due := time.NewTimer(time.Until(next(r.cfg, time.Now())))
+	defer due.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-check.C:
+			r.checkAvailability()
+		case now := <-due.C:
+			r.send(r.build(now))
+			due.Reset(time.Until(next(r.cfg, time.Now())))
+		}
+	}
+}
+
+// next returns the first scheduled report time after now: cfg.At every
+// day, or on Mondays for weekly reports
+func next(cfg config.ReportConfig, now time.Time) time.Time {
+	at, _ := time.Parse("15:04", cfg.At)
+	t := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	for !t.After(now) || (cfg.Schedule == "weekly" && t.Weekday() != time.Monday) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// checkAvailability samples whether any endpoint is healthy
+func (r *Reporter) checkAvailability() {
+	api, _ := r.stats()["api"].(map[string]interface{})
+	healthy, ok := api["endpoints_healthy"].(int)
+	if !ok {
+		return // replayed traffic has no endpoints to judge
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks++
+	if healthy > 0 {
+		r.up++
+	}
+}
+
+// build summarizes the period ending at now and starts the next one
+func (r *Reporter) build(now time.Time) *Report {
+	stats := r.stats()
+
+	r.mu.Lock()
+	rep := &Report{
+		Period:       r.cfg.Schedule,
+		From:         r.from,
+		To:           now,
+		Queries:      r.queries,
+		Sources:      r.sources,
+		OtherDomains: r.other,
+		Availability: 1,
+		Latency:      make(map[string]float64),
+	}
+	if r.checks > 0 {
+		rep.Availability = float64(r.up) / float64(r.checks)
+	}
+	domains := r.domains
+	r.from, r.queries, r.other, r.checks, r.up = now, 0, 0, 0, 0
+	r.sources = make(map[string]int64)
+	r.domains = make(map[string]int64)
+	r.mu.Unlock()
+
+	for _, source := range []querylog.Source{querylog.SourceBlocked, querylog.SourceDenied, querylog.SourceThrottled, querylog.SourceInvalid, querylog.SourceDropped, querylog.SourceCacheOnly} {
+		rep.Blocked += rep.Sources[string(source)]
+	}
+	rep.TopDomains = topDomains(domains, r.cfg.TopDomains)
+
+	api, _ := stats["api"].(map[string]interface{})
+	endpoints, _ := api["endpoints"].(map[string]interface{})
+	for url, v := range endpoints {
+		ep, _ := v.(map[string]interface{})
+		if latency, ok := ep["latency_ms"].(float64); ok {
+			rep.Latency[url] = latency
+		}
+	}
+	if c, ok := stats["cache"].(cache.Stats); ok {
+		rep.Cache = &c
+	}
+	return rep
+}
+
+// topDomains returns the n most queried names, ties broken by name
+func topDomains(domains map[string]int64, n int) []DomainCount {
+	top := make([]DomainCount, 0, len(domains))
+	for name, count := range domains {
+		top = append(top, DomainCount{Domain: name, Queries: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Queries != top[j].Queries {
+			return top[i].Queries > top[j].Queries
+		}
+		return top[i].Domain < top[j].Domain
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// send delivers rep to every configured destination
+func (r *Reporter) send(rep *Report) {
+	if r.cfg.WebhookURL != "" {
+		if err := r.postWebhook(rep); err != nil {
+			r.logger.Warn("report webhook failed", "url", r.cfg.WebhookURL, "error", err)
+		}
+	}
+	if r.cfg.Email.SMTPAddr != "" {
+		if err := r.sendEmail(rep); err != nil {
+			r.logger.Warn("report email failed", "smtp_addr", r.cfg.Email.SMTPAddr, "error", err)
+		}
+	}
+	r.logger.Info("report sent", "period", rep.Period, "queries", rep.Queries)
+}
+
+func (r *Reporter) postWebhook(rep *Report) error {
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *Reporter) sendEmail(rep *Report) error {
+	e := r.cfg.Email
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, _ := net.SplitHostPort(e.SMTPAddr)
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: DNS proxy %s report, %s\r\n", rep.Period, rep.To.Format("2006-01-02"))
+	fmt.Fprintf(&msg, "Date: %s\r\n", rep.To.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(rep.Text(), "\n", "\r\n"))
+
+	return r.mail(e.SMTPAddr, auth, e.From, e.To, msg.Bytes())
+}
+
+// Text formats the report for reading, as sent by email
+func (rep *Report) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Period: %s to %s\n\n", rep.From.Format("2006-01-02 15:04"), rep.To.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&b, "Queries: %d\n", rep.Queries)
+
+	sources := make([]string, 0, len(rep.Sources))
+	for source := range rep.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		fmt.Fprintf(&b, "  %-10s %d\n", source, rep.Sources[source])
+	}
+	fmt.Fprintf(&b, "Blocked: %d\n", rep.Blocked)
+	fmt.Fprintf(&b, "Tunnel availability: %.2f%%\n", rep.Availability*100)
+	if rep.Cache != nil {
+		fmt.Fprintf(&b, "Cache: %d entries, %d hits, %d misses since start\n", rep.Cache.Size, rep.Cache.Hits, rep.Cache.Misses)
+	}
+
+	if len(rep.Latency) > 0 {
+		b.WriteString("\nEndpoint latency:\n")
+		urls := make([]string, 0, len(rep.Latency))
+		for url := range rep.Latency {
+			urls = append(urls, url)
+		}
+		sort.Strings(urls)
+		for _, url := range urls {
+			fmt.Fprintf(&b, "  %s  %.1f ms\n", url, rep.Latency[url])
+		}
+	}
+
+	if len(rep.TopDomains) > 0 {
+		b.WriteString("\nTop domains:\n")
+		for _, d := range rep.TopDomains {
+			fmt.Fprintf(&b, "  %8d  %s\n", d.Queries, d.Domain)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package report
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/cache"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+	"github.com/mahdi/dns-proxy-local/internal/querylog"
+)
+
+func TestDisabledIsNil(t *testing.T) {
+	r := New(config.ReportConfig{}, nil, logging.Discard())
+	if r != nil {
+		t.Fatal("expected nil reporter when disabled")
+	}
+	r.Observe("example.com.", querylog.SourceAPI)
+	r.Close()
+}
+
+func TestNext(t *testing.T) {
+	// 2024-06-05 is a Wednesday
+	now := time.Date(2024, 6, 5, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		schedule, at string
+		want         time.Time
+	}{
+		{"daily", "10:00", time.Date(2024, 6, 5, 10, 0, 0, 0, time.UTC)},
+		{"daily", "08:00", time.Date(2024, 6, 6, 8, 0, 0, 0, time.UTC)},
+		{"weekly", "08:00", time.Date(2024, 6, 10, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got := next(config.ReportConfig{Schedule: tt.schedule, At: tt.at}, now)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s at %s: next = %v, want %v", tt.schedule, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestBuildAndSend(t *testing.T) {
+	var got Report
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer hook.Close()
+
+	healthy := 1
+	stats := func() map[string]interface{} {
+		return map[string]interface{}{
+			"api": map[string]interface{}{
+				"endpoints_healthy": healthy,
+				"endpoints": map[string]interface{}{
+					"https://a.example/api/v1/resolve": map[string]interface{}{"latency_ms": 42.5},
+				},
+			},
+			"cache": cache.Stats{Size: 3, Hits: 7},
+		}
+	}
+	r := newReporter(config.ReportConfig{
+		Enabled:    true,
+		Schedule:   "daily",
+		TopDomains: 2,
+		WebhookURL: hook.URL,
+		Email:      config.EmailConfig{SMTPAddr: "mail.example:25", From: "proxy@example", To: []string{"ops@example"}},
+	}, stats, logging.Discard())
+
+	var mail string
+	r.mail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		mail = string(msg)
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		r.Observe("Popular.example.", querylog.SourceAPI)
+	}
+	r.Observe("popular.example.", querylog.SourceCache)
+	r.Observe("other.example.", querylog.SourceAPI)
+	r.Observe("rare.example.", querylog.SourceDenied)
+	r.Observe("rare2.example.", querylog.SourceThrottled)
+
+	r.checkAvailability()
+	healthy = 0
+	r.checkAvailability()
+
+	r.send(r.build(time.Now()))
+
+	if got.Queries != 7 || got.Blocked != 2 || got.Sources["cache"] != 1 {
+		t.Errorf("counts: queries %d, blocked %d, sources %v", got.Queries, got.Blocked, got.Sources)
+	}
+	if len(got.TopDomains) != 2 || got.TopDomains[0] != (DomainCount{"popular.example", 4}) {
+		t.Errorf("top domains = %v", got.TopDomains)
+	}
+	if got.Availability != 0.5 {
+		t.Errorf("availability = %v, want 0.5", got.Availability)
+	}
+	if got.Latency["https://a.example/api/v1/resolve"] != 42.5 || got.Cache == nil || got.Cache.Hits != 7 {
+		t.Errorf("latency %v, cache %+v", got.Latency, got.Cache)
+	}
+	if !strings.Contains(mail, "Subject: DNS proxy daily report") || !strings.Contains(mail, "popular.example") {
+		t.Errorf("email = %q", mail)
+	}
+
+	// Counters start over for the next period
+	if rep := r.build(time.Now()); rep.Queries != 0 || len(rep.TopDomains) != 0 {
+		t.Errorf("next period starts with %d queries, %v", rep.Queries, rep.TopDomains)
+	}
+}
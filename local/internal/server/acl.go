@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseNetworks parses CIDRs; bare addresses are treated as single hosts
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", s, err)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// clientAllowed reports whether the client's source address is inside
+// server.allowed_networks; an empty list allows everyone
+func (s *Server) clientAllowed(w dns.ResponseWriter) bool {
+	if len(s.allowed) == 0 {
+		return true
+	}
+	return containsIP(s.allowed, clientIP(w))
+}
+
+// cacheOnlyClient reports whether the client's source address is inside
+// server.cache_only_networks
+func (s *Server) cacheOnlyClient(w dns.ResponseWriter) bool {
+	return len(s.cacheOnly) > 0 && containsIP(s.cacheOnly, clientIP(w))
+}
+
+// clientIP returns the client's source address, or nil if it has none
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
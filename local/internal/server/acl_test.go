@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestClientAllowed(t *testing.T) {
+	allowed, err := parseNetworks([]string{"192.168.1.0/24", "10.0.0.5", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{allowed: allowed}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.20")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.5")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.6")}, false},
+		{&net.UDPAddr{IP: net.ParseIP("fd12::1")}, true},
+		{&net.UDPAddr{IP: net.ParseIP("203.0.113.9")}, false},
+	}
+	for _, tt := range tests {
+		if got := s.clientAllowed(&memoryWriter{remote: tt.addr}); got != tt.want {
+			t.Errorf("%v: allowed = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if !(&Server{}).clientAllowed(&memoryWriter{remote: &net.UDPAddr{IP: net.ParseIP("203.0.113.9")}}) {
+		t.Error("an empty list should allow everyone")
+	}
+	if _, err := parseNetworks([]string{"not-a-network"}); err == nil {
+		t.Error("expected parse error")
+	}
+}
+
+func TestCacheOnlyClients(t *testing.T) {
+	cfg := &config.Config{
+		Server: config.ServerConfig{CacheOnly: []string{"192.168.50.0/24"}},
+		Cache:  config.CacheConfig{Enabled: true, MaxItems: 100, MaxTTL: time.Hour, NegativeTTL: time.Minute},
+	}
+	api := &negativeAPI{negTTL: 60}
+	s, err := New(cfg, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	iot := &net.UDPAddr{IP: net.ParseIP("192.168.50.7")}
+	trusted := &net.UDPAddr{IP: net.ParseIP("192.168.1.20")}
+
+	query := func(client net.Addr) int {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		return s.Exchange(r, client).Rcode
+	}
+
+	if rcode := query(iot); rcode != dns.RcodeRefused || api.calls != 0 {
+		t.Fatalf("cache-only miss: rcode %s, %d API calls", dns.RcodeToString[rcode], api.calls)
+	}
+	if rcode := query(trusted); rcode != dns.RcodeSuccess || api.calls != 1 {
+		t.Fatalf("trusted client: rcode %s, %d API calls", dns.RcodeToString[rcode], api.calls)
+	}
+	if rcode := query(iot); rcode != dns.RcodeSuccess || api.calls != 1 {
+		t.Errorf("cache-only hit: rcode %s, %d API calls", dns.RcodeToString[rcode], api.calls)
+	}
+	if got := s.Stats()["cache_only_refused"]; got != int64(1) {
+		t.Errorf("cache_only_refused = %v", got)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/systemd"
+)
+
+// dotSocketName is the FileDescriptorName= that marks an activated stream
+// socket as the DNS-over-TLS listener
+const dotSocketName = "dot"
+
+// serve starts srv in the background and registers it for shutdown
+func (s *Server) serve(srv *dns.Server, errChan chan<- error, attrs ...any) {
+	s.servers = append(s.servers, srv)
+	go func() {
+		s.logger.Info("starting DNS server", append([]any{"net", srv.Net}, attrs...)...)
+		var err error
+		if srv.PacketConn != nil || srv.Listener != nil {
+			err = srv.ActivateAndServe()
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
+			select {
+			case errChan <- fmt.Errorf("%s server error: %w", srv.Net, err):
+			default:
+			}
+		}
+	}()
+}
+
+// serveActivated serves DNS on every socket passed by systemd: datagram
+// sockets as UDP, stream sockets as TCP, and stream sockets named "dot" as
+// DNS-over-TLS
+func (s *Server) serveActivated(sockets *systemd.Sockets, handler dns.Handler, errChan chan<- error) error {
+	for name, conns := range sockets.Packet {
+		for _, pc := range conns {
+			s.serve(&dns.Server{PacketConn: pc, Net: "udp", Handler: handler}, errChan, "addr", pc.LocalAddr().String(), "socket", name)
+		}
+	}
+
+	for name, lns := range sockets.Stream {
+		if name == dotSocketName {
+			if !s.cfg.Server.DoT.Enabled {
+				s.logger.Warn("ignoring activated DoT socket; server.dot is disabled")
+				continue
+			}
+			dotServer, err := newDoTServer(s.cfg, "", handler) // only its TLS config is used
+			if err != nil {
+				return err
+			}
+			for _, ln := range lns {
+				srv := &dns.Server{
+					Listener:  tls.NewListener(ln, dotServer.TLSConfig),
+					Net:       dotServer.Net,
+					TLSConfig: dotServer.TLSConfig,
+					Handler:   handler,
+				}
+				s.serve(srv, errChan, "addr", ln.Addr().String(), "socket", name, "client_auth", s.cfg.Server.DoT.ClientCAFile != "")
+			}
+			continue
+		}
+
+		for _, ln := range lns {
+			wrapped, err := wrapProxyProtocol(ln, s.cfg.Server.ProxyProtocol)
+			if err != nil {
+				return err
+			}
+			s.serve(&dns.Server{Listener: wrapped, Net: "tcp", Handler: handler}, errChan, "addr", ln.Addr().String(), "socket", name, "proxy_protocol", s.cfg.Server.ProxyProtocol.Enabled)
+		}
+	}
+	return nil
+}
+
+// watchdog keeps systemd's WatchdogSec= timer from firing while the server
+// is running
+func (s *Server) watchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := systemd.Notify("WATCHDOG=1"); err != nil {
+			s.logger.Warn("systemd watchdog notify failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// newAdminServer returns the local control interface. Without a token
+// anyone who can reach it can switch profiles.
+//
+//	GET /profile                      active and available profiles
+//	PUT /profile  {"name": "travel"}  switch the active profile
+func (s *Server) newAdminServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/profile", s.handleProfile)
+	return &http.Server{Addr: s.cfg.Admin.ListenAddr, Handler: s.adminGuard(mux)}
+}
+
+// adminGuard keeps web pages out of the control interface: browsers send
+// an Origin with the requests pages make, and a page reaching it through
+// a name of its own (DNS rebinding) shows in the Host. With a token
+// configured, every request must carry it.
+func (s *Server) adminGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		host = strings.Trim(host, "[]")
+		if r.Header.Get("Origin") != "" || (net.ParseIP(host) == nil && !strings.EqualFold(host, "localhost")) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if token := s.cfg.Admin.Token; token != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin starts the control interface; errors after startup go to errChan
+func (s *Server) serveAdmin(errChan chan<- error) (*http.Server, error) {
+	srv := s.newAdminServer()
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("admin listener: %w", err)
+	}
+	s.logger.Info("admin interface listening", "addr", ln.Addr().String())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errChan <- fmt.Errorf("admin server error: %w", err)
+		}
+	}()
+	return srv, nil
+}
+
+func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// Pages can only send a JSON body after a CORS preflight, which
+		// is never granted
+		if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+			http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, `body must be {"name": "<profile>"}`, http.StatusBadRequest)
+			return
+		}
+		if err := s.SwitchProfile(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Profiles())
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// peerLister is an API client that can list its remotes' cluster nodes
+type peerLister interface {
+	Peers(ctx context.Context) ([]config.EndpointConfig, error)
+}
+
+// discoveryState is what the discovery state file holds. It has the API
+// keys of the endpoints, so it is written readable by the owner only.
+type discoveryState struct {
+	Profile   string                  `json:"profile"`
+	Endpoints []config.EndpointConfig `json:"endpoints"`
+}
+
+// discover refreshes the active profile's endpoints from the remotes' node
+// lists every interval until done is closed. Endpoints saved by an earlier
+// run are restored first, so nodes learned before the configured ones were
+// blocked stay reachable across a restart.
+func (s *Server) discover(done <-chan struct{}) {
+	cfg := s.cfg.API.Discovery
+	if state, err := loadDiscovery(cfg.StateFile); err != nil {
+		s.logger.Warn("failed to read discovery state", "file", cfg.StateFile, "error", err)
+	} else if state != nil {
+		s.applyPeers(state.Profile, state.Endpoints)
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		s.refreshPeers()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshPeers fetches the node list through the active profile's client.
+// An empty list keeps the endpoints discovered before: a cluster with no
+// healthy node to offer is no reason to forget the ones it had.
+func (s *Server) refreshPeers() {
+	active := s.active.Load()
+	lister, ok := active.apiClient.(peerLister)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(client.WithPriority(context.Background(), client.PriorityBackground), s.cfg.API.Timeout)
+	defer cancel()
+
+	peers, err := lister.Peers(ctx)
+	if err != nil {
+		s.logger.Warn("endpoint discovery failed", "error", err)
+		return
+	}
+	if len(peers) > 0 {
+		s.applyPeers(active.name, peers)
+	}
+}
+
+// applyPeers makes peers, besides the configured endpoints, the endpoints
+// of the named profile if it is still active. The client is rebuilt only
+// when the discovered set changes; queries in flight finish on the old one.
+func (s *Server) applyPeers(name string, peers []config.EndpointConfig) {
+	s.switchMu.Lock()
+	defer s.switchMu.Unlock()
+
+	old := s.active.Load()
+	if old.name != name {
+		return
+	}
+	cfg, err := s.cfg.WithProfile(name)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, ep := range cfg.API.Endpoints {
+		seen[ep.URL] = true
+	}
+	var discovered []config.EndpointConfig
+	for _, ep := range peers {
+		if !seen[ep.URL] {
+			seen[ep.URL] = true
+			discovered = append(discovered, ep)
+		}
+	}
+	if slices.EqualFunc(discovered, s.discovered, func(a, b config.EndpointConfig) bool { return a.URL == b.URL }) {
+		return
+	}
+
+	merged := *cfg
+	merged.API.Endpoints = append(slices.Clone(cfg.API.Endpoints), discovered...)
+	apiClient, err := s.newClient(&merged)
+	if err != nil {
+		s.logger.Warn("failed to apply discovered endpoints", "error", err)
+		return
+	}
+	s.active.Store(newProfile(name, &merged, apiClient))
+	s.discovered = discovered
+	if c, ok := old.apiClient.(interface{ Close() }); ok {
+		c.Close()
+	}
+	s.logger.Info("endpoints discovered", "profile", name, "discovered", len(discovered), "endpoints", len(merged.API.Endpoints))
+
+	if file := s.cfg.API.Discovery.StateFile; file != "" {
+		if err := saveDiscovery(file, discoveryState{Profile: name, Endpoints: discovered}); err != nil {
+			s.logger.Warn("failed to save discovery state", "file", file, "error", err)
+		}
+	}
+}
+
+// discoveredCount returns the number of endpoints in use that were discovered
+func (s *Server) discoveredCount() int {
+	s.switchMu.Lock()
+	defer s.switchMu.Unlock()
+	return len(s.discovered)
+}
+
+// loadDiscovery reads a discovery state file; a missing one is no error
+func loadDiscovery(file string) (*discoveryState, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state discoveryState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// saveDiscovery replaces the state file, through a temporary file so a
+// crash can't leave it half written
+func saveDiscovery(file string, state discoveryState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// peerAPI is a fakeAPI whose remote lists cluster nodes
+type peerAPI struct {
+	fakeAPI
+	peers []config.EndpointConfig
+}
+
+func (p *peerAPI) Peers(ctx context.Context) ([]config.EndpointConfig, error) {
+	return p.peers, nil
+}
+
+func TestDiscovery(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "discovered.json")
+	cfg := &config.Config{
+		API: config.APIConfig{
+			Endpoints: []config.EndpointConfig{{URL: "https://a.example/api/v1/resolve"}},
+			Discovery: config.DiscoveryConfig{Enabled: true, StateFile: state},
+		},
+		Profiles: map[string]config.ProfileConfig{"travel": {}},
+	}
+	first := &peerAPI{peers: []config.EndpointConfig{
+		{URL: "https://a.example/api/v1/resolve"},
+		{URL: "https://b.example/api/v1/resolve"},
+	}}
+	s, err := New(cfg, first, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var built [][]config.EndpointConfig
+	s.EnableProfiles(func(cfg *config.Config) (APIClient, error) {
+		built = append(built, cfg.API.Endpoints)
+		return &peerAPI{peers: first.peers}, nil
+	})
+
+	s.refreshPeers()
+	if len(built) != 1 || len(built[0]) != 2 || built[0][1].URL != "https://b.example/api/v1/resolve" {
+		t.Fatalf("clients built for %+v", built)
+	}
+	if !first.closed {
+		t.Error("client without the discovered endpoints was not closed")
+	}
+	if got := s.Stats()["discovered_endpoints"]; got != 1 {
+		t.Errorf("discovered_endpoints = %v, want 1", got)
+	}
+
+	// The same list again keeps the client
+	s.refreshPeers()
+	if len(built) != 1 {
+		t.Errorf("unchanged peers rebuilt the client")
+	}
+
+	// A restart restores the discovered endpoints before asking the remotes
+	restarted, err := New(cfg, &fakeAPI{}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.EnableProfiles(func(cfg *config.Config) (APIClient, error) {
+		built = append(built, cfg.API.Endpoints)
+		return &fakeAPI{}, nil
+	})
+	saved, err := loadDiscovery(state)
+	if err != nil || saved == nil {
+		t.Fatalf("state %v, %v", saved, err)
+	}
+	restarted.applyPeers(saved.Profile, saved.Endpoints)
+	if len(built) != 2 || len(built[1]) != 2 {
+		t.Errorf("restored endpoints %+v", built)
+	}
+
+	// Switching profiles drops them, and a state file of another profile
+	// is not applied
+	if err := restarted.SwitchProfile("travel"); err != nil {
+		t.Fatal(err)
+	}
+	if n := restarted.discoveredCount(); n != 0 {
+		t.Errorf("%d discovered endpoints after a profile switch", n)
+	}
+	restarted.applyPeers(saved.Profile, saved.Endpoints)
+	if len(built) != 3 {
+		t.Errorf("default profile's endpoints applied to travel: %+v", built)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// dns64 synthesizes AAAA records from A answers (RFC 6147), so IPv6-only
+// clients behind a NAT64 gateway reach IPv4-only names through the tunnel
+type dns64 struct {
+	prefix      netip.Prefix
+	clients     []*net.IPNet // empty for every client
+	synthesized atomic.Int64
+}
+
+// newDNS64 returns nil when DNS64 is disabled
+func newDNS64(cfg config.DNS64Config) (*dns64, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	prefix, err := netip.ParsePrefix(cfg.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns64 prefix: %w", err)
+	}
+	clients, err := parseNetworks(cfg.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns64 clients: %w", err)
+	}
+	return &dns64{prefix: prefix.Masked(), clients: clients}, nil
+}
+
+// applies reports whether AAAA queries from the client may be synthesized
+func (d *dns64) applies(w dns.ResponseWriter) bool {
+	return d != nil && (len(d.clients) == 0 || containsIP(d.clients, clientIP(w)))
+}
+
+// synthesizeAAAA returns resp, the answer to r, or when r is an AAAA query
+// that resp answers without addresses, one synthesized from the name's A
+// records. Those come from the cache or, unless the client is cache-only,
+// the API; holdsSlot says whether the query already holds an API slot.
+// Without A records resp is returned unchanged.
+func (s *Server) synthesizeAAAA(w dns.ResponseWriter, r, resp *dns.Msg, cacheOnly, holdsSlot bool) *dns.Msg {
+	q := r.Question[0]
+	if q.Qtype != dns.TypeAAAA || resp.Rcode != dns.RcodeSuccess || !s.dns64.applies(w) {
+		return resp
+	}
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return resp
+		}
+	}
+
+	a := new(dns.Msg)
+	a.SetQuestion(q.Name, dns.TypeA)
+	answer, ok := s.lookupA(a, cacheOnly, holdsSlot)
+	if !ok {
+		return resp
+	}
+
+	synth := resp.Copy()
+	synth.Answer = nil
+	synth.Ns = nil
+	for _, rr := range answer.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			synth.Answer = append(synth.Answer, rr)
+		case *dns.A:
+			v4, ok := netip.AddrFromSlice(rr.A.To4())
+			if !ok {
+				continue
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			synth.Answer = append(synth.Answer, &dns.AAAA{Hdr: hdr, AAAA: synthesize(s.dns64.prefix, v4).AsSlice()})
+		}
+	}
+	if len(synth.Answer) == len(resp.Answer) {
+		return resp
+	}
+	s.dns64.synthesized.Add(1)
+	return synth
+}
+
+// lookupA answers the A query a from the cache, or through the API when the
+// client may cause API requests and a slot is free
+func (s *Server) lookupA(a *dns.Msg, cacheOnly, holdsSlot bool) (*dns.Msg, bool) {
+	q := a.Question[0]
+	dnsCache := s.cache.Load()
+	if dnsCache != nil {
+		if cached, ok := s.cacheGet(dnsCache, q, cacheOnly); ok {
+			return cached, true
+		}
+	}
+	if cacheOnly {
+		return nil, false
+	}
+	if !holdsSlot {
+		if !s.limits.acquire() {
+			return nil, false
+		}
+		defer s.limits.release()
+	}
+
+	resp, negTTL, err := s.resolveViaAPI(context.Background(), s.active.Load(), a)
+	if err != nil {
+		s.logger.Debug("dns64 A lookup failed", "name", q.Name, "error", err)
+		return nil, false
+	}
+	if dnsCache != nil {
+		cacheAnswer(dnsCache, q, resp, negTTL)
+	}
+	return resp, true
+}
+
+// synthesize embeds v4 in prefix as RFC 6052 lays it out, skipping the
+// reserved bits 64-71
+func synthesize(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Addr().As16()
+	v := v4.As4()
+	for i, j := prefix.Bits()/8, 0; j < 4; i++ {
+		if i == 8 {
+			continue
+		}
+		b[i] = v[j]
+		j++
+	}
+	return netip.AddrFrom16(b)
+}
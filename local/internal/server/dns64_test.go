@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// ipv4OnlyAPI answers like a remote for IPv4-only names: an A record and no
+// AAAA records
+type ipv4OnlyAPI struct {
+	calls map[string]int
+}
+
+func (f *ipv4OnlyAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	f.calls[recordType]++
+	if recordType == "A" {
+		return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{{Name: domain, Type: "A", Value: "192.0.2.33", TTL: 60}}}, nil
+	}
+	return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{}, NegativeTTL: 60}, nil
+}
+
+func (f *ipv4OnlyAPI) Stats() map[string]interface{} { return nil }
+
+func (f *ipv4OnlyAPI) Close() {}
+
+func TestDNS64(t *testing.T) {
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true, MaxItems: 100, MaxTTL: time.Hour, NegativeTTL: time.Minute},
+		DNS64: config.DNS64Config{Enabled: true, Prefix: "64:ff9b::/96", Clients: []string{"fd00::/8"}},
+	}
+	api := &ipv4OnlyAPI{calls: make(map[string]int)}
+	s, err := New(cfg, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(client string) []dns.RR {
+		r := new(dns.Msg)
+		r.SetQuestion("legacy.example.", dns.TypeAAAA)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.ParseIP(client)})
+		if resp == nil || resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("unexpected response %v", resp)
+		}
+		return resp.Answer
+	}
+
+	for i := 0; i < 2; i++ { // through the API, then from the cache
+		answer := query("fd00::10")
+		if len(answer) != 1 {
+			t.Fatalf("answer %v, want one synthesized AAAA", answer)
+		}
+		aaaa, ok := answer[0].(*dns.AAAA)
+		if !ok || aaaa.AAAA.String() != "64:ff9b::c000:221" || aaaa.Hdr.Name != "legacy.example." {
+			t.Errorf("synthesized %v", answer[0])
+		}
+	}
+	if api.calls["A"] != 1 || api.calls["AAAA"] != 1 {
+		t.Errorf("API calls %v, want one of each type", api.calls)
+	}
+
+	if answer := query("192.168.1.20"); len(answer) != 0 {
+		t.Errorf("client outside dns64 clients got %v", answer)
+	}
+	if got := s.Stats()["dns64_synthesized"]; got != int64(2) {
+		t.Errorf("dns64_synthesized = %v", got)
+	}
+}
+
+func TestSynthesize(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.33")
+	tests := []struct {
+		prefix, want string
+	}{
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+	}
+	for _, tt := range tests {
+		if got := synthesize(netip.MustParsePrefix(tt.prefix), v4); got.String() != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.prefix, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// newDoTServer creates the DNS-over-TLS listener for LAN clients. With a
+// client CA configured, devices may present certificates that identify them
+// in logs independently of their IP address.
+func newDoTServer(cfg *config.Config, host string, handler dns.Handler) (*dns.Server, error) {
+	dot := cfg.Server.DoT
+
+	cert, err := tls.LoadX509KeyPair(dot.CertFile, dot.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load DoT certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if dot.ClientCAFile != "" {
+		pem, err := os.ReadFile(dot.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read DoT client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", dot.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if dot.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return &dns.Server{
+		Addr:      net.JoinHostPort(host, strconv.Itoa(dot.Port)),
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		Handler:   handler,
+	}, nil
+}
+
+// deviceID returns the identity from a verified client certificate: its
+// common name, or the first DNS name when the common name is empty
+func deviceID(w dns.ResponseWriter) string {
+	cs, ok := w.(dns.ConnectionStater)
+	if !ok {
+		return ""
+	}
+	state := cs.ConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName
+	}
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0]
+	}
+	return ""
+}
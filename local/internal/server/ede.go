@@ -0,0 +1,34 @@
+package server
+
+import (
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+// edeCodes maps error codes to Extended DNS Error info codes (RFC 8914).
+// Codes without a close match use Other; the error code is always sent as
+// the extra text.
+var edeCodes = map[errcode.Code]uint16{
+	errcode.TunnelDown:       dns.ExtendedErrorCodeNetworkError,
+	errcode.EndpointAuth:     dns.ExtendedErrorCodeOther,
+	errcode.UpstreamTimeout:  dns.ExtendedErrorCodeNoReachableAuthority,
+	errcode.BlockedPolicy:    dns.ExtendedErrorCodeProhibited,
+	errcode.RateLimited:      dns.ExtendedErrorCodeOther,
+	errcode.ProtocolMismatch: dns.ExtendedErrorCodeOther,
+}
+
+// addEDE attaches an Extended DNS Error for code to resp. Only EDNS clients
+// can receive one, so resp must already carry the OPT record echoed by
+// postProcess.
+func addEDE(resp *dns.Msg, code errcode.Code) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	info, ok := edeCodes[code]
+	if !ok {
+		info = dns.ExtendedErrorCodeOther
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: info, ExtraText: string(code)})
+}
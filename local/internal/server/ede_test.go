@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+func TestAddEDE(t *testing.T) {
+	s := &Server{cfg: &config.Config{}}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	resp := new(dns.Msg)
+	resp.SetRcode(r, dns.RcodeServerFailure)
+	s.postProcess(r, resp)
+	addEDE(resp, errcode.UpstreamTimeout)
+
+	opt := resp.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("expected one EDNS option, got %v", opt)
+	}
+	ede, ok := opt.Option[0].(*dns.EDNS0_EDE)
+	if !ok || ede.InfoCode != dns.ExtendedErrorCodeNoReachableAuthority || ede.ExtraText != "upstream_timeout" {
+		t.Errorf("EDE = %v", opt.Option[0])
+	}
+
+	// Clients without EDNS get no OPT record at all
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	resp = new(dns.Msg)
+	resp.SetRcode(plain, dns.RcodeServerFailure)
+	s.postProcess(plain, resp)
+	addEDE(resp, errcode.TunnelDown)
+	if resp.IsEdns0() != nil {
+		t.Error("EDE added for a client without EDNS")
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+)
+
+// fallbackAllowed reports whether a query the tunnel failed to resolve may
+// be sent to the fallback upstreams: only if the tunnel was down or the
+// request never got an answer. Names the remote blocked, clients over
+// their rate and rejected credentials must not leave the host another way,
+// and upstreams the remote could not reach are not fixed privately by
+// plain DNS from here.
+func fallbackAllowed(err error) bool {
+	switch errcode.Of(err) {
+	case errcode.TunnelDown, "":
+		return true
+	}
+	return false
+}
+
+// resolveDirect answers a query from the plain-DNS fallback upstreams. It is
+// only used when every API endpoint has failed: the query leaves the tunnel
+// unencrypted, so each use is logged and counted.
+func (s *Server) resolveDirect(fallback config.FallbackConfig, r *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: "udp", Timeout: fallback.Timeout}
+
+	var lastErr error
+	for _, upstream := range fallback.Upstreams {
+		resp, _, err := c.Exchange(r, upstream)
+		if err == nil && resp.Truncated {
+			c.Net = "tcp"
+			resp, _, err = c.Exchange(r, upstream)
+			c.Net = "udp"
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.fallbacks.Add(1)
+		s.logger.Warn("answered via plain DNS fallback; query left the tunnel unencrypted",
+			"name", r.Question[0].Name, "upstream", upstream)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("all fallback upstreams failed: %w", lastErr)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// failingAPI fails every query with err
+type failingAPI struct {
+	fakeAPI
+	err error
+}
+
+func (f *failingAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	return nil, f.err
+}
+
+// plainUpstream starts a plain DNS server answering every A query with
+// 192.0.2.53, counting the queries it gets
+func plainUpstream(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := new(atomic.Int64)
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 53),
+		})
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String(), queries
+}
+
+func TestFallback(t *testing.T) {
+	upstream, queries := plainUpstream(t)
+
+	tests := []struct {
+		err      error
+		fallback bool // answered by the plain upstream
+		rcode    int  // otherwise
+	}{
+		{errcode.New(errcode.TunnelDown, "no healthy endpoints available"), true, 0},
+		{fmt.Errorf("post: %w", errors.New("connection reset by peer")), true, 0},
+		{errcode.New(errcode.BlockedPolicy, "blocked by tenant policy"), false, dns.RcodeRefused},
+		{errcode.New(errcode.RateLimited, "too many requests"), false, dns.RcodeServerFailure},
+		{errcode.New(errcode.EndpointAuth, "invalid API key"), false, dns.RcodeServerFailure},
+		{errcode.New(errcode.UpstreamTimeout, "upstreams did not answer"), false, dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{
+			API:      config.APIConfig{Timeout: time.Second},
+			Fallback: config.FallbackConfig{Enabled: true, Upstreams: []string{upstream}, Timeout: time.Second},
+		}
+		s, err := New(cfg, &failingAPI{err: tt.err}, logging.Discard())
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := queries.Load()
+		r := new(dns.Msg)
+		r.SetQuestion("www.example.com.", dns.TypeA)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+
+		sent := queries.Load() > before
+		if sent != tt.fallback {
+			t.Errorf("%v: sent to the fallback %v, want %v", tt.err, sent, tt.fallback)
+			continue
+		}
+		switch {
+		case resp == nil:
+			t.Errorf("%v: no answer", tt.err)
+		case tt.fallback && (len(resp.Answer) != 1 || s.Stats()["fallback_answers"] != int64(1)):
+			t.Errorf("%v: %v, want the fallback's answer", tt.err, resp)
+		case !tt.fallback && resp.Rcode != tt.rcode:
+			t.Errorf("%v: %s, want %s", tt.err, dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+}
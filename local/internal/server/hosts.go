@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/hosts"
+)
+
+// hostsAnswers answers the names listed in the hosts files, and reverse
+// lookups of their addresses with the first name given each. Names an
+// ad-block list points at 0.0.0.0 or :: are blocked: both A and AAAA get
+// the null address, so clients give up at once instead of trying the
+// other family through the tunnel.
+type hostsAnswers struct {
+	table    *hosts.Hosts
+	ttl      uint32
+	answered atomic.Int64
+	blocked  atomic.Int64
+}
+
+// newHostsAnswers wraps the loaded files, or returns nil if there are none
+func newHostsAnswers(cfg config.HostsConfig, table *hosts.Hosts) *hostsAnswers {
+	if table == nil {
+		return nil
+	}
+	return &hostsAnswers{table: table, ttl: uint32(cfg.TTL.Seconds())}
+}
+
+// answer returns the response to r from the hosts files, or nil if they
+// don't list its name, and whether the name is blocked. Types other than
+// A and AAAA get an empty NOERROR answer. It is safe to call on a nil
+// hostsAnswers.
+func (h *hostsAnswers) answer(r *dns.Msg) (resp *dns.Msg, blocked bool) {
+	if h == nil {
+		return nil, false
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil, false
+	}
+	name := strings.ToLower(q.Name)
+	if target := h.pointer(name); target != "" {
+		resp = h.reply(r)
+		if q.Qtype == dns.TypePTR {
+			resp.Answer = []dns.RR{&dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: h.ttl},
+				Ptr: target,
+			}}
+		}
+		h.answered.Add(1)
+		return resp, false
+	}
+	addrs := h.table.Lookup(name)
+	if addrs == nil {
+		return nil, false
+	}
+	blocked = true
+	for _, a := range addrs {
+		blocked = blocked && a.IsUnspecified()
+	}
+
+	resp = h.reply(r)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: h.ttl}
+	switch {
+	case blocked && q.Qtype == dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: make([]byte, 4)})
+	case blocked && q.Qtype == dns.TypeAAAA:
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: make([]byte, 16)})
+	default:
+		for _, a := range addrs {
+			switch {
+			case q.Qtype == dns.TypeA && a.Is4():
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: a.AsSlice()})
+			case q.Qtype == dns.TypeAAAA && a.Is6():
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: a.AsSlice()})
+			}
+		}
+	}
+
+	if blocked {
+		h.blocked.Add(1)
+	} else {
+		h.answered.Add(1)
+	}
+	return resp, blocked
+}
+
+// pointer returns the name the files give the address whose reverse name
+// is name, or ""
+func (h *hostsAnswers) pointer(name string) string {
+	prefix, bits, _, ok := reversePrefix(name)
+	if !ok || bits != len(prefix)*8 {
+		return ""
+	}
+	addr, _ := netip.AddrFromSlice(prefix)
+	return h.table.Name(addr)
+}
+
+// reply returns an empty authoritative answer to r
+func (h *hostsAnswers) reply(r *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	return resp
+}
+
+// Stats returns the table's stats with the queries answered from it
+func (h *hostsAnswers) Stats() map[string]interface{} {
+	stats := h.table.Stats()
+	stats["answered"] = h.answered.Load()
+	stats["blocked"] = h.blocked.Load()
+	return stats
+}
+
+// close stops watching the files. It is safe to call on a nil
+// hostsAnswers.
+func (h *hostsAnswers) close() {
+	if h != nil {
+		h.table.Close()
+	}
+}
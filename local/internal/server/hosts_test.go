@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(file, []byte("192.168.1.10 nas.lan\nfd00::10 nas.lan\n192.168.1.11 nas.home.arpa\n0.0.0.0 ads.example.com\n"), 0o644)
+	// Special-use names and private reverse zones are answered locally
+	// too, after the hosts files and rewrite rules
+	cfg := &config.Config{
+		Hosts:          config.HostsConfig{Files: []string{file}, TTL: time.Minute},
+		Rewrite:        config.RewriteConfig{TTL: time.Minute, Rules: []config.RewriteRule{{Match: "*.dev.test", Answer: []string{"127.0.0.1"}}}},
+		SpecialUse:     config.SpecialUseConfig{TTL: time.Minute},
+		PrivateReverse: config.PrivateReverseConfig{Enabled: true, Networks: []string{"192.168.0.0/16", "fd00::/8"}, TTL: time.Minute},
+	}
+	s, err := New(cfg, &downAPI{}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.hosts.close()
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		{"NAS.lan.", dns.TypeA, []string{"NAS.lan.\t60\tIN\tA\t192.168.1.10"}},
+		{"nas.lan.", dns.TypeAAAA, []string{"nas.lan.\t60\tIN\tAAAA\tfd00::10"}},
+		{"nas.lan.", dns.TypeMX, nil},
+		// Blocked names get the null address of both families
+		{"ads.example.com.", dns.TypeA, []string{"ads.example.com.\t60\tIN\tA\t0.0.0.0"}},
+		{"ads.example.com.", dns.TypeAAAA, []string{"ads.example.com.\t60\tIN\tAAAA\t::"}},
+		{"ads.example.com.", dns.TypeHTTPS, nil},
+		{"nas.home.arpa.", dns.TypeA, []string{"nas.home.arpa.\t60\tIN\tA\t192.168.1.11"}},
+		{"web.dev.test.", dns.TypeA, []string{"web.dev.test.\t60\tIN\tA\t127.0.0.1"}},
+		// Reverse lookups of the files' addresses get the first name
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"10.1.168.192.in-addr.arpa.\t60\tIN\tPTR\tnas.lan."}},
+		{"11.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"11.1.168.192.in-addr.arpa.\t60\tIN\tPTR\tnas.home.arpa."}},
+		{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, []string{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.\t60\tIN\tPTR\tnas.lan."}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, tt.qtype)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+		if resp == nil || resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s: %v", tt.name, resp)
+		}
+		var got []string
+		for _, rr := range resp.Answer {
+			got = append(got, rr.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s %s: %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+
+	// Other names in special-use and private reverse zones still are not
+	for _, name := range []string{"other.home.arpa.", "12.1.168.192.in-addr.arpa."} {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypePTR)
+		if resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)}); resp == nil || resp.Rcode != dns.RcodeNameError {
+			t.Errorf("%s: %v, want NXDOMAIN", name, resp)
+		}
+	}
+
+	// Other names go to the tunnel, which is down
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	if resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)}); resp != nil && len(resp.Answer) > 0 {
+		t.Errorf("www.example.com answered from the hosts file: %v", resp)
+	}
+
+	stats, _ := s.Stats()["hosts"].(map[string]interface{})
+	if stats["names"] != 3 || stats["answered"] != int64(7) || stats["blocked"] != int64(3) {
+		t.Errorf("hosts stats %v", stats)
+	}
+
+	cfg.Hosts.Files = []string{filepath.Join(t.TempDir(), "missing")}
+	if _, err := New(cfg, &downAPI{}, logging.Discard()); err == nil {
+		t.Error("started with a missing hosts file")
+	}
+}
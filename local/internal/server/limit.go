@@ -0,0 +1,104 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// limiter bounds the work the listener takes on: a pool of slots for
+// queries going to the API, and a cap on the queries each client (device
+// or source IP) has in progress. Both fail fast instead of queueing, so a
+// misbehaving LAN client can neither pile up goroutines and sockets nor
+// spend the API quota of everyone else.
+type limiter struct {
+	slots     chan struct{} // API call slots; nil for no limit
+	perClient int           // 0 for no limit
+
+	mu      sync.Mutex
+	clients map[string]int // queries in progress per client
+
+	busy      atomic.Int64 // queries answered SERVFAIL for want of a slot
+	overLimit atomic.Int64 // queries refused over the per-client cap
+}
+
+// newLimiter creates a limiter, or returns nil if neither limit is set
+func newLimiter(cfg config.ServerConfig) *limiter {
+	if cfg.MaxInFlight <= 0 && cfg.MaxPerClient <= 0 {
+		return nil
+	}
+	l := &limiter{perClient: cfg.MaxPerClient, clients: make(map[string]int)}
+	if cfg.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, cfg.MaxInFlight)
+	}
+	return l
+}
+
+// enter starts a query from client, reporting false if the client already
+// has its share in progress. Every successful enter must be paired with
+// leave. It is safe to call on a nil limiter.
+func (l *limiter) enter(client string) bool {
+	if l == nil || l.perClient <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client] >= l.perClient {
+		l.overLimit.Add(1)
+		return false
+	}
+	l.clients[client]++
+	return true
+}
+
+// leave ends a query started by enter
+func (l *limiter) leave(client string) {
+	if l == nil || l.perClient <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+}
+
+// acquire takes an API call slot, reporting false if all are in use. Every
+// successful acquire must be paired with release.
+func (l *limiter) acquire() bool {
+	if l == nil || l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		l.busy.Add(1)
+		return false
+	}
+}
+
+// release returns a slot taken by acquire
+func (l *limiter) release() {
+	if l == nil || l.slots == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Stats returns the limits, current use and rejections
+func (l *limiter) Stats() map[string]interface{} {
+	l.mu.Lock()
+	clients := len(l.clients)
+	l.mu.Unlock()
+
+	return map[string]interface{}{
+		"max_in_flight":     cap(l.slots),
+		"in_flight":         len(l.slots),
+		"busy":              l.busy.Load(),
+		"max_per_client":    l.perClient,
+		"active_clients":    clients,
+		"over_client_limit": l.overLimit.Load(),
+	}
+}
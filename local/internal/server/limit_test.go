@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// blockingAPI answers once release is closed, signalling each call on entered
+type blockingAPI struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{{Name: domain, Type: "A", Value: "203.0.113.1", TTL: 60}}}, nil
+}
+
+func (b *blockingAPI) Stats() map[string]interface{} { return nil }
+
+func TestConcurrencyLimits(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{MaxInFlight: 1, MaxPerClient: 1}}
+	api := &blockingAPI{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	s, err := New(cfg, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(ip byte) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		return s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, ip)})
+	}
+
+	first := make(chan *dns.Msg)
+	go func() { first <- query(10) }()
+	<-api.entered
+
+	if resp := query(10); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("second query from a client at its cap: %s, want REFUSED", dns.RcodeToString[resp.Rcode])
+	}
+	if resp := query(11); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query with every API slot in use: %s, want SERVFAIL", dns.RcodeToString[resp.Rcode])
+	}
+
+	close(api.release)
+	if resp := <-first; resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("first query: %v", resp)
+	}
+	// Slots and client shares are returned
+	if resp := query(10); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("query after the first finished: %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	stats := s.Stats()["limits"].(map[string]interface{})
+	if stats["busy"] != int64(1) || stats["over_client_limit"] != int64(1) || stats["in_flight"] != 0 || stats["active_clients"] != 0 {
+		t.Errorf("limits stats = %v", stats)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestListenDualStack(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	} else {
+		ln.Close()
+	}
+	// A port free on both loopbacks
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := &config.Config{Server: config.ServerConfig{
+		ListenAddrs: []string{"127.0.0.1", "::1"},
+		Port:        port,
+		Protocol:    "both",
+	}}
+	s, err := New(cfg, &fakeAPI{addr: "203.0.113.1"}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 4)
+	for _, host := range cfg.Server.Addresses() {
+		if err := s.listen(host, dns.HandlerFunc(s.handleRequest), errChan); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, srv := range s.servers {
+			srv.Shutdown()
+		}
+	}()
+
+	for _, host := range cfg.Server.Addresses() {
+		for _, network := range []string{"udp", "tcp"} {
+			addr := net.JoinHostPort(host, strconv.Itoa(port))
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			c := &dns.Client{Net: network, Timeout: time.Second}
+
+			// The UDP servers start in the background
+			var resp *dns.Msg
+			for i := 0; i < 20; i++ {
+				if resp, _, err = c.Exchange(r, addr); err == nil {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("%s %s: %v", network, addr, err)
+			}
+			if len(resp.Answer) != 1 {
+				t.Errorf("%s %s: answer %v", network, addr, resp.Answer)
+			}
+		}
+	}
+	select {
+	case err := <-errChan:
+		t.Fatal(err)
+	default:
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// localAnswers answers the names that must never depend on the tunnel:
+// localhost and its subdomains (RFC 6761), reverse lookups of loopback
+// addresses, and this host's own names and addresses
+type localAnswers struct {
+	ttl      uint32
+	hosts    map[string][]net.IP // own FQDNs, lower case
+	hostname string              // first own FQDN, the target of own PTRs
+	ptr      map[string]bool     // reverse names of own addresses
+	answered atomic.Int64
+}
+
+// newLocalAnswers builds the built-in answers, or returns nil if they are
+// disabled. listen is the addresses the listeners bind, which the own
+// hostnames resolve to unless addresses are configured.
+func newLocalAnswers(cfg config.LocalAnswersConfig, listen []string) *localAnswers {
+	if cfg.Disabled {
+		return nil
+	}
+	l := &localAnswers{
+		ttl:   uint32(cfg.TTL.Seconds()),
+		hosts: make(map[string][]net.IP),
+		ptr:   make(map[string]bool),
+	}
+
+	names := cfg.Hostnames
+	if len(names) == 0 {
+		if name, err := os.Hostname(); err == nil && name != "" {
+			names = []string{name}
+		}
+	}
+	addrs := ownAddresses(cfg.Addresses, listen)
+	for _, name := range names {
+		fqdn := dns.Fqdn(strings.ToLower(name))
+		if l.hostname == "" {
+			l.hostname = fqdn
+		}
+		l.hosts[fqdn] = addrs
+	}
+	if l.hostname != "" {
+		for _, ip := range addrs {
+			if rev, err := dns.ReverseAddr(ip.String()); err == nil {
+				l.ptr[rev] = true
+			}
+		}
+	}
+	return l
+}
+
+// ownAddresses returns the configured addresses, or else the specific
+// listen addresses. A wildcard listener stands for every address of the
+// host; loopback is the last resort.
+func ownAddresses(configured, listen []string) []net.IP {
+	var ips []net.IP
+	for _, a := range configured {
+		if ip := net.ParseIP(a); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) > 0 {
+		return ips
+	}
+	wildcard := false
+	for _, a := range listen {
+		ip := net.ParseIP(a)
+		switch {
+		case ip == nil || ip.IsUnspecified():
+			wildcard = true
+		default:
+			ips = append(ips, ip)
+		}
+	}
+	if wildcard {
+		if ifAddrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range ifAddrs {
+				if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() {
+					ips = append(ips, n.IP)
+				}
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	return ips
+}
+
+// answer returns the built-in response to r, or nil if r's name has none.
+// Types without a built-in record get an empty NOERROR answer, so these
+// names never leave the host. It is safe to call on a nil localAnswers.
+func (l *localAnswers) answer(r *dns.Msg) *dns.Msg {
+	if l == nil {
+		return nil
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	name := strings.ToLower(q.Name)
+
+	var rrs []dns.RR
+	switch {
+	case name == "localhost." || strings.HasSuffix(name, ".localhost."):
+		rrs = l.addresses(q, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback})
+	case l.hosts[name] != nil:
+		rrs = l.addresses(q, l.hosts[name])
+	case loopbackReverse(name):
+		rrs = l.pointer(q, "localhost.")
+	case l.ptr[name]:
+		rrs = l.pointer(q, l.hostname)
+	default:
+		return nil
+	}
+
+	l.answered.Add(1)
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Answer = rrs
+	return resp
+}
+
+// addresses returns the A or AAAA records of ips that q asks for
+func (l *localAnswers) addresses(q dns.Question, ips []net.IP) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: l.ttl}
+		switch v4 := ip.To4(); {
+		case q.Qtype == dns.TypeA && v4 != nil:
+			hdr.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: v4})
+		case q.Qtype == dns.TypeAAAA && v4 == nil:
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+// pointer returns a PTR record to target if q asks for one
+func (l *localAnswers) pointer(q dns.Question, target string) []dns.RR {
+	if q.Qtype != dns.TypePTR {
+		return nil
+	}
+	return []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: l.ttl},
+		Ptr: target,
+	}}
+}
+
+// loopbackIPv6Reverse is the reverse name of ::1
+var loopbackIPv6Reverse, _ = dns.ReverseAddr("::1")
+
+// loopbackReverse reports whether name is the reverse name of a loopback
+// address: any of 127.0.0.0/8, or ::1
+func loopbackReverse(name string) bool {
+	if name == loopbackIPv6Reverse {
+		return true
+	}
+	labels := dns.SplitDomainName(name)
+	return len(labels) == 6 && strings.HasSuffix(name, ".127.in-addr.arpa.")
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// downAPI fails every query, like a tunnel with no connectivity
+type downAPI struct{ fakeAPI }
+
+func (*downAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	return nil, errors.New("tunnel down")
+}
+
+func TestLocalAnswers(t *testing.T) {
+	cfg := &config.Config{LocalAnswers: config.LocalAnswersConfig{
+		Hostnames: []string{"Gateway.lan"},
+		Addresses: []string{"192.168.1.1", "fd00::1"},
+		TTL:       time.Minute,
+	}}
+	s, err := New(cfg, &downAPI{}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string // answer data; empty for NOERROR without records
+	}{
+		{"localhost.", dns.TypeA, []string{"127.0.0.1"}},
+		{"LocalHost.", dns.TypeAAAA, []string{"::1"}},
+		{"app.localhost.", dns.TypeA, []string{"127.0.0.1"}},
+		{"localhost.", dns.TypeMX, nil},
+		{"1.0.0.127.in-addr.arpa.", dns.TypePTR, []string{"localhost."}},
+		{"5.4.3.127.in-addr.arpa.", dns.TypePTR, []string{"localhost."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", dns.TypePTR, []string{"localhost."}},
+		{"gateway.lan.", dns.TypeA, []string{"192.168.1.1"}},
+		{"gateway.lan.", dns.TypeAAAA, []string{"fd00::1"}},
+		{"1.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"gateway.lan."}},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, tt.qtype)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+		if resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != len(tt.want) {
+			t.Errorf("%s %s: %v", tt.name, dns.TypeToString[tt.qtype], resp)
+			continue
+		}
+		for i, rr := range resp.Answer {
+			var got string
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = rr.A.String()
+			case *dns.AAAA:
+				got = rr.AAAA.String()
+			case *dns.PTR:
+				got = rr.Ptr
+			}
+			if got != tt.want[i] || rr.Header().Name != tt.name || rr.Header().Ttl != 60 {
+				t.Errorf("%s %s: answer %v, want %s", tt.name, dns.TypeToString[tt.qtype], rr, tt.want[i])
+			}
+		}
+	}
+
+	// Other names still go to the tunnel, which is down
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	if resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)}); resp == nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("example.com: %v", resp)
+	}
+	if got := s.Stats()["local_answers"]; got != int64(len(tests)) {
+		t.Errorf("local_answers = %v, want %d", got, len(tests))
+	}
+
+	if newLocalAnswers(config.LocalAnswersConfig{Disabled: true}, nil) != nil {
+		t.Error("disabled local answers built")
+	}
+}
+
+func TestOwnAddresses(t *testing.T) {
+	tests := []struct {
+		configured, listen []string
+		want               []string
+	}{
+		{[]string{"10.0.0.1"}, []string{"192.168.1.1"}, []string{"10.0.0.1"}},
+		{nil, []string{"192.168.1.1", "::1"}, []string{"192.168.1.1", "::1"}},
+		{nil, nil, []string{"127.0.0.1", "::1"}},
+	}
+	for _, tt := range tests {
+		got := ownAddresses(tt.configured, tt.listen)
+		if len(got) != len(tt.want) {
+			t.Errorf("ownAddresses(%v, %v) = %v, want %v", tt.configured, tt.listen, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(net.ParseIP(tt.want[i])) {
+				t.Errorf("ownAddresses(%v, %v) = %v, want %v", tt.configured, tt.listen, got, tt.want)
+			}
+		}
+	}
+}
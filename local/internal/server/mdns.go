@@ -0,0 +1,325 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+const (
+	mdnsPort = 5353
+	mdnsTTL  = 120 // seconds, RFC 6762's TTL for records naming hosts
+
+	mdnsService  = "_dns._udp.local."
+	mdnsServices = "_services._dns-sd._udp.local." // DNS-SD service type enumeration
+
+	// mdnsUnique is the cache-flush bit of answer classes, and the
+	// unicast-response (QU) bit of question classes
+	mdnsUnique = 1 << 15
+)
+
+var (
+	mdnsGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+)
+
+// advertiser answers multicast DNS queries (RFC 6762) for the server's
+// DNS-SD service (RFC 6763), so devices on the LAN can discover it
+type advertiser struct {
+	instance string // service instance name, e.g. "DNS proxy on pi._dns._udp.local."
+	host     string // e.g. "pi.local."
+	port     uint16
+	txt      []string
+	addrs    []net.IP
+	iface    *net.Interface // nil for the system's default
+	conns    []mdnsConn
+	done     chan struct{}
+	logger   *slog.Logger
+}
+
+// mdnsConn is a socket joined to the mDNS group of one address family
+type mdnsConn struct {
+	*net.UDPConn
+	group *net.UDPAddr
+}
+
+// newAdvertiser prepares the advertisement, or returns nil if mdns is
+// disabled. Nothing is sent until start.
+func newAdvertiser(cfg config.MDNSConfig, srv config.ServerConfig, logger *slog.Logger) (*advertiser, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	hostname := cfg.Hostname
+	if hostname == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("mdns: %w", err)
+		}
+		hostname, _, _ = strings.Cut(name, ".")
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(hostname, "."), ".local"))
+	instance := cfg.Instance
+	if instance == "" {
+		instance = "DNS proxy on " + hostname
+	}
+
+	a := &advertiser{
+		instance: mdnsLabel(instance) + "." + mdnsService,
+		host:     hostname + ".local.",
+		port:     uint16(srv.Port),
+		txt:      []string{"txtvers=1", "proto=" + srv.Protocol},
+		done:     make(chan struct{}),
+		logger:   logger,
+	}
+	if srv.DoT.Enabled {
+		a.txt = append(a.txt, "dot="+strconv.Itoa(srv.DoT.Port))
+	}
+	if cfg.Interface != "" {
+		iface, err := net.InterfaceByName(cfg.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("mdns interface: %w", err)
+		}
+		a.iface = iface
+	}
+	a.addrs = a.ownAddresses(cfg.Addresses, srv.Addresses())
+	if len(a.addrs) == 0 {
+		return nil, fmt.Errorf("mdns needs the server listening on a LAN address, or mdns addresses")
+	}
+	return a, nil
+}
+
+// mdnsLabel returns label, which may hold any character, as one label of a
+// name in the escaped form names in unpacked queries have
+func mdnsLabel(label string) string {
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	wire := append(append([]byte{byte(len(label))}, label...), 0)
+	name, _, err := dns.UnpackDomainName(wire, 0)
+	if err != nil {
+		return "dns"
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// ownAddresses returns the addresses to advertise: those of the host the
+// listeners take, without loopback, and only the interface's if one is set
+func (a *advertiser) ownAddresses(configured, listen []string) []net.IP {
+	var onIface map[string]bool
+	if a.iface != nil && len(configured) == 0 {
+		if ifAddrs, err := a.iface.Addrs(); err == nil {
+			onIface = make(map[string]bool)
+			for _, ifAddr := range ifAddrs {
+				if n, ok := ifAddr.(*net.IPNet); ok {
+					onIface[n.IP.String()] = true
+				}
+			}
+		}
+	}
+	var ips []net.IP
+	for _, ip := range ownAddresses(configured, listen) {
+		if ip.IsLoopback() || (onIface != nil && !onIface[ip.String()]) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// start joins the mDNS groups, answers queries until close and announces
+// the service. It is safe to call on a nil advertiser.
+func (a *advertiser) start() error {
+	if a == nil {
+		return nil
+	}
+	conn4, err := net.ListenMulticastUDP("udp4", a.iface, mdnsGroup4)
+	if err != nil {
+		return fmt.Errorf("mdns: %w", err)
+	}
+	ipv4.NewPacketConn(conn4).SetMulticastTTL(255)
+	a.conns = append(a.conns, mdnsConn{conn4, mdnsGroup4})
+	if conn6, err := net.ListenMulticastUDP("udp6", a.iface, mdnsGroup6); err == nil {
+		ipv6.NewPacketConn(conn6).SetMulticastHopLimit(255)
+		a.conns = append(a.conns, mdnsConn{conn6, mdnsGroup6})
+	} else {
+		a.logger.Debug("mdns over IPv6 unavailable", "error", err)
+	}
+
+	for _, conn := range a.conns {
+		go a.serve(conn)
+	}
+	go a.announce()
+	a.logger.Info("advertising on mDNS", "instance", a.instance, "host", a.host, "addresses", a.addrs)
+	return nil
+}
+
+// announce sends the records unsolicited twice, a second apart, as
+// RFC 6762 section 8.3 asks of a new service
+func (a *advertiser) announce() {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			select {
+			case <-a.done:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		for _, conn := range a.conns {
+			a.send(conn, a.announcement(mdnsTTL), conn.group)
+		}
+	}
+}
+
+// close withdraws the service with TTL 0 records and stops answering. It is
+// safe to call on a nil advertiser.
+func (a *advertiser) close() {
+	if a == nil {
+		return
+	}
+	close(a.done)
+	for _, conn := range a.conns {
+		a.send(conn, a.announcement(0), conn.group)
+		conn.Close()
+	}
+}
+
+// serve answers the queries arriving on conn until it is closed
+func (a *advertiser) serve(conn mdnsConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if req.Unpack(buf[:n]) != nil || req.Response || req.Opcode != dns.OpcodeQuery {
+			continue
+		}
+		resp := a.answer(req)
+		if resp == nil {
+			continue
+		}
+		to := conn.group
+		switch {
+		case src.Port != mdnsPort:
+			// A plain resolver asking the group (RFC 6762 section 6.7):
+			// a DNS reply, without mDNS class bits and cached briefly
+			resp.Id, resp.Question = req.Id, req.Question
+			for _, rr := range append(resp.Answer, resp.Extra...) {
+				rr.Header().Class &^= mdnsUnique
+				rr.Header().Ttl = min(rr.Header().Ttl, 10)
+			}
+			to = src
+		case req.Question[0].Qclass&mdnsUnique != 0:
+			to = src
+		}
+		a.send(conn, resp, to)
+	}
+}
+
+func (a *advertiser) send(conn mdnsConn, m *dns.Msg, to *net.UDPAddr) {
+	data, err := m.Pack()
+	if err != nil {
+		a.logger.Debug("mdns pack failed", "error", err)
+		return
+	}
+	if _, err := conn.WriteToUDP(data, to); err != nil {
+		a.logger.Debug("mdns send failed", "to", to, "error", err)
+	}
+}
+
+// answer returns the response to an mDNS query, or nil if none of its
+// questions are about the service
+func (a *advertiser) answer(req *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{MsgHdr: dns.MsgHdr{Response: true, Authoritative: true}}
+	for _, q := range req.Question {
+		if class := q.Qclass &^ mdnsUnique; class != dns.ClassINET && class != dns.ClassANY {
+			continue
+		}
+		name, all := strings.ToLower(q.Name), q.Qtype == dns.TypeANY
+		switch {
+		case name == mdnsServices && (q.Qtype == dns.TypePTR || all):
+			resp.Answer = append(resp.Answer, a.ptr(mdnsServices, mdnsService, mdnsTTL))
+		case name == mdnsService && (q.Qtype == dns.TypePTR || all):
+			resp.Answer = append(resp.Answer, a.ptr(mdnsService, a.instance, mdnsTTL))
+			resp.Extra = append(resp.Extra, a.srv(mdnsTTL), a.text(mdnsTTL))
+			resp.Extra = append(resp.Extra, a.addresses(0, mdnsTTL)...)
+		case name == strings.ToLower(a.instance) && (q.Qtype == dns.TypeSRV || all):
+			resp.Answer = append(resp.Answer, a.srv(mdnsTTL))
+			if all {
+				resp.Answer = append(resp.Answer, a.text(mdnsTTL))
+			}
+			resp.Extra = append(resp.Extra, a.addresses(0, mdnsTTL)...)
+		case name == strings.ToLower(a.instance) && q.Qtype == dns.TypeTXT:
+			resp.Answer = append(resp.Answer, a.text(mdnsTTL))
+		case name == a.host && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || all):
+			qtype := q.Qtype
+			if all {
+				qtype = 0
+			}
+			resp.Answer = append(resp.Answer, a.addresses(qtype, mdnsTTL)...)
+		}
+	}
+	if len(resp.Answer) == 0 {
+		return nil
+	}
+	return resp
+}
+
+// announcement is every record of the service, with ttl
+func (a *advertiser) announcement(ttl uint32) *dns.Msg {
+	resp := &dns.Msg{MsgHdr: dns.MsgHdr{Response: true, Authoritative: true}}
+	resp.Answer = append(resp.Answer, a.ptr(mdnsService, a.instance, ttl), a.srv(ttl), a.text(ttl))
+	resp.Answer = append(resp.Answer, a.addresses(0, ttl)...)
+	return resp
+}
+
+func (a *advertiser) ptr(name, target string, ttl uint32) dns.RR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: target,
+	}
+}
+
+func (a *advertiser) srv(ttl uint32) dns.RR {
+	return &dns.SRV{
+		Hdr:    dns.RR_Header{Name: a.instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET | mdnsUnique, Ttl: ttl},
+		Port:   a.port,
+		Target: a.host,
+	}
+}
+
+func (a *advertiser) text(ttl uint32) dns.RR {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: a.instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET | mdnsUnique, Ttl: ttl},
+		Txt: a.txt,
+	}
+}
+
+// addresses returns the host's records of qtype, or of both types for 0
+func (a *advertiser) addresses(qtype uint16, ttl uint32) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range a.addrs {
+		hdr := dns.RR_Header{Name: a.host, Class: dns.ClassINET | mdnsUnique, Ttl: ttl}
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == 0 || qtype == dns.TypeA {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+			}
+		} else if qtype == 0 || qtype == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
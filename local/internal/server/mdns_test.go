@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestMDNSAnswer(t *testing.T) {
+	a, err := newAdvertiser(config.MDNSConfig{
+		Enabled:   true,
+		Hostname:  "Pi",
+		Addresses: []string{"192.168.1.2", "127.0.0.1", "fd00::2"},
+	}, config.ServerConfig{Port: 53, Protocol: "both"}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const instance = "DNS\\ proxy\\ on\\ pi._dns._udp.local."
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.Id = 0
+		return a.answer(req)
+	}
+
+	resp := query("_dns._udp.local.", dns.TypePTR)
+	if resp == nil || len(resp.Answer) != 1 {
+		t.Fatalf("browse answer = %v", resp)
+	}
+	if ptr := resp.Answer[0].(*dns.PTR); ptr.Ptr != instance {
+		t.Errorf("instance = %q, want %q", ptr.Ptr, instance)
+	}
+	var srv *dns.SRV
+	addrs := 0
+	for _, rr := range resp.Extra {
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			srv = rr
+		case *dns.A, *dns.AAAA:
+			addrs++
+		}
+	}
+	if srv == nil || srv.Port != 53 || srv.Target != "pi.local." {
+		t.Errorf("SRV = %v, want port 53 on pi.local.", srv)
+	}
+	if addrs != 2 {
+		t.Errorf("%d address records, want 2 (loopback left out)", addrs)
+	}
+
+	if resp := query("PI.local.", dns.TypeAAAA); resp == nil || len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::2" {
+		t.Errorf("AAAA answer = %v", resp)
+	}
+	if resp := query(instance, dns.TypeTXT); resp == nil || len(resp.Answer) != 1 {
+		t.Errorf("TXT answer = %v", resp)
+	}
+	if resp := query("printer.local.", dns.TypeA); resp != nil {
+		t.Errorf("answered another host: %v", resp)
+	}
+
+	// Withdrawing the service sends every record with TTL 0
+	for _, rr := range a.announcement(0).Answer {
+		if rr.Header().Ttl != 0 {
+			t.Errorf("goodbye record with TTL %d: %v", rr.Header().Ttl, rr)
+		}
+	}
+
+	if _, err := newAdvertiser(config.MDNSConfig{Enabled: true, Hostname: "pi"},
+		config.ServerConfig{ListenAddr: "127.0.0.1", Port: 53}, logging.Discard()); err == nil {
+		t.Error("advertised a server listening on loopback only")
+	}
+}
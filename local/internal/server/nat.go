@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// natRule is a parsed response.nat entry
+type natRule struct {
+	public   net.IP
+	internal net.IP
+	domains  []string // lower-case FQDNs; empty matches every name
+}
+
+// parseNAT converts the configured rules; addresses were checked when the
+// config was loaded
+func parseNAT(rules []config.NATRule) []natRule {
+	parsed := make([]natRule, 0, len(rules))
+	for _, r := range rules {
+		rule := natRule{public: net.ParseIP(r.Public), internal: net.ParseIP(r.Internal)}
+		for _, d := range r.Domains {
+			rule.domains = append(rule.domains, strings.ToLower(dns.Fqdn(d)))
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed
+}
+
+// matches reports whether qname is one of the rule's domains or below one
+func (r natRule) matches(qname string) bool {
+	if len(r.domains) == 0 {
+		return true
+	}
+	qname = strings.ToLower(qname)
+	for _, d := range r.domains {
+		if qname == d || strings.HasSuffix(qname, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteNAT replaces public addresses in A/AAAA answers with the internal
+// address of the first rule matching the question name. Names are matched
+// on the question, so a CNAME chain ending at a dynamic DNS name is
+// rewritten too. It reports whether any address was replaced.
+func rewriteNAT(rules []natRule, qname string, answer []dns.RR) (rewritten bool) {
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if ip := natAddress(rules, qname, rr.A); ip != nil {
+				rr.A = ip.To4()
+				rewritten = true
+			}
+		case *dns.AAAA:
+			if ip := natAddress(rules, qname, rr.AAAA); ip != nil {
+				rr.AAAA = ip.To16()
+				rewritten = true
+			}
+		}
+	}
+	return rewritten
+}
+
+// natAddress returns the internal address for ip, or nil if no rule applies
+func natAddress(rules []natRule, qname string, ip net.IP) net.IP {
+	for _, rule := range rules {
+		if rule.public.Equal(ip) && rule.matches(qname) {
+			return rule.internal
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// normalizeAnswer tidies an answer assembled from API records before it is
+// cached and sent: the names records point to are lower-cased, identical records (which some
+// upstream combinations return twice) are merged keeping the lowest TTL,
+// and with sorted set each type's records are put in a deterministic order
+// in their places, so CNAME chains stay first.
+func normalizeAnswer(answer []dns.RR, sorted bool) []dns.RR {
+	out := answer[:0]
+	for _, rr := range answer {
+		lowerTarget(rr)
+		if i := slices.IndexFunc(out, func(seen dns.RR) bool { return dns.IsDuplicate(seen, rr) }); i >= 0 {
+			out[i].Header().Ttl = min(out[i].Header().Ttl, rr.Header().Ttl)
+			continue
+		}
+		out = append(out, rr)
+	}
+	clear(answer[len(out):])
+
+	if sorted {
+		seen := make(map[uint16]bool)
+		for _, rr := range out {
+			t := rr.Header().Rrtype
+			if t == dns.TypeCNAME || seen[t] {
+				continue
+			}
+			seen[t] = true
+			reorder(out, t, func(rrs []dns.RR) { slices.SortStableFunc(rrs, compareRR) })
+		}
+	}
+	return out
+}
+
+// lowerTarget lower-cases the name a record points to. Owner names keep
+// the case of the question, which some stub resolvers randomize and check.
+func lowerTarget(rr dns.RR) {
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		rr.Target = strings.ToLower(rr.Target)
+	case *dns.MX:
+		rr.Mx = strings.ToLower(rr.Mx)
+	case *dns.NS:
+		rr.Ns = strings.ToLower(rr.Ns)
+	case *dns.PTR:
+		rr.Ptr = strings.ToLower(rr.Ptr)
+	case *dns.SRV:
+		rr.Target = strings.ToLower(rr.Target)
+	}
+}
+
+// compareRR orders records of one type: addresses numerically, MX and SRV
+// records by priority, the rest by their text
+func compareRR(a, b dns.RR) int {
+	switch a := a.(type) {
+	case *dns.A:
+		return bytes.Compare(a.A.To4(), b.(*dns.A).A.To4())
+	case *dns.AAAA:
+		return bytes.Compare(a.AAAA.To16(), b.(*dns.AAAA).AAAA.To16())
+	case *dns.MX:
+		if c := int(a.Preference) - int(b.(*dns.MX).Preference); c != 0 {
+			return c
+		}
+	case *dns.SRV:
+		if c := int(a.Priority) - int(b.(*dns.SRV).Priority); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(rdata(a), rdata(b))
+}
+
+// rdata returns a record's text without its header
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
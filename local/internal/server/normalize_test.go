@@ -0,0 +1,68 @@
+package server
+
+import "testing"
+
+func TestNormalizeAnswer(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []string
+		sorted bool
+		want   []string
+	}{
+		{
+			name: "duplicates merged with the lowest TTL, whatever their case",
+			in: []string{
+				"www.example.com. 300 IN A 192.0.2.2",
+				"www.example.com. 60 IN A 192.0.2.2",
+				"WWW.example.com. 300 IN A 192.0.2.2",
+				"www.example.com. 300 IN A 192.0.2.1",
+			},
+			want: []string{
+				"www.example.com.\t60\tIN\tA\t192.0.2.2",
+				"www.example.com.\t300\tIN\tA\t192.0.2.1",
+			},
+		},
+		{
+			name: "sorted after the CNAME chain",
+			in: []string{
+				"Www.Example.com. 30 IN CNAME LB.Example.com.",
+				"lb.example.com. 300 IN A 192.0.2.10",
+				"lb.example.com. 300 IN A 192.0.2.9",
+				"lb.example.com. 300 IN A 192.0.2.10",
+			},
+			sorted: true,
+			want: []string{
+				"Www.Example.com.\t30\tIN\tCNAME\tlb.example.com.",
+				"lb.example.com.\t300\tIN\tA\t192.0.2.9",
+				"lb.example.com.\t300\tIN\tA\t192.0.2.10",
+			},
+		},
+		{
+			name: "MX by preference, then host",
+			in: []string{
+				"example.com. 300 IN MX 20 Mx2.example.com.",
+				"example.com. 300 IN MX 10 mx3.example.com.",
+				"example.com. 300 IN MX 20 mx1.example.com.",
+			},
+			sorted: true,
+			want: []string{
+				"example.com.\t300\tIN\tMX\t10 mx3.example.com.",
+				"example.com.\t300\tIN\tMX\t20 mx1.example.com.",
+				"example.com.\t300\tIN\tMX\t20 mx2.example.com.",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeAnswer(answerFor(t, tt.in...), tt.sorted)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i, rr := range got {
+				if rr.String() != tt.want[i] {
+					t.Errorf("record %d = %q, want %q", i, rr.String(), tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// queryPolicy refuses or silently drops queries of the types the operator
+// listed, typically ANY (amplification) and NULL or TXT (data smuggled
+// through DNS), and strips 0x20 case randomization from the names sent
+// through the tunnel
+type queryPolicy struct {
+	refuse    map[uint16]bool
+	drop      map[uint16]bool
+	lowercase bool
+
+	refused atomic.Int64
+	dropped atomic.Int64
+}
+
+// newQueryPolicy returns the configured policy, or nil if it does nothing
+func newQueryPolicy(cfg config.QueryPolicyConfig) *queryPolicy {
+	if len(cfg.RefuseTypes) == 0 && len(cfg.DropTypes) == 0 && !cfg.LowercaseNames {
+		return nil
+	}
+	p := &queryPolicy{
+		refuse:    make(map[uint16]bool),
+		drop:      make(map[uint16]bool),
+		lowercase: cfg.LowercaseNames,
+	}
+	for _, t := range cfg.RefuseTypes {
+		p.refuse[dns.StringToType[strings.ToUpper(t)]] = true
+	}
+	for _, t := range cfg.DropTypes {
+		p.drop[dns.StringToType[strings.ToUpper(t)]] = true
+	}
+	return p
+}
+
+// check reports whether a query of qtype is refused or dropped, counting
+// it. It is safe to call on a nil queryPolicy.
+func (p *queryPolicy) check(qtype uint16) (refuse, drop bool) {
+	if p == nil {
+		return false, false
+	}
+	switch {
+	case p.drop[qtype]:
+		p.dropped.Add(1)
+		return false, true
+	case p.refuse[qtype]:
+		p.refused.Add(1)
+		return true, false
+	}
+	return false, false
+}
+
+// apiName returns the name of q as sent to the remote. Answers keep the
+// case of the question, since owner names are matched without regard to
+// case. It is safe to call on a nil queryPolicy.
+func (p *queryPolicy) apiName(q dns.Question) string {
+	name := strings.TrimSuffix(q.Name, ".")
+	if p != nil && p.lowercase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// Stats returns the policy's counters
+func (p *queryPolicy) Stats() map[string]int64 {
+	return map[string]int64{
+		"refused": p.refused.Load(),
+		"dropped": p.dropped.Load(),
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// namesAPI records the names it is asked for
+type namesAPI struct {
+	fakeAPI
+	names []string
+}
+
+func (n *namesAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	n.names = append(n.names, domain)
+	return n.fakeAPI.Resolve(ctx, domain, recordType)
+}
+
+func TestQueryPolicy(t *testing.T) {
+	cfg := &config.Config{QueryPolicy: config.QueryPolicyConfig{
+		RefuseTypes:    []string{"any"},
+		DropTypes:      []string{"NULL"},
+		LowercaseNames: true,
+	}}
+	api := &namesAPI{fakeAPI: fakeAPI{addr: "203.0.113.7"}}
+	s, err := New(cfg, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		return s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+	}
+
+	if resp := query("example.com.", dns.TypeANY); resp == nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("ANY answered %v, want REFUSED", resp)
+	}
+	if resp := query("example.com.", dns.TypeNULL); resp != nil {
+		t.Errorf("NULL answered %v, want no answer", resp)
+	}
+
+	resp := query("wWw.ExAmPlE.cOm.", dns.TypeA)
+	if resp == nil || len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "wWw.ExAmPlE.cOm." {
+		t.Fatalf("A answered %v, want the record under the question's name", resp)
+	}
+	if len(api.names) != 1 || api.names[0] != "www.example.com" {
+		t.Errorf("API asked for %v, want [www.example.com]", api.names)
+	}
+
+	stats, _ := s.Stats()["query_policy"].(map[string]int64)
+	if stats["refused"] != 1 || stats["dropped"] != 1 {
+		t.Errorf("query_policy stats %v", stats)
+	}
+
+	if newQueryPolicy(config.QueryPolicyConfig{}) != nil {
+		t.Error("empty query policy built")
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"math/rand"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP payload size advertised to EDNS clients (the DNS
+// flag day 2020 recommendation, which avoids IP fragmentation)
+const ednsUDPSize = 1232
+
+// minUDPSize is the smallest UDP payload every DNS client accepts
+const minUDPSize = 512
+
+// udpSize returns the UDP payload size to advertise: ednsUDPSize, or less
+// when API tuning found the network dropping smaller payloads, as a link
+// with a low MTU does to the LAN's UDP as much as to the API's requests
+func (s *Server) udpSize() int {
+	p := s.active.Load()
+	if p == nil {
+		return ednsUDPSize
+	}
+	tuned, ok := p.apiClient.(interface{ PayloadLimit() int })
+	if !ok {
+		return ednsUDPSize
+	}
+	if limit := tuned.PayloadLimit(); limit > 0 && limit < ednsUDPSize {
+		return max(limit, minUDPSize)
+	}
+	return ednsUDPSize
+}
+
+// truncateUDP trims a UDP response that is larger than both the client's
+// buffer and a tuned-down udpSize, setting TC so the client retries over
+// TCP instead of losing the fragments
+func (s *Server) truncateUDP(w dns.ResponseWriter, r, resp *dns.Msg) {
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); !udp {
+		return
+	}
+	size := s.udpSize()
+	if size == ednsUDPSize {
+		return // untuned: responses go out as they always have
+	}
+	if opt := r.IsEdns0(); opt == nil || int(opt.UDPSize()) < size {
+		size = minUDPSize
+		if opt != nil {
+			size = max(int(opt.UDPSize()), minUDPSize)
+		}
+	}
+	resp.Truncate(size)
+}
+
+// postProcess shapes a response like a recursive resolver would: answer
+// TTLs are clamped to the configured range, public addresses of
+// self-hosted services are rewritten to internal ones, the AD bit goes only
+// to clients that asked for it, A/AAAA answers are
+// rotated or shuffled to spread load over the addresses, and EDNS is echoed
+// to clients that sent it.
+func (s *Server) postProcess(r, resp *dns.Msg) {
+	cfg := s.cfg.Response
+
+	if p := s.active.Load(); p != nil && len(p.nat) > 0 && len(r.Question) > 0 {
+		if rewriteNAT(p.nat, r.Question[0].Name, resp.Answer) {
+			// The rewritten addresses are not the validated ones
+			resp.AuthenticatedData = false
+		}
+	}
+	// AD is only for clients that asked for it (RFC 6840 5.7); cached
+	// answers keep the bit for those that do
+	if !queryFlags(r).AuthenticatedData {
+		resp.AuthenticatedData = false
+	}
+
+	minTTL := uint32(cfg.MinTTL.Seconds())
+	maxTTL := uint32(cfg.MaxTTL.Seconds())
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if minTTL > 0 && hdr.Ttl < minTTL {
+			hdr.Ttl = minTTL
+		}
+		if maxTTL > 0 && hdr.Ttl > maxTTL {
+			hdr.Ttl = maxTTL
+		}
+	}
+
+	switch cfg.AnswerOrder {
+	case "rotate":
+		n := int(s.rotation.Add(1))
+		reorder(resp.Answer, dns.TypeA, func(rrs []dns.RR) { rotate(rrs, n) })
+		reorder(resp.Answer, dns.TypeAAAA, func(rrs []dns.RR) { rotate(rrs, n) })
+	case "random":
+		shuffle := func(rrs []dns.RR) {
+			rand.Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+		}
+		reorder(resp.Answer, dns.TypeA, shuffle)
+		reorder(resp.Answer, dns.TypeAAAA, shuffle)
+	}
+
+	if opt := r.IsEdns0(); opt != nil && resp.IsEdns0() == nil {
+		resp.SetEdns0(uint16(s.udpSize()), opt.Do())
+	}
+}
+
+// reorder applies fn to the records of type t and writes them back into
+// their original positions, so CNAMEs and other records keep their place
+func reorder(answer []dns.RR, t uint16, fn func([]dns.RR)) {
+	var idx []int
+	var rrs []dns.RR
+	for i, rr := range answer {
+		if rr.Header().Rrtype == t {
+			idx = append(idx, i)
+			rrs = append(rrs, rr)
+		}
+	}
+	if len(rrs) < 2 {
+		return
+	}
+	fn(rrs)
+	for i, pos := range idx {
+		answer[pos] = rrs[i]
+	}
+}
+
+// rotate shifts rrs left by n positions
+func rotate(rrs []dns.RR, n int) {
+	n %= len(rrs)
+	rotated := append(append([]dns.RR{}, rrs[n:]...), rrs[:n]...)
+	copy(rrs, rotated)
+}
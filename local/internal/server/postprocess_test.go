@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func answerFor(t *testing.T, records ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func TestPostProcessRotate(t *testing.T) {
+	s := &Server{cfg: &config.Config{Response: config.ResponseConfig{
+		AnswerOrder: "rotate",
+		MinTTL:      time.Minute,
+		MaxTTL:      time.Hour,
+	}}}
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	r.SetEdns0(4096, true)
+
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Answer = answerFor(t,
+		"www.example.com. 30 IN CNAME lb.example.com.",
+		"lb.example.com. 86400 IN A 192.0.2.1",
+		"lb.example.com. 300 IN A 192.0.2.2",
+		"lb.example.com. 300 IN A 192.0.2.3",
+	)
+	s.postProcess(r, resp)
+
+	if _, ok := resp.Answer[0].(*dns.CNAME); !ok {
+		t.Fatal("CNAME must stay first")
+	}
+	if got := resp.Answer[1].(*dns.A).A.String(); got != "192.0.2.2" {
+		t.Errorf("first address after rotation = %s, want 192.0.2.2", got)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 60 {
+		t.Errorf("CNAME TTL = %d, want floor 60", ttl)
+	}
+	if ttl := resp.Answer[3].Header().Ttl; ttl != 3600 {
+		t.Errorf("A TTL = %d, want ceiling 3600", ttl)
+	}
+	if opt := resp.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("expected EDNS with DO bit echoed")
+	}
+}
+
+func TestPostProcessNAT(t *testing.T) {
+	s := &Server{cfg: &config.Config{}}
+	s.active.Store(&profile{nat: parseNAT([]config.NATRule{
+		{Public: "203.0.113.10", Internal: "192.168.1.10", Domains: []string{"home.example.com"}},
+		{Public: "2001:db8::10", Internal: "fd00::10"},
+	})})
+
+	answer := func(qname string, records ...string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, dns.TypeA)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = answerFor(t, records...)
+		s.postProcess(r, resp)
+		return resp
+	}
+
+	resp := answer("nas.HOME.example.com.",
+		"nas.home.example.com. 60 IN CNAME me.dyndns.test.",
+		"me.dyndns.test. 60 IN A 203.0.113.10",
+		"me.dyndns.test. 60 IN AAAA 2001:db8::10",
+	)
+	if got := resp.Answer[1].(*dns.A).A.String(); got != "192.168.1.10" {
+		t.Errorf("A = %s, want 192.168.1.10", got)
+	}
+	if got := resp.Answer[2].(*dns.AAAA).AAAA.String(); got != "fd00::10" {
+		t.Errorf("AAAA = %s, want fd00::10", got)
+	}
+
+	resp = answer("other.example.com.", "other.example.com. 60 IN A 203.0.113.10")
+	if got := resp.Answer[0].(*dns.A).A.String(); got != "203.0.113.10" {
+		t.Errorf("A outside the rule's domains rewritten to %s", got)
+	}
+}
+
+// tunedAPI is a fakeAPI whose tuning found a payload limit
+type tunedAPI struct {
+	fakeAPI
+	limit int
+}
+
+func (t *tunedAPI) PayloadLimit() int { return t.limit }
+
+func TestTunedUDPSize(t *testing.T) {
+	api := &tunedAPI{fakeAPI: fakeAPI{addr: "192.0.2.1"}}
+	s, err := New(&config.Config{}, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ limit, want int }{{0, 1232}, {4096, 1232}, {1024, 1024}, {256, 512}} {
+		api.limit = tt.limit
+		if got := s.udpSize(); got != tt.want {
+			t.Errorf("limit %d: udpSize = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+
+	// A large answer is truncated for UDP clients only once tuned down
+	large := func() (*dns.Msg, *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetQuestion("many.example.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		for i := 0; i < 60; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "many.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(i)),
+			})
+		}
+		return r, resp
+	}
+	udp := &memoryWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	tcp := &memoryWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+
+	api.limit = 0
+	r, resp := large()
+	s.truncateUDP(udp, r, resp)
+	if resp.Truncated || len(resp.Answer) != 60 {
+		t.Error("truncated without tuning")
+	}
+	api.limit = 512
+	r, resp = large()
+	s.truncateUDP(tcp, r, resp)
+	if resp.Truncated {
+		t.Error("truncated over TCP")
+	}
+	s.truncateUDP(udp, r, resp)
+	if !resp.Truncated || resp.Len() > 512 {
+		t.Errorf("not truncated to 512: TC %v, %d bytes", resp.Truncated, resp.Len())
+	}
+}
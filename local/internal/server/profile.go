@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// profile is the endpoint set and rules queries are answered with. A switch
+// replaces it as a whole, so each query sees one profile from start to end.
+type profile struct {
+	name      string
+	apiClient APIClient
+	nat       []natRule
+	fallback  config.FallbackConfig
+}
+
+// newProfile returns the profile for cfg, a configuration with the named
+// profile applied
+func newProfile(name string, cfg *config.Config, apiClient APIClient) *profile {
+	if name == "" {
+		name = config.DefaultProfile
+	}
+	return &profile{
+		name:      name,
+		apiClient: apiClient,
+		nat:       parseNAT(cfg.Response.NAT),
+		fallback:  cfg.Fallback,
+	}
+}
+
+// ProfileStatus lists the profiles and the one in use
+type ProfileStatus struct {
+	Active   string   `json:"active"`
+	Profiles []string `json:"profiles"`
+}
+
+// EnableProfiles allows switching profiles at runtime. newClient builds the
+// API client for a profile's configuration on each switch.
+func (s *Server) EnableProfiles(newClient func(*config.Config) (APIClient, error)) {
+	s.newClient = newClient
+}
+
+// Profiles returns the configured profiles and the active one
+func (s *Server) Profiles() ProfileStatus {
+	return ProfileStatus{Active: s.active.Load().name, Profiles: s.cfg.ProfileNames()}
+}
+
+// SwitchProfile makes the named profile active. Its API client is built
+// before the switch, so a bad profile leaves the current one in place;
+// queries in flight finish on the old client, which is then closed.
+func (s *Server) SwitchProfile(name string) error {
+	if s.newClient == nil {
+		return errors.New("profile switching is not enabled")
+	}
+	if name == "" {
+		name = config.DefaultProfile
+	}
+
+	s.switchMu.Lock()
+	defer s.switchMu.Unlock()
+
+	old := s.active.Load()
+	if old.name == name {
+		return nil
+	}
+	cfg, err := s.cfg.WithProfile(name)
+	if err != nil {
+		return err
+	}
+	apiClient, err := s.newClient(cfg)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	s.active.Store(newProfile(name, cfg, apiClient))
+	// Discovered endpoints belong to the previous profile's cluster
+	s.discovered = nil
+
+	if c, ok := old.apiClient.(interface{ Close() }); ok {
+		c.Close()
+	}
+	s.logger.Info("switched profile", "from", old.name, "to", name, "endpoints", len(cfg.API.Endpoints))
+	return nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// fakeAPI answers every A query with one address
+type fakeAPI struct {
+	addr   string
+	closed bool
+}
+
+func (f *fakeAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{{Name: domain, Type: "A", Value: f.addr, TTL: 60}}}, nil
+}
+
+func (f *fakeAPI) Stats() map[string]interface{} { return nil }
+
+func (f *fakeAPI) Close() { f.closed = true }
+
+func TestSwitchProfile(t *testing.T) {
+	cfg := &config.Config{
+		API: config.APIConfig{Endpoints: []config.EndpointConfig{{URL: "https://home.example/api/v1/resolve"}}},
+		Profiles: map[string]config.ProfileConfig{
+			"travel": {
+				Endpoints: []config.EndpointConfig{{URL: "https://travel.example/api/v1/resolve"}},
+				NAT:       []config.NATRule{{Public: "203.0.113.2", Internal: "192.168.1.2"}},
+			},
+		},
+	}
+	home := &fakeAPI{addr: "203.0.113.1"}
+	s, err := New(cfg, home, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := func() string {
+		r := new(dns.Msg)
+		r.SetQuestion("nas.example.", dns.TypeA)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("unexpected response %v", resp)
+		}
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+
+	if err := s.SwitchProfile("travel"); err == nil {
+		t.Error("switched without EnableProfiles")
+	}
+
+	var built []string
+	s.EnableProfiles(func(cfg *config.Config) (APIClient, error) {
+		built = append(built, cfg.API.Endpoints[0].URL)
+		return &fakeAPI{addr: "203.0.113.2"}, nil
+	})
+	if got := query(); got != "203.0.113.1" {
+		t.Fatalf("default profile answered %s", got)
+	}
+
+	if err := s.SwitchProfile("nowhere"); err == nil {
+		t.Error("switched to an unknown profile")
+	}
+	if err := s.SwitchProfile("travel"); err != nil {
+		t.Fatal(err)
+	}
+	if len(built) != 1 || built[0] != "https://travel.example/api/v1/resolve" {
+		t.Errorf("clients built for %v", built)
+	}
+	if !home.closed {
+		t.Error("previous profile's client was not closed")
+	}
+	// The travel client's answer, rewritten by the travel NAT rule
+	if got := query(); got != "192.168.1.2" {
+		t.Errorf("travel profile answered %s, want 192.168.1.2", got)
+	}
+	if got := s.Stats()["profile"]; got != "travel" {
+		t.Errorf("profile stat = %v", got)
+	}
+
+	// Switching to the active profile keeps its client
+	if err := s.SwitchProfile("travel"); err != nil || len(built) != 1 {
+		t.Errorf("re-selecting the active profile: err %v, %d clients built", err, len(built))
+	}
+}
+
+func TestAdminProfile(t *testing.T) {
+	cfg := &config.Config{Profiles: map[string]config.ProfileConfig{"travel": {}}}
+	s, err := New(cfg, &fakeAPI{}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.EnableProfiles(func(*config.Config) (APIClient, error) { return &fakeAPI{}, nil })
+	ts := httptest.NewServer(s.newAdminServer().Handler)
+	defer ts.Close()
+
+	jsonBody := http.Header{"Content-Type": {"application/json"}}
+	tests := []struct {
+		method, body string
+		header       http.Header
+		status       int
+		want         string
+	}{
+		{http.MethodGet, "", nil, http.StatusOK, `{"active":"default","profiles":["default","travel"]}`},
+		{http.MethodPut, `{"name":"travel"}`, jsonBody, http.StatusOK, `{"active":"travel","profiles":["default","travel"]}`},
+		{http.MethodPut, `{"name":"home"}`, jsonBody, http.StatusBadRequest, `unknown profile "home"`},
+		{http.MethodPut, `{}`, jsonBody, http.StatusBadRequest, "body must be"},
+		{http.MethodDelete, "", nil, http.StatusMethodNotAllowed, "method not allowed"},
+		// What a web page can send without a CORS preflight
+		{http.MethodPost, `{"name":"default"}`, http.Header{"Content-Type": {"text/plain"}}, http.StatusMethodNotAllowed, "method not allowed"},
+		{http.MethodPut, `{"name":"default"}`, http.Header{"Content-Type": {"text/plain"}}, http.StatusUnsupportedMediaType, "application/json"},
+		{http.MethodPut, `{"name":"default"}`, nil, http.StatusUnsupportedMediaType, "application/json"},
+		// Pages, and names rebound to loopback
+		{http.MethodPut, `{"name":"default"}`, http.Header{"Content-Type": {"application/json"}, "Origin": {"https://evil.example"}}, http.StatusForbidden, "forbidden"},
+		{http.MethodGet, "", http.Header{"Host": {"rebind.evil.example:5380"}}, http.StatusForbidden, "forbidden"},
+		{http.MethodGet, "", http.Header{"Host": {"localhost:5380"}}, http.StatusOK, `"active":"travel"`},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, ts.URL+"/profile", strings.NewReader(tt.body))
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		if host := tt.header.Get("Host"); host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || !strings.Contains(string(body), tt.want) {
+			t.Errorf("%s %s %v: %d %q, want %d %q", tt.method, tt.body, tt.header, resp.StatusCode, body, tt.status, tt.want)
+		}
+	}
+
+	// With a token every request needs it
+	cfg.Admin.Token = "s3cret"
+	for auth, status := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "Bearer s3cret": http.StatusOK} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/profile", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Authorization %q: %d, want %d", auth, resp.StatusCode, status)
+		}
+	}
+}
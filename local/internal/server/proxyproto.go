@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY header
+const proxyHeaderTimeout = 5 * time.Second
+
+// wrapProxyProtocol makes the listener accept HAProxy PROXY v1/v2 headers so
+// RemoteAddr reports the original client behind an L4 load balancer. Headers
+// from peers outside the trusted networks are read but ignored.
+func wrapProxyProtocol(ln net.Listener, cfg config.ProxyProtocolConfig) (net.Listener, error) {
+	if !cfg.Enabled {
+		return ln, nil
+	}
+
+	pl := &proxyproto.Listener{
+		Listener:          ln,
+		ReadHeaderTimeout: proxyHeaderTimeout,
+	}
+	if len(cfg.TrustedNetworks) > 0 {
+		policy, err := proxyproto.LaxWhiteListPolicy(cfg.TrustedNetworks)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_protocol trusted_networks: %w", err)
+		}
+		pl.Policy = policy
+	}
+	return pl, nil
+}
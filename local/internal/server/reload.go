@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/mahdi/dns-proxy-local/internal/cache"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// EnableReload allows reloading the configuration at runtime (on SIGHUP).
+// load reads it again the way it was read at startup.
+func (s *Server) EnableReload(load func() (*config.Config, error)) {
+	s.reload = load
+}
+
+// Reload reads the configuration again and applies the settings that can
+// change at runtime, currently the cache; the rest need a restart
+func (s *Server) Reload() error {
+	if s.reload == nil {
+		return errors.New("reloading is not enabled")
+	}
+	cfg, err := s.reload()
+	if err != nil {
+		return err
+	}
+	s.ReloadCache(cfg.Cache)
+	s.logger.Info("configuration reloaded")
+	return nil
+}
+
+// ReloadCache rebuilds the cache for new settings. The live entries of the
+// old cache move into the new one under its limits, so a resize doesn't
+// send every name back to the API at once. Unchanged settings keep the
+// cache as is; disabling the cache drops it.
+func (s *Server) ReloadCache(cfg config.CacheConfig) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if cfg == s.cacheCfg {
+		return
+	}
+	s.cacheCfg = cfg
+
+	// Queries switch to the new cache at once; answers they store there
+	// take precedence over the migrated ones
+	next := s.newCache(cfg)
+	old := s.cache.Swap(next)
+	if old == nil {
+		s.logger.Info("cache reconfigured", "enabled", cfg.Enabled)
+		return
+	}
+	old.Close()
+	if next == nil {
+		s.logger.Info("cache disabled", "dropped", old.Len())
+		return
+	}
+	moved := next.Migrate(old)
+	s.logger.Info("cache reconfigured",
+		"max_items", cfg.MaxItems,
+		"migrated", moved,
+		"dropped", old.Len()-moved,
+	)
+}
+
+// newCache builds the cache for cfg, or returns nil if caching is disabled
+func (s *Server) newCache(cfg config.CacheConfig) *cache.Cache {
+	if !cfg.Enabled {
+		return nil
+	}
+	c := cache.New(cfg.MaxItems, cfg.DefaultTTL, cfg.MinTTL, cfg.MaxTTL)
+	c.LimitNegative(cfg.NegativeTTL)
+	if s.saver != nil {
+		c.RetainExpired(s.saver.retain(cfg.MaxTTL))
+	}
+	if p := cfg.Prefetch; p.Enabled {
+		c.EnablePrefetch(p.MinHits, p.Window, p.Concurrency, s.prefetch)
+	}
+	return c
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// privateReverse answers reverse lookups within private ranges, which no
+// public resolver knows and which would only tell the tunnel about the
+// LAN: mapped addresses get their name, anything else NXDOMAIN
+type privateReverse struct {
+	networks []*net.IPNet
+	hosts    map[string]string // reverse name -> FQDN
+	ttl      uint32
+	answered atomic.Int64
+}
+
+// newPrivateReverse returns the private reverse zones, or nil if they are
+// disabled
+func newPrivateReverse(cfg config.PrivateReverseConfig) *privateReverse {
+	if !cfg.Enabled {
+		return nil
+	}
+	p := &privateReverse{
+		hosts: make(map[string]string, len(cfg.Hosts)),
+		ttl:   uint32(cfg.TTL.Seconds()),
+	}
+	for _, cidr := range cfg.Networks {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			p.networks = append(p.networks, n)
+		}
+	}
+	for addr, name := range cfg.Hosts {
+		if rev, err := dns.ReverseAddr(addr); err == nil {
+			p.hosts[rev] = dns.Fqdn(strings.ToLower(name))
+		}
+	}
+	return p
+}
+
+// answer returns the local response to r, or nil if r's name is not in a
+// private reverse zone. It is safe to call on a nil privateReverse.
+func (p *privateReverse) answer(r *dns.Msg) *dns.Msg {
+	if p == nil {
+		return nil
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	name := strings.ToLower(q.Name)
+	target, mapped := p.hosts[name]
+	zone := ""
+	if !mapped {
+		if zone = p.zone(name); zone == "" {
+			return nil
+		}
+	}
+
+	p.answered.Add(1)
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	switch {
+	case mapped && q.Qtype == dns.TypePTR:
+		resp.Answer = []dns.RR{&dns.PTR{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: p.ttl},
+			Ptr: target,
+		}}
+	case mapped:
+		// The name exists, without records of this type
+	default:
+		resp.Rcode = dns.RcodeNameError
+		resp.Ns = []dns.RR{localSOA(zone, p.ttl)}
+	}
+	return resp
+}
+
+// zone returns the reverse zone of a private network name falls in, or ""
+// if it is outside every network. Names above a network's zone, such as
+// 172.in-addr.arpa. for 172.16.0.0/12, are not in it.
+func (p *privateReverse) zone(name string) string {
+	prefix, bits, labels, ok := reversePrefix(name)
+	if !ok {
+		return ""
+	}
+	for _, n := range p.networks {
+		ones, size := n.Mask.Size()
+		if size != len(prefix)*8 || bits < ones || !n.Contains(prefix) {
+			continue
+		}
+		// The zone apex: as many labels as cover the network's prefix
+		perLabel := 8
+		if size == 128 {
+			perLabel = 4
+		}
+		keep := (ones + perLabel - 1) / perLabel
+		return dns.Fqdn(strings.Join(dns.SplitDomainName(name)[labels-keep:], "."))
+	}
+	return ""
+}
+
+// reversePrefix parses a name in in-addr.arpa. or ip6.arpa. into the
+// address prefix it stands for, how many bits of it the name gives, and
+// how many address labels it has
+func reversePrefix(name string) (prefix net.IP, bits, labels int, ok bool) {
+	var parts []string
+	var size, perLabel, base int
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		parts = dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		size, perLabel, base = 4, 8, 10
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		parts = dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		size, perLabel, base = 16, 4, 16
+	default:
+		return nil, 0, 0, false
+	}
+	if len(parts) == 0 || len(parts)*perLabel > size*8 {
+		return nil, 0, 0, false
+	}
+	prefix = make(net.IP, size)
+	for i := range parts {
+		v, err := strconv.ParseUint(parts[len(parts)-1-i], base, perLabel)
+		if err != nil {
+			return nil, 0, 0, false
+		}
+		bit := i * perLabel
+		prefix[bit/8] |= byte(v) << (8 - perLabel - bit%8)
+	}
+	return prefix, len(parts) * perLabel, len(parts), true
+}
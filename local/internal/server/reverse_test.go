@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestPrivateReverse(t *testing.T) {
+	cfg := &config.Config{PrivateReverse: config.PrivateReverseConfig{
+		Enabled:  true,
+		Networks: []string{"192.168.0.0/16", "172.16.0.0/12", "fc00::/7"},
+		Hosts:    map[string]string{"192.168.1.10": "NAS.lan"},
+		TTL:      time.Minute,
+	}}
+	s, err := New(cfg, &downAPI{}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd00, _ := dns.ReverseAddr("fd00::5")
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  string // PTR target, or the SOA owner of NXDOMAIN
+	}{
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, "nas.lan."},
+		{"10.1.168.192.in-addr.arpa.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"20.1.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, "168.192.in-addr.arpa."},
+		{"168.192.in-addr.arpa.", dns.TypeSOA, dns.RcodeNameError, "168.192.in-addr.arpa."},
+		{"5.0.20.172.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, "20.172.in-addr.arpa."},
+		{fd00, dns.TypePTR, dns.RcodeNameError, "d.f.ip6.arpa."},
+		// Outside the private zones the tunnel, which is down, is asked
+		{"172.in-addr.arpa.", dns.TypeNS, dns.RcodeServerFailure, ""},
+		{"5.0.32.172.in-addr.arpa.", dns.TypePTR, dns.RcodeServerFailure, ""},
+		{"1.2.0.192.in-addr.arpa.", dns.TypePTR, dns.RcodeServerFailure, ""},
+	}
+	local := 0
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, tt.qtype)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+		if resp == nil || resp.Rcode != tt.rcode {
+			t.Errorf("%s %s: %v, want %s", tt.name, dns.TypeToString[tt.qtype], resp, dns.RcodeToString[tt.rcode])
+			continue
+		}
+		var got string
+		switch {
+		case len(resp.Answer) == 1:
+			got = resp.Answer[0].(*dns.PTR).Ptr
+		case len(resp.Ns) == 1:
+			got = resp.Ns[0].Header().Name
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+		if tt.rcode != dns.RcodeServerFailure {
+			local++
+		}
+	}
+	if got := s.Stats()["private_reverse"]; got != int64(local) {
+		t.Errorf("private_reverse = %v, want %d", got, local)
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// rewriter applies the rewrite rules. Before resolution the first rule
+// matching the query name answers it with fixed addresses or sends another
+// name to be resolved in its place; after resolution the first cname rule
+// matching a CNAME target in the answer points that CNAME elsewhere.
+type rewriter struct {
+	rules []*rewriteRule // in configured order
+	ttl   uint32
+}
+
+// rewriteRule is a parsed rewrite rule
+type rewriteRule struct {
+	match    string         // as configured
+	name     string         // exact rules: lower case FQDN
+	suffix   string         // wildcard rules: ".example.com."
+	re       *regexp.Regexp // regex rules, matched without the trailing dot
+	answer   []net.IP
+	redirect string
+	cname    string
+	hits     atomic.Int64
+}
+
+// newRewriter parses the rules, which were checked when the config was
+// loaded, or returns nil if there are none
+func newRewriter(cfg config.RewriteConfig) *rewriter {
+	if len(cfg.Rules) == 0 {
+		return nil
+	}
+	w := &rewriter{ttl: uint32(cfg.TTL.Seconds())}
+	for _, r := range cfg.Rules {
+		rule := &rewriteRule{match: r.Match, redirect: r.Redirect}
+		if r.CNAME != "" {
+			rule.cname = dns.Fqdn(strings.ToLower(r.CNAME))
+		}
+		for _, a := range r.Answer {
+			rule.answer = append(rule.answer, net.ParseIP(a))
+		}
+		switch pattern, ok := config.RewritePattern(r.Match); {
+		case ok:
+			rule.re = regexp.MustCompile(pattern)
+		case strings.HasPrefix(r.Match, "*."):
+			rule.suffix = dns.Fqdn(strings.ToLower(r.Match[1:]))
+		default:
+			rule.name = dns.Fqdn(strings.ToLower(r.Match))
+		}
+		w.rules = append(w.rules, rule)
+	}
+	return w
+}
+
+// target returns the name rule maps name, a lower case FQDN, to: its
+// redirect or cname with * replaced by the labels a wildcard matched and
+// $1 and the like by a regex's groups. ok is false if the rule does not
+// match name.
+func (rule *rewriteRule) target(name string) (target string, ok bool) {
+	to := rule.redirect
+	if rule.cname != "" {
+		to = rule.cname
+	}
+	switch {
+	case rule.re != nil:
+		subject := strings.TrimSuffix(name, ".")
+		m := rule.re.FindStringSubmatchIndex(subject)
+		if m == nil {
+			return "", false
+		}
+		to = string(rule.re.ExpandString(nil, to, subject, m))
+	case rule.suffix != "":
+		if len(name) <= len(rule.suffix) || !strings.HasSuffix(name, rule.suffix) {
+			return "", false
+		}
+		to = strings.Replace(to, "*", name[:len(name)-len(rule.suffix)], 1)
+	case name != rule.name:
+		return "", false
+	}
+	return dns.Fqdn(strings.ToLower(to)), true
+}
+
+// apply returns a fixed answer to r, or the query to resolve in its place:
+// r itself unless a redirect applies. It is safe to call on a nil
+// rewriter.
+func (w *rewriter) apply(r *dns.Msg) (resp, fwd *dns.Msg) {
+	if w == nil {
+		return nil, r
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	for _, rule := range w.rules {
+		if rule.cname != "" {
+			continue
+		}
+		target, ok := rule.target(name)
+		if !ok {
+			continue
+		}
+		rule.hits.Add(1)
+		if rule.redirect != "" {
+			fwd = r.Copy()
+			fwd.Question[0].Name = target
+			return nil, fwd
+		}
+
+		resp = new(dns.Msg)
+		resp.SetReply(r)
+		resp.Authoritative = true
+		resp.RecursionAvailable = true
+		for _, ip := range rule.answer {
+			hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: w.ttl}
+			switch v4 := ip.To4(); {
+			case q.Qtype == dns.TypeA && v4 != nil:
+				hdr.Rrtype = dns.TypeA
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: v4})
+			case q.Qtype == dns.TypeAAAA && v4 == nil:
+				hdr.Rrtype = dns.TypeAAAA
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		return resp, nil
+	}
+	return nil, r
+}
+
+// restore answers r with the response to fwd, the query a redirect sent in
+// its place: a CNAME from r's name to fwd's comes first
+func (w *rewriter) restore(r, fwd, resp *dns.Msg) *dns.Msg {
+	if fwd == r {
+		return resp
+	}
+	out := resp.Copy()
+	out.Id, out.Question = r.Id, r.Question
+	out.AuthenticatedData = false // the CNAME is not signed by anyone
+	out.Answer = append([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: w.ttl},
+		Target: fwd.Question[0].Name,
+	}}, out.Answer...)
+	return out
+}
+
+// retarget points the first CNAME in resp whose target a cname rule
+// matches at the rule's name, dropping the records that followed it, and
+// returns that name to be resolved, or "". It is safe to call on a nil
+// rewriter.
+func (w *rewriter) retarget(resp *dns.Msg) string {
+	if w == nil {
+		return ""
+	}
+	for i, rr := range resp.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		for _, rule := range w.rules {
+			if rule.cname == "" {
+				continue
+			}
+			target, ok := rule.target(strings.ToLower(cname.Target))
+			if !ok {
+				continue
+			}
+			rule.hits.Add(1)
+			cname.Target = target
+			resp.Answer = resp.Answer[:i+1]
+			return target
+		}
+	}
+	return ""
+}
+
+// Stats returns the hits of each rule, by its match
+func (w *rewriter) Stats() map[string]int64 {
+	stats := make(map[string]int64, len(w.rules))
+	for _, rule := range w.rules {
+		stats[rule.match] += rule.hits.Load()
+	}
+	return stats
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// cdnAPI answers www.shop.example with a CNAME chain into a CDN, and
+// every other name with one address
+type cdnAPI struct {
+	fakeAPI
+	names []string
+}
+
+func (c *cdnAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	c.names = append(c.names, domain)
+	if domain == "www.shop.example" {
+		return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{
+			{Name: domain, Type: "CNAME", Value: "shop.cdn.example.", TTL: 60},
+			{Name: "shop.cdn.example", Type: "A", Value: "198.51.100.1", TTL: 60},
+		}}, nil
+	}
+	return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{{Name: domain, Type: "A", Value: "203.0.113.9", TTL: 60}}}, nil
+}
+
+func TestRewrite(t *testing.T) {
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true, MaxItems: 100, MaxTTL: time.Hour},
+		Rewrite: config.RewriteConfig{TTL: time.Minute, Rules: []config.RewriteRule{
+			{Match: "api.dev.example.com", Answer: []string{"10.0.0.2"}},
+			{Match: "*.dev.example.com", Answer: []string{"10.0.0.1", "fd00::1"}},
+			{Match: "/dev/", Answer: []string{"10.0.0.3"}}, // shadowed for names under dev.example.com
+			{Match: `/^(.+)\.old\.example$/`, Redirect: "$1.new.example"},
+			{Match: "*.legacy.example", Redirect: "*.modern.example"},
+			{Match: "*.cdn.example", CNAME: "edge.example.net"},
+		}},
+	}
+	api := &cdnAPI{}
+	s, err := New(cfg, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) []string {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+		if resp == nil || resp.Rcode != dns.RcodeSuccess || resp.Question[0].Name != name {
+			t.Fatalf("%s: %v", name, resp)
+		}
+		var rrs []string
+		for _, rr := range resp.Answer {
+			rr.Header().Ttl = 0
+			rrs = append(rrs, rr.String())
+		}
+		return rrs
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		// The first matching rule wins
+		{"api.dev.example.com.", dns.TypeA, []string{"api.dev.example.com.\t0\tIN\tA\t10.0.0.2"}},
+		{"Web.Dev.Example.com.", dns.TypeA, []string{"Web.Dev.Example.com.\t0\tIN\tA\t10.0.0.1"}},
+		{"web.dev.example.com.", dns.TypeAAAA, []string{"web.dev.example.com.\t0\tIN\tAAAA\tfd00::1"}},
+		{"web.dev.example.com.", dns.TypeTXT, nil},
+		{"dev.example.org.", dns.TypeA, []string{"dev.example.org.\t0\tIN\tA\t10.0.0.3"}},
+		// Redirects resolve another name, answered with a CNAME to it
+		{"app.old.example.", dns.TypeA, []string{
+			"app.old.example.\t0\tIN\tCNAME\tapp.new.example.",
+			"app.new.example.\t0\tIN\tA\t203.0.113.9",
+		}},
+		{"a.b.legacy.example.", dns.TypeA, []string{
+			"a.b.legacy.example.\t0\tIN\tCNAME\ta.b.modern.example.",
+			"a.b.modern.example.\t0\tIN\tA\t203.0.113.9",
+		}},
+		// From the cache the second time
+		{"app.old.example.", dns.TypeA, []string{
+			"app.old.example.\t0\tIN\tCNAME\tapp.new.example.",
+			"app.new.example.\t0\tIN\tA\t203.0.113.9",
+		}},
+		// CNAMEs into the CDN are pointed elsewhere
+		{"www.shop.example.", dns.TypeA, []string{
+			"www.shop.example.\t0\tIN\tCNAME\tedge.example.net.",
+			"edge.example.net.\t0\tIN\tA\t203.0.113.9",
+		}},
+		{"legacy.example.", dns.TypeA, []string{"legacy.example.\t0\tIN\tA\t203.0.113.9"}},
+	}
+	for _, tt := range tests {
+		if got := query(tt.name, tt.qtype); !slices.Equal(got, tt.want) {
+			t.Errorf("%s %s: %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+
+	want := []string{"app.new.example", "a.b.modern.example", "www.shop.example", "edge.example.net", "legacy.example"}
+	if !slices.Equal(api.names, want) {
+		t.Errorf("API asked for %v, want %v", api.names, want)
+	}
+	stats, _ := s.Stats()["rewrite"].(map[string]int64)
+	if stats["api.dev.example.com"] != 1 || stats["*.dev.example.com"] != 3 || stats["/dev/"] != 1 || stats[`/^(.+)\.old\.example$/`] != 2 || stats["*.cdn.example"] != 1 {
+		t.Errorf("rewrite stats %v", stats)
+	}
+}
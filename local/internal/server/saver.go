@@ -0,0 +1,128 @@
+package server
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/cache"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// saver is the bandwidth saver mode: while it is on, cached answers stay
+// fresh for longer and are then served stale instead of being resolved
+// again, and popular entries are not prefetched. It turns on during the
+// configured hours and once the day's API requests near the quota.
+type saver struct {
+	cfg     config.BandwidthSaverConfig
+	windows [][2]time.Duration // from and to, as offsets into the day
+	now     func() time.Time
+	logger  *slog.Logger
+
+	mu       sync.Mutex
+	day      int // of the year, for the request count
+	requests int64
+	reason   string // why the saver is on; empty when off
+}
+
+// newSaver returns nil when the bandwidth saver is disabled
+func newSaver(cfg config.BandwidthSaverConfig, logger *slog.Logger) *saver {
+	if !cfg.Enabled {
+		return nil
+	}
+	s := &saver{cfg: cfg, now: time.Now, logger: logger}
+	for _, window := range cfg.Hours {
+		from, to, _ := strings.Cut(window, "-")
+		s.windows = append(s.windows, [2]time.Duration{clock(from), clock(to)})
+	}
+	return s
+}
+
+// clock returns an HH:MM time as an offset into the day; config
+// validation has checked its format
+func clock(hhmm string) time.Duration {
+	t, _ := time.Parse("15:04", hhmm)
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+// retain returns how long the cache must keep expired entries, whose TTLs
+// are at most maxTTL, to serve them stretched and stale
+func (s *saver) retain(maxTTL time.Duration) time.Duration {
+	return time.Duration(float64(maxTTL)*(s.cfg.TTLFactor-1)) + s.cfg.MaxStale
+}
+
+// freshness returns how cache lookups are relaxed, and false while the
+// saver is off. It is safe to call on a nil saver.
+func (s *saver) freshness() (cache.Freshness, bool) {
+	if s == nil {
+		return cache.Freshness{}, false
+	}
+	s.mu.Lock()
+	on := s.update(s.now())
+	s.mu.Unlock()
+	return cache.Freshness{Stretch: s.cfg.TTLFactor, Stale: s.cfg.MaxStale}, on
+}
+
+// countRequest counts an API request against the daily quota
+func (s *saver) countRequest() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(s.now())
+	s.requests++
+}
+
+// update starts a new count on a new day and logs the saver turning on
+// or off. Called with mu held.
+func (s *saver) update(now time.Time) bool {
+	if now.YearDay() != s.day {
+		s.day, s.requests = now.YearDay(), 0
+	}
+
+	reason := ""
+	if s.cfg.DailyRequests > 0 && float64(s.requests) >= s.cfg.Threshold*float64(s.cfg.DailyRequests) {
+		reason = "quota"
+	}
+	offset := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	for _, w := range s.windows {
+		if inWindow(offset, w[0], w[1]) {
+			reason = "hours"
+			break
+		}
+	}
+
+	if reason != s.reason {
+		if reason != "" {
+			s.logger.Info("bandwidth saver on", "reason", reason, "requests_today", s.requests)
+		} else {
+			s.logger.Info("bandwidth saver off", "requests_today", s.requests)
+		}
+		s.reason = reason
+	}
+	return reason != ""
+}
+
+// inWindow reports whether offset falls in [from, to), which wraps past
+// midnight when to is earlier than from
+func inWindow(offset, from, to time.Duration) bool {
+	if from <= to {
+		return offset >= from && offset < to
+	}
+	return offset >= from || offset < to
+}
+
+// Stats returns whether the saver is on and the day's API requests
+func (s *saver) Stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(s.now())
+	return map[string]interface{}{
+		"active":         s.reason != "",
+		"reason":         s.reason,
+		"requests_today": s.requests,
+		"daily_requests": s.cfg.DailyRequests,
+	}
+}
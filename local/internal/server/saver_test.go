@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestSaver(t *testing.T) {
+	s := newSaver(config.BandwidthSaverConfig{
+		Enabled:       true,
+		Hours:         []string{"22:00-02:00"},
+		DailyRequests: 10,
+		Threshold:     0.8,
+		TTLFactor:     4,
+		MaxStale:      time.Hour,
+	}, logging.Discard())
+
+	at := func(hhmm string, day int) {
+		s.now = func() time.Time {
+			return time.Date(2026, time.March, day, 0, 0, 0, 0, time.UTC).Add(clock(hhmm))
+		}
+	}
+	on := func() bool {
+		_, ok := s.freshness()
+		return ok
+	}
+
+	tests := []struct {
+		at   string
+		want bool
+	}{
+		{"12:00", false},
+		{"22:00", true},
+		{"23:59", true},
+		{"01:30", true},
+		{"02:00", false},
+	}
+	for _, tt := range tests {
+		at(tt.at, 2)
+		if got := on(); got != tt.want {
+			t.Errorf("at %s: on = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+
+	// Outside the hours, the saver turns on at 80% of the quota, until
+	// the count starts over the next day
+	at("12:00", 2)
+	for i := 0; i < 7; i++ {
+		s.countRequest()
+	}
+	if on() {
+		t.Error("on after 7 of 10 requests")
+	}
+	s.countRequest()
+	if !on() {
+		t.Error("off after 8 of 10 requests")
+	}
+	if got := s.Stats()["reason"]; got != "quota" {
+		t.Errorf("reason = %v", got)
+	}
+	at("12:00", 3)
+	if on() {
+		t.Error("still on the next day")
+	}
+
+	if f, _ := s.freshness(); f.Stretch != 4 || f.Stale != time.Hour {
+		t.Errorf("freshness = %+v", f)
+	}
+	if got := s.retain(time.Hour); got != 4*time.Hour {
+		t.Errorf("retain = %v, want 4h", got)
+	}
+}
@@ -3,115 +3,333 @@ package server
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 
+	"github.com/mahdi/dns-proxy-local/internal/anomaly"
 	"github.com/mahdi/dns-proxy-local/internal/cache"
 	"github.com/mahdi/dns-proxy-local/internal/client"
 	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/dnstap"
+	"github.com/mahdi/dns-proxy-local/internal/errcode"
+	"github.com/mahdi/dns-proxy-local/internal/hosts"
+	"github.com/mahdi/dns-proxy-local/internal/obfuscation"
+	"github.com/mahdi/dns-proxy-local/internal/pcap"
+	"github.com/mahdi/dns-proxy-local/internal/querylog"
+	"github.com/mahdi/dns-proxy-local/internal/recorder"
+	"github.com/mahdi/dns-proxy-local/internal/report"
+	"github.com/mahdi/dns-proxy-local/internal/systemd"
 )
 
+// APIClient resolves queries through the remote API: a *client.Client in
+// production, or a recording when replaying traffic
+type APIClient interface {
+	Resolve(ctx context.Context, domain string, recordType string) (*client.ResolveResponse, error)
+	Stats() map[string]interface{}
+}
+
 // Server represents the local DNS server
 type Server struct {
-	cfg       *config.Config
-	udpServer *dns.Server
-	tcpServer *dns.Server
-	apiClient *client.Client
-	cache     *cache.Cache
-	logger    *log.Logger
+	cfg        *config.Config
+	servers    []*dns.Server
+	active     atomic.Pointer[profile] // endpoints and rules queries are answered with
+	newClient  func(*config.Config) (APIClient, error)
+	switchMu   sync.Mutex              // serializes profile switches
+	discovered []config.EndpointConfig // endpoints added to the active profile by discovery, guarded by switchMu
+	recorder   *recorder.Recorder
+	cache      atomic.Pointer[cache.Cache] // nil when caching is disabled
+	cacheCfg   config.CacheConfig          // settings the cache was built with
+	reload     func() (*config.Config, error)
+	reloadMu   sync.Mutex // serializes reloads
+	queryLog   *querylog.Logger
+	tap        *dnstap.Writer
+	pcap       *pcap.Writer
+	anomaly    *anomaly.Detector
+	validator  *anomaly.Validator
+	shaper     *obfuscation.Shaper
+	limits     *limiter // nil unless server concurrency limits are set
+	report     *report.Reporter
+	rotation   atomic.Uint32   // answer rotation counter
+	fallbacks  atomic.Int64    // queries answered outside the tunnel
+	allowed    []*net.IPNet    // client networks; empty allows all
+	refused    atomic.Int64    // queries refused by allowed_networks
+	cacheOnly  []*net.IPNet    // client networks answered only from the cache
+	cacheMiss  atomic.Int64    // cache-only clients' queries refused on a cache miss
+	dns64      *dns64          // nil unless dns64 is enabled
+	local      *localAnswers   // nil when local_answers is disabled
+	reverse    *privateReverse // nil unless private_reverse is enabled
+	special    *specialUse     // nil when special_use is disabled
+	policy     *queryPolicy    // nil unless query_policy sets something
+	rewrite    *rewriter       // nil without rewrite rules
+	hosts      *hostsAnswers   // nil without hosts files
+	saver      *saver          // nil unless bandwidth_saver is enabled
+	mdns       *advertiser     // nil unless mdns is enabled
+	quit       chan struct{}   // closed by Stop
+	quitOnce   sync.Once
+	logger     *slog.Logger
 }
 
-// New creates a new DNS server
-func New(cfg *config.Config, apiClient *client.Client) *Server {
-	logger := log.New(os.Stdout, "[DNS-LOCAL] ", log.LstdFlags|log.Lshortfile)
+// New creates a new DNS server. apiClient serves the profile selected by
+// cfg.Profile.
+func New(cfg *config.Config, apiClient APIClient, logger *slog.Logger) (*Server, error) {
+	active, err := cfg.WithProfile(cfg.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := parseNetworks(cfg.Server.AllowedNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed_networks: %w", err)
+	}
+	cacheOnly, err := parseNetworks(cfg.Server.CacheOnly)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache_only_networks: %w", err)
+	}
+	synth, err := newDNS64(cfg.DNS64)
+	if err != nil {
+		return nil, err
+	}
+
+	queryLog, err := querylog.New(cfg.QueryLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create query log: %w", err)
+	}
+
+	tap, err := dnstap.New(cfg.Dnstap, logger.With("component", "dnstap"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dnstap writer: %w", err)
+	}
+
+	capture, err := pcap.New(cfg.Pcap)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := recorder.New(cfg.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	mdns, err := newAdvertiser(cfg.MDNS, cfg.Server, logger.With("component", "mdns"))
+	if err != nil {
+		return nil, err
+	}
 
-	var dnsCache *cache.Cache
-	if cfg.Cache.Enabled {
-		dnsCache = cache.New(
-			cfg.Cache.MaxItems,
-			cfg.Cache.DefaultTTL,
-			cfg.Cache.MinTTL,
-			cfg.Cache.MaxTTL,
-		)
+	table, err := hosts.New(cfg.Hosts, logger.With("component", "hosts"))
+	if err != nil {
+		return nil, err
 	}
 
-	return &Server{
+	s := &Server{
 		cfg:       cfg,
-		apiClient: apiClient,
-		cache:     dnsCache,
+		cacheCfg:  cfg.Cache,
+		queryLog:  queryLog,
+		tap:       tap,
+		pcap:      capture,
+		recorder:  rec,
+		anomaly:   anomaly.New(cfg.Anomaly, logger.With("component", "anomaly")),
+		validator: anomaly.NewValidator(cfg.QueryValidation, logger.With("component", "validation")),
+		limits:    newLimiter(cfg.Server),
+		allowed:   allowed,
+		cacheOnly: cacheOnly,
+		dns64:     synth,
+		local:     newLocalAnswers(cfg.LocalAnswers, cfg.Server.Addresses()),
+		reverse:   newPrivateReverse(cfg.PrivateReverse),
+		special:   newSpecialUse(cfg.SpecialUse),
+		policy:    newQueryPolicy(cfg.QueryPolicy),
+		rewrite:   newRewriter(cfg.Rewrite),
+		hosts:     newHostsAnswers(cfg.Hosts, table),
+		saver:     newSaver(cfg.BandwidthSaver, logger.With("component", "bandwidth_saver")),
+		mdns:      mdns,
+		quit:      make(chan struct{}),
 		logger:    logger,
 	}
+	s.active.Store(newProfile(cfg.Profile, active, apiClient))
+
+	// Decoys go straight to the API: they must not fill the cache or logs
+	s.shaper = obfuscation.New(cfg.Obfuscation, func(ctx context.Context, domain, recordType string) error {
+		ctx, cancel := context.WithTimeout(client.WithPriority(ctx, client.PriorityBackground), cfg.API.Timeout)
+		defer cancel()
+		_, err := s.active.Load().apiClient.Resolve(ctx, domain, recordType)
+		return err
+	}, logger.With("component", "obfuscation"))
+
+	s.report = report.New(cfg.Report, s.Stats, logger.With("component", "report"))
+
+	s.cache.Store(s.newCache(cfg.Cache))
+
+	return s, nil
 }
 
 // Run starts the DNS server and blocks until shutdown
 func (s *Server) Run() error {
-	addr := fmt.Sprintf("%s:%d", s.cfg.Server.ListenAddr, s.cfg.Server.Port)
-
 	// Create DNS handler
 	handler := dns.HandlerFunc(s.handleRequest)
 
 	// Setup graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 3)
 
-	// Start UDP server
-	if s.cfg.Server.Protocol == "udp" || s.cfg.Server.Protocol == "both" {
-		s.udpServer = &dns.Server{
-			Addr:    addr,
-			Net:     "udp",
-			Handler: handler,
+	// Sockets passed by systemd replace the ones we would bind ourselves,
+	// so the service can use port 53 without root or CAP_NET_BIND_SERVICE
+	sockets, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	if sockets != nil {
+		s.logger.Info("using systemd socket activation", "sockets", sockets.Len())
+		if err := s.serveActivated(sockets, handler, errChan); err != nil {
+			return err
 		}
-		go func() {
-			s.logger.Printf("Starting UDP DNS server on %s", addr)
-			if err := s.udpServer.ListenAndServe(); err != nil {
-				errChan <- fmt.Errorf("UDP server error: %w", err)
-			}
-		}()
 	}
 
-	// Start TCP server
-	if s.cfg.Server.Protocol == "tcp" || s.cfg.Server.Protocol == "both" {
-		s.tcpServer = &dns.Server{
-			Addr:    addr,
-			Net:     "tcp",
-			Handler: handler,
+	// Start UDP, TCP and DNS-over-TLS servers on every listen address. With
+	// "::" one socket takes both IPv4 and IPv6 clients.
+	if sockets == nil {
+		for _, host := range s.cfg.Server.Addresses() {
+			if err := s.listen(host, handler, errChan); err != nil {
+				return err
+			}
 		}
-		go func() {
-			s.logger.Printf("Starting TCP DNS server on %s", addr)
-			if err := s.tcpServer.ListenAndServe(); err != nil {
-				errChan <- fmt.Errorf("TCP server error: %w", err)
+	}
+	if s.cfg.Server.DoT.Enabled && sockets != nil && len(sockets.Stream[dotSocketName]) == 0 {
+		for _, host := range s.cfg.Server.Addresses() {
+			if err := s.listenDoT(host, handler, errChan); err != nil {
+				return err
 			}
-		}()
+		}
+	}
+
+	if s.cfg.API.Discovery.Enabled && s.newClient != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go s.discover(done)
+	}
+
+	var admin *http.Server
+	if s.cfg.Admin.Enabled {
+		if admin, err = s.serveAdmin(errChan); err != nil {
+			return err
+		}
 	}
 
-	// Wait for shutdown or error
-	select {
-	case <-stop:
-		s.logger.Println("Shutting down DNS server...")
-	case err := <-errChan:
+	// Advertise the service only once it answers
+	if err := s.mdns.start(); err != nil {
 		return err
 	}
 
+	if err := systemd.Notify("READY=1"); err != nil {
+		s.logger.Warn("systemd notify failed", "error", err)
+	}
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		go s.watchdog(interval)
+	}
+
+	// Wait for shutdown or error, reloading on SIGHUP
+wait:
+	for {
+		select {
+		case <-hup:
+			if err := s.Reload(); err != nil {
+				s.logger.Error("reload failed", "error", err)
+			}
+		case <-stop:
+			s.logger.Info("shutting down DNS server")
+			break wait
+		case <-s.quit:
+			s.logger.Info("shutting down DNS server")
+			break wait
+		case err := <-errChan:
+			return err
+		}
+	}
+
 	// Graceful shutdown
+	systemd.Notify("STOPPING=1")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	if s.udpServer != nil {
-		s.udpServer.ShutdownContext(ctx)
+	s.mdns.close()
+	for _, srv := range s.servers {
+		srv.ShutdownContext(ctx)
+	}
+	if admin != nil {
+		admin.Shutdown(ctx)
+	}
+	s.shaper.Close()
+	s.report.Close()
+	s.queryLog.Close()
+	s.tap.Close()
+	s.pcap.Close()
+	s.hosts.close()
+	s.recorder.Close()
+
+	return nil
+}
+
+// Stop makes Run shut down as it does on SIGTERM, for service managers that
+// don't signal the process (the Windows SCM)
+func (s *Server) Stop() {
+	s.quitOnce.Do(func() { close(s.quit) })
+}
+
+// listen starts the configured protocols' servers on host
+func (s *Server) listen(host string, handler dns.Handler, errChan chan<- error) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(s.cfg.Server.Port))
+
+	if s.cfg.Server.Protocol == "udp" || s.cfg.Server.Protocol == "both" {
+		s.serve(&dns.Server{
+			Addr:    addr,
+			Net:     "udp",
+			Handler: handler,
+		}, errChan, "addr", addr)
+	}
+
+	if s.cfg.Server.Protocol == "tcp" || s.cfg.Server.Protocol == "both" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("TCP server error: %w", err)
+		}
+		if ln, err = wrapProxyProtocol(ln, s.cfg.Server.ProxyProtocol); err != nil {
+			ln.Close()
+			return err
+		}
+		s.serve(&dns.Server{
+			Listener: ln,
+			Net:      "tcp",
+			Handler:  handler,
+		}, errChan, "addr", addr, "proxy_protocol", s.cfg.Server.ProxyProtocol.Enabled)
 	}
-	if s.tcpServer != nil {
-		s.tcpServer.ShutdownContext(ctx)
+
+	if s.cfg.Server.DoT.Enabled {
+		return s.listenDoT(host, handler, errChan)
 	}
+	return nil
+}
 
+// listenDoT starts the DNS-over-TLS server on host
+func (s *Server) listenDoT(host string, handler dns.Handler, errChan chan<- error) error {
+	dotServer, err := newDoTServer(s.cfg, host, handler)
+	if err != nil {
+		return err
+	}
+	s.serve(dotServer, errChan, "addr", dotServer.Addr, "client_auth", s.cfg.Server.DoT.ClientCAFile != "")
 	return nil
 }
 
@@ -121,86 +339,434 @@ func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 	}
 
 	q := r.Question[0]
-	s.logger.Printf("Query: %s %s", q.Name, dns.TypeToString[q.Qtype])
+	start := time.Now()
+	s.logger.Debug("query", "name", q.Name, "type", dns.TypeToString[q.Qtype], "client", w.RemoteAddr().String(), "device", deviceID(w))
+	s.tapClient(dnstap.ClientQuery, w, r, start)
+	s.capture(w, r, false)
+
+	if !s.clientAllowed(w) {
+		s.refused.Add(1)
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+		s.replyCode(w, r, resp, querylog.SourceDenied, errcode.BlockedPolicy, start)
+		return
+	}
+
+	switch refuse, drop := s.policy.check(q.Qtype); {
+	case drop:
+		// No answer at all; the log records it without an rcode
+		s.logQuery(w, q, -1, querylog.SourceDropped, errcode.BlockedPolicy, start)
+		return
+	case refuse:
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+		s.replyCode(w, r, resp, querylog.SourceDenied, errcode.BlockedPolicy, start)
+		return
+	}
 
-	// Check cache
-	if s.cache != nil {
-		cacheKey := cache.Key(q)
-		if cached, ok := s.cache.Get(cacheKey); ok {
+	// Localhost and this host's names are answered before any limit, cache
+	// or tunnel, so they work even with no connectivity
+	if resp := s.local.answer(r); resp != nil {
+		s.reply(w, r, resp, querylog.SourceLocal, start)
+		return
+	}
+
+	// Hosts files come next, with the reverse lookups of their addresses;
+	// the names ad-block lists point at the null address are logged as
+	// blocked
+	if resp, blocked := s.hosts.answer(r); resp != nil {
+		source := querylog.SourceLocal
+		if blocked {
+			source = querylog.SourceBlocked
+		}
+		s.reply(w, r, resp, source, start)
+		return
+	}
+
+	// Rewrite rules answer with fixed addresses, or redirect the query to
+	// another name that is resolved (and cached) in its place
+	resp, fwd := s.rewrite.apply(r)
+	if resp != nil {
+		s.reply(w, r, resp, querylog.SourceRewrite, start)
+		return
+	}
+
+	// Private reverse lookups and special-use names must not leave the LAN;
+	// those given above, such as nas.home.arpa in /etc/hosts, already have
+	// their answer
+	if resp := s.reverse.answer(fwd); resp != nil {
+		s.reply(w, r, s.rewrite.restore(r, fwd, resp), querylog.SourceLocal, start)
+		return
+	}
+	if resp := s.special.answer(fwd); resp != nil {
+		s.reply(w, r, s.rewrite.restore(r, fwd, resp), querylog.SourceLocal, start)
+		return
+	}
+
+	key := clientKey(w)
+	if !s.limits.enter(key) {
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+		s.replyCode(w, r, resp, querylog.SourceThrottled, errcode.RateLimited, start)
+		return
+	}
+	defer s.limits.leave(key)
+
+	// Invalid names are stopped before they count toward a client's pattern
+	if _, reject := s.validator.Check(key, q.Name); reject {
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+		s.replyCode(w, r, resp, querylog.SourceInvalid, errcode.BlockedPolicy, start)
+		return
+	}
+
+	if s.anomaly.Observe(key, q.Name) {
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+		s.replyCode(w, r, resp, querylog.SourceThrottled, errcode.RateLimited, start)
+		return
+	}
+
+	// Check cache. Cache-only clients are refused what trusted clients
+	// haven't resolved. Queries with checking disabled or without recursion
+	// ask for different answers than the cache holds, so they bypass it.
+	cacheOnly := s.cacheOnlyClient(w)
+	flags := queryFlags(r)
+	dnsCache := s.cache.Load()
+	if flags.CheckingDisabled || flags.NoRecursion {
+		dnsCache = nil
+	}
+	if dnsCache != nil {
+		if cached, ok := s.cacheGet(dnsCache, fwd.Question[0], cacheOnly); ok {
 			cached.Id = r.Id
-			w.WriteMsg(cached)
-			s.logger.Printf("Cache hit: %s", q.Name)
+			s.logger.Debug("cache hit", "name", q.Name)
+			s.reply(w, r, s.rewrite.restore(r, fwd, s.synthesizeAAAA(w, fwd, cached, cacheOnly, false)), querylog.SourceCache, start)
 			return
 		}
 	}
+	if cacheOnly {
+		s.cacheMiss.Add(1)
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+		s.replyCode(w, r, resp, querylog.SourceCacheOnly, errcode.BlockedPolicy, start)
+		return
+	}
 
-	// Resolve via API
-	resp, err := s.resolveViaAPI(r)
+	// Resolve via API, if a slot is free
+	if !s.limits.acquire() {
+		resp := new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeServerFailure)
+		s.replyCode(w, r, resp, querylog.SourceThrottled, errcode.RateLimited, start)
+		return
+	}
+	defer s.limits.release()
+
+	p := s.active.Load()
+	ctx := client.WithFlags(context.Background(), flags)
+	resp, negTTL, err := s.resolveViaAPI(ctx, p, fwd)
+	if err == nil {
+		// A cname rule sends the rest of the chain to another name
+		if target := s.rewrite.retarget(resp); target != "" {
+			resp, negTTL, err = s.followCNAME(ctx, p, fwd, resp, target)
+		}
+	}
+	if err != nil && p.fallback.Enabled && fallbackAllowed(err) {
+		var fbErr error
+		if resp, fbErr = s.resolveDirect(p.fallback, fwd); fbErr == nil {
+			s.reply(w, r, s.rewrite.restore(r, fwd, resp), querylog.SourceFallback, start)
+			return
+		}
+		err = fmt.Errorf("%w; %v", err, fbErr)
+	}
 	if err != nil {
-		s.logger.Printf("Resolution failed: %v", err)
-		s.writeError(w, r, dns.RcodeServerFailure)
+		s.logger.Warn("resolution failed", "name", q.Name, "code", errcode.Of(err), "error", err)
+		s.writeError(w, r, err, start)
 		return
 	}
 
 	// Cache response
-	if s.cache != nil && len(resp.Answer) > 0 {
-		cacheKey := cache.Key(q)
-		s.cache.Set(cacheKey, resp)
+	if dnsCache != nil {
+		cacheAnswer(dnsCache, fwd.Question[0], resp, negTTL)
+	}
+
+	s.reply(w, r, s.rewrite.restore(r, fwd, s.synthesizeAAAA(w, fwd, resp, false, true)), querylog.SourceAPI, start)
+}
+
+// followCNAME resolves target, the new end of resp's CNAME chain set by a
+// cname rule, and appends its records to resp
+func (s *Server) followCNAME(ctx context.Context, p *profile, r, resp *dns.Msg, target string) (*dns.Msg, time.Duration, error) {
+	req := r.Copy()
+	req.Question[0].Name = target
+	next, negTTL, err := s.resolveViaAPI(ctx, p, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp.Answer = append(resp.Answer, next.Answer...)
+	resp.Ns, resp.Rcode = next.Ns, next.Rcode
+	// The rewritten chain is not the validated one
+	resp.AuthenticatedData = false
+	return resp, negTTL, nil
+}
+
+// cacheGet looks q up in the cache. Cache-only clients must not cause API
+// requests, not even a prefetch; in bandwidth saver mode nobody prefetches,
+// and entries are served stretched and stale.
+func (s *Server) cacheGet(c *cache.Cache, q dns.Question, cacheOnly bool) (*dns.Msg, bool) {
+	if f, ok := s.saver.freshness(); ok {
+		return c.Lookup(cache.Key(q), f)
+	}
+	if cacheOnly {
+		return c.Peek(cache.Key(q))
+	}
+	return c.Get(cache.Key(q))
+}
+
+// cacheAnswer stores an answer from the API. Answers without records are
+// only cached when the remote passed on the zone's negative TTL.
+func cacheAnswer(c *cache.Cache, q dns.Question, resp *dns.Msg, negTTL time.Duration) {
+	switch {
+	case len(resp.Answer) > 0:
+		c.Set(cache.Key(q), resp)
+	case negTTL > 0:
+		c.SetNegative(cache.Key(q), resp, negTTL)
+	}
+}
+
+// queryFlags returns the header bits of r that are passed on to the remote.
+// A DO bit asks for the AD bit like AD itself does (RFC 6840).
+func queryFlags(r *dns.Msg) client.Flags {
+	f := client.Flags{
+		CheckingDisabled:  r.CheckingDisabled,
+		AuthenticatedData: r.AuthenticatedData,
+		NoRecursion:       !r.RecursionDesired,
+	}
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		f.AuthenticatedData = true
+	}
+	return f
+}
+
+// prefetch refreshes a popular cache entry in the background
+func (s *Server) prefetch(q dns.Question) {
+	r := new(dns.Msg)
+	r.SetQuestion(q.Name, q.Qtype)
+
+	resp, negTTL, err := s.resolveViaAPI(client.WithPriority(context.Background(), client.PriorityBackground), s.active.Load(), r)
+	if err != nil {
+		s.logger.Debug("prefetch failed", "name", q.Name, "error", err)
+		return
+	}
+	if dnsCache := s.cache.Load(); dnsCache != nil {
+		cacheAnswer(dnsCache, q, resp, negTTL)
+	}
+}
+
+// clientKey identifies the client for per-client tracking: the device
+// certificate when present, otherwise the source IP
+func clientKey(w dns.ResponseWriter) string {
+	if device := deviceID(w); device != "" {
+		return device
+	}
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return w.RemoteAddr().String()
 	}
+	return host
+}
 
+// reply writes resp to the client and records it in the query log and dnstap
+func (s *Server) reply(w dns.ResponseWriter, r, resp *dns.Msg, source querylog.Source, start time.Time) {
+	s.replyCode(w, r, resp, source, "", start)
+}
+
+// replyCode is reply for a failed query: a non-empty code is counted, logged
+// and sent to EDNS clients as an Extended DNS Error
+func (s *Server) replyCode(w dns.ResponseWriter, r, resp *dns.Msg, source querylog.Source, code errcode.Code, start time.Time) {
+	s.postProcess(r, resp)
+	if code != "" {
+		errcode.Count(code)
+		addEDE(resp, code)
+	}
+	s.truncateUDP(w, r, resp)
 	w.WriteMsg(resp)
+	s.logQuery(w, r.Question[0], resp.Rcode, source, code, start)
+	s.tapClient(dnstap.ClientResponse, w, resp, start)
+	s.capture(w, resp, true)
+}
+
+func (s *Server) logQuery(w dns.ResponseWriter, q dns.Question, rcode int, source querylog.Source, code errcode.Code, start time.Time) {
+	s.report.Observe(q.Name, source)
+	s.queryLog.Log(querylog.Entry{
+		Time:      start,
+		Client:    w.RemoteAddr().String(),
+		Device:    deviceID(w),
+		QName:     q.Name,
+		QType:     dns.TypeToString[q.Qtype],
+		Rcode:     dns.RcodeToString[rcode],
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		Source:    source,
+		Code:      string(code),
+	})
+}
+
+// resolveViaAPI resolves r through the profile's API client. negTTL is how
+// long an answer without records may be cached, as passed on by the remote.
+func (s *Server) resolveViaAPI(ctx context.Context, p *profile, r *dns.Msg) (resp *dns.Msg, negTTL time.Duration, err error) {
+	sibling := s.pairedType(r)
+	resp, negTTL, err = s.resolveTypes(ctx, p, r, sibling)
+	if sibling != 0 && err == nil && resp.Rcode == dns.RcodeSuccess && negTTL == 0 && !hasType(resp.Answer, r.Question[0].Qtype) {
+		// Without a negative TTL for it, the queried type may have failed
+		// on the remote while the other one was answered
+		return s.resolveTypes(ctx, p, r, 0)
+	}
+	return resp, negTTL, err
 }
 
-func (s *Server) resolveViaAPI(r *dns.Msg) (*dns.Msg, error) {
+// resolveTypes is resolveViaAPI, asking for the sibling address type in
+// the same request unless it is 0
+func (s *Server) resolveTypes(ctx context.Context, p *profile, r *dns.Msg, sibling uint16) (resp *dns.Msg, negTTL time.Duration, err error) {
 	q := r.Question[0]
 
 	// Map DNS type
 	recordType := dns.TypeToString[q.Qtype]
+	if sibling != 0 {
+		recordType = "A+AAAA"
+	}
 
 	// Call API
-	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.API.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.API.Timeout)
 	defer cancel()
 
-	result, err := s.apiClient.Resolve(ctx, strings.TrimSuffix(q.Name, "."), recordType)
+	queryTime := time.Now()
+	s.tapForwarder(dnstap.ForwarderQuery, r, queryTime)
+
+	if err := s.shaper.Delay(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	domain := s.policy.apiName(q)
+	s.saver.countRequest()
+	result, err := p.apiClient.Resolve(ctx, domain, recordType)
+	s.recorder.Record(domain, recordType, result, err, time.Since(queryTime))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	defer func() { s.tapForwarder(dnstap.ForwarderResponse, resp, queryTime) }()
 
 	// Build DNS response
-	resp := new(dns.Msg)
+	resp = new(dns.Msg)
 	resp.SetReply(r)
 	resp.Authoritative = false
 	resp.RecursionAvailable = true
+	resp.AuthenticatedData = result.AD
+	negTTL = time.Duration(result.NegativeTTL) * time.Second
 
 	if result.Error != "" {
+		// Classified errors are failures of the remote, not answers
+		if result.Code != "" {
+			return nil, 0, errcode.New(result.Code, result.Error)
+		}
 		resp.Rcode = dns.RcodeNameError
-		return resp, nil
+		return resp, negTTL, nil
 	}
 
-	// Convert records to DNS RRs
+	// Convert records to DNS RRs, the CNAME chain first as the remote lists it
+	var siblingAnswer []dns.RR
 	for _, rec := range result.Records {
-		rr, err := s.createRR(rec, q.Name)
+		rr, err := s.createRR(rec, ownerName(rec.Name, q.Name))
 		if err != nil {
-			s.logger.Printf("Failed to create RR: %v", err)
+			s.logger.Warn("failed to create RR", "name", q.Name, "error", err)
+			continue
+		}
+		switch rr.Header().Rrtype {
+		case sibling:
+			siblingAnswer = append(siblingAnswer, rr)
 			continue
+		case dns.TypeCNAME:
+			siblingAnswer = append(siblingAnswer, dns.Copy(rr))
 		}
 		resp.Answer = append(resp.Answer, rr)
 	}
+	resp.Answer = normalizeAnswer(resp.Answer, s.cfg.Response.AnswerOrder == "fixed")
+	if sibling != 0 {
+		s.cacheSibling(r, sibling, resp, siblingAnswer, negTTL)
+	}
+
+	return resp, negTTL, nil
+}
+
+// pairedType returns the other address type when r is an A or AAAA query
+// that cache.pair_addresses resolves together with it, otherwise 0
+func (s *Server) pairedType(r *dns.Msg) uint16 {
+	if !s.cfg.Cache.PairAddresses || s.cache.Load() == nil {
+		return 0
+	}
+	// Such queries bypass the cache, so the other answer would go unused
+	if f := queryFlags(r); f.CheckingDisabled || f.NoRecursion {
+		return 0
+	}
+	switch r.Question[0].Qtype {
+	case dns.TypeA:
+		return dns.TypeAAAA
+	case dns.TypeAAAA:
+		return dns.TypeA
+	}
+	return 0
+}
+
+// cacheSibling caches the answer for the other address type that came
+// along with resp. The remote only passes on a negative TTL for the types
+// that had no records, so a sibling without addresses is only cached when
+// resp has some, which leaves it the one type the TTL can be for;
+// otherwise it may just have failed on the remote.
+func (s *Server) cacheSibling(r *dns.Msg, sibling uint16, resp *dns.Msg, answer []dns.RR, negTTL time.Duration) {
+	dnsCache := s.cache.Load()
+	if dnsCache == nil {
+		return
+	}
+	if !hasType(answer, sibling) && (negTTL == 0 || !hasType(resp.Answer, r.Question[0].Qtype)) {
+		return
+	}
 
-	return resp, nil
+	sr := r.Copy()
+	sr.Question[0].Qtype = sibling
+	sresp := new(dns.Msg)
+	sresp.SetReply(sr)
+	sresp.RecursionAvailable = true
+	sresp.AuthenticatedData = resp.AuthenticatedData
+	sresp.Answer = normalizeAnswer(answer, s.cfg.Response.AnswerOrder == "fixed")
+	cacheAnswer(dnsCache, sr.Question[0], sresp, negTTL)
+}
+
+// hasType reports whether rrs holds a record of type t
+func hasType(rrs []dns.RR, t uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerName returns the owner of a record named name in the answer to
+// qname: qname itself, in the client's spelling, for records of the queried
+// name (and remotes that don't name records), otherwise the name along the
+// CNAME chain
+func ownerName(name, qname string) string {
+	if name == "" || strings.EqualFold(dns.Fqdn(name), qname) {
+		return qname
+	}
+	return dns.Fqdn(name)
 }
 
 func (s *Server) createRR(rec client.DNSRecord, name string) (dns.RR, error) {
 	ttl := rec.TTL
-	if ttl == 0 {
-		ttl = 300
-	}
 
 	switch rec.Type {
 	case "A":
-		ip := net.ParseIP(rec.Value)
+		ip := net.ParseIP(rec.Value).To4()
 		if ip == nil {
-			return nil, fmt.Errorf("invalid IP: %s", rec.Value)
+			return nil, fmt.Errorf("invalid IPv4: %s", rec.Value)
 		}
 		return &dns.A{
 			Hdr: dns.RR_Header{
@@ -209,7 +775,7 @@ func (s *Server) createRR(rec client.DNSRecord, name string) (dns.RR, error) {
 				Class:  dns.ClassINET,
 				Ttl:    ttl,
 			},
-			A: ip.To4(),
+			A: ip,
 		}, nil
 
 	case "AAAA":
@@ -272,24 +838,169 @@ func (s *Server) createRR(rec client.DNSRecord, name string) (dns.RR, error) {
 			Ns: dns.Fqdn(rec.Value),
 		}, nil
 
+	case "PTR":
+		return &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Ptr: dns.Fqdn(rec.Value),
+		}, nil
+
 	default:
 		return nil, fmt.Errorf("unsupported record type: %s", rec.Type)
 	}
 }
 
-func (s *Server) writeError(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+// writeError answers a query that could not be resolved. Queries the remote
+// refused by policy get REFUSED, everything else SERVFAIL.
+func (s *Server) writeError(w dns.ResponseWriter, r *dns.Msg, err error, start time.Time) {
+	code := errcode.Of(err)
+	rcode := dns.RcodeServerFailure
+	if code == errcode.BlockedPolicy {
+		rcode = dns.RcodeRefused
+	}
 	resp := new(dns.Msg)
 	resp.SetRcode(r, rcode)
-	w.WriteMsg(resp)
+	s.replyCode(w, r, resp, querylog.SourceError, code, start)
+}
+
+// tapClient emits a client query/response dnstap event
+func (s *Server) tapClient(typ dnstap.MessageType, w dns.ResponseWriter, msg *dns.Msg, queryTime time.Time) {
+	if s.tap == nil {
+		return
+	}
+	wire, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	m := &dnstap.Message{
+		Type:         typ,
+		Protocol:     dnstap.ProtocolUDP,
+		QueryAddr:    w.RemoteAddr(),
+		ResponseAddr: w.LocalAddr(),
+		QueryTime:    queryTime,
+	}
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		m.Protocol = dnstap.ProtocolTCP
+	}
+	if typ == dnstap.ClientQuery {
+		m.Query = wire
+	} else {
+		m.ResponseTime = time.Now()
+		m.Response = wire
+	}
+	s.tap.Write(m)
+}
+
+// capture writes a sampled client query, or its response, to the pcap file
+func (s *Server) capture(w dns.ResponseWriter, msg *dns.Msg, response bool) {
+	if !s.pcap.Sampled(w.RemoteAddr(), msg.Id) {
+		return
+	}
+	wire, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	src, dst := w.RemoteAddr(), w.LocalAddr()
+	if response {
+		src, dst = dst, src
+	}
+	s.pcap.Write(src, dst, wire, time.Now())
+}
+
+// tapForwarder emits a forwarder query/response dnstap event for the API call
+func (s *Server) tapForwarder(typ dnstap.MessageType, msg *dns.Msg, queryTime time.Time) {
+	if s.tap == nil || msg == nil {
+		return
+	}
+	wire, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	m := &dnstap.Message{
+		Type:      typ,
+		Protocol:  dnstap.ProtocolDoH,
+		QueryTime: queryTime,
+	}
+	if typ == dnstap.ForwarderQuery {
+		m.Query = wire
+	} else {
+		m.ResponseTime = time.Now()
+		m.Response = wire
+	}
+	s.tap.Write(m)
 }
 
 // Stats returns server statistics
 func (s *Server) Stats() map[string]interface{} {
+	p := s.active.Load()
 	stats := map[string]interface{}{
-		"api": s.apiClient.Stats(),
+		"api":     p.apiClient.Stats(),
+		"profile": p.name,
+	}
+	if dnsCache := s.cache.Load(); dnsCache != nil {
+		stats["cache_size"] = dnsCache.Len()
+		stats["cache"] = dnsCache.Stats()
+	}
+	if p.fallback.Enabled {
+		stats["fallback_answers"] = s.fallbacks.Load()
+	}
+	if len(s.allowed) > 0 {
+		stats["refused_clients"] = s.refused.Load()
+	}
+	if len(s.cacheOnly) > 0 {
+		stats["cache_only_refused"] = s.cacheMiss.Load()
+	}
+	if s.dns64 != nil {
+		stats["dns64_synthesized"] = s.dns64.synthesized.Load()
+	}
+	if s.saver != nil {
+		stats["bandwidth_saver"] = s.saver.Stats()
+	}
+	if s.anomaly != nil {
+		stats["anomaly"] = s.anomaly.Stats()
+	}
+	if s.limits != nil {
+		stats["limits"] = s.limits.Stats()
+	}
+	if s.validator != nil {
+		stats["query_validation"] = s.validator.Stats()
+	}
+	if s.tap != nil {
+		stats["dnstap"] = s.tap.Stats()
+	}
+	if s.pcap != nil {
+		stats["pcap"] = s.pcap.Stats()
+	}
+	if s.reverse != nil {
+		stats["private_reverse"] = s.reverse.answered.Load()
+	}
+	if s.special != nil {
+		stats["special_use"] = s.special.answered.Load()
+	}
+	if s.policy != nil {
+		stats["query_policy"] = s.policy.Stats()
+	}
+	if s.rewrite != nil {
+		stats["rewrite"] = s.rewrite.Stats()
+	}
+	if s.hosts != nil {
+		stats["hosts"] = s.hosts.Stats()
+	}
+	if s.local != nil {
+		stats["local_answers"] = s.local.answered.Load()
+	}
+	if s.cfg.API.Discovery.Enabled {
+		stats["discovered_endpoints"] = s.discoveredCount()
 	}
-	if s.cache != nil {
-		stats["cache_size"] = s.cache.Len()
+	if s.shaper != nil {
+		stats["obfuscation"] = s.shaper.Stats()
 	}
+	stats["errors"] = errcode.Stats()
 	return stats
 }
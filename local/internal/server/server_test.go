@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/client"
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+// negativeAPI answers like a remote passing on negative TTLs: names under
+// missing. do not exist, others have no records of any type
+type negativeAPI struct {
+	calls  int
+	negTTL uint32
+}
+
+func (n *negativeAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	n.calls++
+	if domain == "missing.example" {
+		return &client.ResolveResponse{Domain: domain, Error: "lookup missing.example: no such host", NegativeTTL: n.negTTL}, nil
+	}
+	return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{}, NegativeTTL: n.negTTL}, nil
+}
+
+func (n *negativeAPI) Stats() map[string]interface{} { return nil }
+
+func TestNegativeCaching(t *testing.T) {
+	for _, negTTL := range []uint32{0, 120} {
+		cfg := &config.Config{Cache: config.CacheConfig{Enabled: true, MaxItems: 100, MaxTTL: time.Hour, NegativeTTL: time.Minute}}
+		api := &negativeAPI{negTTL: negTTL}
+		s, err := New(cfg, api, logging.Discard())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			name  string
+			rcode int
+		}{
+			{"missing.example.", dns.RcodeNameError},
+			{"empty.example.", dns.RcodeSuccess},
+		} {
+			api.calls = 0
+			for i := 0; i < 2; i++ {
+				r := new(dns.Msg)
+				r.SetQuestion(tt.name, dns.TypeA)
+				if resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); resp.Rcode != tt.rcode || len(resp.Answer) != 0 {
+					t.Errorf("%s: unexpected response %v", tt.name, resp)
+				}
+			}
+			// Cached only when the remote says for how long
+			want := 2
+			if negTTL > 0 {
+				want = 1
+			}
+			if api.calls != want {
+				t.Errorf("negative TTL %d, %s: %d API calls, want %d", negTTL, tt.name, api.calls, want)
+			}
+		}
+	}
+}
+
+// chainAPI answers with a CNAME chain ending in two addresses
+type chainAPI struct{}
+
+func (chainAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{
+		{Name: domain, Type: "CNAME", Value: "edge.cdn.example.", TTL: 300},
+		{Name: "edge.cdn.example", Type: "CNAME", Value: "pop1.cdn.example.", TTL: 60},
+		{Name: "pop1.cdn.example", Type: "A", Value: "192.0.2.1", TTL: 20},
+		{Name: "pop1.cdn.example", Type: "A", Value: "192.0.2.2", TTL: 20},
+	}}, nil
+}
+
+func (chainAPI) Stats() map[string]interface{} { return nil }
+
+func TestCNAMEChain(t *testing.T) {
+	s, err := New(&config.Config{}, chainAPI{}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("WWW.example.", dns.TypeA)
+	resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	want := []string{
+		"WWW.example.\t300\tIN\tCNAME\tedge.cdn.example.",
+		"edge.cdn.example.\t60\tIN\tCNAME\tpop1.cdn.example.",
+		"pop1.cdn.example.\t20\tIN\tA\t192.0.2.1",
+		"pop1.cdn.example.\t20\tIN\tA\t192.0.2.2",
+	}
+	if len(resp.Answer) != len(want) {
+		t.Fatalf("answer %v", resp.Answer)
+	}
+	for i, rr := range resp.Answer {
+		if rr.String() != want[i] {
+			t.Errorf("answer %d = %q, want %q", i, rr.String(), want[i])
+		}
+	}
+}
+
+// validatingAPI answers every name with a validated address
+type validatingAPI struct {
+	fakeAPI
+	calls int
+}
+
+func (v *validatingAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	v.calls++
+	return &client.ResolveResponse{Domain: domain, Records: []client.DNSRecord{{Name: domain, Type: "A", Value: "192.0.2.1", TTL: 60}}, AD: true}, nil
+}
+
+func TestQueryFlags(t *testing.T) {
+	api := &validatingAPI{}
+	cfg := &config.Config{Cache: config.CacheConfig{Enabled: true, MaxItems: 100, MaxTTL: time.Hour}}
+	s, err := New(cfg, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	tests := []struct {
+		name   string
+		set    func(r *dns.Msg)
+		ad     bool
+		cached bool // answered without asking the API
+	}{
+		{"plain", func(r *dns.Msg) {}, false, false},
+		{"ad", func(r *dns.Msg) { r.AuthenticatedData = true }, true, true},
+		{"do", func(r *dns.Msg) { r.SetEdns0(1232, true) }, true, true},
+		{"cd", func(r *dns.Msg) { r.CheckingDisabled = true; r.AuthenticatedData = true }, true, false},
+		{"no_rd", func(r *dns.Msg) { r.RecursionDesired = false }, false, false},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("signed.example.", dns.TypeA)
+		tt.set(r)
+		calls := api.calls
+		resp := s.Exchange(r, addr)
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("%s: %v", tt.name, resp)
+		}
+		if resp.AuthenticatedData != tt.ad {
+			t.Errorf("%s: AD = %v, want %v", tt.name, resp.AuthenticatedData, tt.ad)
+		}
+		if cached := api.calls == calls; cached != tt.cached {
+			t.Errorf("%s: answered from cache %v, want %v", tt.name, cached, tt.cached)
+		}
+		if resp.CheckingDisabled != r.CheckingDisabled || resp.RecursionDesired != r.RecursionDesired {
+			t.Errorf("%s: CD/RD not echoed: %v", tt.name, resp.MsgHdr)
+		}
+	}
+}
+
+// dualAPI answers A+AAAA requests like a remote merging the types:
+// dual.example has both, v4.example only A, and flaky.example's A lookup
+// fails on the remote unless asked for alone
+type dualAPI struct {
+	fakeAPI
+	types []string
+}
+
+func (d *dualAPI) Resolve(ctx context.Context, domain, recordType string) (*client.ResolveResponse, error) {
+	d.types = append(d.types, recordType)
+	a := client.DNSRecord{Name: domain, Type: "A", Value: "192.0.2.1", TTL: 60}
+	aaaa := client.DNSRecord{Name: domain, Type: "AAAA", Value: "2001:db8::1", TTL: 60}
+	resp := &client.ResolveResponse{Domain: domain}
+	switch {
+	case domain == "dual.example":
+		resp.Records = []client.DNSRecord{a, aaaa}
+	case domain == "v4.example":
+		resp.Records, resp.NegativeTTL = []client.DNSRecord{a}, 300
+	case recordType == "A":
+		resp.Records = []client.DNSRecord{a}
+	default:
+		resp.Records = []client.DNSRecord{aaaa}
+	}
+	return resp, nil
+}
+
+func TestPairAddresses(t *testing.T) {
+	api := &dualAPI{}
+	cfg := &config.Config{Cache: config.CacheConfig{Enabled: true, MaxItems: 100, MaxTTL: time.Hour, NegativeTTL: time.Minute, PairAddresses: true}}
+	s, err := New(cfg, api, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if resp == nil || resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s %s: %v", name, dns.TypeToString[qtype], resp)
+		}
+		return resp
+	}
+
+	// One request answers both types
+	if resp := query("dual.example.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("A answer %v", resp.Answer)
+	}
+	if resp := query("dual.example.", dns.TypeAAAA); len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeAAAA {
+		t.Errorf("AAAA answer %v", resp.Answer)
+	}
+	// and the type without records is cached as no data
+	query("v4.example.", dns.TypeA)
+	if resp := query("v4.example.", dns.TypeAAAA); len(resp.Answer) != 0 {
+		t.Errorf("v4-only AAAA answer %v", resp.Answer)
+	}
+	if want := []string{"A+AAAA", "A+AAAA"}; !slices.Equal(api.types, want) {
+		t.Errorf("requests %v, want %v", api.types, want)
+	}
+
+	// Without a negative TTL an empty answer for the queried type is asked
+	// for again on its own
+	api.types = nil
+	if resp := query("flaky.example.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("flaky A answer %v", resp.Answer)
+	}
+	if want := []string{"A+AAAA", "A"}; !slices.Equal(api.types, want) {
+		t.Errorf("requests %v, want %v", api.types, want)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+// specialUseDomains are the special-use names (RFC 6761 and later) no
+// public resolver can answer: local (multicast DNS, RFC 6762), invalid,
+// test, onion (RFC 7686), home.arpa (RFC 8375), alt (RFC 9476) and
+// internal, reserved for private use. localhost is one too, answered by
+// localAnswers.
+var specialUseDomains = []string{"local", "invalid", "test", "onion", "home.arpa", "alt", "internal"}
+
+// specialUse answers names under the special-use domains NXDOMAIN, so
+// they never reach the tunnel
+type specialUse struct {
+	zones    map[string]bool // FQDNs, lower case
+	ttl      uint32
+	answered atomic.Int64
+}
+
+// newSpecialUse returns the special-use zones with the configured ones
+// added, or nil if they are disabled
+func newSpecialUse(cfg config.SpecialUseConfig) *specialUse {
+	if cfg.Disabled {
+		return nil
+	}
+	u := &specialUse{
+		zones: make(map[string]bool),
+		ttl:   uint32(cfg.TTL.Seconds()),
+	}
+	for _, d := range append(append([]string(nil), specialUseDomains...), cfg.Domains...) {
+		u.zones[dns.Fqdn(strings.ToLower(strings.TrimPrefix(d, ".")))] = true
+	}
+	return u
+}
+
+// answer returns NXDOMAIN for r if its name is under a special-use domain,
+// or nil. It is safe to call on a nil specialUse.
+func (u *specialUse) answer(r *dns.Msg) *dns.Msg {
+	if u == nil {
+		return nil
+	}
+	zone := u.zone(strings.ToLower(r.Question[0].Name))
+	if zone == "" {
+		return nil
+	}
+	u.answered.Add(1)
+	resp := new(dns.Msg)
+	resp.SetRcode(r, dns.RcodeNameError)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Ns = []dns.RR{localSOA(zone, u.ttl)}
+	return resp
+}
+
+// localSOA is the SOA of a zone answered locally, which lets clients cache
+// its negative answers for ttl (RFC 2308)
+func localSOA(zone string, ttl uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  ttl,
+	}
+}
+
+// zone returns the special-use domain name is in, or ""
+func (u *specialUse) zone(name string) string {
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if u.zones[name[i:]] {
+			return name[i:]
+		}
+	}
+	return ""
+}
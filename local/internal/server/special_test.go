@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/logging"
+)
+
+func TestSpecialUse(t *testing.T) {
+	cfg := &config.Config{SpecialUse: config.SpecialUseConfig{Domains: []string{".LAN"}, TTL: time.Minute}}
+	s, err := New(cfg, &downAPI{}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		zone string // SOA owner of the NXDOMAIN; empty for names sent to the tunnel
+	}{
+		{"printer.local.", "local."},
+		{"local.", "local."},
+		{"foo.invalid.", "invalid."},
+		{"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.ONION.", "onion."},
+		{"router.home.arpa.", "home.arpa."},
+		{"nas.lan.", "lan."},
+		{"localhost.", ""}, // answered by local_answers instead
+		{"arpa.", ""},
+		{"local.example.com.", ""},
+		{"example.onion.example.", ""},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		resp := s.Exchange(r, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+		if tt.zone == "" {
+			if resp == nil || resp.Rcode == dns.RcodeNameError {
+				t.Errorf("%s answered as special-use: %v", tt.name, resp)
+			}
+			continue
+		}
+		if resp == nil || resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 || resp.Ns[0].Header().Name != tt.zone {
+			t.Errorf("%s: %v, want NXDOMAIN with the SOA of %s", tt.name, resp, tt.zone)
+		}
+	}
+	if got := s.Stats()["special_use"]; got != int64(6) {
+		t.Errorf("special_use = %v, want 6", got)
+	}
+
+	if newSpecialUse(config.SpecialUseConfig{Disabled: true}) != nil {
+		t.Error("disabled special-use zones built")
+	}
+}
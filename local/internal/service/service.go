@@ -0,0 +1,57 @@
+// Package service installs and controls the local server as a boot-time
+// service of the platform's service manager: systemd on Linux, launchd on
+// macOS and the service control manager on Windows.
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Name is the service's name in the service manager
+const Name = "dns-local"
+
+// Install registers the executable running now to start at boot with the
+// config file at configPath. It doesn't start the service.
+func Install(configPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return err
+	}
+	return install(exe, absConfig)
+}
+
+// Start starts the installed service
+func Start() error {
+	return start()
+}
+
+// Stop stops the running service
+func Stop() error {
+	return stop()
+}
+
+// Uninstall stops the service and removes it from the service manager
+func Uninstall() error {
+	return uninstall()
+}
+
+// Managed reports whether the process was started by a service manager
+// that has to be answered, which is only the Windows one: systemd and
+// launchd just run the command and signal it.
+func Managed() bool {
+	return managed()
+}
+
+// Run runs serve under the service manager when Managed. serve must
+// return soon after stop is closed, and should log to logs, the platform
+// event log, when no other output is configured.
+func Run(serve func(stop <-chan struct{}, logs io.Writer) error) error {
+	return run(serve)
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	launchdLabel = "com.github.mahdi." + Name
+	plistPath    = "/Library/LaunchDaemons/" + launchdLabel + ".plist"
+	logPath      = "/Library/Logs/" + Name + ".log" // shown by Console.app
+)
+
+const launchdPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>run</string>
+		<string>-config</string>
+		<string>%s</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+	<key>StandardOutPath</key>
+	<string>%s</string>
+	<key>StandardErrorPath</key>
+	<string>%s</string>
+</dict>
+</plist>
+`
+
+// install writes the launch daemon's property list. launchd loads it at
+// every boot; stdout and stderr go to logPath.
+func install(exe, configPath string) error {
+	plist := fmt.Sprintf(launchdPlist, launchdLabel, escape(exe), escape(configPath), logPath, logPath)
+	if err := os.WriteFile(plistPath, []byte(plist), 0o644); err != nil {
+		return fmt.Errorf("failed to write launch daemon: %w", err)
+	}
+	return launchctl("enable", "system/"+launchdLabel)
+}
+
+func start() error {
+	return launchctl("bootstrap", "system", plistPath)
+}
+
+func stop() error {
+	return launchctl("bootout", "system/"+launchdLabel)
+}
+
+func uninstall() error {
+	stop() // not loaded when already stopped
+	if err := os.Remove(plistPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove launch daemon: %w", err)
+	}
+	return nil
+}
+
+func launchctl(args ...string) error {
+	if out, err := exec.Command("launchctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("launchctl %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// escape makes s safe in a property list string
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func managed() bool { return false }
+
+func run(serve func(stop <-chan struct{}, logs io.Writer) error) error {
+	return serve(nil, nil)
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const systemdUnitPath = "/etc/systemd/system/" + Name + ".service"
+
+const systemdUnit = `[Unit]
+Description=Local DNS Proxy
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s run -config %s
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=always
+RestartSec=5
+WatchdogSec=30
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// install writes the systemd unit and enables it. Logs go to the journal.
+func install(exe, configPath string) error {
+	unit := fmt.Sprintf(systemdUnit, exe, configPath)
+	if err := os.WriteFile(systemdUnitPath, []byte(unit), 0o644); err != nil {
+		return fmt.Errorf("failed to write unit file: %w", err)
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", Name)
+}
+
+func start() error {
+	return systemctl("start", Name)
+}
+
+func stop() error {
+	return systemctl("stop", Name)
+}
+
+func uninstall() error {
+	if err := systemctl("disable", "--now", Name); err != nil {
+		return err
+	}
+	if err := os.Remove(systemdUnitPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove unit file: %w", err)
+	}
+	return systemctl("daemon-reload")
+}
+
+func systemctl(args ...string) error {
+	if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func managed() bool { return false }
+
+func run(serve func(stop <-chan struct{}, logs io.Writer) error) error {
+	return serve(nil, nil)
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !windows
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+func install(exe, configPath string) error { return unsupported() }
+func start() error                         { return unsupported() }
+func stop() error                          { return unsupported() }
+func uninstall() error                     { return unsupported() }
+
+func unsupported() error {
+	return fmt.Errorf("services are not supported on %s", runtime.GOOS)
+}
+
+func managed() bool { return false }
+
+func run(serve func(stop <-chan struct{}, logs io.Writer) error) error {
+	return serve(nil, nil)
+}
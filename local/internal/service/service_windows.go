@@ -0,0 +1,185 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// install creates an automatic-start service, restarted when it fails, and
+// registers it as an event log source for its logs
+func install(exe, configPath string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", Name)
+	}
+	s, err := m.CreateService(Name, exe, mgr.Config{
+		DisplayName: "Local DNS Proxy",
+		Description: "Resolves DNS queries through the remote DNS API",
+		StartType:   mgr.StartAutomatic,
+	}, "run", "-config", configPath)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart}, 0); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+	eventlog.Remove(Name) // left behind by an earlier install
+	if err := eventlog.InstallAsEventCreate(Name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("failed to register event log source: %w", err)
+	}
+	return nil
+}
+
+func start() error {
+	return withService(func(s *mgr.Service) error {
+		return s.Start()
+	})
+}
+
+// stop asks the service to stop and waits until it has
+func stop() error {
+	return withService(func(s *mgr.Service) error {
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(30 * time.Second)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("service %s did not stop in time", Name)
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func uninstall() error {
+	if err := stop(); err != nil && !errors.Is(err, windows.ERROR_SERVICE_NOT_ACTIVE) {
+		return err
+	}
+	if err := withService(func(s *mgr.Service) error { return s.Delete() }); err != nil {
+		return err
+	}
+	return eventlog.Remove(Name)
+}
+
+// withService calls fn with the installed service
+func withService(fn func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(Name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", Name, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
+
+func managed() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+func run(serve func(stop <-chan struct{}, logs io.Writer) error) error {
+	elog, err := eventlog.Open(Name)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %w", err)
+	}
+	defer elog.Close()
+
+	h := &handler{serve: serve, logs: &eventWriter{elog}}
+	if err := svc.Run(Name, h); err != nil {
+		return err
+	}
+	return h.err
+}
+
+// handler runs serve and answers the service manager's requests
+type handler struct {
+	serve func(stop <-chan struct{}, logs io.Writer) error
+	logs  io.Writer
+	err   error // what serve returned
+}
+
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stopCh := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- h.serve(stopCh, h.logs) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	stopping := false
+	for {
+		select {
+		case h.err = <-done:
+			if h.err != nil {
+				fmt.Fprintf(h.logs, "level=ERROR msg=\"server error\" error=%q\n", h.err)
+				return true, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				if !stopping {
+					stopping = true
+					status <- svc.Status{State: svc.StopPending}
+					close(stopCh)
+				}
+			}
+		}
+	}
+}
+
+// eventWriter writes each log line as an event, at the level the line
+// names in either log format
+type eventWriter struct {
+	log *eventlog.Log
+}
+
+// eventID is the one event ID the source uses; the message carries the rest
+const eventID = 1
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimRight(p, "\n"))
+	var err error
+	switch {
+	case bytes.Contains(p, []byte("level=ERROR")), bytes.Contains(p, []byte(`"level":"ERROR"`)):
+		err = w.log.Error(eventID, msg)
+	case bytes.Contains(p, []byte("level=WARN")), bytes.Contains(p, []byte(`"level":"WARN"`)):
+		err = w.log.Warning(eventID, msg)
+	default:
+		err = w.log.Info(eventID, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,296 @@
+package setup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+	"github.com/mahdi/dns-proxy-local/internal/crypto"
+	"github.com/mahdi/dns-proxy-local/internal/sysdns"
+)
+
+// Answers holds everything collected by the wizard
+type Answers struct {
+	EndpointURL   string
+	APIKey        string
+	EncryptionKey string // empty disables payload encryption
+	ListenAddr    string
+	Port          int
+}
+
+// Bundle is the connection bundle a remote operator can hand out:
+// base64-encoded JSON with the endpoint and its credentials.
+type Bundle struct {
+	URL           string `json:"url"`
+	APIKey        string `json:"api_key"`
+	EncryptionKey string `json:"encryption_key,omitempty"`
+}
+
+// ParseBundle decodes a base64 connection bundle
+func ParseBundle(s string) (*Bundle, error) {
+	s = strings.TrimSpace(s)
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		data, err = base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle encoding: %w", err)
+		}
+	}
+
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid bundle payload: %w", err)
+	}
+	if b.URL == "" || b.APIKey == "" {
+		return nil, fmt.Errorf("bundle must contain url and api_key")
+	}
+	return &b, nil
+}
+
+// Wizard walks the user through a first-run configuration
+type Wizard struct {
+	in         *bufio.Reader
+	out        io.Writer
+	httpClient *http.Client
+}
+
+// NewWizard creates a wizard reading answers from in and prompting on out
+func NewWizard(in io.Reader, out io.Writer) *Wizard {
+	return &Wizard{
+		in:         bufio.NewReader(in),
+		out:        out,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run executes the wizard and writes the resulting configuration to path
+func (w *Wizard) Run(path string) error {
+	fmt.Fprintln(w.out, "DNS proxy setup")
+	fmt.Fprintln(w.out, "Press Enter to accept the [default] value.")
+	fmt.Fprintln(w.out)
+
+	if _, err := os.Stat(path); err == nil {
+		if !w.confirm(fmt.Sprintf("%s already exists. Overwrite?", path), false) {
+			return fmt.Errorf("aborted: %s exists", path)
+		}
+	}
+
+	answers, err := w.collect()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w.out, "\nTesting connectivity to %s ...\n", answers.EndpointURL)
+	if err := CheckEndpoint(context.Background(), w.httpClient, answers.EndpointURL, answers.APIKey); err != nil {
+		fmt.Fprintf(w.out, "  failed: %v\n", err)
+		if !w.confirm("Write the configuration anyway?", false) {
+			return fmt.Errorf("connectivity test failed: %w", err)
+		}
+	} else {
+		fmt.Fprintln(w.out, "  ok")
+	}
+
+	data, err := RenderConfig(answers)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if _, err := config.Load(path); err != nil {
+		return fmt.Errorf("generated config is invalid: %w", err)
+	}
+	fmt.Fprintf(w.out, "Wrote %s\n", path)
+
+	if w.confirm("Install as a system service?", false) {
+		if err := InstallService(path); err != nil {
+			fmt.Fprintf(w.out, "  service install failed: %v\n", err)
+		} else {
+			fmt.Fprintln(w.out, "  service installed")
+		}
+	}
+
+	// The replaced settings go where "run -set-system-dns" keeps them, so
+	// they are put back the next time it stops
+	if answers.ListenAddr == "127.0.0.1" && answers.Port == 53 {
+		stateFile := filepath.Join(filepath.Dir(path), "system-dns-state.json")
+		if w.confirm("Point the system DNS at the proxy?", false) {
+			if err := sysdns.Point(answers.ListenAddr, stateFile); err != nil {
+				fmt.Fprintf(w.out, "  failed: %v\n", err)
+			} else {
+				fmt.Fprintf(w.out, "  system DNS updated, previous settings saved in %s\n", stateFile)
+			}
+		} else if err := sysdns.Restore(stateFile); err != nil {
+			fmt.Fprintf(w.out, "  failed to restore the previous system DNS: %v\n", err)
+		}
+	}
+
+	fmt.Fprintln(w.out, "\nSetup complete.")
+	return nil
+}
+
+func (w *Wizard) collect() (*Answers, error) {
+	a := &Answers{}
+
+	endpoint := w.ask("Remote endpoint URL or connection bundle", "")
+	if endpoint == "" {
+		return nil, fmt.Errorf("an endpoint is required")
+	}
+
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		a.EndpointURL = endpoint
+		a.APIKey = w.ask("API key", "")
+		if a.APIKey == "" {
+			return nil, fmt.Errorf("an API key is required")
+		}
+		if w.confirm("Enable payload encryption?", false) {
+			a.EncryptionKey = w.ask("Encryption key (64 hex chars, must match the remote)", "")
+			if _, err := crypto.NewCipher(a.EncryptionKey); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		b, err := ParseBundle(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		a.EndpointURL = b.URL
+		a.APIKey = b.APIKey
+		a.EncryptionKey = b.EncryptionKey
+		fmt.Fprintf(w.out, "  using endpoint %s\n", a.EndpointURL)
+	}
+
+	if _, err := url.ParseRequestURI(a.EndpointURL); err != nil {
+		return nil, fmt.Errorf("invalid endpoint URL: %w", err)
+	}
+
+	a.ListenAddr = w.ask("Listen address", "127.0.0.1")
+	port, err := strconv.Atoi(w.ask("Listen port", "53"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port")
+	}
+	a.Port = port
+
+	return a, nil
+}
+
+func (w *Wizard) ask(prompt, def string) string {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", prompt, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", prompt)
+	}
+
+	line, _ := w.in.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return def
+	}
+	return line
+}
+
+func (w *Wizard) confirm(prompt string, def bool) bool {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+	switch strings.ToLower(w.ask(prompt+" ("+d+")", "")) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
+	default:
+		return def
+	}
+}
+
+// CheckEndpoint verifies the remote is reachable and accepts the API key
+// by resolving a sentinel domain through it.
+func CheckEndpoint(ctx context.Context, httpClient *http.Client, endpointURL, apiKey string) error {
+	body, _ := json.Marshal(map[string]string{"domain": "example.com", "type": "A"})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpointURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest:
+		// Reachable and authenticated; the remote expects an encrypted payload
+		return nil
+	case http.StatusUnauthorized:
+		return fmt.Errorf("API key rejected")
+	default:
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// configTemplate quotes every answer, so none can break out of its value
+var configTemplate = template.Must(template.New("config").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(`# Local DNS Server Configuration
+# Generated by "setup"
+
+server:
+  listen_addr: {{quote .ListenAddr}}
+  port: {{.Port}}
+  protocol: "both"
+
+api:
+  endpoints:
+    - url: {{quote .EndpointURL}}
+      api_key: {{quote .APIKey}}
+      weight: 1
+  timeout: 10s
+  max_retries: 3
+  retry_delay: 500ms
+  health_check_freq: 30s
+  load_balancing: "round_robin"
+
+cache:
+  enabled: true
+  max_items: 10000
+  default_ttl: 5m
+  min_ttl: 60s
+  max_ttl: 24h
+  negative_ttl: 5m
+
+security:
+  encryption_enabled: {{if .EncryptionKey}}true{{else}}false{{end}}
+  encryption_key: {{quote .EncryptionKey}}
+
+logging:
+  level: "info"
+  format: "text"
+  output_file: ""
+`))
+
+// RenderConfig renders a config.yaml for the given answers
+func RenderConfig(a *Answers) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := configTemplate.Execute(&buf, a); err != nil {
+		return nil, fmt.Errorf("failed to render config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package setup
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mahdi/dns-proxy-local/internal/config"
+)
+
+func TestRenderConfig(t *testing.T) {
+	a := &Answers{
+		EndpointURL:   "https://dns.example.com/api/v1/resolve?x=\"y\"#frag",
+		APIKey:        "key\" # not a comment\nevil: true",
+		EncryptionKey: strings.Repeat("ab", 32),
+		ListenAddr:    "127.0.0.1",
+		Port:          5353,
+	}
+	data, err := RenderConfig(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, data, 0o600)
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+
+	// Every answer comes back as given, quotes and newlines included
+	ep := cfg.API.Endpoints[0]
+	if ep.URL != a.EndpointURL || ep.APIKey != a.APIKey {
+		t.Errorf("endpoint %q %q, want %q %q", ep.URL, ep.APIKey, a.EndpointURL, a.APIKey)
+	}
+	if !cfg.Security.EncryptionEnabled || cfg.Security.EncryptionKey != a.EncryptionKey {
+		t.Errorf("encryption %v %q", cfg.Security.EncryptionEnabled, cfg.Security.EncryptionKey)
+	}
+	if cfg.Server.ListenAddr != a.ListenAddr || cfg.Server.Port != a.Port {
+		t.Errorf("listening on %s:%d", cfg.Server.ListenAddr, cfg.Server.Port)
+	}
+
+	a.EncryptionKey = ""
+	data, _ = RenderConfig(a)
+	os.WriteFile(path, data, 0o600)
+	if cfg, err := config.Load(path); err != nil || cfg.Security.EncryptionEnabled {
+		t.Errorf("without a key: %v", err)
+	}
+}
+
+func TestParseBundle(t *testing.T) {
+	payload := `{"url":"https://dns.example.com/api/v1/resolve","api_key":"k1","encryption_key":"` + strings.Repeat("ab", 32) + `"}`
+	tests := []struct {
+		name  string
+		input string
+		ok    bool
+	}{
+		{"standard", base64.StdEncoding.EncodeToString([]byte(payload)), true},
+		{"url-safe unpadded", " " + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "\n", true},
+		{"not base64", "not a bundle!", false},
+		{"not json", base64.StdEncoding.EncodeToString([]byte("url=x")), false},
+		{"no api key", base64.StdEncoding.EncodeToString([]byte(`{"url":"https://dns.example.com"}`)), false},
+		{"no url", base64.StdEncoding.EncodeToString([]byte(`{"api_key":"k1"}`)), false},
+	}
+	for _, tt := range tests {
+		b, err := ParseBundle(tt.input)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (b.URL != "https://dns.example.com/api/v1/resolve" || b.APIKey != "k1" || len(b.EncryptionKey) != 64) {
+			t.Errorf("%s: %+v", tt.name, b)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package setup
+
+import "github.com/mahdi/dns-proxy-local/internal/service"
+
+// InstallService registers the proxy as a boot-time service and starts it
+func InstallService(configPath string) error {
+	if err := service.Install(configPath); err != nil {
+		return err
+	}
+	return service.Start()
+}
@@ -0,0 +1,74 @@
+// Package sysdns points the operating system's resolver at the proxy for
+// as long as it runs. What it replaces is written to a state file before
+// anything changes, so it can be put back on shutdown, or on the next start
+// after a crash.
+package sysdns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// State is the resolver configuration replaced by Point
+type State struct {
+	Method   string    `json:"method"` // how it was changed: resolved, resolvconf, file, networksetup or netsh
+	Addr     string    `json:"addr"`   // address the resolver was pointed at
+	Settings []Setting `json:"settings"`
+}
+
+// Setting is the configuration of one link, network service, interface or
+// file before it was changed
+type Setting struct {
+	Name    string   `json:"name"`
+	Servers []string `json:"servers,omitempty"` // empty for none, or for DHCP-assigned servers on Windows
+	Domains []string `json:"domains,omitempty"` // systemd-resolved routing domains
+	Content string   `json:"content,omitempty"` // the replaced resolv.conf
+}
+
+// Point makes the system resolver use the DNS server at addr (port 53),
+// after restoring what a previous run left in stateFile
+func Point(addr, stateFile string) error {
+	if err := Restore(stateFile); err != nil {
+		return fmt.Errorf("failed to restore the previous run's system DNS: %w", err)
+	}
+	st, err := current(addr)
+	if err != nil {
+		return err
+	}
+	st.Addr = addr
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(stateFile, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write system DNS state: %w", err)
+	}
+	if err := set(st, addr); err != nil {
+		revert(st)
+		os.Remove(stateFile)
+		return err
+	}
+	return nil
+}
+
+// Restore puts back the configuration recorded in stateFile and removes
+// the file. Without a state file there is nothing to do.
+func Restore(stateFile string) error {
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var st State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %w", stateFile, err)
+	}
+	if err := revert(&st); err != nil {
+		return err
+	}
+	return os.Remove(stateFile)
+}
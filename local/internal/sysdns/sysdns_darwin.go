@@ -0,0 +1,62 @@
+package sysdns
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// current records the DNS servers of every enabled network service
+func current(addr string) (*State, error) {
+	out, err := networksetup("-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	st := &State{Method: "networksetup"}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for _, service := range lines[1:] { // after a line explaining the asterisk
+		if service == "" || strings.HasPrefix(service, "*") { // disabled
+			continue
+		}
+		servers, err := networksetup("-getdnsservers", service)
+		if err != nil {
+			return nil, err
+		}
+		s := Setting{Name: service}
+		if !strings.Contains(servers, " ") { // else "There aren't any DNS Servers set on ..."
+			s.Servers = strings.Fields(servers)
+		}
+		st.Settings = append(st.Settings, s)
+	}
+	return st, nil
+}
+
+func set(st *State, addr string) error {
+	for _, s := range st.Settings {
+		if _, err := networksetup("-setdnsservers", s.Name, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revert(st *State) error {
+	for _, s := range st.Settings {
+		servers := s.Servers
+		if len(servers) == 0 {
+			servers = []string{"Empty"}
+		}
+		if _, err := networksetup(append([]string{"-setdnsservers", s.Name}, servers...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func networksetup(args ...string) (string, error) {
+	out, err := exec.Command("networksetup", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("networksetup %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
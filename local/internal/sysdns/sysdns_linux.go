@@ -0,0 +1,156 @@
+package sysdns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	resolvConf      = "/etc/resolv.conf"
+	resolvconfEntry = "lo.dns-local" // resolvconf lists lo.* interfaces first
+)
+
+// current picks the way the resolver is managed: per-link settings of
+// systemd-resolved for the default route's interfaces, an entry of
+// resolvconf, or else /etc/resolv.conf itself
+func current(addr string) (*State, error) {
+	target, _ := filepath.EvalSymlinks(resolvConf)
+	_, resolvectlErr := exec.LookPath("resolvectl")
+	_, resolvconfErr := exec.LookPath("resolvconf")
+
+	switch {
+	case strings.HasPrefix(target, "/run/systemd/resolve/") && resolvectlErr == nil:
+		st := &State{Method: "resolved"}
+		links, err := defaultRouteLinks()
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			servers, err := resolvectl("dns", link)
+			if err != nil {
+				return nil, err
+			}
+			domains, err := resolvectl("domain", link)
+			if err != nil {
+				return nil, err
+			}
+			st.Settings = append(st.Settings, Setting{Name: link, Servers: servers, Domains: domains})
+		}
+		return st, nil
+
+	case target != resolvConf && resolvconfErr == nil:
+		return &State{Method: "resolvconf", Settings: []Setting{{Name: resolvconfEntry}}}, nil
+
+	default:
+		data, err := os.ReadFile(resolvConf)
+		if err != nil {
+			return nil, err
+		}
+		return &State{Method: "file", Settings: []Setting{{Name: resolvConf, Content: string(data)}}}, nil
+	}
+}
+
+func set(st *State, addr string) error {
+	switch st.Method {
+	case "resolved":
+		for _, s := range st.Settings {
+			if _, err := resolvectl("dns", s.Name, addr); err != nil {
+				return err
+			}
+			// Route every name to the link, ahead of other links' servers
+			if _, err := resolvectl("domain", s.Name, "~."); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "resolvconf":
+		cmd := exec.Command("resolvconf", "-a", resolvconfEntry)
+		cmd.Stdin = strings.NewReader("nameserver " + addr + "\n")
+		return run(cmd)
+	default:
+		return os.WriteFile(resolvConf, []byte("nameserver "+addr+"\n"), 0o644)
+	}
+}
+
+func revert(st *State) error {
+	switch st.Method {
+	case "resolved":
+		for _, s := range st.Settings {
+			if _, err := resolvectl(append([]string{"dns", s.Name}, orEmpty(s.Servers)...)...); err != nil {
+				return err
+			}
+			if _, err := resolvectl(append([]string{"domain", s.Name}, orEmpty(s.Domains)...)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "resolvconf":
+		return run(exec.Command("resolvconf", "-d", resolvconfEntry))
+	default:
+		return os.WriteFile(resolvConf, []byte(st.Settings[0].Content), 0o644)
+	}
+}
+
+// orEmpty returns values, or the empty argument that clears a resolvectl
+// setting
+func orEmpty(values []string) []string {
+	if len(values) == 0 {
+		return []string{""}
+	}
+	return values
+}
+
+// resolvectl runs a resolvectl command and returns the values it prints
+// after "Link N (name):"
+func resolvectl(args ...string) ([]string, error) {
+	out, err := exec.Command("resolvectl", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("resolvectl %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	_, values, _ := strings.Cut(string(out), "):")
+	return strings.Fields(values), nil
+}
+
+func run(cmd *exec.Cmd) error {
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", cmd.Args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// defaultRouteLinks returns the interfaces of the IPv4 default routes
+func defaultRouteLinks() ([]string, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	links := parseDefaultRoutes(f)
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no default route")
+	}
+	return links, nil
+}
+
+// parseDefaultRoutes reads /proc/net/route: interface, destination in hex,
+// and so on, after a header line
+func parseDefaultRoutes(r io.Reader) []string {
+	var links []string
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[1] != "00000000" || seen[fields[0]] {
+			continue
+		}
+		seen[fields[0]] = true
+		links = append(links, fields[0])
+	}
+	return links
+}
@@ -0,0 +1,19 @@
+package sysdns
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDefaultRoutes(t *testing.T) {
+	const routes = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wlan0	00000000	0101A8C0	0003	0	0	600	00000000	0	0	0
+wlan0	0001A8C0	00000000	0001	0	0	600	00FFFFFF	0	0	0
+eth0	00000000	0100000A	0003	0	0	100	00000000	0	0	0
+wlan0	00000000	0101A8C0	0003	0	0	700	00000000	0	0	0
+`
+	if got := parseDefaultRoutes(strings.NewReader(routes)); !slices.Equal(got, []string{"wlan0", "eth0"}) {
+		t.Errorf("links = %v, want [wlan0 eth0]", got)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+
+package sysdns
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func current(addr string) (*State, error) {
+	return nil, fmt.Errorf("setting the system DNS is not supported on %s", runtime.GOOS)
+}
+
+func set(st *State, addr string) error { return nil }
+func revert(st *State) error           { return nil }
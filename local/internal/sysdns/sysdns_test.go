@@ -0,0 +1,18 @@
+package sysdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreWithoutState(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state.json")
+	if err := Restore(state); err != nil {
+		t.Fatalf("Restore without a state file: %v", err)
+	}
+	os.WriteFile(state, []byte("{"), 0o600)
+	if err := Restore(state); err == nil {
+		t.Error("Restore accepted a corrupt state file")
+	}
+}
@@ -0,0 +1,127 @@
+package sysdns
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// current records the static DNS servers of every connected interface;
+// none means the servers come from DHCP
+func current(addr string) (*State, error) {
+	adapters, err := adapters()
+	if err != nil {
+		return nil, err
+	}
+	st := &State{Method: "netsh"}
+	for _, a := range adapters {
+		if a.OperStatus != windows.IfOperStatusUp || a.IfType == windows.IF_TYPE_SOFTWARE_LOOPBACK {
+			continue
+		}
+		guid := windows.BytePtrToString(a.AdapterName)
+		servers, err := staticServers(family(addr), guid)
+		if err != nil {
+			return nil, err
+		}
+		st.Settings = append(st.Settings, Setting{
+			Name:    windows.UTF16PtrToString(a.FriendlyName),
+			Servers: servers,
+		})
+	}
+	return st, nil
+}
+
+func set(st *State, addr string) error {
+	for _, s := range st.Settings {
+		if err := netsh("set", family(addr), "name="+s.Name, "source=static", "address="+addr, "register=none", "validate=no"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revert(st *State) error {
+	fam := family(st.Addr)
+	for _, s := range st.Settings {
+		if len(s.Servers) == 0 {
+			if err := netsh("set", fam, "name="+s.Name, "source=dhcp"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := netsh("set", fam, "name="+s.Name, "source=static", "address="+s.Servers[0], "register=primary", "validate=no"); err != nil {
+			return err
+		}
+		for i, server := range s.Servers[1:] {
+			if err := netsh("add", fam, "name="+s.Name, "address="+server, "index="+strconv.Itoa(i+2), "validate=no"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// family returns netsh's name for the address family of addr
+func family(addr string) string {
+	if a, err := netip.ParseAddr(addr); err == nil && a.Is6() {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+func netsh(verb, fam string, args ...string) error {
+	args = append([]string{"interface", fam, verb, "dnsservers"}, args...)
+	if out, err := exec.Command("netsh", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("netsh %s dnsservers: %v: %s", verb, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// staticServers reads the interface's statically configured servers from
+// the registry, where DHCP-assigned ones are kept under another value
+func staticServers(fam, guid string) ([]string, error) {
+	service := "Tcpip"
+	if fam == "ipv6" {
+		service = "Tcpip6"
+	}
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+service+`\Parameters\Interfaces\`+guid, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, nil // no settings of that family
+	}
+	defer k.Close()
+	value, _, err := k.GetStringValue("NameServer")
+	if err == registry.ErrNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }), nil
+}
+
+// adapters returns the network adapters, growing the buffer as asked
+func adapters() ([]*windows.IpAdapterAddresses, error) {
+	size := uint32(15000)
+	for {
+		buf := make([]byte, size)
+		first := (*windows.IpAdapterAddresses)(unsafe.Pointer(&buf[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, 0, 0, first, &size)
+		if err == windows.ERROR_BUFFER_OVERFLOW {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GetAdaptersAddresses: %w", err)
+		}
+		var list []*windows.IpAdapterAddresses
+		for a := first; a != nil; a = a.Next {
+			list = append(list, a)
+		}
+		return list, nil
+	}
+}
@@ -0,0 +1,118 @@
+// Package systemd implements the parts of the systemd service protocol the
+// local server uses: socket activation (LISTEN_FDS) and readiness and
+// watchdog notifications (sd_notify). Everything is a no-op when the
+// process was not started by systemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first inherited descriptor (SD_LISTEN_FDS_START)
+const listenFDsStart = 3
+
+// Sockets are the listening sockets passed by systemd, keyed by the
+// FileDescriptorName= of their .socket unit (the socket unit's name when
+// unset)
+type Sockets struct {
+	Packet map[string][]net.PacketConn
+	Stream map[string][]net.Listener
+}
+
+// Len returns the number of inherited sockets
+func (s *Sockets) Len() int {
+	n := 0
+	for _, conns := range s.Packet {
+		n += len(conns)
+	}
+	for _, lns := range s.Stream {
+		n += len(lns)
+	}
+	return n
+}
+
+// Listeners returns the sockets passed by socket activation, or nil when
+// there are none. The LISTEN_* variables are cleared so child processes do
+// not inherit them.
+func Listeners() (*Sockets, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	sockets := &Sockets{
+		Packet: make(map[string][]net.PacketConn),
+		Stream: make(map[string][]net.Listener),
+	}
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+
+		// net.File* duplicate the descriptor, so the original is closed
+		// either way
+		if ln, err := net.FileListener(f); err == nil {
+			sockets.Stream[name] = append(sockets.Stream[name], ln)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			sockets.Packet[name] = append(sockets.Packet[name], pc)
+		} else {
+			f.Close()
+			return nil, fmt.Errorf("inherited socket %d (%s) is not a listener: %w", fd, name, err)
+		}
+		f.Close()
+	}
+	return sockets, nil
+}
+
+// Notify sends a state string such as "READY=1" to the service manager. It
+// does nothing when NOTIFY_SOCKET is unset.
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval returns WatchdogSec= for this process, or 0 when the
+// watchdog is disabled. Pings should be sent at about half this interval.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mahdi/dns-proxy-remote/internal/audit"
+	"github.com/mahdi/dns-proxy-remote/internal/crypto"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+	"github.com/mahdi/dns-proxy-remote/internal/server"
+)
+
+const redacted = "REDACTED"
+
+// runServer loads the configuration and serves the API until shutdown
+func runServer(args []string) error {
+	fs, cf := newFlagSet("run")
+	fs.Parse(args)
+
+	// Load configuration
+	cfg, err := cf.load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// Create logger
+	logger, logCloser, err := logging.New(cfg.Logging)
+	if err != nil {
+		return fmt.Errorf("failed to create logger: %w", err)
+	}
+	defer logCloser.Close()
+
+	// Create and run server
+	srv, err := server.New(cfg, logger)
+	if err != nil {
+		logger.Error("failed to create server", "error", err)
+		logCloser.Close()
+		os.Exit(1)
+	}
+
+	if err := srv.Run(); err != nil {
+		logger.Error("server shutdown", "error", err)
+		logCloser.Close()
+		os.Exit(1)
+	}
+	return nil
+}
+
+// runKeygen prints a new encryption key
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Parse(args)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// runCheck validates the configuration and prints the effective settings
+func runCheck(args []string) error {
+	fs, cf := newFlagSet("check")
+	showSecrets := fs.Bool("show-secrets", false, "Print API keys and encryption keys instead of redacting them")
+	fs.Parse(args)
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+
+	if !*showSecrets {
+		for i := range cfg.Security.APIKeys {
+			cfg.Security.APIKeys[i] = redacted
+		}
+		for i := range cfg.Security.AdminKeys {
+			cfg.Security.AdminKeys[i] = redacted
+		}
+		if cfg.Security.EncryptionKey != "" {
+			cfg.Security.EncryptionKey = redacted
+		}
+		for i := range cfg.Security.EncryptionKeys {
+			cfg.Security.EncryptionKeys[i].Key = redacted
+		}
+		if cfg.Resolver.Redis.Password != "" {
+			cfg.Resolver.Redis.Password = redacted
+		}
+		for i := range cfg.Security.Signing.Secrets {
+			cfg.Security.Signing.Secrets[i].APIKey = redacted
+			cfg.Security.Signing.Secrets[i].Secret = redacted
+		}
+	}
+
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: configuration is valid\n", cf.path)
+	os.Stdout.Write(out)
+	return nil
+}
+
+// runQuery resolves one name through the configured upstreams
+func runQuery(args []string) error {
+	fs, cf := newFlagSet("query")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("usage: query [-config file] <domain> [type]")
+	}
+	domain := fs.Arg(0)
+	recordType := resolver.TypeA
+	if fs.NArg() == 2 {
+		recordType = resolver.RecordType(strings.ToUpper(fs.Arg(1)))
+	}
+
+	cfg, err := cf.load()
+	if err != nil {
+		return err
+	}
+
+	res, err := server.NewResolver(cfg, logging.Discard())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Resolver.MaxRetries+1)*cfg.Resolver.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	result, err := res.Resolve(ctx, domain, recordType)
+	if err != nil {
+		return err
+	}
+	for _, rec := range result.Records {
+		fmt.Printf("%s\t%d\t%s\t%s\n", rec.Name, rec.TTL, rec.Type, rec.Value)
+	}
+	fmt.Fprintf(os.Stderr, ";; %d records in %s\n", len(result.Records), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runAudit verifies the hash chain of the audit log
+func runAudit(args []string) error {
+	fs, cf := newFlagSet("audit")
+	file := fs.String("file", "", "Audit log to verify (default audit.file from the config)")
+	fs.Parse(args)
+
+	path := *file
+	if path == "" {
+		cfg, err := cf.load()
+		if err != nil {
+			return err
+		}
+		if path = cfg.Audit.File; path == "" {
+			return fmt.Errorf("no audit file configured; use -file")
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := audit.Verify(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	fmt.Printf("%s: %d entries, chain intact\n", path, n)
+	return nil
+}
@@ -2,31 +2,72 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/mahdi/dns-proxy-remote/internal/config"
-	"github.com/mahdi/dns-proxy-remote/internal/server"
 )
 
-func main() {
-	configPath := flag.String("config", "config.yaml", "Path to configuration file")
-	flag.Parse()
+const usage = `Usage: dns-api [command] [flags]
 
-	// Load configuration
-	cfg, err := config.Load(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+Commands:
+  run       Start the API server (default)
+  keygen    Generate a random 32-byte encryption key
+  check     Validate a configuration file and print it with defaults applied
+  query     Resolve a name through the configured upstreams: query example.com [A]
+  audit     Verify the hash chain of the audit log
+
+Run "dns-api <command> -h" for command flags.
+`
+
+func main() {
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		command, args = args[0], args[1:]
 	}
 
-	// Create and run server
-	srv, err := server.New(cfg)
+	var err error
+	switch command {
+	case "run":
+		err = runServer(args)
+	case "keygen":
+		err = runKeygen(args)
+	case "check", "validate-config":
+		err = runCheck(args)
+	case "query":
+		err = runQuery(args)
+	case "audit":
+		err = runAudit(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
 	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
+		log.Fatal(err)
 	}
+}
 
-	if err := srv.Run(); err != nil {
-		log.Printf("Server shutdown: %v", err)
-		os.Exit(1)
-	}
+// configFlags holds the shared flags that locate and override the config
+type configFlags struct {
+	path string
+	set  config.Overrides
+}
+
+// load reads the config file with DNS_PROXY_* environment variables and
+// -set flags applied on top, in that order
+func (c *configFlags) load() (*config.Config, error) {
+	return config.Load(c.path, c.set...)
+}
+
+// newFlagSet returns a flag set with the shared -config and -set flags
+func newFlagSet(name string) (*flag.FlagSet, *configFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	cf := &configFlags{}
+	fs.StringVar(&cf.path, "config", "config.yaml", "Path to configuration file")
+	fs.Var(&cf.set, "set", "Override a config value, e.g. -set server.port=9443 (repeatable)")
+	return fs, cf
 }
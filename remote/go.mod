@@ -1,8 +1,29 @@
 module github.com/mahdi/dns-proxy-remote
 
-go 1.21
+go 1.24
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/miekg/dns v1.1.58
+	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/pires/go-proxyproto v0.7.0
+	github.com/quic-go/quic-go v0.59.0
+	github.com/redis/go-redis/v9 v9.7.3
+	golang.org/x/crypto v0.41.0
 	golang.org/x/time v0.5.0
 	gopkg.in/yaml.v3 v3.0.1
 )
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
+)
@@ -0,0 +1,204 @@
+// Package audit records administrative actions on the server to an
+// append-only file, one JSON entry per line. Each entry carries the hash of
+// the one before it, so an entry edited or removed after the fact breaks
+// the chain from there on and Verify reports where.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+	"github.com/mahdi/dns-proxy-remote/internal/middleware"
+)
+
+// System is the actor of actions the server takes on its own, such as
+// starting with a configuration
+const System = "system"
+
+// Entry is one recorded action
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`            // "key:<fingerprint>", "cert:<subject>" or System
+	Addr   string    `json:"addr,omitempty"`   // client IP of requests
+	Action string    `json:"action"`           // e.g. "cluster.register"
+	Target string    `json:"target,omitempty"` // what was acted on
+	Prev   string    `json:"prev"`             // hash of the previous entry; empty for the first
+	Hash   string    `json:"hash"`             // SHA-256 of Prev and the entry without Hash
+}
+
+// sum returns the hash e should carry
+func (e Entry) sum() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(e.Prev))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Log appends entries to the audit file
+type Log struct {
+	logger *slog.Logger
+
+	mu   sync.Mutex
+	file *os.File
+	last string // hash of the last entry
+}
+
+// New opens the audit file for appending, or returns nil if auditing is
+// disabled. The chain continues from the file's last entry; a broken chain
+// is logged but doesn't stop the server, so one damaged file can't keep it
+// down.
+func New(cfg config.AuditConfig, logger *slog.Logger) (*Log, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	file, err := os.OpenFile(cfg.File, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l := &Log{logger: logger, file: file}
+	var n int
+	n, l.last, err = verify(file)
+	if err != nil {
+		logger.Error("audit log chain is broken; later entries chain from the last one", "file", cfg.File, "error", err)
+	} else {
+		logger.Info("audit log opened", "file", cfg.File, "entries", n)
+	}
+	return l, nil
+}
+
+// Record appends an action taken by actor. Failures to write are logged;
+// the action itself has already happened.
+func (l *Log) Record(actor, addr, action, target string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := Entry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Addr:   addr,
+		Action: action,
+		Target: target,
+		Prev:   l.last,
+	}
+	if err := l.append(e); err != nil {
+		l.logger.Error("failed to write audit entry", "action", action, "actor", actor, "error", err)
+	}
+}
+
+// RecordRequest appends an action taken through request r, by the holder
+// of its client certificate or API key
+func (l *Log) RecordRequest(r *http.Request, action, target string) {
+	if l == nil {
+		return
+	}
+	l.Record(Actor(r), middleware.ClientIP(r), action, target)
+}
+
+func (l *Log) append(e Entry) error {
+	hash, err := e.sum()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.last = hash
+	return nil
+}
+
+// Close closes the audit file
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Actor names who made r: the subject of a verified client certificate,
+// else a fingerprint of the API key, which stays out of the file
+func Actor(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "cert:" + r.TLS.PeerCertificates[0].Subject.String()
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	if key == "" {
+		return "anonymous"
+	}
+	return "key:" + middleware.KeyFingerprint(key)
+}
+
+// Verify checks the hash chain of the audit log read from r and returns
+// the number of entries. The error names the first line that doesn't
+// chain.
+func Verify(r io.Reader) (int, error) {
+	n, _, err := verify(r)
+	return n, err
+}
+
+// verify is Verify that also returns the hash of the last entry, to chain
+// the next one from even when the chain is broken
+func verify(r io.Reader) (int, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var (
+		n      int
+		last   string
+		broken error
+	)
+	for scanner.Scan() {
+		n++
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			if broken == nil {
+				broken = fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		}
+		if broken == nil {
+			if e.Prev != last {
+				broken = fmt.Errorf("line %d: does not follow the previous entry", n)
+			} else if sum, err := e.sum(); err != nil || sum != e.Hash {
+				broken = fmt.Errorf("line %d: hash does not match the entry", n)
+			}
+		}
+		last = e.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return n, last, err
+	}
+	if broken != nil {
+		return n, last, fmt.Errorf("audit chain broken: %w", broken)
+	}
+	return n, last, nil
+}
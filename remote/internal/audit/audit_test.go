@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+)
+
+func TestChain(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	cfg := config.AuditConfig{Enabled: true, File: file}
+
+	l, err := New(cfg, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(System, "", "server.start", "config:abc")
+	req := httptest.NewRequest("POST", "/api/v1/peers", nil)
+	req.Header.Set("X-API-Key", "secret-key")
+	l.RecordRequest(req, "cluster.register", "https://b.example/api/v1/resolve")
+	l.Close()
+
+	// Reopening continues the chain
+	l, err = New(cfg, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(System, "", "server.stop", "")
+	l.Close()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Verify(strings.NewReader(string(data))); err != nil || n != 3 {
+		t.Fatalf("Verify = %d, %v; want 3 entries", n, err)
+	}
+	if strings.Contains(string(data), "secret-key") {
+		t.Error("API key written to the audit log")
+	}
+	if !strings.Contains(string(data), `"actor":"`+Actor(req)+`"`) {
+		t.Errorf("actor %q missing from %s", Actor(req), data)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	tests := []struct {
+		name string
+		log  string
+		want string
+	}{
+		{"edited", lines[0] + strings.Replace(lines[1], "b.example", "c.example", 1) + lines[2], "line 2: hash"},
+		{"removed", lines[0] + lines[2], "line 2: does not follow"},
+		{"truncated head", lines[1] + lines[2], "line 1: does not follow"},
+		{"garbage", lines[0] + "{\n" + lines[1], "line 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Verify(strings.NewReader(tt.log)); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Verify = %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	l, err := New(config.AuditConfig{}, logging.Discard())
+	if l != nil || err != nil {
+		t.Fatalf("New = %v, %v; want nil", l, err)
+	}
+	// A nil log records nothing
+	l.Record(System, "", "server.start", "")
+	l.RecordRequest(httptest.NewRequest("GET", "/", nil), "cluster.register", "")
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,244 @@
+// Package cluster keeps the list of remote nodes handed to local proxies at
+// /api/v1/peers: configured peers, nodes that registered themselves, and
+// this node, each with the result of its last health check.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+)
+
+// SecretHeader carries the cluster secret on registrations
+const SecretHeader = "X-Cluster-Secret"
+
+// Peer is a node as listed to clients
+type Peer struct {
+	URL     string `json:"url"`     // resolve URL
+	Healthy bool   `json:"healthy"` // last health check from this node passed
+}
+
+type node struct {
+	static  bool      // configured; never expires
+	expires time.Time // registered nodes only
+	healthy bool
+}
+
+// Registry tracks the cluster's nodes
+type Registry struct {
+	self     string
+	secret   string
+	apiKey   string
+	seeds    []string
+	interval time.Duration
+	ttl      time.Duration
+	client   *http.Client
+	logger   *slog.Logger
+
+	mu    sync.Mutex
+	nodes map[string]*node // by resolve URL, this node excluded
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates a registry, or returns nil if clustering is disabled
+func New(cfg config.ClusterConfig, logger *slog.Logger) *Registry {
+	if !cfg.Enabled {
+		return nil
+	}
+	r := &Registry{
+		self:     cfg.Self,
+		secret:   cfg.Secret,
+		apiKey:   cfg.APIKey,
+		seeds:    cfg.Seeds,
+		interval: cfg.HealthInterval,
+		ttl:      cfg.PeerTTL,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		logger:   logger,
+		nodes:    make(map[string]*node),
+		stop:     make(chan struct{}),
+	}
+	for _, u := range append(slices.Clone(cfg.Peers), cfg.Seeds...) {
+		if u != r.self {
+			r.nodes[u] = &node{static: true}
+		}
+	}
+	return r
+}
+
+// Run checks the nodes' health and renews this node's registration with
+// the seeds until Close
+func (r *Registry) Run() {
+	health := time.NewTicker(r.interval)
+	defer health.Stop()
+	// Renew well within the seeds' TTL, which is assumed to match ours
+	renew := time.NewTicker(r.ttl / 3)
+	defer renew.Stop()
+
+	r.checkAll()
+	r.register()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-health.C:
+			r.checkAll()
+		case <-renew.C:
+			r.register()
+		}
+	}
+}
+
+// Close stops Run
+func (r *Registry) Close() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// Authorized reports whether secret is the cluster secret. Without one,
+// registrations are refused.
+func (r *Registry) Authorized(secret string) bool {
+	return r.secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(r.secret)) == 1
+}
+
+// Register adds or renews a node that registered itself, and checks its
+// health in the background
+func (r *Registry) Register(u string) {
+	if u == r.self {
+		return
+	}
+	r.mu.Lock()
+	n, ok := r.nodes[u]
+	if !ok {
+		n = &node{}
+		r.nodes[u] = n
+		r.logger.Info("node registered", "url", u)
+	}
+	if !n.static {
+		n.expires = time.Now().Add(r.ttl)
+	}
+	r.mu.Unlock()
+	if !ok {
+		go r.check(u)
+	}
+}
+
+// Peers lists the nodes by URL, this one first when withSelf is set.
+// Registrations past their TTL are dropped.
+func (r *Registry) Peers(withSelf bool) []Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	peers := make([]Peer, 0, len(r.nodes)+1)
+	for u, n := range r.nodes {
+		if !n.static && now.After(n.expires) {
+			delete(r.nodes, u)
+			r.logger.Info("node registration expired", "url", u)
+			continue
+		}
+		peers = append(peers, Peer{URL: u, Healthy: n.healthy})
+	}
+	slices.SortFunc(peers, func(a, b Peer) int { return strings.Compare(a.URL, b.URL) })
+	if withSelf && r.self != "" {
+		peers = slices.Insert(peers, 0, Peer{URL: r.self, Healthy: true})
+	}
+	return peers
+}
+
+func (r *Registry) checkAll() {
+	for _, p := range r.Peers(false) {
+		r.check(p.URL)
+	}
+}
+
+// check requests a node's /health and records the outcome
+func (r *Registry) check(u string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.client.Timeout)
+	defer cancel()
+
+	healthy := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, siblingURL(u, "/health"), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = r.client.Do(req); err == nil {
+			resp.Body.Close()
+			healthy = resp.StatusCode == http.StatusOK
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, ok := r.nodes[u]
+	if !ok {
+		return
+	}
+	if n.healthy != healthy {
+		r.logger.Info("node health changed", "url", u, "healthy", healthy, "error", err)
+	}
+	n.healthy = healthy
+}
+
+// register announces this node to every seed
+func (r *Registry) register() {
+	if r.self == "" || len(r.seeds) == 0 {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"url": r.self})
+	for _, seed := range r.seeds {
+		if err := r.registerWith(seed, body); err != nil {
+			r.logger.Warn("registration failed", "seed", seed, "error", err)
+		}
+	}
+}
+
+func (r *Registry) registerWith(seed string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, siblingURL(seed, "/api/v1/peers"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", r.apiKey)
+	req.Header.Set(SecretHeader, r.secret)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// siblingURL replaces the /api/v1/resolve path of a node's resolve URL with
+// path, keeping any prefix it is mounted under
+func siblingURL(resolveURL, path string) string {
+	u, err := url.Parse(resolveURL)
+	if err != nil {
+		return resolveURL
+	}
+	prefix := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/v1/resolve")
+	u.Path = prefix + path
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+)
+
+func TestRegistration(t *testing.T) {
+	// The seed: a registry behind a minimal peers endpoint
+	var seed *Registry
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/v1/peers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "node-key" || !seed.Authorized(r.Header.Get(SecretHeader)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req struct{ URL string }
+		json.NewDecoder(r.Body).Decode(&req)
+		seed.Register(req.URL)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	seedURL := ts.URL + "/api/v1/resolve"
+
+	seed = New(config.ClusterConfig{
+		Enabled:        true,
+		Self:           seedURL,
+		Secret:         "s3cret",
+		Peers:          []string{"https://static.example/api/v1/resolve"},
+		HealthInterval: time.Hour,
+		PeerTTL:        time.Hour,
+	}, logging.Discard())
+
+	// The node registers with the seed; its resolve URL is served by the
+	// same test server, so its health check passes
+	nodeURL := ts.URL + "/node/api/v1/resolve"
+	mux.HandleFunc("/node/health", func(w http.ResponseWriter, r *http.Request) {})
+	node := New(config.ClusterConfig{
+		Enabled:        true,
+		Self:           nodeURL,
+		Seeds:          []string{seedURL},
+		Secret:         "s3cret",
+		APIKey:         "node-key",
+		HealthInterval: time.Hour,
+		PeerTTL:        time.Hour,
+	}, logging.Discard())
+	node.register()
+
+	peers := seed.Peers(true)
+	if len(peers) != 3 || peers[0].URL != seedURL || !peers[0].Healthy {
+		t.Fatalf("seed peers %+v", peers)
+	}
+	seed.checkAll()
+	for _, p := range seed.Peers(false) {
+		want := p.URL == nodeURL // the static peer does not exist
+		if p.Healthy != want {
+			t.Errorf("%s healthy = %v, want %v", p.URL, p.Healthy, want)
+		}
+	}
+
+	// The seed is a static peer of the node
+	if peers := node.Peers(false); len(peers) != 1 || peers[0].URL != seedURL {
+		t.Errorf("node peers %+v", peers)
+	}
+
+	// A wrong secret is refused
+	node.secret = "wrong"
+	body, _ := json.Marshal(map[string]string{"url": nodeURL})
+	if err := node.registerWith(seedURL, body); err == nil {
+		t.Error("registration with a wrong secret succeeded")
+	}
+}
+
+func TestRegistrationExpires(t *testing.T) {
+	r := New(config.ClusterConfig{Enabled: true, Secret: "s", HealthInterval: time.Hour, PeerTTL: time.Millisecond}, logging.Discard())
+	r.Register("https://node.example/api/v1/resolve")
+	if len(r.Peers(false)) != 1 {
+		t.Fatal("registered node not listed")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if peers := r.Peers(false); len(peers) != 0 {
+		t.Errorf("expired node still listed: %+v", peers)
+	}
+	if (&Registry{}).Authorized("") {
+		t.Error("registration accepted without a cluster secret")
+	}
+}
+
+func TestSiblingURL(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"https://node.example/api/v1/resolve", "https://node.example/api/v1/peers"},
+		{"https://node.example:8443/dns/api/v1/resolve/", "https://node.example:8443/dns/api/v1/peers"},
+		{"https://node.example/custom", "https://node.example/custom/api/v1/peers"},
+	}
+	for _, tt := range tests {
+		if got := siblingURL(tt.in, "/api/v1/peers"); got != tt.want {
+			t.Errorf("siblingURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
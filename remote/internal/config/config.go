@@ -2,7 +2,13 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -14,58 +20,324 @@ type Config struct {
 	Resolver ResolverConfig `yaml:"resolver"`
 	Security SecurityConfig `yaml:"security"`
 	Logging  LoggingConfig  `yaml:"logging"`
+	Cluster  ClusterConfig  `yaml:"cluster"`
+	Tenants  []TenantConfig `yaml:"tenants"`
+	Audit    AuditConfig    `yaml:"audit"`
 }
 
 // ServerConfig holds HTTP server settings
 type ServerConfig struct {
-	Host         string        `yaml:"host"`
-	Port         int           `yaml:"port"`
-	TLSCertFile  string        `yaml:"tls_cert_file"`
-	TLSKeyFile   string        `yaml:"tls_key_file"`
-	ReadTimeout  time.Duration `yaml:"read_timeout"`
-	WriteTimeout time.Duration `yaml:"write_timeout"`
-	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	Host            string              `yaml:"host"` // "::" listens on every IPv4 and IPv6 address
+	Port            int                 `yaml:"port"`
+	ExtraPorts      []int               `yaml:"extra_ports"` // additional ports serving the same API
+	Sniff           SniffConfig         `yaml:"sniff"`
+	ProxyProtocol   ProxyProtocolConfig `yaml:"proxy_protocol"`
+	TLSCertFile     string              `yaml:"tls_cert_file"`
+	TLSKeyFile      string              `yaml:"tls_key_file"`
+	TLSMinVersion   string              `yaml:"tls_min_version"` // 1.2 or 1.3
+	ACME            ACMEConfig          `yaml:"acme"`
+	H2C             bool                `yaml:"h2c"` // accept cleartext HTTP/2 with prior knowledge
+	HTTP3           HTTP3Config         `yaml:"http3"`
+	SessionTickets  SessionTicketConfig `yaml:"session_tickets"`
+	ReadTimeout     time.Duration       `yaml:"read_timeout"`
+	WriteTimeout    time.Duration       `yaml:"write_timeout"`
+	IdleTimeout     time.Duration       `yaml:"idle_timeout"`
+	DrainPeriod     time.Duration       `yaml:"drain_period"`     // on shutdown, keep serving this long while clients move away; 0 to stop at once
+	ShutdownTimeout time.Duration       `yaml:"shutdown_timeout"` // then wait this long for requests in flight
+	Compression     CompressionConfig   `yaml:"compression"`
+}
+
+// HTTP3Config holds the optional HTTP/3 (QUIC) listener, announced to
+// clients by Alt-Svc on the TCP ports
+type HTTP3Config struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"` // UDP port; the API port by default
+}
+
+// CompressionConfig holds gzip Content-Encoding of API responses
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	MinSize int  `yaml:"min_size"` // bytes; smaller responses are sent as they are
+}
+
+// ProxyProtocolConfig holds HAProxy PROXY protocol settings
+type ProxyProtocolConfig struct {
+	Enabled         bool     `yaml:"enabled"`
+	TrustedNetworks []string `yaml:"trusted_networks"` // CIDRs whose PROXY headers are used; empty trusts all
+}
+
+// ACMEConfig holds automatic certificate management settings, used instead
+// of tls_cert_file and tls_key_file
+type ACMEConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Domains      []string      `yaml:"domains"`       // names on the certificate; must resolve to this server
+	Email        string        `yaml:"email"`         // account contact for expiry notices
+	CacheDir     string        `yaml:"cache_dir"`     // account key and issued certificate
+	Challenge    string        `yaml:"challenge"`     // tls-alpn-01 (on the API port, which must be 443) or http-01
+	HTTPAddr     string        `yaml:"http_addr"`     // http-01 listener, reachable as port 80
+	DirectoryURL string        `yaml:"directory_url"` // ACME directory; Let's Encrypt by default
+	RenewBefore  time.Duration `yaml:"renew_before"`  // renew when the certificate expires sooner than this
+}
+
+// SessionTicketConfig holds TLS session resumption settings
+type SessionTicketConfig struct {
+	Disabled bool   `yaml:"disabled"` // force a full handshake on every connection
+	KeyFile  string `yaml:"key_file"` // shared ticket keys (hex, one per line, newest first)
+}
+
+// SniffConfig holds protocol sniffing settings for sharing a port with
+// other services
+type SniffConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	ServerNames  []string `yaml:"server_names"`  // TLS SNI routed to the API; empty for any
+	ALPN         []string `yaml:"alpn"`          // ALPN protocols routed to the API; empty for any
+	FallbackAddr string   `yaml:"fallback_addr"` // other traffic is proxied here
 }
 
 // ResolverConfig holds DNS resolver settings
 type ResolverConfig struct {
-	Upstreams     []string      `yaml:"upstreams"`
-	Timeout       time.Duration `yaml:"timeout"`
-	MaxRetries    int           `yaml:"max_retries"`
-	CacheEnabled  bool          `yaml:"cache_enabled"`
-	CacheTTL      time.Duration `yaml:"cache_ttl"`
-	CacheMaxItems int           `yaml:"cache_max_items"`
+	Upstreams       []string              `yaml:"upstreams"`
+	Timeout         time.Duration         `yaml:"timeout"`
+	TimeoutZones    []TimeoutZoneConfig   `yaml:"timeout_zones"` // per-zone upstream timeouts
+	MaxRetries      int                   `yaml:"max_retries"`
+	CacheEnabled    bool                  `yaml:"cache_enabled"`
+	CacheTTL        time.Duration         `yaml:"cache_ttl"`     // lifetime of answers without records
+	CacheMinTTL     time.Duration         `yaml:"cache_min_ttl"` // floor for record TTLs
+	CacheMaxTTL     time.Duration         `yaml:"cache_max_ttl"` // ceiling for record TTLs
+	CacheZones      []CacheZoneConfig     `yaml:"cache_zones"`   // per-zone TTL bounds
+	CacheMaxItems   int                   `yaml:"cache_max_items"`
+	CacheBackend    string                `yaml:"cache_backend"` // memory, redis
+	StaleWindow     time.Duration         `yaml:"stale_window"`  // serve expired entries this long while refreshing; 0 disables
+	Redis           RedisConfig           `yaml:"redis"`
+	BogonFilter     BogonFilterConfig     `yaml:"bogon_filter"`
+	TamperDetection TamperDetectionConfig `yaml:"tamper_detection"`
+	HealthCheck     HealthCheckConfig     `yaml:"health_check"`
+	Strategy        string                `yaml:"strategy"`       // sequential, race, consensus
+	RaceCount       int                   `yaml:"race_count"`     // upstreams queried at once in race and consensus modes
+	Quorum          int                   `yaml:"quorum"`         // agreeing upstreams required in consensus mode
+	AddressFamily   string                `yaml:"address_family"` // auto, ipv4, ipv6 or dual: families upstreams are reached over
+	NAT64Prefix     string                `yaml:"nat64_prefix"`   // e.g. 64:ff9b::/96, or auto (RFC 7050), for IPv4 upstreams on IPv6-only hosts
+	RootServers     []string              `yaml:"root_servers"`   // addresses the iterative upstream starts from; empty for the IANA roots
+	Policy          PolicyConfig          `yaml:"policy"`
+	RPZ             RPZConfig             `yaml:"rpz"`
+}
+
+// RPZConfig holds the response policy zones applied to every lookup
+type RPZConfig struct {
+	Zones          []RPZZoneConfig `yaml:"zones"`           // consulted in order; the first with a rule for a name decides
+	ReloadInterval time.Duration   `yaml:"reload_interval"` // how often the files are checked for changes
+}
+
+// RPZZoneConfig is a response policy zone file
+type RPZZoneConfig struct {
+	Name string `yaml:"name"` // for stats; defaults to the zone's SOA owner
+	File string `yaml:"file"`
+}
+
+// PolicyConfig holds the query types the resolver refuses and what its
+// upstream queries reveal
+type PolicyConfig struct {
+	RefuseTypes       []string `yaml:"refuse_types"`       // answered blocked_policy, e.g. TXT
+	LowercaseNames    bool     `yaml:"lowercase_names"`    // strip 0x20 case randomization before the cache and upstreams
+	QNameMinimization bool     `yaml:"qname_minimization"` // the iterative upstream sends each zone one label more than it (RFC 9156)
+}
+
+// CacheZoneConfig overrides the cache TTL bounds for a zone and its
+// subdomains; unset bounds inherit the global ones
+type CacheZoneConfig struct {
+	Zone   string        `yaml:"zone"`
+	MinTTL time.Duration `yaml:"min_ttl"`
+	MaxTTL time.Duration `yaml:"max_ttl"`
+}
+
+// TimeoutZoneConfig overrides the upstream timeout for a zone and its
+// subdomains
+type TimeoutZoneConfig struct {
+	Zone    string        `yaml:"zone"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// BogonFilterConfig holds filtering of private/reserved addresses in answers
+type BogonFilterConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	AllowDomains []string `yaml:"allow_domains"` // domains that may legitimately resolve to private space
+}
+
+// TamperDetectionConfig holds the comparison of upstream answers that flags
+// domains interfered with on some upstream's path
+type TamperDetectionConfig struct {
+	Enabled    bool    `yaml:"enabled"`
+	SampleRate float64 `yaml:"sample_rate"` // share of fresh lookups asked of every upstream; consensus compares all
+	MinSamples int     `yaml:"min_samples"` // comparisons before a domain can be flagged
+	Threshold  float64 `yaml:"threshold"`   // share of comparisons an upstream must fail to flag the domain
+	MaxDomains int     `yaml:"max_domains"` // domains tracked at once
+}
+
+// HealthCheckConfig holds the probing of upstreams that takes failing ones
+// out of rotation until they answer again
+type HealthCheckConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	Interval         time.Duration `yaml:"interval"`          // between probes of every upstream
+	ProbeDomain      string        `yaml:"probe_domain"`      // name the probes ask for
+	FailureThreshold int           `yaml:"failure_threshold"` // consecutive failures before an upstream is excluded
+	SuccessThreshold int           `yaml:"success_threshold"` // consecutive successes before it is reinstated
+}
+
+// RedisConfig holds the shared Redis cache settings
+type RedisConfig struct {
+	Addr      string `yaml:"addr"`
+	Password  string `yaml:"password"`
+	DB        int    `yaml:"db"`
+	KeyPrefix string `yaml:"key_prefix"`
 }
 
 // SecurityConfig holds security settings
 type SecurityConfig struct {
-	APIKeys           []string `yaml:"api_keys"`
-	EncryptionEnabled bool     `yaml:"encryption_enabled"`
-	EncryptionKey     string   `yaml:"encryption_key"` // 32 bytes hex for AES-256
-	RateLimitEnabled  bool     `yaml:"rate_limit_enabled"`
-	RateLimitPerSec   float64  `yaml:"rate_limit_per_sec"`
-	RateLimitBurst    int      `yaml:"rate_limit_burst"`
+	APIKeys           []string      `yaml:"api_keys"`
+	AdminKeys         []string      `yaml:"admin_keys"` // keys for /api/v1/admin/; none disables it
+	EncryptionEnabled bool          `yaml:"encryption_enabled"`
+	EncryptionKey     string        `yaml:"encryption_key"`  // 32 bytes hex for AES-256
+	EncryptionKeys    []KeyConfig   `yaml:"encryption_keys"` // further keys, selected by the request's key ID
+	CipherSuites      []string      `yaml:"cipher_suites"`   // accepted suites: aes-256-gcm, xchacha20-poly1305
+	RateLimitEnabled  bool          `yaml:"rate_limit_enabled"`
+	RateLimitPerSec   float64       `yaml:"rate_limit_per_sec"`
+	RateLimitBurst    int           `yaml:"rate_limit_burst"`
+	IdempotencyTTL    time.Duration `yaml:"idempotency_ttl"`    // how long Idempotency-Key responses are replayed
+	StrictJSON        bool          `yaml:"strict_json"`        // reject request bodies with unknown fields
+	PlaintextFallback bool          `yaml:"plaintext_fallback"` // accept unencrypted requests despite encryption_enabled
+	TrustedProxies    []string      `yaml:"trusted_proxies"`    // CIDRs allowed to set X-Forwarded-For/X-Real-IP
+	AllowedNetworks   []string      `yaml:"allowed_networks"`   // client CIDRs admitted to /api/; empty admits all
+	GeoIP             GeoIPConfig   `yaml:"geoip"`
+	Padding           PaddingConfig `yaml:"padding"`
+	Signing           SigningConfig `yaml:"signing"`
+	Sessions          SessionConfig `yaml:"sessions"`
+	Tokens            TokensConfig  `yaml:"tokens"`
+}
+
+// TokensConfig enables temporary API keys minted on the admin API, to share
+// access for a while without handing out a permanent key. Tokens are held
+// in memory by the instance that minted them.
+type TokensConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	DefaultTTL      time.Duration `yaml:"default_ttl"`        // lifetime of tokens minted without one
+	MaxTTL          time.Duration `yaml:"max_ttl"`            // longest lifetime a token may be minted with
+	RateLimitPerSec float64       `yaml:"rate_limit_per_sec"` // default and highest rate of a token
+	RateLimitBurst  int           `yaml:"rate_limit_burst"`
+	MaxActive       int           `yaml:"max_active"` // tokens alive at once
+}
+
+// SessionConfig enables per-session X25519 key exchange, so payload keys
+// have forward secrecy and a leaked encryption key can't decrypt recorded
+// traffic
+type SessionConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	Required    bool          `yaml:"required"`     // refuse queries sealed with an encryption key directly
+	TTL         time.Duration `yaml:"ttl"`          // session key lifetime
+	MaxSessions int           `yaml:"max_sessions"` // sessions held at once
+}
+
+// KeyConfig is an encryption key named by the ID clients send with
+// requests. Keeping the old and new keys here during a rotation lets clients
+// switch one at a time.
+type KeyConfig struct {
+	ID  string `yaml:"id"`
+	Key string `yaml:"key"` // 32 bytes hex for AES-256
+}
+
+// SigningConfig requires HMAC-signed requests, for integrity and replay
+// protection where no encryption key can be shared
+type SigningConfig struct {
+	Enabled bool            `yaml:"enabled"`
+	MaxSkew time.Duration   `yaml:"max_skew"` // accepted clock difference; nonces are remembered this long
+	Secrets []SigningSecret `yaml:"secrets"`
+}
+
+// SigningSecret is the HMAC secret of one API key
+type SigningSecret struct {
+	APIKey string `yaml:"api_key"`
+	Secret string `yaml:"secret"`
+}
+
+// PaddingConfig sets how encrypted responses are padded for clients that
+// pad their requests
+type PaddingConfig struct {
+	Mode      string `yaml:"mode"`       // none, block, random
+	BlockSize int    `yaml:"block_size"` // block mode: round payloads up to a multiple of this
+	MaxRandom int    `yaml:"max_random"` // random mode: up to this many extra bytes
+}
+
+// GeoIPConfig holds country-based access rules for /api/
+type GeoIPConfig struct {
+	Database         string   `yaml:"database"`          // MaxMind GeoLite2/GeoIP2 Country or City .mmdb
+	AllowedCountries []string `yaml:"allowed_countries"` // ISO codes; when set, other countries are refused
+	DeniedCountries  []string `yaml:"denied_countries"`  // ISO codes refused
+}
+
+// ClusterConfig holds peer discovery. Nodes list each other at
+// /api/v1/peers, so local proxies learn of added or moved nodes without a
+// config change.
+type ClusterConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	Self           string        `yaml:"self"`            // this node's resolve URL as clients reach it
+	Peers          []string      `yaml:"peers"`           // other nodes' resolve URLs
+	Seeds          []string      `yaml:"seeds"`           // resolve URLs of nodes this one registers with
+	Secret         string        `yaml:"secret"`          // shared by the nodes; authenticates registrations
+	APIKey         string        `yaml:"api_key"`         // key presented to seeds when registering
+	HealthInterval time.Duration `yaml:"health_interval"` // how often peers' /health is checked
+	PeerTTL        time.Duration `yaml:"peer_ttl"`        // registered nodes are dropped unless they renew within this
+}
+
+// AuditConfig holds the audit log of administrative actions: cache
+// flushes and TTL overrides, tokens minted and revoked, cluster
+// registrations and the configuration the server starts with
+type AuditConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file"` // append-only JSON lines, hash chained
+}
+
+// TenantConfig gives the API keys of one tenant (a user or family sharing
+// the server) their own upstreams, cache, rate limit and blocklist. Keys
+// in no tenant use the resolver and security settings.
+type TenantConfig struct {
+	Name            string   `yaml:"name"`               // in logs and stats; also namespaces the tenant's Redis keys
+	APIKeys         []string `yaml:"api_keys"`           // keys of the tenant, not also listed in security.api_keys
+	Upstreams       []string `yaml:"upstreams"`          // empty uses resolver.upstreams
+	RateLimitPerSec float64  `yaml:"rate_limit_per_sec"` // shared by the tenant's keys; 0 uses the security settings
+	RateLimitBurst  int      `yaml:"rate_limit_burst"`
+	Blocklist       []string `yaml:"blocklist"` // domains refused, with their subdomains
 }
 
 // LoggingConfig holds logging settings
 type LoggingConfig struct {
-	Level      string `yaml:"level"` // debug, info, warn, error
-	Format     string `yaml:"format"` // json, text
+	Level      string `yaml:"level"`       // debug, info, warn, error
+	Format     string `yaml:"format"`      // json, text
 	OutputFile string `yaml:"output_file"` // empty for stdout
+	MaxSizeMB  int    `yaml:"max_size_mb"` // rotate output_file after this size
+	MaxBackups int    `yaml:"max_backups"` // rotated files to keep
 }
 
-// Load loads configuration from a YAML file
-func Load(path string) (*Config, error) {
+// Load loads configuration from a YAML file. Values are layered: the file
+// first, then DNS_PROXY_* environment variables, then overrides
+// ("path=value", usually from -set flags), before defaults are applied.
+func Load(path string, overrides ...string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	if err := checkSchema(path, data); err != nil {
+		return nil, fmt.Errorf("invalid config file:\n%w", err)
+	}
+
 	cfg := &Config{}
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := cfg.applyOverrides(overrides); err != nil {
+		return nil, fmt.Errorf("invalid override: %w", err)
+	}
+
 	// Set defaults
 	cfg.setDefaults()
 
@@ -84,6 +356,9 @@ func (c *Config) setDefaults() {
 	if c.Server.Port == 0 {
 		c.Server.Port = 8443
 	}
+	if c.Server.HTTP3.Port == 0 {
+		c.Server.HTTP3.Port = c.Server.Port
+	}
 	if c.Server.ReadTimeout == 0 {
 		c.Server.ReadTimeout = 30 * time.Second
 	}
@@ -93,6 +368,30 @@ func (c *Config) setDefaults() {
 	if c.Server.IdleTimeout == 0 {
 		c.Server.IdleTimeout = 120 * time.Second
 	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = 30 * time.Second
+	}
+	if c.Server.Compression.MinSize == 0 {
+		c.Server.Compression.MinSize = 1024
+	}
+	if c.Server.TLSMinVersion == "" {
+		c.Server.TLSMinVersion = "1.2"
+	}
+	if c.Server.ACME.CacheDir == "" {
+		c.Server.ACME.CacheDir = "acme-cache"
+	}
+	if c.Server.ACME.Challenge == "" {
+		c.Server.ACME.Challenge = "tls-alpn-01"
+	}
+	if c.Server.ACME.HTTPAddr == "" {
+		c.Server.ACME.HTTPAddr = ":80"
+	}
+	if c.Server.ACME.DirectoryURL == "" {
+		c.Server.ACME.DirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	}
+	if c.Server.ACME.RenewBefore == 0 {
+		c.Server.ACME.RenewBefore = 30 * 24 * time.Hour
+	}
 	if len(c.Resolver.Upstreams) == 0 {
 		c.Resolver.Upstreams = []string{"8.8.8.8:53", "1.1.1.1:53", "8.8.4.4:53"}
 	}
@@ -105,29 +404,453 @@ func (c *Config) setDefaults() {
 	if c.Resolver.CacheTTL == 0 {
 		c.Resolver.CacheTTL = 5 * time.Minute
 	}
+	if c.Resolver.CacheMaxTTL == 0 {
+		c.Resolver.CacheMaxTTL = 24 * time.Hour
+	}
 	if c.Resolver.CacheMaxItems == 0 {
 		c.Resolver.CacheMaxItems = 10000
 	}
+	if c.Resolver.CacheBackend == "" {
+		c.Resolver.CacheBackend = "memory"
+	}
+	if c.Resolver.Redis.Addr == "" {
+		c.Resolver.Redis.Addr = "127.0.0.1:6379"
+	}
+	if c.Resolver.Redis.KeyPrefix == "" {
+		c.Resolver.Redis.KeyPrefix = "dns-proxy:"
+	}
+	if c.Resolver.Strategy == "" {
+		c.Resolver.Strategy = "sequential"
+	}
+	if c.Resolver.Strategy == "fastest" {
+		c.Resolver.Strategy = "race"
+	}
+	if c.Resolver.RaceCount == 0 {
+		c.Resolver.RaceCount = 3
+	}
+	if c.Resolver.Quorum == 0 {
+		c.Resolver.Quorum = 2
+	}
+	if c.Resolver.TamperDetection.SampleRate == 0 {
+		c.Resolver.TamperDetection.SampleRate = 0.05
+	}
+	if c.Resolver.TamperDetection.MinSamples == 0 {
+		c.Resolver.TamperDetection.MinSamples = 5
+	}
+	if c.Resolver.TamperDetection.Threshold == 0 {
+		c.Resolver.TamperDetection.Threshold = 0.6
+	}
+	if c.Resolver.TamperDetection.MaxDomains == 0 {
+		c.Resolver.TamperDetection.MaxDomains = 10000
+	}
+	if c.Resolver.RPZ.ReloadInterval == 0 {
+		c.Resolver.RPZ.ReloadInterval = 5 * time.Minute
+	}
+	if c.Resolver.HealthCheck.Interval == 0 {
+		c.Resolver.HealthCheck.Interval = 30 * time.Second
+	}
+	if c.Resolver.HealthCheck.ProbeDomain == "" {
+		c.Resolver.HealthCheck.ProbeDomain = "example.com"
+	}
+	if c.Resolver.HealthCheck.FailureThreshold == 0 {
+		c.Resolver.HealthCheck.FailureThreshold = 3
+	}
+	if c.Resolver.HealthCheck.SuccessThreshold == 0 {
+		c.Resolver.HealthCheck.SuccessThreshold = 2
+	}
+	if c.Resolver.AddressFamily == "" {
+		c.Resolver.AddressFamily = "auto"
+	}
 	if c.Security.RateLimitPerSec == 0 {
 		c.Security.RateLimitPerSec = 100
 	}
 	if c.Security.RateLimitBurst == 0 {
 		c.Security.RateLimitBurst = 200
 	}
+	if c.Security.IdempotencyTTL == 0 {
+		c.Security.IdempotencyTTL = 2 * time.Minute
+	}
+	if c.Security.Sessions.TTL == 0 {
+		c.Security.Sessions.TTL = time.Hour
+	}
+	if c.Security.Sessions.MaxSessions == 0 {
+		c.Security.Sessions.MaxSessions = 10000
+	}
+	if t := &c.Security.Tokens; t.Enabled {
+		if t.DefaultTTL == 0 {
+			t.DefaultTTL = 24 * time.Hour
+		}
+		if t.MaxTTL == 0 {
+			t.MaxTTL = 7 * 24 * time.Hour
+		}
+		if t.RateLimitPerSec == 0 {
+			t.RateLimitPerSec = 2
+		}
+		if t.RateLimitBurst == 0 {
+			t.RateLimitBurst = max(1, int(2*t.RateLimitPerSec))
+		}
+		if t.MaxActive == 0 {
+			t.MaxActive = 100
+		}
+	}
+	if c.Security.Signing.MaxSkew == 0 {
+		c.Security.Signing.MaxSkew = 5 * time.Minute
+	}
+	if len(c.Security.CipherSuites) == 0 {
+		c.Security.CipherSuites = []string{"aes-256-gcm", "xchacha20-poly1305"}
+	}
+	if c.Security.Padding.Mode == "" {
+		c.Security.Padding.Mode = "block"
+	}
+	if c.Security.Padding.BlockSize == 0 {
+		c.Security.Padding.BlockSize = 128
+	}
+	if c.Security.Padding.MaxRandom == 0 {
+		c.Security.Padding.MaxRandom = 256
+	}
+	if c.Cluster.HealthInterval == 0 {
+		c.Cluster.HealthInterval = 30 * time.Second
+	}
+	if c.Cluster.PeerTTL == 0 {
+		c.Cluster.PeerTTL = 10 * time.Minute
+	}
+	for i := range c.Tenants {
+		t := &c.Tenants[i]
+		if t.RateLimitPerSec > 0 && t.RateLimitBurst == 0 {
+			t.RateLimitBurst = max(1, int(2*t.RateLimitPerSec))
+		}
+	}
 	if c.Logging.Level == "" {
 		c.Logging.Level = "info"
 	}
 	if c.Logging.Format == "" {
 		c.Logging.Format = "json"
 	}
+	if c.Logging.MaxSizeMB == 0 {
+		c.Logging.MaxSizeMB = 100
+	}
+	if c.Logging.MaxBackups == 0 {
+		c.Logging.MaxBackups = 3
+	}
 }
 
 func (c *Config) validate() error {
-	if len(c.Security.APIKeys) == 0 {
+	if len(c.AllAPIKeys()) == 0 {
 		return fmt.Errorf("at least one API key is required")
 	}
-	if c.Security.EncryptionEnabled && len(c.Security.EncryptionKey) != 64 {
-		return fmt.Errorf("encryption key must be 64 hex characters (32 bytes)")
+	if c.Security.EncryptionEnabled {
+		if c.Security.EncryptionKey == "" && len(c.Security.EncryptionKeys) == 0 {
+			return fmt.Errorf("encryption requires encryption_key or encryption_keys")
+		}
+		if c.Security.EncryptionKey != "" && len(c.Security.EncryptionKey) != 64 {
+			return fmt.Errorf("encryption key must be 64 hex characters (32 bytes)")
+		}
+		for _, suite := range c.Security.CipherSuites {
+			if suite != "aes-256-gcm" && suite != "xchacha20-poly1305" {
+				return fmt.Errorf("cipher suite must be aes-256-gcm or xchacha20-poly1305, got %q", suite)
+			}
+		}
+		seen := make(map[string]bool)
+		for _, k := range c.Security.EncryptionKeys {
+			if k.ID == "" {
+				return fmt.Errorf("encryption_keys entries need an id")
+			}
+			if seen[k.ID] {
+				return fmt.Errorf("duplicate encryption key id %q", k.ID)
+			}
+			seen[k.ID] = true
+			if len(k.Key) != 64 {
+				return fmt.Errorf("encryption key %q must be 64 hex characters (32 bytes)", k.ID)
+			}
+		}
+	}
+	for _, port := range append([]int{c.Server.Port}, c.Server.ExtraPorts...) {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port: %d", port)
+		}
+	}
+	if h3 := c.Server.HTTP3; h3.Enabled {
+		if h3.Port < 0 || h3.Port > 65535 {
+			return fmt.Errorf("invalid http3 port: %d", h3.Port)
+		}
+		// QUIC has no cleartext mode
+		if !c.Server.ACME.Enabled && (c.Server.TLSCertFile == "" || c.Server.TLSKeyFile == "") {
+			return fmt.Errorf("http3 requires tls_cert_file and tls_key_file, or acme")
+		}
+	}
+	switch c.Server.TLSMinVersion {
+	case "1.2", "1.3":
+	default:
+		return fmt.Errorf("tls_min_version must be 1.2 or 1.3")
+	}
+	if c.Server.DrainPeriod < 0 || c.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("drain_period and shutdown_timeout must not be negative")
+	}
+	if c.Server.Compression.MinSize < 0 {
+		return fmt.Errorf("server compression min_size must not be negative")
+	}
+	if acme := c.Server.ACME; acme.Enabled {
+		if len(acme.Domains) == 0 {
+			return fmt.Errorf("acme requires at least one domain")
+		}
+		if c.Server.TLSCertFile != "" || c.Server.TLSKeyFile != "" {
+			return fmt.Errorf("acme and tls_cert_file/tls_key_file are mutually exclusive")
+		}
+		switch acme.Challenge {
+		case "http-01", "tls-alpn-01":
+		default:
+			return fmt.Errorf("acme challenge must be http-01 or tls-alpn-01")
+		}
+	}
+	switch c.Resolver.Strategy {
+	case "sequential", "race", "consensus":
+	default:
+		return fmt.Errorf("resolver strategy must be sequential, race, or consensus")
+	}
+	if c.Resolver.Strategy == "consensus" {
+		queried := c.Resolver.RaceCount
+		if queried > len(c.Resolver.Upstreams) {
+			queried = len(c.Resolver.Upstreams)
+		}
+		if c.Resolver.Quorum < 1 || c.Resolver.Quorum > queried {
+			return fmt.Errorf("resolver quorum must be between 1 and the number of upstreams queried (%d)", queried)
+		}
+	}
+	if c.Resolver.CacheMinTTL < 0 || c.Resolver.CacheMinTTL > c.Resolver.CacheMaxTTL {
+		return fmt.Errorf("resolver cache_min_ttl must be between 0 and cache_max_ttl")
+	}
+	for _, z := range c.Resolver.CacheZones {
+		if z.Zone == "" {
+			return fmt.Errorf("resolver cache_zones entries need a zone")
+		}
+		if z.MinTTL < 0 || z.MaxTTL < 0 || (z.MaxTTL > 0 && z.MinTTL > z.MaxTTL) {
+			return fmt.Errorf("resolver cache_zones %q: min_ttl must not exceed max_ttl", z.Zone)
+		}
+	}
+	for _, z := range c.Resolver.TimeoutZones {
+		if z.Zone == "" {
+			return fmt.Errorf("resolver timeout_zones entries need a zone")
+		}
+		if z.Timeout <= 0 {
+			return fmt.Errorf("resolver timeout_zones %q: timeout must be positive", z.Zone)
+		}
+		// A query may take a timeout per retry and one more; the answer must
+		// still get out before the server gives up on writing it
+		if total := time.Duration(c.Resolver.MaxRetries+1) * z.Timeout; total >= c.Server.WriteTimeout {
+			return fmt.Errorf("resolver timeout_zones %q: %s per attempt, %s in all with max_retries, must stay under server write_timeout (%s)", z.Zone, z.Timeout, total, c.Server.WriteTimeout)
+		}
+	}
+	if t := c.Resolver.TamperDetection; t.Enabled {
+		if len(c.Resolver.Upstreams) < 2 {
+			return fmt.Errorf("resolver tamper_detection needs at least two upstreams to compare")
+		}
+		if t.SampleRate < 0 || t.SampleRate > 1 || t.Threshold <= 0 || t.Threshold > 1 {
+			return fmt.Errorf("resolver tamper_detection sample_rate and threshold must be between 0 and 1")
+		}
+	}
+	names := make(map[string]bool)
+	for _, z := range c.Resolver.RPZ.Zones {
+		if z.File == "" {
+			return fmt.Errorf("resolver rpz zones need a file")
+		}
+		if z.Name != "" && names[z.Name] {
+			return fmt.Errorf("resolver rpz zone name %q is used twice", z.Name)
+		}
+		names[z.Name] = true
+	}
+	if c.Resolver.RPZ.ReloadInterval < 0 {
+		return fmt.Errorf("resolver rpz reload_interval must not be negative")
+	}
+	if h := c.Resolver.HealthCheck; h.Enabled {
+		if h.Interval <= 0 || h.FailureThreshold <= 0 || h.SuccessThreshold <= 0 {
+			return fmt.Errorf("resolver health_check interval, failure_threshold and success_threshold must be positive")
+		}
+	}
+	switch c.Resolver.AddressFamily {
+	case "auto", "ipv4", "ipv6", "dual":
+	default:
+		return fmt.Errorf("resolver address_family must be auto, ipv4, ipv6, or dual")
+	}
+	if p := c.Resolver.NAT64Prefix; p != "" && p != "auto" {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil || !prefix.Addr().Is6() || !slices.Contains([]int{32, 40, 48, 56, 64, 96}, prefix.Bits()) {
+			return fmt.Errorf("resolver nat64_prefix must be auto or an IPv6 /32, /40, /48, /56, /64 or /96 prefix")
+		}
+	}
+	iterative := slices.Contains(c.Resolver.Upstreams, "iterative")
+	for _, upstream := range c.Resolver.Upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil && upstream != "iterative" {
+			return fmt.Errorf("resolver upstream %q must be host:port, e.g. 8.8.8.8:53 or [2001:4860:4860::8888]:53, or iterative", upstream)
+		}
+	}
+	for _, t := range c.Tenants {
+		iterative = iterative || slices.Contains(t.Upstreams, "iterative")
+	}
+	for _, addr := range c.Resolver.RootServers {
+		if _, err := netip.ParseAddr(addr); err != nil {
+			return fmt.Errorf("resolver root server %q must be an IP address", addr)
+		}
+	}
+	if c.Resolver.Policy.QNameMinimization && !iterative {
+		return fmt.Errorf("resolver policy qname_minimization needs the iterative upstream")
+	}
+	for _, t := range c.Resolver.Policy.RefuseTypes {
+		if strings.TrimSpace(t) == "" || strings.ContainsAny(t, "+ ") {
+			return fmt.Errorf("resolver policy refuse_types: invalid type %q", t)
+		}
+	}
+	if c.Resolver.StaleWindow < 0 {
+		return fmt.Errorf("resolver stale_window must not be negative")
+	}
+	switch c.Security.Padding.Mode {
+	case "none", "block", "random":
+	default:
+		return fmt.Errorf("security padding mode must be none, block, or random")
+	}
+	if c.Security.Padding.BlockSize < 1 || c.Security.Padding.MaxRandom < 1 {
+		return fmt.Errorf("security padding block_size and max_random must be positive")
+	}
+	if t := c.Security.Tokens; t.Enabled {
+		if len(c.Security.AdminKeys) == 0 {
+			return fmt.Errorf("security tokens require admin_keys to mint them with")
+		}
+		if c.Security.Signing.Enabled {
+			return fmt.Errorf("security tokens cannot be used with signing, which needs a secret per key")
+		}
+		if t.DefaultTTL <= 0 || t.MaxTTL < t.DefaultTTL {
+			return fmt.Errorf("security tokens default_ttl must be positive and at most max_ttl")
+		}
+		if t.RateLimitPerSec <= 0 || t.RateLimitBurst <= 0 || t.MaxActive <= 0 {
+			return fmt.Errorf("security tokens rate_limit_per_sec, rate_limit_burst and max_active must be positive")
+		}
+	}
+	if c.Security.Sessions.Enabled && !c.Security.EncryptionEnabled {
+		return fmt.Errorf("security sessions require encryption_enabled")
+	}
+	if c.Security.PlaintextFallback && c.Security.Sessions.Required {
+		return fmt.Errorf("security plaintext_fallback conflicts with sessions.required")
+	}
+	if c.Security.Signing.Enabled {
+		secrets := make(map[string]bool)
+		for _, s := range c.Security.Signing.Secrets {
+			if s.Secret == "" {
+				return fmt.Errorf("security signing secrets need a secret for every api_key")
+			}
+			secrets[s.APIKey] = true
+		}
+		for _, key := range c.AllAPIKeys() {
+			if !secrets[key] {
+				return fmt.Errorf("security signing is enabled but an api key has no secret")
+			}
+		}
+		if c.Security.Signing.MaxSkew < 0 {
+			return fmt.Errorf("security signing max_skew must not be negative")
+		}
+	}
+	geo := c.Security.GeoIP
+	if (len(geo.AllowedCountries) > 0 || len(geo.DeniedCountries) > 0) && geo.Database == "" {
+		return fmt.Errorf("security geoip country rules require a database")
+	}
+	if err := c.validateCluster(); err != nil {
+		return err
+	}
+	if err := c.validateTenants(); err != nil {
+		return err
+	}
+	if c.Audit.Enabled && c.Audit.File == "" {
+		return fmt.Errorf("audit requires a file")
+	}
+	switch c.Resolver.CacheBackend {
+	case "memory", "redis":
+	default:
+		return fmt.Errorf("resolver cache_backend must be memory or redis")
+	}
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("logging level must be one of debug, info, warn, error")
+	}
+	switch c.Logging.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("logging format must be text or json")
+	}
+	return nil
+}
+
+// validateCluster checks the node URLs and that registering with seeds has
+// what it needs
+func (c *Config) validateCluster() error {
+	cl := c.Cluster
+	if !cl.Enabled {
+		return nil
+	}
+	urls := append(append([]string{}, cl.Peers...), cl.Seeds...)
+	if cl.Self != "" {
+		urls = append(urls, cl.Self)
+	}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("cluster node %q must be an http(s) resolve URL", raw)
+		}
+	}
+	if len(cl.Seeds) > 0 && (cl.Self == "" || cl.Secret == "" || cl.APIKey == "") {
+		return fmt.Errorf("cluster seeds require self, secret and api_key")
+	}
+	if cl.HealthInterval <= 0 || cl.PeerTTL <= 0 {
+		return fmt.Errorf("cluster health_interval and peer_ttl must be positive")
 	}
 	return nil
 }
+
+// validateTenants checks that tenants are named and that every API key
+// belongs to one place
+func (c *Config) validateTenants() error {
+	owner := make(map[string]string)
+	for _, key := range c.Security.APIKeys {
+		owner[key] = "security.api_keys"
+	}
+	names := make(map[string]bool)
+	for _, t := range c.Tenants {
+		if t.Name == "" {
+			return fmt.Errorf("tenants entries need a name")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tenant name %q", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.APIKeys) == 0 {
+			return fmt.Errorf("tenant %q needs at least one api key", t.Name)
+		}
+		for _, key := range t.APIKeys {
+			if other, ok := owner[key]; ok {
+				return fmt.Errorf("tenant %q: an api key is also in %s", t.Name, other)
+			}
+			owner[key] = "tenant " + strconv.Quote(t.Name)
+		}
+		for _, upstream := range t.Upstreams {
+			if _, _, err := net.SplitHostPort(upstream); err != nil && upstream != "iterative" {
+				return fmt.Errorf("tenant %q: upstream %q must be host:port or iterative", t.Name, upstream)
+			}
+		}
+		if t.RateLimitPerSec < 0 || t.RateLimitBurst < 0 {
+			return fmt.Errorf("tenant %q: rate_limit_per_sec and rate_limit_burst must not be negative", t.Name)
+		}
+		for _, domain := range t.Blocklist {
+			if strings.Trim(domain, ".") == "" {
+				return fmt.Errorf("tenant %q: empty blocklist entry", t.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// AllAPIKeys returns the keys in security.api_keys and those of every tenant
+func (c *Config) AllAPIKeys() []string {
+	keys := slices.Clone(c.Security.APIKeys)
+	for _, t := range c.Tenants {
+		keys = append(keys, t.APIKeys...)
+	}
+	return keys
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTimeoutZones(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string // substring of the error, empty when valid
+	}{
+		// The defaults allow 4 attempts in 30s
+		{"resolver:\n  timeout_zones:\n    - zone: slow.example\n      timeout: 7s\n", ""},
+		{"resolver:\n  timeout_zones:\n    - zone: slow.example\n      timeout: 15s\n", `"slow.example": 15s per attempt, 1m0s in all`},
+		{"resolver:\n  max_retries: 1\n  timeout_zones:\n    - zone: slow.example\n      timeout: 14s\n", ""},
+		{"server:\n  write_timeout: 60s\nresolver:\n  timeout_zones:\n    - zone: slow.example\n      timeout: 14s\n", ""},
+		{"resolver:\n  max_retries: 1\n  timeout_zones:\n    - zone: slow.example\n      timeout: 15s\n", "must stay under server write_timeout (30s)"},
+		{"resolver:\n  timeout_zones:\n    - zone: slow.example\n      timeout: 0s\n", "timeout must be positive"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte("security:\n  api_keys: [\"k\"]\n"+tt.yaml), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(path)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%q: %v", tt.yaml, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%q: %v, want an error containing %q", tt.yaml, err, tt.want)
+		}
+	}
+}
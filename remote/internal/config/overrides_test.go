@@ -0,0 +1,41 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOverridePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "server:\n  port: 8443\nsecurity:\n  api_keys: [\"from-file\"]\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DNS_PROXY_SERVER_PORT", "9000")
+	t.Setenv("DNS_PROXY_SECURITY_API_KEYS", "env-a, env-b")
+	t.Setenv("DNS_PROXY_RESOLVER_TIMEOUT", "2s")
+
+	cfg, err := Load(path, "server.port=9443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 9443 {
+		t.Errorf("flag should beat env: port = %d", cfg.Server.Port)
+	}
+	if len(cfg.Security.APIKeys) != 2 || cfg.Security.APIKeys[1] != "env-b" {
+		t.Errorf("env should replace file list: %v", cfg.Security.APIKeys)
+	}
+	if cfg.Resolver.Timeout != 2*time.Second {
+		t.Errorf("timeout = %v", cfg.Resolver.Timeout)
+	}
+
+	if _, err := Load(path, "server.nope=1"); err == nil {
+		t.Error("unknown key should be rejected")
+	}
+	if _, err := Load(path, "server.port=abc"); err == nil {
+		t.Error("bad value should be rejected")
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	tests := []struct {
+		name, yaml string
+		want       []string // substrings of the error, empty when valid
+	}{
+		{"valid", "server:\n  port: 8443\nresolver:\n  timeout: 5s\n  max_retries: 2\n", nil},
+		{"empty", "", nil},
+		{"integer duration", "resolver:\n  timeout: 5000000000\n", nil},
+		{"null section", "logging:\n", nil},
+		{"typo", "resolver:\n  max_retires: 2\n", []string{`config.yaml:2:3: resolver: unknown key "max_retires" (did you mean "max_retries"?)`}},
+		{"unknown section", "logs:\n  level: info\n", []string{`config.yaml:1:1: unknown key "logs"`}},
+		{"bad duration", "resolver:\n  timeout: 5 seconds\n", []string{`config.yaml:2:12: resolver.timeout: invalid duration "5 seconds"`}},
+		{"wrong type", "server:\n  port: https\n", []string{`config.yaml:2:9: server.port: expected a whole number, got "https"`}},
+		{"list expected", "security:\n  api_keys: secret\n", []string{"security.api_keys: expected a list"}},
+		{"mapping expected", "server: 8443\n", []string{"config.yaml:1:9: server: expected a mapping of settings"}},
+		{"all reported", "server:\n  prot: 1\n  host: [a]\n", []string{`unknown key "prot"`, "server.host: expected a string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSchema("config.yaml", []byte(tt.yaml))
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("no error, want %q", tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExampleConfigMatchesSchema(t *testing.T) {
+	data, err := os.ReadFile("../../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSchema("config.example.yaml", data); err != nil {
+		t.Error(err)
+	}
+}
@@ -84,3 +84,82 @@ func TestGenerateKey(t *testing.T) {
 		t.Errorf("Key should be 64 hex chars, got %d", len(key1))
 	}
 }
+
+func TestKeyring(t *testing.T) {
+	oldKey, _ := GenerateKey()
+	newKey, _ := GenerateKey()
+	ring, err := NewKeyring(map[string]string{"": oldKey, "2024-06": newKey})
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+
+	client, _ := NewKeyedCipher("2024-06", newKey)
+	encrypted, _ := client.Encrypt([]byte("hello"))
+
+	c, ok := ring.Cipher(client.ID(), client.Suite())
+	if !ok {
+		t.Fatal("key 2024-06 not found")
+	}
+	if _, err := c.Decrypt(encrypted); err != nil {
+		t.Errorf("Decrypt with the named key failed: %v", err)
+	}
+	legacy, _ := ring.Cipher("", "")
+	if _, err := legacy.Decrypt(encrypted); err == nil {
+		t.Error("expected the unnamed key to reject data sealed with another key")
+	}
+	if _, ok := ring.Cipher("retired", ""); ok {
+		t.Error("unknown key ID should not be found")
+	}
+
+	stats := ring.Stats()
+	if stats["2024-06"] != 1 || stats["default"] != 1 {
+		t.Errorf("stats = %v", stats)
+	}
+
+	if _, err := NewKeyring(map[string]string{"bad": "abcd"}); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
+
+// suiteVectors were sealed with fixed nonces by the reference AEAD
+// implementations. The local proxy's crypto package carries the same
+// vectors, so both sides are held to one wire format.
+var suiteVectors = []struct {
+	suite      string
+	ciphertext string
+}{
+	{SuiteAES256GCM, "oKGio6SlpqeoqaqrnToYQiiqa9FAX6W2fxutrhzJd3P92mBAvnpf9hqJTyOTVDpYLcFDqX6b3/KqhshoogqY"},
+	{SuiteXChaCha20Poly1305, "oKGio6SlpqeoqaqrrK2ur7CxsrO0tba3Ps5ucto8zcJDVQ/sCVHOsFfPsU/Fa+j1PzTyl4KBxBSQpdcDrM4qkQmv2KHdZYVZgAsI"},
+}
+
+const (
+	vectorKey       = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	vectorPlaintext = `{"domain":"example.com","type":"A"}`
+)
+
+func TestSuiteVectors(t *testing.T) {
+	for _, v := range suiteVectors {
+		c, err := NewSuiteCipher(v.suite, "", vectorKey)
+		if err != nil {
+			t.Fatalf("%s: %v", v.suite, err)
+		}
+		plain, err := c.Decrypt(v.ciphertext)
+		if err != nil || string(plain) != vectorPlaintext {
+			t.Errorf("%s: Decrypt = %q, %v", v.suite, plain, err)
+		}
+
+		sealed, _ := c.Encrypt([]byte(vectorPlaintext))
+		if plain, err := c.Decrypt(sealed); err != nil || string(plain) != vectorPlaintext {
+			t.Errorf("%s: round trip = %q, %v", v.suite, plain, err)
+		}
+	}
+
+	// A payload sealed under one suite must not open under the other
+	aes, _ := NewSuiteCipher(SuiteAES256GCM, "", vectorKey)
+	if _, err := aes.Decrypt(suiteVectors[1].ciphertext); err == nil {
+		t.Error("AES-256-GCM opened an XChaCha20-Poly1305 payload")
+	}
+	if _, err := NewSuiteCipher("rot13", "", vectorKey); err == nil {
+		t.Error("expected an error for an unknown suite")
+	}
+}
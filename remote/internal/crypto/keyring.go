@@ -0,0 +1,93 @@
+package crypto
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Keyring holds every key the server accepts, by key ID, in each accepted
+// cipher suite. Clients name the key they used, so a new key can be added,
+// clients moved to it one by one, and the old key retired, without a
+// coordinated switch.
+type Keyring struct {
+	ciphers map[string]map[string]*Cipher // key ID -> suite -> cipher
+	uses    map[string]*atomic.Int64
+}
+
+// NewKeyring creates a keyring from key IDs to hex-encoded keys, usable with
+// the given suites (all supported suites if none are given). The empty ID
+// holds the unnamed key used by requests that carry no key ID.
+func NewKeyring(keys map[string]string, suites ...string) (*Keyring, error) {
+	if len(suites) == 0 {
+		suites = Suites
+	}
+	k := &Keyring{
+		ciphers: make(map[string]map[string]*Cipher, len(keys)),
+		uses:    make(map[string]*atomic.Int64, len(keys)),
+	}
+	for id, hexKey := range keys {
+		k.ciphers[id] = make(map[string]*Cipher, len(suites))
+		for _, suite := range suites {
+			c, err := NewSuiteCipher(suite, id, hexKey)
+			if err != nil {
+				if id == "" {
+					return nil, err
+				}
+				return nil, fmt.Errorf("key %q: %w", id, err)
+			}
+			k.ciphers[id][c.Suite()] = c
+		}
+		k.uses[id] = new(atomic.Int64)
+	}
+	return k, nil
+}
+
+// Cipher returns the cipher for a key ID and suite and counts the key's use.
+// The empty suite is AES-256-GCM.
+func (k *Keyring) Cipher(id, suite string) (*Cipher, bool) {
+	if suite == "" {
+		suite = SuiteAES256GCM
+	}
+	c, ok := k.ciphers[id][suite]
+	if ok {
+		k.uses[id].Add(1)
+	}
+	return c, ok
+}
+
+// Supports reports whether the keyring accepts suite
+func (k *Keyring) Supports(suite string) bool {
+	if suite == "" {
+		suite = SuiteAES256GCM
+	}
+	for _, suites := range k.ciphers {
+		_, ok := suites[suite]
+		return ok
+	}
+	return false
+}
+
+// IDs returns the configured key IDs, sorted
+func (k *Keyring) IDs() []string {
+	ids := make([]string, 0, len(k.ciphers))
+	for id := range k.ciphers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Stats returns how many requests used each key, so an old key can be
+// retired once its count stops growing. The unnamed key is reported as
+// "default".
+func (k *Keyring) Stats() map[string]int64 {
+	stats := make(map[string]int64, len(k.uses))
+	for id, n := range k.uses {
+		if id == "" {
+			id = "default"
+		}
+		stats[id] = n.Load()
+	}
+	return stats
+}
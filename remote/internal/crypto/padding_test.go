@@ -0,0 +1,65 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingRoundTrip(t *testing.T) {
+	short := []byte(`{"domain":"a.io","type":"A"}`)
+	long := []byte(`{"domain":"a-much-longer-name.subdomain.example.com","type":"AAAA"}`)
+
+	testCases := []struct {
+		name    string
+		padding Padding
+		check   func(t *testing.T, a, b []byte)
+	}{
+		{"none", Padding{Mode: PadNone}, func(t *testing.T, a, b []byte) {
+			if len(a) != lengthPrefix+len(short) {
+				t.Errorf("unexpected padding: %d bytes", len(a))
+			}
+		}},
+		{"block", Padding{Mode: PadBlock, BlockSize: 128}, func(t *testing.T, a, b []byte) {
+			if len(a) != 128 || len(b) != 128 {
+				t.Errorf("lengths = %d, %d; want both 128", len(a), len(b))
+			}
+		}},
+		{"random", Padding{Mode: PadRandom, MaxRandom: 64}, func(t *testing.T, a, b []byte) {
+			if len(a) > lengthPrefix+len(short)+64 {
+				t.Errorf("padding exceeds max_random: %d bytes", len(a))
+			}
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := tc.padding.Pad(short)
+			if err != nil {
+				t.Fatalf("Pad failed: %v", err)
+			}
+			b, err := tc.padding.Pad(long)
+			if err != nil {
+				t.Fatalf("Pad failed: %v", err)
+			}
+			tc.check(t, a, b)
+
+			for _, c := range []struct{ padded, want []byte }{{a, short}, {b, long}} {
+				got, err := Unpad(c.padded)
+				if err != nil {
+					t.Fatalf("Unpad failed: %v", err)
+				}
+				if !bytes.Equal(got, c.want) {
+					t.Errorf("Unpad = %q, want %q", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpadRejectsBadLength(t *testing.T) {
+	for _, padded := range [][]byte{{0, 0}, {0, 0, 1, 0, 'x'}} {
+		if _, err := Unpad(padded); err == nil {
+			t.Errorf("Unpad(%v) succeeded, want error", padded)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sessionInfo binds derived keys to this protocol and its version
+const sessionInfo = "dns-tunnel session v1"
+
+// KeyPair is an ephemeral X25519 key pair for one session. The exchange
+// of public keys is sealed with the pre-shared key, which authenticates it;
+// the session key comes from the X25519 secret alone, so recorded traffic
+// stays private even if the pre-shared key later leaks.
+type KeyPair struct {
+	priv *ecdh.PrivateKey
+}
+
+// NewKeyPair generates an ephemeral key pair
+func NewKeyPair() (*KeyPair, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %w", err)
+	}
+	return &KeyPair{priv: priv}, nil
+}
+
+// Public returns the public key to send to the peer
+func (k *KeyPair) Public() []byte {
+	return k.priv.PublicKey().Bytes()
+}
+
+// SessionCipher derives the session cipher shared with the peer. Both
+// public keys salt the derivation, so the key belongs to this exchange
+// only; id names the session in request envelopes.
+func (k *KeyPair) SessionCipher(suite, id string, clientPub, serverPub []byte) (*Cipher, error) {
+	peerPub := clientPub
+	if bytes.Equal(peerPub, k.Public()) {
+		peerPub = serverPub
+	}
+	peer, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer session key: %w", err)
+	}
+	secret, err := k.priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("session key agreement failed: %w", err)
+	}
+
+	salt := append(append([]byte{}, clientPub...), serverPub...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(sessionInfo)), key); err != nil {
+		return nil, fmt.Errorf("failed to derive session key: %w", err)
+	}
+	return newCipher(suite, id, key)
+}
@@ -0,0 +1,100 @@
+// Package errcode names the ways a tunnelled query can fail. The same codes
+// are used by the local proxy, so one failure reads the same in API
+// responses, logs and statistics on both sides.
+package errcode
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// Code identifies a class of failure
+type Code string
+
+// Error codes shared with the local proxy
+const (
+	TunnelDown       Code = "tunnel_down"       // no API endpoint could be reached
+	EndpointAuth     Code = "endpoint_auth"     // API key or request signature rejected
+	UpstreamTimeout  Code = "upstream_timeout"  // upstream DNS servers did not answer in time
+	BlockedPolicy    Code = "blocked_policy"    // refused by an access policy
+	RateLimited      Code = "rate_limited"      // client exceeded its request rate
+	ProtocolMismatch Code = "protocol_mismatch" // envelope version, key or encryption disagreement
+)
+
+// Codes lists every code, in a fixed order
+var Codes = []Code{TunnelDown, EndpointAuth, UpstreamTimeout, BlockedPolicy, RateLimited, ProtocolMismatch}
+
+// Error is an error classified by a code
+type Error struct {
+	Code Code
+	Msg  string
+	Err  error // underlying cause, may be nil
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Msg + ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New returns an error with the given code and message
+func New(code Code, msg string) error {
+	return &Error{Code: code, Msg: msg}
+}
+
+// Wrap classifies err under code, prefixing it with msg
+func Wrap(code Code, msg string, err error) error {
+	return &Error{Code: code, Msg: msg, Err: err}
+}
+
+// Of returns the code of the outermost classified error in err's chain, or
+// the empty code if there is none
+func Of(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+var counts = func() map[Code]*atomic.Int64 {
+	m := make(map[Code]*atomic.Int64, len(Codes))
+	for _, c := range Codes {
+		m[c] = new(atomic.Int64)
+	}
+	return m
+}()
+
+// Count records one occurrence of code; unknown codes are ignored
+func Count(code Code) {
+	if n, ok := counts[code]; ok {
+		n.Add(1)
+	}
+}
+
+// Stats returns how often each code was reported
+func Stats() map[string]int64 {
+	stats := make(map[string]int64, len(counts))
+	for c, n := range counts {
+		stats[string(c)] = n.Load()
+	}
+	return stats
+}
+
+// Write sends a JSON error response carrying code and counts it
+func Write(w http.ResponseWriter, status int, code Code, msg string) {
+	Count(code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  Code   `json:"code"`
+	}{msg, code})
+}
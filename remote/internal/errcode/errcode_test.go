@@ -0,0 +1,43 @@
+package errcode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	err := fmt.Errorf("resolve: %w", Wrap(UpstreamTimeout, "all upstreams failed", errors.New("i/o timeout")))
+	if got := Of(err); got != UpstreamTimeout {
+		t.Errorf("Of = %q, want %q", got, UpstreamTimeout)
+	}
+	if err.Error() != "resolve: all upstreams failed: i/o timeout" {
+		t.Errorf("message = %q", err)
+	}
+	if got := Of(errors.New("plain")); got != "" {
+		t.Errorf("unclassified error has code %q", got)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	before := Stats()[string(RateLimited)]
+	rec := httptest.NewRecorder()
+	Write(rec, http.StatusTooManyRequests, RateLimited, "too many requests")
+
+	var body struct {
+		Error string `json:"error"`
+		Code  Code   `json:"code"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != RateLimited {
+		t.Errorf("body = %s", rec.Body)
+	}
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d", rec.Code)
+	}
+	if Stats()[string(RateLimited)] != before+1 {
+		t.Error("Write did not count the code")
+	}
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/middleware"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+// FlushRequest names the cached answers to remove
+type FlushRequest struct {
+	Suffix string `json:"suffix,omitempty"` // domain whose answers, subdomains included, are removed; empty for all
+}
+
+// FlushResponse reports how many cached answers were removed
+type FlushResponse struct {
+	Removed int `json:"removed"`
+}
+
+// TTLOverrideRequest sets or removes the cache TTL override of a name
+type TTLOverrideRequest struct {
+	Name string `json:"name"`
+	TTL  uint32 `json:"ttl"` // seconds; 0 removes the override
+}
+
+// TTLOverridesResponse lists the cache TTL overrides in seconds by name
+type TTLOverridesResponse struct {
+	Overrides map[string]uint32 `json:"overrides"`
+}
+
+// resolvers returns the handler's resolver and those of its tenants, each
+// once, for actions on every cache
+func (h *Handler) resolvers() []*resolver.Resolver {
+	all := []*resolver.Resolver{h.resolver}
+	seen := map[*resolver.Resolver]bool{h.resolver: true}
+	for _, t := range h.tenants {
+		if !seen[t.resolver] {
+			seen[t.resolver] = true
+			all = append(all, t.resolver)
+		}
+	}
+	return all
+}
+
+// FlushCache handles POST /api/v1/admin/cache/flush, which removes cached
+// answers from every cache, the tenants' included, so a changed record is
+// served without waiting out its TTL
+func (h *Handler) FlushCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, c, err := readBody(w, r)
+	if err != nil {
+		h.writeRequestError(w, err)
+		return
+	}
+	var req FlushRequest
+	if len(body) > 0 {
+		if err := c.decode(body, &req, h.strict); err != nil {
+			h.writeRequestError(w, err)
+			return
+		}
+	}
+
+	removed := 0
+	for _, res := range h.resolvers() {
+		removed += res.Flush(req.Suffix)
+	}
+	target := strings.Trim(req.Suffix, ".")
+	if target == "" {
+		target = "*"
+	}
+	h.audit.RecordRequest(r, "cache.flush", target)
+	h.logger.Info("cache flushed", "suffix", target, "removed", removed)
+	h.writeJSON(w, FlushResponse{Removed: removed}, http.StatusOK)
+}
+
+// CacheTTL handles GET /api/v1/admin/cache/ttl, which lists the TTL
+// overrides, and POST, which sets or removes one on every resolver
+func (h *Handler) CacheTTL(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, c, err := readBody(w, r)
+		if err != nil {
+			h.writeRequestError(w, err)
+			return
+		}
+		var req TTLOverrideRequest
+		if err := c.decode(body, &req, h.strict); err != nil {
+			h.writeRequestError(w, err)
+			return
+		}
+		if strings.Trim(req.Name, ".") == "" {
+			h.writeError(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		ttl := time.Duration(req.TTL) * time.Second
+		for _, res := range h.resolvers() {
+			res.SetTTLOverride(req.Name, ttl)
+		}
+		h.audit.RecordRequest(r, "cache.ttl", fmt.Sprintf("%s=%ds", strings.Trim(req.Name, "."), req.TTL))
+		h.logger.Info("cache ttl override set", "name", req.Name, "ttl", ttl)
+	default:
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	overrides := make(map[string]uint32)
+	for name, ttl := range h.resolver.TTLOverrides() {
+		overrides[name] = uint32(ttl / time.Second)
+	}
+	h.writeJSON(w, TTLOverridesResponse{Overrides: overrides}, http.StatusOK)
+}
+
+// MintTokenRequest describes a temporary API key to mint; zero fields take
+// the security.tokens defaults
+type MintTokenRequest struct {
+	Label           string   `json:"label,omitempty"`              // who or what the token is for
+	TTL             uint32   `json:"ttl,omitempty"`                // seconds until the token expires
+	RateLimitPerSec float64  `json:"rate_limit_per_sec,omitempty"` // at most security.tokens.rate_limit_per_sec
+	RateLimitBurst  int      `json:"rate_limit_burst,omitempty"`   // at most security.tokens.rate_limit_burst
+	Quota           int64    `json:"quota,omitempty"`              // requests allowed in all
+	Scopes          []string `json:"scopes,omitempty"`             // resolve, peers, tamper; default resolve
+}
+
+// TokensResponse lists the live temporary API keys, without the keys
+type TokensResponse struct {
+	Tokens []middleware.Token `json:"tokens"`
+}
+
+// EnableTokens serves the temporary API keys of t on Tokens
+func (h *Handler) EnableTokens(t *middleware.Tokens) {
+	h.tokens = t
+}
+
+// Tokens handles GET /api/v1/admin/tokens, which lists the live temporary
+// API keys, POST, which mints one and is the only time its key is shown,
+// and DELETE with an id parameter, which revokes one
+func (h *Handler) Tokens(w http.ResponseWriter, r *http.Request) {
+	if h.tokens == nil {
+		h.writeError(w, "tokens are not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, c, err := readBody(w, r)
+		if err != nil {
+			h.writeRequestError(w, err)
+			return
+		}
+		var req MintTokenRequest
+		if err := c.decode(body, &req, h.strict); err != nil {
+			h.writeRequestError(w, err)
+			return
+		}
+		tok, err := h.tokens.Mint(middleware.TokenRequest{
+			Label:           req.Label,
+			TTL:             time.Duration(req.TTL) * time.Second,
+			RateLimitPerSec: req.RateLimitPerSec,
+			RateLimitBurst:  req.RateLimitBurst,
+			Quota:           req.Quota,
+			Scopes:          req.Scopes,
+		})
+		if errors.Is(err, middleware.ErrTooManyTokens) {
+			h.writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			h.writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.audit.RecordRequest(r, "token.mint", tokenTarget(tok))
+		h.logger.Info("token minted", "id", tok.ID, "label", tok.Label, "expires_at", tok.ExpiresAt)
+		h.writeJSON(w, tok, http.StatusOK)
+		return
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !h.tokens.Revoke(id) {
+			h.writeError(w, "no such token", http.StatusNotFound)
+			return
+		}
+		h.audit.RecordRequest(r, "token.revoke", id)
+		h.logger.Info("token revoked", "id", id)
+	default:
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.writeJSON(w, TokensResponse{Tokens: h.tokens.List()}, http.StatusOK)
+}
+
+// tokenTarget describes a minted token in the audit log
+func tokenTarget(tok middleware.Token) string {
+	s := tok.ID
+	if tok.Label != "" {
+		s += " " + tok.Label
+	}
+	return s + " until " + tok.ExpiresAt.Format(time.RFC3339)
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/audit"
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+func TestAdmin(t *testing.T) {
+	newResolver := func() *resolver.Resolver {
+		return resolver.New(resolver.Config{Upstreams: []string{"127.0.0.1:1"}, Timeout: 100 * time.Millisecond, MaxRetries: 1, CacheEnabled: true, CacheMaxItems: 10})
+	}
+	h := NewHandler(newResolver(), nil, logging.Discard())
+	tenant := newResolver()
+	h.EnableTenant(NewTenant("family", tenant, nil), []string{"k1"})
+	file := filepath.Join(t.TempDir(), "audit.log")
+	log, err := audit.New(config.AuditConfig{Enabled: true, File: file}, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	h.EnableAudit(log)
+
+	tests := []struct {
+		name   string
+		handle http.HandlerFunc
+		method string
+		body   string
+		status int
+		want   string
+	}{
+		{"flush all", h.FlushCache, http.MethodPost, `{}`, http.StatusOK, `{"removed":0}`},
+		{"flush suffix", h.FlushCache, http.MethodPost, `{"suffix":"example.com"}`, http.StatusOK, `{"removed":0}`},
+		{"flush method", h.FlushCache, http.MethodGet, ``, http.StatusMethodNotAllowed, "method not allowed"},
+		{"no overrides", h.CacheTTL, http.MethodGet, ``, http.StatusOK, `{"overrides":{}}`},
+		{"set override", h.CacheTTL, http.MethodPost, `{"name":"www.example.com.","ttl":30}`, http.StatusOK, `{"overrides":{"www.example.com":30}}`},
+		{"no name", h.CacheTTL, http.MethodPost, `{"ttl":30}`, http.StatusBadRequest, "name is required"},
+		{"remove override", h.CacheTTL, http.MethodPost, `{"name":"www.example.com","ttl":0}`, http.StatusOK, `{"overrides":{}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/admin/cache", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "admin")
+			rec := httptest.NewRecorder()
+			tt.handle(rec, req)
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got %d %s, want %d %q", rec.Code, rec.Body, tt.status, tt.want)
+			}
+		})
+	}
+
+	// Overrides reach the tenants' resolvers too
+	h.CacheTTL(httptest.NewRecorder(), func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/cache/ttl", strings.NewReader(`{"name":"a.example","ttl":5}`))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}())
+	if tenant.TTLOverrides()["a.example"] != 5*time.Second {
+		t.Errorf("tenant overrides %v", tenant.TTLOverrides())
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"action":"cache.flush","target":"*"`, `"target":"example.com"`, `"action":"cache.ttl","target":"www.example.com=30s"`, `"target":"a.example=5s"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("audit log lacks %s:\n%s", want, data)
+		}
+	}
+}
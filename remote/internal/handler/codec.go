@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Body media types. A request's media type is used for its response too;
+// error responses are always JSON.
+const (
+	mediaJSON = "application/json"
+	mediaCBOR = "application/cbor"
+)
+
+// CBOR decoders with the same depth limit as JSON, taking definite-length
+// items without tags only; the strict one rejects unknown fields. Struct
+// fields go by their JSON names, so every API type has the same shape in
+// both encodings.
+var cborLenient, cborStrict = cborDecoder(cbor.ExtraDecErrorNone), cborDecoder(cbor.ExtraDecErrorUnknownField)
+
+func cborDecoder(extra cbor.ExtraDecErrorCond) cbor.DecMode {
+	dm, err := cbor.DecOptions{
+		MaxNestedLevels:   maxJSONDepth,
+		IndefLength:       cbor.IndefLengthForbidden,
+		TagsMd:            cbor.TagsForbidden,
+		ExtraReturnErrors: extra,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return dm
+}
+
+// codec reads and writes bodies of one media type. CBOR bodies carry the
+// same fields as JSON under the same names, but sealed data travels as a
+// byte string, which saves the base64 overhead and the cost of encoding
+// it on every query.
+type codec string
+
+// binaryEnvelope is EncryptedRequest and EncryptedResponse in CBOR bodies
+type binaryEnvelope struct {
+	Version int    `json:"v,omitempty"`
+	KeyID   string `json:"kid,omitempty"`
+	Suite   string `json:"alg,omitempty"`
+	Session string `json:"sid,omitempty"`
+	Data    []byte `json:"data"`
+}
+
+// decode decodes a body into v, rejecting unknown fields in strict mode
+func (c codec) decode(data []byte, v any, strict bool) error {
+	if c == mediaJSON {
+		return decodeJSON(data, v, strict)
+	}
+	return decodeCBOR(data, v, strict)
+}
+
+func (c codec) encode(v any) ([]byte, error) {
+	if c == mediaJSON {
+		return json.Marshal(v)
+	}
+	return cbor.Marshal(v)
+}
+
+// isEnvelope reports whether body is an EncryptedRequest rather than a
+// plaintext ResolveRequest, going by its data field. Malformed bodies are
+// left to the decoder to report.
+func (c codec) isEnvelope(body []byte) bool {
+	var probe struct {
+		Data any `json:"data"`
+	}
+	return c.decode(body, &probe, false) == nil && probe.Data != nil
+}
+
+// decodeEnvelope decodes an EncryptedRequest with its sealed data as bytes
+func (c codec) decodeEnvelope(body []byte, strict bool) (*binaryEnvelope, error) {
+	if c == mediaCBOR {
+		var env binaryEnvelope
+		return &env, decodeCBOR(body, &env, strict)
+	}
+
+	var req EncryptedRequest
+	if err := decodeJSON(body, &req, strict); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Data)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, CodeInvalidRequest, "data is not valid base64"}
+	}
+	return &binaryEnvelope{
+		Version: req.Version,
+		KeyID:   req.KeyID,
+		Suite:   req.Suite,
+		Session: req.Session,
+		Data:    data,
+	}, nil
+}
+
+// encodeEnvelope encodes an EncryptedResponse carrying sealed
+func (c codec) encodeEnvelope(version int, sealed []byte) ([]byte, error) {
+	if c == mediaCBOR {
+		return cbor.Marshal(binaryEnvelope{Version: version, Data: sealed})
+	}
+	return json.Marshal(EncryptedResponse{Version: version, Data: base64.StdEncoding.EncodeToString(sealed)})
+}
+
+// decodeCBOR is decodeJSON for CBOR bodies, with the same depth limit
+func decodeCBOR(data []byte, v any, strict bool) error {
+	dm := cborLenient
+	if strict {
+		dm = cborStrict
+	}
+	err := dm.Unmarshal(data, v)
+	var unknown *cbor.UnknownFieldError
+	var tooDeep *cbor.MaxNestedLevelError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &unknown):
+		return &requestError{http.StatusBadRequest, CodeUnknownField, err.Error()}
+	case errors.As(err, &tooDeep):
+		return &requestError{http.StatusBadRequest, CodeTooDeep, fmt.Sprintf("CBOR nested deeper than %d levels", maxJSONDepth)}
+	}
+	return &requestError{http.StatusBadRequest, CodeInvalidCBOR, "invalid CBOR: " + err.Error()}
+}
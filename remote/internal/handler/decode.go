@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBodyBytes bounds request bodies; a resolve request is a few
+	// hundred bytes even when encrypted
+	maxBodyBytes = 64 << 10
+	// maxJSONDepth bounds nesting; requests are flat objects
+	maxJSONDepth = 4
+	// bodyReadTimeout bounds how long a client may take to send the body
+	bodyReadTimeout = 5 * time.Second
+)
+
+// Error codes returned in ErrorResponse.Code
+const (
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeBodyTooLarge         = "body_too_large"
+	CodeInvalidJSON          = "invalid_json"
+	CodeInvalidCBOR          = "invalid_cbor"
+	CodeUnknownField         = "unknown_field"
+	CodeTooDeep              = "too_deep"
+	CodeInvalidRequest       = "invalid_request"
+)
+
+// requestError is a client error with its HTTP status and code
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// readBody reads a JSON or CBOR request body, enforcing the content type,
+// the size limit, and a read deadline. The codec of the body's media type
+// is returned with it.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, codec, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != mediaJSON && mediaType != mediaCBOR) {
+		return nil, "", &requestError{http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "content type must be application/json or application/cbor"}
+	}
+
+	// Not every writer reaches the connection (e.g. in tests); the
+	// server's read timeout still applies then
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(bodyReadTimeout))
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, "", &requestError{http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBodyBytes)}
+		}
+		return nil, "", &requestError{http.StatusBadRequest, CodeInvalidRequest, "failed to read request body"}
+	}
+	return body, codec(mediaType), nil
+}
+
+// decodeJSON decodes a single JSON object into v. Nesting deeper than
+// maxJSONDepth and trailing data are rejected; in strict mode so are
+// unknown fields.
+func decodeJSON(data []byte, v interface{}, strict bool) error {
+	if err := checkDepth(data, maxJSONDepth); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return &requestError{http.StatusBadRequest, CodeUnknownField, err.Error()}
+		}
+		return &requestError{http.StatusBadRequest, CodeInvalidJSON, "invalid JSON: " + err.Error()}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &requestError{http.StatusBadRequest, CodeInvalidJSON, "unexpected data after JSON object"}
+	}
+	return nil
+}
+
+// checkDepth rejects documents nested deeper than max before they are
+// decoded
+func checkDepth(data []byte, max int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &requestError{http.StatusBadRequest, CodeInvalidJSON, "invalid JSON: " + err.Error()}
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > max {
+				return &requestError{http.StatusBadRequest, CodeTooDeep, fmt.Sprintf("JSON nested deeper than %d levels", max)}
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
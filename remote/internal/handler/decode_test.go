@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+)
+
+func TestResolveRejectsBadBodies(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		strict      bool
+		status      int
+		code        string
+	}{
+		{"wrong content type", "text/plain", `{"domain":"example.com"}`, false, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType},
+		{"missing content type", "", `{"domain":"example.com"}`, false, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType},
+		{"too large", "application/json", `{"domain":"` + strings.Repeat("a", maxBodyBytes) + `"}`, false, http.StatusRequestEntityTooLarge, CodeBodyTooLarge},
+		{"malformed", "application/json", `{"domain":`, false, http.StatusBadRequest, CodeInvalidJSON},
+		{"trailing data", "application/json; charset=utf-8", `{"domain":"example.com"} {}`, false, http.StatusBadRequest, CodeInvalidJSON},
+		{"too deep", "application/json", `{"domain":"example.com","x":[[[[1]]]]}`, false, http.StatusBadRequest, CodeTooDeep},
+		{"unknown field strict", "application/json", `{"domain":"example.com","extra":1}`, true, http.StatusBadRequest, CodeUnknownField},
+		{"malformed CBOR", "application/cbor", "\xa1\x66domain", false, http.StatusBadRequest, CodeInvalidCBOR},
+		{"too deep CBOR", "application/cbor", "\xa1\x61x\x81\x81\x81\x81\x01", false, http.StatusBadRequest, CodeTooDeep},
+		{"unknown field strict CBOR", "application/cbor", "\xa1\x65extra\x01", true, http.StatusBadRequest, CodeUnknownField},
+	}
+
+	for _, tt := range tests {
+		h := NewHandler(nil, nil, logging.Discard())
+		if tt.strict {
+			h.EnableStrictDecoding()
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := httptest.NewRecorder()
+		h.Resolve(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		var resp ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if resp.Code != tt.code {
+			t.Errorf("%s: code %q, want %q", tt.name, resp.Code, tt.code)
+		}
+	}
+}
+
+func TestDecodeJSONLenient(t *testing.T) {
+	var req ResolveRequest
+	if err := decodeJSON([]byte(`{"domain":"example.com","extra":{"a":1}}`), &req, false); err != nil {
+		t.Fatalf("unknown fields should be ignored outside strict mode: %v", err)
+	}
+	if req.Domain != "example.com" {
+		t.Errorf("domain = %q", req.Domain)
+	}
+}
@@ -3,48 +3,138 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/mahdi/dns-proxy-remote/internal/audit"
+	"github.com/mahdi/dns-proxy-remote/internal/cluster"
 	"github.com/mahdi/dns-proxy-remote/internal/crypto"
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+	"github.com/mahdi/dns-proxy-remote/internal/middleware"
 	"github.com/mahdi/dns-proxy-remote/internal/resolver"
 )
 
 // ResolveRequest represents the incoming DNS resolution request
 type ResolveRequest struct {
-	Domain    string `json:"domain"`
-	Type      string `json:"type"`
-	Encrypted string `json:"encrypted,omitempty"` // Base64 encoded encrypted payload
+	Domain  string   `json:"domain"`
+	Type    string   `json:"type"`               // single type, or "A+AAAA" for several
+	Types   []string `json:"types,omitempty"`    // alternative to Type for several types
+	CD      bool     `json:"cd,omitempty"`       // checking disabled: passed to upstreams so they return unvalidated answers
+	AD      bool     `json:"ad,omitempty"`       // ask upstreams whether they validated the answer
+	RD      *bool    `json:"rd,omitempty"`       // recursion desired; absent means true
+	NoCache bool     `json:"no_cache,omitempty"` // resolve even if cached
 }
 
 // ResolveResponse represents the DNS resolution response
 type ResolveResponse struct {
-	Domain  string               `json:"domain"`
-	Records []resolver.DNSRecord `json:"records"`
-	Cached  bool                 `json:"cached"`
-	Error   string               `json:"error,omitempty"`
+	Domain      string               `json:"domain"`
+	Records     []resolver.DNSRecord `json:"records"`
+	Cached      bool                 `json:"cached"`
+	NegativeTTL uint32               `json:"negative_ttl,omitempty"` // seconds a response without records (or a nonexistent domain), or the types of several that had none, may be cached
+	Error       string               `json:"error,omitempty"`
+	Code        errcode.Code         `json:"code,omitempty"` // class of Error, empty when unclassified
+	AD          bool                 `json:"ad,omitempty"`   // the upstream validated the answer with DNSSEC
 }
 
-// EncryptedRequest represents an encrypted request payload
+// ErrorResponse is returned with non-200 statuses
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"` // machine-readable reason, e.g. unsupported_media_type
+}
+
+// HealthResponse is returned by the health endpoint
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Time   string                 `json:"time"`
+	Stats  map[string]interface{} `json:"stats"`
+}
+
+// TamperResponse is the per-domain tamper suspicion report, flagged
+// domains first
+type TamperResponse struct {
+	Domains []resolver.TamperSuspicion `json:"domains"`
+}
+
+// EncryptedRequest represents an encrypted request payload. A body with a
+// data field is always taken for one; any other body is a plaintext
+// ResolveRequest.
 type EncryptedRequest struct {
-	Data string `json:"data"` // Base64 encoded encrypted JSON
+	Version int    `json:"v,omitempty"`   // 1: padded plaintext, encrypted response
+	KeyID   string `json:"kid,omitempty"` // key the data is sealed with; empty for the unnamed key
+	Suite   string `json:"alg,omitempty"` // cipher suite; empty for aes-256-gcm
+	Session string `json:"sid,omitempty"` // session whose key sealed the data, replacing kid and alg
+	Data    string `json:"data"`          // Base64 encoded encrypted JSON
+}
+
+// EncryptedResponse carries an encrypted, padded ResolveResponse to clients
+// that sent a version 1 request
+type EncryptedResponse struct {
+	Version int    `json:"v"`
+	Data    string `json:"data"` // Base64 encoded encrypted JSON
 }
 
 // Handler handles DNS resolution HTTP requests
 type Handler struct {
 	resolver *resolver.Resolver
 	cipher   *crypto.Cipher
+	keys     *crypto.Keyring      // replaces cipher when set
+	sessions *sessionStore        // nil unless key exchange is enabled
+	cluster  *cluster.Registry    // nil unless clustering is enabled
+	tenants  map[string]*Tenant   // by API key; nil without tenants
+	audit    *audit.Log           // nil unless auditing is enabled
+	tokens   *middleware.Tokens   // nil unless temporary tokens are enabled
+	usage    *middleware.KeyUsage // nil unless requests are counted per key
+	padding  crypto.Padding       // applied to version 1 responses
+	strict   bool                 // reject unknown JSON fields
+	fallback bool                 // accept plaintext requests despite encryption
+	logger   *slog.Logger
+	started  time.Time
+
+	plaintext atomic.Int64 // plaintext requests accepted through fallback
+	draining  atomic.Bool  // shutting down; health checks fail
 }
 
 // NewHandler creates a new DNS resolution handler
-func NewHandler(resolver *resolver.Resolver, cipher *crypto.Cipher) *Handler {
+func NewHandler(resolver *resolver.Resolver, cipher *crypto.Cipher, logger *slog.Logger) *Handler {
 	return &Handler{
 		resolver: resolver,
 		cipher:   cipher,
+		logger:   logger,
+		started:  time.Now(),
 	}
 }
 
+// EnableKeyring accepts requests sealed with any key in k, chosen by the
+// request's key ID and cipher suite. Responses are sealed with the key and
+// suite of the request.
+func (h *Handler) EnableKeyring(k *crypto.Keyring) {
+	h.keys = k
+}
+
+// EnableStrictDecoding rejects request bodies with fields the API does not
+// define instead of ignoring them
+func (h *Handler) EnableStrictDecoding() {
+	h.strict = true
+}
+
+// EnablePadding sets the padding of encrypted responses. It only applies to
+// clients that pad their own requests (envelope version 1); others keep
+// receiving plaintext responses.
+func (h *Handler) EnablePadding(p crypto.Padding) {
+	h.padding = p
+}
+
+// EnablePlaintextFallback accepts plaintext requests while encryption is
+// enabled, answering them in plaintext. It is meant for moving clients over
+// to encryption; /health counts the requests still arriving unencrypted.
+func (h *Handler) EnablePlaintextFallback() {
+	h.fallback = true
+}
+
 // Resolve handles POST /api/v1/resolve
 func (h *Handler) Resolve(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -52,35 +142,38 @@ func (h *Handler) Resolve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req ResolveRequest
-
-	// Handle encrypted payload if cipher is configured
-	if h.cipher != nil {
-		var encReq EncryptedRequest
-		if err := json.NewDecoder(r.Body).Decode(&encReq); err != nil {
-			h.writeError(w, "invalid request body", http.StatusBadRequest)
-			return
-		}
+	body, c, err := readBody(w, r)
+	if err != nil {
+		h.writeRequestError(w, err)
+		return
+	}
 
-		if encReq.Data == "" {
-			h.writeError(w, "encrypted data required when encryption is enabled", http.StatusBadRequest)
-			return
-		}
+	var req ResolveRequest
+	version := 0
+	var cipher *crypto.Cipher
 
-		decrypted, err := h.cipher.Decrypt(encReq.Data)
-		if err != nil {
-			h.writeError(w, "decryption failed", http.StatusBadRequest)
-			return
-		}
-		if err := json.Unmarshal(decrypted, &req); err != nil {
-			h.writeError(w, "invalid decrypted payload", http.StatusBadRequest)
-			return
-		}
-	} else {
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			h.writeError(w, "invalid request body", http.StatusBadRequest)
+	encryption := h.cipher != nil || h.keys != nil
+	switch {
+	case c.isEnvelope(body) && !encryption:
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "encryption is not enabled")
+		return
+	case c.isEnvelope(body):
+		var decrypted []byte
+		var ok bool
+		if decrypted, cipher, version, ok = h.openEnvelope(w, r, c, body, true); !ok {
 			return
 		}
+		body = decrypted
+	case encryption && !h.fallback:
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "encrypted data required when encryption is enabled")
+		return
+	case encryption:
+		h.plaintext.Add(1)
+		h.logger.Debug("plaintext request accepted by fallback", "remote", r.RemoteAddr)
+	}
+	if err := c.decode(body, &req, h.strict); err != nil {
+		h.writeRequestError(w, err)
+		return
 	}
 
 	// Validate request
@@ -89,43 +182,253 @@ func (h *Handler) Resolve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Default to A record if not specified
-	recordType := resolver.TypeA
-	if req.Type != "" {
-		recordType = resolver.RecordType(strings.ToUpper(req.Type))
+	recordTypes := requestTypes(&req)
+
+	res := h.resolver
+	if tenant := h.tenantOf(r); tenant != nil {
+		tenant.queries.Add(1)
+		if tenant.Blocks(req.Domain) {
+			tenant.refused.Add(1)
+			errcode.Count(errcode.BlockedPolicy)
+			h.logger.Info("domain blocklisted", "tenant", tenant.Name, "domain", req.Domain, "code", errcode.BlockedPolicy)
+			h.writeResult(w, ResolveResponse{
+				Domain: req.Domain,
+				Error:  "blocked by tenant policy",
+				Code:   errcode.BlockedPolicy,
+			}, c, cipher, version)
+			return
+		}
+		res = tenant.resolver
 	}
 
-	// Resolve DNS
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	// Resolve DNS, for as long as the domain's zone timeout allows
+	ctx, cancel := context.WithTimeout(resolver.WithQueryFlags(r.Context(), queryFlags(&req)), res.QueryTimeout(req.Domain))
 	defer cancel()
 
-	result, err := h.resolver.Resolve(ctx, req.Domain, recordType)
+	result, err := res.ResolveMulti(ctx, req.Domain, recordTypes)
 	if err != nil {
-		h.writeJSON(w, ResolveResponse{
+		code := errcode.Of(err)
+		errcode.Count(code)
+		h.logger.Info("resolution failed", "domain", req.Domain, "types", recordTypes, "code", code, "error", err)
+		resp := ResolveResponse{
 			Domain: req.Domain,
 			Error:  err.Error(),
-		}, http.StatusOK)
+			Code:   code,
+		}
+		var nx *resolver.NXDomainError
+		if errors.As(err, &nx) {
+			resp.NegativeTTL = nx.TTL
+		}
+		h.writeResult(w, resp, c, cipher, version)
+		return
+	}
+
+	h.writeResult(w, ResolveResponse{
+		Domain:      result.Domain,
+		Records:     result.Records,
+		Cached:      result.Cached,
+		NegativeTTL: result.NegativeTTL,
+		AD:          result.AuthenticatedData,
+	}, c, cipher, version)
+}
+
+// supportsSuite reports whether requests sealed with suite can be decrypted
+func (h *Handler) supportsSuite(suite string) bool {
+	if h.keys != nil {
+		return h.keys.Supports(suite)
+	}
+	if suite == "" {
+		suite = crypto.SuiteAES256GCM
+	}
+	return suite == h.cipher.Suite()
+}
+
+// openEnvelope decrypts an EncryptedRequest body and returns the plaintext
+// with the cipher that opened it, which must also seal the response. Sealed
+// requests name either a session or a pre-shared key; sessions are only
+// accepted when withSession is set. On failure the error response has been
+// written and ok is false.
+func (h *Handler) openEnvelope(w http.ResponseWriter, r *http.Request, c codec, body []byte, withSession bool) (plain []byte, cipher *crypto.Cipher, version int, ok bool) {
+	encReq, err := c.decodeEnvelope(body, h.strict)
+	if err != nil {
+		h.writeRequestError(w, err)
+		return nil, nil, 0, false
+	}
+
+	if len(encReq.Data) == 0 {
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "encrypted data required when encryption is enabled")
+		return nil, nil, 0, false
+	}
+
+	if encReq.Version > crypto.PaddingVersion {
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "unsupported envelope version")
+		return nil, nil, 0, false
+	}
+
+	switch {
+	case encReq.Session != "":
+		if withSession {
+			cipher, ok = h.sessions.get(encReq.Session)
+		}
+		if !ok {
+			errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "unknown session")
+			return nil, nil, 0, false
+		}
+	case withSession && h.sessions != nil && h.sessions.required:
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "session required")
+		return nil, nil, 0, false
+	case !h.supportsSuite(encReq.Suite):
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "unsupported cipher suite")
+		return nil, nil, 0, false
+	case h.keys != nil:
+		if cipher, ok = h.keys.Cipher(encReq.KeyID, encReq.Suite); !ok {
+			h.logger.Warn("unknown encryption key", "remote", r.RemoteAddr, "key_id", encReq.KeyID, "code", errcode.ProtocolMismatch)
+			errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "unknown key id")
+			return nil, nil, 0, false
+		}
+	default:
+		cipher = h.cipher
+	}
+
+	plain, err = cipher.Open(encReq.Data)
+	if err != nil {
+		h.logger.Warn("decryption failed", "remote", r.RemoteAddr, "key_id", encReq.KeyID, "session", encReq.Session, "code", errcode.ProtocolMismatch, "error", err)
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "decryption failed")
+		return nil, nil, 0, false
+	}
+	if encReq.Version == crypto.PaddingVersion {
+		if plain, err = crypto.Unpad(plain); err != nil {
+			errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "invalid padding")
+			return nil, nil, 0, false
+		}
+	}
+	return plain, cipher, encReq.Version, true
+}
+
+// writeResult sends a result in the request's media type, encrypted with
+// the request's cipher and padded when the request used envelope version 1
+func (h *Handler) writeResult(w http.ResponseWriter, resp any, c codec, cipher *crypto.Cipher, version int) {
+	data, err := c.encode(resp)
+	if err == nil && version >= crypto.PaddingVersion {
+		var padded, sealed []byte
+		if padded, err = h.padding.Pad(data); err == nil {
+			if sealed, err = cipher.Seal(padded); err == nil {
+				data, err = c.encodeEnvelope(version, sealed)
+			}
+		}
+	}
+	if err != nil {
+		h.logger.Error("failed to encode response", "error", err)
+		h.writeError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	h.writeJSON(w, ResolveResponse{
-		Domain:  result.Domain,
-		Records: result.Records,
-		Cached:  result.Cached,
-	}, http.StatusOK)
+	w.Header().Set("Content-Type", string(c))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// requestTypes returns the record types asked for, defaulting to A.
+// Types may come from the Types list or a "+"-joined Type such as "A+AAAA".
+func requestTypes(req *ResolveRequest) []resolver.RecordType {
+	names := req.Types
+	if len(names) == 0 && req.Type != "" {
+		names = strings.Split(req.Type, "+")
+	}
+
+	seen := make(map[resolver.RecordType]bool)
+	var types []resolver.RecordType
+	for _, name := range names {
+		rt := resolver.RecordType(strings.ToUpper(strings.TrimSpace(name)))
+		if rt == "" || seen[rt] {
+			continue
+		}
+		seen[rt] = true
+		types = append(types, rt)
+	}
+
+	// Default to A record if not specified
+	if len(types) == 0 {
+		types = []resolver.RecordType{resolver.TypeA}
+	}
+	return types
+}
+
+// queryFlags returns the header bits the request asks upstreams to be
+// queried with
+func queryFlags(req *ResolveRequest) resolver.QueryFlags {
+	return resolver.QueryFlags{
+		CheckingDisabled:  req.CD,
+		AuthenticatedData: req.AD,
+		NoRecursion:       req.RD != nil && !*req.RD,
+		NoCache:           req.NoCache,
+	}
 }
 
 // Health handles GET /health
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
-	h.writeJSON(w, map[string]interface{}{
-		"status": "ok",
-		"time":   time.Now().UTC().Format(time.RFC3339),
-		"stats":  h.resolver.Stats(),
-	}, http.StatusOK)
+	stats := h.resolver.Stats()
+	if h.keys != nil {
+		// Per-key request counts show when a rotated-out key can be removed
+		stats["key_uses"] = h.keys.Stats()
+	}
+	stats["errors"] = errcode.Stats()
+	if h.sessions != nil {
+		stats["sessions"] = h.sessions.len()
+	}
+	if h.fallback {
+		stats["plaintext_requests"] = h.plaintext.Load()
+	}
+	if h.tenants != nil {
+		stats["tenants"] = h.tenantStats()
+	}
+	if h.tokens != nil {
+		stats["tokens"] = h.tokens.Stats()
+	}
+	status, code := "ok", http.StatusOK
+	if h.draining.Load() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+	h.writeJSON(w, HealthResponse{
+		Status: status,
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Stats:  stats,
+	}, code)
+}
+
+// Drain makes health checks fail with status "draining", so load balancers
+// and local proxies move to other servers before this one shuts down.
+// Queries are still answered.
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// Tamper handles GET /api/v1/tamper
+func (h *Handler) Tamper(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := h.resolver.TamperReport()
+	if report == nil {
+		h.writeError(w, "tamper detection is not enabled", http.StatusNotFound)
+		return
+	}
+	h.writeJSON(w, TamperResponse{Domains: report}, http.StatusOK)
 }
 
 func (h *Handler) writeError(w http.ResponseWriter, message string, status int) {
-	h.writeJSON(w, map[string]string{"error": message}, status)
+	h.writeJSON(w, ErrorResponse{Error: message}, status)
+}
+
+// writeRequestError reports a body decoding failure with its status and code
+func (h *Handler) writeRequestError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		h.writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.writeJSON(w, ErrorResponse{Error: reqErr.message, Code: reqErr.code}, reqErr.status)
 }
 
 func (h *Handler) writeJSON(w http.ResponseWriter, data interface{}, status int) {
@@ -0,0 +1,410 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-remote/internal/crypto"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+	"github.com/mahdi/dns-proxy-remote/internal/middleware"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+func TestResolvePaddedEnvelope(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	cipher, err := crypto.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resolver.New(resolver.Config{
+		Upstreams:  []string{"127.0.0.1:1"},
+		Timeout:    100 * time.Millisecond,
+		MaxRetries: 1,
+	})
+	h := NewHandler(res, cipher, logging.Discard())
+	h.EnablePadding(crypto.Padding{Mode: crypto.PadBlock, BlockSize: 256})
+
+	post := func(env EncryptedRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(env)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Resolve(rec, req)
+		return rec
+	}
+	seal := func(p crypto.Padding) string {
+		padded, _ := p.Pad([]byte(`{"domain":"padded.test","type":"A"}`))
+		data, _ := cipher.Encrypt(padded)
+		return data
+	}
+
+	t.Run("version 1", func(t *testing.T) {
+		rec := post(EncryptedRequest{Version: 1, Data: seal(crypto.Padding{Mode: crypto.PadBlock, BlockSize: 128})})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var env EncryptedResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil || env.Version != 1 {
+			t.Fatalf("expected encrypted v1 response, got %s", rec.Body)
+		}
+		padded, err := cipher.Decrypt(env.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(padded)%256 != 0 {
+			t.Errorf("response plaintext is %d bytes, not a multiple of 256", len(padded))
+		}
+		plain, _ := crypto.Unpad(padded)
+		var resp ResolveResponse
+		if err := json.Unmarshal(plain, &resp); err != nil || resp.Domain != "padded.test" {
+			t.Errorf("decrypted response = %s", plain)
+		}
+	})
+
+	t.Run("version 0 stays plaintext", func(t *testing.T) {
+		data, _ := cipher.Encrypt([]byte(`{"domain":"legacy.test","type":"A"}`))
+		rec := post(EncryptedRequest{Data: data})
+		var resp ResolveResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Domain != "legacy.test" {
+			t.Errorf("legacy response = %s", rec.Body)
+		}
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		rec := post(EncryptedRequest{Version: 2, Data: seal(crypto.Padding{})})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want 400", rec.Code)
+		}
+	})
+}
+
+func TestResolveKeyring(t *testing.T) {
+	oldKey, _ := crypto.GenerateKey()
+	newKey, _ := crypto.GenerateKey()
+	ring, err := crypto.NewKeyring(map[string]string{"": oldKey, "next": newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := resolver.New(resolver.Config{
+		Upstreams:  []string{"127.0.0.1:1"},
+		Timeout:    100 * time.Millisecond,
+		MaxRetries: 1,
+	})
+	h := NewHandler(res, nil, logging.Discard())
+	h.EnableKeyring(ring)
+
+	post := func(kid, key string) *httptest.ResponseRecorder {
+		c, _ := crypto.NewKeyedCipher(kid, key)
+		padded, _ := crypto.Padding{}.Pad([]byte(`{"domain":"rotate.test","type":"A"}`))
+		data, _ := c.Encrypt(padded)
+		body, _ := json.Marshal(EncryptedRequest{Version: 1, KeyID: c.ID(), Data: data})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Resolve(rec, req)
+		return rec
+	}
+
+	rec := post("next", newKey)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var env EncryptedResponse
+	json.Unmarshal(rec.Body.Bytes(), &env)
+	next, _ := crypto.NewCipher(newKey)
+	if _, err := next.Decrypt(env.Data); err != nil {
+		t.Errorf("response not sealed with the request's key: %v", err)
+	}
+
+	if rec := post("", oldKey); rec.Code != http.StatusOK {
+		t.Errorf("unnamed key: status %d", rec.Code)
+	}
+	if rec := post("retired", oldKey); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown key id: status %d, want 400", rec.Code)
+	}
+	if rec := post("next", oldKey); rec.Code != http.StatusBadRequest {
+		t.Errorf("wrong key for id: status %d, want 400", rec.Code)
+	}
+}
+
+func TestResolveCipherSuites(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	ring, err := crypto.NewKeyring(map[string]string{"": key}, crypto.SuiteXChaCha20Poly1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(nil, nil, logging.Discard())
+	h.EnableKeyring(ring)
+
+	post := func(suite string) *httptest.ResponseRecorder {
+		c, _ := crypto.NewSuiteCipher(suite, "", key)
+		data, _ := c.Encrypt([]byte(`{"domain":""}`))
+		body, _ := json.Marshal(EncryptedRequest{Suite: suite, Data: data})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Resolve(rec, req)
+		return rec
+	}
+
+	// The empty domain is refused only after the payload was decrypted
+	rec := post(crypto.SuiteXChaCha20Poly1305)
+	if !strings.Contains(rec.Body.String(), "domain is required") {
+		t.Errorf("xchacha20-poly1305: %d %s", rec.Code, rec.Body)
+	}
+	rec = post("")
+	if !strings.Contains(rec.Body.String(), "unsupported cipher suite") {
+		t.Errorf("disabled suite: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSessionHandshake(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	psk, _ := crypto.NewCipher(key)
+	h := NewHandler(nil, psk, logging.Discard())
+	h.EnableSessions(time.Hour, 1, true)
+
+	post := func(handle http.HandlerFunc, env EncryptedRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(env)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		return rec
+	}
+	seal := func(c *crypto.Cipher, plain string) string {
+		padded, _ := crypto.Padding{}.Pad([]byte(plain))
+		data, _ := c.Encrypt(padded)
+		return data
+	}
+
+	kp, _ := crypto.NewKeyPair()
+	hello, _ := json.Marshal(SessionRequest{PublicKey: kp.Public()})
+	rec := post(h.Session, EncryptedRequest{Version: 1, Data: seal(psk, string(hello))})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("handshake: status %d: %s", rec.Code, rec.Body)
+	}
+	var env EncryptedResponse
+	json.Unmarshal(rec.Body.Bytes(), &env)
+	padded, err := psk.Decrypt(env.Data)
+	if err != nil {
+		t.Fatalf("handshake response not sealed with the pre-shared key: %v", err)
+	}
+	plain, _ := crypto.Unpad(padded)
+	var sess SessionResponse
+	json.Unmarshal(plain, &sess)
+	sc, err := kp.SessionCipher(psk.Suite(), sess.ID, kp.Public(), sess.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty domain is refused only after the payload was decrypted
+	rec = post(h.Resolve, EncryptedRequest{Version: 1, Session: sess.ID, Data: seal(sc, `{"domain":""}`)})
+	if !strings.Contains(rec.Body.String(), "domain is required") {
+		t.Errorf("session request: %d %s", rec.Code, rec.Body)
+	}
+	rec = post(h.Resolve, EncryptedRequest{Version: 1, Session: sess.ID, Data: seal(psk, `{"domain":""}`)})
+	if rec.Code != http.StatusBadRequest || strings.Contains(rec.Body.String(), "domain is required") {
+		t.Errorf("pre-shared key under a session: %d %s", rec.Code, rec.Body)
+	}
+	rec = post(h.Resolve, EncryptedRequest{Version: 1, Session: "forgotten", Data: seal(sc, `{"domain":""}`)})
+	if !strings.Contains(rec.Body.String(), "unknown session") {
+		t.Errorf("unknown session: %d %s", rec.Code, rec.Body)
+	}
+	rec = post(h.Resolve, EncryptedRequest{Version: 1, Data: seal(psk, `{"domain":""}`)})
+	if !strings.Contains(rec.Body.String(), "session required") {
+		t.Errorf("required mode: %d %s", rec.Code, rec.Body)
+	}
+
+	rec = post(h.Session, EncryptedRequest{Version: 1, Data: seal(psk, string(hello))})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("full store: status %d, want 503", rec.Code)
+	}
+}
+
+func TestResolveEnvelopeDetection(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	cipher, _ := crypto.NewCipher(key)
+	sealed, _ := cipher.Encrypt([]byte(`{"domain":""}`))
+	envelope, _ := json.Marshal(EncryptedRequest{Data: sealed})
+	plaintext := `{"domain":""}`
+
+	post := func(h *Handler, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Resolve(rec, req)
+		return rec
+	}
+
+	// "domain is required" shows the body got as far as the resolve request
+	tests := []struct {
+		name     string
+		cipher   *crypto.Cipher
+		fallback bool
+		body     string
+		want     string
+	}{
+		{"encrypted", cipher, false, string(envelope), "domain is required"},
+		{"plaintext refused", cipher, false, plaintext, "encrypted data required"},
+		{"plaintext fallback", cipher, true, plaintext, "domain is required"},
+		{"envelope fallback", cipher, true, string(envelope), "domain is required"},
+		{"no encryption", nil, false, plaintext, "domain is required"},
+		{"envelope without encryption", nil, false, string(envelope), "encryption is not enabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(nil, tt.cipher, logging.Discard())
+			if tt.fallback {
+				h.EnablePlaintextFallback()
+			}
+			rec := post(h, tt.body)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got %d %s, want %q", rec.Code, rec.Body, tt.want)
+			}
+			if tt.fallback && tt.body == plaintext && h.plaintext.Load() != 1 {
+				t.Errorf("plaintext requests = %d, want 1", h.plaintext.Load())
+			}
+		})
+	}
+}
+
+func TestResolveCBOR(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	c, _ := crypto.NewCipher(key)
+	h := NewHandler(nil, c, logging.Discard())
+
+	padded, _ := crypto.Padding{}.Pad(mustCBOR(t, ResolveRequest{Domain: ""}))
+	sealed, _ := c.Seal(padded)
+	body := mustCBOR(t, binaryEnvelope{Version: 1, Data: sealed})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/cbor")
+	rec := httptest.NewRecorder()
+	h.Resolve(rec, req)
+
+	// The empty domain is refused only after the payload was decrypted
+	if !strings.Contains(rec.Body.String(), "domain is required") {
+		t.Errorf("CBOR envelope: %d %q", rec.Code, rec.Body)
+	}
+
+	// Results are written in the media type of the request
+	rec = httptest.NewRecorder()
+	h.writeResult(rec, ResolveResponse{Domain: "cbor.test"}, mediaCBOR, c, 1)
+	if ct := rec.Header().Get("Content-Type"); ct != mediaCBOR {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var env binaryEnvelope
+	if err := cbor.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	padded, err := c.Open(env.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := crypto.Unpad(padded)
+	var resp ResolveResponse
+	if err := cbor.Unmarshal(plain, &resp); err != nil || resp.Domain != "cbor.test" {
+		t.Errorf("decoded response = %+v, %v", resp, err)
+	}
+}
+
+func mustCBOR(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := cbor.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStats(t *testing.T) {
+	newResolver := func() *resolver.Resolver {
+		return resolver.New(resolver.Config{Upstreams: []string{"127.0.0.1:1"}, Timeout: 100 * time.Millisecond, MaxRetries: 1, CacheEnabled: true, CacheMaxItems: 10})
+	}
+	h := NewHandler(newResolver(), nil, logging.Discard())
+	tenant := newResolver()
+	h.EnableTenant(NewTenant("family", tenant, nil), []string{"k1"})
+	usage := middleware.NewKeyUsage()
+	h.EnableKeyUsage(usage)
+
+	// Failed lookups still count as queries, misses and upstream failures
+	h.resolver.Resolve(context.Background(), "a.example", resolver.TypeA)
+	tenant.Resolve(context.Background(), "b.example", resolver.TypeAAAA)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil)
+	req.Header.Set("X-API-Key", "k1")
+	rec := httptest.NewRecorder()
+	usage.Middleware(http.HandlerFunc(h.Stats)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var stats StatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Queries["A"] != 1 || stats.Queries["AAAA"] != 1 {
+		t.Errorf("queries = %v", stats.Queries)
+	}
+	if stats.Cache.Misses != 2 || stats.Cache.HitRatio != 0 {
+		t.Errorf("cache = %+v", stats.Cache)
+	}
+	if u := stats.Upstreams["127.0.0.1:1"]; u.Failures != 2 {
+		t.Errorf("upstream = %+v", u)
+	}
+	if k := stats.Keys[middleware.KeyFingerprint("k1")]; k.Requests != 1 {
+		t.Errorf("keys = %v", stats.Keys)
+	}
+	if stats.Runtime.Goroutines == 0 || stats.Runtime.GoVersion == "" {
+		t.Errorf("runtime = %+v", stats.Runtime)
+	}
+}
+
+func TestResolveZoneTimeout(t *testing.T) {
+	// An upstream slower than the default timeout but within the zone's
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(200 * time.Millisecond)
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		w.WriteMsg(resp)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	res := resolver.New(resolver.Config{
+		Upstreams:    []string{pc.LocalAddr().String()},
+		Timeout:      50 * time.Millisecond,
+		MaxRetries:   1,
+		ZoneTimeouts: []resolver.ZoneTimeout{{Zone: "slow-cctld.example", Timeout: 400 * time.Millisecond}},
+	})
+	h := NewHandler(res, nil, logging.Discard())
+
+	for domain, answered := range map[string]bool{"www.slow-cctld.example": true, "www.example.com": false} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(`{"domain":"`+domain+`","type":"A"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Resolve(rec, req)
+
+		var resp ResolveResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if got := resp.Error == "" && len(resp.Records) == 1; got != answered {
+			t.Errorf("%s: %d %s, answered %v want %v", domain, rec.Code, rec.Body, got, answered)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+	"github.com/mahdi/dns-proxy-remote/internal/middleware"
+	"github.com/mahdi/dns-proxy-remote/internal/openapi"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+var (
+	specOnce sync.Once
+	spec     map[string]any
+)
+
+// OpenAPISpec returns the OpenAPI 3 description of the API, generated from
+// the handler request and response types. The obfuscated /api/v1/data alias
+// is deliberately left out.
+func OpenAPISpec() map[string]any {
+	specOnce.Do(func() {
+		g := openapi.NewGenerator()
+		g.Enum(reflect.TypeOf(resolver.RecordType("")),
+			string(resolver.TypeA), string(resolver.TypeAAAA), string(resolver.TypeCNAME),
+			string(resolver.TypeMX), string(resolver.TypeTXT), string(resolver.TypeNS),
+			string(resolver.TypePTR))
+		codes := make([]string, len(errcode.Codes))
+		for i, c := range errcode.Codes {
+			codes[i] = string(c)
+		}
+		g.Enum(reflect.TypeOf(errcode.Code("")), codes...)
+
+		jsonBody := func(schema map[string]any) map[string]any {
+			return map[string]any{"content": map[string]any{"application/json": map[string]any{"schema": schema}}}
+		}
+		// API bodies may also be CBOR, with the same fields and data as a
+		// byte string; the response uses the media type of the request
+		apiBody := func(schema map[string]any) map[string]any {
+			return map[string]any{"content": map[string]any{
+				mediaJSON: map[string]any{"schema": schema},
+				mediaCBOR: map[string]any{"schema": schema},
+			}}
+		}
+		response := func(description string, schema map[string]any) map[string]any {
+			r := jsonBody(schema)
+			r["description"] = description
+			return r
+		}
+		apiResponse := func(description string, schema map[string]any) map[string]any {
+			r := apiBody(schema)
+			r["description"] = description
+			return r
+		}
+		errorResponse := g.Ref(ErrorResponse{})
+
+		spec = map[string]any{
+			"openapi": "3.0.3",
+			"info": map[string]any{
+				"title":   "DNS Proxy Remote API",
+				"version": "1.0.0",
+			},
+			"paths": map[string]any{
+				"/api/v1/resolve": map[string]any{
+					"post": map[string]any{
+						"operationId": "resolve",
+						"summary":     "Resolve a domain name",
+						"description": "Bodies with a data field are EncryptedRequests whose data decrypts to a ResolveRequest; others are plaintext ResolveRequests. With encryption enabled plaintext is refused unless security.plaintext_fallback is set, and without it envelopes are refused (protocol_mismatch). Version 1 envelopes carry a length-prefixed, padded plaintext and are answered with an EncryptedResponse padded the same way. CBOR bodies (application/cbor) are answered in CBOR, and their sealed data is a byte string that decrypts to CBOR.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"requestBody": apiBody(map[string]any{
+							"oneOf": []any{g.Ref(ResolveRequest{}), g.Ref(EncryptedRequest{})},
+						}),
+						"responses": map[string]any{
+							"200": apiResponse("Resolution result; failures are reported in the error field", map[string]any{
+								"oneOf": []any{g.Ref(ResolveResponse{}), g.Ref(EncryptedResponse{})},
+							}),
+							"400": response("Malformed request", errorResponse),
+							"413": response("Request body too large", errorResponse),
+							"415": response("Content type is not application/json or application/cbor", errorResponse),
+							"401": response("Missing or invalid API key", errorResponse),
+							"429": response("Rate limit exceeded", errorResponse),
+						},
+					},
+				},
+				"/api/v1/session": map[string]any{
+					"post": map[string]any{
+						"operationId": "session",
+						"summary":     "Open a forward-secret session",
+						"description": "X25519 key exchange. The body is a version 1 EncryptedRequest sealed with a pre-shared key whose data decrypts to a SessionRequest; the EncryptedResponse decrypts to a SessionResponse. Both sides derive the session key with HKDF-SHA256 and later requests name the session in sid. Returns 404 when sessions are disabled.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"requestBody": apiBody(g.Ref(EncryptedRequest{})),
+						"responses": map[string]any{
+							"200": apiResponse("Sealed SessionResponse", g.Ref(EncryptedResponse{})),
+							"400": response("Malformed or unauthenticated key exchange", errorResponse),
+							"401": response("Missing or invalid API key", errorResponse),
+							"404": response("Sessions are not enabled", errorResponse),
+						},
+						"x-sealed-request":  g.Ref(SessionRequest{}),
+						"x-sealed-response": g.Ref(SessionResponse{}),
+					},
+				},
+				"/api/v1/tamper": map[string]any{
+					"get": map[string]any{
+						"operationId": "tamper",
+						"summary":     "Domains whose upstream answers suggest interference",
+						"description": "Domains where an upstream answered differently from the others, or timed out while they answered, in lookups compared across upstreams. A domain is suspected once its worst upstream fails the comparison often enough. Returns 404 unless resolver.tamper_detection is enabled.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"responses": map[string]any{
+							"200": response("Tamper suspicion report", g.Ref(TamperResponse{})),
+							"401": response("Missing or invalid API key", errorResponse),
+							"404": response("Tamper detection is not enabled", errorResponse),
+						},
+					},
+				},
+				"/api/v1/stats": map[string]any{
+					"get": map[string]any{
+						"operationId": "stats",
+						"summary":     "Server counters",
+						"description": "Queries by record type, cache hits and misses, successes, failures and average latency by upstream, requests by API key fingerprint and process runtime figures, all since the server started and summed over the tenants' resolvers, for monitoring without Prometheus.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"responses": map[string]any{
+							"200": response("Server counters", g.Ref(StatsResponse{})),
+							"401": response("Missing or invalid API key", errorResponse),
+						},
+					},
+				},
+				"/api/v1/peers": map[string]any{
+					"get": map[string]any{
+						"operationId": "peers",
+						"summary":     "Nodes of the cluster",
+						"description": "Configured and registered nodes by resolve URL, each with the result of this node's last health check of it; this node comes first unless it is draining. Local proxies add the nodes to their endpoints. Returns 404 unless cluster is enabled.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"responses": map[string]any{
+							"200": response("Cluster nodes", g.Ref(PeersResponse{})),
+							"401": response("Missing or invalid API key", errorResponse),
+							"404": response("Clustering is not enabled", errorResponse),
+						},
+					},
+					"post": map[string]any{
+						"operationId": "registerPeer",
+						"summary":     "Register a node with the cluster",
+						"description": "Adds or renews a node, which is dropped unless it registers again within cluster.peer_ttl. Requires the cluster secret in the X-Cluster-Secret header.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"requestBody": jsonBody(g.Ref(RegisterRequest{})),
+						"responses": map[string]any{
+							"200": response("Cluster nodes", g.Ref(PeersResponse{})),
+							"400": response("Malformed request", errorResponse),
+							"401": response("Missing or invalid API key", errorResponse),
+							"403": response("Missing or invalid cluster secret", errorResponse),
+							"404": response("Clustering is not enabled", errorResponse),
+						},
+					},
+				},
+				"/api/v1/admin/cache/flush": map[string]any{
+					"post": map[string]any{
+						"operationId": "flushCache",
+						"summary":     "Remove cached answers",
+						"description": "Removes the cached answers for suffix and its subdomains, or all of them when suffix is empty, from every cache including the tenants'. Requires a key from security.admin_keys; the endpoint does not exist without one.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"requestBody": jsonBody(g.Ref(FlushRequest{})),
+						"responses": map[string]any{
+							"200": response("Number of answers removed", g.Ref(FlushResponse{})),
+							"400": response("Malformed request", errorResponse),
+							"401": response("Missing or invalid admin key", errorResponse),
+						},
+					},
+				},
+				"/api/v1/admin/cache/ttl": map[string]any{
+					"get": map[string]any{
+						"operationId": "cacheTTLOverrides",
+						"summary":     "Cache TTL overrides",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"responses": map[string]any{
+							"200": response("TTL overrides in seconds by name", g.Ref(TTLOverridesResponse{})),
+							"401": response("Missing or invalid admin key", errorResponse),
+						},
+					},
+					"post": map[string]any{
+						"operationId": "setCacheTTLOverride",
+						"summary":     "Set or remove the cache TTL override of a name",
+						"description": "Answers for the name, and only the name, are cached for exactly ttl seconds with their record TTLs set to match; the answers cached so far are dropped. A ttl of 0 removes the override. Overrides live in the memory of the instance.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"requestBody": jsonBody(g.Ref(TTLOverrideRequest{})),
+						"responses": map[string]any{
+							"200": response("TTL overrides in seconds by name", g.Ref(TTLOverridesResponse{})),
+							"400": response("Malformed request", errorResponse),
+							"401": response("Missing or invalid admin key", errorResponse),
+						},
+					},
+				},
+				"/api/v1/admin/tokens": map[string]any{
+					"get": map[string]any{
+						"operationId": "listTokens",
+						"summary":     "Live temporary API keys",
+						"description": "Tokens that have not expired or been revoked, soonest to expire first, without their keys. Returns 404 unless security.tokens is enabled.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"responses": map[string]any{
+							"200": response("Live tokens", g.Ref(TokensResponse{})),
+							"401": response("Missing or invalid admin key", errorResponse),
+							"404": response("Tokens are not enabled", errorResponse),
+						},
+					},
+					"post": map[string]any{
+						"operationId": "mintToken",
+						"summary":     "Mint a temporary API key",
+						"description": "The key, shown only in this response, is accepted on the endpoints of its scopes until it expires, rate limited on its own and refused once it has made quota requests. Rates and lifetimes are capped by security.tokens.",
+						"security":    []any{map[string]any{"apiKey": []any{}}},
+						"requestBody": jsonBody(g.Ref(MintTokenRequest{})),
+						"responses": map[string]any{
+							"200": response("The minted token with its key", g.Ref(middleware.Token{})),
+							"400": response("Malformed request or limits exceeded", errorResponse),
+							"401": response("Missing or invalid admin key", errorResponse),
+							"404": response("Tokens are not enabled", errorResponse),
+							"409": response("security.tokens.max_active tokens are alive", errorResponse),
+						},
+					},
+					"delete": map[string]any{
+						"operationId": "revokeToken",
+						"summary":     "Revoke a temporary API key",
+						"parameters": []any{map[string]any{
+							"name": "id", "in": "query", "required": true,
+							"schema": map[string]any{"type": "string"},
+						}},
+						"security": []any{map[string]any{"apiKey": []any{}}},
+						"responses": map[string]any{
+							"200": response("Live tokens", g.Ref(TokensResponse{})),
+							"401": response("Missing or invalid admin key", errorResponse),
+							"404": response("No such token, or tokens are not enabled", errorResponse),
+						},
+					},
+				},
+				"/health": map[string]any{
+					"get": map[string]any{
+						"operationId": "health",
+						"summary":     "Service health and resolver statistics",
+						"responses": map[string]any{
+							"200": response("Service is up", g.Ref(HealthResponse{})),
+						},
+					},
+				},
+				"/api/v1/openapi.json": map[string]any{
+					"get": map[string]any{
+						"operationId": "openapi",
+						"summary":     "This document",
+						"responses": map[string]any{
+							"200": map[string]any{"description": "OpenAPI document"},
+						},
+					},
+				},
+			},
+			"components": map[string]any{
+				"schemas": g.Schemas(),
+				"securitySchemes": map[string]any{
+					"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				},
+			},
+		}
+	})
+	return spec
+}
+
+// OpenAPI handles GET /api/v1/openapi.json
+func (h *Handler) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.writeJSON(w, OpenAPISpec(), http.StatusOK)
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mahdi/dns-proxy-remote/internal/cluster"
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+	"github.com/mahdi/dns-proxy-remote/internal/middleware"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+// TestOpenAPIMatchesTypes encodes a populated value of every documented type
+// and checks its JSON against the published schema.
+func TestOpenAPIMatchesTypes(t *testing.T) {
+	spec := OpenAPISpec()
+	if _, err := json.Marshal(spec); err != nil {
+		t.Fatalf("spec does not marshal: %v", err)
+	}
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]map[string]any)
+
+	samples := map[string]any{
+		"ResolveRequest":       ResolveRequest{Domain: "example.com", Type: "A", Types: []string{"A"}, CD: true, AD: true, RD: new(bool), NoCache: true},
+		"ResolveResponse":      ResolveResponse{Domain: "example.com", Records: []resolver.DNSRecord{{Name: "example.com", Type: resolver.TypeA, Value: "192.0.2.1", TTL: 60}}, NegativeTTL: 60, Error: "x", Code: errcode.UpstreamTimeout, AD: true},
+		"ErrorResponse":        ErrorResponse{Error: "x", Code: CodeInvalidJSON},
+		"HealthResponse":       HealthResponse{Status: "ok", Time: "now", Stats: map[string]interface{}{}},
+		"EncryptedRequest":     EncryptedRequest{Version: 1, KeyID: "k", Suite: "x", Session: "x", Data: "x"},
+		"EncryptedResponse":    EncryptedResponse{Version: 1, Data: "x"},
+		"SessionRequest":       SessionRequest{PublicKey: []byte{1}},
+		"SessionResponse":      SessionResponse{ID: "x", PublicKey: []byte{1}, ExpiresIn: 1},
+		"TamperResponse":       TamperResponse{Domains: []resolver.TamperSuspicion{{Domain: "example.com"}}},
+		"TamperSuspicion":      resolver.TamperSuspicion{Domain: "example.com", Upstreams: []resolver.UpstreamTamper{{Upstream: "x"}}},
+		"PeersResponse":        PeersResponse{Peers: []cluster.Peer{{URL: "https://node.example/api/v1/resolve"}}},
+		"Peer":                 cluster.Peer{URL: "https://node.example/api/v1/resolve", Healthy: true},
+		"RegisterRequest":      RegisterRequest{URL: "https://node.example/api/v1/resolve"},
+		"FlushRequest":         FlushRequest{Suffix: "example.com"},
+		"FlushResponse":        FlushResponse{Removed: 1},
+		"MintTokenRequest":     MintTokenRequest{Label: "guest", TTL: 3600, RateLimitPerSec: 1, RateLimitBurst: 2, Quota: 100, Scopes: []string{"resolve"}},
+		"TokensResponse":       TokensResponse{Tokens: []middleware.Token{{ID: "x"}}},
+		"Token":                middleware.Token{ID: "x", Key: "tok_x", Label: "guest", Scopes: []string{"resolve"}, RateLimitPerSec: 1, RateLimitBurst: 2, Quota: 100, Used: 1},
+		"TTLOverrideRequest":   TTLOverrideRequest{Name: "example.com", TTL: 30},
+		"TTLOverridesResponse": TTLOverridesResponse{Overrides: map[string]uint32{"example.com": 30}},
+		"StatsResponse":        StatsResponse{Time: "now", UptimeSeconds: 1, Queries: map[string]int64{"A": 1}, Upstreams: map[string]resolver.UpstreamMetrics{"x": {}}, Keys: map[string]middleware.KeyStats{"x": {}}},
+		"CacheStats":           CacheStats{Hits: 1, Misses: 1, HitRatio: 0.5, Size: 1},
+		"UpstreamMetrics":      resolver.UpstreamMetrics{Successes: 1, Failures: 1, AvgLatencyMs: 1},
+		"KeyStats":             middleware.KeyStats{Requests: 1},
+		"RuntimeStats":         RuntimeStats{GoVersion: "go1.24", Goroutines: 1, CPUs: 1, HeapAlloc: 1, HeapSys: 1, GCCycles: 1, LastGCPauseMs: 1},
+	}
+	for name, v := range samples {
+		schema, ok := schemas[name]
+		if !ok {
+			t.Errorf("%s: missing from components", name)
+			continue
+		}
+		data, _ := json.Marshal(v)
+		var doc map[string]any
+		json.Unmarshal(data, &doc)
+
+		props := schema["properties"].(map[string]any)
+		for key := range doc {
+			if _, ok := props[key]; !ok {
+				t.Errorf("%s: field %q not in schema", name, key)
+			}
+		}
+		for key := range props {
+			if _, ok := doc[key]; !ok {
+				t.Errorf("%s: schema property %q not produced by the type", name, key)
+			}
+		}
+		required, _ := schema["required"].([]string)
+		for _, key := range required {
+			if _, ok := doc[key]; !ok {
+				t.Errorf("%s: required field %q missing", name, key)
+			}
+		}
+	}
+
+	record := schemas["DNSRecord"]
+	if record == nil {
+		t.Fatal("DNSRecord schema not registered")
+	}
+	typ := record["properties"].(map[string]any)["type"].(map[string]any)
+	if enum, _ := typ["enum"].([]string); len(enum) == 0 {
+		t.Errorf("record type should be an enum, got %v", typ)
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/mahdi/dns-proxy-remote/internal/audit"
+	"github.com/mahdi/dns-proxy-remote/internal/cluster"
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// PeersResponse lists the cluster's nodes, this one first
+type PeersResponse struct {
+	Peers []cluster.Peer `json:"peers"`
+}
+
+// RegisterRequest announces a node to the cluster
+type RegisterRequest struct {
+	URL string `json:"url"` // the node's resolve URL
+}
+
+// EnableCluster serves the nodes of r on Peers
+func (h *Handler) EnableCluster(r *cluster.Registry) {
+	h.cluster = r
+}
+
+// EnableAudit records registrations, and attempts with a wrong secret, to l
+func (h *Handler) EnableAudit(l *audit.Log) {
+	h.audit = l
+}
+
+// Peers handles GET /api/v1/peers, the node list local proxies refresh
+// their endpoints from, and POST /api/v1/peers, by which nodes holding the
+// cluster secret register themselves. A draining node leaves itself out.
+func (h *Handler) Peers(w http.ResponseWriter, r *http.Request) {
+	if h.cluster == nil {
+		h.writeError(w, "clustering is not enabled", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !h.cluster.Authorized(r.Header.Get(cluster.SecretHeader)) {
+			h.audit.RecordRequest(r, "cluster.register.denied", "")
+			errcode.Write(w, http.StatusForbidden, errcode.EndpointAuth, "invalid or missing cluster secret")
+			return
+		}
+		body, c, err := readBody(w, r)
+		if err != nil {
+			h.writeRequestError(w, err)
+			return
+		}
+		var req RegisterRequest
+		if err := c.decode(body, &req, h.strict); err != nil {
+			h.writeRequestError(w, err)
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			h.writeError(w, "url must be an http(s) resolve URL", http.StatusBadRequest)
+			return
+		}
+		h.cluster.Register(req.URL)
+		h.audit.RecordRequest(r, "cluster.register", req.URL)
+	default:
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.writeJSON(w, PeersResponse{Peers: h.cluster.Peers(!h.draining.Load())}, http.StatusOK)
+}
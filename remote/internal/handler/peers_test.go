@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/cluster"
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+)
+
+func TestPeers(t *testing.T) {
+	serve := func(h *Handler, method, secret, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/peers", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			req.Header.Set(cluster.SecretHeader, secret)
+		}
+		rec := httptest.NewRecorder()
+		h.Peers(rec, req)
+		return rec
+	}
+
+	h := NewHandler(nil, nil, logging.Discard())
+	if rec := serve(h, http.MethodGet, "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("without clustering: %d", rec.Code)
+	}
+
+	h.EnableCluster(cluster.New(config.ClusterConfig{
+		Enabled:        true,
+		Self:           "https://a.example/api/v1/resolve",
+		Peers:          []string{"https://b.example/api/v1/resolve"},
+		Secret:         "s3cret",
+		HealthInterval: time.Hour,
+		PeerTTL:        time.Hour,
+	}, logging.Discard()))
+
+	tests := []struct {
+		name, method, secret, body string
+		status                     int
+		want                       string
+	}{
+		{"list", http.MethodGet, "", "", http.StatusOK, `{"peers":[{"url":"https://a.example/api/v1/resolve","healthy":true},{"url":"https://b.example/api/v1/resolve","healthy":false}]}`},
+		{"no secret", http.MethodPost, "", `{"url":"https://c.example/api/v1/resolve"}`, http.StatusForbidden, "cluster secret"},
+		{"bad url", http.MethodPost, "s3cret", `{"url":"c.example"}`, http.StatusBadRequest, "resolve URL"},
+		{"register", http.MethodPost, "s3cret", `{"url":"https://c.example/api/v1/resolve"}`, http.StatusOK, `"url":"https://c.example/api/v1/resolve"`},
+		{"method", http.MethodDelete, "", "", http.StatusMethodNotAllowed, "method not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(h, tt.method, tt.secret, tt.body)
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("got %d %s, want %d %q", rec.Code, rec.Body, tt.status, tt.want)
+			}
+		})
+	}
+
+	// A draining node stops offering itself
+	h.Drain()
+	if rec := serve(h, http.MethodGet, "", ""); strings.Contains(rec.Body.String(), "a.example") {
+		t.Errorf("draining node listed itself: %s", rec.Body)
+	}
+}
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/crypto"
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// SessionRequest opens a session. It travels as a version 1 EncryptedRequest
+// sealed with a pre-shared key, which authenticates the client's key.
+type SessionRequest struct {
+	PublicKey []byte `json:"pub"` // client's ephemeral X25519 public key
+}
+
+// SessionResponse completes the key exchange, sealed with the same
+// pre-shared key as the request
+type SessionResponse struct {
+	ID        string `json:"sid"`
+	PublicKey []byte `json:"pub"`        // server's ephemeral X25519 public key
+	ExpiresIn int    `json:"expires_in"` // seconds until the session is forgotten
+}
+
+// sessionStore holds the keys of established sessions until they expire
+type sessionStore struct {
+	sessions map[string]*session
+	mu       sync.Mutex
+	ttl      time.Duration
+	max      int
+	required bool // refuse resolve requests sealed with a pre-shared key
+}
+
+type session struct {
+	cipher    *crypto.Cipher
+	expiresAt time.Time
+}
+
+// EnableSessions accepts X25519 key exchanges on Session. Session keys live
+// for ttl; at most max sessions are held at once. With required set,
+// resolve requests must use a session, so no query is ever sealed with a
+// pre-shared key.
+func (h *Handler) EnableSessions(ttl time.Duration, max int, required bool) {
+	h.sessions = &sessionStore{
+		sessions: make(map[string]*session),
+		ttl:      ttl,
+		max:      max,
+		required: required,
+	}
+}
+
+// add stores a session, dropping expired ones when the store is full.
+// It reports false if the store is still full.
+func (s *sessionStore) add(id string, c *crypto.Cipher) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.sessions) >= s.max {
+		now := time.Now()
+		for id, sess := range s.sessions {
+			if now.After(sess.expiresAt) {
+				delete(s.sessions, id)
+			}
+		}
+		if len(s.sessions) >= s.max {
+			return false
+		}
+	}
+	s.sessions[id] = &session{cipher: c, expiresAt: time.Now().Add(s.ttl)}
+	return true
+}
+
+// get returns the cipher of an unexpired session; safe on a nil store
+func (s *sessionStore) get(id string) (*crypto.Cipher, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(sess.expiresAt) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return sess.cipher, true
+}
+
+func (s *sessionStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Session handles POST /api/v1/session, an ephemeral X25519 key exchange
+// whose derived key seals later requests naming the session, for forward
+// secrecy
+func (h *Handler) Session(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.sessions == nil {
+		h.writeError(w, "sessions are not enabled", http.StatusNotFound)
+		return
+	}
+
+	body, c, err := readBody(w, r)
+	if err != nil {
+		h.writeRequestError(w, err)
+		return
+	}
+	plain, psk, version, ok := h.openEnvelope(w, r, c, body, false)
+	if !ok {
+		return
+	}
+	if version < crypto.PaddingVersion {
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, "session requests need envelope version 1")
+		return
+	}
+	var req SessionRequest
+	if err := c.decode(plain, &req, h.strict); err != nil {
+		h.writeRequestError(w, err)
+		return
+	}
+
+	kp, err := crypto.NewKeyPair()
+	if err != nil {
+		h.logger.Error("failed to create session", "error", err)
+		h.writeError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	sid := hex.EncodeToString(id)
+
+	sc, err := kp.SessionCipher(psk.Suite(), sid, req.PublicKey, kp.Public())
+	if err != nil {
+		errcode.Write(w, http.StatusBadRequest, errcode.ProtocolMismatch, err.Error())
+		return
+	}
+	if !h.sessions.add(sid, sc) {
+		errcode.Write(w, http.StatusServiceUnavailable, errcode.RateLimited, "too many sessions")
+		return
+	}
+
+	h.writeResult(w, SessionResponse{
+		ID:        sid,
+		PublicKey: kp.Public(),
+		ExpiresIn: int(h.sessions.ttl.Seconds()),
+	}, c, psk, version)
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/middleware"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+// StatsResponse holds the server's counters since it started, those of the
+// tenants' resolvers included
+type StatsResponse struct {
+	Time          string                              `json:"time"`
+	UptimeSeconds int64                               `json:"uptime_seconds"`
+	Queries       map[string]int64                    `json:"queries"` // by record type
+	Cache         CacheStats                          `json:"cache"`
+	Upstreams     map[string]resolver.UpstreamMetrics `json:"upstreams"` // by address
+	Keys          map[string]middleware.KeyStats      `json:"keys"`      // by API key fingerprint
+	Runtime       RuntimeStats                        `json:"runtime"`
+}
+
+// CacheStats counts answers served from and missing in the caches
+type CacheStats struct {
+	Hits     int64   `json:"hits"` // stale answers included
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"` // hits over lookups; 0 before any
+	Size     int     `json:"size"`
+}
+
+// RuntimeStats describes the server process
+type RuntimeStats struct {
+	GoVersion     string  `json:"go_version"`
+	Goroutines    int     `json:"goroutines"`
+	CPUs          int     `json:"cpus"`
+	HeapAlloc     uint64  `json:"heap_alloc_bytes"`
+	HeapSys       uint64  `json:"heap_sys_bytes"`
+	GCCycles      uint32  `json:"gc_cycles"`
+	LastGCPauseMs float64 `json:"last_gc_pause_ms"`
+}
+
+// EnableKeyUsage reports the per-key request counts of u on Stats
+func (h *Handler) EnableKeyUsage(u *middleware.KeyUsage) {
+	h.usage = u
+}
+
+// Stats handles GET /api/v1/stats, the server's counters as JSON for
+// monitoring without a metrics system
+func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := StatsResponse{
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		UptimeSeconds: int64(time.Since(h.started) / time.Second),
+		Queries:       make(map[string]int64),
+		Upstreams:     make(map[string]resolver.UpstreamMetrics),
+		Keys:          make(map[string]middleware.KeyStats),
+		Runtime:       runtimeStats(),
+	}
+	for _, res := range h.resolvers() {
+		m := res.Metrics()
+		for t, n := range m.Queries {
+			resp.Queries[t] += n
+		}
+		resp.Cache.Hits += m.CacheHits
+		resp.Cache.Misses += m.CacheMisses
+		resp.Cache.Size += m.CacheSize
+		for addr, u := range m.Upstreams {
+			resp.Upstreams[addr] = mergeUpstream(resp.Upstreams[addr], u)
+		}
+	}
+	if lookups := resp.Cache.Hits + resp.Cache.Misses; lookups > 0 {
+		resp.Cache.HitRatio = float64(resp.Cache.Hits) / float64(lookups)
+	}
+	if h.usage != nil {
+		resp.Keys = h.usage.Stats()
+	}
+	h.writeJSON(w, resp, http.StatusOK)
+}
+
+// mergeUpstream adds the counters of b to a, weighting the latencies by
+// their successes
+func mergeUpstream(a, b resolver.UpstreamMetrics) resolver.UpstreamMetrics {
+	merged := resolver.UpstreamMetrics{
+		Successes: a.Successes + b.Successes,
+		Failures:  a.Failures + b.Failures,
+	}
+	if merged.Successes > 0 {
+		merged.AvgLatencyMs = (a.AvgLatencyMs*float64(a.Successes) + b.AvgLatencyMs*float64(b.Successes)) / float64(merged.Successes)
+	}
+	return merged
+}
+
+func runtimeStats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return RuntimeStats{
+		GoVersion:     runtime.Version(),
+		Goroutines:    runtime.NumGoroutine(),
+		CPUs:          runtime.NumCPU(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapSys:       mem.HeapSys,
+		GCCycles:      mem.NumGC,
+		LastGCPauseMs: float64(mem.PauseNs[(mem.NumGC+255)%256]) / float64(time.Millisecond),
+	}
+}
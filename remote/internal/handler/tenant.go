@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+// Tenant is the resolver and policy serving the API keys of one tenant.
+// Its resolver has its own upstreams and cache, so tenants sharing the
+// server neither see each other's lookups nor warm each other's cache.
+type Tenant struct {
+	Name     string
+	resolver *resolver.Resolver
+	blocked  map[string]bool // lower case, without the trailing dot
+
+	queries atomic.Int64
+	refused atomic.Int64 // queries for blocklisted domains
+}
+
+// NewTenant returns a tenant resolving through res that refuses the
+// domains in blocklist and their subdomains
+func NewTenant(name string, res *resolver.Resolver, blocklist []string) *Tenant {
+	t := &Tenant{Name: name, resolver: res, blocked: make(map[string]bool, len(blocklist))}
+	for _, domain := range blocklist {
+		t.blocked[strings.ToLower(strings.Trim(domain, "."))] = true
+	}
+	return t
+}
+
+// Resolver returns the tenant's resolver
+func (t *Tenant) Resolver() *resolver.Resolver {
+	return t.resolver
+}
+
+// Blocks reports whether domain or one of its parents is blocklisted
+func (t *Tenant) Blocks(domain string) bool {
+	name := strings.ToLower(strings.TrimSuffix(domain, "."))
+	for {
+		if t.blocked[name] {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// EnableTenant serves requests made with any of keys through t instead of
+// the handler's own resolver
+func (h *Handler) EnableTenant(t *Tenant, keys []string) {
+	if h.tenants == nil {
+		h.tenants = make(map[string]*Tenant)
+	}
+	for _, key := range keys {
+		h.tenants[key] = t
+	}
+}
+
+// tenantOf returns the tenant of the request's API key, or nil for keys
+// that belong to none. The key is read as the auth middleware reads it.
+func (h *Handler) tenantOf(r *http.Request) *Tenant {
+	if h.tenants == nil {
+		return nil
+	}
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	return h.tenants[key]
+}
+
+// tenantStats returns the query counts and resolver statistics per tenant
+func (h *Handler) tenantStats() map[string]interface{} {
+	stats := make(map[string]interface{})
+	for _, t := range h.tenants {
+		if _, ok := stats[t.Name]; ok {
+			continue
+		}
+		s := t.resolver.Stats()
+		s["queries"] = t.queries.Load()
+		s["blocklist_refused"] = t.refused.Load()
+		stats[t.Name] = s
+	}
+	return stats
+}
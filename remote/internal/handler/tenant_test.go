@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+	"github.com/mahdi/dns-proxy-remote/internal/resolver"
+)
+
+func TestTenants(t *testing.T) {
+	newResolver := func(upstream string) *resolver.Resolver {
+		return resolver.New(resolver.Config{
+			Upstreams:  []string{upstream},
+			Timeout:    100 * time.Millisecond,
+			MaxRetries: 1,
+		})
+	}
+	h := NewHandler(newResolver("127.0.0.1:1"), nil, logging.Discard())
+	family := NewTenant("family", newResolver("127.0.0.1:2"), []string{"Ads.example.", "tracker.test"})
+	h.EnableTenant(family, []string{"k1", "k2"})
+
+	post := func(key, domain string) ResolveResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(`{"domain":"`+domain+`","type":"A"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		h.Resolve(rec, req)
+		var resp ResolveResponse
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+			t.Fatalf("%s for %s: %d %s", domain, key, rec.Code, rec.Body)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		key, domain string
+		upstream    string // in the resolution error, showing the resolver used
+		blocked     bool
+	}{
+		{"k1", "www.ads.example", "", true},
+		{"k2", "tracker.test.", "", true},
+		{"k1", "example.com", "127.0.0.1:2", false},
+		{"other", "www.ads.example", "127.0.0.1:1", false},
+	}
+	for _, tt := range tests {
+		resp := post(tt.key, tt.domain)
+		if blocked := resp.Code == errcode.BlockedPolicy; blocked != tt.blocked {
+			t.Errorf("%s for %s: code %q, blocked want %v", tt.domain, tt.key, resp.Code, tt.blocked)
+		}
+		if !tt.blocked && !strings.Contains(resp.Error, tt.upstream) {
+			t.Errorf("%s for %s: %q, want a failure of %s", tt.domain, tt.key, resp.Error, tt.upstream)
+		}
+	}
+
+	stats := h.tenantStats()["family"].(map[string]interface{})
+	if stats["queries"] != int64(3) || stats["blocklist_refused"] != int64(2) {
+		t.Errorf("tenant stats %v", stats)
+	}
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// AccessOptions configures an AccessPolicy
+type AccessOptions struct {
+	AllowedNetworks  []string // CIDRs or addresses always admitted
+	GeoIPDatabase    string   // MaxMind GeoIP2/GeoLite2 Country or City database
+	AllowedCountries []string // ISO codes admitted when set; everyone else is refused
+	DeniedCountries  []string // ISO codes refused
+	Logger           *slog.Logger
+}
+
+// AccessPolicy restricts the API by client address. Clients inside an
+// allowed network are always admitted. Otherwise, when countries are
+// configured the client's country decides; when only networks are
+// configured everyone else is refused.
+type AccessPolicy struct {
+	networks []*net.IPNet
+	allow    map[string]bool
+	deny     map[string]bool
+	geo      *maxminddb.Reader
+	country  func(ip net.IP) string
+	refused  atomic.Int64
+	logger   *slog.Logger
+}
+
+// geoRecord is the part of a MaxMind record the policy reads
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// NewAccessPolicy creates an access policy, or returns nil when no
+// restriction is configured
+func NewAccessPolicy(opts AccessOptions) (*AccessPolicy, error) {
+	if len(opts.AllowedNetworks) == 0 && len(opts.AllowedCountries) == 0 && len(opts.DeniedCountries) == 0 {
+		return nil, nil
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	p := &AccessPolicy{
+		allow:  make(map[string]bool),
+		deny:   make(map[string]bool),
+		logger: opts.Logger,
+	}
+	for _, s := range opts.AllowedNetworks {
+		network, err := parseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network %q: %w", s, err)
+		}
+		p.networks = append(p.networks, network)
+	}
+	for _, c := range opts.AllowedCountries {
+		p.allow[strings.ToUpper(c)] = true
+	}
+	for _, c := range opts.DeniedCountries {
+		p.deny[strings.ToUpper(c)] = true
+	}
+
+	if len(p.allow) > 0 || len(p.deny) > 0 {
+		if opts.GeoIPDatabase == "" {
+			return nil, fmt.Errorf("country rules need a GeoIP database")
+		}
+		geo, err := maxminddb.Open(opts.GeoIPDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+		}
+		p.geo = geo
+		p.country = p.lookupCountry
+	}
+	return p, nil
+}
+
+// Allowed reports whether a client address may use the API
+func (p *AccessPolicy) Allowed(ip net.IP) bool {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if p.country == nil {
+		return false
+	}
+
+	country := p.country(ip)
+	if p.deny[country] {
+		return false
+	}
+	if len(p.allow) > 0 {
+		return p.allow[country]
+	}
+	return true
+}
+
+// Middleware refuses requests from clients outside the policy with 403.
+// A nil policy admits everyone.
+func (p *AccessPolicy) Middleware(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(ClientIP(r))
+		if ip == nil || !p.Allowed(ip) {
+			p.refused.Add(1)
+			p.logger.Debug("client refused by access policy", "client", ClientIP(r))
+			errcode.Write(w, http.StatusForbidden, errcode.BlockedPolicy, "forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Refused returns the number of requests refused so far
+func (p *AccessPolicy) Refused() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.refused.Load()
+}
+
+// Close releases the GeoIP database
+func (p *AccessPolicy) Close() error {
+	if p == nil || p.geo == nil {
+		return nil
+	}
+	return p.geo.Close()
+}
+
+// lookupCountry returns the ISO country code of ip, or "" if unknown
+func (p *AccessPolicy) lookupCountry(ip net.IP) string {
+	var rec geoRecord
+	if err := p.geo.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+	return strings.ToUpper(rec.Country.ISOCode)
+}
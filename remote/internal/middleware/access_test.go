@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	p, err := NewAccessPolicy(AccessOptions{AllowedNetworks: []string{"198.51.100.0/24", "2001:db8::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Countries are stubbed; opening a real database is covered by maxminddb
+	countries := map[string]string{"203.0.113.1": "DE", "203.0.113.2": "CN", "203.0.113.3": ""}
+	lookup := func(ip net.IP) string { return countries[ip.String()] }
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		country bool
+		ip      string
+		want    bool
+	}{
+		{"network", nil, nil, false, "198.51.100.7", true},
+		{"single address", nil, nil, false, "2001:db8::1", true},
+		{"outside networks", nil, nil, false, "203.0.113.1", false},
+		{"allowed country", []string{"de"}, nil, true, "203.0.113.1", true},
+		{"other country", []string{"DE"}, nil, true, "203.0.113.2", false},
+		{"unknown country with allow list", []string{"DE"}, nil, true, "203.0.113.3", false},
+		{"denied country", nil, []string{"CN"}, true, "203.0.113.2", false},
+		{"deny list only", nil, []string{"CN"}, true, "203.0.113.3", true},
+		{"network beats country", nil, []string{"CN"}, true, "198.51.100.7", true},
+	}
+	for _, tt := range tests {
+		p.allow, p.deny, p.country = map[string]bool{}, map[string]bool{}, nil
+		for _, c := range tt.allow {
+			p.allow[strings.ToUpper(c)] = true
+		}
+		for _, c := range tt.deny {
+			p.deny[strings.ToUpper(c)] = true
+		}
+		if tt.country {
+			p.country = lookup
+		}
+		if got := p.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: Allowed(%s) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAccessPolicyMiddleware(t *testing.T) {
+	if p, err := NewAccessPolicy(AccessOptions{}); p != nil || err != nil {
+		t.Fatalf("expected no policy, got %v, %v", p, err)
+	}
+	if _, err := NewAccessPolicy(AccessOptions{AllowedCountries: []string{"DE"}}); err == nil {
+		t.Error("country rules without a database should fail")
+	}
+
+	p, _ := NewAccessPolicy(AccessOptions{AllowedNetworks: []string{"192.0.2.0/24"}})
+	h := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for addr, want := range map[string]int{"192.0.2.10:1234": http.StatusOK, "203.0.113.5:1234": http.StatusForbidden} {
+		req := httptest.NewRequest("POST", "/api/v1/resolve", nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", addr, rec.Code, want)
+		}
+	}
+	if p.Refused() != 1 {
+		t.Errorf("refused = %d, want 1", p.Refused())
+	}
+}
@@ -3,35 +3,34 @@ package middleware
 import (
 	"net/http"
 	"sync"
+	"sync/atomic"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
 )
 
-// APIKeyAuth is a middleware that validates API keys
+// APIKeyAuth is a middleware that validates API keys. The key set is an
+// immutable snapshot replaced on change, so checking a key takes no lock.
 type APIKeyAuth struct {
-	validKeys map[string]bool
-	mu        sync.RWMutex
+	validKeys atomic.Pointer[map[string]bool]
+	mu        sync.Mutex // serializes writers
 }
 
 // NewAPIKeyAuth creates a new API key authentication middleware
 func NewAPIKeyAuth(keys []string) *APIKeyAuth {
-	auth := &APIKeyAuth{
-		validKeys: make(map[string]bool),
-	}
+	auth := &APIKeyAuth{}
+	validKeys := make(map[string]bool, len(keys))
 	for _, key := range keys {
-		auth.validKeys[key] = true
+		validKeys[key] = true
 	}
+	auth.validKeys.Store(&validKeys)
 	return auth
 }
 
 // Middleware returns an HTTP middleware function
 func (a *APIKeyAuth) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey == "" {
-			apiKey = r.URL.Query().Get("api_key")
-		}
-
-		if !a.IsValidKey(apiKey) {
-			http.Error(w, `{"error": "unauthorized", "message": "invalid or missing API key"}`, http.StatusUnauthorized)
+		if !a.IsValidKey(apiKeyOf(r)) {
+			errcode.Write(w, http.StatusUnauthorized, errcode.EndpointAuth, "invalid or missing API key")
 			return
 		}
 
@@ -39,23 +38,40 @@ func (a *APIKeyAuth) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// apiKeyOf returns the API key r presents, in the X-API-Key header or the
+// api_key query parameter
+func apiKeyOf(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
 // IsValidKey checks if an API key is valid
 func (a *APIKeyAuth) IsValidKey(key string) bool {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-	return a.validKeys[key]
+	return (*a.validKeys.Load())[key]
 }
 
 // AddKey adds a new API key
 func (a *APIKeyAuth) AddKey(key string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.validKeys[key] = true
+	a.update(func(keys map[string]bool) { keys[key] = true })
 }
 
 // RemoveKey removes an API key
 func (a *APIKeyAuth) RemoveKey(key string) {
+	a.update(func(keys map[string]bool) { delete(keys, key) })
+}
+
+// update publishes a modified copy of the key set
+func (a *APIKeyAuth) update(fn func(map[string]bool)) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	delete(a.validKeys, key)
+
+	old := *a.validKeys.Load()
+	next := make(map[string]bool, len(old)+1)
+	for k, v := range old {
+		next[k] = v
+	}
+	fn(next)
+	a.validKeys.Store(&next)
 }
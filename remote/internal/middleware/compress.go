@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// Compression is a middleware that gzips responses of at least minSize
+// bytes for clients that send Accept-Encoding: gzip. Batch responses and
+// TXT-heavy answers shrink severalfold; small ones would only pay the
+// gzip header. Responses are buffered, which suits the API's short bodies.
+type Compression struct {
+	minSize int
+}
+
+// NewCompression creates a new compression middleware
+func NewCompression(minSize int) *Compression {
+	return &Compression{minSize: minSize}
+}
+
+// Middleware returns an HTTP middleware function
+func (c *Compression) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buf := &bufferingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(buf, r)
+
+		body := buf.body.Bytes()
+		if len(body) >= c.minSize && w.Header().Get("Content-Encoding") == "" {
+			if compressed, ok := compress(body); ok {
+				body = compressed
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Del("Content-Length")
+			}
+		}
+		w.WriteHeader(buf.status)
+		w.Write(body)
+	})
+}
+
+// compress gzips body, reporting false when that doesn't make it smaller
+func compress(body []byte) ([]byte, bool) {
+	var out bytes.Buffer
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(&out)
+	if _, err := gz.Write(body); err != nil {
+		return nil, false
+	}
+	if err := gz.Close(); err != nil || out.Len() >= len(body) {
+		return nil, false
+	}
+	return out.Bytes(), true
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip: it
+// is listed, or covered by *, without q=0
+func acceptsGzip(header string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		accepted := true
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			accepted = err == nil && q > 0
+		}
+		if coding == "gzip" {
+			return accepted
+		}
+		wildcard = accepted
+	}
+	return wildcard
+}
+
+// bufferingWriter holds the response back until it is complete
+type bufferingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (bw *bufferingWriter) WriteHeader(code int) {
+	bw.status = code
+}
+
+func (bw *bufferingWriter) Write(p []byte) (int, error) {
+	return bw.body.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (bw *bufferingWriter) Unwrap() http.ResponseWriter {
+	return bw.ResponseWriter
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	large := `{"records":[` + strings.Repeat(`{"type":"TXT","value":"v=spf1 include:_spf.example.com ~all"},`, 50) + `{}]}`
+	small := `{"records":[]}`
+
+	tests := []struct {
+		name, accept, body string
+		gzipped            bool
+	}{
+		{"large", "gzip, deflate, br", large, true},
+		{"small", "gzip", small, false},
+		{"not accepted", "", large, false},
+		{"refused", "gzip;q=0, *", large, false},
+		{"wildcard", "*", large, true},
+		{"weighted", "br, gzip;q=0.5", large, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewCompression(1024).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				io.WriteString(w, tt.body)
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusAccepted {
+				t.Errorf("status %d", rec.Code)
+			}
+			if rec.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary = %q", rec.Header().Get("Vary"))
+			}
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.gzipped {
+				t.Fatalf("gzipped = %v, want %v", gzipped, tt.gzipped)
+			}
+			body := rec.Body.String()
+			if gzipped {
+				if rec.Body.Len() >= len(tt.body) {
+					t.Errorf("%d bytes compressed to %d", len(tt.body), rec.Body.Len())
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(raw)
+			}
+			if body != tt.body {
+				t.Errorf("body changed: %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// IdempotencyHeader carries a client-chosen key that stays the same across
+// retries of one logical request
+const IdempotencyHeader = "Idempotency-Key"
+
+const (
+	maxIdempotencyKeyLen = 128
+	// maxIdempotentBody bounds the bodies fingerprinted; larger requests
+	// are not deduplicated (the handler rejects them anyway)
+	maxIdempotentBody = 64 << 10
+	// maxIdempotencyEntries bounds the remembered keys; requests beyond it
+	// run without replay until entries expire
+	maxIdempotencyEntries = 100000
+)
+
+// storedResponse is a recorded response, or a pending one while done is open
+type storedResponse struct {
+	request   [sha256.Size]byte // fingerprint of the request the key was first used with
+	done      chan struct{}
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// Idempotency is a middleware that replays the recorded response for a
+// repeated Idempotency-Key instead of running the request again, so retries
+// after a dropped connection don't trigger a second upstream resolution or
+// count twice against the rate limit. Keys are scoped per API key, however
+// it was presented, and bound to the request they were first used with: a
+// key reused for a different request is answered 422.
+type Idempotency struct {
+	entries map[string]*storedResponse
+	mu      sync.Mutex
+	ttl     time.Duration
+}
+
+// NewIdempotency creates a new idempotency middleware remembering responses for ttl
+func NewIdempotency(ttl time.Duration) *Idempotency {
+	i := &Idempotency{
+		entries: make(map[string]*storedResponse),
+		ttl:     ttl,
+	}
+
+	go i.cleanup()
+
+	return i
+}
+
+// Middleware returns an HTTP middleware function
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idemKey := r.Header.Get(IdempotencyHeader)
+		if idemKey == "" || len(idemKey) > maxIdempotencyKeyLen {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fingerprint, ok := requestFingerprint(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := apiKeyOf(r) + ":" + idemKey
+
+		i.mu.Lock()
+		entry, exists := i.entries[key]
+		if exists && !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+			exists = false
+		}
+		if !exists && len(i.entries) >= maxIdempotencyEntries {
+			i.sweep(time.Now())
+			if len(i.entries) >= maxIdempotencyEntries {
+				i.mu.Unlock()
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if !exists {
+			entry = &storedResponse{request: fingerprint, done: make(chan struct{})}
+			i.entries[key] = entry
+		}
+		i.mu.Unlock()
+
+		if exists && entry.request != fingerprint {
+			errcode.Write(w, http.StatusUnprocessableEntity, errcode.ProtocolMismatch, "Idempotency-Key was used for a different request")
+			return
+		}
+		if exists {
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.status != 0 {
+				replay(w, entry)
+				return
+			}
+			// The original attempt produced nothing reusable; run again
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		i.mu.Lock()
+		// Only successful responses are worth replaying; errors should be retried for real
+		if rec.status < 500 && rec.status != http.StatusTooManyRequests {
+			entry.status = rec.status
+			entry.header = w.Header().Clone()
+			entry.body = rec.body.Bytes()
+			entry.expiresAt = time.Now().Add(i.ttl)
+		} else {
+			delete(i.entries, key)
+		}
+		close(entry.done)
+		i.mu.Unlock()
+	})
+}
+
+// Len returns the number of remembered keys
+func (i *Idempotency) Len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.entries)
+}
+
+// requestFingerprint hashes r's method, path and body, leaving the body
+// to be read again. ok is false if the body is too large or unreadable.
+func requestFingerprint(r *http.Request) (sum [sha256.Size]byte, ok bool) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		// The server closes the original body after the handler
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if err != nil || len(body) > maxIdempotentBody {
+			return sum, false
+		}
+	}
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	h.Sum(sum[:0])
+	return sum, true
+}
+
+func replay(w http.ResponseWriter, entry *storedResponse) {
+	for k, v := range entry.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+func (i *Idempotency) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		i.mu.Lock()
+		i.sweep(time.Now())
+		i.mu.Unlock()
+	}
+}
+
+// sweep drops the expired entries; i.mu must be held
+func (i *Idempotency) sweep(now time.Time) {
+	for key, entry := range i.entries {
+		if !entry.expiresAt.IsZero() && now.After(entry.expiresAt) {
+			delete(i.entries, key)
+		}
+	}
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyReplay(t *testing.T) {
+	var calls atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"domain":"example.com"}`))
+	})
+
+	h := NewIdempotency(time.Minute).Middleware(next)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", nil)
+		req.Header.Set("X-API-Key", "k")
+		if key != "" {
+			req.Header.Set(IdempotencyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	send("abc")
+	rec := send("abc")
+
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 handler call, got %d", calls.Load())
+	}
+	if rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("Expected replayed response")
+	}
+	if rec.Body.String() != `{"domain":"example.com"}` {
+		t.Errorf("Unexpected replayed body: %s", rec.Body.String())
+	}
+
+	send("")
+	send("")
+	if calls.Load() != 3 {
+		t.Errorf("Requests without a key must not be deduplicated, got %d calls", calls.Load())
+	}
+}
+
+func TestIdempotencySkipsServerErrors(t *testing.T) {
+	var calls atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	h := NewIdempotency(time.Minute).Middleware(next)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", nil)
+		req.Header.Set(IdempotencyHeader, "retry-me")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if calls.Load() != 2 {
+		t.Errorf("Expected failed responses to be retried, got %d calls", calls.Load())
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	var calls atomic.Int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	h := NewIdempotency(time.Minute).Middleware(next)
+
+	send := func(target, apiKey, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		req.Header.Set(IdempotencyHeader, "same")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Keys in the query string are scoped like header keys
+	send("/api/v1/resolve?api_key=alice", "", `{"domain":"alice.example"}`)
+	rec := send("/api/v1/resolve?api_key=bob", "", `{"domain":"alice.example"}`)
+	if calls.Load() != 2 || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("bob was replayed alice's answer: %d calls", calls.Load())
+	}
+	rec = send("/api/v1/resolve", "alice", `{"domain":"alice.example"}`)
+	if calls.Load() != 2 || rec.Body.String() != `{"domain":"alice.example"}` {
+		t.Errorf("alice's retry with the key in the header: %d calls, %q", calls.Load(), rec.Body.String())
+	}
+
+	// A key reused for another request is refused, not answered wrongly
+	rec = send("/api/v1/resolve", "alice", `{"domain":"other.example"}`)
+	if rec.Code != http.StatusUnprocessableEntity || calls.Load() != 2 {
+		t.Errorf("reused key: %d after %d calls, want 422", rec.Code, calls.Load())
+	}
+	rec = send("/api/v1/data", "alice", `{"domain":"alice.example"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key on another path: %d, want 422", rec.Code)
+	}
+}
+
+func TestIdempotencyBounded(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	i := NewIdempotency(time.Minute)
+	h := i.Middleware(next)
+	for n := 0; n < maxIdempotencyEntries+10; n++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", nil)
+		req.Header.Set(IdempotencyHeader, strconv.Itoa(n))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if i.Len() != maxIdempotencyEntries {
+		t.Errorf("%d keys remembered, want at most %d", i.Len(), maxIdempotencyEntries)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"sync"
 
 	"golang.org/x/time/rate"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
 )
 
 // RateLimiter is a middleware that limits request rates
@@ -30,13 +32,13 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 		// Use API key as the limiter key, fallback to IP
 		key := r.Header.Get("X-API-Key")
 		if key == "" {
-			key = getClientIP(r)
+			key = ClientIP(r)
 		}
 
 		limiter := rl.getLimiter(key)
 		if !limiter.Allow() {
 			w.Header().Set("Retry-After", "1")
-			http.Error(w, `{"error": "rate_limit_exceeded", "message": "too many requests"}`, http.StatusTooManyRequests)
+			errcode.Write(w, http.StatusTooManyRequests, errcode.RateLimited, "too many requests")
 			return
 		}
 
@@ -44,6 +46,27 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	})
 }
 
+// AddGroup makes keys share one limiter at their own rate and burst,
+// instead of each having one at the default rate
+func (rl *RateLimiter) AddGroup(keys []string, ratePerSec float64, burst int) {
+	limiter := rate.NewLimiter(rate.Limit(ratePerSec), burst)
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, key := range keys {
+		rl.limiters[key] = limiter
+	}
+}
+
+// Remove drops the limiters of keys, which fall back to the default rate
+// if used again
+func (rl *RateLimiter) Remove(keys ...string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, key := range keys {
+		delete(rl.limiters, key)
+	}
+}
+
 func (rl *RateLimiter) getLimiter(key string) *rate.Limiter {
 	rl.mu.RLock()
 	limiter, exists := rl.limiters[key]
@@ -65,20 +88,3 @@ func (rl *RateLimiter) getLimiter(key string) *rate.Limiter {
 	rl.limiters[key] = limiter
 	return limiter
 }
-
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		return xff
-	}
-
-	// Check X-Real-IP header
-	xri := r.Header.Get("X-Real-IP")
-	if xri != "" {
-		return xri
-	}
-
-	// Fall back to RemoteAddr
-	return r.RemoteAddr
-}
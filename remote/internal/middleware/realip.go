@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// RealIP is a middleware that determines the real client IP. Forwarding
+// headers (X-Forwarded-For, X-Real-IP) are only honored when the direct peer
+// is a trusted proxy; otherwise any client could spoof its address.
+type RealIP struct {
+	trusted []*net.IPNet
+}
+
+// NewRealIP creates a new real client IP middleware trusting the given CIDRs
+// (single addresses are accepted as /32 or /128)
+func NewRealIP(trustedProxies []string) (*RealIP, error) {
+	rip := &RealIP{}
+	for _, cidr := range trustedProxies {
+		network, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		rip.trusted = append(rip.trusted, network)
+	}
+	return rip, nil
+}
+
+// Middleware returns an HTTP middleware function
+func (rip *RealIP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := rip.clientIP(r)
+		ctx := context.WithValue(r.Context(), clientIPKey{}, ip)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (rip *RealIP) clientIP(r *http.Request) string {
+	peer := remoteHost(r.RemoteAddr)
+	if !rip.isTrusted(peer) {
+		return peer
+	}
+
+	// Walk X-Forwarded-For from the right, skipping our own proxies; the
+	// first untrusted hop is the client as seen by the outermost proxy
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !rip.isTrusted(hop) {
+				return hop
+			}
+		}
+	}
+
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xri) != nil {
+		return xri
+	}
+
+	return peer
+}
+
+func (rip *RealIP) isTrusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range rip.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the client IP determined by RealIP, falling back to the
+// direct peer address when the middleware is not installed
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("not an IP address or CIDR")
+		}
+		bits := 128
+		if ip.To4() != nil {
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	rip, err := NewRealIP([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		xri    string
+		want   string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.5:1234", "1.2.3.4", "5.6.7.8", "203.0.113.5"},
+		{"trusted peer uses forwarded for", "10.1.1.1:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"skips trusted hops", "10.1.1.1:1234", "1.2.3.4, 192.0.2.1, 10.2.2.2", "", "1.2.3.4"},
+		{"spoofed leftmost hop ignored", "10.1.1.1:1234", "9.9.9.9, 1.2.3.4", "", "1.2.3.4"},
+		{"falls back to real ip header", "192.0.2.1:1234", "", "5.6.7.8", "5.6.7.8"},
+		{"no headers", "10.1.1.1:1234", "", "", "10.1.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := rip.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIP(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xri != "" {
+				req.Header.Set("X-Real-IP", tt.xri)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/crypto"
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// maxSignedBody bounds how much of a body is read to check its signature;
+// the handler applies its own, smaller limit afterwards
+const maxSignedBody = 1 << 20
+
+// SignatureVerifier is a middleware that requires requests to be signed
+// with the HMAC secret of their API key. The signature covers a timestamp,
+// a nonce and the body digest, so a tampered body is refused, and a captured
+// request can't be replayed: its timestamp goes stale after maxSkew and its
+// nonce is remembered until then.
+type SignatureVerifier struct {
+	secrets map[string]string // API key -> secret
+	maxSkew time.Duration
+	seen    map[string]time.Time // API key and nonce -> when it may be forgotten
+	mu      sync.Mutex
+	logger  *slog.Logger
+}
+
+// NewSignatureVerifier creates a signature middleware, or returns nil when
+// no secrets are configured
+func NewSignatureVerifier(secrets map[string]string, maxSkew time.Duration, logger *slog.Logger) *SignatureVerifier {
+	if len(secrets) == 0 {
+		return nil
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	v := &SignatureVerifier{
+		secrets: secrets,
+		maxSkew: maxSkew,
+		seen:    make(map[string]time.Time),
+		logger:  logger,
+	}
+
+	go v.cleanup()
+
+	return v
+}
+
+// Middleware returns an HTTP middleware function. A nil verifier passes
+// every request through.
+func (v *SignatureVerifier) Middleware(next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey := r.Header.Get("X-API-Key")
+		timestamp := r.Header.Get(crypto.TimestampHeader)
+		nonce := r.Header.Get(crypto.NonceHeader)
+		signature := r.Header.Get(crypto.SignatureHeader)
+
+		secret, ok := v.secrets[apiKey]
+		if !ok || timestamp == "" || nonce == "" || signature == "" {
+			v.reject(w, r, "missing request signature")
+			return
+		}
+
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			v.reject(w, r, "invalid signature timestamp")
+			return
+		}
+		signedAt := time.Unix(unix, 0)
+		if skew := time.Since(signedAt); skew > v.maxSkew || skew < -v.maxSkew {
+			v.reject(w, r, "request timestamp outside allowed skew")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+		if err != nil {
+			v.reject(w, r, "failed to read request body")
+			return
+		}
+		if len(body) > maxSignedBody {
+			http.Error(w, `{"error": "request body too large"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if !crypto.VerifySignature(secret, timestamp, nonce, body, signature) {
+			v.reject(w, r, "invalid request signature")
+			return
+		}
+
+		// Check the nonce only after the signature, so forged requests
+		// can't fill the table
+		key := apiKey + ":" + nonce
+		v.mu.Lock()
+		_, replayed := v.seen[key]
+		if !replayed {
+			v.seen[key] = signedAt.Add(v.maxSkew)
+		}
+		v.mu.Unlock()
+		if replayed {
+			v.reject(w, r, "replayed request")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (v *SignatureVerifier) reject(w http.ResponseWriter, r *http.Request, reason string) {
+	v.logger.Warn("request signature rejected", "remote", r.RemoteAddr, "reason", reason)
+	errcode.Write(w, http.StatusUnauthorized, errcode.EndpointAuth, reason)
+}
+
+// Len returns the number of remembered nonces
+func (v *SignatureVerifier) Len() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.seen)
+}
+
+func (v *SignatureVerifier) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		v.mu.Lock()
+		now := time.Now()
+		for key, forgetAt := range v.seen {
+			if now.After(forgetAt) {
+				delete(v.seen, key)
+			}
+		}
+		v.mu.Unlock()
+	}
+}
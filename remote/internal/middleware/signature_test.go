@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/crypto"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	v := NewSignatureVerifier(map[string]string{"k": "secret"}, time.Minute, logging.Discard())
+	h := v.Middleware(next)
+
+	const body = `{"domain":"example.com","type":"A"}`
+	send := func(sentBody, secret, nonce string, signedAt time.Time) int {
+		ts := strconv.FormatInt(signedAt.Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(sentBody))
+		req.Header.Set("X-API-Key", "k")
+		req.Header.Set(crypto.TimestampHeader, ts)
+		req.Header.Set(crypto.NonceHeader, nonce)
+		req.Header.Set(crypto.SignatureHeader, crypto.Sign(secret, ts, nonce, []byte(body)))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		body   string
+		secret string
+		nonce  string
+		at     time.Time
+		status int
+	}{
+		{"valid", body, "secret", "n1", now, http.StatusOK},
+		{"replayed nonce", body, "secret", "n1", now, http.StatusUnauthorized},
+		{"tampered body", strings.Replace(body, "example", "evil", 1), "secret", "n2", now, http.StatusUnauthorized},
+		{"wrong secret", body, "other", "n3", now, http.StatusUnauthorized},
+		{"stale timestamp", body, "secret", "n4", now.Add(-2 * time.Minute), http.StatusUnauthorized},
+		{"future timestamp", body, "secret", "n5", now.Add(2 * time.Minute), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := send(tt.body, tt.secret, tt.nonce, tt.at); got != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.status)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/resolve", strings.NewReader(body))
+	req.Header.Set("X-API-Key", "k")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: status %d, want 401", rec.Code)
+	}
+
+	if v.Len() != 1 {
+		t.Errorf("expected 1 remembered nonce, got %d", v.Len())
+	}
+}
@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// tokenScopes maps the scopes a token may grant to the paths they open
+var tokenScopes = map[string][]string{
+	"resolve": {"/api/v1/resolve", "/api/v1/data", "/api/v1/session"},
+	"peers":   {"/api/v1/peers"},
+	"tamper":  {"/api/v1/tamper"},
+}
+
+// ErrTooManyTokens is returned by Mint while max_active tokens are alive
+var ErrTooManyTokens = errors.New("too many active tokens")
+
+// Token is a temporary API key as listed to operators. Key is only set
+// when the token is minted.
+type Token struct {
+	ID              string    `json:"id"`
+	Key             string    `json:"token,omitempty"`
+	Label           string    `json:"label,omitempty"`
+	Scopes          []string  `json:"scopes"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	RateLimitPerSec float64   `json:"rate_limit_per_sec"`
+	RateLimitBurst  int       `json:"rate_limit_burst"`
+	Quota           int64     `json:"quota,omitempty"` // requests allowed in all; 0 for no limit
+	Used            int64     `json:"used"`
+}
+
+// TokenRequest describes a token to mint. Zero fields take the defaults.
+type TokenRequest struct {
+	Label           string
+	TTL             time.Duration
+	RateLimitPerSec float64
+	RateLimitBurst  int
+	Quota           int64
+	Scopes          []string // default resolve
+}
+
+// TokenLimits bounds the tokens that may be minted
+type TokenLimits struct {
+	DefaultTTL      time.Duration
+	MaxTTL          time.Duration
+	RateLimitPerSec float64 // default and highest rate
+	RateLimitBurst  int     // default and highest burst
+	MaxActive       int
+}
+
+type token struct {
+	Token
+	used atomic.Int64
+}
+
+// Tokens mints temporary API keys, each valid until it expires, limited to
+// the endpoints of its scopes, rate limited on its own and optionally
+// capped at a number of requests. Its middleware goes inside the API key
+// check, which the keys are added to.
+type Tokens struct {
+	auth    *APIKeyAuth
+	limiter *RateLimiter
+	limits  TokenLimits
+
+	mu     sync.Mutex
+	byKey  map[string]*token
+	byID   map[string]*token
+	minted atomic.Int64
+}
+
+// NewTokens creates a token store adding keys to auth and their rate
+// limits to limiter
+func NewTokens(auth *APIKeyAuth, limiter *RateLimiter, limits TokenLimits) *Tokens {
+	return &Tokens{
+		auth:    auth,
+		limiter: limiter,
+		limits:  limits,
+		byKey:   make(map[string]*token),
+		byID:    make(map[string]*token),
+	}
+}
+
+// Mint creates a token. Rates above the limits and unknown scopes are
+// refused.
+func (t *Tokens) Mint(req TokenRequest) (Token, error) {
+	if req.TTL == 0 {
+		req.TTL = t.limits.DefaultTTL
+	}
+	if req.RateLimitPerSec == 0 {
+		req.RateLimitPerSec = t.limits.RateLimitPerSec
+	}
+	if req.RateLimitBurst == 0 {
+		req.RateLimitBurst = t.limits.RateLimitBurst
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{"resolve"}
+	}
+	switch {
+	case req.TTL < 0 || req.TTL > t.limits.MaxTTL:
+		return Token{}, fmt.Errorf("ttl must be at most %s", t.limits.MaxTTL)
+	case req.RateLimitPerSec < 0 || req.RateLimitPerSec > t.limits.RateLimitPerSec:
+		return Token{}, fmt.Errorf("rate_limit_per_sec must be at most %g", t.limits.RateLimitPerSec)
+	case req.RateLimitBurst < 0 || req.RateLimitBurst > t.limits.RateLimitBurst:
+		return Token{}, fmt.Errorf("rate_limit_burst must be at most %d", t.limits.RateLimitBurst)
+	case req.Quota < 0:
+		return Token{}, fmt.Errorf("quota must not be negative")
+	}
+	for _, scope := range req.Scopes {
+		if _, ok := tokenScopes[scope]; !ok {
+			return Token{}, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	key, id := make([]byte, 24), make([]byte, 4)
+	if _, err := rand.Read(key); err != nil {
+		return Token{}, err
+	}
+	rand.Read(id)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(time.Now())
+	if len(t.byKey) >= t.limits.MaxActive {
+		return Token{}, ErrTooManyTokens
+	}
+	tok := &token{Token: Token{
+		ID:              hex.EncodeToString(id),
+		Key:             "tok_" + hex.EncodeToString(key),
+		Label:           req.Label,
+		Scopes:          req.Scopes,
+		ExpiresAt:       time.Now().Add(req.TTL).UTC().Truncate(time.Second),
+		RateLimitPerSec: req.RateLimitPerSec,
+		RateLimitBurst:  req.RateLimitBurst,
+		Quota:           req.Quota,
+	}}
+	t.byKey[tok.Key] = tok
+	t.byID[tok.ID] = tok
+	t.auth.AddKey(tok.Key)
+	t.limiter.AddGroup([]string{tok.Key}, req.RateLimitPerSec, req.RateLimitBurst)
+	t.minted.Add(1)
+	return tok.Token, nil
+}
+
+// Revoke ends the token with the given ID before it expires
+func (t *Tokens) Revoke(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tok, ok := t.byID[id]
+	if ok {
+		t.remove(tok)
+	}
+	return ok
+}
+
+// List returns the live tokens, soonest to expire first, without their keys
+func (t *Tokens) List() []Token {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(time.Now())
+	list := make([]Token, 0, len(t.byKey))
+	for _, tok := range t.byKey {
+		list = append(list, tok.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ExpiresAt.Before(list[j].ExpiresAt) })
+	return list
+}
+
+// Stats returns the number of live and minted tokens
+func (t *Tokens) Stats() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(time.Now())
+	return map[string]interface{}{
+		"active": len(t.byKey),
+		"minted": t.minted.Load(),
+	}
+}
+
+// Middleware enforces the expiry, scopes and quota of requests made with a
+// token; requests with other keys pass through
+func (t *Tokens) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyOf(r)
+		t.mu.Lock()
+		tok, ok := t.byKey[key]
+		if ok && !time.Now().Before(tok.ExpiresAt) {
+			t.remove(tok)
+			t.mu.Unlock()
+			errcode.Write(w, http.StatusUnauthorized, errcode.EndpointAuth, "token expired")
+			return
+		}
+		t.mu.Unlock()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !tok.grants(r.URL.Path) {
+			errcode.Write(w, http.StatusForbidden, errcode.EndpointAuth, "token does not grant access to this endpoint")
+			return
+		}
+		if used := tok.used.Add(1); tok.Quota > 0 && used > tok.Quota {
+			tok.used.Add(-1)
+			errcode.Write(w, http.StatusTooManyRequests, errcode.RateLimited, "token quota used up")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grants reports whether one of the token's scopes opens path
+func (tok *token) grants(path string) bool {
+	for _, scope := range tok.Scopes {
+		if slices.Contains(tokenScopes[scope], path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tok *token) snapshot() Token {
+	s := tok.Token
+	s.Key = ""
+	s.Used = tok.used.Load()
+	return s
+}
+
+// sweep removes expired tokens (must be called with the lock held)
+func (t *Tokens) sweep(now time.Time) {
+	for _, tok := range t.byKey {
+		if !now.Before(tok.ExpiresAt) {
+			t.remove(tok)
+		}
+	}
+}
+
+// remove ends tok (must be called with the lock held)
+func (t *Tokens) remove(tok *token) {
+	delete(t.byKey, tok.Key)
+	delete(t.byID, tok.ID)
+	t.auth.RemoveKey(tok.Key)
+	t.limiter.Remove(tok.Key)
+}
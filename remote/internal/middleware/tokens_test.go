@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	auth := NewAPIKeyAuth([]string{"permanent"})
+	limiter := NewRateLimiter(math.Inf(1), 1)
+	tokens := NewTokens(auth, limiter, TokenLimits{
+		DefaultTTL:      time.Hour,
+		MaxTTL:          24 * time.Hour,
+		RateLimitPerSec: 100,
+		RateLimitBurst:  100,
+		MaxActive:       3,
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := auth.Middleware(tokens.Middleware(limiter.Middleware(ok)))
+	send := func(key, path string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, req := range []TokenRequest{
+		{TTL: 48 * time.Hour},
+		{RateLimitPerSec: 1000},
+		{Quota: -1},
+		{Scopes: []string{"admin"}},
+	} {
+		if _, err := tokens.Mint(req); err == nil {
+			t.Errorf("Mint(%+v) succeeded beyond the limits", req)
+		}
+	}
+
+	guest, err := tokens.Mint(TokenRequest{Label: "guest", Quota: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guest.Key == "" || guest.RateLimitPerSec != 100 || guest.Scopes[0] != "resolve" || time.Until(guest.ExpiresAt) < 59*time.Minute {
+		t.Errorf("defaults not applied: %+v", guest)
+	}
+
+	tests := []struct {
+		name, key, path string
+		want            int
+	}{
+		{"permanent key", "permanent", "/api/v1/tamper", http.StatusOK},
+		{"in scope", guest.Key, "/api/v1/resolve", http.StatusOK},
+		{"out of scope", guest.Key, "/api/v1/tamper", http.StatusForbidden},
+		{"quota left", guest.Key, "/api/v1/data", http.StatusOK},
+		{"quota used up", guest.Key, "/api/v1/resolve", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		if got := send(tt.key, tt.path); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if list := tokens.List(); len(list) != 1 || list[0].Used != 2 || list[0].Key != "" {
+		t.Errorf("List = %+v", list)
+	}
+
+	// Revoked and expired tokens stop working
+	if !tokens.Revoke(guest.ID) || tokens.Revoke(guest.ID) {
+		t.Error("Revoke should succeed once")
+	}
+	if got := send(guest.Key, "/api/v1/resolve"); got != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d", got)
+	}
+	short, _ := tokens.Mint(TokenRequest{TTL: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	if got := send(short.Key, "/api/v1/resolve"); got != http.StatusUnauthorized {
+		t.Errorf("expired token: status %d", got)
+	}
+	if send(short.Key, "/api/v1/resolve") != http.StatusUnauthorized || auth.IsValidKey(short.Key) {
+		t.Error("expired token still accepted")
+	}
+
+	for i := 0; i < 3; i++ {
+		tokens.Mint(TokenRequest{})
+	}
+	if _, err := tokens.Mint(TokenRequest{}); !errors.Is(err, ErrTooManyTokens) {
+		t.Errorf("Mint beyond max_active: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyFingerprint identifies an API key in logs and statistics without
+// revealing it: the first 6 bytes of its SHA-256, in hex
+func KeyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// KeyStats counts the requests made with one API key
+type KeyStats struct {
+	Requests int64     `json:"requests"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+type keyCounter struct {
+	requests atomic.Int64
+	lastUsed atomic.Int64 // unix nanoseconds
+}
+
+// KeyUsage counts requests per API key. Its middleware goes inside the API
+// key check, so only valid keys are counted.
+type KeyUsage struct {
+	keys sync.Map // fingerprint -> *keyCounter
+}
+
+// NewKeyUsage creates an empty per-key request counter
+func NewKeyUsage() *KeyUsage {
+	return &KeyUsage{}
+}
+
+// Middleware counts the request under its API key
+func (u *KeyUsage) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyOf(r)
+		v, _ := u.keys.LoadOrStore(KeyFingerprint(key), new(keyCounter))
+		c := v.(*keyCounter)
+		c.requests.Add(1)
+		c.lastUsed.Store(time.Now().UnixNano())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stats returns the request counts by key fingerprint
+func (u *KeyUsage) Stats() map[string]KeyStats {
+	stats := make(map[string]KeyStats)
+	u.keys.Range(func(k, v any) bool {
+		c := v.(*keyCounter)
+		stats[k.(string)] = KeyStats{
+			Requests: c.requests.Load(),
+			LastUsed: time.Unix(0, c.lastUsed.Load()).UTC(),
+		}
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,130 @@
+// Package openapi generates OpenAPI 3 schemas from Go types so the published
+// API description cannot drift from the structs the handlers encode.
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Generator builds JSON schemas for Go types. Named struct types are
+// emitted once under components/schemas and referenced elsewhere.
+type Generator struct {
+	schemas map[string]map[string]any
+	enums   map[reflect.Type][]string
+}
+
+// NewGenerator creates an empty generator
+func NewGenerator() *Generator {
+	return &Generator{
+		schemas: make(map[string]map[string]any),
+		enums:   make(map[reflect.Type][]string),
+	}
+}
+
+// Enum restricts values of a named string type to the given set
+func (g *Generator) Enum(t reflect.Type, values ...string) {
+	g.enums[t] = values
+}
+
+// Ref returns a reference to the schema of v's type, registering it
+func (g *Generator) Ref(v any) map[string]any {
+	return g.schema(reflect.TypeOf(v))
+}
+
+// Schemas returns the registered component schemas
+func (g *Generator) Schemas() map[string]map[string]any {
+	return g.schemas
+}
+
+func (g *Generator) schema(t reflect.Type) map[string]any {
+	if values, ok := g.enums[t]; ok {
+		return map[string]any{"type": "string", "enum": values}
+	}
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"} // RFC 3339 in encoding/json
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"} // encoding/json uses base64
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]any{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = nil // placeholder breaks recursion
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// object builds an object schema from exported fields and their json tags;
+// fields without omitempty are required
+func (g *Generator) object(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, omitempty, skip := jsonName(f)
+		if skip {
+			continue
+		}
+		props[name] = g.schema(f.Type)
+		if !omitempty {
+			required = append(required, name)
+		}
+	}
+
+	obj := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
+
+// jsonName returns the JSON property name of a struct field
+func jsonName(f reflect.StructField) (name string, omitempty, skip bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, true
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+	for _, opt := range parts[1:] {
+		if opt == "omitempty" {
+			omitempty = true
+		}
+	}
+	return name, omitempty, false
+}
@@ -0,0 +1,101 @@
+package resolver
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// bogonPrefixes are ranges that never appear in public DNS answers. An
+// upstream returning them for a public name is misconfigured or poisoned
+// (censors commonly answer with 10.x or 0.0.0.0).
+var bogonPrefixes = mustPrefixes(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustPrefixes(cidrs ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(cidrs))
+	for i, cidr := range cidrs {
+		prefixes[i] = netip.MustParsePrefix(cidr)
+	}
+	return prefixes
+}
+
+// isBogon reports whether an address lies in reserved or private space
+func isBogon(value string) bool {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range bogonPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBogons drops bogon A/AAAA records from a result. It returns an
+// error when every address was a bogon so the caller tries another
+// upstream instead of caching a poisoned answer.
+func (r *Resolver) filterBogons(result *ResolveResult, upstream string) error {
+	if !r.filterBogon || r.bogonExempt(result.Domain) {
+		return nil
+	}
+
+	kept := result.Records[:0]
+	dropped, addresses := 0, 0
+	for _, rec := range result.Records {
+		if rec.Type == TypeA || rec.Type == TypeAAAA {
+			if isBogon(rec.Value) {
+				dropped++
+				continue
+			}
+			addresses++
+		}
+		kept = append(kept, rec)
+	}
+	result.Records = kept
+	if dropped == 0 {
+		return nil
+	}
+
+	r.bogonsFiltered.Add(int64(dropped))
+	r.logger.Warn("filtered bogon answers", "domain", result.Domain, "upstream", upstream, "dropped", dropped)
+	if addresses == 0 {
+		return fmt.Errorf("upstream %s returned only bogon addresses for %s", upstream, result.Domain)
+	}
+	return nil
+}
+
+// bogonExempt reports whether domain is allowed to resolve to private space
+func (r *Resolver) bogonExempt(domain string) bool {
+	domain = strings.ToLower(domain)
+	for _, suffix := range r.bogonAllow {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
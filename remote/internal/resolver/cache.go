@@ -5,9 +5,25 @@ import (
 	"time"
 )
 
+// CacheBackend stores resolved results. Implementations must be safe for
+// concurrent use and return copies the caller may modify.
+type CacheBackend interface {
+	Get(key string) (*ResolveResult, bool)
+	// GetStale returns an expired result still inside the backend's
+	// serve-stale window; fresh entries are reported by Get instead
+	GetStale(key string) (*ResolveResult, bool)
+	// Set stores result for ttl, plus any serve-stale window
+	Set(key string, result *ResolveResult, ttl time.Duration)
+	// DeleteFunc removes the entries whose key match reports true and
+	// returns how many it removed
+	DeleteFunc(match func(key string) bool) int
+	Len() int
+}
+
 // cacheEntry represents a cached DNS result
 type cacheEntry struct {
 	result    *ResolveResult
+	storedAt  time.Time
 	expiresAt time.Time
 }
 
@@ -16,15 +32,14 @@ type Cache struct {
 	items    map[string]*cacheEntry
 	mu       sync.RWMutex
 	maxItems int
-	ttl      time.Duration
+	stale    time.Duration // expired entries are kept this long for GetStale
 }
 
 // NewCache creates a new DNS cache
-func NewCache(maxItems int, ttl time.Duration) *Cache {
+func NewCache(maxItems int) *Cache {
 	c := &Cache{
 		items:    make(map[string]*cacheEntry),
 		maxItems: maxItems,
-		ttl:      ttl,
 	}
 
 	// Start cleanup goroutine
@@ -33,6 +48,14 @@ func NewCache(maxItems int, ttl time.Duration) *Cache {
 	return c
 }
 
+// EnableServeStale keeps expired entries for window so they can be served
+// by GetStale while a refresh is in flight
+func (c *Cache) EnableServeStale(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale = window
+}
+
 // Get retrieves a cached result
 func (c *Cache) Get(key string) (*ResolveResult, bool) {
 	c.mu.RLock()
@@ -47,17 +70,40 @@ func (c *Cache) Get(key string) (*ResolveResult, bool) {
 		return nil, false
 	}
 
-	// Return a copy to avoid data races
+	return entry.copy(), true
+}
+
+// GetStale retrieves an expired result that is still within the stale window
+func (c *Cache) GetStale(key string) (*ResolveResult, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	if !now.After(entry.expiresAt) || now.After(entry.expiresAt.Add(c.stale)) {
+		return nil, false
+	}
+
+	return entry.copy(), true
+}
+
+// copy returns the result with aged TTLs; callers may modify it
+func (entry *cacheEntry) copy() *ResolveResult {
 	result := *entry.result
 	records := make([]DNSRecord, len(entry.result.Records))
 	copy(records, entry.result.Records)
 	result.Records = records
+	ageRecords(&result, time.Since(entry.storedAt))
 
-	return &result, true
+	return &result
 }
 
-// Set stores a result in the cache
-func (c *Cache) Set(key string, result *ResolveResult) {
+// Set stores a result in the cache for ttl
+func (c *Cache) Set(key string, result *ResolveResult, ttl time.Duration) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -66,10 +112,27 @@ func (c *Cache) Set(key string, result *ResolveResult) {
 		c.evictOldest()
 	}
 
+	now := time.Now()
 	c.items[key] = &cacheEntry{
 		result:    result,
-		expiresAt: time.Now().Add(c.ttl),
+		storedAt:  now,
+		expiresAt: now.Add(ttl),
+	}
+}
+
+// DeleteFunc removes the entries whose key match reports true
+func (c *Cache) DeleteFunc(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key := range c.items {
+		if match(key) {
+			delete(c.items, key)
+			removed++
+		}
 	}
+	return removed
 }
 
 // Len returns the number of items in the cache
@@ -79,6 +142,19 @@ func (c *Cache) Len() int {
 	return len(c.items)
 }
 
+// ageRecords lowers record TTLs by the time spent in the cache, keeping at
+// least one second so clients do not treat the answer as uncacheable
+func ageRecords(result *ResolveResult, elapsed time.Duration) {
+	secs := uint32(elapsed / time.Second)
+	for i := range result.Records {
+		if result.Records[i].TTL > secs {
+			result.Records[i].TTL -= secs
+		} else {
+			result.Records[i].TTL = 1
+		}
+	}
+}
+
 // evictOldest removes the oldest entry (must be called with lock held)
 func (c *Cache) evictOldest() {
 	var oldestKey string
@@ -103,7 +179,7 @@ func (c *Cache) cleanup() {
 		c.mu.Lock()
 		now := time.Now()
 		for key, entry := range c.items {
-			if now.After(entry.expiresAt) {
+			if now.After(entry.expiresAt.Add(c.stale)) {
 				delete(c.items, key)
 			}
 		}
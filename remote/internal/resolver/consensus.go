@@ -0,0 +1,106 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// consensus queries raceCount upstreams concurrently and returns an answer
+// only if at least quorum of them agree, so a single poisoned or censored
+// upstream cannot decide the result. Two answers agree when they share a
+// record value, which tolerates CDNs handing different upstreams different
+// subsets of their addresses while still rejecting a forged answer.
+func (r *Resolver) consensus(ctx context.Context, domain string, recordType RecordType) (*ResolveResult, error) {
+	upstreams := r.health.available(r.upstreams)
+	if len(upstreams) < r.quorum {
+		// Too few left to ever agree; the excluded ones may yet answer
+		upstreams = r.upstreams
+	}
+	upstreams = upstreams[:min(r.raceCount, len(upstreams))]
+	results := make([]*ResolveResult, len(upstreams))
+	errs := make([]error, len(upstreams))
+
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(i int, upstream string) {
+			defer wg.Done()
+			result, err := r.resolveWithUpstream(ctx, domain, recordType, upstream)
+			if err != nil {
+				r.logger.Debug("upstream query failed", "upstream", upstream, "domain", domain, "type", recordType, "error", err)
+				errs[i] = err
+				return
+			}
+			results[i] = result
+		}(i, upstream)
+	}
+	wg.Wait()
+	r.tamper.observe(domain, upstreams, results, errs)
+
+	if result := findConsensus(results, r.quorum); result != nil {
+		return result, nil
+	}
+
+	answered := 0
+	for _, result := range results {
+		if result != nil {
+			answered++
+		}
+	}
+	r.consensusFailures.Add(1)
+	r.logger.Warn("upstreams disagree", "domain", domain, "type", recordType, "answered", answered, "quorum", r.quorum)
+	return nil, fmt.Errorf("no consensus among upstreams for %s (%d answered, quorum %d)", domain, answered, r.quorum)
+}
+
+// findConsensus returns the first result that agrees with at least quorum
+// results (itself included), or nil. Nil entries are failed upstreams.
+func findConsensus(results []*ResolveResult, quorum int) *ResolveResult {
+	for i, candidate := range results {
+		if candidate == nil {
+			continue
+		}
+		votes := 0
+		for _, other := range results {
+			if other != nil && agree(candidate, other) {
+				votes++
+			}
+		}
+		if votes >= quorum {
+			return results[i]
+		}
+	}
+	return nil
+}
+
+// agree reports whether two answers share a record value; two empty answers
+// (no records of the type) also agree. CNAME chains are passed over: only
+// the records they lead to are compared.
+func agree(a, b *ResolveResult) bool {
+	ra, rb := finalRecords(a.Records), finalRecords(b.Records)
+	if len(ra) == 0 || len(rb) == 0 {
+		return len(ra) == len(rb)
+	}
+	values := make(map[string]bool, len(ra))
+	for _, rec := range ra {
+		values[rec.Value] = true
+	}
+	for _, rec := range rb {
+		if values[rec.Value] {
+			return true
+		}
+	}
+	return false
+}
+
+// finalRecords returns the records after the CNAME chain that leads an
+// answer, or the chain itself when nothing follows it (a CNAME query, or an
+// alias to a name without records of the type)
+func finalRecords(records []DNSRecord) []DNSRecord {
+	for i, rec := range records {
+		if rec.Type != TypeCNAME {
+			return records[i:]
+		}
+	}
+	return records
+}
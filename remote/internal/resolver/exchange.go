@@ -0,0 +1,156 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// qtypes maps the supported record types to their wire types
+var qtypes = map[RecordType]uint16{
+	TypeA:     dns.TypeA,
+	TypeAAAA:  dns.TypeAAAA,
+	TypeCNAME: dns.TypeCNAME,
+	TypeMX:    dns.TypeMX,
+	TypeTXT:   dns.TypeTXT,
+	TypeNS:    dns.TypeNS,
+	TypePTR:   dns.TypePTR,
+}
+
+const (
+	// ednsBufferSize is the UDP payload size advertised to upstreams, small
+	// enough to avoid IP fragmentation (DNS Flag Day 2020)
+	ednsBufferSize = 1232
+	// maxCNAMEChain bounds how many aliases are followed in an answer
+	maxCNAMEChain = 8
+)
+
+// NXDomainError is an upstream's answer that the name does not exist
+type NXDomainError struct {
+	Domain string
+	TTL    uint32 // how long the answer may be cached, from the zone's SOA; 0 if unknown
+}
+
+func (e *NXDomainError) Error() string {
+	return "lookup " + e.Domain + ": no such host"
+}
+
+// exchange sends one query to upstream with the client's flags, over TCP
+// again if the UDP answer was truncated
+func exchange(ctx context.Context, upstream, domain string, qtype uint16, timeout time.Duration, flags QueryFlags) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), qtype)
+	m.SetEdns0(ednsBufferSize, false)
+	m.CheckingDisabled = flags.CheckingDisabled
+	m.AuthenticatedData = flags.AuthenticatedData
+	m.RecursionDesired = !flags.NoRecursion
+
+	c := &dns.Client{Net: "udp", Timeout: timeout, UDPSize: ednsBufferSize}
+	resp, _, err := c.ExchangeContext(ctx, m, upstream)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, m, upstream)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchange sends one query to upstream, or resolves it from the root
+// servers for the iterative upstream
+func (r *Resolver) exchange(ctx context.Context, upstream, domain string, qtype uint16, timeout time.Duration, flags QueryFlags) (*dns.Msg, error) {
+	if upstream == IterativeUpstream {
+		return r.iter.resolve(ctx, domain, qtype, 0)
+	}
+	return exchange(ctx, upstream, domain, qtype, timeout, flags)
+}
+
+// parseAnswer converts an upstream response into a result. Aliases are
+// followed to the records of the requested type, and the result lists the
+// CNAME chain first, then those records, in the order a recursive resolver
+// answers.
+func parseAnswer(domain string, recordType RecordType, qtype uint16, msg *dns.Msg) (*ResolveResult, error) {
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, &NXDomainError{Domain: domain, TTL: negativeTTL(msg)}
+	default:
+		return nil, fmt.Errorf("lookup %s: upstream answered %s", domain, dns.RcodeToString[msg.Rcode])
+	}
+
+	var chain, answers []DNSRecord
+	name, owner := dns.Fqdn(domain), domain
+	for hops := 0; ; hops++ {
+		var alias *dns.CNAME
+		for _, rr := range msg.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if cname, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+				alias = cname
+				continue
+			}
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+			if rec, ok := toRecord(owner, recordType, rr); ok {
+				answers = append(answers, rec)
+			}
+		}
+		if len(answers) > 0 || alias == nil || hops == maxCNAMEChain {
+			break
+		}
+		chain = append(chain, DNSRecord{Name: owner, Type: TypeCNAME, Value: alias.Target, TTL: alias.Hdr.Ttl})
+		name, owner = alias.Target, strings.TrimSuffix(alias.Target, ".")
+	}
+
+	result := &ResolveResult{
+		Domain:            domain,
+		Records:           append(append([]DNSRecord{}, chain...), answers...),
+		AuthenticatedData: msg.AuthenticatedData,
+	}
+	if len(answers) == 0 {
+		result.NegativeTTL = negativeTTL(msg)
+	}
+	return result, nil
+}
+
+// toRecord converts an answer record owned by name
+func toRecord(name string, recordType RecordType, rr dns.RR) (DNSRecord, bool) {
+	rec := DNSRecord{Name: name, Type: recordType, TTL: rr.Header().Ttl}
+	switch v := rr.(type) {
+	case *dns.A:
+		rec.Value = v.A.String()
+	case *dns.AAAA:
+		rec.Value = v.AAAA.String()
+	case *dns.CNAME:
+		rec.Value = v.Target
+	case *dns.MX:
+		rec.Value = fmt.Sprintf("%d %s", v.Preference, v.Mx)
+	case *dns.TXT:
+		rec.Value = strings.Join(v.Txt, "")
+	case *dns.NS:
+		rec.Value = v.Ns
+	case *dns.PTR:
+		rec.Value = v.Ptr
+	default:
+		return DNSRecord{}, false
+	}
+	return rec, true
+}
+
+// negativeTTL returns how long a negative answer may be cached: the lower
+// of the authority SOA's TTL and its minimum field (RFC 2308 section 5), or
+// 0 without an SOA
+func negativeTTL(msg *dns.Msg) uint32 {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	return 0
+}
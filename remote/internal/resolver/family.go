@@ -0,0 +1,222 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// Address families the host can reach upstreams over
+const (
+	FamilyAuto = "auto" // detected from the routing table
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+	FamilyDual = "dual"
+)
+
+// NAT64Auto discovers the NAT64 prefix from the system resolver (RFC 7050)
+const NAT64Auto = "auto"
+
+// ipv4OnlyArpa is the name DNS64 resolvers synthesize AAAA records for,
+// from its well-known A records 192.0.0.170 and 192.0.0.171
+const ipv4OnlyArpa = "ipv4only.arpa"
+
+var ipv4OnlyAddrs = []netip.Addr{netip.AddrFrom4([4]byte{192, 0, 0, 170}), netip.AddrFrom4([4]byte{192, 0, 0, 171})}
+
+// nat64PrefixLengths are the prefix lengths RFC 6052 embeds IPv4 addresses in
+var nat64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+// UpstreamOptions controls how upstream addresses are fitted to the host's
+// network
+type UpstreamOptions struct {
+	Family      string // auto, ipv4, ipv6 or dual
+	NAT64Prefix string // prefix IPv4 upstreams are reached through on IPv6-only hosts, or "auto"
+	Logger      *slog.Logger
+}
+
+// PrepareUpstreams turns the configured upstreams into addresses the host
+// can reach. Hostnames are resolved, AAAA first when IPv6 is available
+// (a DNS64 system resolver returns synthesized ones for IPv4-only servers).
+// On an IPv6-only host, IPv4 upstreams are translated into the NAT64 prefix,
+// or dropped without one. An error means no upstream is usable.
+func PrepareUpstreams(ctx context.Context, upstreams []string, opts UpstreamOptions) ([]string, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	hasV4, hasV6 := families(opts.Family)
+
+	var prefix netip.Prefix
+	if !hasV4 && opts.NAT64Prefix != "" {
+		var err error
+		if opts.NAT64Prefix == NAT64Auto {
+			prefix, err = DiscoverNAT64(ctx, net.DefaultResolver)
+		} else {
+			prefix, err = ParseNAT64Prefix(opts.NAT64Prefix)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("nat64 prefix: %w", err)
+		}
+		logger.Info("reaching IPv4 upstreams through NAT64", "prefix", prefix)
+	}
+
+	var out []string
+	for _, upstream := range upstreams {
+		// Reaches the root servers over IPv4
+		if upstream == IterativeUpstream {
+			out = append(out, upstream)
+			continue
+		}
+		host, port, err := net.SplitHostPort(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", upstream, err)
+		}
+
+		var addrs []netip.Addr
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = []netip.Addr{addr}
+		} else {
+			resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+			if err != nil {
+				logger.Warn("upstream hostname did not resolve", "upstream", upstream, "error", err)
+				continue
+			}
+			addrs = preferIPv6(resolved, hasV6)
+		}
+
+		addr, ok := reachable(addrs, hasV4, hasV6, prefix)
+		if !ok {
+			logger.Warn("upstream unreachable over this host's address families", "upstream", upstream, "ipv4", hasV4, "ipv6", hasV6)
+			continue
+		}
+		// One address per upstream, so retries aren't multiplied
+		out = append(out, net.JoinHostPort(addr.String(), port))
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no upstream is reachable (ipv4 %v, ipv6 %v); add IPv6 upstreams or set nat64_prefix", hasV4, hasV6)
+	}
+	return out, nil
+}
+
+// reachable returns the first address the host can reach, translating IPv4
+// addresses into the NAT64 prefix when the host has no IPv4
+func reachable(addrs []netip.Addr, hasV4, hasV6 bool, nat64 netip.Prefix) (netip.Addr, bool) {
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		switch {
+		case addr.Is4() && hasV4, addr.Is6() && hasV6:
+			return addr, true
+		case addr.Is4() && hasV6 && nat64.IsValid():
+			return synthesize(nat64, addr), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// ParseNAT64Prefix parses an IPv6 prefix of a length RFC 6052 allows
+func ParseNAT64Prefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if !prefix.Addr().Is6() || !slices.Contains(nat64PrefixLengths, prefix.Bits()) {
+		return netip.Prefix{}, fmt.Errorf("%s is not an IPv6 /32, /40, /48, /56, /64 or /96", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// families returns the address families in use, detecting them for auto
+func families(family string) (v4, v6 bool) {
+	switch family {
+	case FamilyIPv4:
+		return true, false
+	case FamilyIPv6:
+		return false, true
+	case FamilyDual:
+		return true, true
+	}
+	return routable("udp4", "192.0.2.1:53"), routable("udp6", "[2001:db8::1]:53")
+}
+
+// routable reports whether the host has a route for network. Connecting a
+// UDP socket sends nothing; it only looks the route up.
+func routable(network, addr string) bool {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// preferIPv6 orders IPv6 addresses first when the host has IPv6
+func preferIPv6(addrs []netip.Addr, hasV6 bool) []netip.Addr {
+	if !hasV6 {
+		return addrs
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for _, a := range addrs {
+		if a.Unmap().Is6() {
+			out = append(out, a)
+		}
+	}
+	for _, a := range addrs {
+		if a.Unmap().Is4() {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// synthesize embeds an IPv4 address in a NAT64 prefix (RFC 6052 section
+// 2.2); bits 64-71 stay zero
+func synthesize(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Masked().Addr().As16()
+	v := v4.As4()
+	for i, j := prefix.Bits()/8, 0; j < 4; i++ {
+		if i == 8 {
+			continue
+		}
+		b[i] = v[j]
+		j++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// extract is the inverse of synthesize for one prefix length
+func extract(addr netip.Addr, bits int) (netip.Prefix, netip.Addr) {
+	b := addr.As16()
+	var v [4]byte
+	for i, j := bits/8, 0; j < 4; i++ {
+		if i == 8 {
+			continue
+		}
+		v[j] = b[i]
+		j++
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix, netip.AddrFrom4(v)
+}
+
+// DiscoverNAT64 finds the NAT64 prefix from the AAAA records a DNS64
+// resolver synthesizes for ipv4only.arpa (RFC 7050)
+func DiscoverNAT64(ctx context.Context, r *net.Resolver) (netip.Prefix, error) {
+	addrs, err := r.LookupNetIP(ctx, "ip6", ipv4OnlyArpa)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("no DNS64 answer for %s: %w", ipv4OnlyArpa, err)
+	}
+	for _, addr := range addrs {
+		for _, bits := range nat64PrefixLengths {
+			prefix, v4 := extract(addr, bits)
+			for _, known := range ipv4OnlyAddrs {
+				if v4 == known {
+					return prefix, nil
+				}
+			}
+		}
+	}
+	return netip.Prefix{}, fmt.Errorf("%s AAAA records embed no known address", ipv4OnlyArpa)
+}
@@ -0,0 +1,42 @@
+package resolver
+
+import "context"
+
+// QueryFlags are the header bits a client set on its query, passed on to
+// upstreams so DNSSEC and recursion semantics survive the API, and whether
+// it may be answered from the cache. The zero value is a plain recursive
+// query.
+type QueryFlags struct {
+	CheckingDisabled  bool // CD: the client validates; upstreams must not drop bogus answers
+	AuthenticatedData bool // AD: ask upstreams to report whether they validated (RFC 6840)
+	NoRecursion       bool // RD clear: answer only from the upstream's cache
+	NoCache           bool // ask the upstreams even if cached; the answer still replaces the cached one
+}
+
+// cacheSuffix keeps answers to queries with different header bits apart in
+// the cache; plain queries keep their historical key
+func (f QueryFlags) cacheSuffix() string {
+	s := ""
+	if f.CheckingDisabled {
+		s += ":cd"
+	}
+	if f.AuthenticatedData {
+		s += ":ad"
+	}
+	if f.NoRecursion {
+		s += ":nord"
+	}
+	return s
+}
+
+type flagsKey struct{}
+
+// WithQueryFlags returns a context whose lookups are sent with flags f
+func WithQueryFlags(ctx context.Context, f QueryFlags) context.Context {
+	return context.WithValue(ctx, flagsKey{}, f)
+}
+
+func flagsOf(ctx context.Context) QueryFlags {
+	f, _ := ctx.Value(flagsKey{}).(QueryFlags)
+	return f
+}
@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"strings"
+	"time"
+)
+
+// Flush removes the cached answers for suffix and its subdomains, or every
+// cached answer when suffix is empty, and returns how many it removed
+func (r *Resolver) Flush(suffix string) int {
+	if r.cache == nil {
+		return 0
+	}
+	suffix = strings.ToLower(strings.Trim(suffix, "."))
+	return r.cache.DeleteFunc(func(key string) bool {
+		if suffix == "" {
+			return true
+		}
+		// Keys are the domain, its record type and any flag suffixes
+		domain, _, _ := strings.Cut(key, ":")
+		domain = strings.ToLower(domain)
+		return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+	})
+}
+
+// SetTTLOverride caches answers for name, and only name, for exactly ttl,
+// with their record TTLs set to it, until the override is removed with a
+// zero ttl. The answers cached so far are flushed so it applies at once.
+func (r *Resolver) SetTTLOverride(name string, ttl time.Duration) {
+	name = strings.ToLower(strings.Trim(name, "."))
+	r.overrideMu.Lock()
+	if ttl > 0 {
+		if r.ttlOverrides == nil {
+			r.ttlOverrides = make(map[string]time.Duration)
+		}
+		r.ttlOverrides[name] = ttl
+	} else {
+		delete(r.ttlOverrides, name)
+	}
+	r.overrideMu.Unlock()
+
+	if r.cache != nil {
+		r.cache.DeleteFunc(func(key string) bool {
+			domain, _, _ := strings.Cut(key, ":")
+			return strings.ToLower(domain) == name
+		})
+	}
+}
+
+// TTLOverrides returns the TTL overrides by name
+func (r *Resolver) TTLOverrides() map[string]time.Duration {
+	r.overrideMu.RLock()
+	defer r.overrideMu.RUnlock()
+	overrides := make(map[string]time.Duration, len(r.ttlOverrides))
+	for name, ttl := range r.ttlOverrides {
+		overrides[name] = ttl
+	}
+	return overrides
+}
+
+// ttlOverride returns the TTL override of name, which is lower case
+func (r *Resolver) ttlOverride(name string) (time.Duration, bool) {
+	r.overrideMu.RLock()
+	defer r.overrideMu.RUnlock()
+	ttl, ok := r.ttlOverrides[name]
+	return ttl, ok
+}
@@ -0,0 +1,201 @@
+package resolver
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthOptions configures upstream health checking
+type HealthOptions struct {
+	Interval         time.Duration // between probes of every upstream
+	ProbeDomain      string        // name the probes ask for
+	FailureThreshold int           // consecutive failures before an upstream is excluded
+	SuccessThreshold int           // consecutive successes before an excluded upstream is reinstated
+}
+
+// UpstreamHealth is the health of one upstream as reported in stats
+type UpstreamHealth struct {
+	Excluded            bool      `json:"excluded"`
+	Score               float64   `json:"score"` // recent share of failed exchanges, 0 (all answered) to 1
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Since               time.Time `json:"since"` // when the upstream was last excluded or reinstated
+}
+
+// scoreWeight is the weight of the latest exchange in an upstream's score
+const scoreWeight = 0.2
+
+// healthChecker tracks the exchanges with every upstream, from lookups and
+// from its own probes, and excludes upstreams that keep failing from
+// lookups until probes see them answer again. It plays the part of the
+// local proxy's circuit breakers for the remote resolver's upstreams.
+type healthChecker struct {
+	opts HealthOptions
+
+	mu        sync.Mutex
+	upstreams map[string]*upstreamState
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type upstreamState struct {
+	UpstreamHealth
+	successes int // consecutive, counted while excluded
+}
+
+func newHealthChecker(opts HealthOptions, upstreams []string) *healthChecker {
+	if opts.Interval <= 0 {
+		opts.Interval = 30 * time.Second
+	}
+	if opts.ProbeDomain == "" {
+		opts.ProbeDomain = "example.com"
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 3
+	}
+	if opts.SuccessThreshold <= 0 {
+		opts.SuccessThreshold = 2
+	}
+	h := &healthChecker{
+		opts:      opts,
+		upstreams: make(map[string]*upstreamState, len(upstreams)),
+		stop:      make(chan struct{}),
+	}
+	for _, u := range upstreams {
+		h.upstreams[u] = &upstreamState{UpstreamHealth: UpstreamHealth{Since: time.Now().UTC()}}
+	}
+	return h
+}
+
+// observe records one exchange with upstream and reports whether that
+// excluded or reinstated it
+func (h *healthChecker) observe(upstream string, err error) (changed bool) {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.upstreams[upstream]
+	if !ok {
+		return false
+	}
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	s.Score = (1-scoreWeight)*s.Score + scoreWeight*failed
+
+	if err != nil {
+		s.ConsecutiveFailures++
+		s.successes = 0
+		if !s.Excluded && s.ConsecutiveFailures >= h.opts.FailureThreshold {
+			s.Excluded, s.Since = true, time.Now().UTC()
+			return true
+		}
+		return false
+	}
+	s.ConsecutiveFailures = 0
+	if s.Excluded {
+		if s.successes++; s.successes >= h.opts.SuccessThreshold {
+			s.Excluded, s.Since, s.successes = false, time.Now().UTC(), 0
+			return true
+		}
+	}
+	return false
+}
+
+// available returns upstreams without the excluded ones, in their order.
+// If every upstream is excluded they are all returned, lowest score first,
+// so lookups still have somewhere to go.
+func (h *healthChecker) available(upstreams []string) []string {
+	if h == nil {
+		return upstreams
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	healthy := make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		if s, ok := h.upstreams[u]; !ok || !s.Excluded {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	all := append([]string(nil), upstreams...)
+	sort.SliceStable(all, func(i, j int) bool { return h.upstreams[all[i]].Score < h.upstreams[all[j]].Score })
+	return all
+}
+
+// report returns the health of every upstream
+func (h *healthChecker) report() map[string]UpstreamHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	report := make(map[string]UpstreamHealth, len(h.upstreams))
+	for u, s := range h.upstreams {
+		report[u] = s.UpstreamHealth
+	}
+	return report
+}
+
+// Run probes every upstream each health check interval, and reloads
+// changed response policy zones, until Close. It returns at once unless
+// health checking is enabled.
+func (r *Resolver) Run() {
+	go r.rpz.Run()
+	if r.health == nil {
+		return
+	}
+	ticker := time.NewTicker(r.health.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.health.stop:
+			return
+		case <-ticker.C:
+		}
+		r.probeAll()
+	}
+}
+
+// Close stops Run
+func (r *Resolver) Close() {
+	r.rpz.Close()
+	if r.health == nil {
+		return
+	}
+	r.health.stopOnce.Do(func() { close(r.health.stop) })
+}
+
+// probeAll asks every upstream for the probe domain at once
+func (r *Resolver) probeAll() {
+	var wg sync.WaitGroup
+	for _, upstream := range r.upstreams {
+		wg.Add(1)
+		go func(upstream string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+			defer cancel()
+			_, err := r.exchange(ctx, upstream, r.health.opts.ProbeDomain, dns.TypeA, r.timeout, QueryFlags{})
+			r.observeUpstream(upstream, err)
+		}(upstream)
+	}
+	wg.Wait()
+}
+
+// observeUpstream feeds the outcome of an exchange to the health checker
+// and logs the upstreams it excludes or reinstates
+func (r *Resolver) observeUpstream(upstream string, err error) {
+	if !r.health.observe(upstream, err) {
+		return
+	}
+	if err != nil {
+		r.logger.Warn("upstream excluded", "upstream", upstream, "failures", r.health.opts.FailureThreshold, "error", err)
+	} else {
+		r.logger.Info("upstream reinstated", "upstream", upstream)
+	}
+}
@@ -0,0 +1,284 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// IterativeUpstream, listed among the upstreams, resolves names from the
+// root servers down instead of asking a recursive resolver, so no single
+// third party sees every name looked up
+const IterativeUpstream = "iterative"
+
+// rootServers are the IANA root servers' IPv4 addresses, a.root-servers.net
+// to m.root-servers.net
+var rootServers = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	// maxReferrals bounds the queries made for one name
+	maxReferrals = 30
+	// maxIterationDepth bounds nested lookups of name server addresses and
+	// alias targets
+	maxIterationDepth = 4
+	// iterativeQueryTimeout is how long one authoritative server is waited
+	// for before the next is tried
+	iterativeQueryTimeout = time.Second
+	// maxDelegations bounds the remembered zone cuts
+	maxDelegations = 10000
+)
+
+// iterator resolves names by following referrals from the root servers.
+// With QNAME minimization (RFC 9156) each zone's servers are asked about
+// only one label more than the zone, not the full name, so the root and
+// TLD servers learn the domain but not the host.
+type iterator struct {
+	roots    []string // addresses without port
+	port     string
+	minimize bool
+
+	mu          sync.Mutex
+	delegations map[string]delegation // by zone, a lower case FQDN
+}
+
+// delegation is a zone's name server addresses, learned from a referral
+type delegation struct {
+	servers []string // host:port
+	expires time.Time
+}
+
+func newIterator(roots []string, minimize bool) *iterator {
+	if len(roots) == 0 {
+		roots = rootServers
+	}
+	return &iterator{
+		roots:       roots,
+		port:        "53",
+		minimize:    minimize,
+		delegations: make(map[string]delegation),
+	}
+}
+
+// resolve looks up domain from the closest zone cut known, returning the
+// authoritative answer. depth counts the lookups this one is nested in.
+func (it *iterator) resolve(ctx context.Context, domain string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxIterationDepth {
+		return nil, fmt.Errorf("lookup %s: nested lookups too deep", domain)
+	}
+	name := strings.ToLower(dns.Fqdn(domain))
+	labels := dns.CountLabel(name)
+	zone, servers := it.closest(name)
+	revealed := dns.CountLabel(zone) + 1 // labels sent to the zone's servers
+
+	for range maxReferrals {
+		qname, qt := name, qtype
+		if it.minimize && revealed < labels {
+			// A hides the real type too, and unlike NS draws correct
+			// answers from broken servers (RFC 9156 section 3)
+			qname, qt = lastLabels(name, revealed), dns.TypeA
+		}
+		resp, err := it.query(ctx, servers, qname, qt)
+		if err != nil {
+			return nil, fmt.Errorf("lookup %s in %s: %w", domain, zone, err)
+		}
+
+		if child, ns, ttl := referral(resp, zone); child != "" {
+			addrs, err := it.addresses(ctx, resp, zone, ns, depth)
+			if err != nil {
+				return nil, fmt.Errorf("lookup %s: delegation to %s: %w", domain, child, err)
+			}
+			it.remember(child, addrs, ttl)
+			zone, servers = child, addrs
+			revealed = dns.CountLabel(child) + 1
+			continue
+		}
+		if qname == name {
+			return it.chase(ctx, name, qtype, resp, depth)
+		}
+		// Nothing exists below a name that does not (RFC 8020)
+		if resp.Rcode == dns.RcodeNameError {
+			return resp, nil
+		}
+		// The same servers answer for the next label
+		revealed++
+	}
+	return nil, fmt.Errorf("lookup %s: too many referrals", domain)
+}
+
+// query asks servers in turn until one answers; servers that fail or
+// refuse are skipped
+func (it *iterator) query(ctx context.Context, servers []string, qname string, qtype uint16) (*dns.Msg, error) {
+	var lastErr error
+	for _, server := range servers {
+		resp, err := exchange(ctx, server, qname, qtype, iterativeQueryTimeout, QueryFlags{NoRecursion: true})
+		if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+			err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+		}
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// referral returns the child zone below zone that resp delegates to, its
+// name servers and the delegation's TTL, or an empty zone if resp is not a
+// referral. Referrals upward or sideways are ignored.
+func referral(resp *dns.Msg, zone string) (child string, ns []string, ttl uint32) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return "", nil, 0
+	}
+	for _, rr := range resp.Ns {
+		rec, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(rec.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || (child != "" && owner != child) {
+			continue
+		}
+		if child == "" || rec.Hdr.Ttl < ttl {
+			ttl = rec.Hdr.Ttl
+		}
+		child = owner
+		ns = append(ns, strings.ToLower(rec.Ns))
+	}
+	return child, ns, ttl
+}
+
+// addresses returns the addresses of the name servers ns, from the glue in
+// resp or, without glue, by looking them up. IPv4 addresses come first.
+// Glue is only taken for names within zone, whose servers sent it, so they
+// cannot redirect lookups of other zones.
+func (it *iterator) addresses(ctx context.Context, resp *dns.Msg, zone string, ns []string, depth int) ([]string, error) {
+	var v4, v6 []string
+	for _, rr := range resp.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if !slices.Contains(ns, owner) || !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		switch rec := rr.(type) {
+		case *dns.A:
+			v4 = append(v4, net.JoinHostPort(rec.A.String(), it.port))
+		case *dns.AAAA:
+			v6 = append(v6, net.JoinHostPort(rec.AAAA.String(), it.port))
+		}
+	}
+	if addrs := append(v4, v6...); len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	var lastErr error
+	for _, host := range ns {
+		msg, err := it.resolve(ctx, host, dns.TypeA, depth+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var addrs []string
+		for _, rr := range msg.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), it.port))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no address for %s", strings.Join(ns, ", "))
+	}
+	return nil, lastErr
+}
+
+// chase follows an alias in resp whose target the answering servers did
+// not include, appending the target's records
+func (it *iterator) chase(ctx context.Context, name string, qtype uint16, resp *dns.Msg, depth int) (*dns.Msg, error) {
+	if qtype == dns.TypeCNAME || resp.Rcode != dns.RcodeSuccess {
+		return resp, nil
+	}
+	target := name
+	for hops := 0; hops <= maxCNAMEChain; hops++ {
+		next := ""
+		for _, rr := range resp.Answer {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return resp, nil
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if strings.EqualFold(target, name) {
+		return resp, nil
+	}
+
+	more, err := it.resolve(ctx, target, qtype, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	resp.Answer = append(resp.Answer, more.Answer...)
+	resp.Ns, resp.Rcode = more.Ns, more.Rcode
+	return resp, nil
+}
+
+// closest returns the deepest zone above name whose servers are known,
+// the root if none is
+func (it *iterator) closest(name string) (string, []string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	now := time.Now()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone := name[off:]
+		if d, ok := it.delegations[zone]; ok {
+			if now.Before(d.expires) {
+				return zone, d.servers
+			}
+			delete(it.delegations, zone)
+		}
+	}
+
+	roots := make([]string, len(it.roots))
+	for i, root := range it.roots {
+		roots[i] = net.JoinHostPort(root, it.port)
+	}
+	return ".", roots
+}
+
+// remember records zone's servers for ttl seconds
+func (it *iterator) remember(zone string, servers []string, ttl uint32) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if len(it.delegations) >= maxDelegations {
+		clear(it.delegations)
+	}
+	it.delegations[zone] = delegation{servers: servers, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// lastLabels returns the FQDN of the last n labels of name
+func lastLabels(name string, n int) string {
+	indexes := dns.Split(name)
+	return name[indexes[len(indexes)-n]:]
+}
@@ -0,0 +1,90 @@
+package resolver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamMetrics counts the exchanges with one upstream
+type UpstreamMetrics struct {
+	Successes    int64   `json:"successes"`
+	Failures     int64   `json:"failures"`       // timeouts and network errors; error answers such as NXDOMAIN count as successes
+	AvgLatencyMs float64 `json:"avg_latency_ms"` // of the successes
+}
+
+// Metrics is a snapshot of the resolver's counters since it was created
+type Metrics struct {
+	Queries     map[string]int64           `json:"queries"` // by record type
+	CacheHits   int64                      `json:"cache_hits"`
+	CacheMisses int64                      `json:"cache_misses"`
+	CacheSize   int                        `json:"cache_size"`
+	Upstreams   map[string]UpstreamMetrics `json:"upstreams"`
+}
+
+// upstreamCounters are the live counters behind UpstreamMetrics
+type upstreamCounters struct {
+	successes atomic.Int64
+	failures  atomic.Int64
+	latency   atomic.Int64 // total of successful exchanges, in nanoseconds
+}
+
+// metrics holds the resolver's counters. Record types and upstreams are
+// fixed sets, so the maps stay small.
+type metrics struct {
+	queries     sync.Map // RecordType -> *atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	upstreams   sync.Map // address -> *upstreamCounters
+}
+
+func (m *metrics) query(recordType RecordType) {
+	n, _ := m.queries.LoadOrStore(recordType, new(atomic.Int64))
+	n.(*atomic.Int64).Add(1)
+}
+
+// exchanged records one exchange with upstream that took d
+func (m *metrics) exchanged(upstream string, d time.Duration, err error) {
+	v, _ := m.upstreams.LoadOrStore(upstream, new(upstreamCounters))
+	c := v.(*upstreamCounters)
+	if err != nil {
+		c.failures.Add(1)
+		return
+	}
+	c.successes.Add(1)
+	c.latency.Add(int64(d))
+}
+
+// Metrics returns the resolver's query, cache and upstream counters
+func (r *Resolver) Metrics() Metrics {
+	m := Metrics{
+		Queries:     make(map[string]int64),
+		CacheHits:   r.metrics.cacheHits.Load(),
+		CacheMisses: r.metrics.cacheMisses.Load(),
+		Upstreams:   make(map[string]UpstreamMetrics),
+	}
+	r.metrics.queries.Range(func(k, v any) bool {
+		m.Queries[string(k.(RecordType))] = v.(*atomic.Int64).Load()
+		return true
+	})
+	r.metrics.upstreams.Range(func(k, v any) bool {
+		c := v.(*upstreamCounters)
+		u := UpstreamMetrics{
+			Successes: c.successes.Load(),
+			Failures:  c.failures.Load(),
+		}
+		if u.Successes > 0 {
+			u.AvgLatencyMs = milliseconds(c.latency.Load() / u.Successes)
+		}
+		m.Upstreams[k.(string)] = u
+		return true
+	})
+	if r.cache != nil {
+		m.CacheSize = r.cache.Len()
+	}
+	return m
+}
+
+func milliseconds(ns int64) float64 {
+	return float64(ns) / float64(time.Millisecond)
+}
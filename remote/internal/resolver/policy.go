@@ -0,0 +1,36 @@
+package resolver
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// Policy restricts what the resolver answers and what its upstream queries
+// reveal. The zero value restricts nothing.
+type Policy struct {
+	RefuseTypes       []RecordType // answered blocked_policy without asking upstreams, e.g. TXT
+	LowercaseNames    bool         // strip 0x20 case randomization before the cache and upstreams
+	QNameMinimization bool         // the iterative upstream sends each zone one label more than it (RFC 9156)
+}
+
+// refuse returns the error for a query of recordType the policy refuses,
+// or nil
+func (r *Resolver) refuse(recordType RecordType) error {
+	if !slices.Contains(r.policy.RefuseTypes, recordType) {
+		return nil
+	}
+	r.policyRefused.Add(1)
+	return errcode.New(errcode.BlockedPolicy, fmt.Sprintf("%s queries are refused by policy", recordType))
+}
+
+// normalize returns domain as it is cached and sent upstream
+func (r *Resolver) normalize(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	if r.policy.LowercaseNames {
+		domain = strings.ToLower(domain)
+	}
+	return domain
+}
@@ -0,0 +1,158 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds each cache round trip; a slow cache must not delay
+// resolution more than a miss would
+const redisTimeout = 200 * time.Millisecond
+
+// RedisCache is a cache backend shared by every remote instance pointing at
+// the same Redis, so instances behind a load balancer answer consistently
+type RedisCache struct {
+	client *redis.Client
+	prefix string
+	stale  time.Duration
+	logger *slog.Logger
+}
+
+// RedisOptions configures a RedisCache
+type RedisOptions struct {
+	Addr      string
+	Password  string
+	DB        int
+	KeyPrefix string
+	Stale     time.Duration // keys outlive their TTL by this much for GetStale
+	Logger    *slog.Logger
+}
+
+// redisEntry is the stored form of a result; StoredAt lets every instance
+// age record TTLs the same way
+type redisEntry struct {
+	Result    *ResolveResult `json:"result"`
+	StoredAt  time.Time      `json:"stored_at"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// NewRedisCache creates a Redis cache backend
+func NewRedisCache(opts RedisOptions) *RedisCache {
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &RedisCache{
+		client: redis.NewClient(&redis.Options{
+			Addr:     opts.Addr,
+			Password: opts.Password,
+			DB:       opts.DB,
+		}),
+		prefix: opts.KeyPrefix,
+		stale:  opts.Stale,
+		logger: opts.Logger,
+	}
+}
+
+// Ping checks that Redis is reachable
+func (c *RedisCache) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+// Get retrieves a cached result; Redis errors are treated as misses
+func (c *RedisCache) Get(key string) (*ResolveResult, bool) {
+	entry, ok := c.load(key)
+	if !ok || !time.Now().Before(entry.ExpiresAt) {
+		return nil, false
+	}
+	ageRecords(entry.Result, time.Since(entry.StoredAt))
+	return entry.Result, true
+}
+
+// GetStale retrieves a result past its TTL; Redis expires the key once the
+// stale window has passed too
+func (c *RedisCache) GetStale(key string) (*ResolveResult, bool) {
+	entry, ok := c.load(key)
+	if !ok || time.Now().Before(entry.ExpiresAt) {
+		return nil, false
+	}
+	ageRecords(entry.Result, time.Since(entry.StoredAt))
+	return entry.Result, true
+}
+
+func (c *RedisCache) load(key string) (*redisEntry, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			c.logger.Warn("redis get failed", "key", key, "error", err)
+		}
+		return nil, false
+	}
+
+	var entry redisEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Result == nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Set stores a result for ttl plus the stale window
+func (c *RedisCache) Set(key string, result *ResolveResult, ttl time.Duration) {
+	now := time.Now()
+	data, err := json.Marshal(redisEntry{Result: result, StoredAt: now, ExpiresAt: now.Add(ttl)})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	if err := c.client.Set(ctx, c.prefix+key, data, ttl+c.stale).Err(); err != nil {
+		c.logger.Warn("redis set failed", "key", key, "error", err)
+	}
+}
+
+// DeleteFunc scans the keys under the prefix and removes those match
+// reports true for. Keys of other instances sharing the Redis go too.
+func (c *RedisCache) DeleteFunc(match func(key string) bool) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	removed := 0
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if !match(strings.TrimPrefix(key, c.prefix)) {
+			continue
+		}
+		if err := c.client.Del(ctx, key).Err(); err != nil {
+			c.logger.Warn("redis delete failed", "key", key, "error", err)
+			continue
+		}
+		removed++
+	}
+	if err := iter.Err(); err != nil {
+		c.logger.Warn("redis scan failed", "error", err)
+	}
+	return removed
+}
+
+// Len returns the number of keys in the Redis database, so a dedicated
+// database gives an accurate count
+func (c *RedisCache) Len() int {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	n, err := c.client.DBSize(ctx).Result()
+	if err != nil {
+		return -1
+	}
+	return int(n)
+}
@@ -2,11 +2,17 @@ package resolver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
 )
 
 // RecordType represents DNS record types
@@ -19,6 +25,7 @@ const (
 	TypeMX    RecordType = "MX"
 	TypeTXT   RecordType = "TXT"
 	TypeNS    RecordType = "NS"
+	TypePTR   RecordType = "PTR"
 )
 
 // DNSRecord represents a resolved DNS record
@@ -31,28 +38,91 @@ type DNSRecord struct {
 
 // ResolveResult holds the result of a DNS resolution
 type ResolveResult struct {
-	Domain  string      `json:"domain"`
-	Records []DNSRecord `json:"records"`
-	Cached  bool        `json:"cached"`
+	Domain      string      `json:"domain"`
+	Records     []DNSRecord `json:"records"`
+	Cached      bool        `json:"cached"`
+	NegativeTTL uint32      `json:"negative_ttl,omitempty"` // for an answer without records: how long the zone lets it be cached (RFC 2308)
+
+	AuthenticatedData bool `json:"ad,omitempty"` // the upstream validated the answer with DNSSEC
 }
 
+// staleAnswerTTL is the TTL given to records served past expiry (RFC 8767)
+const staleAnswerTTL = 30
+
+// Upstream selection strategies
+const (
+	StrategySequential = "sequential"
+	StrategyRace       = "race"
+	StrategyConsensus  = "consensus"
+)
+
 // Resolver handles DNS resolution using upstream servers
 type Resolver struct {
-	upstreams  []string
-	timeout    time.Duration
-	maxRetries int
-	cache      *Cache
-	mu         sync.RWMutex
+	upstreams    []string
+	timeout      time.Duration
+	zoneTimeouts []ZoneTimeout
+	maxRetries   int
+	strategy     string
+	raceCount    int
+	quorum       int
+	cache        CacheBackend
+	defaultTTL   time.Duration
+	minTTL       time.Duration
+	maxTTL       time.Duration
+	zoneTTLs     []ZoneTTL
+
+	overrideMu   sync.RWMutex
+	ttlOverrides map[string]time.Duration // by name; set at runtime
+
+	filterBogon    bool
+	bogonAllow     []string
+	bogonsFiltered atomic.Int64
+
+	consensusFailures atomic.Int64
+
+	tamper *tamperDetector // nil unless tamper detection is enabled
+	health *healthChecker  // nil unless health checking is enabled
+	iter   *iterator       // nil unless the iterative upstream is listed
+	rpz    *RPZ            // nil unless response policy zones are loaded
+
+	policy        Policy
+	policyRefused atomic.Int64
+
+	serveStale  bool
+	refreshing  sync.Map // cache keys with a background refresh in flight
+	staleServed atomic.Int64
+
+	metrics metrics
+
+	logger *slog.Logger
+	mu     sync.RWMutex
 }
 
 // Config holds resolver configuration
 type Config struct {
 	Upstreams     []string
 	Timeout       time.Duration
+	ZoneTimeouts  []ZoneTimeout // per-zone overrides of the timeout
 	MaxRetries    int
 	CacheEnabled  bool
-	CacheTTL      time.Duration
+	CacheTTL      time.Duration // lifetime of answers without records
+	CacheMinTTL   time.Duration // floor for record TTLs and cache lifetime
+	CacheMaxTTL   time.Duration // ceiling for record TTLs and cache lifetime; 0 for none
+	ZoneTTLs      []ZoneTTL     // per-zone overrides of the bounds
 	CacheMaxItems int
+	Cache         CacheBackend   // overrides the in-memory cache when set
+	StaleWindow   time.Duration  // serve expired entries this long while refreshing; 0 disables
+	FilterBogons  bool           // drop private/reserved addresses from answers
+	BogonAllow    []string       // domains (and subdomains) exempt from bogon filtering
+	Strategy      string         // sequential (default) or race
+	RaceCount     int            // upstreams queried concurrently in race and consensus modes
+	Quorum        int            // agreeing upstreams required in consensus mode
+	Tamper        *TamperOptions // compare upstream answers for interference; nil disables
+	Health        *HealthOptions // probe upstreams and exclude failing ones; nil disables
+	Policy        Policy         // types refused and names normalized
+	RootServers   []string       // addresses the iterative upstream starts from; empty for the IANA roots
+	RPZ           *RPZ           // response policy zones applied before the cache; nil for none
+	Logger        *slog.Logger   // defaults to slog.Default()
 }
 
 // New creates a new Resolver
@@ -61,151 +131,327 @@ func New(cfg Config) *Resolver {
 		upstreams:  cfg.Upstreams,
 		timeout:    cfg.Timeout,
 		maxRetries: cfg.MaxRetries,
+		strategy:   cfg.Strategy,
+		raceCount:  cfg.RaceCount,
+		quorum:     cfg.Quorum,
+		defaultTTL: cfg.CacheTTL,
+		minTTL:     cfg.CacheMinTTL,
+		maxTTL:     cfg.CacheMaxTTL,
+		logger:     cfg.Logger,
+		policy:     cfg.Policy,
+		rpz:        cfg.RPZ,
+
+		filterBogon: cfg.FilterBogons,
+	}
+	for _, z := range cfg.ZoneTTLs {
+		z.Zone = strings.ToLower(strings.TrimSuffix(z.Zone, "."))
+		r.zoneTTLs = append(r.zoneTTLs, z)
+	}
+	for _, z := range cfg.ZoneTimeouts {
+		z.Zone = strings.ToLower(strings.TrimSuffix(z.Zone, "."))
+		r.zoneTimeouts = append(r.zoneTimeouts, z)
+	}
+	for _, d := range cfg.BogonAllow {
+		r.bogonAllow = append(r.bogonAllow, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+	if r.raceCount <= 0 || r.raceCount > len(r.upstreams) {
+		r.raceCount = len(r.upstreams)
+	}
+	if r.logger == nil {
+		r.logger = slog.Default()
+	}
+	if r.quorum <= 0 {
+		r.quorum = 1
+	}
+	if cfg.Tamper != nil {
+		r.tamper = newTamperDetector(*cfg.Tamper)
+	}
+	if cfg.Health != nil {
+		r.health = newHealthChecker(*cfg.Health, r.upstreams)
+	}
+	if slices.Contains(r.upstreams, IterativeUpstream) {
+		r.iter = newIterator(cfg.RootServers, cfg.Policy.QNameMinimization)
 	}
 
-	if cfg.CacheEnabled {
-		r.cache = NewCache(cfg.CacheMaxItems, cfg.CacheTTL)
+	if cfg.Cache != nil {
+		r.cache = cfg.Cache
+	} else if cfg.CacheEnabled {
+		c := NewCache(cfg.CacheMaxItems)
+		if cfg.StaleWindow > 0 {
+			c.EnableServeStale(cfg.StaleWindow)
+		}
+		r.cache = c
 	}
+	r.serveStale = r.cache != nil && cfg.StaleWindow > 0
 
 	return r
 }
 
 // Resolve performs DNS resolution for the given domain and record type
 func (r *Resolver) Resolve(ctx context.Context, domain string, recordType RecordType) (*ResolveResult, error) {
-	domain = strings.TrimSuffix(domain, ".")
-	cacheKey := fmt.Sprintf("%s:%s", domain, recordType)
+	if err := r.refuse(recordType); err != nil {
+		return nil, err
+	}
+	domain = r.normalize(domain)
+	if result, matched, err := r.applyRPZ(ctx, domain, recordType); matched {
+		return result, err
+	}
+	return r.lookup(ctx, domain, recordType)
+}
+
+// lookup answers from the cache or the upstreams
+func (r *Resolver) lookup(ctx context.Context, domain string, recordType RecordType) (*ResolveResult, error) {
+	flags := flagsOf(ctx)
+	cacheKey := fmt.Sprintf("%s:%s", domain, recordType) + flags.cacheSuffix()
+	r.metrics.query(recordType)
+
+	if flags.NoCache {
+		return r.resolveUpstreams(ctx, cacheKey, domain, recordType)
+	}
 
 	// Check cache
 	if r.cache != nil {
 		if result, ok := r.cache.Get(cacheKey); ok {
+			r.metrics.cacheHits.Add(1)
 			result.Cached = true
 			return result, nil
 		}
 	}
 
+	// Serve an expired answer immediately and refresh it in the background
+	if r.serveStale {
+		if result, ok := r.cache.GetStale(cacheKey); ok {
+			r.metrics.cacheHits.Add(1)
+			r.staleServed.Add(1)
+			for i := range result.Records {
+				result.Records[i].TTL = staleAnswerTTL
+			}
+			result.Cached = true
+			r.revalidate(cacheKey, domain, recordType, flags)
+			return result, nil
+		}
+	}
+
+	if r.cache != nil {
+		r.metrics.cacheMisses.Add(1)
+	}
+	return r.resolveUpstreams(ctx, cacheKey, domain, recordType)
+}
+
+// revalidate refreshes a stale cache entry in the background, at most once
+// per key at a time, with the flags of the query that found it stale
+func (r *Resolver) revalidate(cacheKey, domain string, recordType RecordType, flags QueryFlags) {
+	if _, busy := r.refreshing.LoadOrStore(cacheKey, struct{}{}); busy {
+		return
+	}
+	go func() {
+		defer r.refreshing.Delete(cacheKey)
+		ctx, cancel := context.WithTimeout(WithQueryFlags(context.Background(), flags), r.QueryTimeout(domain))
+		defer cancel()
+		if _, err := r.resolveUpstreams(ctx, cacheKey, domain, recordType); err != nil {
+			r.logger.Debug("stale refresh failed", "domain", domain, "type", recordType, "error", err)
+		}
+	}()
+}
+
+// resolveUpstreams queries the upstreams with retries and caches the answer
+func (r *Resolver) resolveUpstreams(ctx context.Context, cacheKey, domain string, recordType RecordType) (*ResolveResult, error) {
 	// Try upstreams
 	var lastErr error
 	for attempt := 0; attempt < r.maxRetries; attempt++ {
-		for _, upstream := range r.upstreams {
+		if r.strategy == StrategyRace || r.strategy == StrategyConsensus {
+			var result *ResolveResult
+			var err error
+			if r.strategy == StrategyConsensus {
+				result, err = r.consensus(ctx, domain, recordType)
+			} else {
+				result, err = r.race(ctx, domain, recordType, attempt)
+			}
+			if err == nil {
+				if r.cache != nil {
+					r.store(cacheKey, domain, result)
+				}
+				// Consensus already compares every answer
+				if r.strategy == StrategyRace && r.tamper.sample() {
+					r.compare(domain, recordType)
+				}
+				return result, nil
+			}
+			lastErr = err
+			continue
+		}
+
+		for _, upstream := range r.health.available(r.upstreams) {
 			result, err := r.resolveWithUpstream(ctx, domain, recordType, upstream)
 			if err == nil {
 				// Cache result
 				if r.cache != nil {
-					r.cache.Set(cacheKey, result)
+					r.store(cacheKey, domain, result)
+				}
+				if r.tamper.sample() {
+					r.compare(domain, recordType)
 				}
 				return result, nil
 			}
+			r.logger.Debug("upstream query failed", "upstream", upstream, "domain", domain, "type", recordType, "attempt", attempt+1, "error", err)
 			lastErr = err
 		}
 	}
 
+	if isTimeout(lastErr) {
+		return nil, errcode.Wrap(errcode.UpstreamTimeout, "all upstreams failed", lastErr)
+	}
 	return nil, fmt.Errorf("all upstreams failed: %w", lastErr)
 }
 
-func (r *Resolver) resolveWithUpstream(ctx context.Context, domain string, recordType RecordType, upstream string) (*ResolveResult, error) {
-	resolver := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{Timeout: r.timeout}
-			return d.DialContext(ctx, "udp", upstream)
-		},
+// isTimeout reports whether err is an upstream that did not answer in time,
+// as opposed to one that answered with an error such as NXDOMAIN
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
 	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
 
-	ctx, cancel := context.WithTimeout(ctx, r.timeout)
-	defer cancel()
-
-	result := &ResolveResult{
-		Domain:  domain,
-		Records: []DNSRecord{},
+// ResolveMulti resolves several record types for the same domain concurrently
+// and merges the records into a single result. It fails only if every type
+// fails; the result is marked cached only if every type came from cache.
+// Its negative TTL is the shortest of the types answered without records,
+// so clients can cache those even when other types had some.
+func (r *Resolver) ResolveMulti(ctx context.Context, domain string, recordTypes []RecordType) (*ResolveResult, error) {
+	if len(recordTypes) == 1 {
+		return r.Resolve(ctx, domain, recordTypes[0])
 	}
 
-	switch recordType {
-	case TypeA:
-		ips, err := resolver.LookupIP(ctx, "ip4", domain)
-		if err != nil {
-			return nil, err
-		}
-		for _, ip := range ips {
-			result.Records = append(result.Records, DNSRecord{
-				Name:  domain,
-				Type:  TypeA,
-				Value: ip.String(),
-				TTL:   300, // Default TTL
-			})
-		}
+	results := make([]*ResolveResult, len(recordTypes))
+	errs := make([]error, len(recordTypes))
 
-	case TypeAAAA:
-		ips, err := resolver.LookupIP(ctx, "ip6", domain)
-		if err != nil {
-			return nil, err
-		}
-		for _, ip := range ips {
-			result.Records = append(result.Records, DNSRecord{
-				Name:  domain,
-				Type:  TypeAAAA,
-				Value: ip.String(),
-				TTL:   300,
-			})
-		}
+	var wg sync.WaitGroup
+	for i, rt := range recordTypes {
+		wg.Add(1)
+		go func(i int, rt RecordType) {
+			defer wg.Done()
+			results[i], errs[i] = r.Resolve(ctx, domain, rt)
+		}(i, rt)
+	}
+	wg.Wait()
 
-	case TypeCNAME:
-		cname, err := resolver.LookupCNAME(ctx, domain)
-		if err != nil {
-			return nil, err
+	merged := &ResolveResult{
+		Domain:            r.normalize(domain),
+		Records:           []DNSRecord{},
+		Cached:            true,
+		AuthenticatedData: true,
+	}
+	var lastErr error
+	succeeded := 0
+	for i, result := range results {
+		if errs[i] != nil {
+			lastErr = errs[i]
+			continue
 		}
-		result.Records = append(result.Records, DNSRecord{
-			Name:  domain,
-			Type:  TypeCNAME,
-			Value: cname,
-			TTL:   300,
-		})
-
-	case TypeMX:
-		mxRecords, err := resolver.LookupMX(ctx, domain)
-		if err != nil {
-			return nil, err
+		succeeded++
+		for _, rec := range result.Records {
+			// Each type's answer repeats the CNAME chain
+			if rec.Type == TypeCNAME && slices.Contains(merged.Records, rec) {
+				continue
+			}
+			merged.Records = append(merged.Records, rec)
 		}
-		for _, mx := range mxRecords {
-			result.Records = append(result.Records, DNSRecord{
-				Name:  domain,
-				Type:  TypeMX,
-				Value: fmt.Sprintf("%d %s", mx.Pref, mx.Host),
-				TTL:   300,
-			})
+		merged.Cached = merged.Cached && result.Cached
+		merged.AuthenticatedData = merged.AuthenticatedData && result.AuthenticatedData
+		if result.NegativeTTL > 0 && (merged.NegativeTTL == 0 || result.NegativeTTL < merged.NegativeTTL) {
+			merged.NegativeTTL = result.NegativeTTL
 		}
+	}
 
-	case TypeTXT:
-		txtRecords, err := resolver.LookupTXT(ctx, domain)
-		if err != nil {
-			return nil, err
-		}
-		for _, txt := range txtRecords {
-			result.Records = append(result.Records, DNSRecord{
-				Name:  domain,
-				Type:  TypeTXT,
-				Value: txt,
-				TTL:   300,
-			})
-		}
+	if succeeded == 0 {
+		return nil, lastErr
+	}
+	return merged, nil
+}
 
-	case TypeNS:
-		nsRecords, err := resolver.LookupNS(ctx, domain)
-		if err != nil {
-			return nil, err
-		}
-		for _, ns := range nsRecords {
-			result.Records = append(result.Records, DNSRecord{
-				Name:  domain,
-				Type:  TypeNS,
-				Value: ns.Host,
-				TTL:   300,
-			})
+// race queries up to raceCount upstreams concurrently and returns the first
+// successful answer, cancelling the rest. Each attempt races the next
+// raceCount upstreams, so a retry does not ask the ones that just failed.
+func (r *Resolver) race(ctx context.Context, domain string, recordType RecordType, attempt int) (*ResolveResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		result   *ResolveResult
+		err      error
+		upstream string
+	}
+
+	upstreams := window(r.health.available(r.upstreams), r.raceCount, attempt)
+	outcomes := make(chan outcome, len(upstreams))
+	for _, upstream := range upstreams {
+		go func(upstream string) {
+			result, err := r.resolveWithUpstream(ctx, domain, recordType, upstream)
+			outcomes <- outcome{result: result, err: err, upstream: upstream}
+		}(upstream)
+	}
+
+	var lastErr error
+	for range upstreams {
+		o := <-outcomes
+		if o.err == nil {
+			r.logger.Debug("race won", "upstream", o.upstream, "domain", domain, "type", recordType)
+			return o.result, nil
 		}
+		r.logger.Debug("upstream query failed", "upstream", o.upstream, "domain", domain, "type", recordType, "error", o.err)
+		lastErr = o.err
+	}
 
-	default:
+	return nil, lastErr
+}
+
+// window returns the count upstreams raced on the given attempt, starting
+// after those of the previous attempt and wrapping around the list
+func window(upstreams []string, count, attempt int) []string {
+	if count >= len(upstreams) {
+		return upstreams
+	}
+	start := attempt * count % len(upstreams)
+	out := make([]string, 0, count)
+	for i := range count {
+		out = append(out, upstreams[(start+i)%len(upstreams)])
+	}
+	return out
+}
+
+// resolveWithUpstream asks one upstream for the records of domain, with
+// the TTLs it answered with
+func (r *Resolver) resolveWithUpstream(ctx context.Context, domain string, recordType RecordType, upstream string) (*ResolveResult, error) {
+	qtype, ok := qtypes[recordType]
+	if !ok {
 		return nil, fmt.Errorf("unsupported record type: %s", recordType)
 	}
 
+	timeout := r.timeoutFor(domain)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	msg, err := r.exchange(ctx, upstream, domain, qtype, timeout, flagsOf(ctx))
+	// A race that another upstream won says nothing about this one
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		r.metrics.exchanged(upstream, time.Since(start), err)
+		r.observeUpstream(upstream, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result, err := parseAnswer(domain, recordType, qtype, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.filterBogons(result, upstream); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
@@ -213,9 +459,32 @@ func (r *Resolver) resolveWithUpstream(ctx context.Context, domain string, recor
 func (r *Resolver) Stats() map[string]interface{} {
 	stats := map[string]interface{}{
 		"upstreams": r.upstreams,
+		"strategy":  r.strategy,
+	}
+	if r.strategy == StrategyConsensus {
+		stats["quorum"] = r.quorum
+		stats["consensus_failures"] = r.consensusFailures.Load()
+	}
+	if r.filterBogon {
+		stats["bogons_filtered"] = r.bogonsFiltered.Load()
+	}
+	if r.tamper != nil {
+		stats["tamper_suspected"] = r.tamper.suspected()
 	}
 	if r.cache != nil {
 		stats["cache_size"] = r.cache.Len()
 	}
+	if r.serveStale {
+		stats["stale_served"] = r.staleServed.Load()
+	}
+	if r.health != nil {
+		stats["upstream_health"] = r.health.report()
+	}
+	if len(r.policy.RefuseTypes) > 0 {
+		stats["policy_refused"] = r.policyRefused.Load()
+	}
+	if r.rpz != nil {
+		stats["rpz"] = r.rpz.Stats()
+	}
 	return stats
 }
@@ -2,8 +2,21 @@ package resolver
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
 )
 
 func TestResolver(t *testing.T) {
@@ -64,8 +77,40 @@ func TestResolver(t *testing.T) {
 	})
 }
 
+func TestResolveMultiFromCache(t *testing.T) {
+	resolver := New(Config{
+		Upstreams:     []string{"127.0.0.1:1"},
+		Timeout:       100 * time.Millisecond,
+		MaxRetries:    1,
+		CacheEnabled:  true,
+		CacheTTL:      time.Minute,
+		CacheMaxItems: 10,
+	})
+
+	resolver.cache.Set("dual.test:A", &ResolveResult{
+		Domain:  "dual.test",
+		Records: []DNSRecord{{Name: "dual.test", Type: TypeA, Value: "1.2.3.4", TTL: 300}},
+	}, time.Minute)
+	resolver.cache.Set("dual.test:AAAA", &ResolveResult{
+		Domain:  "dual.test",
+		Records: []DNSRecord{{Name: "dual.test", Type: TypeAAAA, Value: "2001:db8::1", TTL: 300}},
+	}, time.Minute)
+
+	result, err := resolver.ResolveMulti(context.Background(), "dual.test", []RecordType{TypeA, TypeAAAA})
+	if err != nil {
+		t.Fatalf("ResolveMulti failed: %v", err)
+	}
+
+	if len(result.Records) != 2 {
+		t.Fatalf("Expected 2 merged records, got %d", len(result.Records))
+	}
+	if !result.Cached {
+		t.Error("Expected merged result to be cached")
+	}
+}
+
 func TestCache(t *testing.T) {
-	cache := NewCache(10, time.Minute)
+	cache := NewCache(10)
 
 	t.Run("set_get", func(t *testing.T) {
 		result := &ResolveResult{
@@ -75,7 +120,7 @@ func TestCache(t *testing.T) {
 			},
 		}
 
-		cache.Set("test.com:A", result)
+		cache.Set("test.com:A", result, time.Minute)
 
 		got, ok := cache.Get("test.com:A")
 		if !ok {
@@ -95,10 +140,10 @@ func TestCache(t *testing.T) {
 	})
 
 	t.Run("expiry", func(t *testing.T) {
-		shortCache := NewCache(10, time.Millisecond)
+		shortCache := NewCache(10)
 
 		result := &ResolveResult{Domain: "expire.com"}
-		shortCache.Set("expire.com:A", result)
+		shortCache.Set("expire.com:A", result, time.Millisecond)
 
 		time.Sleep(10 * time.Millisecond)
 
@@ -108,3 +153,904 @@ func TestCache(t *testing.T) {
 		}
 	})
 }
+
+func TestServeStale(t *testing.T) {
+	resolver := New(Config{
+		Upstreams:     []string{"127.0.0.1:1"},
+		Timeout:       100 * time.Millisecond,
+		MaxRetries:    1,
+		CacheEnabled:  true,
+		CacheTTL:      time.Minute,
+		CacheMaxItems: 10,
+		StaleWindow:   time.Minute,
+	})
+
+	resolver.cache.Set("stale.test:A", &ResolveResult{
+		Domain:  "stale.test",
+		Records: []DNSRecord{{Name: "stale.test", Type: TypeA, Value: "1.2.3.4", TTL: 300}},
+	}, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	if _, ok := resolver.cache.Get("stale.test:A"); ok {
+		t.Fatal("entry should have expired")
+	}
+
+	// The upstream is unreachable, so only the stale entry can answer
+	result, err := resolver.Resolve(context.Background(), "stale.test", TypeA)
+	if err != nil {
+		t.Fatalf("expected stale answer, got %v", err)
+	}
+	if !result.Cached || result.Records[0].TTL != staleAnswerTTL {
+		t.Errorf("stale answer = %+v", result)
+	}
+	if n := resolver.Stats()["stale_served"]; n != int64(1) {
+		t.Errorf("stale_served = %v", n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	resolver := New(Config{
+		CacheTTL:    time.Minute,
+		CacheMinTTL: 30 * time.Second,
+		CacheMaxTTL: time.Hour,
+		ZoneTTLs: []ZoneTTL{
+			{Zone: "cdn.example", MaxTTL: 10 * time.Second, MinTTL: 5 * time.Second},
+			{Zone: "static.example.", MinTTL: 6 * time.Hour, MaxTTL: 24 * time.Hour},
+		},
+	})
+
+	tests := []struct {
+		domain  string
+		ttls    []uint32
+		want    time.Duration
+		wantRec []uint32
+	}{
+		{"example.com", []uint32{5, 600}, 30 * time.Second, []uint32{30, 600}},
+		{"example.com", []uint32{86400}, time.Hour, []uint32{3600}},
+		{"example.com", nil, time.Minute, nil},
+		{"img.cdn.example", []uint32{300}, 10 * time.Second, []uint32{10}},
+		{"STATIC.example", []uint32{60}, 6 * time.Hour, []uint32{21600}},
+	}
+	for _, tt := range tests {
+		result := &ResolveResult{}
+		for _, ttl := range tt.ttls {
+			result.Records = append(result.Records, DNSRecord{TTL: ttl})
+		}
+		if got := resolver.cacheTTL(tt.domain, result); got != tt.want {
+			t.Errorf("%s %v: cache TTL = %v, want %v", tt.domain, tt.ttls, got, tt.want)
+		}
+		for i, rec := range result.Records {
+			if rec.TTL != tt.wantRec[i] {
+				t.Errorf("%s: record %d TTL = %d, want %d", tt.domain, i, rec.TTL, tt.wantRec[i])
+			}
+		}
+	}
+}
+
+func TestTimeoutFor(t *testing.T) {
+	resolver := New(Config{
+		Timeout: 5 * time.Second,
+		ZoneTimeouts: []ZoneTimeout{
+			{Zone: "slow.example", Timeout: 15 * time.Second},
+			{Zone: "fast.slow.example.", Timeout: time.Second},
+		},
+	})
+
+	tests := []struct {
+		domain string
+		want   time.Duration
+	}{
+		{"example.com", 5 * time.Second},
+		{"slow.example", 15 * time.Second},
+		{"ns.SLOW.example.", 15 * time.Second},
+		{"api.fast.slow.example", time.Second},
+		{"notslow.example", 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := resolver.timeoutFor(tt.domain); got != tt.want {
+			t.Errorf("%s: timeout = %v, want %v", tt.domain, got, tt.want)
+		}
+		if got := resolver.QueryTimeout(tt.domain); got != time.Duration(resolver.maxRetries+1)*tt.want {
+			t.Errorf("%s: query timeout = %v, want %d attempts of %v", tt.domain, got, resolver.maxRetries+1, tt.want)
+		}
+	}
+}
+
+func TestAgeRecords(t *testing.T) {
+	result := &ResolveResult{Records: []DNSRecord{{TTL: 300}, {TTL: 5}}}
+	ageRecords(result, 10*time.Second)
+
+	if result.Records[0].TTL != 290 {
+		t.Errorf("TTL = %d, want 290", result.Records[0].TTL)
+	}
+	if result.Records[1].TTL != 1 {
+		t.Errorf("expired TTL = %d, want 1", result.Records[1].TTL)
+	}
+}
+
+func TestFilterBogons(t *testing.T) {
+	r := New(Config{FilterBogons: true, BogonAllow: []string{"corp.example.com"}})
+
+	result := &ResolveResult{Domain: "news.example", Records: []DNSRecord{
+		{Type: TypeA, Value: "10.10.34.35"},
+		{Type: TypeA, Value: "93.184.216.34"},
+		{Type: TypeAAAA, Value: "::ffff:127.0.0.1"},
+	}}
+	if err := r.filterBogons(result, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Records) != 1 || result.Records[0].Value != "93.184.216.34" {
+		t.Errorf("unexpected records after filtering: %+v", result.Records)
+	}
+
+	poisoned := &ResolveResult{Domain: "blocked.example", Records: []DNSRecord{{Type: TypeA, Value: "0.0.0.0"}}}
+	if err := r.filterBogons(poisoned, "test"); err == nil {
+		t.Error("expected an error when every address is a bogon")
+	}
+
+	internal := &ResolveResult{Domain: "git.corp.example.com", Records: []DNSRecord{{Type: TypeA, Value: "10.0.0.5"}}}
+	if err := r.filterBogons(internal, "test"); err != nil || len(internal.Records) != 1 {
+		t.Error("allowed domains must keep private addresses")
+	}
+}
+
+func TestFindConsensus(t *testing.T) {
+	answer := func(values ...string) *ResolveResult {
+		result := &ResolveResult{}
+		for _, v := range values {
+			result.Records = append(result.Records, DNSRecord{Type: TypeA, Value: v})
+		}
+		return result
+	}
+
+	// A CDN gives overlapping address sets; one upstream is poisoned
+	results := []*ResolveResult{
+		answer("10.10.34.36"),
+		answer("93.184.216.34", "93.184.216.35"),
+		answer("93.184.216.35"),
+		nil,
+	}
+	got := findConsensus(results, 2)
+	if got != results[1] {
+		t.Errorf("expected the agreeing answer, got %+v", got)
+	}
+
+	if findConsensus([]*ResolveResult{answer("1.1.1.1"), answer("2.2.2.2"), nil}, 2) != nil {
+		t.Error("expected no consensus when upstreams disagree")
+	}
+}
+
+// Examples from RFC 6052 section 2.4
+func TestNAT64Synthesis(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.33")
+	tests := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+	}
+	for p, want := range tests {
+		prefix, err := ParseNAT64Prefix(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := synthesize(prefix, v4)
+		if got.String() != want {
+			t.Errorf("%s: synthesized %s, want %s", p, got, want)
+		}
+		if back, addr := extract(got, prefix.Bits()); back != prefix || addr != v4 {
+			t.Errorf("%s: extracted %s from %s", p, addr, back)
+		}
+	}
+
+	if _, err := ParseNAT64Prefix("64:ff9b::/80"); err == nil {
+		t.Error("expected /80 to be rejected")
+	}
+}
+
+func TestPrepareUpstreams(t *testing.T) {
+	ctx := context.Background()
+	upstreams := []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53"}
+
+	tests := []struct {
+		name  string
+		opts  UpstreamOptions
+		want  []string
+		fails bool
+	}{
+		{"dual stack", UpstreamOptions{Family: FamilyDual}, upstreams, false},
+		{"ipv4 only", UpstreamOptions{Family: FamilyIPv4}, []string{"8.8.8.8:53"}, false},
+		{"ipv6 only", UpstreamOptions{Family: FamilyIPv6}, []string{"[2001:4860:4860::8888]:53"}, false},
+		{"ipv6 with nat64", UpstreamOptions{Family: FamilyIPv6, NAT64Prefix: "64:ff9b::/96"},
+			[]string{"[64:ff9b::808:808]:53", "[2001:4860:4860::8888]:53"}, false},
+		{"bad prefix", UpstreamOptions{Family: FamilyIPv6, NAT64Prefix: "10.0.0.0/8"}, nil, true},
+	}
+	for _, tt := range tests {
+		tt.opts.Logger = logging.Discard()
+		got, err := PrepareUpstreams(ctx, upstreams, tt.opts)
+		if (err != nil) != tt.fails || !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	// Nothing left to query is a startup error
+	if _, err := PrepareUpstreams(ctx, []string{"1.1.1.1:53"}, UpstreamOptions{Family: FamilyIPv6, Logger: logging.Discard()}); err == nil {
+		t.Error("expected an error without reachable upstreams")
+	}
+}
+
+func TestTamperDetection(t *testing.T) {
+	answer := func(values ...string) *ResolveResult {
+		result := &ResolveResult{}
+		for _, v := range values {
+			result.Records = append(result.Records, DNSRecord{Type: TypeA, Value: v})
+		}
+		return result
+	}
+	upstreams := []string{"a", "b", "c"}
+	d := newTamperDetector(TamperOptions{MinSamples: 3, Threshold: 0.6, MaxDomains: 2})
+
+	// Upstream c is forged for blocked.example four times out of five
+	for i := 0; i < 5; i++ {
+		forged := answer("10.10.34.36")
+		if i == 4 {
+			forged = answer("93.184.216.34")
+		}
+		d.observe("Blocked.example", upstreams, []*ResolveResult{answer("93.184.216.34"), answer("93.184.216.34", "93.184.216.35"), forged}, make([]error, 3))
+	}
+	// Upstream b times out once for slow.example
+	d.observe("slow.example", upstreams, []*ResolveResult{answer("192.0.2.1"), nil, answer("192.0.2.1")}, []error{nil, context.DeadlineExceeded, nil})
+	// A lone answer has nothing to be compared with
+	d.observe("alone.example", upstreams, []*ResolveResult{answer("192.0.2.1"), nil, nil}, []error{nil, context.DeadlineExceeded, context.DeadlineExceeded})
+
+	report := d.report()
+	if len(report) != 2 {
+		t.Fatalf("report = %+v", report)
+	}
+	blocked := report[0]
+	if blocked.Domain != "blocked.example" || !blocked.Suspected || blocked.Score != 0.8 ||
+		len(blocked.Upstreams) != 1 || blocked.Upstreams[0] != (UpstreamTamper{Upstream: "c", Divergent: 4}) {
+		t.Errorf("blocked.example = %+v", blocked)
+	}
+	if slow := report[1]; slow.Suspected || slow.Upstreams[0] != (UpstreamTamper{Upstream: "b", Timeouts: 1}) {
+		t.Errorf("slow.example = %+v", slow)
+	}
+
+	// Clean domains give way when the table is full; flagged ones stay
+	d.observe("clean.example", upstreams, []*ResolveResult{answer("192.0.2.9"), answer("192.0.2.9"), nil}, make([]error, 3))
+	if d.suspected() != 1 || len(d.domains) != 2 {
+		t.Errorf("%d domains tracked, %d suspected", len(d.domains), d.suspected())
+	}
+
+	var disabled *tamperDetector
+	if disabled.sample() || disabled.report() != nil {
+		t.Error("a nil detector should be inert")
+	}
+}
+
+// fakeUpstream serves answers from zone over UDP (truncated when tcpOnly is
+// set) and TCP on the same port
+func fakeUpstream(t *testing.T, tcpOnly bool, zone func(q dns.Question, m *dns.Msg)) string {
+	t.Helper()
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && tcpOnly {
+			m.Truncated = true
+		} else {
+			zone(r.Question[0], m)
+		}
+		w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: ln, Handler: handler}} {
+		go srv.ActivateAndServe()
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+func TestUpstreamTTLs(t *testing.T) {
+	soa := func(name string) dns.RR {
+		rr, _ := dns.NewRR(name + " 3600 IN SOA ns.example. hostmaster.example. 1 7200 900 1209600 120")
+		return rr
+	}
+	zone := func(q dns.Question, m *dns.Msg) {
+		rr := func(s string) dns.RR {
+			r, _ := dns.NewRR(s)
+			return r
+		}
+		switch {
+		case q.Name == "www.example." && q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer,
+				rr("www.example. 60 IN CNAME cdn.example."),
+				rr("cdn.example. 600 IN A 192.0.2.1"),
+				rr("cdn.example. 20 IN A 192.0.2.2"))
+		case q.Name == "www.example." && q.Qtype == dns.TypeAAAA:
+			m.Answer = append(m.Answer,
+				rr("www.example. 60 IN CNAME cdn.example."),
+				rr("cdn.example. 300 IN AAAA 2001:db8::1"))
+		case q.Name == "www.example." && q.Qtype == dns.TypeCNAME:
+			m.Answer = append(m.Answer, rr("www.example. 60 IN CNAME cdn.example."))
+		case q.Name == "txt.example." && q.Qtype == dns.TypeTXT:
+			m.Answer = append(m.Answer, rr(`txt.example. 900 IN TXT "v=spf1 " "-all"`))
+		case q.Name == "1.2.0.192.in-addr.arpa." && q.Qtype == dns.TypePTR:
+			m.Answer = append(m.Answer, rr("1.2.0.192.in-addr.arpa. 3600 IN PTR cdn.example."))
+		case q.Name == "www.example.":
+			m.Ns = append(m.Ns, soa("example."))
+		default:
+			m.Rcode = dns.RcodeNameError
+			m.Ns = append(m.Ns, soa("example."))
+		}
+	}
+
+	for _, tcpOnly := range []bool{false, true} {
+		r := New(Config{Upstreams: []string{fakeUpstream(t, tcpOnly, zone)}, Timeout: time.Second, MaxRetries: 1})
+		ctx := context.Background()
+
+		result, err := r.Resolve(ctx, "www.example", TypeA)
+		if err != nil {
+			t.Fatalf("tcp %v: %v", tcpOnly, err)
+		}
+		want := []DNSRecord{
+			{Name: "www.example", Type: TypeCNAME, Value: "cdn.example.", TTL: 60},
+			{Name: "cdn.example", Type: TypeA, Value: "192.0.2.1", TTL: 600},
+			{Name: "cdn.example", Type: TypeA, Value: "192.0.2.2", TTL: 20},
+		}
+		if !slices.Equal(result.Records, want) {
+			t.Errorf("tcp %v: A records %v, want %v", tcpOnly, result.Records, want)
+		}
+
+		// The chain is listed once when several types are merged
+		result, err = r.ResolveMulti(ctx, "www.example", []RecordType{TypeA, TypeAAAA})
+		want = append(want, DNSRecord{Name: "cdn.example", Type: TypeAAAA, Value: "2001:db8::1", TTL: 300})
+		if err != nil || !slices.Equal(result.Records, want) {
+			t.Errorf("tcp %v: A+AAAA records %v, want %v (%v)", tcpOnly, result.Records, want, err)
+		}
+
+		result, err = r.Resolve(ctx, "www.example", TypeCNAME)
+		if err != nil || len(result.Records) != 1 || result.Records[0].Value != "cdn.example." || result.Records[0].TTL != 60 {
+			t.Errorf("tcp %v: CNAME %v, %v", tcpOnly, result, err)
+		}
+
+		result, err = r.Resolve(ctx, "txt.example", TypeTXT)
+		if err != nil || len(result.Records) != 1 || result.Records[0].Value != "v=spf1 -all" || result.Records[0].TTL != 900 {
+			t.Errorf("tcp %v: TXT %v, %v", tcpOnly, result, err)
+		}
+
+		result, err = r.Resolve(ctx, "1.2.0.192.in-addr.arpa", TypePTR)
+		if err != nil || len(result.Records) != 1 || result.Records[0].Value != "cdn.example." {
+			t.Errorf("tcp %v: PTR %v, %v", tcpOnly, result, err)
+		}
+
+		// No data: an empty answer carrying the SOA minimum
+		result, err = r.Resolve(ctx, "www.example", TypeMX)
+		if err != nil || len(result.Records) != 0 || result.NegativeTTL != 120 {
+			t.Errorf("tcp %v: no-data answer %+v, %v", tcpOnly, result, err)
+		}
+		// and merged with a type that has records, it still says how long
+		// the empty type may be cached
+		result, err = r.ResolveMulti(ctx, "www.example", []RecordType{TypeTXT, TypeA})
+		if err != nil || len(result.Records) != 3 || result.NegativeTTL != 120 {
+			t.Errorf("tcp %v: A+TXT with no TXT %+v, %v", tcpOnly, result, err)
+		}
+
+		var nx *NXDomainError
+		_, err = r.Resolve(ctx, "missing.example", TypeA)
+		if !errors.As(err, &nx) || nx.TTL != 120 {
+			t.Errorf("tcp %v: nonexistent name: %v", tcpOnly, err)
+		}
+	}
+}
+
+func TestRace(t *testing.T) {
+	// Two upstreams failing and one answering, one raced at a time
+	var mu sync.Mutex
+	queried := make(map[string]int)
+	upstream := func(name string, rcode int) string {
+		return fakeUpstream(t, false, func(q dns.Question, m *dns.Msg) {
+			mu.Lock()
+			queried[name]++
+			mu.Unlock()
+			m.Rcode = rcode
+			if rcode == dns.RcodeSuccess {
+				rr, _ := dns.NewRR(q.Name + " 60 IN A 192.0.2.1")
+				m.Answer = append(m.Answer, rr)
+			}
+		})
+	}
+	r := New(Config{
+		Upstreams: []string{
+			upstream("first", dns.RcodeServerFailure),
+			upstream("second", dns.RcodeServerFailure),
+			upstream("third", dns.RcodeSuccess),
+		},
+		Timeout:    time.Second,
+		MaxRetries: 3,
+		Strategy:   StrategyRace,
+		RaceCount:  1,
+	})
+
+	// Each retry moves on to the next upstream
+	result, err := r.Resolve(context.Background(), "www.example", TypeA)
+	if err != nil || len(result.Records) != 1 {
+		t.Fatalf("%v, %v", result, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if queried["first"] != 1 || queried["second"] != 1 || queried["third"] != 1 {
+		t.Errorf("queried %v, want each upstream once", queried)
+	}
+
+	upstreams := []string{"a", "b", "c", "d", "e"}
+	for attempt, want := range [][]string{{"a", "b"}, {"c", "d"}, {"e", "a"}, {"b", "c"}} {
+		if got := window(upstreams, 2, attempt); !slices.Equal(got, want) {
+			t.Errorf("attempt %d raced %v, want %v", attempt, got, want)
+		}
+	}
+	if got := window(upstreams, 5, 3); !slices.Equal(got, upstreams) {
+		t.Errorf("raced %v, want all of them", got)
+	}
+}
+
+func TestQueryFlags(t *testing.T) {
+	// A validating upstream: bogus answers fail unless checking is
+	// disabled, and secure.example's A records are marked validated when
+	// the query asks
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch {
+		case !r.RecursionDesired:
+			m.Rcode = dns.RcodeRefused
+		case r.Question[0].Name == "bogus.example." && !r.CheckingDisabled:
+			m.Rcode = dns.RcodeServerFailure
+		default:
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+			m.AuthenticatedData = r.AuthenticatedData && r.Question[0].Name == "secure.example." && r.Question[0].Qtype == dns.TypeA
+		}
+		w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	r := New(Config{Upstreams: []string{pc.LocalAddr().String()}, Timeout: time.Second, MaxRetries: 1, CacheEnabled: true, CacheMaxItems: 100, CacheTTL: time.Minute})
+	ctx := context.Background()
+
+	if _, err := r.Resolve(ctx, "bogus.example", TypeA); err == nil {
+		t.Error("bogus answer passed validation")
+	}
+	result, err := r.Resolve(WithQueryFlags(ctx, QueryFlags{CheckingDisabled: true}), "bogus.example", TypeA)
+	if err != nil || len(result.Records) != 1 {
+		t.Errorf("with CD: %v, %v", result, err)
+	}
+	// The unvalidated answer is cached apart from plain queries
+	if _, err := r.Resolve(ctx, "bogus.example", TypeA); err == nil {
+		t.Error("plain query answered from the CD query's cache entry")
+	}
+
+	ad := WithQueryFlags(ctx, QueryFlags{AuthenticatedData: true})
+	if result, err := r.Resolve(ad, "secure.example", TypeA); err != nil || !result.AuthenticatedData {
+		t.Errorf("with AD: %+v, %v", result, err)
+	}
+	if result, err := r.ResolveMulti(ad, "secure.example", []RecordType{TypeA, TypeAAAA}); err != nil || result.AuthenticatedData {
+		t.Errorf("AAAA is not validated, merged result %+v, %v", result, err)
+	}
+	if result, err := r.Resolve(ctx, "secure.example", TypeA); err != nil || result.AuthenticatedData {
+		t.Errorf("without AD: %+v, %v", result, err)
+	}
+
+	if _, err := r.Resolve(WithQueryFlags(ctx, QueryFlags{NoRecursion: true}), "secure.example", TypeA); err == nil {
+		t.Error("RD clear was not passed on")
+	}
+
+	// secure.example's A answer is cached by now; no-cache asks again
+	if result, err := r.Resolve(ctx, "secure.example", TypeA); err != nil || !result.Cached {
+		t.Errorf("second plain query: %+v, %v", result, err)
+	}
+	if result, err := r.Resolve(WithQueryFlags(ctx, QueryFlags{NoCache: true}), "secure.example", TypeA); err != nil || result.Cached {
+		t.Errorf("with no-cache: %+v, %v", result, err)
+	}
+}
+
+func TestFlushAndTTLOverride(t *testing.T) {
+	upstream := fakeUpstream(t, false, func(q dns.Question, m *dns.Msg) {
+		rr, _ := dns.NewRR(q.Name + " 3600 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	})
+	r := New(Config{Upstreams: []string{upstream}, Timeout: time.Second, MaxRetries: 1, CacheEnabled: true, CacheMaxItems: 100, CacheTTL: time.Minute})
+	ctx := context.Background()
+	names := []string{"example.com", "www.example.com", "WWW.Example.com", "example.org", "notexample.com"}
+	fill := func() {
+		for _, name := range names {
+			if _, err := r.Resolve(ctx, name, TypeA); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	fill()
+	if n := r.Flush("Example.com."); n != 3 {
+		t.Errorf("Flush(example.com) removed %d, want 3", n)
+	}
+	if result, _ := r.Resolve(ctx, "example.org", TypeA); !result.Cached {
+		t.Error("example.org was flushed")
+	}
+	if result, _ := r.Resolve(ctx, "www.example.com", TypeA); result.Cached {
+		t.Error("www.example.com was not flushed")
+	}
+	fill()
+	if n := r.Flush(""); n != len(names) {
+		t.Errorf("Flush() removed %d, want %d", n, len(names))
+	}
+
+	// The override applies to the name only, at once
+	fill()
+	r.SetTTLOverride("www.example.com.", 30*time.Second)
+	result, _ := r.Resolve(ctx, "www.example.com", TypeA)
+	if result.Cached || result.Records[0].TTL != 30 {
+		t.Errorf("with override: cached %v, TTL %d; want a fresh answer with TTL 30", result.Cached, result.Records[0].TTL)
+	}
+	if result, _ := r.Resolve(ctx, "example.com", TypeA); !result.Cached || result.Records[0].TTL <= 30 {
+		t.Errorf("parent affected by the override: %+v", result)
+	}
+	if got := r.TTLOverrides(); len(got) != 1 || got["www.example.com"] != 30*time.Second {
+		t.Errorf("TTLOverrides = %v", got)
+	}
+	r.SetTTLOverride("www.example.com", 0)
+	if result, _ := r.Resolve(ctx, "www.example.com", TypeA); result.Records[0].TTL != 3600 || len(r.TTLOverrides()) != 0 {
+		t.Errorf("override not removed: %+v", result)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	upstream := fakeUpstream(t, false, func(q dns.Question, m *dns.Msg) {
+		rr, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	})
+	dead := "127.0.0.1:1"
+	r := New(Config{Upstreams: []string{dead, upstream}, Timeout: 200 * time.Millisecond, MaxRetries: 1, CacheEnabled: true, CacheMaxItems: 100})
+	ctx := context.Background()
+	for _, q := range []struct {
+		name string
+		typ  RecordType
+	}{{"a.example", TypeA}, {"a.example", TypeA}, {"b.example", TypeA}, {"a.example", TypeAAAA}} {
+		if _, err := r.Resolve(ctx, q.name, q.typ); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := r.Metrics()
+	if m.Queries["A"] != 3 || m.Queries["AAAA"] != 1 {
+		t.Errorf("queries = %v", m.Queries)
+	}
+	if m.CacheHits != 1 || m.CacheMisses != 3 || m.CacheSize != 3 {
+		t.Errorf("cache hits %d, misses %d, size %d; want 1, 3, 3", m.CacheHits, m.CacheMisses, m.CacheSize)
+	}
+	if u := m.Upstreams[upstream]; u.Successes != 3 || u.Failures != 0 || u.AvgLatencyMs <= 0 {
+		t.Errorf("working upstream: %+v", u)
+	}
+	if u := m.Upstreams[dead]; u.Failures != 3 || u.Successes != 0 {
+		t.Errorf("dead upstream: %+v", u)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	good := fakeUpstream(t, false, func(q dns.Question, m *dns.Msg) {
+		rr, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	})
+	dead := "127.0.0.1:1"
+	r := New(Config{
+		Upstreams:  []string{dead, good},
+		Timeout:    200 * time.Millisecond,
+		MaxRetries: 1,
+		Health:     &HealthOptions{Interval: time.Hour, ProbeDomain: "probe.example", FailureThreshold: 2, SuccessThreshold: 2},
+		Logger:     logging.Discard(),
+	})
+	ctx := context.Background()
+	health := func() map[string]UpstreamHealth {
+		return r.Stats()["upstream_health"].(map[string]UpstreamHealth)
+	}
+
+	// The dead upstream is tried first until it has failed twice
+	for _, name := range []string{"a.example", "b.example", "c.example", "d.example"} {
+		if _, err := r.Resolve(ctx, name, TypeA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := health()[dead]; !h.Excluded || h.ConsecutiveFailures != 2 || h.Score <= 0 {
+		t.Errorf("dead upstream: %+v", h)
+	}
+	if n := r.Metrics().Upstreams[dead].Failures; n != 2 {
+		t.Errorf("dead upstream asked %d times, want 2 before its exclusion", n)
+	}
+
+	// With every upstream excluded lookups still go out, and their answer
+	// and a probe's reinstate the working one
+	r.health.observe(good, errors.New("timeout"))
+	r.health.observe(good, errors.New("timeout"))
+	if !health()[good].Excluded {
+		t.Fatal("good upstream not excluded")
+	}
+	if _, err := r.Resolve(ctx, "e.example", TypeA); err != nil {
+		t.Errorf("lookup with every upstream excluded: %v", err)
+	}
+	if !health()[good].Excluded {
+		t.Error("reinstated after one success")
+	}
+	r.probeAll()
+	if h := health(); h[good].Excluded || !h[dead].Excluded {
+		t.Errorf("after probing: %+v", h)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	upstream := fakeUpstream(t, false, func(q dns.Question, m *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		asked = append(asked, q.Name)
+		rr, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	})
+	r := New(Config{
+		Upstreams:     []string{upstream},
+		Timeout:       time.Second,
+		MaxRetries:    1,
+		CacheEnabled:  true,
+		CacheMaxItems: 10,
+		Policy:        Policy{RefuseTypes: []RecordType{TypeTXT}, LowercaseNames: true},
+		Logger:        logging.Discard(),
+	})
+	ctx := context.Background()
+
+	if _, err := r.Resolve(ctx, "example.com", TypeTXT); errcode.Of(err) != errcode.BlockedPolicy {
+		t.Errorf("TXT lookup: %v, want blocked_policy", err)
+	}
+	for _, name := range []string{"wWw.ExAmPlE.cOm", "WWW.example.COM."} {
+		result, err := r.Resolve(ctx, name, TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Domain != "www.example.com" {
+			t.Errorf("%s resolved as %s", name, result.Domain)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(asked, []string{"www.example.com."}) {
+		t.Errorf("upstream asked %v, want one lower case query", asked)
+	}
+	if n := r.Stats()["policy_refused"]; n != int64(1) {
+		t.Errorf("policy_refused = %v", n)
+	}
+}
+
+// authoritative serves zone at addr, an address on the loopback network.
+// The function returned lists the questions it was asked.
+func authoritative(t *testing.T, addr string, zone func(q dns.Question, m *dns.Msg)) func() []string {
+	t.Helper()
+	var asked []string
+	var mu sync.Mutex
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("loopback address %s: %v", addr, err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		asked = append(asked, r.Question[0].Name+" "+dns.TypeToString[r.Question[0].Qtype])
+		mu.Unlock()
+		m := new(dns.Msg)
+		m.SetReply(r)
+		zone(r.Question[0], m)
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(asked)
+	}
+}
+
+func TestIterative(t *testing.T) {
+	rr := func(s string) dns.RR {
+		r, _ := dns.NewRR(s)
+		return r
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+
+	// The root delegates each TLD to 127.0.0.2, which delegates
+	// example.test. to ns.example.net., at 127.0.0.3
+	root := authoritative(t, "127.0.0.1:"+port, func(q dns.Question, m *dns.Msg) {
+		tld := lastLabels(q.Name, 1)
+		m.Ns = append(m.Ns, rr(tld+" 3600 IN NS ns."+tld))
+		m.Extra = append(m.Extra, rr("ns."+tld+" 3600 IN A 127.0.0.2"))
+	})
+	tld := authoritative(t, "127.0.0.2:"+port, func(q dns.Question, m *dns.Msg) {
+		switch {
+		case dns.IsSubDomain("example.test.", q.Name):
+			// Glue outside test. must be ignored
+			m.Ns = append(m.Ns, rr("example.test. 3600 IN NS ns.example.net."))
+			m.Extra = append(m.Extra, rr("ns.example.net. 3600 IN A 192.0.2.66"))
+		case q.Name == "ns.example.net.":
+			m.Authoritative = true
+			m.Answer = append(m.Answer, rr("ns.example.net. 3600 IN A 127.0.0.3"))
+		case q.Name == "example.net.":
+			m.Authoritative = true
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+	})
+	leaf := authoritative(t, "127.0.0.3:"+port, func(q dns.Question, m *dns.Msg) {
+		m.Authoritative = true
+		switch q.Name {
+		case "a.example.test.":
+		case "www.a.example.test.":
+			m.Answer = append(m.Answer, rr("www.a.example.test. 300 IN CNAME host.test."))
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+	})
+
+	r := New(Config{
+		Upstreams:   []string{IterativeUpstream},
+		Timeout:     5 * time.Second,
+		MaxRetries:  1,
+		RootServers: []string{"127.0.0.1"},
+		Policy:      Policy{QNameMinimization: true},
+		Logger:      logging.Discard(),
+	})
+	r.iter.port = port
+	ctx := context.Background()
+
+	var nx *NXDomainError
+	if _, err := r.Resolve(ctx, "www.a.example.test", TypeA); !errors.As(err, &nx) {
+		t.Fatalf("lookup: %v, want NXDOMAIN for the alias target", err)
+	}
+
+	// Each server saw one label more than its zone, asked as A, until the
+	// full name
+	if want := []string{"test. A", "net. A"}; !slices.Equal(root(), want) {
+		t.Errorf("root asked %v, want %v", root(), want)
+	}
+	if want := []string{"example.test. A", "example.net. A", "ns.example.net. A", "host.test. A"}; !slices.Equal(tld(), want) {
+		t.Errorf("TLD servers asked %v, want %v", tld(), want)
+	}
+	if want := []string{"a.example.test. A", "www.a.example.test. A"}; !slices.Equal(leaf(), want) {
+		t.Errorf("example.test. asked %v, want %v", leaf(), want)
+	}
+
+	// The zone cuts are remembered
+	if zone, servers := r.iter.closest("mail.example.test."); zone != "example.test." || !slices.Equal(servers, []string{"127.0.0.3:" + port}) {
+		t.Errorf("closest zone %s %v", zone, servers)
+	}
+}
+
+func TestRPZ(t *testing.T) {
+	var mu sync.Mutex
+	var asked []string
+	upstream := fakeUpstream(t, false, func(q dns.Question, m *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		asked = append(asked, q.Name)
+		rr, _ := dns.NewRR(q.Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+	})
+	file := filepath.Join(t.TempDir(), "threats.rpz")
+	zone := `$ORIGIN rpz.test.
+$TTL 60
+@                  IN SOA ns.rpz.test. hostmaster.rpz.test. 1 3600 600 86400 60
+@                  IN NS  ns.rpz.test.
+nx.example         IN CNAME .
+nodata.example 120 IN CNAME *.
+*.bad.example      IN CNAME .
+ok.bad.example     IN CNAME rpz-passthru.
+drop.example       IN CNAME rpz-drop.
+moved.example      IN CNAME garden.example.
+*.redir.example    IN CNAME *.garden.example.
+local.example      IN A 192.0.2.99
+local.example      IN A 192.0.2.98
+32.1.2.0.192.rpz-ip IN CNAME .
+`
+	if err := os.WriteFile(file, []byte(zone), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rpz, err := LoadRPZ(RPZOptions{Zones: []RPZZone{{File: file}}, Logger: logging.Discard()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(Config{Upstreams: []string{upstream}, Timeout: time.Second, MaxRetries: 1, RPZ: rpz, Logger: logging.Discard()})
+	ctx := context.Background()
+	var nx *NXDomainError
+
+	for _, name := range []string{"nx.example", "www.bad.example", "a.b.bad.example"} {
+		if _, err := r.Resolve(ctx, name, TypeA); !errors.As(err, &nx) || nx.TTL != 60 {
+			t.Errorf("%s: %v, want NXDOMAIN with TTL 60", name, err)
+		}
+	}
+	if result, err := r.Resolve(ctx, "NoData.Example.", TypeA); err != nil || len(result.Records) != 0 || result.NegativeTTL != 120 {
+		t.Errorf("nodata.example: %+v, %v", result, err)
+	}
+	if _, err := r.Resolve(ctx, "drop.example", TypeA); errcode.Of(err) != errcode.BlockedPolicy {
+		t.Errorf("drop.example: %v, want blocked_policy", err)
+	}
+	for _, name := range []string{"ok.bad.example", "bad.example"} {
+		if result, err := r.Resolve(ctx, name, TypeA); err != nil || len(result.Records) != 1 {
+			t.Errorf("%s not passed through: %+v, %v", name, result, err)
+		}
+	}
+
+	rewrites := map[string]string{
+		"moved.example":   "garden.example.",
+		"x.redir.example": "x.redir.example.garden.example.",
+	}
+	for name, target := range rewrites {
+		result, err := r.Resolve(ctx, name, TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []DNSRecord{
+			{Name: name, Type: TypeCNAME, Value: target, TTL: 60},
+			{Name: strings.TrimSuffix(target, "."), Type: TypeA, Value: "192.0.2.1", TTL: 300},
+		}
+		if result.Domain != name || !slices.Equal(result.Records, want) {
+			t.Errorf("%s rewritten to %+v, want %+v", name, result, want)
+		}
+	}
+
+	result, err := r.ResolveMulti(ctx, "local.example", []RecordType{TypeA, TypeAAAA})
+	if err != nil || len(result.Records) != 2 || result.Records[0].Value != "192.0.2.99" || result.NegativeTTL != 60 {
+		t.Errorf("local data: %+v, %v", result, err)
+	}
+
+	mu.Lock()
+	if want := []string{"ok.bad.example.", "bad.example.", "garden.example.", "x.redir.example.garden.example."}; !slices.Equal(asked, want) {
+		t.Errorf("upstream asked %v, want %v", asked, want)
+	}
+	mu.Unlock()
+
+	stats := r.Stats()["rpz"].(map[string]RPZZoneStats)["rpz.test"]
+	if stats.Rules != 8 || stats.Skipped != 1 || stats.Hits != 10 || stats.RuleHits["*.bad.example"] != 2 || stats.RuleHits["ok.bad.example"] != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// A changed file replaces the rules; those kept keep their hits
+	zone = strings.Replace(zone, "drop.example       IN CNAME rpz-drop.\n", "", 1)
+	zone += "new.example IN CNAME .\n"
+	if err := os.WriteFile(file, []byte(zone), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	rpz.reload()
+	if _, err := r.Resolve(ctx, "new.example", TypeA); !errors.As(err, &nx) {
+		t.Errorf("new rule not loaded: %v", err)
+	}
+	stats = r.Stats()["rpz"].(map[string]RPZZoneStats)["rpz.test"]
+	if _, ok := stats.RuleHits["drop.example"]; ok || stats.RuleHits["nx.example"] != 1 || stats.RuleHits["new.example"] != 1 {
+		t.Errorf("stats after reload %+v", stats)
+	}
+}
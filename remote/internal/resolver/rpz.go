@@ -0,0 +1,380 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mahdi/dns-proxy-remote/internal/errcode"
+)
+
+// RPZ applies response policy zones: files of rules in DNS zone format, as
+// published by threat intelligence feeds, that rewrite the answers for the
+// names they list. Zones are consulted in order and the first with a rule
+// for a name decides. Only QNAME triggers are supported; IP, NSDNAME,
+// NSIP and client IP triggers are skipped and counted.
+type RPZ struct {
+	zones    []*rpzZone
+	interval time.Duration
+	logger   *slog.Logger
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// RPZZone is a response policy zone file
+type RPZZone struct {
+	Name string // for stats and logs; defaults to the zone's SOA owner
+	File string
+}
+
+// RPZOptions configures LoadRPZ
+type RPZOptions struct {
+	Zones          []RPZZone
+	ReloadInterval time.Duration // how often files are checked for changes; 0 disables reloading
+	Logger         *slog.Logger  // defaults to slog.Default()
+}
+
+// rpzAction is what a rule does to an answer
+type rpzAction int
+
+const (
+	rpzNXDomain  rpzAction = iota // CNAME .: the name does not exist
+	rpzNoData                     // CNAME *.: the name has no records
+	rpzPassthru                   // CNAME rpz-passthru.: answer normally, skipping later zones
+	rpzDrop                       // CNAME rpz-drop.: no answer; refused through the API
+	rpzRewrite                    // CNAME to another name, answered in its place
+	rpzLocalData                  // records answered instead of the upstreams'
+)
+
+// rpzSkippedTriggers are the labels marking triggers other than QNAME
+var rpzSkippedTriggers = []string{"rpz-ip", "rpz-nsip", "rpz-nsdname", "rpz-client-ip"}
+
+// rpzRule is the policy for one trigger name
+type rpzRule struct {
+	trigger string // lower case FQDN, *. first for wildcards
+	action  rpzAction
+	target  string   // rpzRewrite: the alias target, *. first to prefix the query name
+	records []dns.RR // rpzLocalData
+	ttl     uint32
+	hits    atomic.Int64
+}
+
+// rpzRules are the rules of one zone as last loaded
+type rpzRules struct {
+	origin   string
+	exact    map[string]*rpzRule // by trigger
+	wildcard map[string]*rpzRule // by the domain under the *. of the trigger
+	skipped  int
+	loaded   time.Time
+}
+
+// rpzZone is a zone file and the rules last loaded from it
+type rpzZone struct {
+	name  string
+	file  string
+	rules atomic.Pointer[rpzRules]
+
+	modTime time.Time // of the file as last loaded
+	size    int64
+}
+
+// LoadRPZ reads the response policy zones. It fails if any file cannot be
+// read or parsed; later reloads that fail keep the rules already loaded.
+func LoadRPZ(opts RPZOptions) (*RPZ, error) {
+	p := &RPZ{
+		interval: opts.ReloadInterval,
+		logger:   opts.Logger,
+		stop:     make(chan struct{}),
+	}
+	if p.logger == nil {
+		p.logger = slog.Default()
+	}
+	for _, z := range opts.Zones {
+		zone := &rpzZone{name: z.Name, file: z.File}
+		if err := zone.load(); err != nil {
+			return nil, err
+		}
+		if zone.name == "" {
+			zone.name = strings.TrimSuffix(zone.rules.Load().origin, ".")
+		}
+		rules := zone.rules.Load()
+		p.logger.Info("response policy zone loaded", "zone", zone.name, "file", zone.file, "rules", len(rules.exact)+len(rules.wildcard), "skipped", rules.skipped)
+		p.zones = append(p.zones, zone)
+	}
+	return p, nil
+}
+
+// load reads the zone's file, keeping the hit counts of rules it still has
+func (z *rpzZone) load() error {
+	f, err := os.Open(z.file)
+	if err != nil {
+		return fmt.Errorf("rpz: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("rpz: %w", err)
+	}
+
+	rules := &rpzRules{
+		origin:   ".",
+		exact:    make(map[string]*rpzRule),
+		wildcard: make(map[string]*rpzRule),
+		loaded:   time.Now().UTC(),
+	}
+	zp := dns.NewZoneParser(f, ".", z.file)
+	zp.SetIncludeAllowed(false)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA && len(rrs) == 0 {
+			rules.origin = strings.ToLower(soa.Hdr.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("rpz: %w", err)
+	}
+	for _, rr := range rrs {
+		rules.add(rr)
+	}
+
+	if old := z.rules.Load(); old != nil {
+		for trigger, rule := range old.exact {
+			if r, ok := rules.exact[trigger]; ok {
+				r.hits.Store(rule.hits.Load())
+			}
+		}
+		for domain, rule := range old.wildcard {
+			if r, ok := rules.wildcard[domain]; ok {
+				r.hits.Store(rule.hits.Load())
+			}
+		}
+	}
+	z.rules.Store(rules)
+	z.modTime, z.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// add turns one record of the zone into (part of) the rule for its owner
+func (rs *rpzRules) add(rr dns.RR) {
+	owner := strings.ToLower(rr.Header().Name)
+	// The apex holds the zone's SOA and NS records, not rules
+	if owner == rs.origin || !dns.IsSubDomain(rs.origin, owner) {
+		return
+	}
+	trigger := owner
+	if rs.origin != "." {
+		trigger = owner[:len(owner)-len(rs.origin)]
+	}
+	labels := dns.SplitDomainName(trigger)
+	for _, skipped := range rpzSkippedTriggers {
+		if labels[len(labels)-1] == skipped {
+			rs.skipped++
+			return
+		}
+	}
+
+	rule := rs.exact[trigger]
+	if domain, ok := strings.CutPrefix(trigger, "*."); ok {
+		rule = rs.wildcard[domain]
+	}
+	if rule == nil {
+		rule = &rpzRule{trigger: trigger, ttl: rr.Header().Ttl}
+		if domain, ok := strings.CutPrefix(trigger, "*."); ok {
+			rs.wildcard[domain] = rule
+		} else {
+			rs.exact[trigger] = rule
+		}
+	}
+
+	cname, ok := rr.(*dns.CNAME)
+	if !ok {
+		rule.action = rpzLocalData
+		rule.records = append(rule.records, rr)
+		return
+	}
+	rule.ttl = cname.Hdr.Ttl
+	switch target := strings.ToLower(cname.Target); target {
+	case ".":
+		rule.action = rpzNXDomain
+	case "*.":
+		rule.action = rpzNoData
+	case "rpz-passthru.", "rpz-tcp-only.":
+		// Answers come through the API either way
+		rule.action = rpzPassthru
+	case "rpz-drop.":
+		rule.action = rpzDrop
+	default:
+		rule.action, rule.target = rpzRewrite, target
+	}
+}
+
+// match returns the zone's rule for name, a lower case FQDN: its own, or
+// the wildcard of its closest parent
+func (rs *rpzRules) match(name string) *rpzRule {
+	if rule, ok := rs.exact[name]; ok {
+		return rule
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule, ok := rs.wildcard[name[off:]]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// match returns the first zone's rule for domain, or nil. It is safe to
+// call on a nil RPZ.
+func (p *RPZ) match(domain string) (*rpzRule, string) {
+	if p == nil {
+		return nil, ""
+	}
+	name := strings.ToLower(dns.Fqdn(domain))
+	for _, z := range p.zones {
+		if rule := z.rules.Load().match(name); rule != nil {
+			rule.hits.Add(1)
+			return rule, z.name
+		}
+	}
+	return nil, ""
+}
+
+// applyRPZ answers a lookup its response policy zones have a rule for.
+// matched is false when the lookup goes to the upstreams as usual.
+func (r *Resolver) applyRPZ(ctx context.Context, domain string, recordType RecordType) (result *ResolveResult, matched bool, err error) {
+	rule, zone := r.rpz.match(domain)
+	if rule == nil || rule.action == rpzPassthru {
+		return nil, false, nil
+	}
+	r.logger.Debug("response policy applied", "zone", zone, "rule", rule.trigger, "domain", domain, "type", recordType)
+
+	switch rule.action {
+	case rpzNXDomain:
+		return nil, true, &NXDomainError{Domain: domain, TTL: rule.ttl}
+	case rpzNoData:
+		return &ResolveResult{Domain: domain, Records: []DNSRecord{}, NegativeTTL: rule.ttl}, true, nil
+	case rpzDrop:
+		return nil, true, errcode.New(errcode.BlockedPolicy, "dropped by response policy zone "+zone)
+	case rpzRewrite:
+		target := rule.target
+		if suffix, ok := strings.CutPrefix(target, "*."); ok {
+			target = strings.ToLower(dns.Fqdn(domain)) + suffix
+		}
+		alias := DNSRecord{Name: domain, Type: TypeCNAME, Value: target, TTL: rule.ttl}
+		if recordType == TypeCNAME {
+			return &ResolveResult{Domain: domain, Records: []DNSRecord{alias}}, true, nil
+		}
+		result, err := r.lookup(ctx, strings.TrimSuffix(target, "."), recordType)
+		if err != nil {
+			return nil, true, err
+		}
+		rewritten := *result
+		rewritten.Domain = domain
+		rewritten.Records = append([]DNSRecord{alias}, result.Records...)
+		return &rewritten, true, nil
+	}
+
+	result = &ResolveResult{Domain: domain, Records: []DNSRecord{}}
+	qtype := qtypes[recordType]
+	for _, rr := range rule.records {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		if rec, ok := toRecord(domain, recordType, rr); ok {
+			result.Records = append(result.Records, rec)
+		}
+	}
+	if len(result.Records) == 0 {
+		result.NegativeTTL = rule.ttl
+	}
+	return result, true, nil
+}
+
+// Run re-reads the zone files that changed each reload interval until
+// Close. It returns at once if reloading is disabled.
+func (p *RPZ) Run() {
+	if p == nil || p.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.reload()
+	}
+}
+
+// reload re-reads the zone files modified since they were loaded
+func (p *RPZ) reload() {
+	for _, z := range p.zones {
+		info, err := os.Stat(z.file)
+		if err != nil {
+			p.logger.Warn("response policy zone unreadable; keeping its rules", "zone", z.name, "file", z.file, "error", err)
+			continue
+		}
+		if info.ModTime().Equal(z.modTime) && info.Size() == z.size {
+			continue
+		}
+		if err := z.load(); err != nil {
+			p.logger.Warn("response policy zone reload failed; keeping its rules", "zone", z.name, "file", z.file, "error", err)
+			continue
+		}
+		rules := z.rules.Load()
+		p.logger.Info("response policy zone reloaded", "zone", z.name, "rules", len(rules.exact)+len(rules.wildcard), "skipped", rules.skipped)
+	}
+}
+
+// Close stops Run. It is safe to call on a nil RPZ.
+func (p *RPZ) Close() {
+	if p == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// RPZZoneStats describes a loaded response policy zone
+type RPZZoneStats struct {
+	File     string           `json:"file"`
+	Rules    int              `json:"rules"`
+	Skipped  int              `json:"skipped,omitempty"` // rules with unsupported triggers
+	LoadedAt time.Time        `json:"loaded_at"`
+	Hits     int64            `json:"hits"`
+	RuleHits map[string]int64 `json:"rule_hits,omitempty"` // by trigger, for rules hit at least once
+}
+
+// Stats returns each zone's rules and hits, by zone name
+func (p *RPZ) Stats() map[string]RPZZoneStats {
+	stats := make(map[string]RPZZoneStats, len(p.zones))
+	for _, z := range p.zones {
+		rules := z.rules.Load()
+		s := RPZZoneStats{
+			File:     z.file,
+			Rules:    len(rules.exact) + len(rules.wildcard),
+			Skipped:  rules.skipped,
+			LoadedAt: rules.loaded,
+			RuleHits: make(map[string]int64),
+		}
+		for _, set := range []map[string]*rpzRule{rules.exact, rules.wildcard} {
+			for _, rule := range set {
+				if n := rule.hits.Load(); n > 0 {
+					s.Hits += n
+					s.RuleHits[strings.TrimSuffix(rule.trigger, ".")] = n
+				}
+			}
+		}
+		stats[z.name] = s
+	}
+	return stats
+}
@@ -0,0 +1,221 @@
+package resolver
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TamperOptions configures tamper detection
+type TamperOptions struct {
+	SampleRate float64 // share of fresh lookups re-asked of every upstream for comparison
+	MinSamples int     // comparisons needed before a domain can be flagged
+	Threshold  float64 // share of comparisons an upstream must fail to flag the domain
+	MaxDomains int     // domains tracked at once
+}
+
+// TamperSuspicion is the tamper report entry for one domain
+type TamperSuspicion struct {
+	Domain    string           `json:"domain"`
+	Samples   int              `json:"samples"`   // comparisons across upstreams
+	Score     float64          `json:"score"`     // worst upstream's share of failed comparisons
+	Suspected bool             `json:"suspected"` // score reached the threshold over enough samples
+	Upstreams []UpstreamTamper `json:"upstreams"` // upstreams that failed at least one comparison
+	LastSeen  time.Time        `json:"last_seen"`
+}
+
+// UpstreamTamper counts how one upstream deviated from the others for a domain
+type UpstreamTamper struct {
+	Upstream  string `json:"upstream"`
+	Divergent int    `json:"divergent"` // answers (or errors) sharing nothing with the agreed answer
+	Timeouts  int    `json:"timeouts"`  // no answer while others answered
+}
+
+// tamperDetector compares the answers of several upstreams for the same
+// query. An upstream that keeps answering differently from the rest, or
+// keeps timing out while they answer, for a particular domain is the mark
+// of interference on its path (an ISP or national firewall near the server
+// rewriting or dropping DNS for that name), rather than of a broken upstream.
+type tamperDetector struct {
+	opts TamperOptions
+
+	mu      sync.Mutex
+	domains map[string]*domainTamper
+}
+
+type domainTamper struct {
+	samples   int
+	upstreams map[string]*UpstreamTamper
+	lastSeen  time.Time
+}
+
+func newTamperDetector(opts TamperOptions) *tamperDetector {
+	if opts.MinSamples <= 0 {
+		opts.MinSamples = 5
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = 0.6
+	}
+	if opts.MaxDomains <= 0 {
+		opts.MaxDomains = 10000
+	}
+	return &tamperDetector{opts: opts, domains: make(map[string]*domainTamper)}
+}
+
+// sample reports whether a fresh lookup should be compared across upstreams
+func (t *tamperDetector) sample() bool {
+	return t != nil && rand.Float64() < t.opts.SampleRate
+}
+
+// observe records one comparison. results and errs are per upstream; the
+// agreed answer is one that another upstream shares, so nothing is judged
+// without at least two upstreams agreeing.
+func (t *tamperDetector) observe(domain string, upstreams []string, results []*ResolveResult, errs []error) {
+	if t == nil {
+		return
+	}
+	reference := findConsensus(results, 2)
+	if reference == nil {
+		return
+	}
+
+	domain = strings.ToLower(domain)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d := t.domains[domain]
+	if d == nil {
+		if len(t.domains) >= t.opts.MaxDomains && !t.evict() {
+			return
+		}
+		d = &domainTamper{upstreams: make(map[string]*UpstreamTamper)}
+		t.domains[domain] = d
+	}
+	d.samples++
+	d.lastSeen = time.Now()
+
+	for i, upstream := range upstreams {
+		var divergent, timeout bool
+		switch {
+		case results[i] != nil:
+			divergent = !agree(results[i], reference)
+		case isTimeout(errs[i]):
+			timeout = true
+		case errs[i] != nil:
+			// NXDOMAIN, SERVFAIL or an all-bogon answer where the others resolved
+			divergent = len(reference.Records) > 0
+		}
+		if !divergent && !timeout {
+			continue
+		}
+		u := d.upstreams[upstream]
+		if u == nil {
+			u = &UpstreamTamper{Upstream: upstream}
+			d.upstreams[upstream] = u
+		}
+		if divergent {
+			u.Divergent++
+		} else {
+			u.Timeouts++
+		}
+	}
+}
+
+// evict makes room by dropping the least recently seen domain without
+// deviations, reporting whether one was found. Called with mu held.
+func (t *tamperDetector) evict() bool {
+	var oldest string
+	var oldestSeen time.Time
+	for domain, d := range t.domains {
+		if len(d.upstreams) == 0 && (oldest == "" || d.lastSeen.Before(oldestSeen)) {
+			oldest, oldestSeen = domain, d.lastSeen
+		}
+	}
+	if oldest == "" {
+		return false
+	}
+	delete(t.domains, oldest)
+	return true
+}
+
+// report returns the domains where some upstream deviated: flagged ones
+// first, then by score
+func (t *tamperDetector) report() []TamperSuspicion {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := []TamperSuspicion{}
+	for domain, d := range t.domains {
+		if len(d.upstreams) == 0 {
+			continue
+		}
+		s := TamperSuspicion{Domain: domain, Samples: d.samples, LastSeen: d.lastSeen}
+		for _, u := range d.upstreams {
+			s.Upstreams = append(s.Upstreams, *u)
+			if score := float64(u.Divergent+u.Timeouts) / float64(d.samples); score > s.Score {
+				s.Score = score
+			}
+		}
+		sort.Slice(s.Upstreams, func(i, j int) bool { return s.Upstreams[i].Upstream < s.Upstreams[j].Upstream })
+		s.Suspected = d.samples >= t.opts.MinSamples && s.Score >= t.opts.Threshold
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		switch {
+		case a.Suspected != b.Suspected:
+			return a.Suspected
+		case a.Score != b.Score:
+			return a.Score > b.Score
+		case a.Samples != b.Samples:
+			return a.Samples > b.Samples
+		}
+		return a.Domain < b.Domain
+	})
+	return out
+}
+
+// suspected returns the number of flagged domains
+func (t *tamperDetector) suspected() int {
+	n := 0
+	for _, s := range t.report() {
+		if s.Suspected {
+			n++
+		}
+	}
+	return n
+}
+
+// compare asks every upstream for the query in the background and feeds the
+// answers to the tamper detector
+func (r *Resolver) compare(domain string, recordType RecordType) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeoutFor(domain))
+		defer cancel()
+
+		results := make([]*ResolveResult, len(r.upstreams))
+		errs := make([]error, len(r.upstreams))
+		var wg sync.WaitGroup
+		for i, upstream := range r.upstreams {
+			wg.Add(1)
+			go func(i int, upstream string) {
+				defer wg.Done()
+				results[i], errs[i] = r.resolveWithUpstream(ctx, domain, recordType, upstream)
+			}(i, upstream)
+		}
+		wg.Wait()
+		r.tamper.observe(domain, r.upstreams, results, errs)
+	}()
+}
+
+// TamperReport returns the per-domain tamper suspicion report, or nil when
+// detection is disabled
+func (r *Resolver) TamperReport() []TamperSuspicion {
+	return r.tamper.report()
+}
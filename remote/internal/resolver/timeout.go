@@ -0,0 +1,34 @@
+package resolver
+
+import (
+	"strings"
+	"time"
+)
+
+// ZoneTimeout overrides the upstream timeout for a domain and its subdomains
+type ZoneTimeout struct {
+	Zone    string
+	Timeout time.Duration
+}
+
+// QueryTimeout returns how long resolving domain may take in all: its
+// upstream timeout for each attempt, with room for one more
+func (r *Resolver) QueryTimeout(domain string) time.Duration {
+	return time.Duration(r.maxRetries+1) * r.timeoutFor(domain)
+}
+
+// timeoutFor returns how long an upstream may take to answer for domain;
+// the most specific matching zone wins
+func (r *Resolver) timeoutFor(domain string) time.Duration {
+	timeout := r.timeout
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	best := -1
+	for _, z := range r.zoneTimeouts {
+		if (domain == z.Zone || strings.HasSuffix(domain, "."+z.Zone)) && len(z.Zone) > best {
+			best = len(z.Zone)
+			timeout = z.Timeout
+		}
+	}
+	return timeout
+}
@@ -0,0 +1,77 @@
+package resolver
+
+import (
+	"strings"
+	"time"
+)
+
+// ZoneTTL overrides the cache TTL bounds for a domain and its subdomains.
+// Zero bounds fall back to the global ones.
+type ZoneTTL struct {
+	Zone   string
+	MinTTL time.Duration
+	MaxTTL time.Duration
+}
+
+// ttlBounds returns the cache TTL bounds for domain: its TTL override, or
+// else those of the most specific matching zone
+func (r *Resolver) ttlBounds(domain string) (minTTL, maxTTL time.Duration) {
+	domain = strings.ToLower(domain)
+	if ttl, ok := r.ttlOverride(domain); ok {
+		return ttl, ttl
+	}
+
+	minTTL, maxTTL = r.minTTL, r.maxTTL
+	best := -1
+	for _, z := range r.zoneTTLs {
+		if (domain == z.Zone || strings.HasSuffix(domain, "."+z.Zone)) && len(z.Zone) > best {
+			best = len(z.Zone)
+			minTTL, maxTTL = r.minTTL, r.maxTTL
+			if z.MinTTL > 0 {
+				minTTL = z.MinTTL
+			}
+			if z.MaxTTL > 0 {
+				maxTTL = z.MaxTTL
+			}
+		}
+	}
+	return minTTL, maxTTL
+}
+
+// cacheTTL clamps the record TTLs of result into the domain's bounds and
+// returns how long to cache it: the lowest record TTL, or for answers
+// without records the zone's negative TTL, or the default TTL without one
+func (r *Resolver) cacheTTL(domain string, result *ResolveResult) time.Duration {
+	minTTL, maxTTL := r.ttlBounds(domain)
+	minSecs, maxSecs := uint32(minTTL/time.Second), uint32(maxTTL/time.Second)
+
+	ttl := r.defaultTTL
+	if result.NegativeTTL > 0 {
+		ttl = time.Duration(result.NegativeTTL) * time.Second
+	}
+	for i := range result.Records {
+		rec := &result.Records[i]
+		if rec.TTL < minSecs {
+			rec.TTL = minSecs
+		}
+		if maxSecs > 0 && rec.TTL > maxSecs {
+			rec.TTL = maxSecs
+		}
+		if d := time.Duration(rec.TTL) * time.Second; i == 0 || d < ttl {
+			ttl = d
+		}
+	}
+
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// store caches result under the domain's TTL policy
+func (r *Resolver) store(cacheKey, domain string, result *ResolveResult) {
+	r.cache.Set(cacheKey, result, r.cacheTTL(domain, result))
+}
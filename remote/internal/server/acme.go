@@ -0,0 +1,343 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+)
+
+const (
+	// acmeCheckInterval is how often the certificate's expiry is checked
+	acmeCheckInterval = 12 * time.Hour
+	// acmeRetryInterval is the wait after a failed issuance
+	acmeRetryInterval = time.Hour
+	// acmeTimeout bounds one issuance, challenges included
+	acmeTimeout = 5 * time.Minute
+)
+
+// certManager obtains the server certificate from an ACME CA (Let's
+// Encrypt by default) and renews it before it expires. The account key and
+// certificate are kept in the cache directory, so restarts reuse them
+// instead of hitting the CA's rate limits.
+type certManager struct {
+	cfg    config.ACMEConfig
+	client *acme.Client
+	logger *slog.Logger
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	tokens     map[string]string           // http-01 token -> key authorization
+	alpnCerts  map[string]*tls.Certificate // tls-alpn-01 domain -> challenge cert
+	registered bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newCertManager(cfg config.ACMEConfig, logger *slog.Logger) (*certManager, error) {
+	if err := os.MkdirAll(cfg.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create acme cache dir: %w", err)
+	}
+	key, err := loadOrCreateKey(filepath.Join(cfg.CacheDir, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load acme account key: %w", err)
+	}
+
+	m := &certManager{
+		cfg: cfg,
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.DirectoryURL,
+			UserAgent:    "dns-proxy-remote",
+		},
+		logger:    logger,
+		tokens:    make(map[string]string),
+		alpnCerts: make(map[string]*tls.Certificate),
+		stop:      make(chan struct{}),
+	}
+	if cert, err := tls.LoadX509KeyPair(m.cachePath("cert.pem"), m.cachePath("key.pem")); err == nil {
+		m.cert = &cert
+	}
+	return m, nil
+}
+
+func (m *certManager) cachePath(name string) string {
+	return filepath.Join(m.cfg.CacheDir, name)
+}
+
+// GetCertificate serves the current certificate, or a tls-alpn-01 challenge
+// certificate to the CA's validation connections
+func (m *certManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			if cert := m.alpnCerts[strings.ToLower(hello.ServerName)]; cert != nil {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("no acme challenge for %q", hello.ServerName)
+		}
+	}
+	if m.cert == nil {
+		return nil, errors.New("certificate not issued yet")
+	}
+	return m.cert, nil
+}
+
+// HTTPHandler answers http-01 challenges and redirects everything else to
+// HTTPS
+func (m *certManager) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := strings.CutPrefix(r.URL.Path, "/.well-known/acme-challenge/"); ok {
+			m.mu.RLock()
+			keyAuth, found := m.tokens[token]
+			m.mu.RUnlock()
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(keyAuth))
+			return
+		}
+		host, _, _ := strings.Cut(r.Host, ":")
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+	})
+}
+
+// Run keeps the certificate valid until Close, obtaining it right away if
+// none is cached
+func (m *certManager) Run() {
+	for {
+		wait := acmeCheckInterval
+		if m.needsRenewal(time.Now()) {
+			ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+			err := m.obtain(ctx)
+			cancel()
+			if err != nil {
+				m.logger.Error("acme certificate issuance failed", "domains", m.cfg.Domains, "error", err)
+				wait = acmeRetryInterval
+			} else {
+				m.logger.Info("acme certificate issued", "domains", m.cfg.Domains, "expires", m.expiry())
+			}
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-m.stop:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Close stops renewals
+func (m *certManager) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+func (m *certManager) expiry() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return m.cert.Leaf.NotAfter
+}
+
+// needsRenewal reports whether there is no certificate, it expires within
+// renew_before, or it doesn't cover every configured domain
+func (m *certManager) needsRenewal(now time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil || m.cert.Leaf == nil || now.Add(m.cfg.RenewBefore).After(m.cert.Leaf.NotAfter) {
+		return true
+	}
+	for _, domain := range m.cfg.Domains {
+		if m.cert.Leaf.VerifyHostname(domain) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// obtain runs one ACME order for the configured domains
+func (m *certManager) obtain(ctx context.Context) error {
+	if !m.registered {
+		acct := &acme.Account{}
+		if m.cfg.Email != "" {
+			acct.Contact = []string{"mailto:" + m.cfg.Email}
+		}
+		if _, err := m.client.Register(ctx, acct, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+			return fmt.Errorf("account registration: %w", err)
+		}
+		m.registered = true
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(m.cfg.Domains...))
+	if err != nil {
+		return fmt.Errorf("order: %w", err)
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, url); err != nil {
+			return err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.cfg.Domains[0]},
+		DNSNames: m.cfg.Domains,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("finalize: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+
+	cert := &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}
+	if err := m.save(chain, key); err != nil {
+		// The certificate is still good for this run
+		m.logger.Warn("failed to cache acme certificate", "error", err)
+	}
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	return nil
+}
+
+// authorize completes the configured challenge for one authorization
+func (m *certManager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	domain := strings.ToLower(authz.Identifier.Value)
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == m.cfg.Challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("CA offers no %s challenge for %s", m.cfg.Challenge, domain)
+	}
+
+	switch chal.Type {
+	case "http-01":
+		keyAuth, err := m.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.tokens[chal.Token] = keyAuth
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.tokens, chal.Token)
+			m.mu.Unlock()
+		}()
+	case "tls-alpn-01":
+		cert, err := m.client.TLSALPN01ChallengeCert(chal.Token, domain)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.alpnCerts[domain] = &cert
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.alpnCerts, domain)
+			m.mu.Unlock()
+		}()
+	}
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("%s challenge for %s: %w", chal.Type, domain, err)
+	}
+	if _, err := m.client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("%s challenge for %s: %w", chal.Type, domain, err)
+	}
+	return nil
+}
+
+// save writes the certificate chain and its key to the cache directory
+func (m *certManager) save(chain [][]byte, key *ecdsa.PrivateKey) error {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(m.cachePath("key.pem"), keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(m.cachePath("cert.pem"), certPEM, 0o600)
+}
+
+// loadOrCreateKey reads an EC private key from path, generating and saving
+// one if the file doesn't exist
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+}
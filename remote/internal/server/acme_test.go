@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+)
+
+func TestCertManager(t *testing.T) {
+	cfg := config.ACMEConfig{
+		Enabled:     true,
+		Domains:     []string{"dns.example.com"},
+		CacheDir:    t.TempDir(),
+		Challenge:   "http-01",
+		RenewBefore: 30 * 24 * time.Hour,
+	}
+	m, err := newCertManager(cfg, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.needsRenewal(time.Now()) {
+		t.Error("a manager without a certificate should want one")
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "dns.example.com"}); err == nil {
+		t.Error("expected an error before issuance")
+	}
+
+	// http-01 tokens are served, everything else goes to HTTPS
+	m.tokens["tok"] = "tok.thumbprint"
+	rec := httptest.NewRecorder()
+	m.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://dns.example.com/.well-known/acme-challenge/tok", nil))
+	if rec.Body.String() != "tok.thumbprint" {
+		t.Errorf("challenge response = %q", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	m.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://dns.example.com/health", nil))
+	if loc := rec.Header().Get("Location"); loc != "https://dns.example.com/health" {
+		t.Errorf("redirect = %d %q", rec.Code, loc)
+	}
+
+	// tls-alpn-01 validation connections get the challenge certificate
+	challenge := &tls.Certificate{}
+	m.alpnCerts["dns.example.com"] = challenge
+	got, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "DNS.example.com", SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || got != challenge {
+		t.Errorf("alpn challenge cert = %v, %v", got, err)
+	}
+
+	// An issued certificate is cached and reused by the next run
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:     []string{"dns.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err := m.save([][]byte{der}, key); err != nil {
+		t.Fatal(err)
+	}
+	accountKey := m.client.Key
+
+	m, err = newCertManager(cfg, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.client.Key.Public().(*ecdsa.PublicKey).Equal(accountKey.Public()) {
+		t.Error("account key was not reused")
+	}
+	if m.needsRenewal(time.Now()) {
+		t.Error("cached certificate should be current")
+	}
+	if !m.needsRenewal(time.Now().Add(61 * 24 * time.Hour)) {
+		t.Error("certificate within renew_before should be renewed")
+	}
+	m.cfg.Domains = append(m.cfg.Domains, "other.example.com")
+	if !m.needsRenewal(time.Now()) {
+		t.Error("a new domain should trigger renewal")
+	}
+}
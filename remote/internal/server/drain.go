@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+// drain moves clients off the server before it shuts down, so a rolling
+// deploy doesn't fail their queries: health checks report "draining" and
+// every response closes its connection (a GOAWAY on HTTP/2), sending local
+// proxies to reconnect, to another server if they have one. Queries keep
+// being answered for the drain period, or until a second signal.
+func (s *Server) drain(stop <-chan os.Signal) {
+	period := s.cfg.Server.DrainPeriod
+	if period <= 0 {
+		return
+	}
+	s.draining.Store(true)
+	s.handler.Drain()
+	s.logger.Info("draining connections", "period", period)
+
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stop:
+		s.logger.Info("drain cut short")
+	}
+}
+
+// drainMiddleware asks clients to close their connection after the
+// response while the server drains. HTTP/2 connections are sent a GOAWAY
+// and close once their streams finish.
+func (s *Server) drainMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
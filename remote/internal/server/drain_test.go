@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"testing"
+)
+
+func TestDrainClosesConnections(t *testing.T) {
+	for _, h2c := range []bool{false, true} {
+		s := &Server{logger: slog.New(slog.DiscardHandler)}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{
+			Handler: s.drainMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			})),
+			Protocols: newProtocols(h2c),
+		}
+		go srv.Serve(ln)
+
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(!h2c)
+		protocols.SetUnencryptedHTTP2(h2c)
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+
+		// get reports whether the request reused a connection
+		get := func() bool {
+			var reused bool
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+			req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/", nil)
+			resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+			if err != nil {
+				t.Fatalf("h2c %v: %v", h2c, err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return reused
+		}
+
+		get()
+		if !get() {
+			t.Errorf("h2c %v: connection not kept alive before draining", h2c)
+		}
+		s.draining.Store(true)
+		get() // answered, then the connection is closed
+		if get() {
+			t.Errorf("h2c %v: connection reused while draining", h2c)
+		}
+		srv.Close()
+	}
+}
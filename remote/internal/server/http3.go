@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+)
+
+// newHTTP3Server returns the HTTP/3 listener serving handler, or nil when
+// it is disabled. It shares the TCP listeners' TLS policy; certificate
+// files are loaded here, as http.Server.ServeTLS does for TCP.
+func newHTTP3Server(cfg config.ServerConfig, handler http.Handler, tlsConfig *tls.Config) (*http3.Server, error) {
+	if !cfg.HTTP3.Enabled {
+		return nil, nil
+	}
+	tlsConfig = tlsConfig.Clone()
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http3.Server{
+		Addr:        net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.HTTP3.Port)),
+		Port:        cfg.HTTP3.Port,
+		Handler:     handler,
+		TLSConfig:   http3.ConfigureTLSConfig(tlsConfig),
+		IdleTimeout: cfg.IdleTimeout,
+	}, nil
+}
+
+// altSvc announces the HTTP/3 listener on responses over TCP, so clients
+// that prefer HTTP/3 learn where to find it
+func altSvc(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
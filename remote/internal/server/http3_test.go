@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+)
+
+func TestHTTP3(t *testing.T) {
+	// A self-signed certificate for 127.0.0.1, in the files the config names
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	cfg := config.ServerConfig{
+		Host:        "127.0.0.1",
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		HTTP3:       config.HTTP3Config{Enabled: true, Port: port},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	h3, err := newHTTP3Server(cfg, handler, newTLSConfig("1.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h3.Serve(pc)
+	defer h3.Close()
+
+	roots := x509.NewCertPool()
+	cert, _ := x509.ParseCertificate(der)
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}, Timeout: 5 * time.Second}
+	resp, err := client.Get("https://127.0.0.1:" + strconv.Itoa(port) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/3.0" {
+		t.Errorf("served over %s", body)
+	}
+
+	// Responses over TCP announce the listener; those over HTTP/3 need not
+	tcp := httptest.NewServer(altSvc(h3, handler))
+	defer tcp.Close()
+	resp, err = http.Get(tcp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Header.Get("Alt-Svc"), `h3=":`+strconv.Itoa(port)+`"`; !strings.HasPrefix(got, want) {
+		t.Errorf("Alt-Svc %q, want %s...", got, want)
+	}
+
+	if _, err := newHTTP3Server(config.ServerConfig{HTTP3: config.HTTP3Config{Enabled: true}, TLSCertFile: filepath.Join(dir, "missing")}, handler, newTLSConfig("1.2")); err == nil {
+		t.Error("started without its certificate")
+	}
+	if h3, _ := newHTTP3Server(config.ServerConfig{}, handler, newTLSConfig("1.2")); h3 != nil {
+		t.Error("disabled listener created")
+	}
+}
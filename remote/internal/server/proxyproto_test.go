@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mahdi/dns-proxy-remote/internal/config"
+)
+
+func TestWrapProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		want    string
+	}{
+		{"trust all", nil, "203.0.113.7"},
+		{"trusted peer", []string{"127.0.0.0/8"}, "203.0.113.7"},
+		{"untrusted peer", []string{"192.0.2.0/24"}, "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := wrapProxyProtocol(raw, config.ProxyProtocolConfig{Enabled: true, TrustedNetworks: tt.trusted})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			go func() {
+				c, err := net.Dial("tcp", raw.Addr().String())
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				c.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 40000 443\r\nGET / HTTP/1.1\r\n\r\n"))
+				c.Read(make([]byte, 1))
+			}()
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			buf := make([]byte, 3)
+			if _, err := conn.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "GET" {
+				t.Errorf("payload = %q, want header stripped", buf)
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if host != tt.want {
+				t.Errorf("RemoteAddr = %s, want %s", host, tt.want)
+			}
+		})
+	}
+}
@@ -2,15 +2,28 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mahdi/dns-proxy-remote/internal/audit"
+	"github.com/mahdi/dns-proxy-remote/internal/cluster"
 	"github.com/mahdi/dns-proxy-remote/internal/config"
 	"github.com/mahdi/dns-proxy-remote/internal/crypto"
 	"github.com/mahdi/dns-proxy-remote/internal/handler"
@@ -22,94 +35,417 @@ import (
 type Server struct {
 	cfg        *config.Config
 	httpServer *http.Server
+	h3Server   *http3.Server // nil unless http3 is enabled
+	handler    *handler.Handler
 	resolver   *resolver.Resolver
-	logger     *log.Logger
+	tenants    []*resolver.Resolver // the tenants' resolvers
+	access     *middleware.AccessPolicy
+	cluster    *cluster.Registry // nil unless clustering is enabled
+	audit      *audit.Log        // nil unless auditing is enabled
+	certs      *certManager      // nil unless acme is enabled
+	draining   atomic.Bool       // shutting down; connections are closed after each response
+	logger     *slog.Logger
 }
 
 // New creates a new Server instance
-func New(cfg *config.Config) (*Server, error) {
-	logger := log.New(os.Stdout, "[DNS-API] ", log.LstdFlags|log.Lshortfile)
-
-	// Create resolver
-	res := resolver.New(resolver.Config{
-		Upstreams:     cfg.Resolver.Upstreams,
-		Timeout:       cfg.Resolver.Timeout,
-		MaxRetries:    cfg.Resolver.MaxRetries,
-		CacheEnabled:  cfg.Resolver.CacheEnabled,
-		CacheTTL:      cfg.Resolver.CacheTTL,
-		CacheMaxItems: cfg.Resolver.CacheMaxItems,
-	})
+func New(cfg *config.Config, logger *slog.Logger) (*Server, error) {
+	res, err := NewResolver(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create cipher if encryption is enabled
-	var cipher *crypto.Cipher
+	// Create the keyring if encryption is enabled
+	var keys *crypto.Keyring
 	if cfg.Security.EncryptionEnabled {
+		ids := make(map[string]string, len(cfg.Security.EncryptionKeys)+1)
+		if cfg.Security.EncryptionKey != "" {
+			ids[""] = cfg.Security.EncryptionKey
+		}
+		for _, k := range cfg.Security.EncryptionKeys {
+			ids[k.ID] = k.Key
+		}
 		var err error
-		cipher, err = crypto.NewCipher(cfg.Security.EncryptionKey)
+		keys, err = crypto.NewKeyring(ids, cfg.Security.CipherSuites...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create cipher: %w", err)
 		}
 	}
 
 	// Create handler
-	h := handler.NewHandler(res, cipher)
+	h := handler.NewHandler(res, nil, logger.With("component", "handler"))
+	if keys != nil {
+		h.EnableKeyring(keys)
+	}
+	if s := cfg.Security.Sessions; s.Enabled {
+		h.EnableSessions(s.TTL, s.MaxSessions, s.Required)
+	}
+	if cfg.Security.StrictJSON {
+		h.EnableStrictDecoding()
+	}
+	if cfg.Security.EncryptionEnabled && cfg.Security.PlaintextFallback {
+		h.EnablePlaintextFallback()
+	}
+	tenants, err := newTenants(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	var tenantResolvers []*resolver.Resolver
+	for i, t := range tenants {
+		h.EnableTenant(t, cfg.Tenants[i].APIKeys)
+		tenantResolvers = append(tenantResolvers, t.Resolver())
+	}
+	peers := cluster.New(cfg.Cluster, logger.With("component", "cluster"))
+	if peers != nil {
+		h.EnableCluster(peers)
+	}
+	auditLog, err := audit.New(cfg.Audit, logger.With("component", "audit"))
+	if err != nil {
+		return nil, err
+	}
+	if auditLog != nil {
+		h.EnableAudit(auditLog)
+	}
+	h.EnablePadding(crypto.Padding{
+		Mode:      cfg.Security.Padding.Mode,
+		BlockSize: cfg.Security.Padding.BlockSize,
+		MaxRandom: cfg.Security.Padding.MaxRandom,
+	})
 
 	// Create router
 	mux := http.NewServeMux()
 
 	// Public endpoints (no auth required)
 	mux.HandleFunc("/health", h.Health)
+	mux.HandleFunc("/api/v1/openapi.json", h.OpenAPI)
 
 	// Protected endpoints
 	protectedMux := http.NewServeMux()
 	protectedMux.HandleFunc("/api/v1/resolve", h.Resolve)
 	protectedMux.HandleFunc("/api/v1/data", h.Resolve) // Obfuscated endpoint
+	protectedMux.HandleFunc("/api/v1/session", h.Session)
+	protectedMux.HandleFunc("/api/v1/tamper", h.Tamper)
+	protectedMux.HandleFunc("/api/v1/peers", h.Peers)
+	protectedMux.HandleFunc("/api/v1/stats", h.Stats)
 
 	// Apply middleware chain
 	var protectedHandler http.Handler = protectedMux
 
-	// Rate limiting
-	if cfg.Security.RateLimitEnabled {
-		rateLimiter := middleware.NewRateLimiter(cfg.Security.RateLimitPerSec, cfg.Security.RateLimitBurst)
+	// Rate limiting, per key, per tenant or per token
+	rateLimiter := newRateLimiter(cfg)
+	if rateLimiter != nil {
 		protectedHandler = rateLimiter.Middleware(protectedHandler)
 	}
 
-	// API key authentication
-	auth := middleware.NewAPIKeyAuth(cfg.Security.APIKeys)
+	// Replay retried requests before they reach the rate limiter
+	idempotency := middleware.NewIdempotency(cfg.Security.IdempotencyTTL)
+	protectedHandler = idempotency.Middleware(protectedHandler)
+
+	// Check request signatures once the key is known
+	if cfg.Security.Signing.Enabled {
+		secrets := make(map[string]string, len(cfg.Security.Signing.Secrets))
+		for _, s := range cfg.Security.Signing.Secrets {
+			secrets[s.APIKey] = s.Secret
+		}
+		verifier := middleware.NewSignatureVerifier(secrets, cfg.Security.Signing.MaxSkew, logger.With("component", "signature"))
+		protectedHandler = verifier.Middleware(protectedHandler)
+	}
+
+	// Count requests per key once the key is known to be valid
+	usage := middleware.NewKeyUsage()
+	h.EnableKeyUsage(usage)
+	protectedHandler = usage.Middleware(protectedHandler)
+
+	// API key authentication, temporary tokens included
+	auth := middleware.NewAPIKeyAuth(cfg.AllAPIKeys())
+	if t := cfg.Security.Tokens; t.Enabled {
+		tokens := middleware.NewTokens(auth, rateLimiter, middleware.TokenLimits{
+			DefaultTTL:      t.DefaultTTL,
+			MaxTTL:          t.MaxTTL,
+			RateLimitPerSec: t.RateLimitPerSec,
+			RateLimitBurst:  t.RateLimitBurst,
+			MaxActive:       t.MaxActive,
+		})
+		h.EnableTokens(tokens)
+		protectedHandler = tokens.Middleware(protectedHandler)
+	}
 	protectedHandler = auth.Middleware(protectedHandler)
 
+	// Refuse clients outside the allowed networks and countries before
+	// they can try keys
+	access, err := middleware.NewAccessPolicy(middleware.AccessOptions{
+		AllowedNetworks:  cfg.Security.AllowedNetworks,
+		GeoIPDatabase:    cfg.Security.GeoIP.Database,
+		AllowedCountries: cfg.Security.GeoIP.AllowedCountries,
+		DeniedCountries:  cfg.Security.GeoIP.DeniedCountries,
+		Logger:           logger.With("component", "access"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	protectedHandler = access.Middleware(protectedHandler)
+
+	// Compress large responses, replayed ones included
+	if cfg.Server.Compression.Enabled {
+		protectedHandler = middleware.NewCompression(cfg.Server.Compression.MinSize).Middleware(protectedHandler)
+	}
+
 	// Add logging middleware
 	protectedHandler = loggingMiddleware(logger, protectedHandler)
 
 	// Mount protected routes
 	mux.Handle("/api/", protectedHandler)
 
+	// Administrative endpoints take their own keys
+	if len(cfg.Security.AdminKeys) > 0 {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/api/v1/admin/cache/flush", h.FlushCache)
+		adminMux.HandleFunc("/api/v1/admin/cache/ttl", h.CacheTTL)
+		adminMux.HandleFunc("/api/v1/admin/tokens", h.Tokens)
+		var adminHandler http.Handler = middleware.NewAPIKeyAuth(cfg.Security.AdminKeys).Middleware(adminMux)
+		adminHandler = access.Middleware(adminHandler)
+		adminHandler = loggingMiddleware(logger, adminHandler)
+		mux.Handle("/api/v1/admin/", adminHandler)
+	}
+
+	// Resolve the real client IP first so every layer sees it
+	realIP, err := middleware.NewRealIP(cfg.Security.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := newTLSConfig(cfg.Server.TLSMinVersion)
+	if cfg.Server.SessionTickets.Disabled {
+		tlsConfig.SessionTicketsDisabled = true
+	} else if cfg.Server.SessionTickets.KeyFile != "" {
+		keys, err := loadTicketKeys(cfg.Server.SessionTickets.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.SetSessionTicketKeys(keys)
+	}
+
+	var certs *certManager
+	if cfg.Server.ACME.Enabled {
+		if certs, err = newCertManager(cfg.Server.ACME, logger.With("component", "acme")); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = certs.GetCertificate
+		// Offered after the HTTP protocols, so only the CA's validation
+		// connections, which ask for nothing else, negotiate it
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+
 	// Create HTTP server
-	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-	httpServer := &http.Server{
+	addr := net.JoinHostPort(cfg.Server.Host, strconv.Itoa(cfg.Server.Port))
+	s := &Server{
+		cfg:      cfg,
+		handler:  h,
+		resolver: res,
+		tenants:  tenantResolvers,
+		access:   access,
+		cluster:  peers,
+		audit:    auditLog,
+		certs:    certs,
+		logger:   logger,
+	}
+	s.httpServer = &http.Server{
 		Addr:         addr,
-		Handler:      mux,
+		Handler:      s.drainMiddleware(realIP.Middleware(mux)),
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 		IdleTimeout:  cfg.Server.IdleTimeout,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			},
-		},
-	}
-
-	return &Server{
-		cfg:        cfg,
-		httpServer: httpServer,
-		resolver:   res,
-		logger:     logger,
-	}, nil
+		TLSConfig:    tlsConfig,
+		Protocols:    newProtocols(cfg.Server.H2C),
+	}
+	if s.h3Server, err = newHTTP3Server(cfg.Server, s.httpServer.Handler, tlsConfig); err != nil {
+		return nil, err
+	}
+	if s.h3Server != nil {
+		s.httpServer.Handler = altSvc(s.h3Server, s.httpServer.Handler)
+	}
+
+	return s, nil
+}
+
+// newTenants builds a resolver for each tenant: with the tenant's upstreams
+// when it has some, and always with a cache of its own, in Redis under a
+// key prefix of its own
+func newTenants(cfg *config.Config, logger *slog.Logger) ([]*handler.Tenant, error) {
+	var tenants []*handler.Tenant
+	for _, t := range cfg.Tenants {
+		tcfg := *cfg
+		if len(t.Upstreams) > 0 {
+			tcfg.Resolver.Upstreams = t.Upstreams
+		}
+		tcfg.Resolver.Redis.KeyPrefix = cfg.Resolver.Redis.KeyPrefix + "tenant:" + t.Name + ":"
+		res, err := NewResolver(&tcfg, logger.With("tenant", t.Name))
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		tenants = append(tenants, handler.NewTenant(t.Name, res, t.Blocklist))
+	}
+	return tenants, nil
+}
+
+// newRateLimiter returns the limiter of API requests, or nil if neither
+// the security settings, any tenant nor temporary tokens limit them. Keys
+// outside tenants with a limit are unlimited unless rate_limit_enabled is
+// set.
+func newRateLimiter(cfg *config.Config) *middleware.RateLimiter {
+	perSec, burst := cfg.Security.RateLimitPerSec, cfg.Security.RateLimitBurst
+	if !cfg.Security.RateLimitEnabled {
+		perSec = math.Inf(1)
+	}
+	var rl *middleware.RateLimiter
+	if cfg.Security.RateLimitEnabled || cfg.Security.Tokens.Enabled {
+		rl = middleware.NewRateLimiter(perSec, burst)
+	}
+	for _, t := range cfg.Tenants {
+		if t.RateLimitPerSec == 0 {
+			continue
+		}
+		if rl == nil {
+			rl = middleware.NewRateLimiter(perSec, burst)
+		}
+		rl.AddGroup(t.APIKeys, t.RateLimitPerSec, t.RateLimitBurst)
+	}
+	return rl
+}
+
+// zoneTTLs converts the per-zone cache TTL settings
+func zoneTTLs(zones []config.CacheZoneConfig) []resolver.ZoneTTL {
+	var out []resolver.ZoneTTL
+	for _, z := range zones {
+		out = append(out, resolver.ZoneTTL{Zone: z.Zone, MinTTL: z.MinTTL, MaxTTL: z.MaxTTL})
+	}
+	return out
+}
+
+// zoneTimeouts converts the per-zone upstream timeout settings
+func zoneTimeouts(zones []config.TimeoutZoneConfig) []resolver.ZoneTimeout {
+	var out []resolver.ZoneTimeout
+	for _, z := range zones {
+		out = append(out, resolver.ZoneTimeout{Zone: z.Zone, Timeout: z.Timeout})
+	}
+	return out
+}
+
+// tamperOptions converts the tamper detection settings, nil when disabled
+func tamperOptions(t config.TamperDetectionConfig) *resolver.TamperOptions {
+	if !t.Enabled {
+		return nil
+	}
+	return &resolver.TamperOptions{
+		SampleRate: t.SampleRate,
+		MinSamples: t.MinSamples,
+		Threshold:  t.Threshold,
+		MaxDomains: t.MaxDomains,
+	}
+}
+
+// healthOptions converts the upstream health check settings, nil when
+// disabled
+func healthOptions(h config.HealthCheckConfig) *resolver.HealthOptions {
+	if !h.Enabled {
+		return nil
+	}
+	return &resolver.HealthOptions{
+		Interval:         h.Interval,
+		ProbeDomain:      h.ProbeDomain,
+		FailureThreshold: h.FailureThreshold,
+		SuccessThreshold: h.SuccessThreshold,
+	}
+}
+
+// policy converts the resolver policy settings
+func policy(p config.PolicyConfig) resolver.Policy {
+	var types []resolver.RecordType
+	for _, t := range p.RefuseTypes {
+		types = append(types, resolver.RecordType(strings.ToUpper(t)))
+	}
+	return resolver.Policy{
+		RefuseTypes:       types,
+		LowercaseNames:    p.LowercaseNames,
+		QNameMinimization: p.QNameMinimization,
+	}
+}
+
+// NewResolver creates the resolver described by the configuration,
+// including the shared Redis cache and response policy zones when
+// configured. It fails when no upstream is reachable over the host's
+// address families or a policy zone cannot be loaded.
+func NewResolver(cfg *config.Config, logger *slog.Logger) (*resolver.Resolver, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	upstreams, err := resolver.PrepareUpstreams(ctx, cfg.Resolver.Upstreams, resolver.UpstreamOptions{
+		Family:      cfg.Resolver.AddressFamily,
+		NAT64Prefix: cfg.Resolver.NAT64Prefix,
+		Logger:      logger.With("component", "resolver"),
+	})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheBackend resolver.CacheBackend
+	if cfg.Resolver.CacheEnabled && cfg.Resolver.CacheBackend == "redis" {
+		redisCache := resolver.NewRedisCache(resolver.RedisOptions{
+			Addr:      cfg.Resolver.Redis.Addr,
+			Password:  cfg.Resolver.Redis.Password,
+			DB:        cfg.Resolver.Redis.DB,
+			KeyPrefix: cfg.Resolver.Redis.KeyPrefix,
+			Stale:     cfg.Resolver.StaleWindow,
+			Logger:    logger.With("component", "redis"),
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		if err := redisCache.Ping(ctx); err != nil {
+			// Keep serving; lookups fall through to the upstreams until Redis is back
+			logger.Warn("redis cache unreachable", "addr", cfg.Resolver.Redis.Addr, "error", err)
+		}
+		cancel()
+		cacheBackend = redisCache
+	}
+
+	var rpz *resolver.RPZ
+	if len(cfg.Resolver.RPZ.Zones) > 0 {
+		var zones []resolver.RPZZone
+		for _, z := range cfg.Resolver.RPZ.Zones {
+			zones = append(zones, resolver.RPZZone{Name: z.Name, File: z.File})
+		}
+		rpz, err = resolver.LoadRPZ(resolver.RPZOptions{
+			Zones:          zones,
+			ReloadInterval: cfg.Resolver.RPZ.ReloadInterval,
+			Logger:         logger.With("component", "rpz"),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resolver.New(resolver.Config{
+		Upstreams:     upstreams,
+		Timeout:       cfg.Resolver.Timeout,
+		ZoneTimeouts:  zoneTimeouts(cfg.Resolver.TimeoutZones),
+		MaxRetries:    cfg.Resolver.MaxRetries,
+		CacheEnabled:  cfg.Resolver.CacheEnabled,
+		CacheTTL:      cfg.Resolver.CacheTTL,
+		CacheMinTTL:   cfg.Resolver.CacheMinTTL,
+		CacheMaxTTL:   cfg.Resolver.CacheMaxTTL,
+		ZoneTTLs:      zoneTTLs(cfg.Resolver.CacheZones),
+		CacheMaxItems: cfg.Resolver.CacheMaxItems,
+		Cache:         cacheBackend,
+		StaleWindow:   cfg.Resolver.StaleWindow,
+		FilterBogons:  cfg.Resolver.BogonFilter.Enabled,
+		BogonAllow:    cfg.Resolver.BogonFilter.AllowDomains,
+		Strategy:      cfg.Resolver.Strategy,
+		RaceCount:     cfg.Resolver.RaceCount,
+		Quorum:        cfg.Resolver.Quorum,
+		Tamper:        tamperOptions(cfg.Resolver.TamperDetection),
+		Health:        healthOptions(cfg.Resolver.HealthCheck),
+		Policy:        policy(cfg.Resolver.Policy),
+		RootServers:   cfg.Resolver.RootServers,
+		RPZ:           rpz,
+		Logger:        logger.With("component", "resolver"),
+	}), nil
 }
 
 // Run starts the server and blocks until shutdown
@@ -118,33 +454,196 @@ func (s *Server) Run() error {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	// Start server
-	go func() {
-		s.logger.Printf("Starting HTTPS server on %s", s.httpServer.Addr)
-		var err error
-		if s.cfg.Server.TLSCertFile != "" && s.cfg.Server.TLSKeyFile != "" {
-			err = s.httpServer.ListenAndServeTLS(s.cfg.Server.TLSCertFile, s.cfg.Server.TLSKeyFile)
-		} else {
-			s.logger.Println("WARNING: Running without TLS (development mode only)")
-			err = s.httpServer.ListenAndServe()
+	tlsEnabled := s.certs != nil || (s.cfg.Server.TLSCertFile != "" && s.cfg.Server.TLSKeyFile != "")
+	if !tlsEnabled {
+		s.logger.Warn("running without TLS (development mode only)")
+	} else if s.cfg.Server.TLSMinVersion != "1.3" {
+		s.logger.Warn("TLS 1.2 clients are accepted; set tls_min_version: \"1.3\" to require TLS 1.3")
+	}
+
+	listeners, err := s.listen(tlsEnabled)
+	if err != nil {
+		return err
+	}
+	if s.h3Server != nil {
+		pc, err := net.ListenPacket("udp", s.h3Server.Addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return fmt.Errorf("failed to listen on %s/udp: %w", s.h3Server.Addr, err)
 		}
-		if err != nil && err != http.ErrServerClosed {
-			s.logger.Fatalf("Server error: %v", err)
+		// Serve leaves the socket open when the server shuts down
+		defer pc.Close()
+		go func() {
+			s.logger.Info("starting HTTP/3 server", "addr", pc.LocalAddr().String())
+			if err := s.h3Server.Serve(pc); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("http3 server error", "error", err)
+			}
+		}()
+	}
+
+	if s.certs != nil {
+		if s.cfg.Server.ACME.Challenge == "http-01" {
+			go func() {
+				s.logger.Info("starting ACME challenge server", "addr", s.cfg.Server.ACME.HTTPAddr)
+				if err := http.ListenAndServe(s.cfg.Server.ACME.HTTPAddr, s.certs.HTTPHandler()); err != nil {
+					s.logger.Error("acme challenge server error", "error", err)
+				}
+			}()
 		}
-	}()
+		go s.certs.Run()
+		defer s.certs.Close()
+	}
+
+	// Probe the upstreams of every resolver
+	for _, res := range append([]*resolver.Resolver{s.resolver}, s.tenants...) {
+		go res.Run()
+		defer res.Close()
+	}
+
+	if s.cluster != nil {
+		go s.cluster.Run()
+		defer s.cluster.Close()
+	}
+
+	s.audit.Record(audit.System, "", "server.start", "config:"+configDigest(s.cfg))
+	defer s.audit.Close()
+
+	// Start server on every listener
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			s.logger.Info("starting HTTPS server", "addr", ln.Addr().String(), "sniff", s.cfg.Server.Sniff.Enabled)
+			var err error
+			if tlsEnabled {
+				err = s.httpServer.ServeTLS(ln, s.cfg.Server.TLSCertFile, s.cfg.Server.TLSKeyFile)
+			} else {
+				err = s.httpServer.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				s.logger.Error("server error", "error", err)
+				os.Exit(1)
+			}
+		}(ln)
+	}
 
 	// Wait for shutdown signal
 	<-stop
-	s.logger.Println("Shutting down server...")
+	s.drain(stop)
+	s.logger.Info("shutting down server")
 
 	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Server.ShutdownTimeout)
 	defer cancel()
 
-	return s.httpServer.Shutdown(ctx)
+	defer s.access.Close()
+	err = s.httpServer.Shutdown(ctx)
+	if s.h3Server != nil {
+		if h3err := s.h3Server.Shutdown(ctx); err == nil {
+			err = h3err
+		}
+	}
+	s.audit.Record(audit.System, "", "server.stop", "")
+	return err
+}
+
+// configDigest fingerprints the effective configuration, so the audit log
+// shows when a server came back with different settings without holding
+// its secrets
+func configDigest(cfg *config.Config) string {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
 }
 
-func loggingMiddleware(logger *log.Logger, next http.Handler) http.Handler {
+// listen opens a listener for the main port and every extra port, wrapping
+// them in protocol sniffers when enabled
+func (s *Server) listen(tlsEnabled bool) ([]net.Listener, error) {
+	ports := append([]int{s.cfg.Server.Port}, s.cfg.Server.ExtraPorts...)
+
+	sniff := sniffConfig{
+		tlsEnabled:   tlsEnabled,
+		serverNames:  make(map[string]bool),
+		alpn:         make(map[string]bool),
+		fallbackAddr: s.cfg.Server.Sniff.FallbackAddr,
+	}
+	for _, name := range s.cfg.Server.Sniff.ServerNames {
+		sniff.serverNames[strings.ToLower(name)] = true
+	}
+	for _, proto := range s.cfg.Server.Sniff.ALPN {
+		sniff.alpn[proto] = true
+	}
+	if s.certs != nil && len(sniff.alpn) > 0 {
+		// Let the CA's tls-alpn-01 validation through
+		sniff.alpn[acme.ALPNProto] = true
+	}
+
+	var listeners []net.Listener
+	for _, port := range ports {
+		addr := net.JoinHostPort(s.cfg.Server.Host, strconv.Itoa(port))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		// The PROXY header precedes everything else, so it is parsed before sniffing
+		if ln, err = wrapProxyProtocol(ln, s.cfg.Server.ProxyProtocol); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if s.cfg.Server.Sniff.Enabled {
+			ln = newSniffListener(ln, sniff, s.logger.With("component", "sniff"))
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// newProtocols returns the HTTP versions served. HTTP/2 is negotiated by
+// ALPN over TLS; cleartext HTTP/2 is only accepted from clients that start
+// with the HTTP/2 preface, as a TLS-terminating proxy or a local client set
+// to http_version "2" does.
+func newProtocols(h2c bool) *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(h2c)
+	return p
+}
+
+// newTLSConfig returns the server TLS policy. With "1.3" only TLS 1.3 is
+// accepted, whose cipher suites are fixed (all AEAD) by crypto/tls; otherwise
+// TLS 1.2 is allowed with forward-secret AEAD suites only.
+func newTLSConfig(minVersion string) *tls.Config {
+	cfg := &tls.Config{
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+
+	if minVersion == "1.3" {
+		cfg.MinVersion = tls.VersionTLS13
+		return cfg
+	}
+
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}
+	return cfg
+}
+
+func loggingMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
@@ -153,12 +652,17 @@ func loggingMiddleware(logger *log.Logger, next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		logger.Printf("%s %s %d %s",
-			r.Method,
-			r.URL.Path,
-			wrapped.statusCode,
-			time.Since(start),
-		)
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"client", middleware.ClientIP(r),
+			"status", wrapped.statusCode,
+			"duration", time.Since(start),
+		}
+		if r.TLS != nil {
+			attrs = append(attrs, "tls", tls.VersionName(r.TLS.Version))
+		}
+		logger.Info("request", attrs...)
 	})
 }
 
@@ -171,3 +675,8 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the connection
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
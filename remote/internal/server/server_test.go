@@ -0,0 +1,49 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestH2C(t *testing.T) {
+	for _, h2c := range []bool{false, true} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto)
+			}),
+			Protocols: newProtocols(h2c),
+		}
+		go srv.Serve(ln)
+
+		// A client with prior knowledge skips HTTP/1.1 entirely
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+		resp, err := client.Get("http://" + ln.Addr().String() + "/")
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "HTTP/2.0" {
+				t.Errorf("h2c %v: served over %s", h2c, body)
+			}
+		}
+		if (err == nil) != h2c {
+			t.Errorf("h2c %v: request error %v", h2c, err)
+		}
+
+		// HTTP/1.1 keeps working either way
+		resp, err = http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil || resp.ProtoMajor != 1 {
+			t.Errorf("h2c %v: HTTP/1.1 request failed: %v", h2c, err)
+		} else {
+			resp.Body.Close()
+		}
+		srv.Close()
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sniffTimeout bounds how long a new connection may take to send its first bytes
+const sniffTimeout = 5 * time.Second
+
+// errSniffed aborts the probe handshake once the ClientHello has been read
+var errSniffed = errors.New("client hello captured")
+
+// sniffConfig decides which connections belong to the API
+type sniffConfig struct {
+	tlsEnabled   bool
+	serverNames  map[string]bool // empty accepts any SNI
+	alpn         map[string]bool // empty accepts any ALPN
+	fallbackAddr string          // where everything else is proxied; empty closes it
+}
+
+// sniffListener inspects the first bytes of every accepted connection and
+// hands API traffic to the HTTP server while proxying everything else
+// (another TLS site, plain HTTP, SSH, ...) to a fallback address, so the API
+// can share a scarce open port with other services.
+type sniffListener struct {
+	net.Listener
+	cfg    sniffConfig
+	logger *slog.Logger
+
+	conns     chan net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newSniffListener(ln net.Listener, cfg sniffConfig, logger *slog.Logger) *sniffListener {
+	sl := &sniffListener{
+		Listener: ln,
+		cfg:      cfg,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go sl.acceptLoop()
+	return sl
+}
+
+// Accept returns the next connection routed to the API
+func (sl *sniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sl.conns:
+		return conn, nil
+	case <-sl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener
+func (sl *sniffListener) Close() error {
+	var err error
+	sl.closeOnce.Do(func() {
+		close(sl.done)
+		err = sl.Listener.Close()
+	})
+	return err
+}
+
+func (sl *sniffListener) acceptLoop() {
+	for {
+		conn, err := sl.Listener.Accept()
+		if err != nil {
+			sl.Close()
+			return
+		}
+		go sl.route(conn)
+	}
+}
+
+func (sl *sniffListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	peeked, toAPI := sl.classify(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	pc := &peekedConn{Conn: conn, peeked: peeked}
+	if toAPI {
+		select {
+		case sl.conns <- pc:
+		case <-sl.done:
+			conn.Close()
+		}
+		return
+	}
+
+	if sl.cfg.fallbackAddr == "" {
+		conn.Close()
+		return
+	}
+	sl.proxy(pc)
+}
+
+// classify reads the start of the connection and reports whether it is API
+// traffic, returning the bytes consumed so they can be replayed.
+func (sl *sniffListener) classify(conn net.Conn) ([]byte, bool) {
+	rec := &recordingConn{Conn: conn}
+
+	var first [1]byte
+	if _, err := io.ReadFull(rec, first[:]); err != nil {
+		return rec.buf.Bytes(), false
+	}
+
+	isTLS := first[0] == 0x16 // TLS handshake record
+	if !isTLS {
+		// Plain HTTP only belongs to the API when the API itself runs without TLS
+		return rec.buf.Bytes(), !sl.cfg.tlsEnabled
+	}
+	if !sl.cfg.tlsEnabled {
+		return rec.buf.Bytes(), false
+	}
+
+	var hello *tls.ClientHelloInfo
+	probe := &peekedConn{Conn: rec, peeked: first[:]}
+	tls.Server(probe, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errSniffed
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return rec.buf.Bytes(), false
+	}
+	return rec.buf.Bytes(), sl.cfg.matches(hello)
+}
+
+func (c sniffConfig) matches(hello *tls.ClientHelloInfo) bool {
+	if len(c.serverNames) > 0 && !c.serverNames[strings.ToLower(hello.ServerName)] {
+		return false
+	}
+	if len(c.alpn) > 0 {
+		for _, proto := range hello.SupportedProtos {
+			if c.alpn[proto] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (sl *sniffListener) proxy(client net.Conn) {
+	defer client.Close()
+
+	backend, err := net.DialTimeout("tcp", sl.cfg.fallbackAddr, 5*time.Second)
+	if err != nil {
+		sl.logger.Warn("fallback dial failed", "addr", sl.cfg.fallbackAddr, "error", err)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// recordingConn captures everything read from the connection and refuses
+// writes, so a probe TLS handshake cannot answer the client
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return 0, errSniffed
+}
+
+// peekedConn replays the sniffed bytes before reading from the connection
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(p, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
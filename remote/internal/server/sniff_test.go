@@ -0,0 +1,108 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mahdi/dns-proxy-remote/internal/logging"
+)
+
+func TestSniffListenerRouting(t *testing.T) {
+	fallback, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer fallback.Close()
+
+	fallbackHits := make(chan []byte, 4)
+	go func() {
+		for {
+			conn, err := fallback.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1)
+				io.ReadFull(conn, buf)
+				fallbackHits <- buf
+			}(conn)
+		}
+	}()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	sl := newSniffListener(raw, sniffConfig{
+		tlsEnabled:   true,
+		serverNames:  map[string]bool{"api.test": true},
+		fallbackAddr: fallback.Addr().String(),
+	}, logging.Discard())
+	defer sl.Close()
+
+	dial := func(sni string) {
+		conn, err := tls.Dial("tcp", raw.Addr().String(), &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+		}
+	}
+
+	t.Run("api_sni", func(t *testing.T) {
+		go dial("api.test")
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := sl.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		select {
+		case conn := <-accepted:
+			first := make([]byte, 1)
+			io.ReadFull(conn, first)
+			if first[0] != 0x16 {
+				t.Errorf("Expected replayed TLS handshake byte, got %#x", first[0])
+			}
+			conn.Close()
+		case <-time.After(3 * time.Second):
+			t.Fatal("Expected API connection")
+		}
+	})
+
+	t.Run("other_sni", func(t *testing.T) {
+		go dial("www.other.test")
+
+		select {
+		case b := <-fallbackHits:
+			if b[0] != 0x16 {
+				t.Errorf("Expected TLS bytes at fallback, got %#x", b[0])
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Expected fallback connection")
+		}
+	})
+
+	t.Run("plain_http", func(t *testing.T) {
+		conn, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+		select {
+		case b := <-fallbackHits:
+			if b[0] != 'G' {
+				t.Errorf("Expected HTTP bytes at fallback, got %q", b)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Expected fallback connection")
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadTicketKeys reads TLS session ticket keys, one 32-byte hex key per
+// line. The first key encrypts new tickets; the rest still decrypt tickets
+// issued before a rotation. Sharing the file lets every instance behind a
+// load balancer resume sessions started on another.
+func loadTicketKeys(path string) ([][32]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session ticket keys: %w", err)
+	}
+	defer f.Close()
+
+	var keys [][32]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		raw, err := hex.DecodeString(text)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("session ticket key on line %d must be 64 hex characters", line)
+		}
+		var key [32]byte
+		copy(key[:], raw)
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read session ticket keys: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket keys in %s", path)
+	}
+	return keys, nil
+}